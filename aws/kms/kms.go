@@ -98,6 +98,39 @@ func (k *KMS) DecryptKey(key *security.ManagedKey) error {
 	return nil
 }
 
+// KeyVersion returns the ID of the master key that new keys are generated
+// under. Rotating the master key means configuring a new key ID; keys made
+// under the old one stay decryptable for as long as AWS keeps it enabled.
+func (k *KMS) KeyVersion() string { return k.keyID }
+
+func (k *KMS) RewrapKey(key *security.ManagedKey) (bool, error) {
+	if !key.Encrypted() {
+		return false, fmt.Errorf("aws kms: key must be encrypted")
+	}
+	ctx := map[string]*string{key.ContextKey: &key.ContextValue}
+	req := &kms.ReEncryptInput{
+		CiphertextBlob:               key.Ciphertext,
+		SourceEncryptionContext:      ctx,
+		DestinationKeyId:             &k.keyID,
+		DestinationEncryptionContext: ctx,
+	}
+	resp, err := k.kms.ReEncrypt(req)
+	if err != nil {
+		if apiErr, ok := err.(awserr.Error); ok && apiErr.Message() == "" {
+			err = fmt.Errorf("%s", apiErr.Code())
+		}
+		return false, fmt.Errorf("aws kms: error re-encrypting data key: %s", err)
+	}
+
+	// ReEncrypt always produces a fresh ciphertext, but if the source and
+	// destination keys are the same there's no point storing it.
+	if aws.StringValue(resp.SourceKeyId) == aws.StringValue(resp.KeyId) {
+		return false, nil
+	}
+	key.Ciphertext = resp.CiphertextBlob
+	return true, nil
+}
+
 type kmsCredential struct {
 	AccessKey string `json:"access_key"`
 	SecretKey string `json:"secret_key"`
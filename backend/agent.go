@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"euphoria.io/heim/proto"
@@ -101,6 +102,25 @@ func assignAgent(ctx scope.Context, s *Server, bot bool) (*proto.Agent, *http.Co
 	return agent, cookie, agentKey, nil
 }
 
+// readAgentCredentials decodes the agent cookie presented with a request.
+func readAgentCredentials(s *Server, r *http.Request) (*agentCredentials, error) {
+	cookie, err := r.Cookie(agentCookieName)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := []byte{}
+	if err := s.sc.Decode(agentCookieName, cookie.Value, &encoded); err != nil {
+		return nil, err
+	}
+
+	ac := &agentCredentials{}
+	if err := json.Unmarshal(encoded, ac); err != nil {
+		return nil, err
+	}
+	return ac, nil
+}
+
 func getAgent(
 	ctx scope.Context, s *Server, r *http.Request) (
 	*proto.Agent, *http.Cookie, *security.ManagedKey, error) {
@@ -110,27 +130,17 @@ func getAgent(
 	}
 	bot := r.Form.Get("h") != "1"
 
-	cookie, err := r.Cookie(agentCookieName)
+	ac, err := readAgentCredentials(s, r)
 	if err != nil {
 		return assignAgent(ctx, s, bot)
 	}
 
-	encoded := []byte{}
-	if err := s.sc.Decode(agentCookieName, cookie.Value, &encoded); err != nil {
-		return assignAgent(ctx, s, bot)
-	}
-
-	ac := agentCredentials{}
-	if err := json.Unmarshal(encoded, &ac); err != nil {
-		return assignAgent(ctx, s, bot)
-	}
-
 	agent, err := s.b.AgentTracker().Get(ctx, ac.ID)
 	if err != nil {
 		return assignAgent(ctx, s, bot)
 	}
 
-	cookie, err = ac.Cookie(s.sc)
+	cookie, err := ac.Cookie(s.sc)
 	if err != nil {
 		return nil, nil, nil, err
 	}
@@ -174,3 +184,12 @@ func getClient(ctx scope.Context, s *Server, r *http.Request) (*proto.Client, *h
 
 	return client, cookie, agentKey, nil
 }
+
+func bearerToken(r *http.Request) string {
+	const prefix = "bearer "
+	auth := r.Header.Get("Authorization")
+	if len(auth) <= len(prefix) || strings.ToLower(auth[:len(prefix)]) != prefix {
+		return ""
+	}
+	return strings.TrimSpace(auth[len(prefix):])
+}
@@ -0,0 +1,381 @@
+package backend
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/logging"
+	"euphoria.io/heim/proto/snowflake"
+	"euphoria.io/scope"
+
+	"github.com/gorilla/mux"
+	"github.com/juju/ratelimit"
+)
+
+const (
+	// DefaultAPILogSize is the number of messages returned by the messages
+	// endpoint when the request doesn't specify n.
+	DefaultAPILogSize = 100
+
+	// MaxAPILogSize bounds n for the messages endpoint, as it's bounded for
+	// the log command.
+	MaxAPILogSize = 1000
+
+	// MaxAPIThreadScan bounds how far back the thread endpoint looks for
+	// replies. Replies to threads older than this are cut off. Each page
+	// scanned past the first costs the client another request.
+	MaxAPIThreadScan = 10 * MaxAPILogSize
+
+	// Responses that may change as messages arrive are cached briefly.
+	// Pages of history before a given message change only if a message is
+	// edited or deleted, so they're cached for longer.
+	APILiveMaxAge    = 5 * time.Second
+	APIHistoryMaxAge = time.Minute
+
+	// maxAPILimiters bounds the number of client IPs whose request rate is
+	// tracked at once.
+	maxAPILimiters = 10000
+)
+
+// A ThreadReply is returned by the thread endpoint of the public API.
+type ThreadReply struct {
+	Message   proto.Message   `json:"message"`             // the root of the thread
+	Replies   []proto.Message `json:"replies"`             // descendants of the root, in the order they were sent
+	Truncated bool            `json:"truncated,omitempty"` // true if the thread is too old for all its replies to be found
+}
+
+// errAPIRateLimited is returned by a handler of the public API when the
+// client runs out of requests partway through.
+var errAPIRateLimited = errors.New("rate limited")
+
+// badAPIRequest describes a malformed request to the public API.
+type badAPIRequest string
+
+func (e badAPIRequest) Error() string { return string(e) }
+
+// apiRequest carries a request to the public API through to its response.
+type apiRequest struct {
+	ctx     scope.Context
+	room    proto.Room
+	client  *proto.Client
+	r       *http.Request
+	address string
+}
+
+// apiHandler adapts a handler of the public API to an http.HandlerFunc. The
+// returned handler limits the rate of requests from each client IP, and
+// resolves the room for the given command type before calling handle.
+func (s *Server) apiHandler(
+	cmdType proto.PacketType, handle func(*apiRequest) (interface{}, time.Duration, error)) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The API is meant to be embedded in other sites.
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		address := s.apiClientAddress(r)
+		if !s.takeAPIRequest(address) {
+			apiRateLimited(w)
+			return
+		}
+
+		req, ok := s.resolveAPIRequest(cmdType, w, r)
+		if !ok {
+			return
+		}
+		req.address = address
+
+		result, maxAge, err := handle(req)
+		if err != nil {
+			if msg, ok := err.(badAPIRequest); ok {
+				http.Error(w, "400 "+string(msg), http.StatusBadRequest)
+				return
+			}
+			switch err {
+			case proto.ErrAccessDenied:
+				http.Error(w, "403 forbidden", http.StatusForbidden)
+			case proto.ErrMessageNotFound:
+				http.Error(w, "404 message not found", http.StatusNotFound)
+			case errAPIRateLimited:
+				apiRateLimited(w)
+			default:
+				apiInternalError(req.ctx, w, err)
+			}
+			return
+		}
+
+		// Responses to credentialed requests mustn't be stored by shared
+		// caches.
+		cacheControl := "public"
+		if req.client.APIToken != nil {
+			cacheControl = "private"
+		}
+		w.Header().Set("Cache-Control", fmt.Sprintf("%s, max-age=%d", cacheControl, int(maxAge/time.Second)))
+		w.Header().Set("Vary", "Authorization")
+		serveJSON(req.ctx, w, r, result)
+	}
+}
+
+func apiRateLimited(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "429 too many requests", http.StatusTooManyRequests)
+}
+
+// apiInternalError logs an unexpected error, which isn't passed on to the
+// client.
+func apiInternalError(ctx scope.Context, w http.ResponseWriter, err error) {
+	logging.Logger(ctx).Printf("api error: %s", err)
+	http.Error(w, "500 internal server error", http.StatusInternalServerError)
+}
+
+// resolveAPIRequest authenticates a request to the public API and resolves
+// the room it names. Private rooms are served only to requests bearing a
+// credential with access to the room's current key.
+func (s *Server) resolveAPIRequest(cmdType proto.PacketType, w http.ResponseWriter, r *http.Request) (*apiRequest, bool) {
+	ctx := s.rootCtx.Fork()
+	client := &proto.Client{}
+	client.FromRequest(ctx, r)
+
+	if token := bearerToken(r); token != "" {
+		if err := client.AuthenticateWithAPIToken(ctx, s.b, token); err != nil {
+			switch err {
+			case proto.ErrAccessDenied:
+				http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			default:
+				apiInternalError(ctx, w, err)
+			}
+			return nil, false
+		}
+		if !client.APIToken.Scope.Allows(cmdType) {
+			http.Error(w, "403 forbidden", http.StatusForbidden)
+			return nil, false
+		}
+	}
+
+	// Unlike visiting a room, reading one through the API never creates it.
+	room, err := s.b.GetRoom(ctx, mux.Vars(r)["room"])
+	if err == nil {
+		err = client.RoomAuthorize(ctx, room)
+	}
+	if err != nil {
+		switch err {
+		case proto.ErrRoomNotFound:
+			http.Error(w, "404 room not found", http.StatusNotFound)
+		case proto.ErrAccessDenied:
+			http.Error(w, "403 forbidden", http.StatusForbidden)
+		default:
+			apiInternalError(ctx, w, err)
+		}
+		return nil, false
+	}
+
+	keyID, private, err := room.MessageKeyID(ctx)
+	if err != nil {
+		apiInternalError(ctx, w, err)
+		return nil, false
+	}
+	if private {
+		if _, ok := client.Authorization.MessageKeys[keyID]; !ok {
+			http.Error(w, "403 forbidden", http.StatusForbidden)
+			return nil, false
+		}
+	}
+
+	return &apiRequest{ctx: ctx, room: room, client: client, r: r}, true
+}
+
+// apiClientAddress returns the IP that a request to the public API is
+// counted against. This is the address of the peer, unless the peer is a
+// trusted proxy, in which case it's the address the proxy added last to
+// X-Forwarded-For. Earlier addresses in the header are supplied by the
+// client, so they're never trusted.
+func (s *Server) apiClientAddress(r *http.Request) string {
+	address := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		address = host
+	}
+
+	ffs := r.Header["X-Forwarded-For"]
+	if len(ffs) == 0 || !s.trustsProxy(net.ParseIP(address)) {
+		return address
+	}
+	hops := strings.Split(ffs[len(ffs)-1], ",")
+	if hop := strings.TrimSpace(hops[len(hops)-1]); hop != "" {
+		return hop
+	}
+	return address
+}
+
+// takeAPIRequest takes a request from the bucket of the client's IP,
+// returning false if the bucket is empty.
+func (s *Server) takeAPIRequest(clientAddress string) bool {
+	settings := s.Settings()
+
+	s.apiLimitersM.Lock()
+	defer s.apiLimitersM.Unlock()
+
+	bucket, ok := s.apiLimiters[clientAddress]
+	if !ok {
+		if s.apiLimiters == nil {
+			s.apiLimiters = map[string]*ratelimit.Bucket{}
+		}
+		if len(s.apiLimiters) >= maxAPILimiters {
+			// Forget clients whose buckets have refilled; they've been idle
+			// long enough that a fresh bucket is no more generous.
+			for addr, b := range s.apiLimiters {
+				if b.Available() >= b.Capacity() {
+					delete(s.apiLimiters, addr)
+				}
+			}
+		}
+		bucket = ratelimit.NewBucketWithQuantum(time.Second, settings.APIBurst, settings.APIRate)
+		s.apiLimiters[clientAddress] = bucket
+	}
+	return bucket.TakeAvailable(1) == 1
+}
+
+// serveJSON writes a value as JSON, tagged with an ETag so that clients can
+// revalidate their cached copies.
+func serveJSON(ctx scope.Context, w http.ResponseWriter, r *http.Request, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		apiInternalError(ctx, w, err)
+		return
+	}
+
+	sum := sha1.Sum(data)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// handleAPIMessages serves the messages of a room, most recent last. The
+// optional query parameters n and before select up to n messages sent before
+// the given message.
+func (s *Server) handleAPIMessages(req *apiRequest) (interface{}, time.Duration, error) {
+	query := req.r.URL.Query()
+
+	n := DefaultAPILogSize
+	if v := query.Get("n"); v != "" {
+		var err error
+		n, err = strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, 0, badAPIRequest("n must be a positive integer")
+		}
+		if n > MaxAPILogSize {
+			n = MaxAPILogSize
+		}
+	}
+
+	var before snowflake.Snowflake
+	maxAge := APILiveMaxAge
+	if v := query.Get("before"); v != "" {
+		if err := before.FromString(v); err != nil {
+			return nil, 0, badAPIRequest("before must be a message id")
+		}
+		maxAge = APIHistoryMaxAge
+	}
+
+	msgs, err := req.room.Latest(req.ctx, n, before)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i, msg := range msgs {
+		msgs[i] = req.decrypt(msg)
+	}
+	return &proto.LogReply{Log: msgs, Before: before}, maxAge, nil
+}
+
+// decrypt returns a message as it should be served to the client. As in a
+// session's snapshot, a message encrypted under a key the client doesn't
+// hold is left encrypted rather than failing the whole response.
+func (req *apiRequest) decrypt(msg proto.Message) proto.Message {
+	dmsg, err := proto.DecryptMessage(msg, req.client.Authorization.MessageKeys, proto.General)
+	if err != nil {
+		msg.Sender.ClientAddress = ""
+		return msg
+	}
+	return dmsg
+}
+
+// handleAPIThread serves a message and the replies beneath it.
+func (s *Server) handleAPIThread(req *apiRequest) (interface{}, time.Duration, error) {
+	var rootID snowflake.Snowflake
+	if err := rootID.FromString(mux.Vars(req.r)["id"]); err != nil {
+		return nil, 0, proto.ErrMessageNotFound
+	}
+
+	root, err := req.room.GetMessage(req.ctx, rootID)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !time.Time(root.Deleted).IsZero() {
+		return nil, 0, proto.ErrMessageNotFound
+	}
+
+	// Page backwards through the log until we pass the root, then walk
+	// forwards from it, collecting replies to messages already collected.
+	var (
+		pages     [][]proto.Message
+		before    snowflake.Snowflake
+		scanned   int
+		truncated = true
+	)
+	for scanned < MaxAPIThreadScan {
+		if scanned > 0 && !s.takeAPIRequest(req.address) {
+			return nil, 0, errAPIRateLimited
+		}
+		page, err := req.room.Latest(req.ctx, MaxAPILogSize, before)
+		if err != nil {
+			return nil, 0, err
+		}
+		pages = append(pages, page)
+		scanned += len(page)
+		if len(page) < MaxAPILogSize || !rootID.Before(page[0].ID) {
+			truncated = false
+			break
+		}
+		before = page[0].ID
+	}
+
+	thread := map[snowflake.Snowflake]bool{rootID: true}
+	reply := &ThreadReply{Replies: []proto.Message{}, Truncated: truncated}
+	for i := len(pages) - 1; i >= 0; i-- {
+		for _, msg := range pages[i] {
+			if rootID.Before(msg.ID) && thread[msg.Parent] {
+				thread[msg.ID] = true
+				reply.Replies = append(reply.Replies, msg)
+			}
+		}
+	}
+
+	reply.Message = req.decrypt(*root)
+	for i, msg := range reply.Replies {
+		reply.Replies[i] = req.decrypt(msg)
+	}
+	return reply, APILiveMaxAge, nil
+}
+
+// handleAPIWho serves the sessions present in a room.
+func (s *Server) handleAPIWho(req *apiRequest) (interface{}, time.Duration, error) {
+	listing, err := req.room.Listing(req.ctx, proto.General)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &proto.WhoReply{Listing: listing}, APILiveMaxAge, nil
+}
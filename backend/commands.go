@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"image/png"
+	"strings"
 	"time"
 
 	"golang.org/x/net/context"
@@ -15,6 +16,7 @@ import (
 	"euphoria.io/heim/proto/logging"
 	"euphoria.io/heim/proto/security"
 	"euphoria.io/heim/proto/snowflake"
+	"euphoria.io/scope"
 )
 
 const authDelay = 2 * time.Second
@@ -125,12 +127,28 @@ func (s *session) handleCoreCommands(payload interface{}) *response {
 		return &response{}
 
 	// account management commands
+	case *proto.CancelAccountDeletionCommand:
+		return s.handleCancelAccountDeletionCommand()
 	case *proto.ChangeEmailCommand:
 		return s.handleChangeEmailCommand(msg)
 	case *proto.ChangeNameCommand:
 		return s.handleChangeNameCommand(msg)
 	case *proto.ChangePasswordCommand:
 		return s.handleChangePasswordCommand(msg)
+	case *proto.CreateAPITokenCommand:
+		return s.handleCreateAPITokenCommand(msg)
+	case *proto.DeleteAccountCommand:
+		return s.handleDeleteAccountCommand(msg)
+	case *proto.DisableOTPCommand:
+		return s.handleDisableOTPCommand(msg)
+	case *proto.EnrollOTPCommand:
+		return s.handleEnrollOTPCommand(msg)
+	case *proto.ExportAccountDataCommand:
+		return s.handleExportAccountDataCommand(msg)
+	case *proto.ListAPITokensCommand:
+		return s.handleListAPITokensCommand()
+	case *proto.ListSessionsCommand:
+		return s.handleListSessionsCommand()
 	case *proto.LoginCommand:
 		return s.handleLoginCommand(msg)
 	case *proto.LogoutCommand:
@@ -141,6 +159,12 @@ func (s *session) handleCoreCommands(payload interface{}) *response {
 		return s.handleResendVerificationEmail(msg)
 	case *proto.ResetPasswordCommand:
 		return s.handleResetPasswordCommand(msg)
+	case *proto.RevokeAPITokenCommand:
+		return s.handleRevokeAPITokenCommand(msg)
+	case *proto.RevokeAgentCommand:
+		return s.handleRevokeAgentCommand(msg)
+	case *proto.ValidateOTPCommand:
+		return s.handleValidateOTPCommand(msg)
 
 	// room manager commands
 	case *proto.BanCommand:
@@ -157,6 +181,8 @@ func (s *session) handleCoreCommands(payload interface{}) *response {
 		return s.handleRevokeManagerCommand(msg)
 	case *proto.RevokeAccessCommand:
 		return s.handleRevokeAccessCommand(msg)
+	case *proto.RotateMessageKeyCommand:
+		return s.handleRotateMessageKeyCommand()
 
 	// staff commands
 	case *proto.StaffCreateRoomCommand:
@@ -308,7 +334,7 @@ func (s *session) handleRevokeAccessCommand(cmd *proto.RevokeAccessCommand) *res
 			return &response{err: err}
 		}
 	case cmd.Passcode != "":
-		if err := mkey.RevokeFromPasscode(s.ctx, cmd.Passcode); err != nil {
+		if err := proto.RevokePasscode(s.ctx, s.managedRoom, cmd.Passcode); err != nil {
 			return &response{err: err}
 		}
 	}
@@ -316,6 +342,48 @@ func (s *session) handleRevokeAccessCommand(cmd *proto.RevokeAccessCommand) *res
 	return &response{packet: &proto.RevokeAccessReply{}}
 }
 
+func (s *session) handleRotateMessageKeyCommand() *response {
+	mkp := s.client.Authorization.ManagerKeyPair
+	if s.managedRoom == nil || s.client.Account == nil || mkp == nil {
+		return &response{err: proto.ErrAccessDenied}
+	}
+
+	rmk, err := s.managedRoom.MessageKey(s.ctx)
+	if err != nil {
+		return &response{err: err}
+	}
+	if rmk == nil {
+		return &response{err: fmt.Errorf("room is public")}
+	}
+
+	if _, ok := s.client.Authorization.MessageKeys[rmk.KeyID()]; !ok {
+		return &response{err: fmt.Errorf("not holding message key")}
+	}
+
+	newKey, err := proto.RotateMessageKey(
+		s.ctx, s.kms, s.managedRoom, s.client.Account, s.client.Authorization.ClientKey)
+	if err != nil {
+		return &response{err: err}
+	}
+
+	// Switch this session over to the new key.
+	k := newKey.ManagedKey()
+	if err := s.kms.DecryptKey(&k); err != nil {
+		return &response{err: err}
+	}
+	s.client.Authorization.AddMessageKey(newKey.KeyID(), &k)
+	s.client.Authorization.CurrentMessageKeyID = newKey.KeyID()
+	s.keyID = newKey.KeyID()
+
+	// Every other session still holds the old key, so make them authenticate
+	// again. Those who lost access won't get back in.
+	if err := s.managedRoom.Disconnect(s.ctx, "message key rotated", s); err != nil {
+		return &response{err: err}
+	}
+
+	return &response{packet: &proto.RotateMessageKeyReply{KeyID: newKey.KeyID()}}
+}
+
 func (s *session) handleGrantManagerCommand(cmd *proto.GrantManagerCommand) *response {
 	mkp := s.client.Authorization.ManagerKeyPair
 	if s.managedRoom == nil || s.client.Account == nil || mkp == nil {
@@ -440,7 +508,7 @@ func (s *session) handleStaffRevokeAccessCommand(cmd *proto.StaffRevokeAccessCom
 			return &response{err: err}
 		}
 	case cmd.Passcode != "":
-		if err := mkey.RevokeFromPasscode(s.ctx, cmd.Passcode); err != nil {
+		if err := proto.RevokePasscode(s.ctx, s.managedRoom, cmd.Passcode); err != nil {
 			return &response{err: err}
 		}
 	}
@@ -486,6 +554,23 @@ func (s *session) handleLoginCommand(cmd *proto.LoginCommand) *response {
 		}
 	}
 
+	// Accounts with two-factor authentication enabled need a second factor.
+	required, err := secondFactorRequired(s.ctx, s.backend.AccountManager(), s.kms, account.ID())
+	if err != nil {
+		return &response{err: err}
+	}
+	if required {
+		if cmd.OTP == "" {
+			return &response{packet: &proto.LoginReply{Reason: "one-time password required", OTPRequired: true}}
+		}
+		if err := s.checkSecondFactor(account, clientKey, cmd.OTP); err != nil {
+			if err == proto.ErrAccessDenied || err == proto.ErrOTPLocked {
+				return &response{packet: &proto.LoginReply{Reason: err.Error(), OTPRequired: true}}
+			}
+			return &response{err: err}
+		}
+	}
+
 	err = s.backend.AgentTracker().SetClientKey(
 		s.ctx, s.client.Agent.IDString(), s.agentKey, account.ID(), clientKey)
 	if err != nil {
@@ -519,6 +604,9 @@ func (s *session) handleChangeEmailCommand(msg *proto.ChangeEmailCommand) *respo
 	if s.client.Account == nil {
 		return &response{err: proto.ErrNotLoggedIn}
 	}
+	if !s.client.Account.HasPassword() {
+		return &response{packet: &proto.ChangeEmailReply{Reason: proto.ErrNoPassword.Error()}}
+	}
 	if _, err := s.client.Account.Unlock(s.client.Account.KeyFromPassword(msg.Password)); err != nil {
 		if err == proto.ErrAccessDenied {
 			return &response{packet: &proto.ChangeEmailReply{Reason: err.Error()}}
@@ -583,9 +671,15 @@ func (s *session) handleChangePasswordCommand(msg *proto.ChangePasswordCommand)
 	oldClientKey := s.client.Account.KeyFromPassword(msg.OldPassword)
 	newClientKey := s.client.Account.KeyFromPassword(msg.NewPassword)
 
+	// An account registered through an external identity has no password to
+	// give, so set its first one with the key this session already holds.
+	if !s.client.Account.HasPassword() {
+		oldClientKey = s.client.Authorization.ClientKey
+	}
+
 	// Change password, invalidating all agents.
 	err := s.backend.AccountManager().ChangeClientKey(
-		s.ctx, s.client.Account.ID(), oldClientKey, newClientKey)
+		s.ctx, s.kms, s.client.Account.ID(), oldClientKey, newClientKey)
 	if err != nil {
 		return &response{err: err}
 	}
@@ -610,6 +704,59 @@ func (s *session) handleChangePasswordCommand(msg *proto.ChangePasswordCommand)
 	return &response{packet: &proto.ChangePasswordReply{}}
 }
 
+func (s *session) handleCreateAPITokenCommand(msg *proto.CreateAPITokenCommand) *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
+	}
+	if !msg.Scope.Valid() {
+		return &response{err: fmt.Errorf("invalid scope: %s", msg.Scope)}
+	}
+
+	lifetime := proto.APITokenDefaultLifetime
+	if msg.Lifetime != 0 {
+		lifetime = time.Duration(msg.Lifetime) * time.Second
+	}
+	if lifetime < 0 || lifetime > proto.APITokenMaxLifetime {
+		return &response{err: fmt.Errorf("lifetime must be between 1 and %d seconds", int64(proto.APITokenMaxLifetime/time.Second))}
+	}
+
+	token, secret, err := s.backend.AccountManager().CreateAPIToken(
+		s.ctx, s.client.Account.ID(), s.client.Authorization.ClientKey, msg.Name, msg.Scope, lifetime)
+	if err != nil {
+		return &response{err: err}
+	}
+
+	return &response{packet: &proto.CreateAPITokenReply{APITokenView: *token.View(), Token: secret}}
+}
+
+func (s *session) handleListAPITokensCommand() *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
+	}
+
+	tokens, err := s.backend.AccountManager().APITokens(s.ctx, s.client.Account.ID())
+	if err != nil {
+		return &response{err: err}
+	}
+
+	reply := &proto.ListAPITokensReply{Tokens: make([]proto.APITokenView, len(tokens))}
+	for i, token := range tokens {
+		reply.Tokens[i] = *token.View()
+	}
+	return &response{packet: reply}
+}
+
+func (s *session) handleRevokeAPITokenCommand(msg *proto.RevokeAPITokenCommand) *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
+	}
+
+	if err := s.backend.AccountManager().RevokeAPIToken(s.ctx, s.client.Account.ID(), msg.ID); err != nil {
+		return &response{err: err}
+	}
+	return &response{packet: &proto.RevokeAPITokenReply{}}
+}
+
 func (s *session) handleResetPasswordCommand(msg *proto.ResetPasswordCommand) *response {
 	acc, req, err := s.backend.AccountManager().RequestPasswordReset(s.ctx, s.kms, msg.Namespace, msg.ID)
 	if err != nil {
@@ -630,7 +777,7 @@ func (s *session) handleRegisterAccountCommand(cmd *proto.RegisterAccountCommand
 	}
 
 	// Agent must be of sufficient age.
-	if time.Now().Sub(s.client.Agent.Created) < s.server.newAccountMinAgentAge {
+	if time.Now().Sub(s.client.Agent.Created) < s.server.Settings().NewAccountMinAgentAge {
 		return &response{packet: &proto.RegisterAccountReply{Reason: "not familiar yet, try again later"}}
 	}
 
@@ -705,7 +852,7 @@ func (s *session) handleAuthCommand(msg *proto.AuthCommand) *response {
 		if s.managedRoom == nil {
 			failureReason = fmt.Sprintf("auth type not supported: %s", msg.Type)
 		} else {
-			failureReason, err = s.client.AuthenticateWithPasscode(s.ctx, s.managedRoom, msg.Passcode)
+			failureReason, err = s.client.AuthenticateWithPasscode(s.ctx, s.kms, s.managedRoom, msg.Passcode)
 		}
 	default:
 		failureReason = fmt.Sprintf("auth type not supported: %s", msg.Type)
@@ -743,23 +890,19 @@ func (s *session) handleStaffEnrollOTPCommand(cmd *proto.StaffEnrollOTPCommand)
 	}
 
 	// TODO: use staff's kms
-	otp, err := s.backend.AccountManager().GenerateOTP(s.ctx, s.heim, s.kms, s.client.Account)
+	otp, err := s.backend.AccountManager().GenerateOTP(s.ctx, s.heim, s.kms, s.client.Account, proto.OTPForStaff)
 	if err != nil {
 		return failure(err)
 	}
 
-	img, err := otp.QRImage(200, 200)
+	qrImage, err := otpQRImageURI(otp)
 	if err != nil {
 		return failure(err)
 	}
-	encodedImg := &bytes.Buffer{}
-	if err := png.Encode(encodedImg, img); err != nil {
-		return failure(err)
-	}
 
 	reply := &proto.StaffEnrollOTPReply{
 		URI:     otp.URI,
-		QRImage: fmt.Sprintf("data:image/png;base64,%s", base64.StdEncoding.EncodeToString(encodedImg.Bytes())),
+		QRImage: qrImage,
 	}
 	return &response{packet: reply}
 }
@@ -772,13 +915,327 @@ func (s *session) handleStaffValidateOTPCommand(cmd *proto.StaffValidateOTPComma
 	}
 
 	// TODO: use staff's kms
-	if err := s.backend.AccountManager().ValidateOTP(s.ctx, s.kms, s.client.Account.ID(), cmd.Password); err != nil {
+	err := s.backend.AccountManager().ValidateOTP(
+		s.ctx, s.kms, s.client.Account.ID(), proto.OTPForStaff, cmd.Password)
+	if err != nil {
 		return failure(err)
 	}
 
 	return &response{packet: &proto.StaffValidateOTPReply{}}
 }
 
+func (s *session) handleExportAccountDataCommand(cmd *proto.ExportAccountDataCommand) *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
+	}
+
+	account := s.client.Account
+	if !account.HasPassword() {
+		return &response{err: proto.ErrNoPassword}
+	}
+	if _, err := account.Unlock(account.KeyFromPassword(cmd.Password)); err != nil {
+		return &response{err: err}
+	}
+
+	x := newAccountExport(account.ID())
+	exportURL, err := x.URL(s.server.sc)
+	if err != nil {
+		return &response{err: err}
+	}
+
+	return &response{packet: &proto.ExportAccountDataReply{URL: exportURL, Expires: proto.Time(x.Expires)}}
+}
+
+func (s *session) handleDeleteAccountCommand(cmd *proto.DeleteAccountCommand) *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
+	}
+
+	account := s.client.Account
+	if !account.HasPassword() {
+		return &response{err: proto.ErrNoPassword}
+	}
+	clientKey := account.KeyFromPassword(cmd.Password)
+	if _, err := account.Unlock(clientKey); err != nil {
+		return &response{err: err}
+	}
+
+	otp, err := s.accountOTP(account.ID())
+	if err != nil {
+		return &response{err: err}
+	}
+	if otp != nil && otp.Validated {
+		if cmd.OTP == "" {
+			return &response{err: fmt.Errorf("one-time password required")}
+		}
+		if err := s.checkSecondFactor(account, clientKey, cmd.OTP); err != nil {
+			return &response{err: err}
+		}
+	}
+
+	req, err := proto.ScheduleAccountDeletion(s.ctx, s.backend, account.ID())
+	if err != nil {
+		return &response{err: err}
+	}
+
+	return &response{packet: &proto.DeleteAccountReply{Due: proto.Time(req.Due)}}
+}
+
+func (s *session) handleCancelAccountDeletionCommand() *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
+	}
+
+	if err := proto.CancelAccountDeletion(s.ctx, s.backend, s.client.Account.ID()); err != nil {
+		return &response{err: err}
+	}
+
+	return &response{packet: &proto.CancelAccountDeletionReply{}}
+}
+
+func (s *session) handleListSessionsCommand() *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
+	}
+
+	agents, err := s.backend.AgentTracker().AccountAgents(s.ctx, s.client.Account.ID())
+	if err != nil {
+		return &response{err: err}
+	}
+
+	locations := map[string]string{}
+	reply := &proto.ListSessionsReply{Sessions: make([]proto.AgentView, len(agents))}
+	for i, agent := range agents {
+		view := agent.View()
+		view.Current = agent.AgentID == s.AgentID()
+		if agent.IP != "" {
+			location, ok := locations[agent.IP]
+			if !ok {
+				location = s.approximateLocation(agent.IP)
+				locations[agent.IP] = location
+			}
+			view.Location = location
+		}
+		reply.Sessions[i] = *view
+	}
+	return &response{packet: reply}
+}
+
+func (s *session) handleRevokeAgentCommand(cmd *proto.RevokeAgentCommand) *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
+	}
+
+	if cmd.AgentID == s.AgentID() {
+		return &response{err: fmt.Errorf("cannot revoke current agent, use logout instead")}
+	}
+
+	agent, err := s.backend.AgentTracker().Get(s.ctx, cmd.AgentID)
+	if err != nil {
+		return &response{err: err}
+	}
+	if agent.AccountID != s.client.Account.ID().String() {
+		return &response{err: proto.ErrAgentNotFound}
+	}
+
+	if err := s.backend.AgentTracker().ClearClientKey(s.ctx, cmd.AgentID); err != nil {
+		return &response{err: err}
+	}
+
+	// Live sessions still hold the account in memory, so disconnect them too.
+	userID := proto.UserID("agent:" + cmd.AgentID)
+	if err := s.backend.NotifyUser(s.ctx, userID, proto.LogoutEventType, proto.LogoutEvent{}); err != nil {
+		return &response{err: err}
+	}
+	disconnect := &proto.DisconnectEvent{Reason: "authentication changed"}
+	if err := s.backend.NotifyUser(s.ctx, userID, proto.DisconnectEventType, disconnect); err != nil {
+		return &response{err: err}
+	}
+
+	return &response{packet: &proto.RevokeAgentReply{}}
+}
+
+// approximateLocation describes where an address is, for display to the
+// account holder. An empty string is returned if the address can't be
+// located.
+func (s *session) approximateLocation(ip string) string {
+	if s.heim.GeoIP == nil {
+		return ""
+	}
+
+	// geoip uses google's context package
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := s.heim.GeoIP.City(ctx, ip)
+	if err != nil {
+		logging.Logger(s.ctx).Printf("geoip lookup error for %s: %s", ip, err)
+		return ""
+	}
+
+	parts := []string{}
+	if name := resp.City.Names["en"]; name != "" {
+		parts = append(parts, name)
+	}
+	if len(resp.Subdivisions) > 0 {
+		if name := resp.Subdivisions[0].Names["en"]; name != "" {
+			parts = append(parts, name)
+		}
+	}
+	if name := resp.Country.Names["en"]; name != "" {
+		parts = append(parts, name)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (s *session) handleEnrollOTPCommand(cmd *proto.EnrollOTPCommand) *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
+	}
+
+	otp, err := s.backend.AccountManager().GenerateOTP(s.ctx, s.heim, s.kms, s.client.Account, proto.OTPForLogin)
+	if err != nil {
+		return &response{err: err}
+	}
+
+	qrImage, err := otpQRImageURI(otp)
+	if err != nil {
+		return &response{err: err}
+	}
+
+	reply := &proto.EnrollOTPReply{
+		URI:     otp.URI,
+		QRImage: qrImage,
+	}
+	return &response{packet: reply}
+}
+
+func (s *session) handleValidateOTPCommand(cmd *proto.ValidateOTPCommand) *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
+	}
+
+	otp, err := s.accountOTP(s.client.Account.ID())
+	if err != nil {
+		return &response{err: err}
+	}
+	if otp == nil {
+		return &response{err: proto.ErrOTPNotEnrolled}
+	}
+	enabling := !otp.Validated
+
+	err = s.backend.AccountManager().ValidateOTP(s.ctx, s.kms, s.client.Account.ID(), proto.OTPForLogin, cmd.Password)
+	if err != nil {
+		return &response{err: err}
+	}
+
+	if !enabling {
+		return &response{packet: &proto.ValidateOTPReply{}}
+	}
+
+	codes, err := s.backend.AccountManager().GenerateOTPRecoveryCodes(
+		s.ctx, s.client.Account, s.client.Authorization.ClientKey)
+	if err != nil {
+		return &response{err: err}
+	}
+
+	if err := s.heim.OnAccountOTPChanged(s.ctx, s.backend, s.client.Account, true); err != nil {
+		logging.Logger(s.ctx).Printf("error sending otp-changed email to %s: %s", s.client.Account.ID(), err)
+	}
+
+	return &response{packet: &proto.ValidateOTPReply{RecoveryCodes: codes}}
+}
+
+func (s *session) handleDisableOTPCommand(cmd *proto.DisableOTPCommand) *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
+	}
+
+	account := s.client.Account
+	if !account.HasPassword() {
+		return &response{err: proto.ErrNoPassword}
+	}
+	clientKey := account.KeyFromPassword(cmd.Password)
+	if _, err := account.Unlock(clientKey); err != nil {
+		return &response{err: err}
+	}
+
+	otp, err := s.accountOTP(account.ID())
+	if err != nil {
+		return &response{err: err}
+	}
+	if otp == nil || !otp.Validated {
+		return &response{err: proto.ErrOTPNotEnrolled}
+	}
+
+	if err := s.checkSecondFactor(account, clientKey, cmd.OTP); err != nil {
+		return &response{err: err}
+	}
+
+	if err := s.backend.AccountManager().DisableOTP(s.ctx, account.ID(), proto.OTPForLogin); err != nil {
+		return &response{err: err}
+	}
+
+	if err := s.heim.OnAccountOTPChanged(s.ctx, s.backend, account, false); err != nil {
+		logging.Logger(s.ctx).Printf("error sending otp-changed email to %s: %s", account.ID(), err)
+	}
+
+	return &response{packet: &proto.DisableOTPReply{}}
+}
+
+// accountOTP returns the account's login OTP, or nil if it has never enrolled.
+func (s *session) accountOTP(accountID snowflake.Snowflake) (*proto.OTP, error) {
+	otp, err := s.backend.AccountManager().OTP(s.ctx, s.kms, accountID, proto.OTPForLogin)
+	if err == proto.ErrOTPNotEnrolled {
+		return nil, nil
+	}
+	return otp, err
+}
+
+func (s *session) checkSecondFactor(account proto.Account, clientKey *security.ManagedKey, password string) error {
+	return checkSecondFactor(s.ctx, s.backend.AccountManager(), s.kms, account, clientKey, password)
+}
+
+// checkSecondFactor accepts either a current one-time password or one of the
+// account's unused recovery codes, consuming the latter. Either way a wrong
+// guess counts once towards locking out the account's second factor.
+func checkSecondFactor(
+	ctx scope.Context, am proto.AccountManager, kms security.KMS, account proto.Account,
+	clientKey *security.ManagedKey, password string) error {
+
+	if proto.IsOTPRecoveryCode(password) {
+		return am.UseOTPRecoveryCode(ctx, account, clientKey, password)
+	}
+	return am.ValidateOTP(ctx, kms, account.ID(), proto.OTPForLogin, password)
+}
+
+// secondFactorRequired returns true if the account has validated a login OTP key,
+// so that logging in needs a one-time password as well.
+func secondFactorRequired(
+	ctx scope.Context, am proto.AccountManager, kms security.KMS, accountID snowflake.Snowflake) (bool, error) {
+
+	otp, err := am.OTP(ctx, kms, accountID, proto.OTPForLogin)
+	switch err {
+	case nil:
+		return otp != nil && otp.Validated, nil
+	case proto.ErrOTPNotEnrolled:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func otpQRImageURI(otp *proto.OTP) (string, error) {
+	img, err := otp.QRImage(200, 200)
+	if err != nil {
+		return "", err
+	}
+	encodedImg := &bytes.Buffer{}
+	if err := png.Encode(encodedImg, img); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("data:image/png;base64,%s", base64.StdEncoding.EncodeToString(encodedImg.Bytes())), nil
+}
+
 func (s *session) handleStaffInspectIPCommand(cmd *proto.StaffInspectIPCommand) *response {
 	if s.privilegeLevel() != proto.Staff {
 		return &response{err: proto.ErrAccessDenied}
@@ -820,7 +1277,9 @@ func (s *session) handleStaffInvadeCommand(cmd *proto.StaffInvadeCommand) *respo
 	}
 
 	// TODO: use staff's kms
-	if err := s.backend.AccountManager().ValidateOTP(s.ctx, s.kms, s.client.Account.ID(), cmd.Password); err != nil {
+	err := s.backend.AccountManager().ValidateOTP(
+		s.ctx, s.kms, s.client.Account.ID(), proto.OTPForStaff, cmd.Password)
+	if err != nil {
 		return failure(err)
 	}
 
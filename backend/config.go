@@ -9,6 +9,7 @@ import (
 	"net/smtp"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"strconv"
 	"time"
@@ -20,10 +21,13 @@ import (
 	"euphoria.io/heim/aws/kms"
 	"euphoria.io/heim/cluster"
 	"euphoria.io/heim/cluster/etcd"
+	"euphoria.io/heim/cluster/static"
+	"euphoria.io/heim/oidc"
 	"euphoria.io/heim/proto"
 	"euphoria.io/heim/proto/emails"
 	"euphoria.io/heim/proto/security"
 	"euphoria.io/heim/templates"
+	"euphoria.io/heim/vault/transit"
 	"euphoria.io/scope"
 )
 
@@ -33,6 +37,8 @@ var (
 	}
 
 	backendFactories = map[string]proto.BackendFactory{}
+
+	validOIDCProviderName = regexp.MustCompile("^[a-z0-9]+$")
 )
 
 func init() {
@@ -66,11 +72,17 @@ func init() {
 		"name of the AWS region to use for crypto")
 	flag.StringVar(&Config.KMS.Amazon.KeyID, "kms-aws-key-id", env("HEIM_KMS_AWS_KEY_ID", ""),
 		"id of the AWS key to use for crypto")
+	flag.StringVar(&Config.KMS.Vault.Address, "kms-vault-addr", env("HEIM_KMS_VAULT_ADDR", ""),
+		"address of the Vault server to use for crypto")
+	flag.StringVar(&Config.KMS.Vault.KeyName, "kms-vault-key-name", env("HEIM_KMS_VAULT_KEY_NAME", ""),
+		"name of the Vault transit key to use for crypto")
 	flag.StringVar(&Config.KMS.AES256.KeyFile, "kms-local-key-file", env("HEIM_KMS_LOCAL_KEY", ""),
 		"path to file containing a 256-bit key for using local key-management instead of AWS")
 
 	flag.BoolVar(&Config.AllowRoomCreation, "allow-room-creation", true, "allow rooms to be created")
 	flag.BoolVar(&Config.SetInsecureCookies, "set-insecure-cookies", false, "allow non-https cookies")
+	flag.Var(&Config.TrustedProxies, "trusted-proxies",
+		"comma-separated addresses or CIDR networks of reverse proxies whose X-Forwarded-For headers are trusted")
 
 	flag.StringVar(&Config.Email.Server, "smtp-server", "", "address of SMTP server to send mail through")
 	flag.StringVar(&Config.Email.AuthMethod, "smtp-auth-method", "",
@@ -103,6 +115,7 @@ type ServerConfig struct {
 	NewAccountMinAgentAge time.Duration `yaml:"new_account_min_agent_age"`
 	RoomEntryMinAgentAge  time.Duration `yaml:"room_entry_min_agent_age"`
 	SetInsecureCookies    bool          `yaml:"set_insecure_cookies"`
+	TrustedProxies        CSV           `yaml:"trusted_proxies,omitempty"`
 
 	StaticPath string `yaml:"static_path"`
 
@@ -112,6 +125,7 @@ type ServerConfig struct {
 	KMS     KMSConfig      `yaml:"kms"`
 	Email   EmailConfig    `yaml:"email"`
 	GeoIP   GeoIPConfig    `yaml:"geoip"`
+	OIDC    OIDCConfig     `yaml:"oidc,omitempty"`
 }
 
 func (cfg *ServerConfig) String() string {
@@ -122,6 +136,37 @@ func (cfg *ServerConfig) String() string {
 	return string(data)
 }
 
+// TrustedProxyNetworks parses TrustedProxies. A bare address names a
+// network of just that address.
+func (cfg *ServerConfig) TrustedProxyNetworks() ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, addr := range cfg.TrustedProxies {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		if !strings.Contains(addr, "/") {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted proxy %s: invalid address", addr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %s: %s", addr, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
 func (cfg *ServerConfig) LoadFromEtcd(c cluster.Cluster) error {
 	cfgString, err := c.GetValue("config")
 	if err != nil {
@@ -161,13 +206,12 @@ func (cfg *ServerConfig) Heim(ctx scope.Context) (*proto.Heim, error) {
 		return nil, fmt.Errorf("page templates: %s", err)
 	}
 
-	// Load and verify page templates.
-	c, err := cfg.Cluster.EtcdCluster(ctx)
+	kms, err := cfg.KMS.Get()
 	if err != nil {
 		return nil, err
 	}
 
-	kms, err := cfg.KMS.Get()
+	c, err := cfg.Cluster.Get(ctx, kms)
 	if err != nil {
 		return nil, err
 	}
@@ -227,6 +271,19 @@ type ClusterConfig struct {
 	Version  string `yaml:"-"`
 	EtcdHost string `yaml:"etcd-host,omitempty"`
 	EtcdHome string `yaml:"etcd,omitempty"`
+
+	// Static configures a cluster without etcd. If given, the etcd
+	// settings are ignored.
+	Static *static.Config `yaml:"static,omitempty"`
+}
+
+// Get joins the configured cluster. The KMS is used to decrypt the secrets of
+// a static cluster.
+func (c *ClusterConfig) Get(ctx scope.Context, kms security.KMS) (cluster.Cluster, error) {
+	if c.Static != nil {
+		return static.New(ctx, c.Static, kms, c.DescribeSelf())
+	}
+	return c.EtcdCluster(ctx)
 }
 
 func (c *ClusterConfig) EtcdCluster(ctx scope.Context) (cluster.Cluster, error) {
@@ -264,12 +321,19 @@ type DatabaseConfig struct {
 type KMSConfig struct {
 	AES256 struct {
 		KeyFile string `yaml:"key-file"`
+
+		// RotatedKeyFiles lists the master keys that have replaced KeyFile,
+		// oldest first. The last one is used for new keys; the others are kept
+		// only to decrypt keys that haven't been rewrapped yet.
+		RotatedKeyFiles []string `yaml:"rotated-key-files,omitempty"`
 	} `yaml:"aes256,omitempty"`
 
 	Amazon struct {
 		Region string `yaml:"region"`
 		KeyID  string `yaml:"key-id"`
 	} `yaml:"amazon,omitempty"`
+
+	Vault transit.Config `yaml:"vault,omitempty"`
 }
 
 func (kc *KMSConfig) Get() (security.KMS, error) {
@@ -286,13 +350,31 @@ func (kc *KMSConfig) Get() (security.KMS, error) {
 			return nil, fmt.Errorf("kms: amazon: %s", err)
 		}
 		return kms, nil
+	case kc.Vault.Address != "" || kc.Vault.KeyName != "":
+		kms, err := transit.New(kc.Vault)
+		if err != nil {
+			return nil, fmt.Errorf("kms: %s", err)
+		}
+		return kms, nil
 	default:
 		return nil, fmt.Errorf("kms: not configured")
 	}
 }
 
 func (kc *KMSConfig) local() (security.KMS, error) {
-	f, err := os.Open(kc.AES256.KeyFile)
+	kms := security.LocalKMS()
+	for _, path := range append([]string{kc.AES256.KeyFile}, kc.AES256.RotatedKeyFiles...) {
+		masterKey, err := readMasterKey(path)
+		if err != nil {
+			return nil, err
+		}
+		kms.RotateMasterKey(masterKey)
+	}
+	return kms, nil
+}
+
+func readMasterKey(path string) ([]byte, error) {
+	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
@@ -304,17 +386,10 @@ func (kc *KMSConfig) local() (security.KMS, error) {
 		return nil, err
 	}
 	if fi.Size() != int64(keySize) {
-		return nil, fmt.Errorf("key must be exactly %d bytes in size", keySize)
-	}
-
-	masterKey, err := ioutil.ReadAll(f)
-	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%s: key must be exactly %d bytes in size", path, keySize)
 	}
 
-	kms := security.LocalKMS()
-	kms.SetMasterKey(masterKey)
-	return kms, nil
+	return ioutil.ReadAll(f)
 }
 
 func (kc *KMSConfig) amazon() (security.KMS, error) {
@@ -327,6 +402,43 @@ func (kc *KMSConfig) amazon() (security.KMS, error) {
 	return kms.New(kc.Amazon.Region, kc.Amazon.KeyID)
 }
 
+// OIDCConfig maps provider names, as they appear in login URLs, to OpenID
+// Connect provider registrations.
+type OIDCConfig map[string]OIDCProviderConfig
+
+type OIDCProviderConfig struct {
+	Issuer       string   `yaml:"issuer"`
+	ClientID     string   `yaml:"client-id"`
+	ClientSecret string   `yaml:"client-secret"`
+	RedirectURL  string   `yaml:"redirect-url"` // must point at /oidc/<name>/callback
+	Scopes       []string `yaml:"scopes,omitempty,flow"`
+}
+
+func (oc OIDCConfig) Get() (map[string]*oidc.Provider, error) {
+	providers := map[string]*oidc.Provider{}
+	for name, pc := range oc {
+		if !validOIDCProviderName.MatchString(name) {
+			return nil, fmt.Errorf("oidc: %s: provider name must be lowercase alphanumeric", name)
+		}
+		switch {
+		case pc.Issuer == "":
+			return nil, fmt.Errorf("oidc: %s: issuer must be specified", name)
+		case pc.ClientID == "":
+			return nil, fmt.Errorf("oidc: %s: client-id must be specified", name)
+		case pc.RedirectURL == "":
+			return nil, fmt.Errorf("oidc: %s: redirect-url must be specified", name)
+		}
+		providers[name] = oidc.NewProvider(oidc.Config{
+			Issuer:       pc.Issuer,
+			ClientID:     pc.ClientID,
+			ClientSecret: pc.ClientSecret,
+			RedirectURL:  pc.RedirectURL,
+			Scopes:       pc.Scopes,
+		})
+	}
+	return providers, nil
+}
+
 type EmailConfig struct {
 	Server     string `yaml:"server"`
 	AuthMethod string `yaml:"auth_method"` // must be "", "CRAM-MD5", or "PLAIN"
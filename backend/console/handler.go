@@ -7,6 +7,7 @@ import (
 	"io"
 	"strings"
 
+	"euphoria.io/heim/cluster"
 	"euphoria.io/heim/proto"
 	"euphoria.io/heim/proto/security"
 	"euphoria.io/heim/proto/snowflake"
@@ -23,6 +24,7 @@ func cmdConsole(ctrl *Controller, cmd string, term ioterm) *console {
 	c := &console{
 		backend: ctrl.backend,
 		kms:     ctrl.kms,
+		cluster: ctrl.cluster,
 		ioterm:  term,
 		FlagSet: flag.NewFlagSet(cmd, flag.ContinueOnError),
 	}
@@ -36,6 +38,7 @@ type console struct {
 
 	backend proto.Backend
 	kms     security.KMS
+	cluster cluster.Cluster
 }
 
 // Implement Session and Identity.
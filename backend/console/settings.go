@@ -0,0 +1,65 @@
+package console
+
+import (
+	"bytes"
+	"fmt"
+	"text/tabwriter"
+
+	"euphoria.io/heim/backend"
+	"euphoria.io/scope"
+)
+
+func init() {
+	register("settings", settings{})
+}
+
+type settings struct{}
+
+func (settings) usage() string {
+	return ("usage: settings\n" +
+		"       settings set NAME VALUE\n" +
+		"       settings reset NAME")
+}
+
+func (settings) run(ctx scope.Context, c *console, args []string) error {
+	if len(args) == 0 {
+		overrides, err := backend.SettingOverrides(c.cluster)
+		if err != nil {
+			return err
+		}
+
+		// The console's writer translates newlines, so buffer the table.
+		buf := &bytes.Buffer{}
+		w := tabwriter.NewWriter(buf, 0, 8, 2, ' ', 0)
+		c.Printf("Overrides of server settings, applied by every server:\n\n")
+		for _, name := range backend.SettingNames() {
+			value := overrides[name]
+			if value == "" {
+				value = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", name, value, backend.DescribeSetting(name))
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		c.Print(buf.String())
+		return nil
+	}
+
+	switch {
+	case args[0] == "set" && len(args) == 3:
+		if err := backend.OverrideSetting(c.cluster, args[1], args[2]); err != nil {
+			return err
+		}
+		c.Printf("%s overridden to %s\n", args[1], args[2])
+		return nil
+	case args[0] == "reset" && len(args) == 2:
+		if err := backend.ResetSetting(c.cluster, args[1]); err != nil {
+			return err
+		}
+		c.Printf("%s reset to configured value\n", args[1])
+		return nil
+	default:
+		return usageError("invalid arguments")
+	}
+}
@@ -0,0 +1,61 @@
+package console
+
+import (
+	"testing"
+
+	"euphoria.io/heim/backend"
+	"euphoria.io/heim/cluster"
+	"euphoria.io/scope"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSettings(t *testing.T) {
+	ctx := scope.New()
+
+	Convey("Overrides are listed, set, and reset", t, func() {
+		c := &cluster.TestCluster{}
+		ctrl := &Controller{cluster: c}
+
+		term := &testTerm{}
+		runCommand(ctx, ctrl, "settings", term, []string{"set", "allow-room-creation", "false"})
+		So(term.String(), ShouldEqual, "allow-room-creation overridden to false\r\n")
+		overrides, err := backend.SettingOverrides(c)
+		So(err, ShouldBeNil)
+		So(overrides, ShouldResemble, map[string]string{"allow-room-creation": "false"})
+
+		term = &testTerm{}
+		runCommand(ctx, ctrl, "settings", term, nil)
+		So(term.String(), ShouldContainSubstring, "false  whether visiting a nonexistent room creates it\r\n")
+		So(term.String(), ShouldContainSubstring, "-      command credits earned by a connection per second\r\n")
+
+		term = &testTerm{}
+		runCommand(ctx, ctrl, "settings", term, []string{"reset", "allow-room-creation"})
+		So(term.String(), ShouldEqual, "allow-room-creation reset to configured value\r\n")
+		overrides, err = backend.SettingOverrides(c)
+		So(err, ShouldBeNil)
+		So(overrides, ShouldBeEmpty)
+	})
+
+	Convey("Invalid values aren't stored", t, func() {
+		c := &cluster.TestCluster{}
+		ctrl := &Controller{cluster: c}
+
+		term := &testTerm{}
+		runCommand(ctx, ctrl, "settings", term, []string{"set", "flood-rate", "lots"})
+		So(term.String(), ShouldStartWith, "error: flood-rate: ")
+		overrides, err := backend.SettingOverrides(c)
+		So(err, ShouldBeNil)
+		So(overrides, ShouldBeEmpty)
+
+		term = &testTerm{}
+		runCommand(ctx, ctrl, "settings", term, []string{"set", "email-site-url", "ftp://example.com"})
+		So(term.String(), ShouldStartWith, "error: email-site-url: ")
+		term = &testTerm{}
+		runCommand(ctx, ctrl, "settings", term, []string{"set", "email-help-address", "Help <help@example.com>"})
+		So(term.String(), ShouldStartWith, "error: email-help-address: ")
+		overrides, err = backend.SettingOverrides(c)
+		So(err, ShouldBeNil)
+		So(overrides, ShouldBeEmpty)
+	})
+}
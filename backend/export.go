@@ -0,0 +1,63 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/snowflake"
+
+	"github.com/gorilla/securecookie"
+)
+
+const (
+	accountExportTokenName = "x"
+	accountExportPath      = "/prefs/export"
+)
+
+// An accountExport authorizes the download of an account's data archive
+// without a live session. It's handed to the client signed, in a URL.
+type accountExport struct {
+	AccountID snowflake.Snowflake `json:"a"`
+	Expires   time.Time           `json:"e"`
+}
+
+func newAccountExport(accountID snowflake.Snowflake) *accountExport {
+	return &accountExport{
+		AccountID: accountID,
+		Expires:   time.Now().Add(proto.AccountDataExportLifetime),
+	}
+}
+
+func (x *accountExport) URL(sc *securecookie.SecureCookie) (string, error) {
+	encoded, err := json.Marshal(x)
+	if err != nil {
+		return "", err
+	}
+
+	token, err := sc.Encode(accountExportTokenName, encoded)
+	if err != nil {
+		return "", err
+	}
+
+	return accountExportPath + "?" + url.Values{"token": {token}}.Encode(), nil
+}
+
+func getAccountExport(sc *securecookie.SecureCookie, token string) (*accountExport, error) {
+	encoded := []byte{}
+	if err := sc.Decode(accountExportTokenName, token, &encoded); err != nil {
+		return nil, err
+	}
+
+	x := &accountExport{}
+	if err := json.Unmarshal(encoded, x); err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(x.Expires) {
+		return nil, fmt.Errorf("export link expired")
+	}
+	return x, nil
+}
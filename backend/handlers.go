@@ -1,11 +1,15 @@
 package backend
 
 import (
+	"bytes"
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	"encoding/hex"
 	"encoding/json"
@@ -27,6 +31,7 @@ func (s *Server) route() {
 	s.r.Use(func(handler http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Security-Policy", "default-src 'self'; font-src 'self' data: fonts.gstatic.com; img-src 'self' data:; script-src 'self'; style-src 'self' 'unsafe-inline' fonts.googleapis.com; connect-src 'self' wss://euphoria.io; frame-src 'self' embed.space")
+			handler.ServeHTTP(w, r)
 		})
 	})
 
@@ -44,6 +49,21 @@ func (s *Server) route() {
 		prometheus.InstrumentHandler("about", http.HandlerFunc(s.handleAboutStatic)))
 
 	s.r.HandleFunc("/room/{prefix:(?:pm:)?}{room:[a-z0-9]+}/ws", instrumentSocketHandlerFunc("ws", s.handleRoom))
+	s.r.Handle(
+		"/room/{prefix:(?:pm:)?}{room:[a-z0-9]+}/sse",
+		prometheus.InstrumentHandlerFunc("sse", s.handleRoomSSE)).Methods("GET")
+	s.r.Handle(
+		"/room/{prefix:(?:pm:)?}{room:[a-z0-9]+}/sse/{stream:[0-9a-f]+}",
+		prometheus.InstrumentHandlerFunc("sse_command", s.handleRoomSSECommand)).Methods("POST")
+	s.r.Handle(
+		"/api/room/{room:[a-z0-9]+}/messages",
+		prometheus.InstrumentHandlerFunc("api_messages", s.apiHandler(proto.LogType, s.handleAPIMessages))).Methods("GET")
+	s.r.Handle(
+		"/api/room/{room:[a-z0-9]+}/thread/{id:[0-9a-z]+}",
+		prometheus.InstrumentHandlerFunc("api_thread", s.apiHandler(proto.GetMessageType, s.handleAPIThread))).Methods("GET")
+	s.r.Handle(
+		"/api/room/{room:[a-z0-9]+}/who",
+		prometheus.InstrumentHandlerFunc("api_who", s.apiHandler(proto.WhoType, s.handleAPIWho))).Methods("GET")
 	s.r.Handle(
 		"/room/{prefix:(?:pm:)?}{room:[a-z0-9]+}/", prometheus.InstrumentHandlerFunc("room_static", s.handleRoomStatic))
 
@@ -52,6 +72,16 @@ func (s *Server) route() {
 		prometheus.InstrumentHandlerFunc("prefsResetPassword", s.handlePrefsResetPassword))
 	s.r.Handle(
 		"/prefs/verify", prometheus.InstrumentHandlerFunc("prefsVerify", s.handlePrefsVerify))
+	s.r.Handle(
+		accountExportPath, prometheus.InstrumentHandlerFunc("prefsExport", s.handlePrefsExport))
+
+	s.r.Handle(
+		"/oidc/{provider:[a-z0-9]+}/login", prometheus.InstrumentHandlerFunc("oidcLogin", s.handleOIDCLogin))
+	s.r.Handle(
+		"/oidc/{provider:[a-z0-9]+}/callback",
+		prometheus.InstrumentHandlerFunc("oidcCallback", s.handleOIDCCallback))
+	s.r.Handle(
+		"/oidc/{provider:[a-z0-9]+}/otp", prometheus.InstrumentHandlerFunc("oidcOTP", s.handleOIDCOTP))
 }
 
 func (s *Server) handleProbe(w http.ResponseWriter, r *http.Request) {
@@ -93,7 +123,7 @@ func (s *Server) handleRoomStatic(w http.ResponseWriter, r *http.Request) {
 	room, err := s.resolveRoom(ctx, prefix, roomName, client)
 	if err != nil {
 		if err == proto.ErrRoomNotFound {
-			if !s.allowRoomCreation || prefix != "" {
+			if !s.Settings().AllowRoomCreation || prefix != "" {
 				s.serveErrorPage("room not found", http.StatusNotFound, w, r)
 				return
 			}
@@ -146,7 +176,7 @@ func (s *Server) resolveRoom(ctx scope.Context, prefix, roomName string, client
 		return room, nil
 	case "":
 		room, err = s.b.GetRoom(ctx, roomName)
-		if s.allowRoomCreation && err == proto.ErrRoomNotFound {
+		if s.Settings().AllowRoomCreation && err == proto.ErrRoomNotFound {
 			room, err = s.b.CreateRoom(ctx, s.kms, false, roomName)
 		}
 		if err != nil {
@@ -162,7 +192,22 @@ func (s *Server) resolveRoom(ctx scope.Context, prefix, roomName string, client
 }
 
 func (s *Server) handleRoom(w http.ResponseWriter, r *http.Request) {
-	ctx := s.rootCtx.Fork()
+	ctx, room, cookie, client, agentKey, ok := s.resolveRoomRequest(w, r)
+	if !ok {
+		return
+	}
+
+	// Serve the room websocket.
+	s.serveRoomWebsocket(ctx, room, cookie, client, agentKey, w, r)
+}
+
+// resolveRoomRequest identifies the client and resolves the room it's
+// connecting to. If this fails, an error is written to w and ok is false.
+func (s *Server) resolveRoomRequest(w http.ResponseWriter, r *http.Request) (
+	ctx scope.Context, room proto.Room, cookie *http.Cookie, client *proto.Client,
+	agentKey *security.ManagedKey, ok bool) {
+
+	ctx = s.rootCtx.Fork()
 
 	client, cookie, agentKey, err := getClient(ctx, s, r)
 	if err != nil {
@@ -170,10 +215,23 @@ func (s *Server) handleRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Headless clients may present an API token in place of a logged-in agent.
+	if token := bearerToken(r); token != "" {
+		if err := client.AuthenticateWithAPIToken(ctx, s.b, token); err != nil {
+			switch err {
+			case proto.ErrAccessDenied:
+				http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+	}
+
 	// Resolve the room.
 	prefix := mux.Vars(r)["prefix"]
 	roomName := mux.Vars(r)["room"]
-	room, err := s.resolveRoom(ctx, prefix, roomName, client)
+	room, err = s.resolveRoom(ctx, prefix, roomName, client)
 	if err != nil {
 		switch err {
 		case proto.ErrAccessDenied:
@@ -188,8 +246,7 @@ func (s *Server) handleRoom(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Serve the room websocket.
-	s.serveRoomWebsocket(ctx, room, cookie, client, agentKey, w, r)
+	return ctx, room, cookie, client, agentKey, true
 }
 
 func (s *Server) serveRoomWebsocket(
@@ -197,6 +254,12 @@ func (s *Server) serveRoomWebsocket(
 	cookie *http.Cookie, client *proto.Client, agentKey *security.ManagedKey,
 	w http.ResponseWriter, r *http.Request) {
 
+	snapshotOpts, err := parseSnapshotOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Upgrade to a websocket and set cookie.
 	headers := http.Header{}
 	if cookie != nil {
@@ -210,10 +273,18 @@ func (s *Server) serveRoomWebsocket(
 	}
 	defer conn.Close()
 
+	s.serveSession(ctx, newWebsocketTransport(conn), room, client, agentKey, snapshotOpts, r)
+}
+
+// serveSession runs a session over the given transport until it ends.
+func (s *Server) serveSession(
+	ctx scope.Context, t transport, room proto.Room, client *proto.Client, agentKey *security.ManagedKey,
+	snapshotOpts proto.SnapshotOptions, r *http.Request) {
+
 	// Determine client address.
 	clientAddress := r.Header.Get("X-Forwarded-For")
 	if clientAddress == "" {
-		addr := conn.RemoteAddr()
+		addr := t.RemoteAddr()
 		switch a := addr.(type) {
 		case *net.TCPAddr:
 			clientAddress = a.IP.String()
@@ -223,14 +294,65 @@ func (s *Server) serveRoomWebsocket(
 	}
 
 	// Serve the session.
-	session := newSession(ctx, s, conn, clientAddress, room, client, agentKey)
-	if err = session.serve(); err != nil {
+	session := newSession(ctx, s, t, clientAddress, room, client, agentKey)
+	session.snapshotOpts = snapshotOpts
+	if features, ok := r.URL.Query()["features"]; ok {
+		session.features = proto.ParseFeatures(strings.Split(strings.Join(features, ","), ","))
+	}
+	if err := session.serve(); err != nil {
 		// TODO: error handling
 		logging.Logger(ctx).Printf("session serve error: %s", err)
 		return
 	}
 }
 
+// parseSnapshotOptions reads the query parameters a client may give to reduce
+// the snapshot it receives on joining a room:
+//
+//	log=N          include only the N most recent messages
+//	listing=N      list at most N sessions
+//	listing=counts list no sessions, only counts
+//	snapshot=0     shorthand for log=0&listing=counts
+func parseSnapshotOptions(query url.Values) (proto.SnapshotOptions, error) {
+	opts := proto.DefaultSnapshotOptions()
+
+	if v := query.Get("snapshot"); v != "" {
+		if v != "0" {
+			return opts, fmt.Errorf("invalid snapshot: %s", v)
+		}
+		opts.NumMessages = 0
+		opts.CountsOnly = true
+	}
+
+	if v := query.Get("log"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return opts, fmt.Errorf("invalid log: %s", v)
+		}
+		if n < opts.NumMessages {
+			opts.NumMessages = n
+		}
+	}
+
+	if v := query.Get("listing"); v != "" {
+		if v == "counts" {
+			opts.CountsOnly = true
+		} else {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return opts, fmt.Errorf("invalid listing: %s", v)
+			}
+			if n == 0 {
+				opts.CountsOnly = true
+			} else {
+				opts.MaxListing = n
+			}
+		}
+	}
+
+	return opts, nil
+}
+
 func (s *Server) handlePrefsVerify(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
 		s.serveErrorPage("bad request", http.StatusBadRequest, w, r)
@@ -386,3 +508,351 @@ func (s *Server) handlePrefsResetPasswordPost(w http.ResponseWriter, r *http.Req
 		reply(nil, http.StatusOK)
 	}
 }
+
+func (s *Server) handlePrefsExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		s.serveErrorPage("invalid method", http.StatusMethodNotAllowed, w, r)
+		return
+	}
+
+	x, err := getAccountExport(s.sc, r.URL.Query().Get("token"))
+	if err != nil {
+		s.serveErrorPage("invalid/expired export link", http.StatusForbidden, w, r)
+		return
+	}
+
+	ctx := s.rootCtx.Fork()
+	account, err := s.b.AccountManager().Get(ctx, x.AccountID)
+	if err != nil {
+		if err == proto.ErrAccountNotFound {
+			s.serveErrorPage("account not found", http.StatusNotFound, w, r)
+			return
+		}
+		s.serveErrorPage(err.Error(), http.StatusInternalServerError, w, r)
+		return
+	}
+
+	// Build the archive before writing anything, so that failures can still
+	// be reported with an error page.
+	buf := &bytes.Buffer{}
+	if err := proto.WriteAccountDataArchive(ctx, buf, s.b, account); err != nil {
+		logging.Logger(ctx).Printf("account %s export error: %s", account.ID(), err)
+		s.serveErrorPage("export failed", http.StatusInternalServerError, w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set(
+		"Content-Disposition", fmt.Sprintf(`attachment; filename="heim-account-%s.zip"`, account.ID()))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(buf.Bytes())
+}
+
+func (s *Server) handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	ctx := s.rootCtx.Fork()
+
+	name := mux.Vars(r)["provider"]
+	provider, ok := s.oidcProvider(name)
+	if !ok {
+		s.serveErrorPage("page not found", http.StatusNotFound, w, r)
+		return
+	}
+
+	// Make sure the visitor has a (human) agent to sign in.
+	if err := r.ParseForm(); err != nil {
+		s.serveErrorPage("bad request", http.StatusBadRequest, w, r)
+		return
+	}
+	r.Form.Set("h", "1")
+	_, agentCookie, _, err := getClient(ctx, s, r)
+	if err != nil {
+		s.serveErrorPage(err.Error(), http.StatusInternalServerError, w, r)
+		return
+	}
+	if agentCookie != nil {
+		w.Header().Add("Set-Cookie", agentCookie.String())
+	}
+
+	login, err := newOIDCLogin(name, r.Form.Get("next"))
+	if err != nil {
+		s.serveErrorPage(err.Error(), http.StatusInternalServerError, w, r)
+		return
+	}
+
+	authURL, err := provider.AuthCodeURL(login.State, login.Nonce)
+	if err != nil {
+		logging.Logger(ctx).Printf("oidc %s: %s", name, err)
+		s.serveErrorPage("identity provider unavailable", http.StatusBadGateway, w, r)
+		return
+	}
+
+	loginCookie, err := login.Cookie(s.sc)
+	if err != nil {
+		s.serveErrorPage(err.Error(), http.StatusInternalServerError, w, r)
+		return
+	}
+	w.Header().Add("Set-Cookie", loginCookie.String())
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+func (s *Server) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	ctx := s.rootCtx.Fork()
+
+	name := mux.Vars(r)["provider"]
+	provider, ok := s.oidcProvider(name)
+	if !ok {
+		s.serveErrorPage("page not found", http.StatusNotFound, w, r)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		s.serveErrorPage("bad request", http.StatusBadRequest, w, r)
+		return
+	}
+
+	// The login cookie is single-use.
+	login, err := getOIDCLogin(s.sc, r)
+	w.Header().Add("Set-Cookie", clearOIDCLoginCookie().String())
+	if err != nil || login.Provider != name || login.State != r.Form.Get("state") {
+		s.serveErrorPage("login expired, please try again", http.StatusBadRequest, w, r)
+		return
+	}
+
+	if reason := r.Form.Get("error"); reason != "" {
+		s.serveErrorPage(fmt.Sprintf("sign-in failed: %s", reason), http.StatusForbidden, w, r)
+		return
+	}
+
+	claims, err := provider.Exchange(r.Form.Get("code"), login.Nonce)
+	if err != nil {
+		logging.Logger(ctx).Printf("oidc %s: %s", name, err)
+		s.serveErrorPage("sign-in failed", http.StatusForbidden, w, r)
+		return
+	}
+
+	r.Form.Set("h", "1")
+	client, agentCookie, agentKey, err := getClient(ctx, s, r)
+	if err != nil {
+		s.serveErrorPage(err.Error(), http.StatusInternalServerError, w, r)
+		return
+	}
+	if agentCookie != nil {
+		w.Header().Add("Set-Cookie", agentCookie.String())
+	}
+
+	namespace := oidcNamespace(claims.Issuer)
+	account, clientKey, status, err := s.resolveOIDCAccount(ctx, client, agentKey, namespace, claims.Subject)
+	if err != nil {
+		if status == http.StatusInternalServerError {
+			logging.Logger(ctx).Printf("oidc %s: %s", name, err)
+		}
+		s.serveErrorPage(err.Error(), status, w, r)
+		return
+	}
+
+	// As with a password, signing in to an account with two-factor
+	// authentication enabled needs a one-time password too. Linking an
+	// identity to an account that's already logged in doesn't.
+	if client.Account == nil {
+		required, err := secondFactorRequired(ctx, s.b.AccountManager(), s.kms, account.ID())
+		if err != nil {
+			s.serveErrorPage(err.Error(), http.StatusInternalServerError, w, r)
+			return
+		}
+		if required {
+			pending := newOIDCSecondFactor(login, namespace, claims.Subject, account.ID().String())
+			cookie, err := pending.Cookie(s.sc)
+			if err != nil {
+				s.serveErrorPage(err.Error(), http.StatusInternalServerError, w, r)
+				return
+			}
+			w.Header().Add("Set-Cookie", cookie.String())
+			http.Redirect(w, r, fmt.Sprintf("/oidc/%s/otp", name), http.StatusFound)
+			return
+		}
+	}
+
+	if err := s.completeOIDCLogin(ctx, client, agentKey, account, clientKey); err != nil {
+		s.serveErrorPage(err.Error(), http.StatusInternalServerError, w, r)
+		return
+	}
+
+	http.Redirect(w, r, login.Next, http.StatusFound)
+}
+
+// handleOIDCOTP takes the one-time password for a sign-in held back by
+// handleOIDCCallback.
+func (s *Server) handleOIDCOTP(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["provider"]
+	if _, ok := s.oidcProvider(name); !ok {
+		s.serveErrorPage("page not found", http.StatusNotFound, w, r)
+		return
+	}
+
+	pending, err := getOIDCSecondFactor(s.sc, r)
+	if err != nil || pending.Provider != name {
+		s.serveErrorPage("sign-in expired, please try again", http.StatusBadRequest, w, r)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		s.serveJSONPage(OIDCOTPPage, map[string]interface{}{"provider": name, "next": pending.Next}, w, r)
+	case "POST":
+		s.handleOIDCOTPPost(w, r, pending)
+	default:
+		s.serveErrorPage("invalid method", http.StatusMethodNotAllowed, w, r)
+	}
+}
+
+func (s *Server) handleOIDCOTPPost(w http.ResponseWriter, r *http.Request, pending *oidcSecondFactor) {
+	reply := func(err error, status int) {
+		data := struct {
+			Error string `json:"error,omitempty"`
+		}{}
+		if err != nil {
+			data.Error = err.Error()
+		}
+		w.WriteHeader(status)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(data)
+	}
+
+	var req struct {
+		OTP string `json:"otp"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		reply(err, http.StatusBadRequest)
+		return
+	}
+	if req.OTP == "" {
+		reply(fmt.Errorf("missing parameters"), http.StatusBadRequest)
+		return
+	}
+
+	ctx := s.rootCtx.Fork()
+	if err := r.ParseForm(); err != nil {
+		reply(err, http.StatusBadRequest)
+		return
+	}
+	r.Form.Set("h", "1")
+	client, agentCookie, agentKey, err := getClient(ctx, s, r)
+	if err != nil {
+		reply(err, http.StatusInternalServerError)
+		return
+	}
+	if agentCookie != nil {
+		w.Header().Add("Set-Cookie", agentCookie.String())
+	}
+
+	// Unlock the account again, in case anything changed since the callback.
+	am := s.b.AccountManager()
+	account, clientKey, err := am.UnlockExternalIdentity(ctx, s.kms, pending.Namespace, pending.Subject)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == proto.ErrAccountNotFound {
+			status = http.StatusForbidden
+		}
+		reply(err, status)
+		return
+	}
+	if account.ID().String() != pending.AccountID {
+		reply(proto.ErrAccessDenied, http.StatusForbidden)
+		return
+	}
+
+	if err := checkSecondFactor(ctx, am, s.kms, account, clientKey, req.OTP); err != nil {
+		status := http.StatusInternalServerError
+		switch err {
+		case proto.ErrAccessDenied:
+			status = http.StatusForbidden
+		case proto.ErrOTPLocked:
+			status = http.StatusTooManyRequests
+		}
+		reply(err, status)
+		return
+	}
+
+	if err := s.completeOIDCLogin(ctx, client, agentKey, account, clientKey); err != nil {
+		reply(err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Set-Cookie", clearOIDCSecondFactorCookie().String())
+	reply(nil, http.StatusOK)
+}
+
+// completeOIDCLogin authorizes the client's agent to unlock the account.
+func (s *Server) completeOIDCLogin(
+	ctx scope.Context, client *proto.Client, agentKey *security.ManagedKey, account proto.Account,
+	clientKey *security.ManagedKey) error {
+
+	agentID := client.Agent.IDString()
+	if err := s.b.AgentTracker().SetClientKey(ctx, agentID, agentKey, account.ID(), clientKey); err != nil {
+		return err
+	}
+	err := s.b.NotifyUser(
+		ctx, proto.UserID("agent:"+agentID), proto.LoginEventType, proto.LoginEvent{AccountID: account.ID()})
+	if err != nil {
+		logging.Logger(ctx).Printf("oidc: notify error: %s", err)
+	}
+	return nil
+}
+
+// resolveOIDCAccount finds or creates the account for an identity vouched
+// for by an OpenID Connect provider. If the client is already logged in, the
+// identity is linked to the current account. Returned errors are paired with
+// an HTTP status code.
+func (s *Server) resolveOIDCAccount(
+	ctx scope.Context, client *proto.Client, agentKey *security.ManagedKey, namespace, id string) (
+	proto.Account, *security.ManagedKey, int, error) {
+
+	am := s.b.AccountManager()
+
+	// Link the identity to the logged-in account.
+	if client.Account != nil {
+		clientKey := client.Authorization.ClientKey
+		switch err := am.LinkExternalIdentity(ctx, s.kms, client.Account.ID(), namespace, id, clientKey); err {
+		case nil:
+			return client.Account, clientKey, 0, nil
+		case proto.ErrPersonalIdentityInUse:
+			return nil, nil, http.StatusConflict, fmt.Errorf("identity already linked to another account")
+		default:
+			return nil, nil, http.StatusInternalServerError, err
+		}
+	}
+
+	account, clientKey, err := am.UnlockExternalIdentity(ctx, s.kms, namespace, id)
+	switch err {
+	case nil:
+		return account, clientKey, 0, nil
+	case proto.ErrAccountNotFound:
+	default:
+		return nil, nil, http.StatusInternalServerError, err
+	}
+
+	// Register a new account without a password; the external identity is
+	// the only way in until its owner sets one.
+	if time.Now().Sub(client.Agent.Created) < s.Settings().NewAccountMinAgentAge {
+		return nil, nil, http.StatusForbidden, fmt.Errorf("not familiar yet, try again later")
+	}
+
+	account, clientKey, err = am.Register(ctx, s.kms, namespace, id, "", client.Agent.IDString(), agentKey)
+	if err != nil {
+		if err == proto.ErrPersonalIdentityInUse {
+			return nil, nil, http.StatusConflict, err
+		}
+		return nil, nil, http.StatusInternalServerError, err
+	}
+
+	if err := am.LinkExternalIdentity(ctx, s.kms, account.ID(), namespace, id, clientKey); err != nil {
+		return nil, nil, http.StatusInternalServerError, err
+	}
+
+	// Refresh to pick up the now-verified identity.
+	account, err = am.Get(ctx, account.ID())
+	if err != nil {
+		return nil, nil, http.StatusInternalServerError, err
+	}
+	return account, clientKey, 0, nil
+}
@@ -1,6 +1,7 @@
 package backend
 
 import (
+	"archive/zip"
 	"bytes"
 	"crypto/hmac"
 	"crypto/sha1"
@@ -11,6 +12,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -21,12 +23,14 @@ import (
 	"time"
 
 	"euphoria.io/heim/cluster"
+	"euphoria.io/heim/oidc/oidctest"
 	"euphoria.io/heim/proto"
 	"euphoria.io/heim/proto/emails"
 	"euphoria.io/heim/proto/jobs"
 	"euphoria.io/heim/proto/logging"
 	"euphoria.io/heim/proto/security"
 	"euphoria.io/heim/proto/snowflake"
+	"euphoria.io/heim/templates"
 	"euphoria.io/scope"
 
 	"github.com/gorilla/websocket"
@@ -54,6 +58,7 @@ func newServerUnderTest(
 		accounts:    map[string]proto.Account{},
 		accountKeys: map[string]*security.ManagedKey{},
 		rooms:       map[string]proto.ManagedRoom{},
+		transport:   websocketTestTransport,
 	}
 }
 
@@ -66,6 +71,7 @@ type serverUnderTest struct {
 	accounts    map[string]proto.Account
 	accountKeys map[string]*security.ManagedKey
 	rooms       map[string]proto.ManagedRoom
+	transport   string
 }
 
 func (s *serverUnderTest) Close() {
@@ -74,8 +80,15 @@ func (s *serverUnderTest) Close() {
 	s.backend.Close()
 }
 
-func (s *serverUnderTest) openWebsocket(roomName string, cookies []*http.Cookie, params url.Values) (proto.Room, *websocket.Conn, *http.Response) {
-	headers := http.Header{}
+// openConn connects to a room over the server's transport.
+func (s *serverUnderTest) openConn(roomName string, cookies []*http.Cookie, params url.Values) (proto.Room, testTransport, *http.Response) {
+	return s.openConnWithHeaders(roomName, cookies, params, http.Header{})
+}
+
+func (s *serverUnderTest) openConnWithHeaders(
+	roomName string, cookies []*http.Cookie, params url.Values, headers http.Header) (
+	proto.Room, testTransport, *http.Response) {
+
 	for _, cookie := range cookies {
 		clientCookie := http.Cookie{
 			Name:  cookie.Name,
@@ -83,11 +96,26 @@ func (s *serverUnderTest) openWebsocket(roomName string, cookies []*http.Cookie,
 		}
 		headers.Add("Cookie", clientCookie.String())
 	}
-	url := strings.Replace(s.server.URL, "http:", "ws:", 1) + "/room/" + roomName + "/ws"
-	if params != nil {
-		url = fmt.Sprintf("%s?%s", url, params.Encode())
+	var (
+		url  string
+		conn testTransport
+		resp *http.Response
+		err  error
+	)
+	switch s.transport {
+	case sseTestTransport:
+		url = s.server.URL + "/room/" + roomName + "/sse"
+		if params != nil {
+			url = fmt.Sprintf("%s?%s", url, params.Encode())
+		}
+		conn, resp, err = dialSSE(url, headers)
+	default:
+		url = strings.Replace(s.server.URL, "http:", "ws:", 1) + "/room/" + roomName + "/ws"
+		if params != nil {
+			url = fmt.Sprintf("%s?%s", url, params.Encode())
+		}
+		conn, resp, err = websocket.DefaultDialer.Dial(url, headers)
 	}
-	conn, resp, err := websocket.DefaultDialer.Dial(url, headers)
 	if err != nil {
 		if resp != nil {
 			body, _ := ioutil.ReadAll(resp.Body)
@@ -101,12 +129,10 @@ func (s *serverUnderTest) openWebsocket(roomName string, cookies []*http.Cookie,
 	So(headers.Write(headersBuf), ShouldBeNil)
 	r, err := http.NewRequest("GET", url, nil)
 	So(err, ShouldBeNil)
-	for _, cookie := range cookies {
-		clientCookie := http.Cookie{
-			Name:  cookie.Name,
-			Value: cookie.Value,
+	for name, values := range headers {
+		for _, value := range values {
+			r.Header.Add(name, value)
 		}
-		r.Header.Add("Cookie", clientCookie.String())
 	}
 	ctx := scope.New()
 	agent, _, agentKey, err := getAgent(ctx, s.app, r)
@@ -123,6 +149,9 @@ func (s *serverUnderTest) openWebsocket(roomName string, cookies []*http.Cookie,
 		So(accountID.FromString(agent.AccountID), ShouldBeNil)
 		So(client.AuthenticateWithAgent(ctx, s.backend, agent, agentKey), ShouldBeNil)
 	}
+	if token := bearerToken(r); token != "" {
+		So(client.AuthenticateWithAPIToken(ctx, s.backend, token), ShouldBeNil)
+	}
 	var prefix string
 	if strings.HasPrefix(roomName, "pm:") {
 		prefix = "pm:"
@@ -137,7 +166,29 @@ func (s *serverUnderTest) openWebsocket(roomName string, cookies []*http.Cookie,
 }
 
 func (s *serverUnderTest) Connect(roomName string) *testConn {
-	room, conn, resp := s.openWebsocket(roomName, nil, nil)
+	room, conn, resp := s.openConn(roomName, nil, nil)
+	tc := &testConn{Conn: conn, cookies: resp.Cookies(), roomName: roomName, room: room}
+	tc.debug(true)
+	tc.expectHello()
+	return tc
+}
+
+// ConnectWithEncoding connects to a room, negotiating the given packet
+// encoding.
+func (s *serverUnderTest) ConnectWithEncoding(roomName string, encoding proto.PacketEncoding) *testConn {
+	headers := http.Header{}
+	headers.Set("Sec-WebSocket-Protocol", encoding.Subprotocol())
+	room, conn, resp := s.openConnWithHeaders(roomName, nil, nil, headers)
+	So(conn.Subprotocol(), ShouldEqual, encoding.Subprotocol())
+	tc := &testConn{Conn: conn, cookies: resp.Cookies(), roomName: roomName, room: room, encoding: encoding}
+	tc.debug(true)
+	tc.expectHello()
+	return tc
+}
+
+// ConnectWithParams connects to a room with the given query parameters.
+func (s *serverUnderTest) ConnectWithParams(roomName string, params url.Values) *testConn {
+	room, conn, resp := s.openConn(roomName, nil, params)
 	tc := &testConn{Conn: conn, cookies: resp.Cookies(), roomName: roomName, room: room}
 	tc.debug(true)
 	tc.expectHello()
@@ -147,18 +198,41 @@ func (s *serverUnderTest) Connect(roomName string) *testConn {
 func (s *serverUnderTest) ConnectAsHuman(roomName string) *testConn {
 	vs := url.Values{}
 	vs.Add("h", "1")
-	room, conn, resp := s.openWebsocket(roomName, nil, vs)
+	room, conn, resp := s.openConn(roomName, nil, vs)
 	tc := &testConn{Conn: conn, cookies: resp.Cookies(), roomName: roomName, room: room}
 	tc.debug(true)
 	tc.expectHello()
 	return tc
 }
 
+func (s *serverUnderTest) ConnectWithAPIToken(roomName, token string, account proto.Account) *testConn {
+	headers := http.Header{}
+	headers.Set("Authorization", "Bearer "+token)
+	room, conn, resp := s.openConnWithHeaders(roomName, nil, nil, headers)
+	email, _ := account.Email()
+	tc := &testConn{
+		Conn:         conn,
+		cookies:      resp.Cookies(),
+		roomName:     roomName,
+		room:         room,
+		accountID:    account.ID().String(),
+		accountName:  account.Name(),
+		accountEmail: email,
+	}
+	tc.debug(true)
+	tc.expectHello()
+	return tc
+}
+
 func (s *serverUnderTest) Reconnect(tc *testConn, roomNames ...string) *testConn {
 	if roomNames != nil {
 		tc.roomName = roomNames[0]
 	}
-	room, conn, resp := s.openWebsocket(tc.roomName, tc.cookies, nil)
+	headers := http.Header{}
+	if tc.encoding != nil {
+		headers.Set("Sec-WebSocket-Protocol", tc.encoding.Subprotocol())
+	}
+	room, conn, resp := s.openConnWithHeaders(tc.roomName, tc.cookies, nil, headers)
 	tc.room = room
 	tc.Conn = conn
 	tc.cookies = resp.Cookies()
@@ -250,7 +324,7 @@ func (s *serverUnderTest) Login(c *testConn, namespace, id, password string) *te
 }
 
 type testConn struct {
-	*websocket.Conn
+	Conn                 testTransport
 	room                 proto.Room
 	cookies              []*http.Cookie
 	nicks                map[string]string
@@ -261,10 +335,12 @@ type testConn struct {
 	accountName          string
 	accountEmail         string
 	accountEmailVerified bool
+	accountPasswordUnset bool
 	accountHasAccess     bool
 	isStaff              bool
 	isManager            bool
 	debugOn              bool
+	encoding             proto.PacketEncoding
 	pmNick               string
 	pmUserID             string
 }
@@ -274,6 +350,36 @@ func (tc *testConn) clone() *testConn {
 	return &tc2
 }
 
+// writePacket sends a packet given in JSON, in the connection's encoding.
+func (tc *testConn) writePacket(msg string) {
+	if tc.encoding == nil || !tc.encoding.Binary() {
+		So(tc.Conn.WriteMessage(websocket.TextMessage, []byte(msg)), ShouldBeNil)
+		return
+	}
+	packet, err := proto.ParseRequest([]byte(msg))
+	So(err, ShouldBeNil)
+	data, err := tc.encoding.Encode(packet)
+	So(err, ShouldBeNil)
+	So(tc.Conn.WriteMessage(websocket.BinaryMessage, data), ShouldBeNil)
+}
+
+// readPacketJSON receives a packet in the connection's encoding, and returns
+// it in JSON.
+func (tc *testConn) readPacketJSON() []byte {
+	msgType, data, err := tc.Conn.ReadMessage()
+	So(err, ShouldBeNil)
+	if tc.encoding == nil || !tc.encoding.Binary() {
+		So(msgType, ShouldEqual, websocket.TextMessage)
+		return data
+	}
+	So(msgType, ShouldEqual, websocket.BinaryMessage)
+	packet, err := tc.encoding.Decode(data)
+	So(err, ShouldBeNil)
+	data, err = packet.Encode()
+	So(err, ShouldBeNil)
+	return data
+}
+
 func (tc *testConn) debug(on bool) { tc.debugOn = on }
 func (tc *testConn) id() string    { return tc.userID }
 
@@ -307,16 +413,14 @@ func (tc *testConn) send(id, cmdType, data string, args ...interface{}) {
 		}
 		tc.nicks[tc.room.ID()] = parsed["name"].(string)
 	}
-	So(tc.Conn.WriteMessage(websocket.TextMessage, []byte(msg)), ShouldBeNil)
+	tc.writePacket(msg)
 }
 
 func (tc *testConn) readPacket() (proto.PacketType, interface{}) {
-	msgType, data, err := tc.Conn.ReadMessage()
-	So(err, ShouldBeNil)
-	So(msgType, ShouldEqual, websocket.TextMessage)
+	data := tc.readPacketJSON()
 
 	if tc.debugOn {
-		fmt.Printf("%s received %s\n", tc.LocalAddr(), string(data))
+		fmt.Printf("%s received %s\n", tc.Conn.LocalAddr(), string(data))
 	}
 	var packet proto.Packet
 	So(json.Unmarshal(data, &packet), ShouldBeNil)
@@ -340,12 +444,10 @@ func (tc *testConn) expect(id, cmdType, data string, args ...interface{}) map[st
 	So(json.Unmarshal([]byte(data), &expected), ShouldBeNil)
 
 	// Read packet
-	msgType, packetData, err := tc.Conn.ReadMessage()
-	So(err, ShouldBeNil)
-	So(msgType, ShouldEqual, websocket.TextMessage)
+	packetData := tc.readPacketJSON()
 
 	if tc.debugOn {
-		fmt.Printf("%s received %s\n", tc.LocalAddr(), string(packetData))
+		fmt.Printf("%s received %s\n", tc.Conn.LocalAddr(), string(packetData))
 	}
 	var packet proto.Packet
 	So(json.Unmarshal(packetData, &packet), ShouldBeNil)
@@ -490,9 +592,12 @@ func (tc *testConn) expectHello() {
 	if tc.accountEmailVerified {
 		isParts += `,"account_email_verified":true`
 	}
+	if tc.accountPasswordUnset {
+		isParts += `,"account_password_unset":true`
+	}
 	capture := tc.expect(
-		"", "hello-event", `{%s"id":"*","session":{"id":"*","name":"","server_id":"*","server_era":"*","session_id":"*"%s}%s,"version":"*"}`,
-		account, sessionParts, isParts)
+		"", "hello-event", `{%s"id":"*","session":{"id":"*","name":"","server_id":"*","server_era":"*","session_id":"*"%s}%s,"version":"*","protocol_version":%d,"features":"*"}`,
+		account, sessionParts, isParts, proto.ProtocolVersion)
 	tc.sessionID = capture["session.session_id"].(string)
 	tc.userID = capture["id"].(string)
 }
@@ -545,7 +650,7 @@ func IntegrationTest(t *testing.T, factory proto.BackendFactory) {
 	defer func() { security.TestMode = save }()
 	security.TestMode = true
 
-	runTest := func(name string, test testSuite) {
+	runTestOver := func(transport, name string, test testSuite) {
 		// Set up and start backend.
 		heim := &proto.Heim{
 			Cluster:        &cluster.TestCluster{},
@@ -580,9 +685,25 @@ func IntegrationTest(t *testing.T, factory proto.BackendFactory) {
 		defer server.CloseClientConnections()
 
 		s := newServerUnderTest(backend, app, server, heim.KMS.(security.MockKMS))
+		s.transport = transport
+		if transport != websocketTestTransport {
+			name = fmt.Sprintf("%s over %s", name, transport)
+		}
 		Convey(name, t, func() { test(s) })
 	}
 
+	runTest := func(name string, test testSuite) {
+		runTestOver(websocketTestTransport, name, test)
+	}
+
+	// Protocol tests are repeated over each transport, which must behave
+	// identically.
+	runProtocolTest := func(name string, test testSuite) {
+		for _, transport := range testTransports {
+			runTestOver(transport, name, test)
+		}
+	}
+
 	runTestWithFactory := func(name string, test factoryTestSuite) {
 		Convey(name, t, func() { test(factory) })
 	}
@@ -595,30 +716,41 @@ func IntegrationTest(t *testing.T, factory proto.BackendFactory) {
 	runTest("Jobs API", testJobsLowLevel)
 	runTest("Emails API", testEmailsLowLevel)
 
-	// Websocket tests
-	runTest("Lurker", testLurker)
-	runTest("Broadcast", testBroadcast)
-	runTest("Threading", testThreading)
-	runTest("Authentication", testAuthentication)
+	// Protocol tests
+	runProtocolTest("Lurker", testLurker)
+	runProtocolTest("Broadcast", testBroadcast)
+	runProtocolTest("Threading", testThreading)
+	runProtocolTest("Authentication", testAuthentication)
 	runTestWithFactory("Presence", testPresence)
-	runTest("Deletion", testDeletion)
-	runTest("Account login", testAccountLogin)
-	runTest("Account registration", testAccountRegistration)
-	runTest("Account change password", testAccountChangePassword)
-	runTest("Account reset password", testAccountResetPassword)
-	runTest("Account change name", testAccountChangeName)
-	runTest("Room creation", testRoomCreation)
-	runTest("Room grants", testRoomGrants)
-	runTest("Room not found", testRoomNotFound)
-	runTest("KeepAlive", testKeepAlive)
-	runTest("Bans", testBans)
-	runTest("Message truncation", testMessageTruncation)
-	runTest("Bots and humans", testBotsAndHumans)
-	runTest("Staff OTP", testStaffOTP)
-	runTest("Staff invasion", testStaffInvasion)
-	runTest("NotifyUser", testNotifyUser)
-	runTest("Account change email", testAccountChangeEmail)
-	runTest("PMs", testPMs)
+	runProtocolTest("Deletion", testDeletion)
+	runProtocolTest("Account login", testAccountLogin)
+	runProtocolTest("Account registration", testAccountRegistration)
+	runProtocolTest("Account change password", testAccountChangePassword)
+	runProtocolTest("Account reset password", testAccountResetPassword)
+	runProtocolTest("Account change name", testAccountChangeName)
+	runProtocolTest("Room creation", testRoomCreation)
+	runProtocolTest("Room grants", testRoomGrants)
+	runProtocolTest("Room not found", testRoomNotFound)
+	runProtocolTest("Settings", testSettings)
+	runProtocolTest("KeepAlive", testKeepAlive)
+	runProtocolTest("Bans", testBans)
+	runProtocolTest("Message truncation", testMessageTruncation)
+	runProtocolTest("Bots and humans", testBotsAndHumans)
+	runTest("Binary encoding", testBinaryEncoding)
+	runTest("SSE streams", testSSEStreams)
+	runProtocolTest("Reduced snapshots", testReducedSnapshots)
+	runProtocolTest("Feature declaration", testFeatureDeclaration)
+	runTest("Public API", testPublicAPI)
+	runProtocolTest("Staff OTP", testStaffOTP)
+	runProtocolTest("Staff invasion", testStaffInvasion)
+	runProtocolTest("NotifyUser", testNotifyUser)
+	runProtocolTest("Account change email", testAccountChangeEmail)
+	runProtocolTest("PMs", testPMs)
+	runProtocolTest("API tokens", testAPITokens)
+	runProtocolTest("OpenID Connect login", testOIDCLogin)
+	runProtocolTest("Account OTP", testAccountOTP)
+	runProtocolTest("Account sessions", testAccountSessions)
+	runProtocolTest("Account data export and deletion", testAccountDeletion)
 }
 
 func testLurker(s *serverUnderTest) {
@@ -754,6 +886,454 @@ func testBroadcast(s *serverUnderTest) {
 	})
 }
 
+func testBinaryEncoding(s *serverUnderTest) {
+	Convey("Packets are exchanged in the negotiated encoding", func() {
+		server := `"server_id":"test1","server_era":"era1"`
+
+		text := s.Connect("binaryencoding")
+		defer text.Close()
+		text.expectPing()
+		text.expectSnapshot(s.backend.Version(), nil, nil)
+		text.send("1", "nick", `{"name":"text"}`)
+		text.expect("1", "nick-reply",
+			`{"session_id":"%s","id":"%s","from":"","to":"text"}`, text.sessionID, text.id())
+		text.send("2", "send", `{"content":"before"}`)
+		text.expect("2", "send-reply",
+			`{"id":"*","time":"*","sender":{"session_id":"%s","id":"%s","name":"text",%s},"content":"before"}`,
+			text.sessionID, text.id(), server)
+
+		binary := s.ConnectWithEncoding("binaryencoding", proto.CBOREncoding)
+		defer binary.Close()
+		binary.expectPing()
+		binary.expectSnapshot(s.backend.Version(),
+			[]string{fmt.Sprintf(`{"session_id":"%s","id":"%s","name":"text",%s}`, text.sessionID, text.id(), server)},
+			[]string{fmt.Sprintf(
+				`{"id":"*","time":"*","sender":{"session_id":"%s","id":"%s","name":"text",%s},"content":"before"}`,
+				text.sessionID, text.id(), server)})
+		text.expect("", "join-event",
+			`{"session_id":"%s","id":"%s","name":"",%s}`, binary.sessionID, binary.id(), server)
+
+		binary.send("1", "nick", `{"name":"binary"}`)
+		binary.expect("1", "nick-reply",
+			`{"session_id":"%s","id":"%s","from":"","to":"binary"}`, binary.sessionID, binary.id())
+		text.expect("", "nick-event",
+			`{"session_id":"%s","id":"%s","from":"","to":"binary"}`, binary.sessionID, binary.id())
+
+		binary.send("2", "send", `{"content":"compact"}`)
+		binary.expect("2", "send-reply",
+			`{"id":"*","time":"*","sender":{"session_id":"%s","id":"%s","name":"binary",%s},"content":"compact"}`,
+			binary.sessionID, binary.id(), server)
+		text.expect("", "send-event",
+			`{"id":"*","time":"*","sender":{"session_id":"%s","id":"%s","name":"binary",%s},"content":"compact"}`,
+			binary.sessionID, binary.id(), server)
+
+		text.send("3", "send", `{"content":"verbose"}`)
+		text.expect("3", "send-reply",
+			`{"id":"*","time":"*","sender":{"session_id":"%s","id":"%s","name":"text",%s},"content":"verbose"}`,
+			text.sessionID, text.id(), server)
+		binary.expect("", "send-event",
+			`{"id":"*","time":"*","sender":{"session_id":"%s","id":"%s","name":"text",%s},"content":"verbose"}`,
+			text.sessionID, text.id(), server)
+
+		binary.send("4", "bogus", "")
+		packetType, payload := binary.readPacket()
+		So(packetType, ShouldEqual, proto.PacketType("bogus-reply"))
+		So(payload, ShouldResemble, errors.New("payload: invalid command type: bogus"))
+	})
+}
+
+func testSSEStreams(s *serverUnderTest) {
+	Convey("Commands must be posted to a live stream in the same room", func() {
+		s.transport = sseTestTransport
+		c := s.Connect("ssestreams")
+		c.expectPing()
+		c.expectSnapshot(s.backend.Version(), nil, nil)
+		tc := c.Conn.(*sseTestConn)
+		streamURL := tc.streamURL
+
+		post := func(url, body string, header http.Header) int {
+			req, err := http.NewRequest("POST", url, strings.NewReader(body))
+			So(err, ShouldBeNil)
+			req.Header = header
+			resp, err := http.DefaultClient.Do(req)
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+
+		So(post(streamURL, `{"id":"1","type":"nick","data":{"name":"posted"}}`, tc.header),
+			ShouldEqual, http.StatusAccepted)
+		c.expect("1", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"posted"}`)
+
+		So(post(streamURL, `{"id":"2",`, tc.header), ShouldEqual, http.StatusBadRequest)
+		So(post(strings.Replace(streamURL, "ssestreams", "other", 1), `{"id":"3","type":"who"}`, tc.header),
+			ShouldEqual, http.StatusNotFound)
+
+		// Knowing the stream's id isn't enough; the post must come from the
+		// agent that opened it.
+		So(post(streamURL, `{"id":"4","type":"who"}`, http.Header{}), ShouldEqual, http.StatusNotFound)
+		other := s.Connect("ssestreams")
+		other.expectPing()
+		other.expectSnapshot(s.backend.Version(), nil, nil)
+		So(post(streamURL, `{"id":"5","type":"who"}`, other.Conn.(*sseTestConn).header),
+			ShouldEqual, http.StatusNotFound)
+		other.Close()
+
+		c.Close()
+		So(post(streamURL, `{"id":"6","type":"who"}`, tc.header), ShouldEqual, http.StatusNotFound)
+	})
+}
+
+func testReducedSnapshots(s *serverUnderTest) {
+	Convey("Clients may ask for a reduced snapshot", func() {
+		server := `"server_id":"test1","server_era":"era1"`
+
+		named := s.Connect("reduced")
+		defer named.Close()
+		named.expectPing()
+		named.expectSnapshot(s.backend.Version(), nil, nil)
+		named.send("1", "nick", `{"name":"named"}`)
+		named.expect("1", "nick-reply",
+			`{"session_id":"%s","id":"%s","from":"","to":"named"}`, named.sessionID, named.id())
+		named.send("2", "send", `{"content":"first"}`)
+		named.expect("2", "send-reply",
+			`{"id":"*","time":"*","sender":{"session_id":"%s","id":"%s","name":"named",%s},"content":"first"}`,
+			named.sessionID, named.id(), server)
+		named.send("3", "send", `{"content":"second"}`)
+		named.expect("3", "send-reply",
+			`{"id":"*","time":"*","sender":{"session_id":"%s","id":"%s","name":"named",%s},"content":"second"}`,
+			named.sessionID, named.id(), server)
+
+		lurker := s.Connect("reduced")
+		defer lurker.Close()
+		lurker.expectPing()
+		lurker.expectSnapshot(s.backend.Version(),
+			[]string{fmt.Sprintf(`{"session_id":"%s","id":"%s","name":"named",%s}`, named.sessionID, named.id(), server)},
+			[]string{
+				fmt.Sprintf(`{"id":"*","time":"*","sender":{"session_id":"%s","id":"%s","name":"named",%s},"content":"first"}`,
+					named.sessionID, named.id(), server),
+				fmt.Sprintf(`{"id":"*","time":"*","sender":{"session_id":"%s","id":"%s","name":"named",%s},"content":"second"}`,
+					named.sessionID, named.id(), server),
+			})
+		named.expect("", "join-event",
+			`{"session_id":"%s","id":"%s","name":"",%s}`, lurker.sessionID, lurker.id(), server)
+
+		// Counts only, with no log.
+		bare := s.ConnectWithParams("reduced", url.Values{"snapshot": []string{"0"}})
+		defer bare.Close()
+		bare.expectPing()
+		bare.expect("", "snapshot-event",
+			`{"identity":"*","session_id":"*","version":"%s","listing":[],"log":[],"counts":{"sessions":2,"lurkers":1,"bots":2}}`,
+			s.backend.Version())
+
+		// A truncated listing keeps sessions with nicks.
+		partial := s.ConnectWithParams("reduced", url.Values{"log": []string{"1"}, "listing": []string{"1"}})
+		defer partial.Close()
+		partial.expectPing()
+		partial.expect("", "snapshot-event",
+			`{"identity":"*","session_id":"*","version":"%s","listing":[%s],"log":[%s],"counts":{"sessions":3,"lurkers":2,"bots":3}}`,
+			s.backend.Version(),
+			fmt.Sprintf(`{"session_id":"%s","id":"%s","name":"named",%s}`, named.sessionID, named.id(), server),
+			fmt.Sprintf(`{"id":"*","time":"*","sender":{"session_id":"%s","id":"%s","name":"named",%s},"content":"second"}`,
+				named.sessionID, named.id(), server))
+	})
+
+	Convey("Invalid snapshot parameters are rejected", func() {
+		url := strings.Replace(s.server.URL, "http:", "ws:", 1) + "/room/reduced/ws?listing=all"
+		_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+		So(err, ShouldEqual, websocket.ErrBadHandshake)
+		So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+	})
+
+	Convey("Compression is negotiated", func() {
+		url := strings.Replace(s.server.URL, "http:", "ws:", 1) + "/room/reduced/ws"
+		dialer := &websocket.Dialer{EnableCompression: true}
+		conn, resp, err := dialer.Dial(url, nil)
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		So(resp.Header.Get("Sec-WebSocket-Extensions"), ShouldStartWith, "permessage-deflate")
+	})
+}
+
+func testFeatureDeclaration(s *serverUnderTest) {
+	Convey("The hello-event lists the server's features", func() {
+		room, conn, _ := s.openConn("features", nil, nil)
+		defer conn.Close()
+		tc := &testConn{Conn: conn, roomName: "features", room: room}
+		capture := tc.expect("", "hello-event",
+			`{"id":"*","session":"*","room_is_private":false,"version":"*","protocol_version":%d,"features":"*"}`,
+			proto.ProtocolVersion)
+		features := []string{}
+		for _, feature := range capture["features"].([]interface{}) {
+			features = append(features, feature.(string))
+		}
+		So(features, ShouldResemble, proto.Features())
+		So(features, ShouldContain, "send")
+		So(features, ShouldContain, "send-event")
+		So(features, ShouldNotContain, "send-reply")
+	})
+
+	Convey("Events are withheld from clients that don't declare them", func() {
+		server := `"server_id":"test1","server_era":"era1"`
+
+		narrow := s.ConnectWithParams("featurefilter", url.Values{"features": []string{"send-event,future-event"}})
+		defer narrow.Close()
+		narrow.expectPing()
+		narrow.expectSnapshot(s.backend.Version(), nil, nil)
+
+		other := s.Connect("featurefilter")
+		defer other.Close()
+		other.expectPing()
+		other.expectSnapshot(s.backend.Version(),
+			[]string{fmt.Sprintf(`{"session_id":"%s","id":"%s","name":"",%s}`, narrow.sessionID, narrow.id(), server)}, nil)
+		other.send("1", "nick", `{"name":"other"}`)
+		other.expect("1", "nick-reply",
+			`{"session_id":"%s","id":"%s","from":"","to":"other"}`, other.sessionID, other.id())
+		other.send("2", "send", `{"content":"hi"}`)
+		other.expect("2", "send-reply",
+			`{"id":"*","time":"*","sender":{"session_id":"%s","id":"%s","name":"other",%s},"content":"hi"}`,
+			other.sessionID, other.id(), server)
+
+		// The join-event and nick-event are skipped.
+		narrow.expect("", "send-event",
+			`{"id":"*","time":"*","sender":{"session_id":"%s","id":"%s","name":"other",%s},"content":"hi"}`,
+			other.sessionID, other.id(), server)
+
+		// Replies are always sent.
+		narrow.send("1", "nick", `{"name":"narrow"}`)
+		narrow.expect("1", "nick-reply",
+			`{"session_id":"%s","id":"%s","from":"","to":"narrow"}`, narrow.sessionID, narrow.id())
+		other.expect("", "nick-event",
+			`{"session_id":"%s","id":"%s","from":"","to":"narrow"}`, narrow.sessionID, narrow.id())
+	})
+}
+
+func testPublicAPI(s *serverUnderTest) {
+	get := func(path string, headers http.Header) (*http.Response, []byte) {
+		req, err := http.NewRequest("GET", s.server.URL+path, nil)
+		So(err, ShouldBeNil)
+		for name, values := range headers {
+			for _, value := range values {
+				req.Header.Add(name, value)
+			}
+		}
+		resp, err := http.DefaultClient.Do(req)
+		So(err, ShouldBeNil)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		So(err, ShouldBeNil)
+		return resp, body
+	}
+
+	contents := func(msgs []proto.Message) []string {
+		result := make([]string, len(msgs))
+		for i, msg := range msgs {
+			result[i] = msg.Content
+		}
+		return result
+	}
+
+	Convey("Public rooms are readable over HTTP", func() {
+		conn := s.Connect("publicapi")
+		defer conn.Close()
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+		conn.send("1", "nick", `{"name":"author"}`)
+		conn.expect("1", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"author"}`)
+		conn.send("2", "send", `{"content":"root"}`)
+		root := conn.expect("2", "send-reply", `{"id":"*","time":"*","sender":"*","content":"root"}`)["id"]
+		conn.send("3", "send", `{"content":"child","parent":"%s"}`, root)
+		child := conn.expect("3", "send-reply", `{"id":"*","parent":"%s","time":"*","sender":"*","content":"child"}`, root)["id"]
+		conn.send("4", "send", `{"content":"other"}`)
+		conn.expect("4", "send-reply", `{"id":"*","time":"*","sender":"*","content":"other"}`)
+		conn.send("5", "send", `{"content":"grandchild","parent":"%s"}`, child)
+		conn.expect("5", "send-reply", `{"id":"*","parent":"%s","time":"*","sender":"*","content":"grandchild"}`, child)
+
+		resp, body := get("/api/room/publicapi/messages", nil)
+		So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		So(resp.Header.Get("Content-Type"), ShouldEqual, "application/json")
+		So(resp.Header.Get("Cache-Control"), ShouldEqual, "public, max-age=5")
+		So(resp.Header.Get("Access-Control-Allow-Origin"), ShouldEqual, "*")
+		var log proto.LogReply
+		So(json.Unmarshal(body, &log), ShouldBeNil)
+		So(contents(log.Log), ShouldResemble, []string{"root", "child", "other", "grandchild"})
+		So(log.Log[0].Sender.ClientAddress, ShouldEqual, "")
+
+		// Unchanged responses can be revalidated.
+		etag := resp.Header.Get("ETag")
+		So(etag, ShouldNotEqual, "")
+		resp, _ = get("/api/room/publicapi/messages", http.Header{"If-None-Match": []string{etag}})
+		So(resp.StatusCode, ShouldEqual, http.StatusNotModified)
+
+		resp, body = get("/api/room/publicapi/messages?n=2", nil)
+		So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		So(json.Unmarshal(body, &log), ShouldBeNil)
+		So(contents(log.Log), ShouldResemble, []string{"other", "grandchild"})
+
+		resp, body = get(fmt.Sprintf("/api/room/publicapi/messages?before=%s", child), nil)
+		So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		So(resp.Header.Get("Cache-Control"), ShouldEqual, "public, max-age=60")
+		log = proto.LogReply{}
+		So(json.Unmarshal(body, &log), ShouldBeNil)
+		So(contents(log.Log), ShouldResemble, []string{"root"})
+
+		resp, _ = get("/api/room/publicapi/messages?n=none", nil)
+		So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+		resp, _ = get("/api/room/publicapi/messages?before=-", nil)
+		So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+
+		resp, body = get(fmt.Sprintf("/api/room/publicapi/thread/%s", root), nil)
+		So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		var thread ThreadReply
+		So(json.Unmarshal(body, &thread), ShouldBeNil)
+		So(thread.Message.Content, ShouldEqual, "root")
+		So(contents(thread.Replies), ShouldResemble, []string{"child", "grandchild"})
+		So(thread.Truncated, ShouldBeFalse)
+
+		resp, _ = get("/api/room/publicapi/thread/00000000000000", nil)
+		So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+
+		resp, body = get("/api/room/publicapi/who", nil)
+		So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		var who proto.WhoReply
+		So(json.Unmarshal(body, &who), ShouldBeNil)
+		So(len(who.Listing), ShouldEqual, 1)
+		So(who.Listing[0].SessionID, ShouldEqual, conn.sessionID)
+		So(who.Listing[0].ClientAddress, ShouldEqual, "")
+	})
+
+	Convey("Reading a nonexistent room doesn't create it", func() {
+		resp, _ := get("/api/room/publicapinotfound/messages", nil)
+		So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+		_, err := s.backend.GetRoom(scope.New(), "publicapinotfound")
+		So(err, ShouldEqual, proto.ErrRoomNotFound)
+	})
+
+	Convey("Private rooms require a bearer token with access", func() {
+		ctx := scope.New()
+		kms := s.app.kms
+		nonce := fmt.Sprintf("%d", time.Now().UnixNano())
+		logan, _, err := s.Account(ctx, kms, "email", "logan"+nonce, "loganpass")
+		So(err, ShouldBeNil)
+		max, _, err := s.Account(ctx, kms, "email", "max"+nonce, "maxpass")
+		So(err, ShouldBeNil)
+		_, err = s.Room(ctx, kms, true, "privateapi", logan)
+		So(err, ShouldBeNil)
+
+		resp, _ := get("/api/room/privateapi/messages", nil)
+		So(resp.StatusCode, ShouldEqual, http.StatusForbidden)
+
+		bearer := func(token string) http.Header {
+			return http.Header{"Authorization": []string{"Bearer " + token}}
+		}
+
+		resp, _ = get("/api/room/privateapi/messages", bearer("not a token"))
+		So(resp.StatusCode, ShouldEqual, http.StatusUnauthorized)
+
+		// An account without a grant to the room is denied.
+		_, token, err := s.backend.AccountManager().CreateAPIToken(
+			ctx, max.ID(), max.KeyFromPassword("maxpass"), "reader", proto.APITokenReadOnly, time.Hour)
+		So(err, ShouldBeNil)
+		resp, _ = get("/api/room/privateapi/messages", bearer(token))
+		So(resp.StatusCode, ShouldEqual, http.StatusForbidden)
+
+		_, token, err = s.backend.AccountManager().CreateAPIToken(
+			ctx, logan.ID(), logan.KeyFromPassword("loganpass"), "reader", proto.APITokenReadOnly, time.Hour)
+		So(err, ShouldBeNil)
+		resp, body := get("/api/room/privateapi/messages", bearer(token))
+		So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		So(resp.Header.Get("Cache-Control"), ShouldEqual, "private, max-age=5")
+		So(string(body), ShouldEqual, `{"log":[]}`)
+		resp, _ = get("/api/room/privateapi/who", bearer(token))
+		So(resp.StatusCode, ShouldEqual, http.StatusOK)
+	})
+
+	Convey("Messages under keys the reader lacks are left encrypted", func() {
+		ctx := scope.New()
+		kms := s.app.kms
+		nonce := fmt.Sprintf("%d", time.Now().UnixNano())
+		logan, loganKey, err := s.Account(ctx, kms, "email", "logan"+nonce, "loganpass")
+		So(err, ShouldBeNil)
+		max, _, err := s.Account(ctx, kms, "email", "max"+nonce, "maxpass")
+		So(err, ShouldBeNil)
+		room, err := s.Room(ctx, kms, true, "rotatedapi", logan)
+		So(err, ShouldBeNil)
+
+		// Send a message under the room's first key, then rotate the key
+		// and send another.
+		conn := s.Login(nil, "email", "logan"+nonce, "loganpass")
+		conn.Close()
+		conn.accountHasAccess = true
+		conn.isManager = true
+		s.Reconnect(conn, "rotatedapi")
+		defer conn.Close()
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+		conn.send("1", "nick", `{"name":"logan"}`)
+		conn.expect("1", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"logan"}`)
+		conn.send("2", "send", `{"content":"before"}`)
+		conn.expect("2", "send-reply", `{"id":"*","time":"*","sender":"*","content":"before","encryption_key_id":"*"}`)
+		conn.send("3", "rotate-message-key", `{}`)
+		conn.expect("3", "rotate-message-key-reply", `{"key_id":"*"}`)
+		conn.send("4", "send", `{"content":"after"}`)
+		conn.expect("4", "send-reply", `{"id":"*","time":"*","sender":"*","content":"after","encryption_key_id":"*"}`)
+
+		// An account granted only the new key can't read the first message,
+		// but still reads the rest of the log.
+		newKey, err := room.MessageKey(ctx)
+		So(err, ShouldBeNil)
+		So(newKey.GrantToAccount(ctx, kms, logan, loganKey, max), ShouldBeNil)
+		_, token, err := s.backend.AccountManager().CreateAPIToken(
+			ctx, max.ID(), max.KeyFromPassword("maxpass"), "reader", proto.APITokenReadOnly, time.Hour)
+		So(err, ShouldBeNil)
+		resp, body := get("/api/room/rotatedapi/messages",
+			http.Header{"Authorization": []string{"Bearer " + token}})
+		So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		var log proto.LogReply
+		So(json.Unmarshal(body, &log), ShouldBeNil)
+		So(len(log.Log), ShouldEqual, 2)
+		So(log.Log[0].EncryptionKeyID, ShouldNotEqual, "")
+		So(log.Log[0].Content, ShouldNotEqual, "before")
+		So(log.Log[1].Content, ShouldEqual, "after")
+	})
+
+	Convey("Requests are rate limited per client IP", func() {
+		// X-Forwarded-For is ignored unless the peer is a trusted proxy, so
+		// varying it doesn't escape the limit. Earlier requests in this test
+		// may have drawn on the same bucket.
+		var resp *http.Response
+		for i := int64(0); i <= DefaultSettings.APIBurst; i++ {
+			headers := http.Header{"X-Forwarded-For": []string{fmt.Sprintf("192.0.2.%d", i)}}
+			if resp, _ = get("/api/room/publicapinotfound/who", headers); resp.StatusCode != http.StatusNotFound {
+				break
+			}
+		}
+		So(resp.StatusCode, ShouldEqual, http.StatusTooManyRequests)
+		So(resp.Header.Get("Retry-After"), ShouldEqual, "1")
+
+		// Behind a trusted proxy, clients are told apart by the last address
+		// it forwarded.
+		_, loopback, err := net.ParseCIDR("127.0.0.0/8")
+		So(err, ShouldBeNil)
+		s.app.TrustProxies([]*net.IPNet{loopback})
+		defer s.app.TrustProxies(nil)
+
+		headers := http.Header{"X-Forwarded-For": []string{"192.0.2.50"}}
+		for i := int64(0); i < DefaultSettings.APIBurst; i++ {
+			resp, _ := get("/api/room/publicapinotfound/who", headers)
+			So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+		}
+		headers.Set("X-Forwarded-For", "203.0.113.1, 192.0.2.50")
+		resp, _ = get("/api/room/publicapinotfound/who", headers)
+		So(resp.StatusCode, ShouldEqual, http.StatusTooManyRequests)
+
+		// Other clients are unaffected.
+		headers.Set("X-Forwarded-For", "192.0.2.51")
+		resp, _ = get("/api/room/publicapinotfound/who", headers)
+		So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+	})
+}
+
 func testThreading(s *serverUnderTest) {
 	Convey("Send with parent", func() {
 		ctx := scope.New()
@@ -2026,92 +2606,305 @@ func testRoomGrants(s *serverUnderTest) {
 		maxConn.Close()
 	})
 
-	Convey("Grant manager and revoke access by staff", func() {
+	Convey("Rotate message key", func() {
 		b := s.backend
 		ctx := scope.New()
 		kms := s.app.kms
 
-		// Create staff account and room.
-		_, err := b.CreateRoom(ctx, kms, false, "staffmanagergrants")
+		// Create manager and access accounts, and grant access to all but one.
+		nonce := fmt.Sprintf("%s", time.Now())
+		logan, loganKey, err := s.Account(ctx, kms, "email", "logan"+nonce, "loganpass")
 		So(err, ShouldBeNil)
-
-		nonce := fmt.Sprintf("+%s", time.Now())
-		logan, _, err := s.Account(ctx, kms, "email", "logan"+nonce, "loganpass")
+		max, _, err := s.Account(ctx, kms, "email", "max"+nonce, "maxpass")
+		So(err, ShouldBeNil)
+		sam, _, err := s.Account(ctx, kms, "email", "sam"+nonce, "sampass")
+		So(err, ShouldBeNil)
+		room, err := b.CreateRoom(ctx, kms, true, "rotation", logan)
 		So(err, ShouldBeNil)
-		So(b.AccountManager().GrantStaff(ctx, logan.ID(), s.kms.KMSCredential()), ShouldBeNil)
 
-		// Connect to room and make it private.
+		oldKey, err := room.MessageKey(ctx)
+		So(err, ShouldBeNil)
+		So(oldKey.GrantToAccount(ctx, kms, logan, loganKey, max), ShouldBeNil)
+		So(oldKey.GrantToAccount(ctx, kms, logan, loganKey, sam), ShouldBeNil)
+		So(oldKey.GrantToPasscode(ctx, logan, loganKey, "hunter2"), ShouldBeNil)
+		So(oldKey.RevokeFromAccount(ctx, sam), ShouldBeNil)
 
-		// Connect to room, log in, reconnect, lock room, and grant management to self.
-		loganConn := s.Connect("staffmanagergrants")
+		// Connect and log into manager account in a throwaway room.
+		loganConn := s.Connect("rotationstage")
 		loganConn.expectPing()
 		loganConn.expectSnapshot(s.backend.Version(), nil, nil)
 		loganConn.send("1", "login", `{"namespace":"email","id":"logan%s","password":"loganpass"}`, nonce)
 		loganConn.expect("1", "login-reply", `{"success":true,"account_id":"%s"}`, logan.ID())
 		loganConn.Close()
 
-		loganConn.isStaff = true
-		s.Reconnect(loganConn)
-		loganConn.expectPing()
-		loganConn.expectSnapshot(s.backend.Version(), nil, nil)
-		loganConn.send("1", "staff-lock-room", `{}`)
-		loganConn.expect("1", "staff-lock-room-reply", `{}`)
-		loganConn.Close()
-
-		s.Reconnect(loganConn)
-		loganConn.expectPing()
-		loganConn.expect("", "bounce-event", `{"reason":"authentication required"}`)
-		loganConn.send("1", "unlock-staff-capability", `{"password":"loganpass"}`)
-		loganConn.expect("1", "unlock-staff-capability-reply", `{"success":true}`)
-		loganConn.send("2", "staff-grant-manager", `{"account_id":"%s"}`, logan.ID())
-		loganConn.expect("2", "staff-grant-manager-reply", `{}`)
-		loganConn.Close()
-
-		// Reconnect to verify.
+		// Reconnect manager to private room and rotate the key.
 		loganConn.accountHasAccess = true
 		loganConn.isManager = true
-		s.Reconnect(loganConn)
+		s.Reconnect(loganConn, "rotation")
+		defer loganConn.Close()
 		loganConn.expectPing()
 		loganConn.expectSnapshot(s.backend.Version(), nil, nil)
+		loganConn.send("1", "rotate-message-key", `{}`)
+		loganConn.expect("1", "rotate-message-key-reply", `{"key_id":"*"}`)
 
-		// Revoke self as manager.
-		loganConn.send("1", "unlock-staff-capability", `{"password":"loganpass"}`)
-		loganConn.expect("1", "unlock-staff-capability-reply", `{"success":true}`)
-		loganConn.send("2", "staff-revoke-manager", `{"account_id":"%s"}`, logan.ID())
-		loganConn.expect("2", "staff-revoke-manager-reply", `{}`)
+		newKey, err := room.MessageKey(ctx)
+		So(err, ShouldBeNil)
+		So(newKey.KeyID(), ShouldNotEqual, oldKey.KeyID())
 
-		// Revoke access to self.
-		loganConn.send("3", "staff-revoke-access", `{"account_id":"%s"}`, logan.ID())
-		loganConn.expect("3", "staff-revoke-access-reply", `{}`)
-		loganConn.Close()
+		history, err := room.MessageKeyHistory(ctx)
+		So(err, ShouldBeNil)
+		So(len(history), ShouldEqual, 2)
+		So(history[0].KeyID(), ShouldEqual, newKey.KeyID())
+		So(history[1].KeyID(), ShouldEqual, oldKey.KeyID())
 
-		loganConn.accountHasAccess = false
-		loganConn.isManager = false
-		s.Reconnect(loganConn)
-		loganConn.expectPing()
-		loganConn.expect("", "bounce-event", `{"reason":"authentication required"}`)
+		// Remaining accounts hold the new key, and keep the old one.
+		for _, account := range []proto.Account{logan, max} {
+			c, err := newKey.AccountCapability(ctx, account)
+			So(err, ShouldBeNil)
+			So(c, ShouldNotBeNil)
+			c, err = oldKey.AccountCapability(ctx, account)
+			So(err, ShouldBeNil)
+			So(c, ShouldNotBeNil)
+		}
+
+		// The revoked account doesn't.
+		c, err := newKey.AccountCapability(ctx, sam)
+		So(err, ShouldBeNil)
+		So(c, ShouldBeNil)
+
+		// The passcode grant is carried forward on first use.
+		pc, err := newKey.PasscodeCapability(ctx, "hunter2")
+		So(err, ShouldBeNil)
+		So(pc, ShouldBeNil)
+		conn := s.Connect("rotation")
+		conn.expectPing()
+		conn.expect("", "bounce-event", `{"reason":"authentication required"}`)
+		conn.send("1", "auth", `{"type":"passcode","passcode":"hunter2"}`)
+		conn.expect("1", "auth-reply", `{"success":true}`)
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+		conn.Close()
+		pc, err = newKey.PasscodeCapability(ctx, "hunter2")
+		So(err, ShouldBeNil)
+		So(pc, ShouldNotBeNil)
+
+		// Revoking the passcode revokes it from every key.
+		So(proto.RevokePasscode(ctx, room, "hunter2"), ShouldBeNil)
+		for _, key := range history {
+			pc, err := key.PasscodeCapability(ctx, "hunter2")
+			So(err, ShouldBeNil)
+			So(pc, ShouldBeNil)
+		}
+		So(proto.RevokePasscode(ctx, room, "hunter2"), ShouldEqual, proto.ErrCapabilityNotFound)
 	})
 
-	Convey("Grant manager to account", func() {
+	Convey("Rotate message key keeps the old key if a grant fails", func() {
 		b := s.backend
 		ctx := scope.New()
 		kms := s.app.kms
 
-		// Create manager account and room.
-		nonce := fmt.Sprintf("+%s", time.Now())
-		logan, _, err := s.Account(ctx, kms, "email", "logan"+nonce, "loganpass")
+		nonce := fmt.Sprintf("%s", time.Now())
+		logan, loganKey, err := s.Account(ctx, kms, "email", "logan"+nonce, "loganpass")
 		So(err, ShouldBeNil)
-		room, err := b.CreateRoom(ctx, kms, true, "managergrants", logan)
+		max, _, err := s.Account(ctx, kms, "email", "max"+nonce, "maxpass")
+		So(err, ShouldBeNil)
+		room, err := b.CreateRoom(ctx, kms, true, "rotationfailure", logan)
 		So(err, ShouldBeNil)
 
-		// Create access account (without access yet).
-		max, _, err := s.Account(ctx, kms, "email", "max"+nonce, "maxpass")
+		oldKey, err := room.MessageKey(ctx)
 		So(err, ShouldBeNil)
+		So(oldKey.GrantToAccount(ctx, kms, logan, loganKey, max), ShouldBeNil)
 
-		// Connect and log into manager account in a throwaway room.
-		loganConn := s.Connect("managergrantsstage")
-		loganConn.expectPing()
-		loganConn.expectSnapshot(s.backend.Version(), nil, nil)
+		// The wrong manager key lets the manager's own grant through, but
+		// not the grant to max.
+		_, err = proto.RotateMessageKey(ctx, kms, room, logan, logan.KeyFromPassword("wrongpass"))
+		So(err, ShouldNotBeNil)
+
+		key, err := room.MessageKey(ctx)
+		So(err, ShouldBeNil)
+		So(key.KeyID(), ShouldEqual, oldKey.KeyID())
+		history, err := room.MessageKeyHistory(ctx)
+		So(err, ShouldBeNil)
+		So(len(history), ShouldEqual, 1)
+
+		// A later rotation succeeds and grants the new key to everyone.
+		newKey, err := proto.RotateMessageKey(ctx, kms, room, logan, loganKey)
+		So(err, ShouldBeNil)
+		So(newKey.KeyID(), ShouldNotEqual, oldKey.KeyID())
+		c, err := newKey.AccountCapability(ctx, max)
+		So(err, ShouldBeNil)
+		So(c, ShouldNotBeNil)
+	})
+
+	Convey("Rotate message key disconnects other sessions", func() {
+		b := s.backend
+		ctx := scope.New()
+		kms := s.app.kms
+
+		// Create manager and access accounts, and a private room they can all access.
+		nonce := fmt.Sprintf("%s", time.Now())
+		logan, loganKey, err := s.Account(ctx, kms, "email", "logan"+nonce, "loganpass")
+		So(err, ShouldBeNil)
+		max, _, err := s.Account(ctx, kms, "email", "max"+nonce, "maxpass")
+		So(err, ShouldBeNil)
+		sam, _, err := s.Account(ctx, kms, "email", "sam"+nonce, "sampass")
+		So(err, ShouldBeNil)
+		room, err := b.CreateRoom(ctx, kms, true, "rotationkick", logan)
+		So(err, ShouldBeNil)
+
+		oldKey, err := room.MessageKey(ctx)
+		So(err, ShouldBeNil)
+		So(oldKey.GrantToAccount(ctx, kms, logan, loganKey, max), ShouldBeNil)
+		So(oldKey.GrantToAccount(ctx, kms, logan, loganKey, sam), ShouldBeNil)
+
+		// Log everyone in and join the private room, manager last.
+		maxConn := s.Login(nil, "email", "max"+nonce, "maxpass")
+		maxConn.Close()
+		maxConn.accountHasAccess = true
+		s.Reconnect(maxConn, "rotationkick")
+		maxConn.expectPing()
+		maxConn.expectSnapshot(s.backend.Version(), nil, nil)
+
+		samConn := s.Login(nil, "email", "sam"+nonce, "sampass")
+		samConn.Close()
+		samConn.accountHasAccess = true
+		s.Reconnect(samConn, "rotationkick")
+		samConn.expectPing()
+		samConn.expectSnapshot(
+			s.backend.Version(),
+			[]string{
+				fmt.Sprintf(
+					`{"session_id":"%s","id":"%s","name":"","server_id":"test1","server_era":"era1"}`,
+					maxConn.sessionID, maxConn.id())},
+			nil)
+		maxConn.expect("", "join-event",
+			`{"session_id":"%s","id":"%s","name":"","server_id":"test1","server_era":"era1"}`,
+			samConn.sessionID, samConn.id())
+
+		loganConn := s.Login(nil, "email", "logan"+nonce, "loganpass")
+		loganConn.Close()
+		loganConn.accountHasAccess = true
+		loganConn.isManager = true
+		s.Reconnect(loganConn, "rotationkick")
+		defer loganConn.Close()
+		loganConn.expectPing()
+		loganConn.expect("", "snapshot-event",
+			`{"identity":"*","session_id":"*","version":"%s","listing":"*","log":[]}`, s.backend.Version())
+		for _, conn := range []*testConn{maxConn, samConn} {
+			conn.expect("", "join-event",
+				`{"session_id":"%s","id":"%s","name":"","server_id":"test1","server_era":"era1","is_manager":true}`,
+				loganConn.sessionID, loganConn.id())
+		}
+
+		// Revoke sam's access behind the live session's back, then rotate.
+		So(oldKey.RevokeFromAccount(ctx, sam), ShouldBeNil)
+		loganConn.send("1", "rotate-message-key", `{}`)
+		loganConn.expect("1", "rotate-message-key-reply", `{"key_id":"*"}`)
+
+		// Both other sessions are disconnected.
+		maxConn.expect("", "disconnect-event", `{"reason":"message key rotated"}`)
+		samConn.expect("", "disconnect-event", `{"reason":"message key rotated"}`)
+
+		// Max authenticates with the new key and gets back in.
+		s.Reconnect(maxConn)
+		maxConn.expectPing()
+		maxConn.expect("", "snapshot-event",
+			`{"identity":"*","session_id":"*","version":"%s","listing":"*","log":[]}`, s.backend.Version())
+		maxConn.Close()
+
+		// Sam doesn't.
+		samConn.accountHasAccess = false
+		s.Reconnect(samConn)
+		samConn.expectPing()
+		samConn.expect("", "bounce-event", `{"reason":"authentication required"}`)
+		samConn.Close()
+	})
+
+	Convey("Grant manager and revoke access by staff", func() {
+		b := s.backend
+		ctx := scope.New()
+		kms := s.app.kms
+
+		// Create staff account and room.
+		_, err := b.CreateRoom(ctx, kms, false, "staffmanagergrants")
+		So(err, ShouldBeNil)
+
+		nonce := fmt.Sprintf("+%s", time.Now())
+		logan, _, err := s.Account(ctx, kms, "email", "logan"+nonce, "loganpass")
+		So(err, ShouldBeNil)
+		So(b.AccountManager().GrantStaff(ctx, logan.ID(), s.kms.KMSCredential()), ShouldBeNil)
+
+		// Connect to room and make it private.
+
+		// Connect to room, log in, reconnect, lock room, and grant management to self.
+		loganConn := s.Connect("staffmanagergrants")
+		loganConn.expectPing()
+		loganConn.expectSnapshot(s.backend.Version(), nil, nil)
+		loganConn.send("1", "login", `{"namespace":"email","id":"logan%s","password":"loganpass"}`, nonce)
+		loganConn.expect("1", "login-reply", `{"success":true,"account_id":"%s"}`, logan.ID())
+		loganConn.Close()
+
+		loganConn.isStaff = true
+		s.Reconnect(loganConn)
+		loganConn.expectPing()
+		loganConn.expectSnapshot(s.backend.Version(), nil, nil)
+		loganConn.send("1", "staff-lock-room", `{}`)
+		loganConn.expect("1", "staff-lock-room-reply", `{}`)
+		loganConn.Close()
+
+		s.Reconnect(loganConn)
+		loganConn.expectPing()
+		loganConn.expect("", "bounce-event", `{"reason":"authentication required"}`)
+		loganConn.send("1", "unlock-staff-capability", `{"password":"loganpass"}`)
+		loganConn.expect("1", "unlock-staff-capability-reply", `{"success":true}`)
+		loganConn.send("2", "staff-grant-manager", `{"account_id":"%s"}`, logan.ID())
+		loganConn.expect("2", "staff-grant-manager-reply", `{}`)
+		loganConn.Close()
+
+		// Reconnect to verify.
+		loganConn.accountHasAccess = true
+		loganConn.isManager = true
+		s.Reconnect(loganConn)
+		loganConn.expectPing()
+		loganConn.expectSnapshot(s.backend.Version(), nil, nil)
+
+		// Revoke self as manager.
+		loganConn.send("1", "unlock-staff-capability", `{"password":"loganpass"}`)
+		loganConn.expect("1", "unlock-staff-capability-reply", `{"success":true}`)
+		loganConn.send("2", "staff-revoke-manager", `{"account_id":"%s"}`, logan.ID())
+		loganConn.expect("2", "staff-revoke-manager-reply", `{}`)
+
+		// Revoke access to self.
+		loganConn.send("3", "staff-revoke-access", `{"account_id":"%s"}`, logan.ID())
+		loganConn.expect("3", "staff-revoke-access-reply", `{}`)
+		loganConn.Close()
+
+		loganConn.accountHasAccess = false
+		loganConn.isManager = false
+		s.Reconnect(loganConn)
+		loganConn.expectPing()
+		loganConn.expect("", "bounce-event", `{"reason":"authentication required"}`)
+	})
+
+	Convey("Grant manager to account", func() {
+		b := s.backend
+		ctx := scope.New()
+		kms := s.app.kms
+
+		// Create manager account and room.
+		nonce := fmt.Sprintf("+%s", time.Now())
+		logan, _, err := s.Account(ctx, kms, "email", "logan"+nonce, "loganpass")
+		So(err, ShouldBeNil)
+		room, err := b.CreateRoom(ctx, kms, true, "managergrants", logan)
+		So(err, ShouldBeNil)
+
+		// Create access account (without access yet).
+		max, _, err := s.Account(ctx, kms, "email", "max"+nonce, "maxpass")
+		So(err, ShouldBeNil)
+
+		// Connect and log into manager account in a throwaway room.
+		loganConn := s.Connect("managergrantsstage")
+		loganConn.expectPing()
+		loganConn.expectSnapshot(s.backend.Version(), nil, nil)
 		loganConn.send("1", "login", `{"namespace":"email","id":"logan%s","password":"loganpass"}`, nonce)
 		loganConn.expect("1", "login-reply", `{"success":true,"account_id":"%s"}`, logan.ID())
 		loganConn.Close()
@@ -2146,6 +2939,77 @@ func testRoomNotFound(s *serverUnderTest) {
 	So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
 }
 
+func testSettings(s *serverUnderTest) {
+	c := s.app.heim.Cluster
+	settled := func(check func(Settings) bool) bool {
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+			if check(s.app.Settings()) {
+				return true
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		return false
+	}
+
+	Convey("Overrides are applied without restart", func() {
+		So(s.app.Settings().AllowRoomCreation, ShouldBeTrue)
+		So(OverrideSetting(c, "allow-room-creation", "false"), ShouldBeNil)
+		defer ResetSetting(c, "allow-room-creation")
+		So(settled(func(st Settings) bool { return !st.AllowRoomCreation }), ShouldBeTrue)
+
+		url := strings.Replace(s.server.URL, "http:", "ws:", 1) + "/room/settingsnotfound/ws"
+		_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+		So(err, ShouldNotBeNil)
+		So(resp, ShouldNotBeNil)
+		So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+
+		// Configuring the server doesn't disturb the override.
+		s.app.AllowRoomCreation(true)
+		So(s.app.Settings().AllowRoomCreation, ShouldBeFalse)
+
+		So(ResetSetting(c, "allow-room-creation"), ShouldBeNil)
+		_, err = c.GetValue(SettingsDir + "/allow-room-creation")
+		So(err, ShouldEqual, cluster.ErrNotFound)
+		So(settled(func(st Settings) bool { return st.AllowRoomCreation }), ShouldBeTrue)
+	})
+
+	Convey("Invalid overrides are rejected or ignored", func() {
+		So(OverrideSetting(c, "flood-rate", "0"), ShouldNotBeNil)
+		So(OverrideSetting(c, "no-such-setting", "1"), ShouldNotBeNil)
+
+		So(c.SetValue(SettingsDir+"/flood-rate", "bogus"), ShouldBeNil)
+		defer ResetSetting(c, "flood-rate")
+		So(OverrideSetting(c, "flood-burst", "7"), ShouldBeNil)
+		defer ResetSetting(c, "flood-burst")
+		So(settled(func(st Settings) bool { return st.FloodBurst == 7 }), ShouldBeTrue)
+		So(s.app.Settings().FloodRate, ShouldEqual, DefaultSettings.FloodRate)
+	})
+
+	Convey("Email overrides apply to outgoing emails", func() {
+		ctx := scope.New()
+		nonce := fmt.Sprintf("%s", time.Now())
+		logan, _, err := s.Account(ctx, s.app.kms, "email", "logan"+nonce, "loganpass")
+		So(err, ShouldBeNil)
+		inbox := s.app.heim.MockDeliverer().Inbox("logan" + nonce)
+
+		So(OverrideSetting(c, "email-site-name", "elsewhere"), ShouldBeNil)
+		defer ResetSetting(c, "email-site-name")
+		So(OverrideSetting(c, "email-site-url", "https://elsewhere.invalid"), ShouldBeNil)
+		defer ResetSetting(c, "email-site-url")
+		So(settled(func(st Settings) bool {
+			return st.EmailSiteName == "elsewhere" && st.EmailSiteURL == "https://elsewhere.invalid"
+		}), ShouldBeTrue)
+
+		So(s.app.heim.OnAccountPasswordChanged(ctx, s.backend, logan), ShouldBeNil)
+		msg := <-inbox
+		params, ok := msg.Data.(*proto.PasswordChangedEmailParams)
+		So(ok, ShouldBeTrue)
+		So(params.SiteName, ShouldEqual, "elsewhere")
+		So(params.SiteURL, ShouldEqual, "https://elsewhere.invalid")
+		So(params.HelpAddress, ShouldEqual, proto.DefaultCommonEmailParams.HelpAddress)
+	})
+}
+
 func testKeepAlive(s *serverUnderTest) {
 	Convey("Ping event, reply, and timeout", func() {
 		save := KeepAlive
@@ -2828,6 +3692,245 @@ func testJobsLowLevel(s *serverUnderTest) {
 			Log:           []byte("succeeding\n"),
 		})
 	})
+
+	Convey("Dead letters", func() {
+		jq, err := js.GetQueue(ctx, "dead letters")
+		So(err, ShouldBeNil)
+
+		exhaust := func(jobID snowflake.Snowflake, attempts int) {
+			for i := 0; i < attempts; i++ {
+				job, err := jobs.Claim(ctx, jq, "test", 10*time.Millisecond, 0)
+				So(err, ShouldBeNil)
+				So(job.ID, ShouldEqual, jobID)
+				fmt.Fprintf(job, "attempt %d\n", i)
+				So(job.Fail(ctx, "broken"), ShouldBeNil)
+			}
+		}
+
+		jt, jp := makeJob()
+		deadID, err := jq.Add(ctx, jt, jp, jobs.JobOptions.MaxAttempts(2))
+		So(err, ShouldBeNil)
+		exhaust(deadID, 2)
+
+		jt, jp = makeJob()
+		otherID, err := jq.Add(ctx, jt, jp, jobs.JobOptions.MaxAttempts(1))
+		So(err, ShouldBeNil)
+		exhaust(otherID, 1)
+
+		// Dead jobs are no longer claimable.
+		_, err = jq.TryClaim(ctx, "test")
+		So(err, ShouldEqual, jobs.ErrJobNotFound)
+
+		stats, err := jq.Stats(ctx)
+		So(err, ShouldBeNil)
+		So(stats, ShouldResemble, jobs.JobQueueStats{Failed: 2})
+
+		failed, err := jq.ListFailed(ctx, 10)
+		So(err, ShouldBeNil)
+		So(len(failed), ShouldEqual, 2)
+		So(failed[0].ID, ShouldEqual, deadID)
+		So(failed[0].AttemptsRemaining, ShouldEqual, 0)
+		So(failed[1].ID, ShouldEqual, otherID)
+
+		failed, err = jq.ListFailed(ctx, 1)
+		So(err, ShouldBeNil)
+		So(len(failed), ShouldEqual, 1)
+
+		// Retrying restores the original number of attempts, no matter how
+		// many times the job has died.
+		So(jq.Retry(ctx, deadID), ShouldBeNil)
+		So(jq.Retry(ctx, deadID), ShouldEqual, jobs.ErrJobNotFound)
+		exhaust(deadID, 2)
+		So(jq.Retry(ctx, deadID), ShouldBeNil)
+		job, err := jobs.Claim(ctx, jq, "test", 10*time.Millisecond, 0)
+		So(err, ShouldBeNil)
+		So(job.ID, ShouldEqual, deadID)
+		So(job.AttemptsRemaining, ShouldEqual, 1)
+		So(job.Complete(ctx), ShouldBeNil)
+
+		// Purging discards what's left.
+		n, err := jq.Purge(ctx)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 1)
+		failed, err = jq.ListFailed(ctx, 10)
+		So(err, ShouldBeNil)
+		So(len(failed), ShouldEqual, 0)
+		So(jq.Retry(ctx, otherID), ShouldEqual, jobs.ErrJobNotFound)
+
+		stats, err = jq.Stats(ctx)
+		So(err, ShouldBeNil)
+		So(stats, ShouldResemble, jobs.JobQueueStats{})
+	})
+
+	Convey("Priorities", func() {
+		jq, err := js.GetQueue(ctx, "priorities")
+		So(err, ShouldBeNil)
+
+		add := func(options ...jobs.JobOption) snowflake.Snowflake {
+			jt, jp := makeJob()
+			jobID, err := jq.Add(ctx, jt, jp, options...)
+			So(err, ShouldBeNil)
+			return jobID
+		}
+
+		past := time.Now().Add(-time.Minute)
+		lowID := add(jobs.JobOptions.Priority(jobs.LowPriority), jobs.JobOptions.Due(past.Add(-time.Minute)))
+		defaultID := add(jobs.JobOptions.Due(past))
+		laterID := add(jobs.JobOptions.Priority(jobs.HighPriority), jobs.JobOptions.Due(time.Now().Add(time.Hour)))
+		highID := add(jobs.JobOptions.Priority(jobs.HighPriority), jobs.JobOptions.Due(past))
+
+		// Due jobs go by priority, and jobs that aren't due yet come last
+		// regardless of priority.
+		for _, expected := range []snowflake.Snowflake{highID, defaultID, lowID, laterID} {
+			job, err := jq.TryClaim(ctx, "test")
+			So(err, ShouldBeNil)
+			So(job.ID, ShouldEqual, expected)
+			So(job.Complete(ctx), ShouldBeNil)
+		}
+	})
+
+	Convey("Idempotency keys", func() {
+		jq, err := js.GetQueue(ctx, "idempotency")
+		So(err, ShouldBeNil)
+
+		key := jobs.JobOptions.IdempotencyKey("once")
+
+		jt, jp := makeJob()
+		jobID, err := jq.Add(ctx, jt, jp, key)
+		So(err, ShouldBeNil)
+
+		// A pending job absorbs duplicates.
+		jt, jp = makeJob()
+		dupID, err := jq.Add(ctx, jt, jp, key)
+		So(err, ShouldEqual, jobs.ErrDuplicateJob)
+		So(dupID, ShouldEqual, jobID)
+
+		_, err = jq.AddAndClaim(ctx, jt, jp, "test", key)
+		So(err, ShouldEqual, jobs.ErrDuplicateJob)
+
+		// Keys are scoped to the queue.
+		other, err := js.GetQueue(ctx, "idempotency elsewhere")
+		So(err, ShouldBeNil)
+		otherID, err := other.Add(ctx, jt, jp, key)
+		So(err, ShouldBeNil)
+		So(otherID, ShouldNotEqual, jobID)
+		So(other.Cancel(ctx, otherID), ShouldBeNil)
+
+		// So does a claimed job.
+		job, err := jq.TryClaim(ctx, "test")
+		So(err, ShouldBeNil)
+		So(job.ID, ShouldEqual, jobID)
+		So(job.IdempotencyKey, ShouldEqual, "once")
+		dupID, err = jq.Add(ctx, jt, jp, key)
+		So(err, ShouldEqual, jobs.ErrDuplicateJob)
+		So(dupID, ShouldEqual, jobID)
+
+		// Once the job is complete, the key may be used again.
+		So(job.Complete(ctx), ShouldBeNil)
+		nextID, err := jq.Add(ctx, jt, jp, key)
+		So(err, ShouldBeNil)
+		So(nextID, ShouldNotEqual, jobID)
+
+		// Likewise once the job is dead. Retrying the dead job is refused
+		// while its key is taken.
+		So(jq.Cancel(ctx, nextID), ShouldBeNil)
+		deadID, err := jq.Add(ctx, jt, jp, key, jobs.JobOptions.MaxAttempts(1))
+		So(err, ShouldBeNil)
+		job, err = jq.TryClaim(ctx, "test")
+		So(err, ShouldBeNil)
+		So(job.ID, ShouldEqual, deadID)
+		So(job.Fail(ctx, "broken"), ShouldBeNil)
+
+		liveID, err := jq.Add(ctx, jt, jp, key)
+		So(err, ShouldBeNil)
+		So(liveID, ShouldNotEqual, deadID)
+		So(jq.Retry(ctx, deadID), ShouldEqual, jobs.ErrDuplicateJob)
+
+		So(jq.Cancel(ctx, liveID), ShouldBeNil)
+		So(jq.Retry(ctx, deadID), ShouldBeNil)
+		So(jq.Cancel(ctx, deadID), ShouldBeNil)
+		_, err = jq.Purge(ctx)
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Recurring jobs", func() {
+		jq, err := js.GetQueue(ctx, "recurring")
+		So(err, ShouldBeNil)
+
+		rj := &jobs.RecurringJob{
+			Name:     "every-five",
+			Queue:    "recurring",
+			Schedule: jobs.MustParseSchedule("*/5 * * * *"),
+			Type:     jobs.PresenceScanJobType,
+			Payload:  &jobs.PresenceScanJob{},
+			Options:  jobs.PresenceScanJobOptions,
+		}
+
+		// Two schedulers, as if running in different processes.
+		s1 := jobs.NewScheduler(js, rj)
+		s2 := jobs.NewScheduler(js, rj)
+
+		// The most recent tick is enqueued when the schedulers start, and
+		// only once.
+		start := time.Date(2015, 6, 1, 12, 1, 0, 0, time.UTC)
+		So(s1.Tick(ctx, start), ShouldBeNil)
+		So(s2.Tick(ctx, start), ShouldBeNil)
+		job, err := jq.TryClaim(ctx, "test")
+		So(err, ShouldBeNil)
+		So(job.Due.Equal(start.Add(-time.Minute)), ShouldBeTrue)
+		So(job.Complete(ctx), ShouldBeNil)
+		_, err = jq.TryClaim(ctx, "test")
+		So(err, ShouldEqual, jobs.ErrJobNotFound)
+
+		// A scheduler starting later doesn't enqueue it again.
+		So(jobs.NewScheduler(js, rj).Tick(ctx, start.Add(time.Minute)), ShouldBeNil)
+		_, err = jq.TryClaim(ctx, "test")
+		So(err, ShouldEqual, jobs.ErrJobNotFound)
+
+		// Nothing more is enqueued until the next tick comes due.
+		So(s1.Tick(ctx, start.Add(2*time.Minute)), ShouldBeNil)
+		_, err = jq.TryClaim(ctx, "test")
+		So(err, ShouldEqual, jobs.ErrJobNotFound)
+
+		// The tick is enqueued exactly once.
+		So(s1.Tick(ctx, start.Add(4*time.Minute)), ShouldBeNil)
+		So(s2.Tick(ctx, start.Add(5*time.Minute)), ShouldBeNil)
+		job, err = jq.TryClaim(ctx, "test")
+		So(err, ShouldBeNil)
+		So(job.Type, ShouldEqual, jobs.PresenceScanJobType)
+		So(job.Due.Equal(start.Add(4*time.Minute)), ShouldBeTrue)
+		So(job.Complete(ctx), ShouldBeNil)
+		first := job.ID
+		_, err = jq.TryClaim(ctx, "test")
+		So(err, ShouldEqual, jobs.ErrJobNotFound)
+
+		// A direct attempt to enqueue an earlier tick is refused.
+		_, err = jq.AddScheduled(ctx, rj.Name, start, rj.Type, rj.Payload)
+		So(err, ShouldEqual, jobs.ErrJobAlreadyScheduled)
+
+		// The next tick goes to whichever scheduler gets there first.
+		So(s2.Tick(ctx, start.Add(9*time.Minute)), ShouldBeNil)
+		So(s1.Tick(ctx, start.Add(9*time.Minute)), ShouldBeNil)
+		job, err = jq.TryClaim(ctx, "test")
+		So(err, ShouldBeNil)
+		So(job.Complete(ctx), ShouldBeNil)
+		second := job.ID
+		_, err = jq.TryClaim(ctx, "test")
+		So(err, ShouldEqual, jobs.ErrJobNotFound)
+
+		// Enqueuing another tick discards all but the latest completed job.
+		_, err = jq.Log(ctx, first, 0)
+		So(err, ShouldBeNil)
+		So(s1.Tick(ctx, start.Add(14*time.Minute)), ShouldBeNil)
+		_, err = jq.Log(ctx, first, 0)
+		So(err, ShouldEqual, jobs.ErrJobNotFound)
+		_, err = jq.Log(ctx, second, 0)
+		So(err, ShouldBeNil)
+		job, err = jq.TryClaim(ctx, "test")
+		So(err, ShouldBeNil)
+		So(job.Due.Equal(start.Add(14*time.Minute)), ShouldBeTrue)
+		So(job.Complete(ctx), ShouldBeNil)
+	})
 }
 
 type testDeliverer struct {
@@ -3016,8 +4119,422 @@ func testStaffOTP(s *serverUnderTest) {
 	})
 }
 
-func testStaffInvasion(s *serverUnderTest) {
-	Convey("Staff can use OTP to invade room", func() {
+func testAccountOTP(s *serverUnderTest) {
+	ctx := scope.New()
+	kms := s.app.kms
+	nonce := fmt.Sprintf("%s", time.Now())
+	logan, _, err := s.Account(ctx, kms, "email", "logan"+nonce, "loganpass")
+	So(err, ShouldBeNil)
+
+	connect := func() *testConn {
+		c := s.Connect(fmt.Sprintf("accountotp%d", time.Now().UnixNano()))
+		c.expectPing()
+		c.expectSnapshot(s.backend.Version(), nil, nil)
+		return c
+	}
+
+	login := func() *testConn {
+		c := connect()
+		c.send("1", "login", `{"namespace":"email","id":"logan%s","password":"loganpass"}`, nonce)
+		c.expect("1", "login-reply", `{"success":true,"account_id":"%s"}`, logan.ID())
+		c = s.Reconnect(c, fmt.Sprintf("accountotp%d", time.Now().UnixNano()))
+		c.expectPing()
+		c.expectSnapshot(s.backend.Version(), nil, nil)
+		return c
+	}
+
+	Convey("OTP commands require login", func() {
+		c := connect()
+		defer c.Close()
+		c.send("1", "enroll-otp", "")
+		c.expectError("1", "enroll-otp-reply", proto.ErrNotLoggedIn.Error())
+		c.send("2", "validate-otp", `{"password":"000000"}`)
+		c.expectError("2", "validate-otp-reply", proto.ErrNotLoggedIn.Error())
+	})
+
+	Convey("Enroll, log in, and disable", func() {
+		inbox := s.app.heim.MockDeliverer().Inbox("logan" + nonce)
+
+		c := login()
+		c.send("1", "validate-otp", `{"password":"000000"}`)
+		c.expectError("1", "validate-otp-reply", proto.ErrOTPNotEnrolled.Error())
+		c.send("2", "enroll-otp", "")
+		capture := c.expect("2", "enroll-otp-reply", `{"uri":"*","qr_uri":"*"}`)
+		uri := capture["uri"].(string)
+
+		// Logging in still requires only a password until the key is validated.
+		c2 := connect()
+		c2.send("1", "login", `{"namespace":"email","id":"logan%s","password":"loganpass"}`, nonce)
+		c2.expect("1", "login-reply", `{"success":true,"account_id":"%s"}`, logan.ID())
+		c2.Close()
+
+		c.send("3", "validate-otp", `{"password":"bogus"}`)
+		c.expectError("3", "validate-otp-reply", proto.ErrAccessDenied.Error())
+		c.send("4", "validate-otp", `{"password":"%s"}`, oneTimePassword(uri))
+		capture = c.expect("4", "validate-otp-reply", `{"recovery_codes":"*"}`)
+		codes := capture["recovery_codes"].([]interface{})
+		So(len(codes), ShouldEqual, proto.OTPRecoveryCodeCount)
+
+		msg := receiveEmail(inbox)
+		So(msg.EmailType, ShouldEqual, proto.OTPChangedEmail)
+		params, ok := msg.Data.(*proto.OTPChangedEmailParams)
+		So(ok, ShouldBeTrue)
+		So(params.Enabled, ShouldBeTrue)
+
+		// Validating again doesn't reissue recovery codes.
+		c.send("5", "validate-otp", `{"password":"%s"}`, oneTimePassword(uri))
+		c.expect("5", "validate-otp-reply", `{}`)
+
+		time.Sleep(100 * time.Millisecond)
+		c.send("6", "enroll-otp", "")
+		c.expectError("6", "enroll-otp-reply", proto.ErrOTPAlreadyEnrolled.Error())
+		c.Close()
+
+		// Login now requires a second factor.
+		c = connect()
+		c.send("1", "login", `{"namespace":"email","id":"logan%s","password":"loganpass"}`, nonce)
+		c.expect("1", "login-reply", `{"success":false,"reason":"one-time password required","otp_required":true}`)
+		c.send("2", "login", `{"namespace":"email","id":"logan%s","password":"loganpass","otp":"000000"}`, nonce)
+		c.expect("2", "login-reply", `{"success":false,"reason":"access denied","otp_required":true}`)
+		c.send("3", "login", `{"namespace":"email","id":"logan%s","password":"wrongpass","otp":"%s"}`,
+			nonce, oneTimePassword(uri))
+		c.expect("3", "login-reply", `{"success":false,"reason":"access denied"}`)
+		c.send("4", "login", `{"namespace":"email","id":"logan%s","password":"loganpass","otp":"%s"}`,
+			nonce, oneTimePassword(uri))
+		c.expect("4", "login-reply", `{"success":true,"account_id":"%s"}`, logan.ID())
+		c.Close()
+
+		// A recovery code may be used in place of a one-time password, but only once.
+		c = connect()
+		c.send("1", "login", `{"namespace":"email","id":"logan%s","password":"loganpass","otp":"%s"}`,
+			nonce, codes[0])
+		c.expect("1", "login-reply", `{"success":true,"account_id":"%s"}`, logan.ID())
+		c.Close()
+
+		c = connect()
+		c.send("1", "login", `{"namespace":"email","id":"logan%s","password":"loganpass","otp":"%s"}`,
+			nonce, codes[0])
+		c.expect("1", "login-reply", `{"success":false,"reason":"access denied","otp_required":true}`)
+		c.send("2", "login", `{"namespace":"email","id":"logan%s","password":"loganpass","otp":"%s"}`,
+			nonce, codes[1])
+		c.expect("2", "login-reply", `{"success":true,"account_id":"%s"}`, logan.ID())
+		c = s.Reconnect(c, fmt.Sprintf("accountotp%d", time.Now().UnixNano()))
+		c.expectPing()
+		c.expectSnapshot(s.backend.Version(), nil, nil)
+
+		// Disabling requires the password and a second factor.
+		c.send("1", "disable-otp", `{"password":"wrongpass","otp":"%s"}`, oneTimePassword(uri))
+		c.expectError("1", "disable-otp-reply", proto.ErrAccessDenied.Error())
+		c.send("2", "disable-otp", `{"password":"loganpass","otp":"%s"}`, codes[0])
+		c.expectError("2", "disable-otp-reply", proto.ErrAccessDenied.Error())
+		c.send("3", "disable-otp", `{"password":"loganpass","otp":"%s"}`, oneTimePassword(uri))
+		c.expect("3", "disable-otp-reply", `{}`)
+		c.send("4", "disable-otp", `{"password":"loganpass","otp":"%s"}`, oneTimePassword(uri))
+		c.expectError("4", "disable-otp-reply", proto.ErrOTPNotEnrolled.Error())
+		c.Close()
+
+		msg = receiveEmail(inbox)
+		So(msg.EmailType, ShouldEqual, proto.OTPChangedEmail)
+		params, ok = msg.Data.(*proto.OTPChangedEmailParams)
+		So(ok, ShouldBeTrue)
+		So(params.Enabled, ShouldBeFalse)
+
+		// Password alone suffices again.
+		c = connect()
+		defer c.Close()
+		c.send("1", "login", `{"namespace":"email","id":"logan%s","password":"loganpass"}`, nonce)
+		c.expect("1", "login-reply", `{"success":true,"account_id":"%s"}`, logan.ID())
+	})
+
+	Convey("Wrong one-time passwords lock out the second factor", func() {
+		am := s.backend.AccountManager()
+		otp, err := am.GenerateOTP(ctx, s.app.heim, kms, logan, proto.OTPForLogin)
+		So(err, ShouldBeNil)
+		So(am.ValidateOTP(ctx, kms, logan.ID(), proto.OTPForLogin, oneTimePassword(otp.URI)), ShouldBeNil)
+		loganKey := logan.KeyFromPassword("loganpass")
+		codes, err := am.GenerateOTPRecoveryCodes(ctx, logan, loganKey)
+		So(err, ShouldBeNil)
+
+		c := connect()
+		defer c.Close()
+		for i := 0; i < proto.OTPMaxFailedAttempts-1; i++ {
+			c.send("1", "login", `{"namespace":"email","id":"logan%s","password":"loganpass","otp":"000000"}`, nonce)
+			c.expect("1", "login-reply", `{"success":false,"reason":"access denied","otp_required":true}`)
+		}
+
+		// Wrong recovery codes count too.
+		c.send("2", "login", `{"namespace":"email","id":"logan%s","password":"loganpass","otp":"00000-00000"}`, nonce)
+		c.expect("2", "login-reply", `{"success":false,"reason":"access denied","otp_required":true}`)
+
+		// Now even the right one-time password or recovery code is refused.
+		c.send("3", "login", `{"namespace":"email","id":"logan%s","password":"loganpass","otp":"%s"}`,
+			nonce, oneTimePassword(otp.URI))
+		c.expect("3", "login-reply", `{"success":false,"reason":"%s","otp_required":true}`, proto.ErrOTPLocked)
+		c.send("4", "login", `{"namespace":"email","id":"logan%s","password":"loganpass","otp":"%s"}`,
+			nonce, codes[0])
+		c.expect("4", "login-reply", `{"success":false,"reason":"%s","otp_required":true}`, proto.ErrOTPLocked)
+	})
+
+	Convey("Staff OTP is kept apart from login OTP", func() {
+		c := login()
+		defer c.Close()
+
+		am := s.backend.AccountManager()
+		So(am.GrantStaff(ctx, logan.ID(), s.kms.KMSCredential()), ShouldBeNil)
+		staffOTP, err := am.GenerateOTP(ctx, s.app.heim, kms, logan, proto.OTPForStaff)
+		So(err, ShouldBeNil)
+		So(am.ValidateOTP(ctx, kms, logan.ID(), proto.OTPForStaff, oneTimePassword(staffOTP.URI)), ShouldBeNil)
+
+		// A staff OTP doesn't turn on two-factor authentication for login.
+		c2 := connect()
+		c2.send("1", "login", `{"namespace":"email","id":"logan%s","password":"loganpass"}`, nonce)
+		c2.expect("1", "login-reply", `{"success":true,"account_id":"%s"}`, logan.ID())
+		c2.Close()
+
+		c.send("1", "enroll-otp", "")
+		capture := c.expect("1", "enroll-otp-reply", `{"uri":"*","qr_uri":"*"}`)
+		uri := capture["uri"].(string)
+		So(uri, ShouldNotEqual, staffOTP.URI)
+		c.send("2", "validate-otp", `{"password":"%s"}`, oneTimePassword(uri))
+		c.expect("2", "validate-otp-reply", `{"recovery_codes":"*"}`)
+
+		// The staff OTP can't stand in for the login OTP.
+		c.send("3", "disable-otp", `{"password":"loganpass","otp":"%s"}`, oneTimePassword(staffOTP.URI))
+		c.expectError("3", "disable-otp-reply", "%s", proto.ErrAccessDenied)
+
+		// Disabling the login OTP leaves the staff OTP in place.
+		c.send("4", "disable-otp", `{"password":"loganpass","otp":"%s"}`, oneTimePassword(uri))
+		c.expect("4", "disable-otp-reply", `{}`)
+		otp, err := am.OTP(ctx, kms, logan.ID(), proto.OTPForStaff)
+		So(err, ShouldBeNil)
+		So(otp, ShouldNotBeNil)
+		So(otp.URI, ShouldEqual, staffOTP.URI)
+		So(otp.Validated, ShouldBeTrue)
+	})
+}
+
+func testAccountSessions(s *serverUnderTest) {
+	ctx := scope.New()
+	kms := s.app.kms
+	nonce := fmt.Sprintf("%s", time.Now())
+	logan, _, err := s.Account(ctx, kms, "email", "logan"+nonce, "loganpass")
+	So(err, ShouldBeNil)
+
+	login := func(room string) *testConn {
+		c := s.Connect(room)
+		c.expectPing()
+		c.expectSnapshot(s.backend.Version(), nil, nil)
+		c.send("1", "login", `{"namespace":"email","id":"logan%s","password":"loganpass"}`, nonce)
+		c.expect("1", "login-reply", `{"success":true,"account_id":"%s"}`, logan.ID())
+		c = s.Reconnect(c, room)
+		c.expectPing()
+		c.expectSnapshot(s.backend.Version(), nil, nil)
+		return c
+	}
+
+	Convey("Session commands require login", func() {
+		c := s.Connect("accountsessions")
+		defer c.Close()
+		c.expectPing()
+		c.expectSnapshot(s.backend.Version(), nil, nil)
+		c.send("1", "list-sessions", "")
+		c.expectError("1", "list-sessions-reply", proto.ErrNotLoggedIn.Error())
+		c.send("2", "revoke-agent", `{"agent_id":"bogus"}`)
+		c.expectError("2", "revoke-agent-reply", proto.ErrNotLoggedIn.Error())
+	})
+
+	Convey("List and revoke", func() {
+		laptop := login("accountsessions1")
+		defer laptop.Close()
+		phone := login("accountsessions2")
+
+		phone.send("1", "list-sessions", "")
+		capture := phone.expect("1", "list-sessions-reply",
+			`{"sessions":[`+
+				`{"agent_id":"*","current":true,"created":"*","last_seen":"*","user_agent":"*","ip":"*"},`+
+				`{"agent_id":"*","created":"*","last_seen":"*","user_agent":"*","ip":"*"}]}`)
+		phoneID := capture["sessions[0].agent_id"].(string)
+		laptopID := capture["sessions[1].agent_id"].(string)
+		So(phoneID, ShouldNotEqual, laptopID)
+
+		phone.send("2", "revoke-agent", `{"agent_id":"%s"}`, phoneID)
+		phone.expectError("2", "revoke-agent-reply", "cannot revoke current agent, use logout instead")
+
+		laptop.send("1", "revoke-agent", `{"agent_id":"%s"}`, phoneID)
+		laptop.expect("1", "revoke-agent-reply", `{}`)
+		laptop.send("2", "revoke-agent", `{"agent_id":"%s"}`, phoneID)
+		laptop.expectError("2", "revoke-agent-reply", proto.ErrAgentNotFound.Error())
+
+		// The revoked agent's live session is logged out and disconnected.
+		phone.expect("", "logout-event", `{}`)
+		phone.expect("", "disconnect-event", `{"reason":"authentication changed"}`)
+		phone.Close()
+
+		// Reconnecting with the revoked agent finds it logged out.
+		phone.accountID = ""
+		phone = s.Reconnect(phone, "accountsessions2")
+		defer phone.Close()
+		phone.expectPing()
+		phone.expectSnapshot(s.backend.Version(), nil, nil)
+		phone.send("1", "list-sessions", "")
+		phone.expectError("1", "list-sessions-reply", proto.ErrNotLoggedIn.Error())
+
+		laptop.send("3", "list-sessions", "")
+		capture = laptop.expect("3", "list-sessions-reply",
+			`{"sessions":[{"agent_id":"*","current":true,"created":"*","last_seen":"*","user_agent":"*","ip":"*"}]}`)
+		So(capture["sessions[0].agent_id"], ShouldEqual, laptopID)
+	})
+}
+
+func testAccountDeletion(s *serverUnderTest) {
+	ctx := scope.New()
+	kms := s.app.kms
+	am := s.backend.AccountManager()
+	nonce := fmt.Sprintf("%s", time.Now())
+
+	login := func(name, room string) (proto.Account, *testConn) {
+		account, _, err := s.Account(ctx, kms, "email", name+nonce, "password")
+		So(err, ShouldBeNil)
+		c := s.Connect(room)
+		c.expectPing()
+		c.expectSnapshot(s.backend.Version(), nil, nil)
+		c.send("1", "login", `{"namespace":"email","id":"%s%s","password":"password"}`, name, nonce)
+		c.expect("1", "login-reply", `{"success":true,"account_id":"%s"}`, account.ID())
+		c = s.Reconnect(c, room)
+		c.expectPing()
+		c.expectSnapshot(s.backend.Version(), nil, nil)
+		return account, c
+	}
+
+	Convey("Commands require login", func() {
+		c := s.Connect("accountdeletion")
+		defer c.Close()
+		c.expectPing()
+		c.expectSnapshot(s.backend.Version(), nil, nil)
+		c.send("1", "export-account-data", `{"password":"password"}`)
+		c.expectError("1", "export-account-data-reply", proto.ErrNotLoggedIn.Error())
+		c.send("2", "delete-account", `{"password":"password"}`)
+		c.expectError("2", "delete-account-reply", proto.ErrNotLoggedIn.Error())
+		c.send("3", "cancel-account-deletion", "")
+		c.expectError("3", "cancel-account-deletion-reply", proto.ErrNotLoggedIn.Error())
+	})
+
+	Convey("Export", func() {
+		_, c := login("exporter", "accountexport")
+		defer c.Close()
+
+		c.send("2", "nick", `{"name":"exporter"}`)
+		c.expect("2", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"exporter"}`)
+		c.send("3", "send", `{"content":"remember me"}`)
+		c.expect("3", "send-reply", `{"id":"*","time":"*","sender":"*","content":"remember me"}`)
+
+		c.send("4", "export-account-data", `{"password":"wrongpass"}`)
+		c.expectError("4", "export-account-data-reply", proto.ErrAccessDenied.Error())
+
+		c.send("5", "export-account-data", `{"password":"password"}`)
+		capture := c.expect("5", "export-account-data-reply", `{"url":"*","expires":"*"}`)
+
+		resp, err := http.Get(s.server.URL + capture["url"].(string))
+		So(err, ShouldBeNil)
+		defer resp.Body.Close()
+		So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		So(resp.Header.Get("Content-Type"), ShouldEqual, "application/zip")
+		archive, err := ioutil.ReadAll(resp.Body)
+		So(err, ShouldBeNil)
+
+		zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+		So(err, ShouldBeNil)
+		files := map[string][]byte{}
+		for _, f := range zr.File {
+			r, err := f.Open()
+			So(err, ShouldBeNil)
+			files[f.Name], err = ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			r.Close()
+		}
+		So(string(files["account.json"]), ShouldContainSubstring, "exporter"+nonce)
+		So(string(files["messages.json"]), ShouldContainSubstring, `"content": "remember me"`)
+		So(string(files["messages.json"]), ShouldContainSubstring, `"room": "accountexport"`)
+		So(files, ShouldContainKey, "pms.json")
+		So(files, ShouldContainKey, "emails.json")
+
+		// Serve plain error responses in place of the error page.
+		s.app.pageTemplater = &templates.Templater{}
+		resp, err = http.Get(s.server.URL + "/prefs/export?token=bogus")
+		So(err, ShouldBeNil)
+		resp.Body.Close()
+		So(resp.StatusCode, ShouldEqual, http.StatusForbidden)
+	})
+
+	Convey("Deletion", func() {
+		account, c := login("deleter", "accountdeletion")
+		defer c.Close()
+
+		c.send("2", "nick", `{"name":"deleter"}`)
+		c.expect("2", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"deleter"}`)
+		c.send("3", "send", `{"content":"forget me"}`)
+		capture := c.expect("3", "send-reply", `{"id":"*","time":"*","sender":"*","content":"forget me"}`)
+		msgID := capture["id"].(string)
+
+		c.send("4", "cancel-account-deletion", "")
+		c.expectError("4", "cancel-account-deletion-reply", proto.ErrAccountDeletionNotRequested.Error())
+
+		c.send("5", "delete-account", `{"password":"wrongpass"}`)
+		c.expectError("5", "delete-account-reply", proto.ErrAccessDenied.Error())
+		c.send("6", "delete-account", `{"password":"password"}`)
+		c.expect("6", "delete-account-reply", `{"due":"*"}`)
+		c.send("7", "delete-account", `{"password":"password"}`)
+		c.expectError("7", "delete-account-reply", proto.ErrAccountDeletionRequested.Error())
+
+		first, err := am.DeletionRequest(ctx, account.ID())
+		So(err, ShouldBeNil)
+		So(first.Due.Sub(first.Requested), ShouldAlmostEqual, proto.AccountDeletionGracePeriod, time.Second)
+
+		// Canceling removes the queued job.
+		c.send("8", "cancel-account-deletion", "")
+		c.expect("8", "cancel-account-deletion-reply", `{}`)
+		_, err = am.DeletionRequest(ctx, account.ID())
+		So(err, ShouldEqual, proto.ErrAccountDeletionNotRequested)
+		jq, err := s.backend.Jobs().GetQueue(ctx, jobs.AccountQueue)
+		So(err, ShouldBeNil)
+		So(jq.Cancel(ctx, first.JobID), ShouldEqual, jobs.ErrJobNotFound)
+
+		c.send("9", "delete-account", `{"password":"password"}`)
+		c.expect("9", "delete-account-reply", `{"due":"*"}`)
+		second, err := am.DeletionRequest(ctx, account.ID())
+		So(err, ShouldBeNil)
+		So(second.JobID, ShouldNotEqual, first.JobID)
+
+		// Stale jobs are ignored, and current ones wait until they're due.
+		So(proto.ExecuteAccountDeletion(ctx, s.backend, account.ID(), first.JobID), ShouldBeNil)
+		So(proto.ExecuteAccountDeletion(ctx, s.backend, account.ID(), second.JobID), ShouldNotBeNil)
+		_, err = am.Get(ctx, account.ID())
+		So(err, ShouldBeNil)
+
+		// Live sessions are logged out and disconnected once it's gone.
+		So(proto.DeleteAccount(ctx, s.backend, account.ID()), ShouldBeNil)
+		c.expect("", "logout-event", `{}`)
+		c.expect("", "disconnect-event", `{"reason":"account deleted"}`)
+		_, err = am.Get(ctx, account.ID())
+		So(err, ShouldEqual, proto.ErrAccountNotFound)
+		_, err = am.Resolve(ctx, "email", "deleter"+nonce)
+		So(err, ShouldEqual, proto.ErrAccountNotFound)
+
+		// The message survives without its author.
+		room, err := s.backend.GetRoom(ctx, "accountdeletion")
+		So(err, ShouldBeNil)
+		var id snowflake.Snowflake
+		So(id.FromString(msgID), ShouldBeNil)
+		msg, err := room.GetMessage(ctx, id)
+		So(err, ShouldBeNil)
+		So(msg.Content, ShouldEqual, "forget me")
+		So(msg.Sender.ID, ShouldEqual, proto.DeletedUserID)
+		So(msg.Sender.Name, ShouldEqual, "")
+	})
+}
+
+func testStaffInvasion(s *serverUnderTest) {
+	Convey("Staff can use OTP to invade room", func() {
 		b := s.backend
 		ctx := scope.New()
 		kms := s.app.kms
@@ -3468,3 +4985,456 @@ func testPMs(s *serverUnderTest) {
 		c.expect("", "join-event", `{"session_id":"*","id":"account:%s","name":"r","server_id":"*","server_era":"*"}`, bob.ID())
 	})
 }
+
+func testAPITokens(s *serverUnderTest) {
+	ctx := scope.New()
+	kms := s.app.kms
+	nonce := fmt.Sprintf("%s", time.Now())
+	logan, _, err := s.Account(ctx, kms, "email", "logan"+nonce, "loganpass")
+	So(err, ShouldBeNil)
+
+	login := func() *testConn {
+		counter := time.Now().UnixNano()
+		c := s.Connect(fmt.Sprintf("apitokenlogin%d", counter))
+		c.expectPing()
+		c.expectSnapshot(s.backend.Version(), nil, nil)
+		c.send("1", "login", `{"namespace":"email","id":"logan%s","password":"loganpass"}`, nonce)
+		c.expect("1", "login-reply", `{"success":true,"account_id":"%s"}`, logan.ID())
+		c = s.Reconnect(c, fmt.Sprintf("apitokens%d", counter))
+		c.expectPing()
+		c.expectSnapshot(s.backend.Version(), nil, nil)
+		return c
+	}
+
+	createToken := func(c *testConn, id, tokenScope string) (string, string) {
+		c.send(id, "create-api-token", `{"name":"bot","scope":"%s"}`, tokenScope)
+		capture := c.expect(id, "create-api-token-reply",
+			`{"id":"*","name":"bot","scope":"%s","created":"*","expires":"*","token":"*"}`, tokenScope)
+		return capture["id"].(string), capture["token"].(string)
+	}
+
+	dial := func(roomName, token string) *http.Response {
+		headers := http.Header{}
+		headers.Set("Authorization", "Bearer "+token)
+		url := strings.Replace(s.server.URL, "http:", "ws:", 1) + "/room/" + roomName + "/ws"
+		_, resp, err := websocket.DefaultDialer.Dial(url, headers)
+		So(err, ShouldNotBeNil)
+		So(resp, ShouldNotBeNil)
+		return resp
+	}
+
+	Convey("Token management requires login", func() {
+		c := s.Connect("apitokens")
+		defer c.Close()
+		c.expectPing()
+		c.expectSnapshot(s.backend.Version(), nil, nil)
+		c.send("1", "create-api-token", `{"name":"bot","scope":"send"}`)
+		c.expectError("1", "create-api-token-reply", "not logged in")
+		c.send("2", "list-api-tokens", "")
+		c.expectError("2", "list-api-tokens-reply", "not logged in")
+	})
+
+	Convey("Create, list, and revoke", func() {
+		c := login()
+		defer c.Close()
+
+		c.send("1", "create-api-token", `{"name":"bot","scope":"everything"}`)
+		c.expectError("1", "create-api-token-reply", "invalid scope: everything")
+		c.send("2", "create-api-token", `{"name":"bot","scope":"send","lifetime":-1}`)
+		c.expectError("2", "create-api-token-reply", "lifetime must be between 1 and 31536000 seconds")
+
+		tokenID, _ := createToken(c, "3", "read-only")
+		c.send("4", "list-api-tokens", "")
+		c.expect("4", "list-api-tokens-reply",
+			`{"tokens":[{"id":"%s","name":"bot","scope":"read-only","created":"*","expires":"*"}]}`, tokenID)
+
+		c.send("5", "revoke-api-token", `{"id":"%s"}`, tokenID)
+		c.expect("5", "revoke-api-token-reply", `{}`)
+		c.send("6", "list-api-tokens", "")
+		c.expect("6", "list-api-tokens-reply", `{"tokens":[]}`)
+		c.send("7", "revoke-api-token", `{"id":"%s"}`, tokenID)
+		c.expectError("7", "revoke-api-token-reply", "api token not found")
+	})
+
+	Convey("Bearer token authenticates websocket as account", func() {
+		c := login()
+		_, token := createToken(c, "1", "send")
+		c.Close()
+
+		bot := s.ConnectWithAPIToken("apitokenbot", token, logan)
+		defer bot.Close()
+		So(bot.userID, ShouldEqual, fmt.Sprintf("account:%s", logan.ID()))
+		bot.expectPing()
+		bot.expectSnapshot(s.backend.Version(), nil, nil)
+
+		bot.send("1", "nick", `{"name":"bot"}`)
+		bot.expect("1", "nick-reply", `{"session_id":"%s","id":"%s","from":"","to":"bot"}`, bot.sessionID, bot.id())
+		bot.send("2", "send", `{"content":"beep"}`)
+		bot.expect("2", "send-reply", `{"id":"*","time":"*","sender":"*","content":"beep"}`)
+
+		// Account commands are never available to token sessions.
+		bot.send("3", "create-api-token", `{"name":"bot","scope":"manage"}`)
+		bot.expectError("3", "create-api-token-reply", "access denied")
+		bot.send("4", "logout", "")
+		bot.expectError("4", "logout-reply", "access denied")
+	})
+
+	Convey("Read-only token cannot send", func() {
+		c := login()
+		_, token := createToken(c, "1", "read-only")
+		c.Close()
+
+		bot := s.ConnectWithAPIToken("apitokenreader", token, logan)
+		defer bot.Close()
+		bot.expectPing()
+		bot.expectSnapshot(s.backend.Version(), nil, nil)
+
+		bot.send("1", "nick", `{"name":"bot"}`)
+		bot.expectError("1", "nick-reply", "access denied")
+		bot.send("2", "send", `{"content":"beep"}`)
+		bot.expectError("2", "send-reply", "access denied")
+		bot.send("3", "log", `{"n":10}`)
+		bot.expect("3", "log-reply", `{"log":[]}`)
+	})
+
+	Convey("Invalid, revoked, and expired tokens are rejected", func() {
+		resp := dial("apitokenbot", "not a token")
+		So(resp.StatusCode, ShouldEqual, http.StatusUnauthorized)
+
+		c := login()
+		tokenID, token := createToken(c, "1", "send")
+		c.send("2", "revoke-api-token", `{"id":"%s"}`, tokenID)
+		c.expect("2", "revoke-api-token-reply", `{}`)
+		c.Close()
+
+		resp = dial("apitokenbot", token)
+		So(resp.StatusCode, ShouldEqual, http.StatusUnauthorized)
+
+		expired, token, err := s.backend.AccountManager().CreateAPIToken(
+			ctx, logan.ID(), logan.KeyFromPassword("loganpass"), "expired", proto.APITokenSend, -time.Second)
+		So(err, ShouldBeNil)
+		So(expired.Expired(), ShouldBeTrue)
+		resp = dial("apitokenbot", token)
+		So(resp.StatusCode, ShouldEqual, http.StatusUnauthorized)
+	})
+}
+
+func testOIDCLogin(s *serverUnderTest) {
+	ctx := scope.New()
+	kms := s.app.kms
+	nonce := fmt.Sprintf("%d", time.Now().UnixNano())
+
+	idp, err := oidctest.NewServer()
+	So(err, ShouldBeNil)
+	defer idp.Close()
+
+	// Serve plain error responses in place of the error page.
+	s.app.pageTemplater = &templates.Templater{}
+	s.app.AddOIDCProvider("test", idp.Provider(s.server.URL+"/oidc/test/callback"))
+	namespace := "oidc:" + idp.URL
+
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	get := func(url string, cookies map[string]*http.Cookie) *http.Response {
+		req, err := http.NewRequest("GET", url, nil)
+		So(err, ShouldBeNil)
+		for _, cookie := range cookies {
+			req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+		}
+		resp, err := client.Do(req)
+		So(err, ShouldBeNil)
+		resp.Body.Close()
+		for _, cookie := range resp.Cookies() {
+			if cookie.MaxAge < 0 {
+				delete(cookies, cookie.Name)
+			} else {
+				cookies[cookie.Name] = cookie
+			}
+		}
+		return resp
+	}
+
+	// signIn walks through the redirects of a sign-in, returning the response
+	// to the callback along with the cookies held afterward.
+	signIn := func(user *oidctest.User, cookies []*http.Cookie, tamper func(url.Values)) (
+		*http.Response, []*http.Cookie) {
+
+		jar := map[string]*http.Cookie{}
+		for _, cookie := range cookies {
+			jar[cookie.Name] = cookie
+		}
+
+		idp.SignIn(user)
+		resp := get(s.server.URL+"/oidc/test/login?next=/room/oidc/", jar)
+		So(resp.StatusCode, ShouldEqual, http.StatusFound)
+		So(resp.Header.Get("Location"), ShouldStartWith, idp.URL+"/authorize?")
+
+		resp = get(resp.Header.Get("Location"), jar)
+		So(resp.StatusCode, ShouldEqual, http.StatusFound)
+		callback, err := url.Parse(resp.Header.Get("Location"))
+		So(err, ShouldBeNil)
+		So(callback.Path, ShouldEqual, "/oidc/test/callback")
+		if tamper != nil {
+			params := callback.Query()
+			tamper(params)
+			callback.RawQuery = params.Encode()
+		}
+
+		resp = get(callback.String(), jar)
+		_, ok := jar[oidcLoginCookieName]
+		So(ok, ShouldBeFalse)
+
+		result := []*http.Cookie{}
+		for _, cookie := range jar {
+			result = append(result, cookie)
+		}
+		return resp, result
+	}
+
+	connect := func(roomName string, cookies []*http.Cookie, account proto.Account) *testConn {
+		room, conn, resp := s.openConn(roomName, cookies, nil)
+		tc := &testConn{Conn: conn, cookies: resp.Cookies(), roomName: roomName, room: room}
+		if account != nil {
+			tc.accountID = account.ID().String()
+			tc.accountName = account.Name()
+			tc.accountEmail, _ = account.Email()
+			tc.accountPasswordUnset = !account.HasPassword()
+		}
+		tc.debug(true)
+		tc.expectHello()
+		So(tc.userID, ShouldStartWith, "account:")
+		return tc
+	}
+
+	Convey("New identities are registered", func() {
+		alice := &oidctest.User{Subject: "alice" + nonce}
+		resp, cookies := signIn(alice, nil, nil)
+		So(resp.StatusCode, ShouldEqual, http.StatusFound)
+		So(resp.Header.Get("Location"), ShouldEqual, "/room/oidc/")
+
+		account, err := s.backend.AccountManager().Resolve(ctx, namespace, alice.Subject)
+		So(err, ShouldBeNil)
+		pids := account.PersonalIdentities()
+		So(len(pids), ShouldEqual, 1)
+		So(pids[0].Namespace(), ShouldEqual, namespace)
+		So(pids[0].Verified(), ShouldBeTrue)
+
+		c := connect("oidc", cookies, account)
+		c.Close()
+
+		// Signing in again from a new agent finds the same account.
+		resp, cookies = signIn(alice, nil, nil)
+		So(resp.StatusCode, ShouldEqual, http.StatusFound)
+		c = connect("oidc", cookies, account)
+
+		// The account has no password until one is set.
+		So(account.HasPassword(), ShouldBeFalse)
+		c.expectPing()
+		c.expectSnapshot(s.backend.Version(), nil, nil)
+		c.send("1", "export-account-data", `{"password":""}`)
+		c.expectError("1", "export-account-data-reply", "%s", proto.ErrNoPassword)
+		c.send("2", "change-password", `{"old_password":"","new_password":"alicepass"}`)
+		c.expect("2", "change-password-reply", `{}`)
+		c.send("3", "export-account-data", `{"password":"alicepass"}`)
+		c.expect("3", "export-account-data-reply", `{"url":"*","expires":"*"}`)
+		c.Close()
+
+		account, err = s.backend.AccountManager().Get(ctx, account.ID())
+		So(err, ShouldBeNil)
+		So(account.HasPassword(), ShouldBeTrue)
+
+		// The new password logs in, and the provider still does.
+		c = s.Login(nil, namespace, alice.Subject, "alicepass")
+		c.Close()
+		resp, cookies = signIn(alice, nil, nil)
+		So(resp.StatusCode, ShouldEqual, http.StatusFound)
+		c = connect("oidc", cookies, account)
+		c.Close()
+	})
+
+	Convey("Logged-in accounts are linked", func() {
+		logan, loganKey, err := s.Account(ctx, kms, "email", "logan"+nonce, "loganpass")
+		So(err, ShouldBeNil)
+
+		c := s.Login(nil, "email", "logan"+nonce, "loganpass")
+		c.Close()
+
+		bob := &oidctest.User{Subject: "bob" + nonce}
+		resp, _ := signIn(bob, c.cookies, nil)
+		So(resp.StatusCode, ShouldEqual, http.StatusFound)
+
+		account, err := s.backend.AccountManager().Resolve(ctx, namespace, bob.Subject)
+		So(err, ShouldBeNil)
+		So(account.ID(), ShouldEqual, logan.ID())
+
+		// A fresh agent can now sign in to logan's account through the provider.
+		resp, cookies := signIn(bob, nil, nil)
+		So(resp.StatusCode, ShouldEqual, http.StatusFound)
+		c = connect("oidc", cookies, logan)
+		c.Close()
+
+		Convey("Identities can't be linked to a second account", func() {
+			_, _, err := s.Account(ctx, kms, "email", "max"+nonce, "maxpass")
+			So(err, ShouldBeNil)
+			c := s.Login(nil, "email", "max"+nonce, "maxpass")
+			c.Close()
+
+			resp, _ := signIn(bob, c.cookies, nil)
+			So(resp.StatusCode, ShouldEqual, http.StatusConflict)
+		})
+
+		Convey("Accounts with two-factor authentication need a one-time password", func() {
+			am := s.backend.AccountManager()
+			otp, err := am.GenerateOTP(ctx, s.app.heim, kms, logan, proto.OTPForLogin)
+			So(err, ShouldBeNil)
+			So(am.ValidateOTP(ctx, kms, logan.ID(), proto.OTPForLogin, oneTimePassword(otp.URI)), ShouldBeNil)
+			codes, err := am.GenerateOTPRecoveryCodes(ctx, logan, loganKey)
+			So(err, ShouldBeNil)
+
+			postOTP := func(cookies []*http.Cookie, password string) (*http.Response, []*http.Cookie) {
+				body := bytes.NewBufferString(fmt.Sprintf(`{"otp":"%s"}`, password))
+				req, err := http.NewRequest("POST", s.server.URL+"/oidc/test/otp", body)
+				So(err, ShouldBeNil)
+				for _, cookie := range cookies {
+					req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+				}
+				resp, err := client.Do(req)
+				So(err, ShouldBeNil)
+				resp.Body.Close()
+
+				jar := map[string]*http.Cookie{}
+				for _, cookie := range cookies {
+					jar[cookie.Name] = cookie
+				}
+				for _, cookie := range resp.Cookies() {
+					if cookie.MaxAge < 0 {
+						delete(jar, cookie.Name)
+					} else {
+						jar[cookie.Name] = cookie
+					}
+				}
+				result := []*http.Cookie{}
+				for _, cookie := range jar {
+					result = append(result, cookie)
+				}
+				return resp, result
+			}
+
+			hasCookie := func(cookies []*http.Cookie, name string) bool {
+				for _, cookie := range cookies {
+					if cookie.Name == name {
+						return true
+					}
+				}
+				return false
+			}
+
+			// The provider's word alone isn't enough.
+			resp, cookies := signIn(bob, nil, nil)
+			So(resp.StatusCode, ShouldEqual, http.StatusFound)
+			So(resp.Header.Get("Location"), ShouldEqual, "/oidc/test/otp")
+			So(hasCookie(cookies, oidcSecondFactorCookieName), ShouldBeTrue)
+
+			resp, cookies = postOTP(cookies, "000000")
+			So(resp.StatusCode, ShouldEqual, http.StatusForbidden)
+			So(hasCookie(cookies, oidcSecondFactorCookieName), ShouldBeTrue)
+
+			resp, cookies = postOTP(cookies, oneTimePassword(otp.URI))
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(hasCookie(cookies, oidcSecondFactorCookieName), ShouldBeFalse)
+			c := connect("oidc", cookies, logan)
+			c.Close()
+
+			// A recovery code may be given instead, but only once.
+			resp, cookies = signIn(bob, nil, nil)
+			So(resp.StatusCode, ShouldEqual, http.StatusFound)
+			resp, cookies = postOTP(cookies, codes[0])
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			c = connect("oidc", cookies, logan)
+			c.Close()
+
+			resp, cookies = signIn(bob, nil, nil)
+			So(resp.StatusCode, ShouldEqual, http.StatusFound)
+			resp, _ = postOTP(cookies, codes[0])
+			So(resp.StatusCode, ShouldEqual, http.StatusForbidden)
+
+			// Without a pending sign-in there's nothing to complete.
+			resp, _ = postOTP(nil, oneTimePassword(otp.URI))
+			So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("Wrong one-time passwords lock out the second factor", func() {
+			am := s.backend.AccountManager()
+			otp, err := am.GenerateOTP(ctx, s.app.heim, kms, logan, proto.OTPForLogin)
+			So(err, ShouldBeNil)
+			So(am.ValidateOTP(ctx, kms, logan.ID(), proto.OTPForLogin, oneTimePassword(otp.URI)), ShouldBeNil)
+
+			postOTP := func(cookies []*http.Cookie, password string) *http.Response {
+				body := bytes.NewBufferString(fmt.Sprintf(`{"otp":"%s"}`, password))
+				req, err := http.NewRequest("POST", s.server.URL+"/oidc/test/otp", body)
+				So(err, ShouldBeNil)
+				for _, cookie := range cookies {
+					req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+				}
+				resp, err := client.Do(req)
+				So(err, ShouldBeNil)
+				resp.Body.Close()
+				return resp
+			}
+
+			resp, cookies := signIn(bob, nil, nil)
+			So(resp.StatusCode, ShouldEqual, http.StatusFound)
+			for i := 0; i < proto.OTPMaxFailedAttempts; i++ {
+				So(postOTP(cookies, "000000").StatusCode, ShouldEqual, http.StatusForbidden)
+			}
+			So(postOTP(cookies, oneTimePassword(otp.URI)).StatusCode, ShouldEqual, http.StatusTooManyRequests)
+
+			// Signing in again doesn't reset the count.
+			resp, cookies = signIn(bob, nil, nil)
+			So(resp.StatusCode, ShouldEqual, http.StatusFound)
+			So(postOTP(cookies, oneTimePassword(otp.URI)).StatusCode, ShouldEqual, http.StatusTooManyRequests)
+		})
+
+		Convey("Links survive password changes", func() {
+			newKey := logan.KeyFromPassword("newpass")
+			So(s.backend.AccountManager().ChangeClientKey(ctx, kms, logan.ID(), loganKey, newKey), ShouldBeNil)
+
+			resp, cookies := signIn(bob, nil, nil)
+			So(resp.StatusCode, ShouldEqual, http.StatusFound)
+			c := connect("oidc", cookies, logan)
+			c.Close()
+		})
+
+		Convey("Links survive password resets", func() {
+			am := s.backend.AccountManager()
+			_, req, err := am.RequestPasswordReset(ctx, kms, "email", "logan"+nonce)
+			So(err, ShouldBeNil)
+			So(am.ConfirmPasswordReset(ctx, kms, req.String(), "resetpass"), ShouldBeNil)
+
+			resp, cookies := signIn(bob, nil, nil)
+			So(resp.StatusCode, ShouldEqual, http.StatusFound)
+			c := connect("oidc", cookies, logan)
+			c.Close()
+		})
+	})
+
+	Convey("Failed sign-ins", func() {
+		Convey("Denied by provider", func() {
+			resp, _ := signIn(nil, nil, nil)
+			So(resp.StatusCode, ShouldEqual, http.StatusForbidden)
+		})
+
+		Convey("Mismatched state", func() {
+			resp, _ := signIn(
+				&oidctest.User{Subject: "carol" + nonce}, nil, func(v url.Values) { v.Set("state", "forged") })
+			So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("Unknown provider", func() {
+			resp := get(s.server.URL+"/oidc/nope/login", map[string]*http.Cookie{})
+			So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+		})
+	})
+}
@@ -0,0 +1,151 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// The transports the integration tests are run over.
+const (
+	websocketTestTransport = "websocket"
+	sseTestTransport       = "SSE"
+)
+
+var testTransports = []string{websocketTestTransport, sseTestTransport}
+
+// A testTransport is the client end of a session. It's satisfied by
+// *websocket.Conn, and mimicked for other transports.
+type testTransport interface {
+	ReadMessage() (messageType int, data []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	Close() error
+	LocalAddr() net.Addr
+	Subprotocol() string
+}
+
+type sseAddr string
+
+func (a sseAddr) Network() string { return "sse" }
+func (a sseAddr) String() string  { return string(a) }
+
+// sseTestConn is the client end of an SSE stream. Commands written to it
+// are posted to the stream.
+type sseTestConn struct {
+	resp      *http.Response
+	events    *bufio.Reader
+	streamURL string
+	header    http.Header // credentials to post with
+}
+
+// dialSSE opens an SSE stream and reads the stream event that begins it.
+// The response is returned even if the stream couldn't be opened.
+func dialSSE(url string, headers http.Header) (*sseTestConn, *http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, values := range headers {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp, fmt.Errorf("sse: unexpected status: %s", resp.Status)
+	}
+
+	tc := &sseTestConn{resp: resp, events: bufio.NewReader(resp.Body), header: http.Header{}}
+	if auth := headers.Get("Authorization"); auth != "" {
+		tc.header.Set("Authorization", auth)
+	}
+	for _, cookie := range resp.Cookies() {
+		tc.header.Add("Cookie", (&http.Cookie{Name: cookie.Name, Value: cookie.Value}).String())
+	}
+	name, data, err := tc.readEvent()
+	if err != nil {
+		resp.Body.Close()
+		return nil, resp, err
+	}
+	if name != "stream" {
+		resp.Body.Close()
+		return nil, resp, fmt.Errorf("sse: expected stream event, got %q", name)
+	}
+	tc.streamURL = strings.SplitN(url, "?", 2)[0] + "/" + string(data)
+	return tc, resp, nil
+}
+
+func (tc *sseTestConn) readEvent() (name string, data []byte, err error) {
+	for {
+		line, err := tc.events.ReadString('\n')
+		if err != nil {
+			return "", nil, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if data != nil {
+				return name, data, nil
+			}
+		case strings.HasPrefix(line, "event: "):
+			name = line[len("event: "):]
+		case strings.HasPrefix(line, "data: "):
+			data = append(data, line[len("data: "):]...)
+		}
+	}
+}
+
+func (tc *sseTestConn) ReadMessage() (int, []byte, error) {
+	_, data, err := tc.readEvent()
+	if err != nil {
+		return 0, nil, err
+	}
+	return websocket.TextMessage, data, nil
+}
+
+func (tc *sseTestConn) WriteMessage(messageType int, data []byte) error {
+	switch messageType {
+	case websocket.CloseMessage:
+		return tc.Close()
+	case websocket.TextMessage:
+		resp, err := tc.post(data)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		io.Copy(ioutil.Discard, resp.Body)
+		if resp.StatusCode != http.StatusAccepted {
+			return fmt.Errorf("sse: unexpected status: %s", resp.Status)
+		}
+		return nil
+	default:
+		return fmt.Errorf("sse: unsupported message type: %d", messageType)
+	}
+}
+
+// post sends a command to the stream, with the credentials that opened it.
+func (tc *sseTestConn) post(data []byte) (*http.Response, error) {
+	req, err := http.NewRequest("POST", tc.streamURL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range tc.header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return http.DefaultClient.Do(req)
+}
+
+func (tc *sseTestConn) Close() error        { return tc.resp.Body.Close() }
+func (tc *sseTestConn) LocalAddr() net.Addr { return sseAddr(tc.streamURL) }
+func (tc *sseTestConn) Subprotocol() string { return "" }
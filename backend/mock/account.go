@@ -2,6 +2,7 @@ package mock
 
 import (
 	"fmt"
+	"sort"
 	"time"
 
 	"encoding/json"
@@ -38,6 +39,7 @@ type memAccount struct {
 	sec                proto.AccountSecurity
 	staffCapability    security.Capability
 	personalIdentities []proto.PersonalIdentity
+	noPassword         bool
 }
 
 func (a *memAccount) ID() snowflake.Snowflake { return a.id }
@@ -66,6 +68,8 @@ func (a *memAccount) Unlock(clientKey *security.ManagedKey) (*security.ManagedKe
 
 func (a *memAccount) IsStaff() bool { return a.staffCapability != nil }
 
+func (a *memAccount) HasPassword() bool { return !a.noPassword }
+
 func (a *memAccount) UnlockStaffKMS(clientKey *security.ManagedKey) (security.KMS, error) {
 	if a.staffCapability == nil {
 		return nil, proto.ErrAccessDenied
@@ -119,6 +123,11 @@ func (pid *personalIdentity) Namespace() string { return pid.namespace }
 func (pid *personalIdentity) ID() string        { return pid.id }
 func (pid *personalIdentity) Verified() bool    { return pid.verified }
 
+type otpKey struct {
+	accountID snowflake.Snowflake
+	purpose   proto.OTPPurpose
+}
+
 type accountManager struct {
 	b *TestBackend
 }
@@ -144,7 +153,7 @@ func (m *accountManager) VerifyPersonalIdentity(ctx scope.Context, namespace, id
 }
 
 func (m *accountManager) ChangeClientKey(
-	ctx scope.Context, accountID snowflake.Snowflake,
+	ctx scope.Context, kms security.KMS, accountID snowflake.Snowflake,
 	oldClientKey, newClientKey *security.ManagedKey) error {
 
 	m.b.Lock()
@@ -155,7 +164,29 @@ func (m *accountManager) ChangeClientKey(
 		return proto.ErrAccountNotFound
 	}
 
-	return account.(*memAccount).sec.ChangeClientKey(oldClientKey, newClientKey)
+	if err := account.(*memAccount).sec.ChangeClientKey(oldClientKey, newClientKey); err != nil {
+		return err
+	}
+	account.(*memAccount).noPassword = false
+	return m.rewrapExternalIdentities(kms, accountID, newClientKey)
+}
+
+// rewrapExternalIdentities replaces the copies of an account's client key held
+// for its linked external identities. The caller must hold the lock.
+func (m *accountManager) rewrapExternalIdentities(
+	kms security.KMS, accountID snowflake.Snowflake, clientKey *security.ManagedKey) error {
+
+	for pidKey, old := range m.b.externalIDs {
+		if old.AccountID != accountID {
+			continue
+		}
+		key, err := proto.NewExternalIdentityKey(kms, accountID, old.Namespace, old.ID, clientKey)
+		if err != nil {
+			return err
+		}
+		m.b.externalIDs[pidKey] = key
+	}
+	return nil
 }
 
 func (m *accountManager) Register(
@@ -179,6 +210,7 @@ func (m *accountManager) Register(
 	if namespace == "email" {
 		account.(*memAccount).email = id
 	}
+	account.(*memAccount).noPassword = password == ""
 
 	if m.b.accounts == nil {
 		m.b.accounts = map[snowflake.Snowflake]proto.Account{account.ID(): account}
@@ -352,6 +384,10 @@ func (m *accountManager) ConfirmPasswordReset(
 	}
 
 	account.(*memAccount).sec = *sec
+	account.(*memAccount).noPassword = false
+	if err := m.rewrapExternalIdentities(kms, account.ID(), account.KeyFromPassword(password)); err != nil {
+		return err
+	}
 	for id, req := range m.b.resetReqs {
 		if req.AccountID == account.ID() {
 			delete(m.b.resetReqs, id)
@@ -412,19 +448,28 @@ func (m *accountManager) ChangeName(ctx scope.Context, accountID snowflake.Snowf
 	return nil
 }
 
-func (m *accountManager) OTP(ctx scope.Context, kms security.KMS, accountID snowflake.Snowflake) (*proto.OTP, error) {
-	return m.b.otps[accountID], nil
+func (m *accountManager) OTP(
+	ctx scope.Context, kms security.KMS, accountID snowflake.Snowflake, purpose proto.OTPPurpose) (*proto.OTP, error) {
+
+	m.b.Lock()
+	defer m.b.Unlock()
+
+	return m.b.otps[otpKey{accountID, purpose}], nil
 }
 
-func (m *accountManager) GenerateOTP(ctx scope.Context, heim *proto.Heim, kms security.KMS, account proto.Account) (*proto.OTP, error) {
+func (m *accountManager) GenerateOTP(
+	ctx scope.Context, heim *proto.Heim, kms security.KMS, account proto.Account, purpose proto.OTPPurpose) (
+	*proto.OTP, error) {
+
 	m.b.Lock()
 	defer m.b.Unlock()
 
 	if m.b.otps == nil {
-		m.b.otps = map[snowflake.Snowflake]*proto.OTP{}
+		m.b.otps = map[otpKey]*proto.OTP{}
 	}
 
-	old, ok := m.b.otps[account.ID()]
+	key := otpKey{account.ID(), purpose}
+	old, ok := m.b.otps[key]
 	if ok && old.Validated {
 		return nil, proto.ErrOTPAlreadyEnrolled
 	}
@@ -434,23 +479,470 @@ func (m *accountManager) GenerateOTP(ctx scope.Context, heim *proto.Heim, kms se
 		return nil, err
 	}
 
-	m.b.otps[account.ID()] = otp
+	m.b.otps[key] = otp
 	return otp, nil
 }
 
-func (m *accountManager) ValidateOTP(ctx scope.Context, kms security.KMS, accountID snowflake.Snowflake, password string) error {
+func (m *accountManager) ValidateOTP(
+	ctx scope.Context, kms security.KMS, accountID snowflake.Snowflake, purpose proto.OTPPurpose,
+	password string) error {
+
 	m.b.Lock()
 	defer m.b.Unlock()
 
-	otp, ok := m.b.otps[accountID]
+	key := otpKey{accountID, purpose}
+	otp, ok := m.b.otps[key]
 	if !ok {
 		return proto.ErrOTPNotEnrolled
 	}
 
+	now := time.Now()
+	failures := m.b.otpFailures[key]
+	if failures.Locked(now) {
+		return proto.ErrOTPLocked
+	}
+
 	if err := otp.Validate(password); err != nil {
+		if err == proto.ErrAccessDenied {
+			if m.b.otpFailures == nil {
+				m.b.otpFailures = map[otpKey]proto.OTPFailures{}
+			}
+			m.b.otpFailures[key] = failures.Fail(now)
+		}
 		return err
 	}
 
-	m.b.otps[accountID].Validated = true
+	delete(m.b.otpFailures, key)
+	otp.Validated = true
+	return nil
+}
+
+func (m *accountManager) DisableOTP(ctx scope.Context, accountID snowflake.Snowflake, purpose proto.OTPPurpose) error {
+	m.b.Lock()
+	defer m.b.Unlock()
+
+	key := otpKey{accountID, purpose}
+	if _, ok := m.b.otps[key]; !ok {
+		return proto.ErrOTPNotEnrolled
+	}
+	delete(m.b.otps, key)
+	delete(m.b.otpFailures, key)
+	if purpose == proto.OTPForLogin {
+		delete(m.b.otpRecovery, accountID)
+	}
+	return nil
+}
+
+func (m *accountManager) GenerateOTPRecoveryCodes(
+	ctx scope.Context, account proto.Account, clientKey *security.ManagedKey) ([]string, error) {
+
+	codes, err := proto.NewOTPRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := proto.EncryptOTPRecoveryCodes(account, clientKey, codes)
+	if err != nil {
+		return nil, err
+	}
+
+	m.b.Lock()
+	defer m.b.Unlock()
+
+	if _, ok := m.b.otps[otpKey{account.ID(), proto.OTPForLogin}]; !ok {
+		return nil, proto.ErrOTPNotEnrolled
+	}
+
+	if m.b.otpRecovery == nil {
+		m.b.otpRecovery = map[snowflake.Snowflake]*proto.OTPRecoveryCodes{account.ID(): rc}
+	} else {
+		m.b.otpRecovery[account.ID()] = rc
+	}
+	return codes, nil
+}
+
+func (m *accountManager) UseOTPRecoveryCode(
+	ctx scope.Context, account proto.Account, clientKey *security.ManagedKey, code string) error {
+
+	m.b.Lock()
+	defer m.b.Unlock()
+
+	now := time.Now()
+	key := otpKey{account.ID(), proto.OTPForLogin}
+	failures := m.b.otpFailures[key]
+	if failures.Locked(now) {
+		return proto.ErrOTPLocked
+	}
+
+	rc, ok := m.b.otpRecovery[account.ID()]
+	if !ok {
+		return proto.ErrAccessDenied
+	}
+
+	codes, err := rc.Decrypt(account, clientKey)
+	if err != nil {
+		return err
+	}
+
+	codes, ok = proto.RedeemOTPRecoveryCode(codes, code)
+	if !ok {
+		if m.b.otpFailures == nil {
+			m.b.otpFailures = map[otpKey]proto.OTPFailures{}
+		}
+		m.b.otpFailures[key] = failures.Fail(now)
+		return proto.ErrAccessDenied
+	}
+
+	rc, err = proto.EncryptOTPRecoveryCodes(account, clientKey, codes)
+	if err != nil {
+		return err
+	}
+	m.b.otpRecovery[account.ID()] = rc
+	delete(m.b.otpFailures, key)
+	return nil
+}
+
+func (m *accountManager) CreateAPIToken(
+	ctx scope.Context, accountID snowflake.Snowflake, clientKey *security.ManagedKey,
+	name string, tokenScope proto.APITokenScope, lifetime time.Duration) (*proto.APIToken, string, error) {
+
+	m.b.Lock()
+	defer m.b.Unlock()
+
+	if _, ok := m.b.accounts[accountID]; !ok {
+		return nil, "", proto.ErrAccountNotFound
+	}
+
+	token, secret, err := proto.NewAPIToken(accountID, clientKey, name, tokenScope, lifetime)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if m.b.apiTokens == nil {
+		m.b.apiTokens = map[snowflake.Snowflake]*proto.APIToken{token.ID: token}
+	} else {
+		m.b.apiTokens[token.ID] = token
+	}
+	return token, secret, nil
+}
+
+func (m *accountManager) APITokens(ctx scope.Context, accountID snowflake.Snowflake) ([]*proto.APIToken, error) {
+	m.b.Lock()
+	defer m.b.Unlock()
+
+	tokens := []*proto.APIToken{}
+	for _, token := range m.b.apiTokens {
+		if token.AccountID == accountID && !token.Expired() {
+			tokens = append(tokens, token)
+		}
+	}
+	sort.Sort(apiTokenList(tokens))
+	return tokens, nil
+}
+
+func (m *accountManager) RevokeAPIToken(ctx scope.Context, accountID, tokenID snowflake.Snowflake) error {
+	m.b.Lock()
+	defer m.b.Unlock()
+
+	token, ok := m.b.apiTokens[tokenID]
+	if !ok || token.AccountID != accountID {
+		return proto.ErrAPITokenNotFound
+	}
+	delete(m.b.apiTokens, tokenID)
+	return nil
+}
+
+func (m *accountManager) ResolveAPIToken(ctx scope.Context, secret string) (
+	*proto.APIToken, proto.Account, *security.ManagedKey, error) {
+
+	tokenID, tokenKey, err := proto.ParseAPIToken(secret)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	m.b.Lock()
+	defer m.b.Unlock()
+
+	token, ok := m.b.apiTokens[tokenID]
+	if !ok || token.Expired() {
+		return nil, nil, nil, proto.ErrAccessDenied
+	}
+
+	account, ok := m.b.accounts[token.AccountID]
+	if !ok {
+		return nil, nil, nil, proto.ErrAccessDenied
+	}
+
+	clientKey, err := token.Unlock(tokenKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return token, account, clientKey, nil
+}
+
+func (m *accountManager) LinkExternalIdentity(
+	ctx scope.Context, kms security.KMS, accountID snowflake.Snowflake, namespace, id string,
+	clientKey *security.ManagedKey) error {
+
+	key, err := proto.NewExternalIdentityKey(kms, accountID, namespace, id, clientKey)
+	if err != nil {
+		return err
+	}
+
+	m.b.Lock()
+	defer m.b.Unlock()
+
+	account, ok := m.b.accounts[accountID]
+	if !ok {
+		return proto.ErrAccountNotFound
+	}
+
+	pidKey := fmt.Sprintf("%s:%s", namespace, id)
+	pid, ok := m.b.accountIDs[pidKey]
+	switch {
+	case !ok:
+		pid = &personalIdentity{
+			accountID: accountID,
+			namespace: namespace,
+			id:        id,
+		}
+		memAcc := account.(*memAccount)
+		memAcc.personalIdentities = append(memAcc.personalIdentities, pid)
+		if m.b.accountIDs == nil {
+			m.b.accountIDs = map[string]*personalIdentity{pidKey: pid}
+		} else {
+			m.b.accountIDs[pidKey] = pid
+		}
+	case pid.accountID != accountID:
+		return proto.ErrPersonalIdentityInUse
+	}
+	pid.verified = true
+
+	if m.b.externalIDs == nil {
+		m.b.externalIDs = map[string]*proto.ExternalIdentityKey{pidKey: key}
+	} else {
+		m.b.externalIDs[pidKey] = key
+	}
+	return nil
+}
+
+func (m *accountManager) UnlockExternalIdentity(
+	ctx scope.Context, kms security.KMS, namespace, id string) (proto.Account, *security.ManagedKey, error) {
+
+	m.b.Lock()
+	defer m.b.Unlock()
+
+	key, ok := m.b.externalIDs[fmt.Sprintf("%s:%s", namespace, id)]
+	if !ok {
+		return nil, nil, proto.ErrAccountNotFound
+	}
+
+	account, ok := m.b.accounts[key.AccountID]
+	if !ok {
+		return nil, nil, proto.ErrAccountNotFound
+	}
+
+	clientKey, err := key.Unlock(kms)
+	if err != nil {
+		return nil, nil, err
+	}
+	return account, clientKey, nil
+}
+
+type apiTokenList []*proto.APIToken
+
+func (l apiTokenList) Len() int           { return len(l) }
+func (l apiTokenList) Less(i, j int) bool { return l[i].ID < l[j].ID }
+func (l apiTokenList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+func (m *accountManager) ExportData(ctx scope.Context, accountID snowflake.Snowflake) (*proto.AccountData, error) {
+	m.b.Lock()
+	defer m.b.Unlock()
+
+	if _, ok := m.b.accounts[accountID]; !ok {
+		return nil, proto.ErrAccountNotFound
+	}
+
+	userID := proto.UserID(fmt.Sprintf("account:%s", accountID))
+	data := &proto.AccountData{}
+
+	collect := func(roomName string, log *memLog) {
+		log.Lock()
+		defer log.Unlock()
+		for _, msg := range log.msgs {
+			if msg.Sender.ID == userID {
+				data.Messages = append(data.Messages, proto.AuthoredMessage{Room: roomName, Message: *msg})
+			}
+		}
+	}
+
+	for name, room := range m.b.rooms {
+		if r, ok := room.(*memRoom); ok {
+			collect(name, r.log)
+		}
+	}
+
+	m.b.pms.m.Lock()
+	for pmID, pm := range m.b.pms.pms {
+		if pm.pm.Initiator == accountID || pm.pm.Receiver == userID {
+			data.PMs = append(data.PMs, pm.pm)
+			collect(fmt.Sprintf("pm:%s", pmID), pm.log)
+		}
+	}
+	m.b.pms.m.Unlock()
+
+	m.b.et.m.Lock()
+	data.Emails = append(data.Emails, m.b.et.emailsByAccount[accountID]...)
+	m.b.et.m.Unlock()
+
+	return data, nil
+}
+
+func (m *accountManager) RequestDeletion(
+	ctx scope.Context, accountID, jobID snowflake.Snowflake, due time.Time) error {
+
+	m.b.Lock()
+	defer m.b.Unlock()
+
+	if _, ok := m.b.accounts[accountID]; !ok {
+		return proto.ErrAccountNotFound
+	}
+
+	if _, ok := m.b.deletions[accountID]; ok {
+		return proto.ErrAccountDeletionRequested
+	}
+
+	req := &proto.AccountDeletionRequest{
+		AccountID: accountID,
+		JobID:     jobID,
+		Requested: time.Now(),
+		Due:       due,
+	}
+	if m.b.deletions == nil {
+		m.b.deletions = map[snowflake.Snowflake]*proto.AccountDeletionRequest{accountID: req}
+	} else {
+		m.b.deletions[accountID] = req
+	}
+	return nil
+}
+
+func (m *accountManager) DeletionRequest(
+	ctx scope.Context, accountID snowflake.Snowflake) (*proto.AccountDeletionRequest, error) {
+
+	m.b.Lock()
+	defer m.b.Unlock()
+
+	if _, ok := m.b.accounts[accountID]; !ok {
+		return nil, proto.ErrAccountNotFound
+	}
+
+	req, ok := m.b.deletions[accountID]
+	if !ok {
+		return nil, proto.ErrAccountDeletionNotRequested
+	}
+	return req, nil
+}
+
+func (m *accountManager) CancelDeletion(
+	ctx scope.Context, accountID snowflake.Snowflake) (*proto.AccountDeletionRequest, error) {
+
+	m.b.Lock()
+	defer m.b.Unlock()
+
+	req, ok := m.b.deletions[accountID]
+	if !ok {
+		return nil, proto.ErrAccountDeletionNotRequested
+	}
+	delete(m.b.deletions, accountID)
+	return req, nil
+}
+
+func (m *accountManager) Delete(ctx scope.Context, accountID snowflake.Snowflake) error {
+	m.b.Lock()
+	defer m.b.Unlock()
+
+	account, ok := m.b.accounts[accountID]
+	if !ok {
+		return proto.ErrAccountNotFound
+	}
+
+	userID := proto.UserID(fmt.Sprintf("account:%s", accountID))
+
+	anonymize := func(log *memLog) {
+		log.Lock()
+		defer log.Unlock()
+		for _, msg := range log.msgs {
+			if msg.Sender.ID == userID {
+				msg.Sender = proto.SessionView{IdentityView: proto.IdentityView{ID: proto.DeletedUserID}}
+			}
+		}
+	}
+
+	for _, room := range m.b.rooms {
+		r, ok := room.(*memRoom)
+		if !ok {
+			continue
+		}
+		anonymize(r.log)
+		r.m.Lock()
+		delete(r.nicks, userID)
+		for agentID := range r.sessionLog {
+			if agent, ok := m.b.agents[agentID]; ok && agent.AccountID == accountID.String() {
+				delete(r.sessionLog, agentID)
+			}
+		}
+		r.m.Unlock()
+		r.managerKey.Capabilities.(*capabilities).removeAccount(accountID)
+		if r.messageKey != nil {
+			r.messageKey.Capabilities.(*capabilities).removeAccount(accountID)
+		}
+		for _, key := range r.expiredMessageKeys {
+			key.Capabilities.(*capabilities).removeAccount(accountID)
+		}
+	}
+
+	m.b.pms.m.Lock()
+	for pmID, pm := range m.b.pms.pms {
+		if pm.pm.Initiator == accountID || pm.pm.Receiver == userID {
+			delete(m.b.pms.pms, pmID)
+		}
+	}
+	m.b.pms.m.Unlock()
+
+	m.b.et.m.Lock()
+	delete(m.b.et.emailsByAccount, accountID)
+	m.b.et.m.Unlock()
+
+	for _, pid := range account.PersonalIdentities() {
+		key := fmt.Sprintf("%s:%s", pid.Namespace(), pid.ID())
+		delete(m.b.accountIDs, key)
+		delete(m.b.externalIDs, key)
+	}
+
+	for agentID, agent := range m.b.agents {
+		if agent.AccountID == accountID.String() {
+			delete(m.b.agents, agentID)
+		}
+	}
+
+	for tokenID, token := range m.b.apiTokens {
+		if token.AccountID == accountID {
+			delete(m.b.apiTokens, tokenID)
+		}
+	}
+
+	for reqID, req := range m.b.resetReqs {
+		if req.AccountID == accountID {
+			delete(m.b.resetReqs, reqID)
+		}
+	}
+
+	delete(m.b.otps, otpKey{accountID, proto.OTPForStaff})
+	delete(m.b.otps, otpKey{accountID, proto.OTPForLogin})
+	delete(m.b.otpFailures, otpKey{accountID, proto.OTPForStaff})
+	delete(m.b.otpFailures, otpKey{accountID, proto.OTPForLogin})
+	delete(m.b.otpRecovery, accountID)
+	delete(m.b.deletions, accountID)
+	delete(m.b.accounts, accountID)
 	return nil
 }
@@ -1,6 +1,8 @@
 package mock
 
 import (
+	"sort"
+
 	"euphoria.io/heim/proto"
 	"euphoria.io/heim/proto/security"
 	"euphoria.io/heim/proto/snowflake"
@@ -66,3 +68,58 @@ func (t *agentTracker) ClearClientKey(ctx scope.Context, agentID string) error {
 	agent.AccountID = ""
 	return nil
 }
+
+func (t *agentTracker) AccountAgents(
+	ctx scope.Context, accountID snowflake.Snowflake) ([]*proto.AgentActivity, error) {
+
+	t.b.Lock()
+	defer t.b.Unlock()
+
+	activity := map[string]*proto.AgentActivity{}
+	for agentID, agent := range t.b.agents {
+		if agent.AccountID == accountID.String() {
+			activity[agentID] = &proto.AgentActivity{
+				AgentID:  agentID,
+				Created:  agent.Created,
+				LastSeen: agent.Created,
+			}
+		}
+	}
+
+	latest := map[string]*proto.Client{}
+	for _, room := range t.b.rooms {
+		mRoom, ok := room.(*memRoom)
+		if !ok {
+			continue
+		}
+		mRoom.m.Lock()
+		for _, client := range mRoom.sessionLog {
+			agentID := client.Agent.IDString()
+			if prev, ok := latest[agentID]; !ok || client.Connected.After(prev.Connected) {
+				latest[agentID] = client
+			}
+		}
+		mRoom.m.Unlock()
+	}
+
+	for agentID, client := range latest {
+		if a, ok := activity[agentID]; ok {
+			a.LastSeen = client.Connected
+			a.IP = client.IP
+			a.UserAgent = client.UserAgent
+		}
+	}
+
+	agents := make([]*proto.AgentActivity, 0, len(activity))
+	for _, a := range activity {
+		agents = append(agents, a)
+	}
+	sort.Sort(agentActivityList(agents))
+	return agents, nil
+}
+
+type agentActivityList []*proto.AgentActivity
+
+func (l agentActivityList) Len() int           { return len(l) }
+func (l agentActivityList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l agentActivityList) Less(i, j int) bool { return l[i].LastSeen.After(l[j].LastSeen) }
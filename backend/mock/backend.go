@@ -19,10 +19,15 @@ type TestBackend struct {
 	accountIDs     map[string]*personalIdentity
 	agents         map[string]*proto.Agent
 	agentBans      map[proto.UserID]time.Time
+	apiTokens      map[snowflake.Snowflake]*proto.APIToken
+	deletions      map[snowflake.Snowflake]*proto.AccountDeletionRequest
 	et             EmailTracker
+	externalIDs    map[string]*proto.ExternalIdentityKey
 	ipBans         map[string]time.Time
 	js             JobService
-	otps           map[snowflake.Snowflake]*proto.OTP
+	otps           map[otpKey]*proto.OTP
+	otpFailures    map[otpKey]proto.OTPFailures
+	otpRecovery    map[snowflake.Snowflake]*proto.OTPRecoveryCodes
 	pms            PMTracker
 	resetReqs      map[snowflake.Snowflake]*proto.PasswordResetRequest
 	rooms          map[string]proto.ManagedRoom
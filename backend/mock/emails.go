@@ -21,7 +21,7 @@ type EmailTracker struct {
 
 func (et *EmailTracker) Send(
 	ctx scope.Context, js jobs.JobService, templater *templates.Templater, deliverer emails.Deliverer,
-	account proto.Account, to, templateName string, data interface{}) (
+	account proto.Account, to, templateName string, data interface{}, options ...jobs.JobOption) (
 	*emails.EmailRef, error) {
 
 	if to == "" {
@@ -49,7 +49,8 @@ func (et *EmailTracker) Send(
 		AccountID: account.ID(),
 		EmailID:   ref.ID,
 	}
-	job, err := jq.AddAndClaim(ctx, jobs.EmailJobType, payload, "immediate", jobs.EmailJobOptions...)
+	options = append(append([]jobs.JobOption{}, jobs.EmailJobOptions...), options...)
+	job, err := jq.AddAndClaim(ctx, jobs.EmailJobType, payload, "immediate", options...)
 	if err != nil {
 		return nil, err
 	}
@@ -5,6 +5,7 @@ import (
 
 	"euphoria.io/heim/proto"
 	"euphoria.io/heim/proto/security"
+	"euphoria.io/heim/proto/snowflake"
 	"euphoria.io/scope"
 )
 
@@ -49,3 +50,28 @@ func (cs *capabilities) Remove(ctx scope.Context, cid string) error {
 	delete(cs.accounts, cid)
 	return nil
 }
+
+func (cs *capabilities) holders() []proto.Account {
+	cs.Lock()
+	defer cs.Unlock()
+
+	accounts := []proto.Account{}
+	for _, account := range cs.accounts {
+		if account != nil {
+			accounts = append(accounts, account)
+		}
+	}
+	return accounts
+}
+
+func (cs *capabilities) removeAccount(accountID snowflake.Snowflake) {
+	cs.Lock()
+	defer cs.Unlock()
+
+	for cid, account := range cs.accounts {
+		if account != nil && account.ID() == accountID {
+			delete(cs.capabilities, cid)
+			delete(cs.accounts, cid)
+		}
+	}
+}
@@ -60,6 +60,9 @@ type JobQueue struct {
 	name      string
 	available jobHeap
 	working   jobHeap
+	failed    []entry
+	schedules map[string]time.Time
+	scheduled map[string][]snowflake.Snowflake
 	logs      map[snowflake.Snowflake]map[int32]*jobs.JobLog
 }
 
@@ -107,15 +110,104 @@ func (jq *JobQueue) Add(
 	}
 
 	jq.m.Lock()
+	defer jq.m.Unlock()
+
+	if jobID, ok := jq.pending(job.IdempotencyKey); ok {
+		return jobID, jobs.ErrDuplicateJob
+	}
+
 	heap.Push(&jq.available, entry{Job: *job})
 	if jq.c != nil {
 		jq.c.Signal()
 	}
-	jq.m.Unlock()
+	return job.ID, nil
+}
+
+// pending returns the ID of the pending or claimed job with the given
+// idempotency key, if there is one.
+func (jq *JobQueue) pending(key string) (snowflake.Snowflake, bool) {
+	if key == "" {
+		return 0, false
+	}
+	for _, entry := range jq.available {
+		if entry.IdempotencyKey == key {
+			return entry.ID, true
+		}
+	}
+	for _, entry := range jq.working {
+		if entry.IdempotencyKey == key {
+			return entry.ID, true
+		}
+	}
+	return 0, false
+}
+
+func (jq *JobQueue) AddScheduled(
+	ctx scope.Context, schedule string, tick time.Time, jobType jobs.JobType, payload interface{},
+	options ...jobs.JobOption) (snowflake.Snowflake, error) {
+
+	job, err := jq.newJob(jobType, payload, options...)
+	if err != nil {
+		return 0, err
+	}
+
+	jq.m.Lock()
+	defer jq.m.Unlock()
+
+	if last, ok := jq.schedules[schedule]; ok && !last.Before(tick) {
+		return 0, jobs.ErrJobAlreadyScheduled
+	}
+	if jq.schedules == nil {
+		jq.schedules = map[string]time.Time{}
+	}
+	jq.schedules[schedule] = tick
+
+	if jobID, ok := jq.pending(job.IdempotencyKey); ok {
+		return jobID, nil
+	}
 
+	heap.Push(&jq.available, entry{Job: *job})
+	if jq.c != nil {
+		jq.c.Signal()
+	}
+	if jq.scheduled == nil {
+		jq.scheduled = map[string][]snowflake.Snowflake{}
+	}
+	jq.prune(schedule)
+	jq.scheduled[schedule] = append(jq.scheduled[schedule], job.ID)
 	return job.ID, nil
 }
 
+// prune discards the logs of the schedule's completed jobs, except for the
+// most recent. The caller must hold the lock.
+func (jq *JobQueue) prune(schedule string) {
+	var latest snowflake.Snowflake
+	kept := []snowflake.Snowflake{}
+	for _, jobID := range jq.scheduled[schedule] {
+		if !jq.completed(jobID) {
+			kept = append(kept, jobID)
+			continue
+		}
+		if latest != 0 {
+			delete(jq.logs, latest)
+		}
+		latest = jobID
+	}
+	if latest != 0 {
+		kept = append(kept, latest)
+	}
+	jq.scheduled[schedule] = kept
+}
+
+func (jq *JobQueue) completed(jobID snowflake.Snowflake) bool {
+	for _, jl := range jq.logs[jobID] {
+		if jl.Success {
+			return true
+		}
+	}
+	return false
+}
+
 func (jq *JobQueue) AddAndClaim(
 	ctx scope.Context, jobType jobs.JobType, payload interface{}, handlerID string, options ...jobs.JobOption) (
 	*jobs.Job, error) {
@@ -139,8 +231,12 @@ func (jq *JobQueue) AddAndClaim(
 	}
 
 	jq.m.Lock()
+	defer jq.m.Unlock()
+
+	if _, ok := jq.pending(job.IdempotencyKey); ok {
+		return nil, jobs.ErrDuplicateJob
+	}
 	heap.Push(&jq.working, e)
-	jq.m.Unlock()
 
 	return job, nil
 }
@@ -181,6 +277,13 @@ func (jq *JobQueue) Fail(ctx scope.Context, jobID snowflake.Snowflake, handlerID
 		Log:           log,
 	}
 	jq.release(jobID, 0)
+	for i, entry := range jq.available {
+		if entry.ID == jobID && entry.AttemptsRemaining <= 0 {
+			heap.Remove(&jq.available, i)
+			jq.failed = append(jq.failed, entry)
+			break
+		}
+	}
 	jq.c.Signal()
 	return nil
 }
@@ -197,7 +300,7 @@ func (jq *JobQueue) release(jobID snowflake.Snowflake, penalty int32) {
 		if entry.ID == jobID {
 			heap.Remove(&jq.working, i)
 			entry.AttemptsRemaining += penalty
-			entry.AttemptsMade = entry.JobClaim.AttemptNumber
+			entry.AttemptsMade = entry.JobClaim.AttemptNumber + 1
 			entry.JobClaim = nil
 			heap.Push(&jq.available, entry)
 			return
@@ -220,6 +323,13 @@ func (jq *JobQueue) remove(jobID snowflake.Snowflake, err error) error {
 		}
 	}
 
+	for i, entry := range jq.failed {
+		if entry.ID == jobID {
+			jq.failed = append(jq.failed[:i], jq.failed[i+1:]...)
+			return nil
+		}
+	}
+
 	return jobs.ErrJobNotFound
 }
 
@@ -245,6 +355,7 @@ func (jq *JobQueue) Stats(ctx scope.Context) (jobs.JobQueueStats, error) {
 			stats.Due++
 		}
 	}
+	stats.Failed = int64(len(jq.failed))
 	return stats, nil
 }
 
@@ -278,12 +389,22 @@ func (jq *JobQueue) TryClaim(ctx scope.Context, handlerID string) (*jobs.Job, er
 		return nil, jobs.ErrJobNotFound
 	}
 
-	e := heap.Pop(&jq.available).(entry)
+	// Due jobs go first, by priority. The heap only orders by due time, so
+	// look through all of them.
+	now := time.Now()
+	best := 0
+	for i, e := range jq.available {
+		if claimsBefore(e, jq.available[best], now) {
+			best = i
+		}
+	}
+
+	e := heap.Remove(&jq.available, best).(entry)
 	e.AttemptsRemaining -= 1
 	e.JobClaim = &jobs.JobClaim{
 		JobID:         e.ID,
 		HandlerID:     handlerID,
-		AttemptNumber: e.AttemptsMade + 1,
+		AttemptNumber: e.AttemptsMade,
 		Queue:         jq,
 	}
 	ret := &jobs.Job{}
@@ -291,7 +412,21 @@ func (jq *JobQueue) TryClaim(ctx scope.Context, handlerID string) (*jobs.Job, er
 	e.claimed = time.Now()
 	e.AttemptsMade += 1
 	heap.Push(&jq.working, e)
-	return &e.Job, nil
+	return ret, nil
+}
+
+func claimsBefore(a, b entry, now time.Time) bool {
+	aDue, bDue := !now.Before(a.Due), !now.Before(b.Due)
+	switch {
+	case aDue != bDue:
+		return aDue
+	case aDue && a.Priority != b.Priority:
+		return a.Priority > b.Priority
+	case !a.Due.Equal(b.Due):
+		return a.Due.Before(b.Due)
+	default:
+		return a.ID < b.ID
+	}
 }
 
 func (jq *JobQueue) TrySteal(ctx scope.Context, handlerID string) (*jobs.Job, error) {
@@ -324,16 +459,18 @@ func (jq *JobQueue) TrySteal(ctx scope.Context, handlerID string) (*jobs.Job, er
 		if entry.ID == jobID {
 			heap.Remove(&jq.available, i)
 			entry.claimed = now
-			entry.AttemptsMade += 1
 			entry.AttemptsRemaining -= 1
 			entry.JobClaim = &jobs.JobClaim{
 				JobID:         entry.ID,
 				HandlerID:     handlerID,
-				AttemptNumber: entry.AttemptsMade + 1,
+				AttemptNumber: entry.AttemptsMade,
 				Queue:         jq,
 			}
+			ret := &jobs.Job{}
+			*ret = entry.Job
+			entry.AttemptsMade += 1
 			heap.Push(&jq.working, entry)
-			return &entry.Job, nil
+			return ret, nil
 		}
 	}
 
@@ -353,3 +490,56 @@ func (jq *JobQueue) Log(ctx scope.Context, jobID snowflake.Snowflake, attempt in
 
 	return jl, nil
 }
+
+func (jq *JobQueue) ListFailed(ctx scope.Context, n int) ([]*jobs.Job, error) {
+	jq.m.Lock()
+	defer jq.m.Unlock()
+
+	failed := make([]*jobs.Job, 0, n)
+	for _, entry := range jq.failed {
+		if len(failed) >= n {
+			break
+		}
+		job := entry.Job
+		failed = append(failed, &job)
+	}
+	return failed, nil
+}
+
+func (jq *JobQueue) Retry(ctx scope.Context, jobID snowflake.Snowflake) error {
+	jq.m.Lock()
+	defer jq.m.Unlock()
+
+	for i, entry := range jq.failed {
+		if entry.ID == jobID {
+			if _, ok := jq.pending(entry.IdempotencyKey); ok {
+				return jobs.ErrDuplicateJob
+			}
+			jq.failed = append(jq.failed[:i], jq.failed[i+1:]...)
+			if entry.MaxAttempts < 1 {
+				entry.MaxAttempts = entry.AttemptsMade
+				if entry.MaxAttempts < 1 {
+					entry.MaxAttempts = 1
+				}
+			}
+			entry.AttemptsRemaining = entry.MaxAttempts
+			entry.Due = time.Now()
+			heap.Push(&jq.available, entry)
+			jq.c.Signal()
+			return nil
+		}
+	}
+	return jobs.ErrJobNotFound
+}
+
+func (jq *JobQueue) Purge(ctx scope.Context) (int64, error) {
+	jq.m.Lock()
+	defer jq.m.Unlock()
+
+	for _, entry := range jq.failed {
+		delete(jq.logs, entry.ID)
+	}
+	n := int64(len(jq.failed))
+	jq.failed = nil
+	return n, nil
+}
@@ -52,7 +52,7 @@ func (log *memLog) Latest(ctx scope.Context, n int, before snowflake.Snowflake)
 	}
 
 	slice := make([]*proto.Message, 0, n)
-	for _, msg := range log.msgs[start:] {
+	for _, msg := range log.msgs[start:end] {
 		if time.Time(msg.Deleted).IsZero() {
 			slice = append(slice, maybeTruncate(msg))
 			if len(slice) >= n {
@@ -114,9 +114,9 @@ func (pm *PM) ResolveNick(ctx scope.Context, userID proto.UserID) (string, bool,
 }
 
 func (pm *PM) Snapshot(
-	ctx scope.Context, session proto.Session, level proto.PrivilegeLevel, numMessages int) (*proto.SnapshotEvent, error) {
+	ctx scope.Context, session proto.Session, level proto.PrivilegeLevel, opts proto.SnapshotOptions) (*proto.SnapshotEvent, error) {
 
-	snapshot, err := pm.RoomBase.Snapshot(ctx, session, level, numMessages)
+	snapshot, err := pm.RoomBase.Snapshot(ctx, session, level, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -27,6 +27,7 @@ type RoomBase struct {
 	nicks       map[proto.UserID]string
 	live        map[proto.UserID][]proto.Session
 	clients     map[string]*proto.Client
+	sessionLog  map[string]*proto.Client // latest client of each agent, by agent ID
 	partWaiters map[string]chan struct{}
 	messageKey  *roomMessageKey
 }
@@ -82,6 +83,11 @@ func (r *RoomBase) Join(ctx scope.Context, session proto.Session) (string, error
 
 	r.live[id] = append(r.live[id], session)
 	r.clients[session.ID()] = client
+	if r.sessionLog == nil {
+		r.sessionLog = map[string]*proto.Client{client.Agent.IDString(): client}
+	} else {
+		r.sessionLog[client.Agent.IDString()] = client
+	}
 
 	event := proto.PresenceEvent(session.View(proto.Staff))
 	return "virt:" + event.RealClientAddress, r.broadcast(ctx, proto.JoinType, &event, session)
@@ -106,7 +112,7 @@ func (r *RoomBase) Part(ctx scope.Context, session proto.Session) error {
 	}
 	delete(r.clients, session.ID())
 	event := proto.PresenceEvent(session.View(proto.Staff))
-	return r.broadcast(ctx, proto.PartEventType, &event, session)
+	return r.broadcast(ctx, proto.PartType, &event, session)
 }
 
 func (r *RoomBase) Send(ctx scope.Context, session proto.Session, message proto.Message) (
@@ -185,7 +191,7 @@ func (r *RoomBase) broadcast(
 		}
 	}
 
-	if cmdType == proto.PartEventType {
+	if cmdType == proto.PartType {
 		if presence, ok := payload.(*proto.PresenceEvent); ok {
 			if waiter, ok := r.partWaiters[presence.SessionID]; ok {
 				r.m.Unlock()
@@ -237,7 +243,7 @@ func (r *RoomBase) ResolveNick(ctx scope.Context, userID proto.UserID) (string,
 }
 
 func (r *RoomBase) Snapshot(
-	ctx scope.Context, session proto.Session, level proto.PrivilegeLevel, numMessages int) (*proto.SnapshotEvent, error) {
+	ctx scope.Context, session proto.Session, level proto.PrivilegeLevel, opts proto.SnapshotOptions) (*proto.SnapshotEvent, error) {
 
 	snapshot := &proto.SnapshotEvent{
 		Identity:  session.Identity().ID(),
@@ -250,13 +256,16 @@ func (r *RoomBase) Snapshot(
 	if err != nil {
 		return nil, err
 	}
-	snapshot.Listing = listing
+	snapshot.Listing, snapshot.Counts = opts.ReduceListing(listing)
 
-	log, err := r.Latest(ctx, numMessages, 0)
-	if err != nil {
-		return nil, err
+	snapshot.Log = []proto.Message{}
+	if opts.NumMessages > 0 {
+		log, err := r.Latest(ctx, opts.NumMessages, 0)
+		if err != nil {
+			return nil, err
+		}
+		snapshot.Log = log
 	}
-	snapshot.Log = log
 	if level == proto.General {
 		for i := range snapshot.Log {
 			snapshot.Log[i].Sender.ClientAddress = ""
@@ -280,6 +289,17 @@ func (r *memRoom) MessageKey(ctx scope.Context) (proto.RoomMessageKey, error) {
 	return r.messageKey, nil
 }
 
+func (r *memRoom) MessageKeyHistory(ctx scope.Context) ([]proto.RoomMessageKey, error) {
+	if r.messageKey == nil {
+		return nil, nil
+	}
+	keys := []proto.RoomMessageKey{r.messageKey}
+	for _, key := range r.expiredMessageKeys {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
 func (r *memRoom) ManagerKey(ctx scope.Context) (proto.RoomManagerKey, error) {
 	return r.managerKey, nil
 }
@@ -324,6 +344,9 @@ type memRoom struct {
 
 	sec        *proto.RoomSecurity
 	managerKey *roomManagerKey
+
+	// expiredMessageKeys holds the keys messageKey replaced, newest first.
+	expiredMessageKeys []*roomMessageKey
 }
 
 func NewRoom(
@@ -406,6 +429,29 @@ func NewRoom(
 func (r *memRoom) Title() string { return fmt.Sprintf("&%s", r.name) }
 
 func (r *memRoom) GenerateMessageKey(ctx scope.Context, kms security.KMS) (proto.RoomMessageKey, error) {
+	return r.ReplaceMessageKey(ctx, kms, func(proto.RoomMessageKey) error { return nil })
+}
+
+func (r *memRoom) ReplaceMessageKey(
+	ctx scope.Context, kms security.KMS, grant func(proto.RoomMessageKey) error) (proto.RoomMessageKey, error) {
+
+	key, err := r.newMessageKey(kms)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := grant(key); err != nil {
+		return nil, err
+	}
+
+	if r.messageKey != nil {
+		r.expiredMessageKeys = append([]*roomMessageKey{r.messageKey}, r.expiredMessageKeys...)
+	}
+	r.messageKey = key
+	return key, nil
+}
+
+func (r *memRoom) newMessageKey(kms security.KMS) (*roomMessageKey, error) {
 	nonce, err := kms.GenerateNonce(security.AES128.KeySize())
 	if err != nil {
 		return nil, err
@@ -417,20 +463,21 @@ func (r *memRoom) GenerateMessageKey(ctx scope.Context, kms security.KMS) (proto
 	}
 
 	kp := r.managerKey.KeyPair()
-	r.messageKey = &roomMessageKey{
+	key := &roomMessageKey{
 		GrantManager: &proto.GrantManager{
 			Capabilities:     &capabilities{},
 			Managers:         r.managerKey,
 			KeyEncryptingKey: &r.sec.KeyEncryptingKey,
 			SubjectKeyPair:   &kp,
 			SubjectNonce:     nonce,
+			PayloadKey:       mkey,
 		},
 		timestamp: time.Now(),
 		nonce:     nonce,
 		key:       *mkey,
 	}
-	r.messageKey.id = fmt.Sprintf("%s", r.messageKey.timestamp)
-	return r.messageKey, nil
+	key.id = fmt.Sprintf("%s", key.timestamp)
+	return key, nil
 }
 
 func (r *memRoom) Ban(ctx scope.Context, ban proto.Ban, until time.Time) error {
@@ -475,6 +522,25 @@ func (r *memRoom) Ban(ctx scope.Context, ban proto.Ban, until time.Time) error {
 	}
 }
 
+func (r *memRoom) Disconnect(ctx scope.Context, reason string, exclude ...proto.Session) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	event := &proto.DisconnectEvent{Reason: reason}
+	for _, sessions := range r.live {
+		for _, session := range sessions {
+			if isExcluded(session, exclude) {
+				continue
+			}
+			if err := session.Send(ctx, proto.DisconnectEventType, event); err != nil {
+				// TODO: accumulate errors
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (r *memRoom) Unban(ctx scope.Context, ban proto.Ban) error {
 	r.m.Lock()
 	defer r.m.Unlock()
@@ -583,6 +649,10 @@ func (k *roomMessageKey) Timestamp() time.Time            { return k.timestamp }
 func (k *roomMessageKey) Nonce() []byte                   { return k.nonce }
 func (k *roomMessageKey) ManagedKey() security.ManagedKey { return k.key.Clone() }
 
+func (k *roomMessageKey) AccountHolders(ctx scope.Context) ([]proto.Account, error) {
+	return k.Capabilities.(*capabilities).holders(), nil
+}
+
 type roomManagerKey struct {
 	*proto.GrantManager
 	*proto.RoomSecurity
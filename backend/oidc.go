@@ -0,0 +1,176 @@
+package backend
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+const (
+	oidcLoginCookieName     = "o"
+	oidcLoginCookiePath     = "/oidc/"
+	oidcLoginCookieDuration = 10 * time.Minute
+
+	oidcSecondFactorCookieName     = "f"
+	oidcSecondFactorCookieDuration = 5 * time.Minute
+)
+
+// oidcNamespace returns the personal identity namespace for accounts vouched
+// for by the given issuer.
+func oidcNamespace(issuer string) string { return "oidc:" + issuer }
+
+// An oidcLogin tracks an authorization request in flight, between the
+// redirect to the provider and the provider's redirect back to us.
+type oidcLogin struct {
+	Provider string    `json:"p"`
+	State    string    `json:"s"`
+	Nonce    string    `json:"n"`
+	Next     string    `json:"r"`
+	Expires  time.Time `json:"e"`
+}
+
+func newOIDCLogin(provider, next string) (*oidcLogin, error) {
+	state, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only redirect back to a path on this site.
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		next = "/"
+	}
+
+	login := &oidcLogin{
+		Provider: provider,
+		State:    state,
+		Nonce:    nonce,
+		Next:     next,
+		Expires:  time.Now().Add(oidcLoginCookieDuration),
+	}
+	return login, nil
+}
+
+func (l *oidcLogin) Cookie(sc *securecookie.SecureCookie) (*http.Cookie, error) {
+	return encodeOIDCCookie(sc, oidcLoginCookieName, l, l.Expires)
+}
+
+func getOIDCLogin(sc *securecookie.SecureCookie, r *http.Request) (*oidcLogin, error) {
+	login := &oidcLogin{}
+	if err := decodeOIDCCookie(sc, r, oidcLoginCookieName, login); err != nil {
+		return nil, err
+	}
+	if time.Now().After(login.Expires) {
+		return nil, fmt.Errorf("login expired")
+	}
+	return login, nil
+}
+
+func clearOIDCLoginCookie() *http.Cookie { return clearOIDCCookie(oidcLoginCookieName) }
+
+// An oidcSecondFactor holds a sign-in that the provider vouched for, but
+// which is waiting on a one-time password because the account has two-factor
+// authentication enabled. Only the identity is kept; the account is unlocked
+// again once the second factor is given.
+type oidcSecondFactor struct {
+	Provider  string    `json:"p"`
+	Namespace string    `json:"ns"`
+	Subject   string    `json:"id"`
+	AccountID string    `json:"a"`
+	Next      string    `json:"r"`
+	Expires   time.Time `json:"e"`
+}
+
+func newOIDCSecondFactor(login *oidcLogin, namespace, subject, accountID string) *oidcSecondFactor {
+	return &oidcSecondFactor{
+		Provider:  login.Provider,
+		Namespace: namespace,
+		Subject:   subject,
+		AccountID: accountID,
+		Next:      login.Next,
+		Expires:   time.Now().Add(oidcSecondFactorCookieDuration),
+	}
+}
+
+func (f *oidcSecondFactor) Cookie(sc *securecookie.SecureCookie) (*http.Cookie, error) {
+	return encodeOIDCCookie(sc, oidcSecondFactorCookieName, f, f.Expires)
+}
+
+func getOIDCSecondFactor(sc *securecookie.SecureCookie, r *http.Request) (*oidcSecondFactor, error) {
+	f := &oidcSecondFactor{}
+	if err := decodeOIDCCookie(sc, r, oidcSecondFactorCookieName, f); err != nil {
+		return nil, err
+	}
+	if time.Now().After(f.Expires) {
+		return nil, fmt.Errorf("sign-in expired")
+	}
+	return f, nil
+}
+
+func clearOIDCSecondFactorCookie() *http.Cookie { return clearOIDCCookie(oidcSecondFactorCookieName) }
+
+func encodeOIDCCookie(sc *securecookie.SecureCookie, name string, v interface{}, expires time.Time) (
+	*http.Cookie, error) {
+
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	secured, err := sc.Encode(name, encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    secured,
+		Path:     oidcLoginCookiePath,
+		Expires:  expires,
+		HttpOnly: true,
+	}
+	if !Config.SetInsecureCookies {
+		cookie.Secure = true
+	}
+	return cookie, nil
+}
+
+func decodeOIDCCookie(sc *securecookie.SecureCookie, r *http.Request, name string, v interface{}) error {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return err
+	}
+
+	encoded := []byte{}
+	if err := sc.Decode(name, cookie.Value, &encoded); err != nil {
+		return err
+	}
+	return json.Unmarshal(encoded, v)
+}
+
+func clearOIDCCookie(name string) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Path:     oidcLoginCookiePath,
+		MaxAge:   -1,
+		HttpOnly: true,
+	}
+}
+
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
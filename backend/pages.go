@@ -13,6 +13,7 @@ const (
 	RoomPage          = "room.html"
 	ResetPasswordPage = "reset-password.html"
 	VerifyEmailPage   = "verify-email.html"
+	OIDCOTPPage       = "oidc-otp.html"
 )
 
 var PageScenarios = map[string]map[string]templates.TemplateTest{
@@ -41,6 +42,16 @@ var PageScenarios = map[string]map[string]templates.TemplateTest{
 			},
 		},
 	},
+	OIDCOTPPage: map[string]templates.TemplateTest{
+		"default": templates.TemplateTest{
+			Data: map[string]interface{}{
+				"Data": map[string]interface{}{
+					"provider": "test",
+					"next":     "/room/test/",
+				},
+			},
+		},
+	},
 }
 
 func ValidatePageTemplates(templater *templates.Templater) []error {
@@ -100,6 +111,11 @@ func (s *Server) serveErrorPage(message string, code int, w http.ResponseWriter,
 	params := map[string]interface{}{"Message": message, "Code": code}
 	content, err := s.pageTemplater.Evaluate("error.html", params)
 	if err != nil {
+		// Without an error page, fall back to a plain response.
+		if err == templates.ErrTemplateNotFound {
+			http.Error(w, message, code)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
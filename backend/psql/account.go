@@ -30,6 +30,7 @@ type Account struct {
 	EncryptedPrivateKey []byte         `db:"encrypted_private_key"`
 	PublicKey           []byte         `db:"public_key"`
 	StaffCapabilityID   sql.NullString `db:"staff_capability_id"`
+	PasswordSet         bool           `db:"has_password"`
 }
 
 func (a *Account) Bind(b *Backend) *AccountBinding {
@@ -62,12 +63,102 @@ func (awsc *AccountWithStaffCapability) Bind(b *Backend) *AccountBinding {
 }
 
 type OTP struct {
-	AccountID    string `db:"account_id"`
-	IV           []byte
-	EncryptedKey []byte `db:"encrypted_key"`
-	Digest       []byte
-	EncryptedURI []byte `db:"encrypted_uri"`
-	Validated    bool
+	AccountID              string `db:"account_id"`
+	Purpose                string
+	IV                     []byte
+	EncryptedKey           []byte `db:"encrypted_key"`
+	Digest                 []byte
+	EncryptedURI           []byte `db:"encrypted_uri"`
+	Validated              bool
+	RecoveryIV             []byte        `db:"recovery_iv"`
+	RecoveryDigest         []byte        `db:"recovery_digest"`
+	EncryptedRecoveryCodes []byte        `db:"encrypted_recovery_codes"`
+	FailedAttempts         int           `db:"failed_attempts"`
+	LastFailure            gorp.NullTime `db:"last_failure"`
+}
+
+func (o *OTP) Failures() proto.OTPFailures {
+	return proto.OTPFailures{Count: o.FailedAttempts, Last: o.LastFailure.Time}
+}
+
+type APIToken struct {
+	ID                 string
+	AccountID          string `db:"account_id"`
+	Name               string
+	Scope              string
+	IV                 []byte
+	MAC                []byte
+	EncryptedClientKey []byte `db:"encrypted_client_key"`
+	Created            time.Time
+	Expires            time.Time
+}
+
+func (t *APIToken) ToBackend() *proto.APIToken {
+	token := &proto.APIToken{
+		Name:  t.Name,
+		Scope: proto.APITokenScope(t.Scope),
+		IV:    t.IV,
+		MAC:   t.MAC,
+		EncryptedClientKey: &security.ManagedKey{
+			KeyType:    proto.ClientKeyType,
+			IV:         t.IV,
+			Ciphertext: t.EncryptedClientKey,
+		},
+		Created: t.Created,
+		Expires: t.Expires,
+	}
+	// ignore id parsing errors
+	_ = token.ID.FromString(t.ID)
+	_ = token.AccountID.FromString(t.AccountID)
+	return token
+}
+
+type ExternalIdentity struct {
+	Namespace          string
+	ID                 string
+	AccountID          string `db:"account_id"`
+	EncryptedSystemKey []byte `db:"encrypted_system_key"`
+	IV                 []byte
+	EncryptedClientKey []byte `db:"encrypted_client_key"`
+}
+
+func (e *ExternalIdentity) ToBackend() *proto.ExternalIdentityKey {
+	key := &proto.ExternalIdentityKey{
+		Namespace: e.Namespace,
+		ID:        e.ID,
+		SystemKey: security.ManagedKey{
+			KeyType:      proto.ClientKeyType,
+			Ciphertext:   e.EncryptedSystemKey,
+			ContextKey:   "identity",
+			ContextValue: e.Namespace + ":" + e.ID,
+		},
+		ClientKey: security.ManagedKey{
+			KeyType:    proto.ClientKeyType,
+			IV:         e.IV,
+			Ciphertext: e.EncryptedClientKey,
+		},
+	}
+	// ignore id parsing errors
+	_ = key.AccountID.FromString(e.AccountID)
+	return key
+}
+
+type AccountDeletion struct {
+	AccountID string `db:"account_id"`
+	JobID     int64  `db:"job_id"`
+	Requested time.Time
+	Due       time.Time
+}
+
+func (d *AccountDeletion) ToBackend() *proto.AccountDeletionRequest {
+	req := &proto.AccountDeletionRequest{
+		JobID:     snowflake.Snowflake(d.JobID),
+		Requested: d.Requested,
+		Due:       d.Due,
+	}
+	// ignore id parsing errors
+	_ = req.AccountID.FromString(d.AccountID)
+	return req
 }
 
 type PersonalIdentity struct {
@@ -190,6 +281,8 @@ func (ab *AccountBinding) Unlock(clientKey *security.ManagedKey) (*security.Mana
 
 func (ab *AccountBinding) IsStaff() bool { return ab.StaffCapability != nil }
 
+func (ab *AccountBinding) HasPassword() bool { return ab.PasswordSet }
+
 func (ab *AccountBinding) UnlockStaffKMS(clientKey *security.ManagedKey) (security.KMS, error) {
 	if ab.StaffCapability == nil {
 		return nil, proto.ErrAccessDenied
@@ -311,7 +404,7 @@ func (b *AccountManagerBinding) VerifyPersonalIdentity(ctx scope.Context, namesp
 }
 
 func (b *AccountManagerBinding) ChangeClientKey(
-	ctx scope.Context, accountID snowflake.Snowflake, oldKey, newKey *security.ManagedKey) error {
+	ctx scope.Context, kms security.KMS, accountID snowflake.Snowflake, oldKey, newKey *security.ManagedKey) error {
 
 	t, err := b.DbMap.Begin()
 	if err != nil {
@@ -341,7 +434,7 @@ func (b *AccountManagerBinding) ChangeClientKey(
 	}
 
 	res, err := t.Exec(
-		"UPDATE account SET mac = $2, encrypted_user_key = $3 WHERE id = $1",
+		"UPDATE account SET mac = $2, encrypted_user_key = $3, has_password = true WHERE id = $1",
 		accountID.String(), sec.MAC, sec.UserKey.Ciphertext)
 	if err != nil {
 		rollback()
@@ -358,6 +451,11 @@ func (b *AccountManagerBinding) ChangeClientKey(
 		return proto.ErrAccountNotFound
 	}
 
+	if err := rewrapExternalIdentities(t, kms, accountID, newKey); err != nil {
+		rollback()
+		return err
+	}
+
 	if err := t.Commit(); err != nil {
 		return err
 	}
@@ -430,6 +528,7 @@ func (b *AccountManagerBinding) Register(
 		EncryptedUserKey:    sec.UserKey.Ciphertext,
 		EncryptedPrivateKey: sec.KeyPair.EncryptedPrivateKey,
 		PublicKey:           sec.KeyPair.PublicKey,
+		PasswordSet:         password != "",
 	}
 	if namespace == "email" {
 		account.Email = id
@@ -801,7 +900,7 @@ func (b *AccountManagerBinding) ConfirmPasswordReset(
 	}
 
 	_, err = t.Exec(
-		"UPDATE account SET mac = $2, encrypted_user_key = $3 WHERE id = $1",
+		"UPDATE account SET mac = $2, encrypted_user_key = $3, has_password = true WHERE id = $1",
 		account.ID().String(), sec.MAC, sec.UserKey.Ciphertext)
 	if err != nil {
 		rollback(ctx, t)
@@ -809,6 +908,11 @@ func (b *AccountManagerBinding) ConfirmPasswordReset(
 		return err
 	}
 
+	if err := rewrapExternalIdentities(t, kms, account.ID(), account.KeyFromPassword(password)); err != nil {
+		rollback(ctx, t)
+		return err
+	}
+
 	_, err = t.Exec("UPDATE password_reset_request SET consumed = NOW() where id = $1", req.ID.String())
 	if err != nil {
 		rollback(ctx, t)
@@ -920,8 +1024,10 @@ func (b *AccountManagerBinding) ChangeEmail(ctx scope.Context, accountID snowfla
 	return false, nil
 }
 
-func (b *AccountManagerBinding) getRawOTP(db gorp.SqlExecutor, accountID snowflake.Snowflake) (*OTP, error) {
-	row, err := db.Get(OTP{}, accountID.String())
+func (b *AccountManagerBinding) getRawOTP(
+	db gorp.SqlExecutor, accountID snowflake.Snowflake, purpose proto.OTPPurpose) (*OTP, error) {
+
+	row, err := db.Get(OTP{}, accountID.String(), string(purpose))
 	if row == nil || err != nil {
 		if row == nil || err == sql.ErrNoRows {
 			return nil, proto.ErrOTPNotEnrolled
@@ -931,18 +1037,46 @@ func (b *AccountManagerBinding) getRawOTP(db gorp.SqlExecutor, accountID snowfla
 	return row.(*OTP), nil
 }
 
-func (b *AccountManagerBinding) getOTP(db gorp.SqlExecutor, kms security.KMS, accountID snowflake.Snowflake) (*proto.OTP, error) {
-	encryptedOTP, err := b.getRawOTP(db, accountID)
+// lockRawOTP reads an OTP row, locking it for the rest of the transaction.
+func (b *AccountManagerBinding) lockRawOTP(
+	db gorp.SqlExecutor, accountID snowflake.Snowflake, purpose proto.OTPPurpose) (*OTP, error) {
+
+	cols, err := allColumns(b.DbMap, OTP{}, "")
 	if err != nil {
 		return nil, err
 	}
 
+	var row OTP
+	err = db.SelectOne(
+		&row, fmt.Sprintf("SELECT %s FROM otp WHERE account_id = $1 AND purpose = $2 FOR UPDATE", cols),
+		accountID.String(), string(purpose))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, proto.ErrOTPNotEnrolled
+		}
+		return nil, err
+	}
+	return &row, nil
+}
+
+func (b *AccountManagerBinding) getOTP(
+	db gorp.SqlExecutor, kms security.KMS, accountID snowflake.Snowflake, purpose proto.OTPPurpose) (
+	*proto.OTP, error) {
+
+	encryptedOTP, err := b.getRawOTP(db, accountID, purpose)
+	if err != nil {
+		return nil, err
+	}
+	return b.decryptOTP(kms, encryptedOTP)
+}
+
+func (b *AccountManagerBinding) decryptOTP(kms security.KMS, encryptedOTP *OTP) (*proto.OTP, error) {
 	key := security.ManagedKey{
 		KeyType:      OTPKeyType,
 		IV:           encryptedOTP.IV,
 		Ciphertext:   encryptedOTP.EncryptedKey,
 		ContextKey:   "account",
-		ContextValue: accountID.String(),
+		ContextValue: encryptedOTP.AccountID,
 	}
 	if err := kms.DecryptKey(&key); err != nil {
 		return nil, err
@@ -960,11 +1094,16 @@ func (b *AccountManagerBinding) getOTP(db gorp.SqlExecutor, kms security.KMS, ac
 	return otp, nil
 }
 
-func (b *AccountManagerBinding) OTP(ctx scope.Context, kms security.KMS, accountID snowflake.Snowflake) (*proto.OTP, error) {
-	return b.getOTP(b.DbMap, kms, accountID)
+func (b *AccountManagerBinding) OTP(
+	ctx scope.Context, kms security.KMS, accountID snowflake.Snowflake, purpose proto.OTPPurpose) (*proto.OTP, error) {
+
+	return b.getOTP(b.DbMap, kms, accountID, purpose)
 }
 
-func (b *AccountManagerBinding) GenerateOTP(ctx scope.Context, heim *proto.Heim, kms security.KMS, account proto.Account) (*proto.OTP, error) {
+func (b *AccountManagerBinding) GenerateOTP(
+	ctx scope.Context, heim *proto.Heim, kms security.KMS, account proto.Account, purpose proto.OTPPurpose) (
+	*proto.OTP, error) {
+
 	encryptedKey, err := kms.GenerateEncryptedKey(OTPKeyType, "account", account.ID().String())
 	if err != nil {
 		return nil, err
@@ -985,7 +1124,7 @@ func (b *AccountManagerBinding) GenerateOTP(ctx scope.Context, heim *proto.Heim,
 		return nil, err
 	}
 
-	rawOTP, err := b.getRawOTP(t, account.ID())
+	rawOTP, err := b.getRawOTP(t, account.ID(), purpose)
 	if err != nil && err != proto.ErrOTPNotEnrolled {
 		rollback(ctx, t)
 		return nil, err
@@ -995,8 +1134,7 @@ func (b *AccountManagerBinding) GenerateOTP(ctx scope.Context, heim *proto.Heim,
 			rollback(ctx, t)
 			return nil, proto.ErrOTPAlreadyEnrolled
 		}
-		row := &OTP{AccountID: account.ID().String()}
-		if _, err := t.Delete(row); err != nil {
+		if _, err := t.Delete(rawOTP); err != nil {
 			rollback(ctx, t)
 			return nil, err
 		}
@@ -1016,6 +1154,7 @@ func (b *AccountManagerBinding) GenerateOTP(ctx scope.Context, heim *proto.Heim,
 
 	row := &OTP{
 		AccountID:    account.ID().String(),
+		Purpose:      string(purpose),
 		IV:           iv,
 		EncryptedKey: encryptedKey.Ciphertext,
 		Digest:       digest,
@@ -1035,29 +1174,56 @@ func (b *AccountManagerBinding) GenerateOTP(ctx scope.Context, heim *proto.Heim,
 	return otp, nil
 }
 
-func (b *AccountManagerBinding) ValidateOTP(ctx scope.Context, kms security.KMS, accountID snowflake.Snowflake, password string) error {
+func (b *AccountManagerBinding) ValidateOTP(
+	ctx scope.Context, kms security.KMS, accountID snowflake.Snowflake, purpose proto.OTPPurpose,
+	password string) error {
+
 	t, err := b.DbMap.Begin()
 	if err != nil {
 		return err
 	}
 
-	otp, err := b.getOTP(t, kms, accountID)
+	row, err := b.lockRawOTP(t, accountID, purpose)
 	if err != nil {
 		rollback(ctx, t)
 		return err
 	}
 
-	if err := otp.Validate(password); err != nil {
+	now := time.Now()
+	if row.Failures().Locked(now) {
+		rollback(ctx, t)
+		return proto.ErrOTPLocked
+	}
+
+	otp, err := b.decryptOTP(kms, row)
+	if err != nil {
 		rollback(ctx, t)
 		return err
 	}
 
-	if otp.Validated {
+	if err := otp.Validate(password); err != nil {
+		if err != proto.ErrAccessDenied {
+			rollback(ctx, t)
+			return err
+		}
+		if err := b.recordOTPFailure(t, row, now); err != nil {
+			rollback(ctx, t)
+			return err
+		}
+		if err := t.Commit(); err != nil {
+			return err
+		}
+		return proto.ErrAccessDenied
+	}
+
+	if otp.Validated && row.FailedAttempts == 0 {
 		rollback(ctx, t)
 		return nil
 	}
 
-	res, err := t.Exec("UPDATE otp SET validated = true WHERE account_id = $1", accountID.String())
+	res, err := t.Exec(
+		"UPDATE otp SET validated = true, failed_attempts = 0 WHERE account_id = $1 AND purpose = $2",
+		accountID.String(), string(purpose))
 	if err != nil {
 		rollback(ctx, t)
 		return err
@@ -1078,3 +1244,542 @@ func (b *AccountManagerBinding) ValidateOTP(ctx scope.Context, kms security.KMS,
 
 	return nil
 }
+
+// recordOTPFailure counts a wrong passcode against a row locked by lockRawOTP.
+func (b *AccountManagerBinding) recordOTPFailure(db gorp.SqlExecutor, row *OTP, now time.Time) error {
+	failures := row.Failures().Fail(now)
+	_, err := db.Exec(
+		"UPDATE otp SET failed_attempts = $3, last_failure = $4 WHERE account_id = $1 AND purpose = $2",
+		row.AccountID, row.Purpose, failures.Count, failures.Last)
+	return err
+}
+
+func (b *AccountManagerBinding) DisableOTP(
+	ctx scope.Context, accountID snowflake.Snowflake, purpose proto.OTPPurpose) error {
+
+	res, err := b.DbMap.Exec(
+		"DELETE FROM otp WHERE account_id = $1 AND purpose = $2", accountID.String(), string(purpose))
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n < 1 {
+		return proto.ErrOTPNotEnrolled
+	}
+	return nil
+}
+
+func (b *AccountManagerBinding) GenerateOTPRecoveryCodes(
+	ctx scope.Context, account proto.Account, clientKey *security.ManagedKey) ([]string, error) {
+
+	codes, err := proto.NewOTPRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := proto.EncryptOTPRecoveryCodes(account, clientKey, codes)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.setOTPRecoveryCodes(b.DbMap, account.ID(), rc); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (b *AccountManagerBinding) setOTPRecoveryCodes(
+	db gorp.SqlExecutor, accountID snowflake.Snowflake, rc *proto.OTPRecoveryCodes) error {
+
+	res, err := db.Exec(
+		"UPDATE otp SET recovery_iv = $2, recovery_digest = $3, encrypted_recovery_codes = $4"+
+			" WHERE account_id = $1 AND purpose = $5",
+		accountID.String(), rc.IV, rc.Digest, rc.EncryptedCodes, string(proto.OTPForLogin))
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n < 1 {
+		return proto.ErrOTPNotEnrolled
+	}
+	return nil
+}
+
+func (b *AccountManagerBinding) UseOTPRecoveryCode(
+	ctx scope.Context, account proto.Account, clientKey *security.ManagedKey, code string) error {
+
+	t, err := b.DbMap.Begin()
+	if err != nil {
+		return err
+	}
+
+	row, err := b.lockRawOTP(t, account.ID(), proto.OTPForLogin)
+	if err != nil {
+		rollback(ctx, t)
+		if err == proto.ErrOTPNotEnrolled {
+			return proto.ErrAccessDenied
+		}
+		return err
+	}
+	now := time.Now()
+	if row.Failures().Locked(now) {
+		rollback(ctx, t)
+		return proto.ErrOTPLocked
+	}
+	if row.EncryptedRecoveryCodes == nil {
+		rollback(ctx, t)
+		return proto.ErrAccessDenied
+	}
+
+	rc := &proto.OTPRecoveryCodes{
+		IV:             row.RecoveryIV,
+		Digest:         row.RecoveryDigest,
+		EncryptedCodes: row.EncryptedRecoveryCodes,
+	}
+	codes, err := rc.Decrypt(account, clientKey)
+	if err != nil {
+		rollback(ctx, t)
+		return err
+	}
+
+	codes, ok := proto.RedeemOTPRecoveryCode(codes, code)
+	if !ok {
+		if err := b.recordOTPFailure(t, row, now); err != nil {
+			rollback(ctx, t)
+			return err
+		}
+		if err := t.Commit(); err != nil {
+			return err
+		}
+		return proto.ErrAccessDenied
+	}
+
+	rc, err = proto.EncryptOTPRecoveryCodes(account, clientKey, codes)
+	if err != nil {
+		rollback(ctx, t)
+		return err
+	}
+
+	if err := b.setOTPRecoveryCodes(t, account.ID(), rc); err != nil {
+		rollback(ctx, t)
+		return err
+	}
+
+	_, err = t.Exec(
+		"UPDATE otp SET failed_attempts = 0 WHERE account_id = $1 AND purpose = $2",
+		account.ID().String(), string(proto.OTPForLogin))
+	if err != nil {
+		rollback(ctx, t)
+		return err
+	}
+
+	return t.Commit()
+}
+
+func (b *AccountManagerBinding) CreateAPIToken(
+	ctx scope.Context, accountID snowflake.Snowflake, clientKey *security.ManagedKey,
+	name string, tokenScope proto.APITokenScope, lifetime time.Duration) (*proto.APIToken, string, error) {
+
+	token, secret, err := proto.NewAPIToken(accountID, clientKey, name, tokenScope, lifetime)
+	if err != nil {
+		return nil, "", err
+	}
+
+	row := &APIToken{
+		ID:                 token.ID.String(),
+		AccountID:          token.AccountID.String(),
+		Name:               token.Name,
+		Scope:              string(token.Scope),
+		IV:                 token.IV,
+		MAC:                token.MAC,
+		EncryptedClientKey: token.EncryptedClientKey.Ciphertext,
+		Created:            token.Created,
+		Expires:            token.Expires,
+	}
+	if err := b.DbMap.Insert(row); err != nil {
+		return nil, "", err
+	}
+
+	return token, secret, nil
+}
+
+func (b *AccountManagerBinding) APITokens(ctx scope.Context, accountID snowflake.Snowflake) ([]*proto.APIToken, error) {
+	cols, err := allColumns(b.DbMap, APIToken{}, "")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := b.DbMap.Select(
+		APIToken{},
+		fmt.Sprintf("SELECT %s FROM api_token WHERE account_id = $1 AND expires > NOW() ORDER BY id", cols),
+		accountID.String())
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	tokens := make([]*proto.APIToken, len(rows))
+	for i, row := range rows {
+		tokens[i] = row.(*APIToken).ToBackend()
+	}
+	return tokens, nil
+}
+
+func (b *AccountManagerBinding) RevokeAPIToken(ctx scope.Context, accountID, tokenID snowflake.Snowflake) error {
+	res, err := b.DbMap.Exec(
+		"DELETE FROM api_token WHERE id = $1 AND account_id = $2", tokenID.String(), accountID.String())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n < 1 {
+		return proto.ErrAPITokenNotFound
+	}
+	return nil
+}
+
+func (b *AccountManagerBinding) ResolveAPIToken(ctx scope.Context, secret string) (
+	*proto.APIToken, proto.Account, *security.ManagedKey, error) {
+
+	tokenID, tokenKey, err := proto.ParseAPIToken(secret)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	cols, err := allColumns(b.DbMap, APIToken{}, "")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var row APIToken
+	err = b.DbMap.SelectOne(
+		&row, fmt.Sprintf("SELECT %s FROM api_token WHERE id = $1 AND expires > NOW()", cols), tokenID.String())
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil, nil, proto.ErrAccessDenied
+		}
+		return nil, nil, nil, err
+	}
+
+	token := row.ToBackend()
+	clientKey, err := token.Unlock(tokenKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	account, err := b.get(b.DbMap, token.AccountID)
+	if err != nil {
+		if err == proto.ErrAccountNotFound {
+			return nil, nil, nil, proto.ErrAccessDenied
+		}
+		return nil, nil, nil, err
+	}
+
+	return token, account, clientKey, nil
+}
+
+func (b *AccountManagerBinding) LinkExternalIdentity(
+	ctx scope.Context, kms security.KMS, accountID snowflake.Snowflake, namespace, id string,
+	clientKey *security.ManagedKey) error {
+
+	key, err := proto.NewExternalIdentityKey(kms, accountID, namespace, id, clientKey)
+	if err != nil {
+		return err
+	}
+
+	t, err := b.DbMap.Begin()
+	if err != nil {
+		return err
+	}
+
+	// Claim the personal identity, or make sure it's already ours.
+	var pid PersonalIdentity
+	err = t.SelectOne(
+		&pid, "SELECT account_id FROM personal_identity WHERE namespace = $1 AND id = $2", namespace, id)
+	switch err {
+	case nil:
+		if pid.AccountID != accountID.String() {
+			rollback(ctx, t)
+			return proto.ErrPersonalIdentityInUse
+		}
+		_, err = t.Exec(
+			"UPDATE personal_identity SET verified = true WHERE namespace = $1 AND id = $2", namespace, id)
+	case sql.ErrNoRows:
+		err = t.Insert(&PersonalIdentity{
+			Namespace: namespace,
+			ID:        id,
+			AccountID: accountID.String(),
+			Verified:  true,
+		})
+	}
+	if err != nil {
+		rollback(ctx, t)
+		return err
+	}
+
+	// Replace any previous copy of the client key.
+	if _, err := t.Exec(
+		"DELETE FROM external_identity WHERE namespace = $1 AND id = $2", namespace, id); err != nil {
+		rollback(ctx, t)
+		return err
+	}
+
+	row := &ExternalIdentity{
+		Namespace:          namespace,
+		ID:                 id,
+		AccountID:          accountID.String(),
+		EncryptedSystemKey: key.SystemKey.Ciphertext,
+		IV:                 key.ClientKey.IV,
+		EncryptedClientKey: key.ClientKey.Ciphertext,
+	}
+	if err := t.Insert(row); err != nil {
+		rollback(ctx, t)
+		return err
+	}
+
+	return t.Commit()
+}
+
+func (b *AccountManagerBinding) UnlockExternalIdentity(
+	ctx scope.Context, kms security.KMS, namespace, id string) (proto.Account, *security.ManagedKey, error) {
+
+	cols, err := allColumns(b.DbMap, ExternalIdentity{}, "")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var row ExternalIdentity
+	err = b.DbMap.SelectOne(
+		&row, fmt.Sprintf("SELECT %s FROM external_identity WHERE namespace = $1 AND id = $2", cols),
+		namespace, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil, proto.ErrAccountNotFound
+		}
+		return nil, nil, err
+	}
+
+	key := row.ToBackend()
+	clientKey, err := key.Unlock(kms)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	account, err := b.get(b.DbMap, key.AccountID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return account, clientKey, nil
+}
+
+// rewrapExternalIdentities replaces the copies of an account's client key held
+// for its linked external identities, so that they keep unlocking the account
+// after its password changes.
+func rewrapExternalIdentities(
+	db gorp.SqlExecutor, kms security.KMS, accountID snowflake.Snowflake, clientKey *security.ManagedKey) error {
+
+	var rows []ExternalIdentity
+	if _, err := db.Select(
+		&rows, "SELECT namespace, id FROM external_identity WHERE account_id = $1", accountID.String()); err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		key, err := proto.NewExternalIdentityKey(kms, accountID, row.Namespace, row.ID, clientKey)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(
+			"UPDATE external_identity SET encrypted_system_key = $3, iv = $4, encrypted_client_key = $5"+
+				" WHERE namespace = $1 AND id = $2",
+			row.Namespace, row.ID, key.SystemKey.Ciphertext, key.ClientKey.IV, key.ClientKey.Ciphertext)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *AccountManagerBinding) ExportData(ctx scope.Context, accountID snowflake.Snowflake) (*proto.AccountData, error) {
+	if _, err := b.get(b.DbMap, accountID); err != nil {
+		return nil, err
+	}
+
+	userID := fmt.Sprintf("account:%s", accountID)
+	data := &proto.AccountData{}
+
+	msgCols, err := allColumns(b.DbMap, Message{}, "")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := b.DbMap.Select(
+		Message{},
+		fmt.Sprintf("SELECT %s FROM message WHERE sender_id = $1 ORDER BY room, id", msgCols),
+		userID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	for _, row := range rows {
+		msg := row.(*Message)
+		data.Messages = append(data.Messages, proto.AuthoredMessage{Room: msg.Room, Message: msg.ToBackend()})
+	}
+
+	pmCols, err := allColumns(b.DbMap, PM{}, "")
+	if err != nil {
+		return nil, err
+	}
+	rows, err = b.DbMap.Select(
+		PM{},
+		fmt.Sprintf("SELECT %s FROM pm WHERE initiator = $1 OR receiver = $2 ORDER BY id", pmCols),
+		accountID.String(), userID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	for _, row := range rows {
+		data.PMs = append(data.PMs, row.(*PM).ToBackend())
+	}
+
+	emailCols, err := allColumns(b.DbMap, Email{}, "")
+	if err != nil {
+		return nil, err
+	}
+	rows, err = b.DbMap.Select(
+		Email{},
+		fmt.Sprintf("SELECT %s FROM email WHERE account_id = $1 ORDER BY created", emailCols),
+		accountID.String())
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	for _, row := range rows {
+		ref, err := row.(*Email).ToBackend()
+		if err != nil {
+			return nil, err
+		}
+		data.Emails = append(data.Emails, ref)
+	}
+
+	return data, nil
+}
+
+func (b *AccountManagerBinding) RequestDeletion(
+	ctx scope.Context, accountID, jobID snowflake.Snowflake, due time.Time) error {
+
+	row := &AccountDeletion{
+		AccountID: accountID.String(),
+		JobID:     int64(jobID),
+		Requested: time.Now(),
+		Due:       due,
+	}
+	if err := b.DbMap.Insert(row); err != nil {
+		if strings.HasPrefix(err.Error(), "pq: duplicate key value") {
+			return proto.ErrAccountDeletionRequested
+		}
+		if strings.HasPrefix(err.Error(), "pq: insert or update on table") {
+			return proto.ErrAccountNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (b *AccountManagerBinding) DeletionRequest(
+	ctx scope.Context, accountID snowflake.Snowflake) (*proto.AccountDeletionRequest, error) {
+
+	if _, err := b.get(b.DbMap, accountID); err != nil {
+		return nil, err
+	}
+
+	row, err := b.DbMap.Get(AccountDeletion{}, accountID.String())
+	if err != nil {
+		return nil, err
+	}
+	if row == nil {
+		return nil, proto.ErrAccountDeletionNotRequested
+	}
+	return row.(*AccountDeletion).ToBackend(), nil
+}
+
+func (b *AccountManagerBinding) CancelDeletion(
+	ctx scope.Context, accountID snowflake.Snowflake) (*proto.AccountDeletionRequest, error) {
+
+	cols, err := allColumns(b.DbMap, AccountDeletion{}, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var row AccountDeletion
+	err = b.DbMap.SelectOne(
+		&row, fmt.Sprintf("DELETE FROM account_deletion WHERE account_id = $1 RETURNING %s", cols),
+		accountID.String())
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, proto.ErrAccountDeletionNotRequested
+		}
+		return nil, err
+	}
+	return row.ToBackend(), nil
+}
+
+func (b *AccountManagerBinding) Delete(ctx scope.Context, accountID snowflake.Snowflake) error {
+	t, err := b.DbMap.Begin()
+	if err != nil {
+		return err
+	}
+
+	id := accountID.String()
+	userID := fmt.Sprintf("account:%s", accountID)
+
+	// Messages survive, but lose all trace of their author.
+	if _, err := t.Exec(
+		"UPDATE message SET sender_id = $2, sender_name = '', sender_client_address = '', session_id = ''"+
+			" WHERE sender_id = $1",
+		userID, string(proto.DeletedUserID)); err != nil {
+		rollback(ctx, t)
+		return err
+	}
+	if _, err := t.Exec(
+		"UPDATE message_edit_log SET editor_id = $2 WHERE editor_id = $1",
+		userID, string(proto.DeletedUserID)); err != nil {
+		rollback(ctx, t)
+		return err
+	}
+
+	// The session log records where and how the account's agents connected.
+	if _, err := t.Exec(
+		"DELETE FROM session_log l USING agent a WHERE a.account_id = $1 AND "+agentSessionLogCondition,
+		id); err != nil {
+		rollback(ctx, t)
+		return err
+	}
+
+	deletions := []struct {
+		query string
+		arg   string
+	}{
+		{"DELETE FROM nick WHERE user_id = $1", userID},
+		{"DELETE FROM pm WHERE receiver = $1", userID},
+		{"DELETE FROM pm WHERE initiator = $1", id},
+		{"DELETE FROM email WHERE account_id = $1", id},
+		// Removing capabilities cascades to room access and manager grants.
+		{"DELETE FROM capability WHERE account_id = $1", id},
+		// Removing the account cascades to its identities, agents, tokens,
+		// one-time passwords, reset requests, and deletion request.
+		{"DELETE FROM account WHERE id = $1", id},
+	}
+	for _, d := range deletions {
+		if _, err := t.Exec(d.query, d.arg); err != nil {
+			rollback(ctx, t)
+			return err
+		}
+	}
+
+	return t.Commit()
+}
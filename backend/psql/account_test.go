@@ -0,0 +1,64 @@
+package psql
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/security"
+	"euphoria.io/scope"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func testAccountDeletionSessionLog(t *testing.T, b *Backend) {
+	Convey("Deleting an account removes its agents' session log", t, func() {
+		ctx := scope.New()
+		kms := security.LocalKMS()
+		kms.SetMasterKey(make([]byte, security.AES256.KeySize()))
+		nonce := fmt.Sprintf("%d", time.Now().UnixNano())
+
+		agentKey := &security.ManagedKey{
+			KeyType:   proto.AgentKeyType,
+			Plaintext: make([]byte, proto.AgentKeyType.KeySize()),
+		}
+		newAgent := func(id string) *proto.Agent {
+			agent, err := proto.NewAgent([]byte(id), agentKey)
+			So(err, ShouldBeNil)
+			So(b.AgentTracker().Register(ctx, agent), ShouldBeNil)
+			return agent
+		}
+		logSession := func(agent *proto.Agent) string {
+			entry := &SessionLog{
+				SessionID: fmt.Sprintf("%x-%08x", agent.IDString(), 1),
+				IP:        "10.0.0.1",
+				Room:      "sessionlog",
+				UserAgent: "test",
+				Connected: time.Now(),
+			}
+			So(b.DbMap.Insert(entry), ShouldBeNil)
+			return entry.SessionID
+		}
+		logged := func(sessionID string) bool {
+			n, err := b.DbMap.SelectInt("SELECT COUNT(*) FROM session_log WHERE session_id = $1", sessionID)
+			So(err, ShouldBeNil)
+			return n > 0
+		}
+
+		// The other agent's ID extends the deleted one's, so its sessions
+		// sort right after them.
+		deleted := newAgent("sessionlog" + nonce)
+		kept := newAgent("sessionlog" + nonce + "2")
+		account, _, err := b.AccountManager().Register(
+			ctx, kms, "email", "sessionlog"+nonce, "password", deleted.IDString(), agentKey)
+		So(err, ShouldBeNil)
+
+		deletedSession := logSession(deleted)
+		keptSession := logSession(kept)
+
+		So(b.AccountManager().Delete(ctx, account.ID()), ShouldBeNil)
+		So(logged(deletedSession), ShouldBeFalse)
+		So(logged(keptSession), ShouldBeTrue)
+	})
+}
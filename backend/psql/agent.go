@@ -28,6 +28,30 @@ type Agent struct {
 	Bot                bool
 }
 
+// AgentActivity is an agent joined with its most recent entry in the
+// session log. Session IDs are prefixed with the hex encoding of the agent ID.
+type AgentActivity struct {
+	ID        string
+	Created   time.Time
+	IP        sql.NullString
+	UserAgent sql.NullString `db:"user_agent"`
+	Connected gorp.NullTime
+}
+
+func (aa *AgentActivity) ToBackend() *proto.AgentActivity {
+	activity := &proto.AgentActivity{
+		AgentID:   aa.ID,
+		Created:   aa.Created,
+		LastSeen:  aa.Created,
+		IP:        aa.IP.String,
+		UserAgent: aa.UserAgent.String,
+	}
+	if aa.Connected.Valid {
+		activity.LastSeen = aa.Connected.Time
+	}
+	return activity
+}
+
 type AgentTrackerBinding struct {
 	*Backend
 }
@@ -162,3 +186,35 @@ func (atb *AgentTrackerBinding) ClearClientKey(ctx scope.Context, agentID string
 
 	return nil
 }
+
+// agentSessionLogCondition matches the session_log rows (l) of an agent (a).
+// Session IDs begin with the hex-encoded agent ID and a dash, so this is a
+// range scan over session_log_session_id_prefix, using the text_pattern_ops
+// operators that index supports.
+const agentSessionLogCondition = "l.session_id ~>=~ encode(convert_to(a.id, 'UTF8'), 'hex') || '-'" +
+	" AND l.session_id ~<~ encode(convert_to(a.id, 'UTF8'), 'hex') || '.'"
+
+func (atb *AgentTrackerBinding) AccountAgents(
+	ctx scope.Context, accountID snowflake.Snowflake) ([]*proto.AgentActivity, error) {
+
+	rows, err := atb.Backend.DbMap.Select(
+		AgentActivity{},
+		"SELECT a.id, a.created, s.ip, s.user_agent, s.connected"+
+			" FROM agent a LEFT JOIN LATERAL ("+
+			"  SELECT l.ip, l.user_agent, l.connected FROM session_log l"+
+			"  WHERE "+agentSessionLogCondition+
+			"  ORDER BY l.connected DESC LIMIT 1"+
+			" ) s ON true"+
+			" WHERE a.account_id = $1"+
+			" ORDER BY COALESCE(s.connected, a.created) DESC",
+		accountID.String())
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	agents := make([]*proto.AgentActivity, len(rows))
+	for i, row := range rows {
+		agents[i] = row.(*AgentActivity).ToBackend()
+	}
+	return agents, nil
+}
@@ -63,10 +63,14 @@ var schema = []struct {
 	// Keys and capabilities.
 	{"master_key", MessageKey{}, []string{"ID"}},
 	{"capability", Capability{}, []string{"ID"}},
+	{"key_rewrap", KeyRewrap{}, []string{"KeyColumn"}},
 
 	// Accounts.
+	{"account_deletion", AccountDeletion{}, []string{"AccountID"}},
 	{"agent", Agent{}, []string{"ID"}},
-	{"otp", OTP{}, []string{"AccountID"}},
+	{"api_token", APIToken{}, []string{"ID"}},
+	{"external_identity", ExternalIdentity{}, []string{"Namespace", "ID"}},
+	{"otp", OTP{}, []string{"AccountID", "Purpose"}},
 	{"password_reset_request", PasswordResetRequest{}, []string{"ID"}},
 	{"personal_identity", PersonalIdentity{}, []string{"Namespace", "ID"}},
 	{"account", Account{}, []string{"ID"}},
@@ -75,6 +79,7 @@ var schema = []struct {
 	{"job_log", JobLog{}, []string{"JobID", "Attempt"}},
 	{"job_item", JobItem{}, []string{"ID"}},
 	{"job_queue", JobQueue{}, []string{"Name"}},
+	{"job_schedule", JobSchedule{}, []string{"Queue", "Name"}},
 }
 
 var connCount = prometheus.NewGauge(prometheus.GaugeOpts{
@@ -84,7 +84,7 @@ type EmailTracker struct {
 
 func (et *EmailTracker) Send(
 	ctx scope.Context, js jobs.JobService, templater *templates.Templater, deliverer emails.Deliverer,
-	account proto.Account, to, templateName string, data interface{}) (
+	account proto.Account, to, templateName string, data interface{}, options ...jobs.JobOption) (
 	*emails.EmailRef, error) {
 
 	if to == "" {
@@ -126,7 +126,8 @@ func (et *EmailTracker) Send(
 		AccountID: account.ID(),
 		EmailID:   ref.ID,
 	}
-	job, err := jq.addAndClaim(ctx, t, jobs.EmailJobType, payload, "immediate", jobs.EmailJobOptions...)
+	options = append(append([]jobs.JobOption{}, jobs.EmailJobOptions...), options...)
+	job, err := jq.addAndClaim(ctx, t, jobs.EmailJobType, payload, "immediate", options...)
 	if err != nil {
 		rollback(ctx, t)
 		return nil, err
@@ -94,6 +94,13 @@ func TestBackend(t *testing.T) {
 
 	// Run test suite.
 	backend.IntegrationTest(t, factory)
+
+	if b != nil {
+		// Rewrap the keys the suite left behind.
+		testRewrapKeys(t, b)
+
+		testAccountDeletionSessionLog(t, b)
+	}
 }
 
 type nonClosingBackend struct {
@@ -45,9 +45,13 @@ type JobItem struct {
 	Due                    time.Time
 	Claimed                gorp.NullTime
 	Completed              gorp.NullTime
-	MaxWorkDurationSeconds int32 `db:"max_work_duration_seconds"`
-	AttemptsMade           int32 `db:"attempts_made"`
-	AttemptsRemaining      int32 `db:"attempts_remaining"`
+	MaxWorkDurationSeconds int32          `db:"max_work_duration_seconds"`
+	AttemptsMade           int32          `db:"attempts_made"`
+	AttemptsRemaining      int32          `db:"attempts_remaining"`
+	MaxAttempts            int32          `db:"max_attempts"`
+	Priority               int32          `db:"priority"`
+	IdempotencyKey         sql.NullString `db:"idempotency_key"`
+	Schedule               sql.NullString `db:"schedule"`
 }
 
 type JobLog struct {
@@ -62,6 +66,38 @@ type JobLog struct {
 	Log       []byte
 }
 
+// A JobSchedule records the most recent tick enqueued for a recurring job.
+type JobSchedule struct {
+	Queue    string
+	Name     string
+	LastTick time.Time `db:"last_tick"`
+	JobID    int64     `db:"job_id"`
+}
+
+// failedJobCondition selects jobs that have exhausted their attempts without
+// completing.
+const failedJobCondition = "completed IS NULL AND claimed IS NULL AND attempts_remaining <= 0"
+
+// pendingJobCondition selects jobs that are waiting to be claimed or are
+// claimed. At most one such job per queue may hold a given idempotency key.
+const pendingJobCondition = "completed IS NULL AND (claimed IS NOT NULL OR attempts_remaining > 0)"
+
+func (item *JobItem) ToBackend() *jobs.Job {
+	return &jobs.Job{
+		ID:                snowflake.Snowflake(item.ID),
+		Type:              jobs.JobType(item.JobType),
+		Data:              json.RawMessage(item.Data),
+		Created:           item.Created,
+		Due:               item.Due,
+		MaxWorkDuration:   time.Duration(item.MaxWorkDurationSeconds) * time.Second,
+		AttemptsMade:      item.AttemptsMade,
+		AttemptsRemaining: item.AttemptsRemaining,
+		MaxAttempts:       item.MaxAttempts,
+		Priority:          item.Priority,
+		IdempotencyKey:    item.IdempotencyKey.String,
+	}
+}
+
 type JobService struct {
 	*Backend
 }
@@ -141,7 +177,9 @@ func (jq *JobQueueBinding) newJob(
 	return job, nil
 }
 
-func (jq *JobQueueBinding) insertJob(db gorp.SqlExecutor, job *jobs.Job) error {
+// insertJob adds the job to the queue. A job enqueued by a recurring schedule
+// is tagged with the schedule's name.
+func (jq *JobQueueBinding) insertJob(db gorp.SqlExecutor, job *jobs.Job, schedule string) error {
 	item := &JobItem{
 		ID:                     int64(job.ID),
 		Queue:                  jq.Name(),
@@ -151,7 +189,17 @@ func (jq *JobQueueBinding) insertJob(db gorp.SqlExecutor, job *jobs.Job) error {
 		Due:                    job.Due,
 		AttemptsMade:           job.AttemptsMade,
 		AttemptsRemaining:      job.AttemptsRemaining,
+		MaxAttempts:            job.MaxAttempts,
 		MaxWorkDurationSeconds: int32(job.MaxWorkDuration / time.Second),
+		Priority:               job.Priority,
+		IdempotencyKey: sql.NullString{
+			String: job.IdempotencyKey,
+			Valid:  job.IdempotencyKey != "",
+		},
+		Schedule: sql.NullString{
+			String: schedule,
+			Valid:  schedule != "",
+		},
 	}
 	if job.JobClaim != nil {
 		item.Claimed = gorp.NullTime{
@@ -160,7 +208,21 @@ func (jq *JobQueueBinding) insertJob(db gorp.SqlExecutor, job *jobs.Job) error {
 		}
 	}
 
+	if item.IdempotencyKey.Valid {
+		pendingID, err := jq.pendingJobID(db, item.IdempotencyKey.String)
+		if err != nil {
+			return err
+		}
+		if pendingID != 0 {
+			return jobs.ErrDuplicateJob
+		}
+	}
+
 	if err := db.Insert(item); err != nil {
+		// A concurrent insert may have claimed the idempotency key.
+		if strings.HasPrefix(err.Error(), "pq: duplicate key value") {
+			return jobs.ErrDuplicateJob
+		}
 		return err
 	}
 
@@ -179,6 +241,30 @@ func (jq *JobQueueBinding) insertJob(db gorp.SqlExecutor, job *jobs.Job) error {
 	return nil
 }
 
+// pendingJobID returns the ID of the pending or claimed job with the given
+// idempotency key, or 0 if there isn't one.
+func (jq *JobQueueBinding) pendingJobID(db gorp.SqlExecutor, key string) (snowflake.Snowflake, error) {
+	id, err := db.SelectInt(
+		"SELECT id FROM job_item WHERE queue = $1 AND idempotency_key = $2 AND "+pendingJobCondition,
+		jq.Name(), key)
+	if err != nil {
+		return 0, err
+	}
+	return snowflake.Snowflake(id), nil
+}
+
+// duplicateOf returns the ID of the pending job that a rejected job
+// duplicates, along with ErrDuplicateJob. It's called after the rejecting
+// transaction is rolled back. If the other job has finished in the meantime,
+// the ID is 0.
+func (jq *JobQueueBinding) duplicateOf(job *jobs.Job) (snowflake.Snowflake, error) {
+	pendingID, err := jq.pendingJobID(jq.DbMap, job.IdempotencyKey)
+	if err != nil {
+		return 0, err
+	}
+	return pendingID, jobs.ErrDuplicateJob
+}
+
 func (jq *JobQueueBinding) Add(
 	ctx scope.Context, jobType jobs.JobType, payload interface{}, options ...jobs.JobOption) (
 	snowflake.Snowflake, error) {
@@ -193,7 +279,95 @@ func (jq *JobQueueBinding) Add(
 		return 0, err
 	}
 
-	if err := jq.insertJob(t, job); err != nil {
+	if err := jq.insertJob(t, job, ""); err != nil {
+		rollback(ctx, t)
+		if err == jobs.ErrDuplicateJob {
+			return jq.duplicateOf(job)
+		}
+		return 0, err
+	}
+
+	escaped := strings.Replace(jq.Name(), "'", "''", -1)
+	if _, err := t.Exec(fmt.Sprintf("NOTIFY job_item, '%s'", escaped)); err != nil {
+		rollback(ctx, t)
+		return 0, err
+	}
+
+	if err := t.Commit(); err != nil {
+		return 0, err
+	}
+
+	return job.ID, nil
+}
+
+func (jq *JobQueueBinding) AddScheduled(
+	ctx scope.Context, schedule string, tick time.Time, jobType jobs.JobType, payload interface{},
+	options ...jobs.JobOption) (snowflake.Snowflake, error) {
+
+	job, err := jq.newJob(jobType, payload, options...)
+	if err != nil {
+		return 0, err
+	}
+
+	t, err := jq.DbMap.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	// Lock the schedule's row so concurrent schedulers serialize on it. If
+	// the row doesn't exist yet, the primary key arbitrates between inserts.
+	var last JobSchedule
+	err = t.SelectOne(
+		&last, "SELECT queue, name, last_tick, job_id FROM job_schedule WHERE queue = $1 AND name = $2 FOR UPDATE",
+		jq.Name(), schedule)
+	switch err {
+	case nil:
+		if !last.LastTick.Before(tick) {
+			rollback(ctx, t)
+			return 0, jobs.ErrJobAlreadyScheduled
+		}
+		last.LastTick = tick
+		last.JobID = int64(job.ID)
+		if _, err := t.Update(&last); err != nil {
+			rollback(ctx, t)
+			return 0, err
+		}
+	case sql.ErrNoRows:
+		row := &JobSchedule{
+			Queue:    jq.Name(),
+			Name:     schedule,
+			LastTick: tick,
+			JobID:    int64(job.ID),
+		}
+		if err := t.Insert(row); err != nil {
+			rollback(ctx, t)
+			if strings.HasPrefix(err.Error(), "pq: duplicate key value") {
+				return 0, jobs.ErrJobAlreadyScheduled
+			}
+			return 0, err
+		}
+	default:
+		rollback(ctx, t)
+		return 0, err
+	}
+
+	if err := jq.insertJob(t, job, schedule); err != nil {
+		rollback(ctx, t)
+		if err == jobs.ErrDuplicateJob {
+			return jq.duplicateOf(job)
+		}
+		return 0, err
+	}
+
+	// Keep only the most recently completed of the schedule's earlier jobs.
+	pruned := "SELECT id FROM job_item WHERE queue = $1 AND schedule = $2 AND completed IS NOT NULL" +
+		" AND id <> (SELECT id FROM job_item WHERE queue = $1 AND schedule = $2 AND completed IS NOT NULL" +
+		" ORDER BY completed DESC LIMIT 1)"
+	if _, err := t.Exec("DELETE FROM job_log WHERE job_id IN ("+pruned+")", jq.Name(), schedule); err != nil {
+		rollback(ctx, t)
+		return 0, err
+	}
+	if _, err := t.Exec("DELETE FROM job_item WHERE id IN ("+pruned+")", jq.Name(), schedule); err != nil {
 		rollback(ctx, t)
 		return 0, err
 	}
@@ -250,7 +424,7 @@ func (jq *JobQueueBinding) addAndClaim(
 		AttemptNumber: 0,
 		Queue:         jq,
 	}
-	if err := jq.insertJob(db, job); err != nil {
+	if err := jq.insertJob(db, job, ""); err != nil {
 		return nil, err
 	}
 
@@ -313,6 +487,9 @@ func (jq *JobQueueBinding) TryClaim(ctx scope.Context, handlerID string) (*jobs.
 		MaxWorkDuration:   time.Duration(row.MaxWorkDurationSeconds) * time.Second,
 		AttemptsMade:      row.AttemptsMade,
 		AttemptsRemaining: row.AttemptsRemaining - 1,
+		MaxAttempts:       row.MaxAttempts,
+		Priority:          row.Priority,
+		IdempotencyKey:    row.IdempotencyKey.String,
 		JobClaim: &jobs.JobClaim{
 			JobID:         snowflake.Snowflake(row.ID),
 			HandlerID:     handlerID,
@@ -345,10 +522,13 @@ func (jq *JobQueueBinding) TrySteal(ctx scope.Context, handlerID string) (*jobs.
 		MaxWorkDuration:   time.Duration(row.MaxWorkDurationSeconds) * time.Second,
 		AttemptsMade:      row.AttemptsMade,
 		AttemptsRemaining: row.AttemptsRemaining - 1,
+		MaxAttempts:       row.MaxAttempts,
+		Priority:          row.Priority,
+		IdempotencyKey:    row.IdempotencyKey.String,
 		JobClaim: &jobs.JobClaim{
 			JobID:         snowflake.Snowflake(row.ID),
 			HandlerID:     handlerID,
-			AttemptNumber: row.AttemptsMade + 1,
+			AttemptNumber: row.AttemptsMade,
 			Queue:         jq,
 		},
 	}
@@ -378,15 +558,19 @@ func (jq *JobQueueBinding) Stats(ctx scope.Context) (jobs.JobQueueStats, error)
 		Waiting sql.NullInt64
 		Due     sql.NullInt64
 		Claimed sql.NullInt64
+		Failed  sql.NullInt64
 	}
 
 	err := jq.Backend.DbMap.SelectOne(
 		&row,
-		"SELECT COUNT(*)-SUM(is_claimed) AS waiting, SUM(is_due) AS due, SUM(is_claimed) AS claimed FROM ("+
-			"SELECT CASE WHEN due <= NOW() THEN 1 ELSE 0 END AS is_due,"+
-			" CASE WHEN jl.job_id IS NOT NULL AND jl.started + job.max_work_duration_seconds * interval '1 second' > NOW() THEN 1 ELSE 0 END AS is_claimed"+
-			" FROM job_item job LEFT JOIN job_log jl ON job.id = jl.job_id AND jl.attempt = job.attempts_made-1"+
-			" WHERE job.queue = $1 AND job.completed IS NULL) AS t1",
+		"SELECT COUNT(*)-SUM(is_claimed)-SUM(is_failed) AS waiting, SUM(is_due) AS due,"+
+			" SUM(is_claimed) AS claimed, SUM(is_failed) AS failed FROM ("+
+			"SELECT CASE WHEN due <= NOW() AND NOT failed THEN 1 ELSE 0 END AS is_due,"+
+			" CASE WHEN jl.job_id IS NOT NULL AND NOT failed"+
+			" AND jl.started + job.max_work_duration_seconds * interval '1 second' > NOW() THEN 1 ELSE 0 END AS is_claimed,"+
+			" CASE WHEN failed THEN 1 ELSE 0 END AS is_failed"+
+			" FROM (SELECT *, ("+failedJobCondition+") AS failed FROM job_item WHERE queue = $1 AND completed IS NULL) job"+
+			" LEFT JOIN job_log jl ON job.id = jl.job_id AND jl.attempt = job.attempts_made-1) AS t1",
 		jq.Name())
 
 	stats := jobs.JobQueueStats{}
@@ -399,9 +583,106 @@ func (jq *JobQueueBinding) Stats(ctx scope.Context) (jobs.JobQueueStats, error)
 	if row.Claimed.Valid {
 		stats.Claimed = row.Claimed.Int64
 	}
+	if row.Failed.Valid {
+		stats.Failed = row.Failed.Int64
+	}
 	return stats, err
 }
 
+func (jq *JobQueueBinding) ListFailed(ctx scope.Context, n int) ([]*jobs.Job, error) {
+	cols, err := allColumns(jq.Backend.DbMap, JobItem{}, "")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := jq.Backend.DbMap.Select(
+		JobItem{},
+		fmt.Sprintf(
+			"SELECT %s FROM job_item WHERE queue = $1 AND %s ORDER BY id LIMIT $2", cols, failedJobCondition),
+		jq.Name(), n)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	failed := make([]*jobs.Job, len(rows))
+	for i, row := range rows {
+		failed[i] = row.(*JobItem).ToBackend()
+	}
+	return failed, nil
+}
+
+func (jq *JobQueueBinding) Retry(ctx scope.Context, jobID snowflake.Snowflake) error {
+	t, err := jq.DbMap.Begin()
+	if err != nil {
+		return err
+	}
+
+	// The job is given its original allotment again. Jobs added before the
+	// allotment was recorded have used up every attempt they were given, so
+	// attempts_made stands in for it, and is recorded so that retrying
+	// again doesn't grow it.
+	res, err := t.Exec(
+		"UPDATE job_item SET max_attempts = COALESCE(NULLIF(max_attempts, 0), GREATEST(attempts_made, 1)),"+
+			" attempts_remaining = COALESCE(NULLIF(max_attempts, 0), GREATEST(attempts_made, 1)), due = NOW()"+
+			" WHERE id = $1 AND queue = $2 AND "+failedJobCondition,
+		int64(jobID), jq.Name())
+	if err != nil {
+		rollback(ctx, t)
+		if strings.HasPrefix(err.Error(), "pq: duplicate key value") {
+			return jobs.ErrDuplicateJob
+		}
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		rollback(ctx, t)
+		return err
+	}
+	if n < 1 {
+		rollback(ctx, t)
+		return jobs.ErrJobNotFound
+	}
+
+	escaped := strings.Replace(jq.Name(), "'", "''", -1)
+	if _, err := t.Exec(fmt.Sprintf("NOTIFY job_item, '%s'", escaped)); err != nil {
+		rollback(ctx, t)
+		return err
+	}
+
+	return t.Commit()
+}
+
+func (jq *JobQueueBinding) Purge(ctx scope.Context) (int64, error) {
+	t, err := jq.DbMap.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = t.Exec(
+		"DELETE FROM job_log WHERE job_id IN (SELECT id FROM job_item WHERE queue = $1 AND "+failedJobCondition+")",
+		jq.Name())
+	if err != nil {
+		rollback(ctx, t)
+		return 0, err
+	}
+
+	res, err := t.Exec("DELETE FROM job_item WHERE queue = $1 AND "+failedJobCondition, jq.Name())
+	if err != nil {
+		rollback(ctx, t)
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		rollback(ctx, t)
+		return 0, err
+	}
+
+	if err := t.Commit(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
 func (jq *JobQueueBinding) Log(ctx scope.Context, jobID snowflake.Snowflake, attemptNumber int32) (*jobs.JobLog, error) {
 	var row struct {
 		HandlerID string `db:"handler_id"`
@@ -0,0 +1,19 @@
+-- +migrate Up
+
+CREATE TABLE api_token (
+    id text NOT NULL PRIMARY KEY,
+    account_id text NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+    name text NOT NULL,
+    scope text NOT NULL,
+    iv bytea NOT NULL,
+    mac bytea NOT NULL,
+    encrypted_client_key bytea NOT NULL,
+    created timestamp with time zone NOT NULL,
+    expires timestamp with time zone NOT NULL
+);
+
+CREATE INDEX api_token_account_id_expires ON api_token(account_id, expires);
+
+-- +migrate Down
+
+DROP TABLE IF EXISTS api_token;
@@ -0,0 +1,16 @@
+-- +migrate Up
+
+CREATE TABLE external_identity (
+    namespace text NOT NULL,
+    id text NOT NULL,
+    account_id text NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+    encrypted_system_key bytea NOT NULL,
+    iv bytea NOT NULL,
+    encrypted_client_key bytea NOT NULL,
+    PRIMARY KEY (namespace, id),
+    FOREIGN KEY (namespace, id) REFERENCES personal_identity(namespace, id) ON DELETE CASCADE
+);
+
+-- +migrate Down
+
+DROP TABLE IF EXISTS external_identity;
@@ -0,0 +1,13 @@
+-- +migrate Up
+
+ALTER TABLE otp
+    ADD recovery_iv bytea,
+    ADD recovery_digest bytea,
+    ADD encrypted_recovery_codes bytea;
+
+-- +migrate Down
+
+ALTER TABLE otp
+    DROP IF EXISTS recovery_iv,
+    DROP IF EXISTS recovery_digest,
+    DROP IF EXISTS encrypted_recovery_codes;
@@ -0,0 +1,8 @@
+-- +migrate Up
+-- Session IDs begin with the hex-encoded agent ID, so agents can be matched to
+-- their sessions with a prefix search.
+CREATE INDEX session_log_session_id_prefix ON session_log(session_id text_pattern_ops, connected);
+
+-- +migrate Down
+
+DROP INDEX IF EXISTS session_log_session_id_prefix;
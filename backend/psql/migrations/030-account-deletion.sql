@@ -0,0 +1,12 @@
+-- +migrate Up
+
+CREATE TABLE account_deletion (
+    account_id text NOT NULL PRIMARY KEY REFERENCES account(id) ON DELETE CASCADE,
+    job_id bigint NOT NULL,
+    requested timestamp with time zone NOT NULL,
+    due timestamp with time zone NOT NULL
+);
+
+-- +migrate Down
+
+DROP TABLE IF EXISTS account_deletion;
@@ -0,0 +1,9 @@
+-- +migrate Up
+
+-- find jobs that have exhausted their attempts
+CREATE INDEX job_item_queue_failed_id ON job_item(queue, id)
+    WHERE completed IS NULL AND claimed IS NULL AND attempts_remaining <= 0;
+
+-- +migrate Down
+
+DROP INDEX IF EXISTS job_item_queue_failed_id;
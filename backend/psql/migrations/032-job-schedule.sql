@@ -0,0 +1,14 @@
+-- +migrate Up
+
+CREATE TABLE job_schedule (
+    queue text NOT NULL REFERENCES job_queue(name),
+    name text NOT NULL,
+    last_tick timestamp with time zone NOT NULL,
+    job_id bigint NOT NULL,
+    PRIMARY KEY (queue, name)
+);
+COMMENT ON TABLE job_schedule IS 'The most recent tick enqueued for each recurring job.';
+
+-- +migrate Down
+
+DROP TABLE IF EXISTS job_schedule;
@@ -0,0 +1,107 @@
+-- +migrate Up
+
+ALTER TABLE job_item ADD COLUMN priority integer NOT NULL DEFAULT 0;
+ALTER TABLE job_item ADD COLUMN idempotency_key text;
+
+-- claim due jobs in order of priority
+CREATE INDEX job_item_queue_claimable_priority_due_id ON job_item(queue, priority DESC, due, id)
+    WHERE claimed IS NULL AND completed IS NULL AND attempts_remaining > 0;
+
+-- at most one pending or claimed job per idempotency key
+CREATE UNIQUE INDEX job_item_queue_idempotency_key ON job_item(queue, idempotency_key)
+    WHERE idempotency_key IS NOT NULL AND completed IS NULL AND (claimed IS NOT NULL OR attempts_remaining > 0);
+
+-- +migrate StatementBegin
+CREATE OR REPLACE FUNCTION job_claim(_queue text, _handler_id text) RETURNS SETOF job_item AS
+$$
+DECLARE
+    candidate job_item%rowtype;
+    item job_item%rowtype;
+BEGIN
+    FOR candidate IN
+        SELECT * FROM job_item
+            WHERE queue = _queue AND claimed IS NULL AND completed IS NULL AND attempts_remaining > 0
+            ORDER BY due > NOW(), priority DESC, due, id
+            LIMIT 16
+    LOOP
+        CONTINUE WHEN NOT pg_try_advisory_lock(candidate.id);
+
+        -- Another handler may have claimed the job since we looked.
+        SELECT * INTO item FROM job_item
+            WHERE id = candidate.id AND claimed IS NULL AND completed IS NULL AND attempts_remaining > 0;
+        IF NOT FOUND THEN
+            PERFORM pg_advisory_unlock(candidate.id);
+            CONTINUE;
+        END IF;
+
+        item.claimed := NOW();
+        UPDATE job_item SET claimed = item.claimed, attempts_made = attempts_made+1, attempts_remaining = attempts_remaining-1 WHERE id = item.id;
+        INSERT INTO job_log (job_id, attempt, handler_id, started) VALUES (item.id, item.attempts_made, _handler_id, item.claimed);
+
+        PERFORM pg_advisory_unlock(item.id);
+        RETURN NEXT item;
+        RETURN;
+    END LOOP;
+    RETURN;
+END;
+$$
+LANGUAGE plpgsql;
+-- +migrate StatementEnd
+COMMENT ON FUNCTION job_claim(text, text) IS 'Claim an unclaimed, uncompleted, uncancelled job and returns its job_item row, or NULL if no jobs are immediately available to claim. Due jobs are claimed first, highest priority first.';
+
+-- +migrate Down
+
+-- +migrate StatementBegin
+CREATE OR REPLACE FUNCTION job_claim(_queue text, _handler_id text) RETURNS SETOF job_item AS
+$$
+DECLARE
+    item job_item%rowtype;
+BEGIN
+    WITH RECURSIVE jobs AS (
+        SELECT (job).*, pg_try_advisory_lock((job).id) AS locked
+            FROM (
+                SELECT job
+                    FROM job_item AS job
+                    WHERE job.queue = _queue AND claimed IS NULL AND completed IS NULL AND attempts_remaining > 0
+                    ORDER BY due, id
+                    LIMIT 1
+                ) AS t1
+        UNION ALL (
+            SELECT (job).*, pg_try_advisory_lock((job).id) AS locked
+                FROM (
+                    SELECT (
+                        SELECT job
+                            FROM job_item AS job
+                            WHERE job.queue = _queue AND claimed IS NULL AND completed IS NULL AND attempts_remaining > 0
+                                AND (due, id) > (job.due, job.id)
+                            ORDER BY due, id
+                            LIMIT 1
+                        ) AS job
+                        FROM jobs
+                        WHERE jobs.id IS NOT NULL
+                        LIMIT 1
+                    ) AS t1
+                )
+            ) SELECT * INTO item FROM jobs WHERE locked LIMIT 1;
+
+    IF item IS NULL THEN
+        RETURN;
+    END IF;
+
+    item.claimed := NOW();
+    UPDATE job_item SET claimed = item.claimed, attempts_made = attempts_made+1, attempts_remaining = attempts_remaining-1 WHERE id = item.id;
+    INSERT INTO job_log (job_id, attempt, handler_id, started) VALUES (item.id, item.attempts_made, _handler_id, item.claimed);
+
+    PERFORM pg_advisory_unlock(item.id);
+    RETURN NEXT item;
+    RETURN;
+END;
+$$
+LANGUAGE plpgsql;
+-- +migrate StatementEnd
+COMMENT ON FUNCTION job_claim(text, text) IS 'Claim an unclaimed, uncompleted, uncancelled job and returns its job_item row, or NULL if no jobs are immediately available to claim.';
+
+DROP INDEX IF EXISTS job_item_queue_idempotency_key;
+DROP INDEX IF EXISTS job_item_queue_claimable_priority_due_id;
+ALTER TABLE job_item DROP COLUMN IF EXISTS idempotency_key;
+ALTER TABLE job_item DROP COLUMN IF EXISTS priority;
@@ -0,0 +1,14 @@
+-- +migrate Up
+-- progress of rewrapping encrypted keys under a new KMS master key
+
+CREATE TABLE key_rewrap (
+    key_column text NOT NULL PRIMARY KEY,
+    key_version text NOT NULL,
+    last_id text NOT NULL,
+    completed boolean NOT NULL DEFAULT false,
+    updated timestamp with time zone NOT NULL
+);
+
+-- +migrate Down
+
+DROP TABLE IF EXISTS key_rewrap;
@@ -0,0 +1,9 @@
+-- +migrate Up
+-- the number of attempts each job was given, so that retrying a dead job
+-- restores its allotment; 0 if unlimited or not recorded
+
+ALTER TABLE job_item ADD COLUMN max_attempts integer NOT NULL DEFAULT 0;
+
+-- +migrate Down
+
+ALTER TABLE job_item DROP COLUMN IF EXISTS max_attempts;
@@ -0,0 +1,9 @@
+-- +migrate Up notransaction
+
+-- find messages by author, for export and anonymization, without locking
+-- the message table against writes while the index is built
+CREATE INDEX CONCURRENTLY IF NOT EXISTS message_sender_id ON message(sender_id);
+
+-- +migrate Down notransaction
+
+DROP INDEX CONCURRENTLY IF EXISTS message_sender_id;
@@ -0,0 +1,8 @@
+-- +migrate Up
+
+-- the recurring schedule that enqueued each job, if any
+ALTER TABLE job_item ADD COLUMN schedule text;
+
+-- +migrate Down
+
+ALTER TABLE job_item DROP COLUMN IF EXISTS schedule;
@@ -0,0 +1,8 @@
+-- +migrate Up
+
+-- accounts registered through an external identity have no password until one is set
+ALTER TABLE account ADD COLUMN has_password boolean NOT NULL DEFAULT true;
+
+-- +migrate Down
+
+ALTER TABLE account DROP COLUMN IF EXISTS has_password;
@@ -0,0 +1,15 @@
+-- +migrate Up
+
+-- staff and login one-time passwords are enrolled separately; only login
+-- enrollments have recovery codes
+ALTER TABLE otp ADD COLUMN purpose text NOT NULL DEFAULT 'staff';
+UPDATE otp SET purpose = 'login' WHERE encrypted_recovery_codes IS NOT NULL;
+ALTER TABLE otp DROP CONSTRAINT otp_pkey;
+ALTER TABLE otp ADD PRIMARY KEY (account_id, purpose);
+
+-- +migrate Down
+
+DELETE FROM otp WHERE purpose = 'login';
+ALTER TABLE otp DROP CONSTRAINT otp_pkey;
+ALTER TABLE otp ADD PRIMARY KEY (account_id);
+ALTER TABLE otp DROP COLUMN IF EXISTS purpose;
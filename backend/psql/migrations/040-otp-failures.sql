@@ -0,0 +1,12 @@
+-- +migrate Up
+
+-- consecutive wrong passcodes, for locking out guessing
+ALTER TABLE otp
+    ADD failed_attempts integer NOT NULL DEFAULT 0,
+    ADD last_failure timestamp with time zone;
+
+-- +migrate Down
+
+ALTER TABLE otp
+    DROP IF EXISTS failed_attempts,
+    DROP IF EXISTS last_failure;
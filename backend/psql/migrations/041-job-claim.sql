@@ -0,0 +1,90 @@
+-- +migrate Up
+
+-- +migrate StatementBegin
+CREATE OR REPLACE FUNCTION job_claim(_queue text, _handler_id text) RETURNS SETOF job_item AS
+$$
+DECLARE
+    due_after timestamp with time zone := '-infinity';
+    due_before timestamp with time zone := NOW();
+    candidate job_item%rowtype;
+    item job_item%rowtype;
+BEGIN
+    -- Look through due jobs first, then jobs that aren't due yet. Candidates
+    -- come from a cursor, so a handler keeps looking past jobs locked by
+    -- others instead of giving up.
+    LOOP
+        FOR candidate IN
+            SELECT * FROM job_item
+                WHERE queue = _queue AND claimed IS NULL AND completed IS NULL AND attempts_remaining > 0
+                    AND due > due_after AND due <= due_before
+                ORDER BY priority DESC, due, id
+        LOOP
+            CONTINUE WHEN NOT pg_try_advisory_lock(candidate.id);
+
+            -- Another handler may have claimed the job since we looked.
+            SELECT * INTO item FROM job_item
+                WHERE id = candidate.id AND claimed IS NULL AND completed IS NULL AND attempts_remaining > 0;
+            IF NOT FOUND THEN
+                PERFORM pg_advisory_unlock(candidate.id);
+                CONTINUE;
+            END IF;
+
+            item.claimed := NOW();
+            UPDATE job_item SET claimed = item.claimed, attempts_made = attempts_made+1, attempts_remaining = attempts_remaining-1 WHERE id = item.id;
+            INSERT INTO job_log (job_id, attempt, handler_id, started) VALUES (item.id, item.attempts_made, _handler_id, item.claimed);
+
+            PERFORM pg_advisory_unlock(item.id);
+            RETURN NEXT item;
+            RETURN;
+        END LOOP;
+
+        EXIT WHEN due_before = 'infinity';
+        due_after := due_before;
+        due_before := 'infinity';
+    END LOOP;
+    RETURN;
+END;
+$$
+LANGUAGE plpgsql;
+-- +migrate StatementEnd
+COMMENT ON FUNCTION job_claim(text, text) IS 'Claim an unclaimed, uncompleted, uncancelled job and returns its job_item row, or NULL if no jobs are immediately available to claim. Due jobs are claimed first, highest priority first.';
+
+-- +migrate Down
+
+-- +migrate StatementBegin
+CREATE OR REPLACE FUNCTION job_claim(_queue text, _handler_id text) RETURNS SETOF job_item AS
+$$
+DECLARE
+    candidate job_item%rowtype;
+    item job_item%rowtype;
+BEGIN
+    FOR candidate IN
+        SELECT * FROM job_item
+            WHERE queue = _queue AND claimed IS NULL AND completed IS NULL AND attempts_remaining > 0
+            ORDER BY due > NOW(), priority DESC, due, id
+            LIMIT 16
+    LOOP
+        CONTINUE WHEN NOT pg_try_advisory_lock(candidate.id);
+
+        -- Another handler may have claimed the job since we looked.
+        SELECT * INTO item FROM job_item
+            WHERE id = candidate.id AND claimed IS NULL AND completed IS NULL AND attempts_remaining > 0;
+        IF NOT FOUND THEN
+            PERFORM pg_advisory_unlock(candidate.id);
+            CONTINUE;
+        END IF;
+
+        item.claimed := NOW();
+        UPDATE job_item SET claimed = item.claimed, attempts_made = attempts_made+1, attempts_remaining = attempts_remaining-1 WHERE id = item.id;
+        INSERT INTO job_log (job_id, attempt, handler_id, started) VALUES (item.id, item.attempts_made, _handler_id, item.claimed);
+
+        PERFORM pg_advisory_unlock(item.id);
+        RETURN NEXT item;
+        RETURN;
+    END LOOP;
+    RETURN;
+END;
+$$
+LANGUAGE plpgsql;
+-- +migrate StatementEnd
+COMMENT ON FUNCTION job_claim(text, text) IS 'Claim an unclaimed, uncompleted, uncancelled job and returns its job_item row, or NULL if no jobs are immediately available to claim. Due jobs are claimed first, highest priority first.';
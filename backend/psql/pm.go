@@ -75,9 +75,9 @@ func (pmrb *PMRoomBinding) ResolveNick(ctx scope.Context, userID proto.UserID) (
 }
 
 func (pmrb *PMRoomBinding) Snapshot(
-	ctx scope.Context, session proto.Session, level proto.PrivilegeLevel, numMessages int) (*proto.SnapshotEvent, error) {
+	ctx scope.Context, session proto.Session, level proto.PrivilegeLevel, opts proto.SnapshotOptions) (*proto.SnapshotEvent, error) {
 
-	snapshot, err := pmrb.RoomBinding.Snapshot(ctx, session, level, numMessages)
+	snapshot, err := pmrb.RoomBinding.Snapshot(ctx, session, level, opts)
 	if err != nil {
 		return nil, err
 	}
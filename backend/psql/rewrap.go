@@ -0,0 +1,250 @@
+package psql
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/logging"
+	"euphoria.io/heim/proto/security"
+	"euphoria.io/scope"
+)
+
+const rewrapBatchSize = 100
+
+// A KeyRewrap records how far RewrapKeys has progressed through a column of
+// encrypted keys, for a particular version of the KMS master key.
+type KeyRewrap struct {
+	KeyColumn  string `db:"key_column"`
+	KeyVersion string `db:"key_version"`
+	LastID     string `db:"last_id"`
+	Completed  bool
+	Updated    time.Time
+}
+
+// A RewrapResult summarizes the work done by RewrapKeys on one column.
+type RewrapResult struct {
+	KeyColumn string
+	Scanned   int
+	Rewrapped int
+
+	// Skipped is true if the column had already been completed under the
+	// current key version.
+	Skipped bool
+}
+
+// A keyColumn is a column of KMS-wrapped keys, along with how to recover the
+// encryption context each key was wrapped with.
+type keyColumn struct {
+	table        string
+	column       string
+	from         string
+	id           string
+	keyType      security.KeyType
+	contextKey   string
+	contextValue string
+	encode       func([]byte) string
+}
+
+func (kc keyColumn) String() string { return kc.table + "." + kc.column }
+
+func (kc keyColumn) selectBatch() string {
+	from := kc.from
+	if from == "" {
+		from = kc.table
+	}
+	return fmt.Sprintf(
+		"SELECT %[1]s AS id, %[2]s.%[3]s AS ciphertext, %[4]s AS context FROM %[5]s"+
+			" WHERE %[1]s > $1 AND %[2]s.%[3]s IS NOT NULL ORDER BY %[1]s LIMIT $2",
+		kc.id, kc.table, kc.column, kc.contextValue, from)
+}
+
+func (kc keyColumn) update() string {
+	return fmt.Sprintf("UPDATE %[1]s SET %[2]s = $1 WHERE %[3]s = $2 AND %[1]s.%[2]s = $3",
+		kc.table, kc.column, kc.id)
+}
+
+var keyColumns = []keyColumn{
+	{
+		table:        "account",
+		column:       "encrypted_system_key",
+		id:           "account.id",
+		keyType:      proto.ClientKeyType,
+		contextKey:   "nonce",
+		contextValue: "account.nonce",
+		encode:       base64.URLEncoding.EncodeToString,
+	},
+	{
+		table:        "external_identity",
+		column:       "encrypted_system_key",
+		id:           "external_identity.namespace || ':' || external_identity.id",
+		keyType:      proto.ClientKeyType,
+		contextKey:   "identity",
+		contextValue: "external_identity.namespace || ':' || external_identity.id",
+	},
+	{
+		table:        "otp",
+		column:       "encrypted_key",
+		id:           "otp.account_id || ':' || otp.purpose",
+		keyType:      OTPKeyType,
+		contextKey:   "account",
+		contextValue: "otp.account_id",
+	},
+	{
+		table:        "pm",
+		column:       "encrypted_system_key",
+		id:           "pm.id",
+		keyType:      proto.RoomMessageKeyType,
+		contextKey:   "pm",
+		contextValue: "pm.id",
+	},
+	{
+		table:        "room",
+		column:       "encrypted_management_key",
+		id:           "room.name",
+		keyType:      proto.RoomManagerKeyType,
+		contextKey:   "room",
+		contextValue: "room.name",
+	},
+	{
+		table:        "master_key",
+		column:       "encrypted_key",
+		from:         "master_key JOIN room_master_key ON room_master_key.key_id = master_key.id",
+		id:           "master_key.id",
+		keyType:      proto.RoomMessageKeyType,
+		contextKey:   "room",
+		contextValue: "room_master_key.room",
+	},
+}
+
+// RewrapKeys re-encrypts every KMS-wrapped key in the database under the
+// current version of the KMS master key. Keys that are already current are
+// left alone, and a row is only updated if its key hasn't changed since it
+// was read, so it's safe to run against a live database.
+//
+// Progress is saved after every batch. If interrupted, a later call under the
+// same key version resumes where this one stopped, unless restart is true.
+// Only one call should be in progress at a time.
+func (b *Backend) RewrapKeys(
+	ctx scope.Context, kms security.RotatingKMS, restart bool, report func(RewrapResult)) error {
+
+	version := kms.KeyVersion()
+	if version == "" {
+		return fmt.Errorf("kms: master key version unknown")
+	}
+	for _, kc := range keyColumns {
+		result, err := b.rewrapColumn(ctx, kms, version, kc, restart)
+		if err != nil {
+			return fmt.Errorf("%s: %s", kc, err)
+		}
+		if report != nil {
+			report(result)
+		}
+	}
+	return nil
+}
+
+func (b *Backend) rewrapColumn(
+	ctx scope.Context, kms security.RotatingKMS, version string, kc keyColumn, restart bool) (
+	RewrapResult, error) {
+
+	result := RewrapResult{KeyColumn: kc.String()}
+	progress := &KeyRewrap{KeyColumn: kc.String(), KeyVersion: version}
+
+	var saved KeyRewrap
+	err := b.DbMap.SelectOne(&saved, "SELECT * FROM key_rewrap WHERE key_column = $1", kc.String())
+	switch {
+	case err == nil:
+		if saved.KeyVersion == version && !restart {
+			if saved.Completed {
+				result.Skipped = true
+				return result, nil
+			}
+			progress.LastID = saved.LastID
+		}
+	case err != sql.ErrNoRows:
+		return result, err
+	}
+
+	var rows []struct {
+		ID         string
+		Ciphertext []byte
+		Context    []byte
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+
+		rows = rows[:0]
+		if _, err := b.DbMap.Select(&rows, kc.selectBatch(), progress.LastID, rewrapBatchSize); err != nil {
+			return result, err
+		}
+
+		t, err := b.DbMap.Begin()
+		if err != nil {
+			return result, err
+		}
+
+		for _, row := range rows {
+			mkey := &security.ManagedKey{
+				KeyType:      kc.keyType,
+				Ciphertext:   row.Ciphertext,
+				ContextKey:   kc.contextKey,
+				ContextValue: string(row.Context),
+			}
+			if kc.encode != nil {
+				mkey.ContextValue = kc.encode(row.Context)
+			}
+
+			changed, err := kms.RewrapKey(mkey)
+			if err != nil {
+				rollback(ctx, t)
+				return result, fmt.Errorf("%s: %s", row.ID, err)
+			}
+			result.Scanned++
+			if !changed {
+				continue
+			}
+
+			// The key may have been replaced since we read it, in which case
+			// it was wrapped under the current version anyway.
+			res, err := t.Exec(kc.update(), mkey.Ciphertext, row.ID, row.Ciphertext)
+			if err != nil {
+				rollback(ctx, t)
+				return result, err
+			}
+			if n, err := res.RowsAffected(); err == nil && n > 0 {
+				result.Rewrapped++
+			}
+		}
+
+		if len(rows) > 0 {
+			progress.LastID = rows[len(rows)-1].ID
+		}
+		progress.Completed = len(rows) < rewrapBatchSize
+		progress.Updated = time.Now()
+		n, err := t.Update(progress)
+		if err == nil && n == 0 {
+			err = t.Insert(progress)
+		}
+		if err != nil {
+			rollback(ctx, t)
+			return result, err
+		}
+
+		if err := t.Commit(); err != nil {
+			return result, err
+		}
+
+		logging.Logger(ctx).Printf(
+			"rewrap %s: %d keys scanned, %d rewrapped, through %q",
+			kc, result.Scanned, result.Rewrapped, progress.LastID)
+
+		if progress.Completed {
+			return result, nil
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package psql
+
+import (
+	"encoding/json"
+	"testing"
+
+	"euphoria.io/heim/proto/security"
+	"euphoria.io/scope"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func testRewrapKeys(t *testing.T, b *Backend) {
+	Convey("RewrapKeys", t, func() {
+		ctx := scope.New()
+		kms := security.LocalKMS()
+		kms.SetMasterKey(make([]byte, security.AES256.KeySize()))
+		newMaster := make([]byte, security.AES256.KeySize())
+		newMaster[0] = 1
+		kms.RotateMasterKey(newMaster)
+
+		run := func(restart bool) map[string]RewrapResult {
+			results := map[string]RewrapResult{}
+			So(b.RewrapKeys(ctx, kms, restart, func(r RewrapResult) { results[r.KeyColumn] = r }), ShouldBeNil)
+			So(len(results), ShouldEqual, len(keyColumns))
+			return results
+		}
+
+		results := run(false)
+		So(results["account.encrypted_system_key"].Scanned, ShouldBeGreaterThan, 0)
+		So(results["account.encrypted_system_key"].Rewrapped, ShouldEqual,
+			results["account.encrypted_system_key"].Scanned)
+
+		// Completed columns are skipped.
+		for _, r := range run(false) {
+			So(r.Skipped, ShouldBeTrue)
+		}
+
+		// Restarting finds nothing left to do.
+		for _, r := range run(true) {
+			So(r.Skipped, ShouldBeFalse)
+			So(r.Rewrapped, ShouldEqual, 0)
+		}
+
+		// Rewrapped keys no longer depend on the old master key.
+		var accounts []Account
+		_, err := b.DbMap.Select(&accounts, "SELECT * FROM account")
+		So(err, ShouldBeNil)
+		So(len(accounts), ShouldBeGreaterThan, 0)
+		data, err := json.Marshal(map[string]interface{}{"master_key": newMaster, "version": 1})
+		So(err, ShouldBeNil)
+		cred, err := security.LocalKMSType.KMSCredential()
+		So(err, ShouldBeNil)
+		So(cred.UnmarshalJSON(data), ShouldBeNil)
+		for i := range accounts {
+			ab := &AccountBinding{Account: &accounts[i]}
+			key := ab.SystemKey()
+			So(cred.KMS().DecryptKey(&key), ShouldBeNil)
+		}
+	})
+}
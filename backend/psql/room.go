@@ -175,7 +175,7 @@ func (rb *RoomBinding) Latest(ctx scope.Context, n int, before snowflake.Snowfla
 }
 
 func (rb *RoomBinding) Snapshot(
-	ctx scope.Context, session proto.Session, level proto.PrivilegeLevel, numMessages int) (*proto.SnapshotEvent, error) {
+	ctx scope.Context, session proto.Session, level proto.PrivilegeLevel, opts proto.SnapshotOptions) (*proto.SnapshotEvent, error) {
 
 	snapshot := &proto.SnapshotEvent{
 		Identity:  session.Identity().ID(),
@@ -190,13 +190,16 @@ func (rb *RoomBinding) Snapshot(
 	if err != nil {
 		return nil, err
 	}
-	snapshot.Listing = listing
+	snapshot.Listing, snapshot.Counts = opts.ReduceListing(listing)
 
-	log, err := rb.Latest(ctx, numMessages, 0)
-	if err != nil {
-		return nil, err
+	snapshot.Log = []proto.Message{}
+	if opts.NumMessages > 0 {
+		log, err := rb.Latest(ctx, opts.NumMessages, 0)
+		if err != nil {
+			return nil, err
+		}
+		snapshot.Log = log
 	}
-	snapshot.Log = log
 	if level == proto.General {
 		for i := range snapshot.Log {
 			snapshot.Log[i].Sender.ClientAddress = ""
@@ -429,6 +432,12 @@ func (rb *RoomBinding) ResolveNick(ctx scope.Context, userID proto.UserID) (stri
 func (rb *ManagedRoomBinding) GenerateMessageKey(ctx scope.Context, kms security.KMS) (
 	proto.RoomMessageKey, error) {
 
+	return rb.ReplaceMessageKey(ctx, kms, func(proto.RoomMessageKey) error { return nil })
+}
+
+func (rb *ManagedRoomBinding) ReplaceMessageKey(
+	ctx scope.Context, kms security.KMS, grant func(proto.RoomMessageKey) error) (proto.RoomMessageKey, error) {
+
 	rmkb, err := rb.Room.generateMessageKey(rb.Backend, kms)
 	if err != nil {
 		return nil, err
@@ -441,16 +450,23 @@ func (rb *ManagedRoomBinding) GenerateMessageKey(ctx scope.Context, kms security
 	}
 
 	if err := transaction.Insert(&rmkb.MessageKey); err != nil {
-		if rerr := transaction.Rollback(); rerr != nil {
-			logging.Logger(ctx).Printf("rollback error: %s", rerr)
-		}
+		rollback(ctx, transaction)
 		return nil, err
 	}
 
 	if err := transaction.Insert(&rmkb.RoomMessageKey); err != nil {
-		if rerr := transaction.Rollback(); rerr != nil {
-			logging.Logger(ctx).Printf("rollback error: %s", rerr)
-		}
+		rollback(ctx, transaction)
+		return nil, err
+	}
+
+	// Grants of the new key are saved in the same transaction, so the key
+	// only becomes current if they all succeed.
+	capabilities := rmkb.GrantManager.Capabilities.(*RoomMessageCapabilities)
+	capabilities.Executor = transaction
+	err = grant(rmkb)
+	capabilities.Executor = rb.DbMap
+	if err != nil {
+		rollback(ctx, transaction)
 		return nil, err
 	}
 
@@ -479,46 +495,70 @@ func (rb *ManagedRoomBinding) MessageKeyID(ctx scope.Context) (string, bool, err
 }
 
 func (rb *ManagedRoomBinding) MessageKey(ctx scope.Context) (proto.RoomMessageKey, error) {
-	var row struct {
+	keys, err := rb.messageKeys(" AND r.expired < r.activated ORDER BY r.activated DESC LIMIT 1")
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	return keys[0], nil
+}
+
+func (rb *ManagedRoomBinding) MessageKeyHistory(ctx scope.Context) ([]proto.RoomMessageKey, error) {
+	keys, err := rb.messageKeys(" ORDER BY r.activated DESC")
+	if err != nil {
+		return nil, err
+	}
+	result := make([]proto.RoomMessageKey, len(keys))
+	for i, key := range keys {
+		result[i] = key
+	}
+	return result, nil
+}
+
+func (rb *ManagedRoomBinding) messageKeys(conditions string) ([]*RoomMessageKeyBinding, error) {
+	var rows []struct {
 		MessageKey
 		RoomMessageKey
 	}
 
-	mkCols, err := allColumns(rb.DbMap, row.MessageKey, "mk")
+	mkCols, err := allColumns(rb.DbMap, MessageKey{}, "mk")
 	if err != nil {
 		return nil, err
 	}
-	rCols, err := allColumns(rb.DbMap, row.RoomMessageKey, "r")
+	rCols, err := allColumns(rb.DbMap, RoomMessageKey{}, "r")
 	if err != nil {
 		return nil, err
 	}
 
-	err = rb.DbMap.SelectOne(
-		&row,
+	_, err = rb.DbMap.Select(
+		&rows,
 		fmt.Sprintf("SELECT %s, %s FROM master_key mk, room_master_key r"+
-			" WHERE r.room = $1 AND mk.id = r.key_id AND r.expired < r.activated"+
-			" ORDER BY r.activated DESC LIMIT 1",
+			" WHERE r.room = $1 AND mk.id = r.key_id"+conditions,
 			mkCols, rCols),
 		rb.RoomName)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
-		}
 		return nil, err
 	}
 
-	msgKey := &security.ManagedKey{
-		KeyType:      proto.RoomMessageKeyType,
-		IV:           row.MessageKey.IV,
-		Ciphertext:   row.MessageKey.EncryptedKey,
-		ContextKey:   "room",
-		ContextValue: rb.RoomName,
-	}
-	var keyID snowflake.Snowflake
-	if err := keyID.FromString(row.KeyID); err != nil {
-		return nil, err
+	keys := make([]*RoomMessageKeyBinding, len(rows))
+	for i, row := range rows {
+		msgKey := &security.ManagedKey{
+			KeyType:      proto.RoomMessageKeyType,
+			IV:           row.MessageKey.IV,
+			Ciphertext:   row.MessageKey.EncryptedKey,
+			ContextKey:   "room",
+			ContextValue: rb.RoomName,
+		}
+		var keyID snowflake.Snowflake
+		if err := keyID.FromString(row.KeyID); err != nil {
+			return nil, err
+		}
+		keys[i] = NewRoomMessageKeyBinding(rb, keyID, msgKey, row.Nonce)
+		keys[i].RoomMessageKey = row.RoomMessageKey
 	}
-	return NewRoomMessageKeyBinding(rb, keyID, msgKey, row.Nonce), nil
+	return keys, nil
 }
 
 func (rb *RoomBinding) WaitForPart(sessionID string) error {
@@ -604,6 +644,11 @@ func (rb *ManagedRoomBinding) Unban(ctx scope.Context, ban proto.Ban) error {
 	}
 }
 
+func (rb *ManagedRoomBinding) Disconnect(ctx scope.Context, reason string, exclude ...proto.Session) error {
+	event := &proto.DisconnectEvent{Reason: reason}
+	return rb.broadcast(ctx, rb.DbMap, proto.DisconnectEventType, event, exclude...)
+}
+
 func (rb *ManagedRoomBinding) banAgent(ctx scope.Context, agentID proto.UserID, until time.Time) error {
 	ban := &BannedAgent{
 		AgentID: agentID.String(),
@@ -176,6 +176,7 @@ type RoomMessageKeyBinding struct {
 	*proto.GrantManager
 	MessageKey
 	RoomMessageKey
+	backend *Backend
 }
 
 func NewRoomMessageKeyBinding(
@@ -214,6 +215,7 @@ func NewRoomMessageKeyBinding(
 			KeyID:     keyID.String(),
 			Activated: time.Now(),
 		},
+		backend: rb.Backend,
 	}
 	return rmkb
 }
@@ -222,6 +224,45 @@ func (rmkb *RoomMessageKeyBinding) KeyID() string        { return rmkb.RoomMessa
 func (rmkb *RoomMessageKeyBinding) Timestamp() time.Time { return rmkb.RoomMessageKey.Activated }
 func (rmkb *RoomMessageKeyBinding) Nonce() []byte        { return rmkb.MessageKey.Nonce }
 
+func (rmkb *RoomMessageKeyBinding) AccountHolders(ctx scope.Context) ([]proto.Account, error) {
+	// Capabilities aren't stored with the key they grant, so check each
+	// account with a grant in the room against this key.
+	var rows []struct {
+		AccountID string `db:"account_id"`
+	}
+	_, err := rmkb.backend.DbMap.Select(
+		&rows,
+		"SELECT DISTINCT account_id FROM room_capability"+
+			" WHERE room = $1 AND account_id IS NOT NULL AND account_id != '' AND revoked < granted",
+		rmkb.RoomMessageKey.Room)
+	if err != nil {
+		return nil, err
+	}
+
+	holders := []proto.Account{}
+	for _, row := range rows {
+		var accountID snowflake.Snowflake
+		if err := accountID.FromString(row.AccountID); err != nil {
+			return nil, err
+		}
+		account, err := rmkb.backend.AccountManager().Get(ctx, accountID)
+		if err != nil {
+			if err == proto.ErrAccountNotFound {
+				continue
+			}
+			return nil, err
+		}
+		capability, err := rmkb.AccountCapability(ctx, account)
+		if err != nil {
+			return nil, err
+		}
+		if capability != nil {
+			holders = append(holders, account)
+		}
+	}
+	return holders, nil
+}
+
 func (rmkb *RoomMessageKeyBinding) ManagedKey() security.ManagedKey {
 	dup := func(v []byte) []byte {
 		w := make([]byte, len(v))
@@ -3,12 +3,14 @@ package backend
 import (
 	"fmt"
 	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
 	"sync"
 	"time"
 
+	"euphoria.io/heim/oidc"
 	"euphoria.io/heim/proto"
 	"euphoria.io/heim/proto/security"
 	"euphoria.io/heim/templates"
@@ -18,16 +20,18 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/gorilla/securecookie"
 	"github.com/gorilla/websocket"
+	"github.com/juju/ratelimit"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 const cookieKeySize = 32
 
 var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	Subprotocols:    []string{"heim1"},
-	CheckOrigin:     checkOrigin,
+	ReadBufferSize:    1024,
+	WriteBufferSize:   1024,
+	Subprotocols:      proto.Subprotocols(),
+	CheckOrigin:       checkOrigin,
+	EnableCompression: true,
 }
 
 type Server struct {
@@ -43,14 +47,22 @@ type Server struct {
 	sc            *securecookie.SecureCookie
 	rootCtx       scope.Context
 
-	allowRoomCreation     bool
-	newAccountMinAgentAge time.Duration
-	roomEntryMinAgentAge  time.Duration
-	setInsecureCookies    bool
+	setInsecureCookies bool
+	trustedProxies     []*net.IPNet
 
-	m sync.Mutex
+	m             sync.Mutex
+	oidcProviders map[string]*oidc.Provider
+	configured    Settings
+	overrides     map[string]string
+	settings      Settings
 
 	agentIDGenerator func() ([]byte, error)
+
+	streamsM sync.Mutex
+	streams  map[string]*sseTransport
+
+	apiLimitersM sync.Mutex
+	apiLimiters  map[string]*ratelimit.Bucket
 }
 
 func NewServer(heim *proto.Heim, id, era string) (*Server, error) {
@@ -61,6 +73,12 @@ func NewServer(heim *proto.Heim, id, era string) (*Server, error) {
 		return nil, fmt.Errorf("error coordinating shared cookie secret: %s", err)
 	}
 
+	settings := DefaultSettings
+	settings.EmailSiteName = proto.DefaultCommonEmailParams.SiteName
+	settings.EmailSiteURL = proto.DefaultCommonEmailParams.SiteURL
+	settings.EmailSenderAddress = string(proto.DefaultCommonEmailParams.SenderAddress)
+	settings.EmailHelpAddress = string(proto.DefaultCommonEmailParams.HelpAddress)
+
 	s := &Server{
 		ID:            id,
 		Era:           era,
@@ -72,15 +90,64 @@ func NewServer(heim *proto.Heim, id, era string) (*Server, error) {
 		staticPath:    heim.StaticPath,
 		sc:            securecookie.New(cookieSecret, nil),
 		rootCtx:       heim.Context,
+		configured:    settings,
+		overrides:     map[string]string{},
+		settings:      settings,
 	}
+	heim.EmailParams = s.emailParams
 	s.route()
+	go s.watchSettings(heim.Cluster.WatchDir(SettingsDir))
 	return s, nil
 }
 
-func (s *Server) AllowRoomCreation(allow bool)            { s.allowRoomCreation = allow }
-func (s *Server) NewAccountMinAgentAge(age time.Duration) { s.newAccountMinAgentAge = age }
-func (s *Server) RoomEntryMinAgentAge(age time.Duration)  { s.roomEntryMinAgentAge = age }
-func (s *Server) SetInsecureCookies(allow bool)           { s.setInsecureCookies = allow }
+func (s *Server) AllowRoomCreation(allow bool) {
+	s.configure(func(settings *Settings) { settings.AllowRoomCreation = allow })
+}
+
+func (s *Server) NewAccountMinAgentAge(age time.Duration) {
+	s.configure(func(settings *Settings) { settings.NewAccountMinAgentAge = age })
+}
+
+func (s *Server) RoomEntryMinAgentAge(age time.Duration) {
+	s.configure(func(settings *Settings) { settings.RoomEntryMinAgentAge = age })
+}
+
+func (s *Server) SetInsecureCookies(allow bool) { s.setInsecureCookies = allow }
+
+// TrustProxies names the networks of reverse proxies whose X-Forwarded-For
+// headers are believed when limiting the rate of requests to the public API.
+func (s *Server) TrustProxies(networks []*net.IPNet) { s.trustedProxies = networks }
+
+func (s *Server) trustsProxy(ip net.IP) bool {
+	for _, network := range s.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddOIDCProvider enables OpenID Connect login through the given provider at
+// /oidc/<name>/login. Accounts with two-factor authentication enabled finish
+// signing in with a one-time password at /oidc/<name>/otp.
+func (s *Server) AddOIDCProvider(name string, provider *oidc.Provider) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.oidcProviders == nil {
+		s.oidcProviders = map[string]*oidc.Provider{name: provider}
+	} else {
+		s.oidcProviders[name] = provider
+	}
+}
+
+func (s *Server) oidcProvider(name string) (*oidc.Provider, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	provider, ok := s.oidcProviders[name]
+	return provider, ok
+}
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.r.ServeHTTP(w, r)
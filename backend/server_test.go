@@ -1,8 +1,14 @@
 package backend
 
 import (
+	"bufio"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
+
+	"euphoria.io/heim/proto"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -42,3 +48,36 @@ func TestCheckOrigin(t *testing.T) {
 		})
 	})
 }
+
+func TestSecurityPolicy(t *testing.T) {
+	Convey("Responses carry a security policy and come from the routed handler", t, func() {
+		s := &Server{}
+		s.route()
+
+		w := httptest.NewRecorder()
+		s.r.ServeHTTP(w, httptest.NewRequest("GET", "/static/missing.js", nil))
+		So(w.Code, ShouldEqual, http.StatusNotFound)
+		So(w.Header().Get("Content-Security-Policy"), ShouldStartWith, "default-src 'self';")
+	})
+}
+
+func TestSSEWriteTimeout(t *testing.T) {
+	Convey("An SSE stream is closed when the client stops reading", t, func() {
+		server, client := net.Pipe()
+		defer server.Close()
+		defer client.Close()
+
+		tr := &sseTransport{
+			id:           "stream",
+			writeTimeout: 10 * time.Millisecond,
+			incoming:     make(chan *proto.Packet),
+			done:         make(chan struct{}),
+		}
+
+		// Nothing reads from the client end of the pipe, so the first write
+		// blocks until its deadline.
+		So(tr.start(server, bufio.NewWriter(server), http.Header{}), ShouldNotBeNil)
+		_, err := tr.ReadPacket()
+		So(err, ShouldNotBeNil)
+	})
+}
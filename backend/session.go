@@ -16,7 +16,6 @@ import (
 	"euphoria.io/heim/proto/security"
 	"euphoria.io/scope"
 
-	"github.com/gorilla/websocket"
 	"github.com/juju/ratelimit"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -92,7 +91,7 @@ type session struct {
 	id          string
 	ctx         scope.Context
 	server      *Server
-	conn        *websocket.Conn
+	transport   transport
 	clientAddr  string
 	vClientAddr string
 	identity    *memIdentity
@@ -105,6 +104,9 @@ type session struct {
 	kms         security.KMS
 	heim        *proto.Heim
 
+	snapshotOpts proto.SnapshotOptions
+	features     proto.FeatureSet
+
 	state    cmdState
 	client   *proto.Client
 	agentKey *security.ManagedKey
@@ -115,6 +117,7 @@ type session struct {
 	incoming     chan *proto.Packet
 	outgoing     chan *proto.Packet
 	floodLimiter *ratelimit.Bucket
+	floodKick    int
 
 	authFailCount int
 
@@ -127,19 +130,20 @@ type session struct {
 }
 
 func newSession(
-	ctx scope.Context, server *Server, conn *websocket.Conn, clientAddr string,
+	ctx scope.Context, server *Server, transport transport, clientAddr string,
 	room proto.Room, client *proto.Client, agentKey *security.ManagedKey) *session {
 
 	nextID := atomic.AddUint64(&sessionIDCounter, 1)
 	sessionCount.WithLabelValues(room.ID()).Set(float64(nextID))
 	sessionID := fmt.Sprintf("%x-%08x", client.Agent.IDString(), nextID)
 	ctx = logging.LoggingContext(ctx, os.Stdout, fmt.Sprintf("[%s] ", sessionID))
+	settings := server.Settings()
 
 	session := &session{
 		id:          sessionID,
 		ctx:         ctx,
 		server:      server,
-		conn:        conn,
+		transport:   transport,
 		clientAddr:  clientAddr,
 		vClientAddr: clientAddr,
 		identity:    newMemIdentity(client.UserID(), server.ID, server.Era),
@@ -153,9 +157,12 @@ func newSession(
 		kms:         server.kms,
 		heim:        server.heim,
 
+		snapshotOpts: proto.DefaultSnapshotOptions(),
+
 		incoming:     make(chan *proto.Packet),
 		outgoing:     make(chan *proto.Packet, 100),
-		floodLimiter: ratelimit.NewBucketWithQuantum(time.Second, 50, 10),
+		floodLimiter: ratelimit.NewBucketWithQuantum(time.Second, settings.FloodBurst, settings.FloodRate),
+		floodKick:    settings.FloodKickThreshold,
 	}
 
 	if managedRoom, ok := room.(proto.ManagedRoom); ok {
@@ -197,20 +204,12 @@ func (s *session) View(level proto.PrivilegeLevel) proto.SessionView {
 	return view
 }
 
-func (s *session) writeMessage(messageType int, data []byte) error {
-	if err := s.conn.SetWriteDeadline(time.Now().Add(MaxKeepAliveMisses * KeepAlive)); err != nil {
-		return err
-	}
-	if err := s.conn.WriteMessage(messageType, data); err != nil {
-		return err
-	}
-	if err := s.conn.SetWriteDeadline(time.Time{}); err != nil {
-		return err
+func (s *session) Send(ctx scope.Context, cmdType proto.PacketType, payload interface{}) error {
+	// Withhold events the client hasn't declared support for.
+	if !s.features.Accepts(cmdType) {
+		return nil
 	}
-	return nil
-}
 
-func (s *session) Send(ctx scope.Context, cmdType proto.PacketType, payload interface{}) error {
 	// Special case: certain events have privileged info that may need to be stripped from them
 	switch event := payload.(type) {
 	case *proto.PresenceEvent:
@@ -301,7 +300,7 @@ func (s *session) serve() error {
 	if s.managedRoom != nil {
 		minAgentAge = s.managedRoom.MinAgentAge()
 	}
-	if s.client.Account == nil && !s.client.Agent.Blessed && (agentAge < s.server.roomEntryMinAgentAge || agentAge < minAgentAge) {
+	if s.client.Account == nil && !s.client.Agent.Blessed && (agentAge < s.server.Settings().RoomEntryMinAgentAge || agentAge < minAgentAge) {
 		allowed = false
 		s.sendBounce("room not open")
 		s.state = s.ignoreState
@@ -361,7 +360,12 @@ func (s *session) serve() error {
 				return err
 			}
 		case cmd := <-s.incoming:
-			reply := s.state(cmd)
+			var reply *response
+			if s.client.APIToken != nil && !s.client.APIToken.Scope.Allows(cmd.Type) {
+				reply = &response{err: proto.ErrAccessDenied}
+			} else {
+				reply = s.state(cmd)
+			}
 
 			flooding := false
 			shouldKickForFlooding := false
@@ -369,7 +373,7 @@ func (s *session) serve() error {
 				taken := s.floodLimiter.TakeAvailable(reply.cost)
 				if taken < reply.cost {
 					flooding = true
-					if consecutiveThrottled++; consecutiveThrottled > MaxConsecutiveThrottled {
+					if consecutiveThrottled++; consecutiveThrottled > s.floodKick {
 						shouldKickForFlooding = true
 					}
 					s.floodLimiter.Wait(reply.cost - taken)
@@ -397,13 +401,7 @@ func (s *session) serve() error {
 				return err
 			}
 
-			data, err := resp.Encode()
-			if err != nil {
-				logger.Printf("error: Response encode: %s", err)
-				return err
-			}
-
-			if err := s.writeMessage(websocket.TextMessage, data); err != nil {
+			if err := s.transport.WritePacket(resp); err != nil {
 				logger.Printf("error: write message: %s", err)
 				return err
 			}
@@ -422,13 +420,7 @@ func (s *session) serve() error {
 				}
 			}
 		case cmd := <-s.outgoing:
-			data, err := cmd.Encode()
-			if err != nil {
-				logger.Printf("error: push message encode: %s", err)
-				return err
-			}
-
-			if err := s.writeMessage(websocket.TextMessage, data); err != nil {
+			if err := s.transport.WritePacket(cmd); err != nil {
 				logger.Printf("error: write message: %s", err)
 				return err
 			}
@@ -447,7 +439,7 @@ func (s *session) readMessages() {
 	defer s.Close()
 
 	for s.ctx.Err() == nil {
-		messageType, data, err := s.conn.ReadMessage()
+		cmd, err := s.transport.ReadPacket()
 		if err != nil {
 			if err == io.EOF {
 				logger.Printf("client disconnected")
@@ -456,24 +448,12 @@ func (s *session) readMessages() {
 			logger.Printf("error: read message: %s", err)
 			return
 		}
-
-		switch messageType {
-		case websocket.TextMessage:
-			cmd, err := proto.ParseRequest(data)
-			if err != nil {
-				logger.Printf("error: ParseRequest: %s", err)
-				return
-			}
-			s.incoming <- cmd
-		default:
-			logger.Printf("error: unsupported message type: %v", messageType)
-			return
-		}
+		s.incoming <- cmd
 	}
 }
 
 func (s *session) sendSnapshot() error {
-	snapshot, err := s.room.Snapshot(s.ctx, s, s.privilegeLevel(), 100)
+	snapshot, err := s.room.Snapshot(s.ctx, s, s.privilegeLevel(), s.snapshotOpts)
 	if err != nil {
 		return err
 	}
@@ -576,12 +556,15 @@ func (s *session) sendHello(roomIsPrivate, accountHasAccess bool) error {
 		AccountHasAccess: accountHasAccess,
 		RoomIsPrivate:    roomIsPrivate,
 		Version:          s.room.Version(),
+		ProtocolVersion:  proto.ProtocolVersion,
+		Features:         proto.Features(),
 	}
 	if s.client.Account != nil {
 		event.AccountView = &proto.PersonalAccountView{
 			AccountView: *s.client.Account.View(s.roomName),
 		}
 		event.AccountView.Email, event.AccountEmailVerified = s.client.Account.Email()
+		event.AccountPasswordUnset = !s.client.Account.HasPassword()
 	}
 	event.ID = event.SessionView.ID
 	cmd, err := proto.MakeEvent(event)
@@ -589,13 +572,7 @@ func (s *session) sendHello(roomIsPrivate, accountHasAccess bool) error {
 		logger.Printf("error: hello event: %s", err)
 		return err
 	}
-	data, err := cmd.Encode()
-	if err != nil {
-		logger.Printf("error: hello event encode: %s", err)
-		return err
-	}
-
-	if err := s.writeMessage(websocket.TextMessage, data); err != nil {
+	if err := s.transport.WritePacket(cmd); err != nil {
 		logger.Printf("error: write hello event: %s", err)
 		return err
 	}
@@ -614,13 +591,7 @@ func (s *session) sendPing() error {
 		logger.Printf("error: ping event: %s", err)
 		return err
 	}
-	data, err := cmd.Encode()
-	if err != nil {
-		logger.Printf("error: ping event encode: %s", err)
-		return err
-	}
-
-	if err := s.writeMessage(websocket.TextMessage, data); err != nil {
+	if err := s.transport.WritePacket(cmd); err != nil {
 		logger.Printf("error: write ping event: %s", err)
 		return err
 	}
@@ -0,0 +1,325 @@
+package backend
+
+import (
+	"fmt"
+	"html/template"
+	"net/mail"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"euphoria.io/heim/cluster"
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/logging"
+)
+
+// SettingsDir is the cluster directory in which settings are overridden.
+const SettingsDir = "settings"
+
+// Settings are the parts of a server's configuration that may be changed
+// while it's running. A server starts with the settings it was configured
+// with, and applies overrides of them from SettingsDir as they're made.
+type Settings struct {
+	AllowRoomCreation     bool
+	NewAccountMinAgentAge time.Duration
+	RoomEntryMinAgentAge  time.Duration
+
+	// A connection earns FloodRate credits per second towards the cost of
+	// its commands, banking at most FloodBurst. If it's throttled for lack
+	// of credit more than FloodKickThreshold times in a row, it's
+	// disconnected. Changes to these apply to new connections.
+	FloodRate          int64
+	FloodBurst         int64
+	FloodKickThreshold int
+
+	// Each client IP earns APIRate requests per second to the public HTTP
+	// API, banking at most APIBurst. Changes to these apply to clients not
+	// seen recently.
+	APIRate  int64
+	APIBurst int64
+
+	// Outgoing emails name the site and link to it, and come from
+	// EmailSenderAddress. They direct questions to EmailHelpAddress. The
+	// defaults come from the site section of the configuration.
+	EmailSiteName      string
+	EmailSiteURL       string
+	EmailSenderAddress string
+	EmailHelpAddress   string
+}
+
+var DefaultSettings = Settings{
+	FloodRate:          10,
+	FloodBurst:         50,
+	FloodKickThreshold: MaxConsecutiveThrottled,
+	APIRate:            5,
+	APIBurst:           30,
+}
+
+type setting struct {
+	desc string
+	get  func(*Settings) string
+	set  func(*Settings, string) error
+}
+
+var settingDefs = map[string]setting{
+	"allow-room-creation": {
+		"whether visiting a nonexistent room creates it",
+		func(s *Settings) string { return strconv.FormatBool(s.AllowRoomCreation) },
+		func(s *Settings, v string) (err error) { s.AllowRoomCreation, err = strconv.ParseBool(v); return },
+	},
+	"new-account-min-agent-age": {
+		"how long an agent must exist before registering an account",
+		func(s *Settings) string { return s.NewAccountMinAgentAge.String() },
+		func(s *Settings, v string) (err error) { s.NewAccountMinAgentAge, err = parseDuration(v); return },
+	},
+	"room-entry-min-agent-age": {
+		"how long an agent must exist before entering any room",
+		func(s *Settings) string { return s.RoomEntryMinAgentAge.String() },
+		func(s *Settings, v string) (err error) { s.RoomEntryMinAgentAge, err = parseDuration(v); return },
+	},
+	"flood-rate": {
+		"command credits earned by a connection per second",
+		func(s *Settings) string { return strconv.FormatInt(s.FloodRate, 10) },
+		func(s *Settings, v string) (err error) { s.FloodRate, err = parsePositive(v); return },
+	},
+	"flood-burst": {
+		"most command credits a connection may bank",
+		func(s *Settings) string { return strconv.FormatInt(s.FloodBurst, 10) },
+		func(s *Settings, v string) (err error) { s.FloodBurst, err = parsePositive(v); return },
+	},
+	"flood-kick-threshold": {
+		"consecutive throttled commands after which a connection is dropped",
+		func(s *Settings) string { return strconv.Itoa(s.FloodKickThreshold) },
+		func(s *Settings, v string) error {
+			n, err := parsePositive(v)
+			s.FloodKickThreshold = int(n)
+			return err
+		},
+	},
+	"api-rate": {
+		"public API requests earned by a client IP per second",
+		func(s *Settings) string { return strconv.FormatInt(s.APIRate, 10) },
+		func(s *Settings, v string) (err error) { s.APIRate, err = parsePositive(v); return },
+	},
+	"api-burst": {
+		"most public API requests a client IP may bank",
+		func(s *Settings) string { return strconv.FormatInt(s.APIBurst, 10) },
+		func(s *Settings, v string) (err error) { s.APIBurst, err = parsePositive(v); return },
+	},
+	"email-site-name": {
+		"name of the site in outgoing emails",
+		func(s *Settings) string { return s.EmailSiteName },
+		func(s *Settings, v string) error {
+			if strings.TrimSpace(v) == "" {
+				return fmt.Errorf("must not be blank")
+			}
+			s.EmailSiteName = v
+			return nil
+		},
+	},
+	"email-site-url": {
+		"base URL of the site in links from outgoing emails",
+		func(s *Settings) string { return s.EmailSiteURL },
+		func(s *Settings, v string) (err error) { s.EmailSiteURL, err = parseSiteURL(v); return },
+	},
+	"email-sender-address": {
+		"address outgoing emails are sent from",
+		func(s *Settings) string { return s.EmailSenderAddress },
+		func(s *Settings, v string) (err error) { s.EmailSenderAddress, err = parseAddress(v); return },
+	},
+	"email-help-address": {
+		"address outgoing emails direct questions to",
+		func(s *Settings) string { return s.EmailHelpAddress },
+		func(s *Settings, v string) (err error) { s.EmailHelpAddress, err = parseAddress(v); return },
+	},
+}
+
+func parseDuration(v string) (time.Duration, error) {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("must not be negative")
+	}
+	return d, nil
+}
+
+func parsePositive(v string) (int64, error) {
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < 1 {
+		return 0, fmt.Errorf("must be positive")
+	}
+	return n, nil
+}
+
+// parseSiteURL accepts an absolute http or https URL. Emails append paths to
+// it, so it mustn't end with a slash.
+func parseSiteURL(v string) (string, error) {
+	u, err := url.Parse(v)
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("must be an absolute http or https URL")
+	}
+	if strings.HasSuffix(v, "/") {
+		return "", fmt.Errorf("must not end with /")
+	}
+	return v, nil
+}
+
+func parseAddress(v string) (string, error) {
+	addr, err := mail.ParseAddress(v)
+	if err != nil {
+		return "", err
+	}
+	if addr.Address != v {
+		return "", fmt.Errorf("must be a bare email address")
+	}
+	return v, nil
+}
+
+// SettingNames returns the names of all settings, in order.
+func SettingNames() []string {
+	names := make([]string, 0, len(settingDefs))
+	for name := range settingDefs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DescribeSetting returns a description of the named setting.
+func DescribeSetting(name string) string { return settingDefs[name].desc }
+
+// Get returns the value of the named setting.
+func (s *Settings) Get(name string) (string, error) {
+	st, ok := settingDefs[name]
+	if !ok {
+		return "", fmt.Errorf("no such setting: %s", name)
+	}
+	return st.get(s), nil
+}
+
+// Set parses and applies a value for the named setting.
+func (s *Settings) Set(name, value string) error {
+	st, ok := settingDefs[name]
+	if !ok {
+		return fmt.Errorf("no such setting: %s", name)
+	}
+	updated := *s
+	if err := st.set(&updated, value); err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	*s = updated
+	return nil
+}
+
+// ErrLocalSettings is returned when overriding settings in a cluster whose
+// peers don't share values, where an override would reach only one server.
+var ErrLocalSettings = fmt.Errorf(
+	"settings can't be overridden in a cluster whose servers don't share values; configure each server instead")
+
+// OverrideSetting validates a value for the named setting and stores it in
+// the cluster, where every server will pick it up.
+func OverrideSetting(c cluster.Cluster, name, value string) error {
+	var s Settings
+	if err := s.Set(name, value); err != nil {
+		return err
+	}
+	if !cluster.SharesValues(c) {
+		return ErrLocalSettings
+	}
+	return c.SetValue(SettingsDir+"/"+name, value)
+}
+
+// ResetSetting removes any override of the named setting from the cluster,
+// returning every server to its configured value.
+func ResetSetting(c cluster.Cluster, name string) error {
+	if _, ok := settingDefs[name]; !ok {
+		return fmt.Errorf("no such setting: %s", name)
+	}
+	if !cluster.SharesValues(c) {
+		return ErrLocalSettings
+	}
+	return c.DeleteValue(SettingsDir + "/" + name)
+}
+
+// SettingOverrides returns the overrides stored in the cluster.
+func SettingOverrides(c cluster.Cluster) (map[string]string, error) {
+	overrides, err := c.GetDir(SettingsDir)
+	if err == cluster.ErrNotFound {
+		return map[string]string{}, nil
+	}
+	return overrides, err
+}
+
+// Settings returns the server's current settings.
+func (s *Server) Settings() Settings {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.settings
+}
+
+// emailParams returns the common parameters of outgoing emails under the
+// current settings.
+func (s *Server) emailParams() proto.CommonEmailParams {
+	settings := s.Settings()
+	params := proto.DefaultCommonEmailParams
+	params.SiteName = settings.EmailSiteName
+	params.SiteURL = settings.EmailSiteURL
+	params.SenderAddress = template.HTML(settings.EmailSenderAddress)
+	params.HelpAddress = template.HTML(settings.EmailHelpAddress)
+	return params
+}
+
+func (s *Server) configure(f func(*Settings)) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	f(&s.configured)
+	s.applySettings()
+}
+
+// applySettings recomputes the current settings from the configured ones and
+// the overrides. The caller must hold the lock.
+func (s *Server) applySettings() {
+	settings := s.configured
+	for name, value := range s.overrides {
+		if err := settings.Set(name, value); err != nil {
+			logging.Logger(s.rootCtx).Printf("ignoring setting override: %s", err)
+		}
+	}
+	s.settings = settings
+}
+
+func (s *Server) watchSettings(events <-chan cluster.ValueEvent) {
+	for {
+		select {
+		case <-s.rootCtx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			s.m.Lock()
+			if event.Deleted {
+				delete(s.overrides, event.Key)
+			} else {
+				s.overrides[event.Key] = event.Value
+			}
+			s.applySettings()
+			s.m.Unlock()
+			if event.Deleted {
+				logging.Logger(s.rootCtx).Printf("setting override removed: %s", event.Key)
+			} else {
+				logging.Logger(s.rootCtx).Printf("setting override: %s=%q", event.Key, event.Value)
+			}
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package backend
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/logging"
+
+	"github.com/gorilla/mux"
+)
+
+// MaxSSECommandSize bounds the body of a command posted to an SSE stream. It
+// leaves room for messages over proto.MaxMessageLength, so that the session
+// can reject them with a reply, as it does over a websocket.
+const MaxSSECommandSize = 2 * proto.MaxMessageLength
+
+// sseTransport carries a session over HTTP, for clients behind proxies that
+// block websockets. Packets to the client are streamed as server-sent events
+// on a long-lived GET request, and the client posts each command to the
+// stream's URL. Posts must carry the credential that opened the stream: the
+// agent cookie, or the bearer token if the stream was opened with one.
+//
+// The stream's connection is hijacked from net/http, so that each write can
+// be given a deadline, as writes to a websocket are.
+type sseTransport struct {
+	id           string
+	roomPath     string
+	agentID      string
+	token        string
+	remoteAddr   net.Addr
+	conn         net.Conn
+	w            *bufio.Writer
+	writeTimeout time.Duration
+
+	incoming  chan *proto.Packet
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newSSETransport(r *http.Request, client *proto.Client) (*sseTransport, error) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, err
+	}
+
+	var remoteAddr net.Addr = &net.TCPAddr{}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		remoteAddr = &net.TCPAddr{IP: net.ParseIP(host)}
+	}
+
+	t := &sseTransport{
+		id:           hex.EncodeToString(idBytes),
+		roomPath:     mux.Vars(r)["prefix"] + mux.Vars(r)["room"],
+		agentID:      client.Agent.IDString(),
+		token:        bearerToken(r),
+		remoteAddr:   remoteAddr,
+		writeTimeout: MaxKeepAliveMisses * KeepAlive,
+		incoming:     make(chan *proto.Packet),
+		done:         make(chan struct{}),
+	}
+	return t, nil
+}
+
+// start takes over the connection, writing the response header and the
+// event that names the stream.
+func (t *sseTransport) start(conn net.Conn, w *bufio.Writer, header http.Header) error {
+	t.conn = conn
+	t.w = w
+	return t.write(func() error {
+		if _, err := io.WriteString(w, "HTTP/1.1 200 OK\r\n"); err != nil {
+			return err
+		}
+		if err := header.Write(w); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, "Connection: close\r\n\r\n"); err != nil {
+			return err
+		}
+		return t.writeEvent("stream", []byte(t.id))
+	})
+}
+
+// authorized returns true if the request carries the credential that opened
+// the stream.
+func (t *sseTransport) authorized(s *Server, r *http.Request) bool {
+	if t.token != "" {
+		return subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(t.token)) == 1
+	}
+	ac, err := readAgentCredentials(s, r)
+	return err == nil && ac.ID == t.agentID
+}
+
+func (t *sseTransport) RemoteAddr() net.Addr { return t.remoteAddr }
+
+func (t *sseTransport) ReadPacket() (*proto.Packet, error) {
+	select {
+	case packet := <-t.incoming:
+		return packet, nil
+	case <-t.done:
+		return nil, io.EOF
+	}
+}
+
+func (t *sseTransport) WritePacket(packet *proto.Packet) error {
+	data, err := packet.Encode()
+	if err != nil {
+		return err
+	}
+	return t.write(func() error { return t.writeEvent("", data) })
+}
+
+// write runs f under a write deadline. If the client doesn't keep up, the
+// stream is closed.
+func (t *sseTransport) write(f func() error) error {
+	if err := t.conn.SetWriteDeadline(time.Now().Add(t.writeTimeout)); err != nil {
+		return err
+	}
+	if err := f(); err != nil {
+		t.close()
+		return err
+	}
+	if err := t.w.Flush(); err != nil {
+		t.close()
+		return err
+	}
+	return t.conn.SetWriteDeadline(time.Time{})
+}
+
+// writeEvent buffers a server-sent event. The data must not contain
+// newlines, which encoding/json never produces.
+func (t *sseTransport) writeEvent(name string, data []byte) error {
+	if name != "" {
+		if _, err := fmt.Fprintf(t.w, "event: %s\n", name); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(t.w, "data: %s\n\n", data); err != nil {
+		return err
+	}
+	return nil
+}
+
+// post delivers a command from the client to the session.
+func (t *sseTransport) post(packet *proto.Packet) error {
+	select {
+	case t.incoming <- packet:
+		return nil
+	case <-t.done:
+		return io.EOF
+	}
+}
+
+func (t *sseTransport) close() { t.closeOnce.Do(func() { close(t.done) }) }
+
+func (s *Server) registerStream(t *sseTransport) {
+	s.streamsM.Lock()
+	defer s.streamsM.Unlock()
+	if s.streams == nil {
+		s.streams = map[string]*sseTransport{}
+	}
+	s.streams[t.id] = t
+}
+
+func (s *Server) unregisterStream(t *sseTransport) {
+	s.streamsM.Lock()
+	defer s.streamsM.Unlock()
+	delete(s.streams, t.id)
+}
+
+func (s *Server) stream(id string) *sseTransport {
+	s.streamsM.Lock()
+	defer s.streamsM.Unlock()
+	return s.streams[id]
+}
+
+func (s *Server) handleRoomSSE(w http.ResponseWriter, r *http.Request) {
+	ctx, room, cookie, client, agentKey, ok := s.resolveRoomRequest(w, r)
+	if !ok {
+		return
+	}
+
+	snapshotOpts, err := parseSnapshotOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	t, err := newSSETransport(r, client)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	header := http.Header{}
+	if cookie != nil {
+		header.Add("Set-Cookie", cookie.String())
+	}
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		logging.Logger(ctx).Printf("sse error: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	s.registerStream(t)
+	defer s.unregisterStream(t)
+	defer t.close()
+
+	// The first event names the stream, so the client knows where to post
+	// its commands.
+	if err := t.start(conn, rw.Writer, header); err != nil {
+		logging.Logger(ctx).Printf("sse error: %s", err)
+		return
+	}
+
+	// The client sends nothing more, so a read returns only once it has
+	// gone away.
+	go func() {
+		io.Copy(ioutil.Discard, rw.Reader)
+		t.close()
+	}()
+
+	s.serveSession(ctx, t, room, client, agentKey, snapshotOpts, r)
+}
+
+func (s *Server) handleRoomSSECommand(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	t := s.stream(vars["stream"])
+	if t == nil || t.roomPath != vars["prefix"]+vars["room"] || !t.authorized(s, r) {
+		http.Error(w, "404 stream not found", http.StatusNotFound)
+		return
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxSSECommandSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	packet, err := proto.ParseRequest(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := t.post(packet); err != nil {
+		http.Error(w, "404 stream not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
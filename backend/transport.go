@@ -0,0 +1,78 @@
+package backend
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"euphoria.io/heim/proto"
+
+	"github.com/gorilla/websocket"
+)
+
+// A transport carries packets between a session and its client.
+type transport interface {
+	// ReadPacket blocks until the client sends a packet. It returns an
+	// error once the client has gone away.
+	ReadPacket() (*proto.Packet, error)
+
+	// WritePacket delivers a packet to the client.
+	WritePacket(*proto.Packet) error
+
+	// RemoteAddr returns the address of the client.
+	RemoteAddr() net.Addr
+}
+
+// websocketTransport exchanges packets over a websocket, in the encoding
+// negotiated by its subprotocol.
+type websocketTransport struct {
+	conn     *websocket.Conn
+	encoding proto.PacketEncoding
+}
+
+func newWebsocketTransport(conn *websocket.Conn) *websocketTransport {
+	return &websocketTransport{
+		conn:     conn,
+		encoding: proto.EncodingForSubprotocol(conn.Subprotocol()),
+	}
+}
+
+func (t *websocketTransport) RemoteAddr() net.Addr { return t.conn.RemoteAddr() }
+
+func (t *websocketTransport) ReadPacket() (*proto.Packet, error) {
+	messageType, data, err := t.conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case messageType == websocket.TextMessage && !t.encoding.Binary(),
+		messageType == websocket.BinaryMessage && t.encoding.Binary():
+		return t.encoding.Decode(data)
+	default:
+		return nil, fmt.Errorf("unsupported message type: %v", messageType)
+	}
+}
+
+func (t *websocketTransport) WritePacket(packet *proto.Packet) error {
+	data, err := t.encoding.Encode(packet)
+	if err != nil {
+		return err
+	}
+
+	messageType := websocket.TextMessage
+	if t.encoding.Binary() {
+		messageType = websocket.BinaryMessage
+	}
+
+	if err := t.conn.SetWriteDeadline(time.Now().Add(MaxKeepAliveMisses * KeepAlive)); err != nil {
+		return err
+	}
+	if err := t.conn.WriteMessage(messageType, data); err != nil {
+		return err
+	}
+	if err := t.conn.SetWriteDeadline(time.Time{}); err != nil {
+		return err
+	}
+	return nil
+}
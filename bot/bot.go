@@ -0,0 +1,422 @@
+// Package bot is a runtime for chat bots, built on the heim client library.
+//
+// A Bot joins any number of rooms and routes messages of the form
+// "!command @Nick args..." to registered commands. The conventional !ping,
+// !help, !uptime and !kill commands are provided. Each room has its own
+// state, kept in a Store so that it survives restarts.
+//
+// Bots always connect as bot agents, and reconnect on their own after a
+// disconnect-event or lost connection.
+package bot
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/client"
+	"euphoria.io/heim/proto/logging"
+	"euphoria.io/scope"
+)
+
+// A CommandFunc handles an invocation of a command. Args holds the words
+// following the command name, without any @mention of the bot.
+type CommandFunc func(ctx scope.Context, room *Room, msg *proto.SendEvent, args []string) error
+
+// A MessageHandler is called for every message posted to a room that the bot
+// doesn't handle as a command, including commands addressed to other bots.
+type MessageHandler func(ctx scope.Context, room *Room, msg *proto.SendEvent) error
+
+type command struct {
+	help    string
+	handler CommandFunc
+}
+
+// A Bot is a set of commands and handlers, run in one or more rooms.
+type Bot struct {
+	// Name is the bot's default nick.
+	Name string
+
+	// ShortHelp is the reply to a general !help. If empty, the bot stays
+	// quiet, leaving general help to other bots.
+	ShortHelp string
+
+	// LongHelp introduces the reply to !help @Name, which goes on to list
+	// the bot's commands.
+	LongHelp string
+
+	// Store keeps each room's state. If nil, state is kept in memory.
+	Store Store
+
+	// AllowKill lets users remove the bot from a room with !kill @Name.
+	AllowKill bool
+
+	m        sync.Mutex
+	commands map[string]*command
+	handlers []MessageHandler
+	rooms    map[string]*Room
+}
+
+// New returns a Bot with the given default nick.
+func New(name string) *Bot {
+	return &Bot{
+		Name:     name,
+		commands: map[string]*command{},
+		rooms:    map[string]*Room{},
+	}
+}
+
+// Command registers a command, invoked as !name. The help text is listed in
+// the reply to !help @Name.
+func (b *Bot) Command(name, help string, handler CommandFunc) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.commands[strings.TrimPrefix(name, "!")] = &command{help: help, handler: handler}
+}
+
+// HandleMessage registers a handler for messages that aren't commands.
+func (b *Bot) HandleMessage(handler MessageHandler) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.handlers = append(b.handlers, handler)
+}
+
+// Rooms returns the rooms the bot is running in.
+func (b *Bot) Rooms() []*Room {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	rooms := make([]*Room, 0, len(b.rooms))
+	for _, room := range b.rooms {
+		rooms = append(rooms, room)
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Name < rooms[j].Name })
+	return rooms
+}
+
+// Join starts running the bot in the room described by cfg. The nick
+// defaults to the bot's name. It returns once the room has been joined; if
+// the room bounces the bot, the returned error is a *client.BounceError.
+func (b *Bot) Join(ctx scope.Context, cfg client.Config) (*Room, error) {
+	cfg.Human = false
+	if cfg.Nick == "" {
+		cfg.Nick = b.Name
+	}
+
+	b.m.Lock()
+	if b.commands == nil {
+		b.commands = map[string]*command{}
+	}
+	if b.rooms == nil {
+		b.rooms = map[string]*Room{}
+	}
+	if _, ok := b.rooms[cfg.Room]; ok {
+		b.m.Unlock()
+		return nil, fmt.Errorf("%s: already joined", cfg.Room)
+	}
+	if b.Store == nil {
+		b.Store = MemStore()
+	}
+	b.m.Unlock()
+
+	c, err := client.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := logging.Logger(ctx)
+	ctx = logging.LoggingContext(
+		ctx.Fork(), logger.Writer(), fmt.Sprintf("%s[%s/%s] ", logger.Prefix(), b.Name, cfg.Room))
+	room := &Room{
+		Name:    cfg.Room,
+		Started: time.Now(),
+		nick:    cfg.Nick,
+		bot:     b,
+		client:  c,
+		ctx:     ctx,
+	}
+	if err := room.loadState(); err != nil {
+		return nil, err
+	}
+
+	c.Handle(proto.SendEventType, func(payload interface{}) {
+		room.handleMessage(payload.(*proto.SendEvent))
+	})
+	c.Handle(proto.BounceEventType, func(payload interface{}) {
+		logging.Logger(ctx).Printf("bounced: %s", payload.(*proto.BounceEvent).Reason)
+	})
+	c.Handle(proto.DisconnectEventType, func(payload interface{}) {
+		logging.Logger(ctx).Printf("disconnected: %s", payload.(*proto.DisconnectEvent).Reason)
+	})
+
+	if err := c.Connect(ctx); err != nil {
+		return nil, err
+	}
+
+	b.m.Lock()
+	b.rooms[cfg.Room] = room
+	b.m.Unlock()
+
+	logging.Logger(ctx).Printf("joined as %s", cfg.Nick)
+	return room, nil
+}
+
+// Leave stops running the bot in the named room.
+func (b *Bot) Leave(name string) error {
+	b.m.Lock()
+	room, ok := b.rooms[name]
+	delete(b.rooms, name)
+	b.m.Unlock()
+
+	if !ok {
+		return fmt.Errorf("%s: not joined", name)
+	}
+	return room.close()
+}
+
+// Close leaves every room.
+func (b *Bot) Close() error {
+	var firstErr error
+	for _, room := range b.Rooms() {
+		if err := b.Leave(room.Name); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (b *Bot) command(name string) (*command, bool) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	cmd, ok := b.commands[name]
+	return cmd, ok
+}
+
+func (b *Bot) messageHandlers() []MessageHandler {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.handlers
+}
+
+func (b *Bot) help() string {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	names := make([]string, 0, len(b.commands))
+	for name := range b.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{}
+	if b.LongHelp != "" {
+		lines = append(lines, b.LongHelp)
+	}
+	for _, name := range names {
+		cmd := b.commands[name]
+		if cmd.help == "" {
+			lines = append(lines, "!"+name)
+		} else {
+			lines = append(lines, fmt.Sprintf("!%s - %s", name, cmd.help))
+		}
+	}
+	lines = append(lines,
+		"!ping [@"+b.Name+"] - check that the bot is alive",
+		"!help @"+b.Name+" - show this message",
+		"!uptime @"+b.Name+" - show how long the bot has been running")
+	if b.AllowKill {
+		lines = append(lines, "!kill @"+b.Name+" - remove the bot from this room")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// A Room is a bot's presence in a single room.
+type Room struct {
+	Name    string
+	Started time.Time
+
+	bot    *Bot
+	client *client.Client
+	ctx    scope.Context
+
+	m     sync.Mutex
+	nick  string
+	state json.RawMessage
+}
+
+// Client returns the client connected to the room, for sending commands the
+// Room doesn't wrap.
+func (r *Room) Client() *client.Client { return r.client }
+
+// Nick returns the bot's nick in the room.
+func (r *Room) Nick() string {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.nick
+}
+
+// SetNick changes the bot's nick in the room.
+func (r *Room) SetNick(ctx scope.Context, name string) error {
+	reply, err := r.client.Nick(ctx, name)
+	if err != nil {
+		return err
+	}
+	r.m.Lock()
+	r.nick = reply.To
+	r.m.Unlock()
+	return nil
+}
+
+// Say posts a top-level message to the room.
+func (r *Room) Say(ctx scope.Context, content string) (*proto.SendReply, error) {
+	return r.client.Say(ctx, content)
+}
+
+// Reply posts a message as a reply to msg.
+func (r *Room) Reply(ctx scope.Context, msg *proto.SendEvent, content string) (*proto.SendReply, error) {
+	return r.client.Reply(ctx, msg.ID, content)
+}
+
+// State decodes the room's state into v. If no state has been saved, v is
+// left untouched.
+func (r *Room) State(v interface{}) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.state == nil {
+		return nil
+	}
+	return json.Unmarshal(r.state, v)
+}
+
+// SetState encodes v as the room's state and saves it to the bot's store.
+func (r *Room) SetState(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+	if err := r.bot.Store.Save(r.bot.Name, r.Name, data); err != nil {
+		return err
+	}
+	r.state = data
+	return nil
+}
+
+func (r *Room) loadState() error {
+	data, err := r.bot.Store.Load(r.bot.Name, r.Name)
+	if err != nil {
+		return fmt.Errorf("%s: loading state: %s", r.Name, err)
+	}
+	r.state = data
+	return nil
+}
+
+func (r *Room) close() error {
+	err := r.client.Close()
+	r.ctx.Cancel()
+	return err
+}
+
+// handleMessage runs on the client's event goroutine, so messages are
+// handled one at a time in the order they were posted.
+func (r *Room) handleMessage(msg *proto.SendEvent) {
+	ctx := r.ctx.Fork()
+	defer ctx.Cancel()
+
+	handled, err := false, error(nil)
+	if inv, ok := r.parseCommand(msg.Content); ok {
+		handled, err = r.runCommand(ctx, msg, inv)
+	}
+	if !handled {
+		for _, handler := range r.bot.messageHandlers() {
+			if err = handler(ctx, r, msg); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		logging.Logger(r.ctx).Printf("handling message %s: %s", msg.ID, err)
+	}
+}
+
+type invocation struct {
+	name      string
+	args      []string
+	addressed bool // the command @mentioned this bot
+}
+
+// parseCommand recognizes "!name [@Nick] args...". A command that mentions
+// some other nick isn't for us.
+func (r *Room) parseCommand(content string) (invocation, bool) {
+	words := strings.Fields(content)
+	if len(words) == 0 || len(words[0]) < 2 || words[0][0] != '!' {
+		return invocation{}, false
+	}
+
+	inv := invocation{name: words[0][1:], args: words[1:]}
+	if len(inv.args) > 0 && strings.HasPrefix(inv.args[0], "@") {
+		if normalizeNick(inv.args[0][1:]) != normalizeNick(r.Nick()) {
+			return invocation{}, false
+		}
+		inv.args = inv.args[1:]
+		inv.addressed = true
+	}
+	return inv, true
+}
+
+// runCommand reports whether the bot recognized the command.
+func (r *Room) runCommand(ctx scope.Context, msg *proto.SendEvent, inv invocation) (bool, error) {
+	var reply string
+	switch inv.name {
+	case "ping":
+		reply = "Pong!"
+	case "help":
+		reply = r.bot.ShortHelp
+		if inv.addressed {
+			reply = r.bot.help()
+		}
+	case "uptime":
+		if inv.addressed {
+			uptime := time.Since(r.Started)
+			reply = fmt.Sprintf("/me has been up since %s (%s)",
+				r.Started.UTC().Format("2006-01-02 15:04:05 UTC"), uptime-uptime%time.Second)
+		}
+	case "kill":
+		if !inv.addressed || !r.bot.AllowKill {
+			return false, nil
+		}
+		if _, err := r.Reply(ctx, msg, "/me exits"); err != nil {
+			return true, err
+		}
+		return true, r.bot.Leave(r.Name)
+	default:
+		cmd, ok := r.bot.command(inv.name)
+		if !ok {
+			return false, nil
+		}
+		return true, cmd.handler(ctx, r, msg, inv.args)
+	}
+
+	if reply == "" {
+		return true, nil
+	}
+	_, err := r.Reply(ctx, msg, reply)
+	return true, err
+}
+
+// normalizeNick reduces a nick to the form used in @mentions.
+func normalizeNick(nick string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, nick)
+}
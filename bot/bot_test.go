@@ -0,0 +1,288 @@
+package bot_test
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"euphoria.io/heim/backend"
+	"euphoria.io/heim/backend/mock"
+	"euphoria.io/heim/bot"
+	"euphoria.io/heim/cluster"
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/client"
+	"euphoria.io/heim/proto/emails"
+	"euphoria.io/heim/proto/security"
+	"euphoria.io/scope"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func newServer() (*httptest.Server, *proto.Heim, func()) {
+	heim := &proto.Heim{
+		Backend:        &mock.TestBackend{},
+		Cluster:        &cluster.TestCluster{},
+		Context:        scope.New(),
+		KMS:            security.LocalKMS(),
+		EmailDeliverer: &emails.TestDeliverer{},
+		SiteName:       "test",
+	}
+	heim.KMS.(security.MockKMS).SetMasterKey(make([]byte, security.AES256.KeySize()))
+
+	app, err := backend.NewServer(heim, "test1", "era1")
+	So(err, ShouldBeNil)
+	app.AllowRoomCreation(true)
+
+	server := httptest.NewServer(app)
+	return server, heim, func() {
+		server.CloseClientConnections()
+		server.Close()
+		heim.Backend.Close()
+	}
+}
+
+// A user is a human participant that sends commands and collects replies.
+type user struct {
+	*client.Client
+	messages chan *proto.SendEvent
+}
+
+func newUser(ctx scope.Context, url, room string) *user {
+	c, err := client.New(client.Config{URL: url, Room: room, Nick: "user", Human: true})
+	So(err, ShouldBeNil)
+	u := &user{Client: c, messages: make(chan *proto.SendEvent, 10)}
+	c.Handle(proto.SendEventType, func(payload interface{}) { u.messages <- payload.(*proto.SendEvent) })
+	So(c.Connect(ctx), ShouldBeNil)
+	return u
+}
+
+// ask sends content and returns the replies to it, waiting briefly for any
+// stragglers.
+func (u *user) ask(ctx scope.Context, content string) []string {
+	sent, err := u.Say(ctx, content)
+	So(err, ShouldBeNil)
+
+	replies := []string{}
+	timeout := time.After(500 * time.Millisecond)
+	for {
+		select {
+		case msg := <-u.messages:
+			if msg.Parent == sent.ID {
+				replies = append(replies, msg.Content)
+				timeout = time.After(100 * time.Millisecond)
+			}
+		case <-timeout:
+			return replies
+		}
+	}
+}
+
+func TestBot(t *testing.T) {
+	save := security.TestMode
+	defer func() { security.TestMode = save }()
+	security.TestMode = true
+
+	Convey("Command routing", t, func() {
+		server, _, cleanup := newServer()
+		defer cleanup()
+		ctx := scope.New()
+
+		b := bot.New("TestBot")
+		b.ShortHelp = "I echo things"
+		b.LongHelp = "TestBot echoes its arguments."
+		b.AllowKill = true
+		b.Command("echo", "repeat the arguments", func(
+			ctx scope.Context, room *bot.Room, msg *proto.SendEvent, args []string) error {
+			_, err := room.Reply(ctx, msg, strings.Join(args, " "))
+			return err
+		})
+
+		seen := make(chan string, 10)
+		b.HandleMessage(func(ctx scope.Context, room *bot.Room, msg *proto.SendEvent) error {
+			seen <- msg.Content
+			return nil
+		})
+
+		room, err := b.Join(ctx, client.Config{URL: server.URL, Room: "bots"})
+		So(err, ShouldBeNil)
+		defer b.Close()
+		So(room.Nick(), ShouldEqual, "TestBot")
+
+		u := newUser(ctx, server.URL, "bots")
+		defer u.Close()
+		So(u.Snapshot().Listing, ShouldHaveLength, 1)
+		So(u.Snapshot().Listing[0].Name, ShouldEqual, "TestBot")
+		So(string(u.Snapshot().Listing[0].ID), ShouldStartWith, "bot:")
+
+		So(u.ask(ctx, "!ping"), ShouldResemble, []string{"Pong!"})
+		So(u.ask(ctx, "!ping @testbot"), ShouldResemble, []string{"Pong!"})
+		So(u.ask(ctx, "!ping @OtherBot"), ShouldBeEmpty)
+		So(u.ask(ctx, "!help"), ShouldResemble, []string{"I echo things"})
+
+		help := u.ask(ctx, "!help @TestBot")
+		So(help, ShouldHaveLength, 1)
+		So(help[0], ShouldStartWith, "TestBot echoes its arguments.\n!echo - repeat the arguments\n")
+		So(help[0], ShouldContainSubstring, "!kill @TestBot")
+
+		So(u.ask(ctx, "!uptime"), ShouldBeEmpty)
+		uptime := u.ask(ctx, "!uptime @TestBot")
+		So(uptime, ShouldHaveLength, 1)
+		So(uptime[0], ShouldStartWith, "/me has been up since ")
+
+		So(u.ask(ctx, "!echo a  b c"), ShouldResemble, []string{"a b c"})
+		So(u.ask(ctx, "!echo @TestBot hi"), ShouldResemble, []string{"hi"})
+		So(u.ask(ctx, "!unknown"), ShouldBeEmpty)
+		So(u.ask(ctx, "hello there"), ShouldBeEmpty)
+		So(<-seen, ShouldEqual, "!ping @OtherBot")
+		So(<-seen, ShouldEqual, "!unknown")
+		So(<-seen, ShouldEqual, "hello there")
+
+		So(room.SetNick(ctx, "Echo Bot"), ShouldBeNil)
+		So(u.ask(ctx, "!ping @EchoBot"), ShouldResemble, []string{"Pong!"})
+
+		So(u.ask(ctx, "!kill @EchoBot"), ShouldResemble, []string{"/me exits"})
+		So(b.Rooms(), ShouldBeEmpty)
+		So(u.ask(ctx, "!ping"), ShouldBeEmpty)
+	})
+
+	Convey("Room state persists", t, func() {
+		server, _, cleanup := newServer()
+		defer cleanup()
+		ctx := scope.New()
+
+		dir, err := ioutil.TempDir("", "heimbot")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		type counter struct{ N int }
+		newBot := func() *bot.Bot {
+			b := bot.New("Counter")
+			b.Store = bot.FileStore(dir)
+			b.Command("count", "", func(
+				ctx scope.Context, room *bot.Room, msg *proto.SendEvent, args []string) error {
+				var c counter
+				if err := room.State(&c); err != nil {
+					return err
+				}
+				c.N++
+				if err := room.SetState(&c); err != nil {
+					return err
+				}
+				_, err := room.Reply(ctx, msg, strings.Repeat("!", c.N))
+				return err
+			})
+			return b
+		}
+
+		b := newBot()
+		_, err = b.Join(ctx, client.Config{URL: server.URL, Room: "counta"})
+		So(err, ShouldBeNil)
+		_, err = b.Join(ctx, client.Config{URL: server.URL, Room: "countb"})
+		So(err, ShouldBeNil)
+		So(b.Rooms(), ShouldHaveLength, 2)
+
+		a := newUser(ctx, server.URL, "counta")
+		defer a.Close()
+		So(a.ask(ctx, "!count"), ShouldResemble, []string{"!"})
+		So(a.ask(ctx, "!count"), ShouldResemble, []string{"!!"})
+
+		bu := newUser(ctx, server.URL, "countb")
+		defer bu.Close()
+		So(bu.ask(ctx, "!count"), ShouldResemble, []string{"!"})
+		So(b.Close(), ShouldBeNil)
+
+		_, err = os.Stat(filepath.Join(dir, "Counter", "counta.json"))
+		So(err, ShouldBeNil)
+
+		b = newBot()
+		_, err = b.Join(ctx, client.Config{URL: server.URL, Room: "counta"})
+		So(err, ShouldBeNil)
+		defer b.Close()
+		So(a.ask(ctx, "!count"), ShouldResemble, []string{"!!!"})
+	})
+
+	Convey("Private rooms", t, func() {
+		server, heim, cleanup := newServer()
+		defer cleanup()
+		ctx := scope.New()
+
+		agentKey := &security.ManagedKey{
+			KeyType:   proto.AgentKeyType,
+			Plaintext: make([]byte, proto.AgentKeyType.KeySize()),
+		}
+		agent, err := proto.NewAgent([]byte("owner"), agentKey)
+		So(err, ShouldBeNil)
+		So(heim.Backend.AgentTracker().Register(ctx, agent), ShouldBeNil)
+		owner, ownerKey, err := heim.Backend.AccountManager().Register(
+			ctx, heim.KMS, "email", "owner", "ownerpass", agent.IDString(), agentKey)
+		So(err, ShouldBeNil)
+		room, err := heim.Backend.CreateRoom(ctx, heim.KMS, true, "secret", owner)
+		So(err, ShouldBeNil)
+		rkey, err := room.MessageKey(ctx)
+		So(err, ShouldBeNil)
+		So(rkey.GrantToPasscode(ctx, owner, ownerKey, "hunter2"), ShouldBeNil)
+
+		b := bot.New("Sneaky")
+		_, err = b.Join(ctx, client.Config{URL: server.URL, Room: "secret"})
+		So(err, ShouldResemble, &client.BounceError{Reason: "authentication required"})
+		So(b.Rooms(), ShouldBeEmpty)
+
+		_, err = b.Join(ctx, client.Config{URL: server.URL, Room: "secret", Passcode: "hunter2"})
+		So(err, ShouldBeNil)
+		defer b.Close()
+		So(b.Rooms(), ShouldHaveLength, 1)
+	})
+
+	Convey("YAML configuration", t, func() {
+		server, _, cleanup := newServer()
+		defer cleanup()
+		ctx := scope.New()
+
+		dir, err := ioutil.TempDir("", "heimbot")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "bots.yml")
+		So(ioutil.WriteFile(path, []byte(`
+server: `+server.URL+`
+state-dir: `+filepath.Join(dir, "state")+`
+bots:
+  - name: Greeter
+    short-help: say !hello
+    rooms:
+      - greet
+      - name: greet2
+        nick: Greeter Two
+    responses:
+      hello: "Hello, {{.Sender}}! (#{{.Count}} {{index .Args 0}})"
+`), 0600), ShouldBeNil)
+
+		cfg, err := bot.LoadConfig(path)
+		So(err, ShouldBeNil)
+		So(cfg.Bots, ShouldHaveLength, 1)
+		So(cfg.Bots[0].Rooms, ShouldResemble, []bot.RoomConfig{
+			{Name: "greet"},
+			{Name: "greet2", Nick: "Greeter Two"},
+		})
+
+		bots, err := cfg.Start(ctx)
+		So(err, ShouldBeNil)
+		So(bots, ShouldHaveLength, 1)
+		defer bots[0].Close()
+		So(bots[0].Rooms()[1].Nick(), ShouldEqual, "Greeter Two")
+
+		u := newUser(ctx, server.URL, "greet")
+		defer u.Close()
+		So(u.ask(ctx, "!help"), ShouldResemble, []string{"say !hello"})
+		So(u.ask(ctx, "!hello x"), ShouldResemble, []string{"Hello, user! (#1 x)"})
+		So(u.ask(ctx, "!hello @Greeter y"), ShouldResemble, []string{"Hello, user! (#2 y)"})
+
+		So(ioutil.WriteFile(path, []byte("bots:\n  - name: NoRooms\n    server: http://x\n"), 0600), ShouldBeNil)
+		_, err = bot.LoadConfig(path)
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,234 @@
+package bot
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"text/template"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/client"
+	"euphoria.io/scope"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config declares a set of bots, each answering canned responses to
+// commands. It's the format read by heimctl bot.
+type Config struct {
+	// Server is the base URL of the heim server bots connect to, unless a
+	// bot gives its own.
+	Server string `yaml:"server"`
+
+	// StateDir is where room state is kept. If empty, state is kept in
+	// memory.
+	StateDir string `yaml:"state-dir,omitempty"`
+
+	Bots []BotConfig `yaml:"bots"`
+}
+
+// A BotConfig declares a bot and the rooms it runs in.
+type BotConfig struct {
+	Name      string       `yaml:"name"`
+	Server    string       `yaml:"server,omitempty"`
+	ShortHelp string       `yaml:"short-help,omitempty"`
+	Help      string       `yaml:"help,omitempty"`
+	AllowKill bool         `yaml:"allow-kill,omitempty"`
+	Login     *LoginConfig `yaml:"login,omitempty"`
+	APIToken  string       `yaml:"api-token,omitempty"`
+	Rooms     []RoomConfig `yaml:"rooms"`
+
+	// Responses maps command names to replies. Replies are templates
+	// executed with a ResponseData.
+	Responses map[string]string `yaml:"responses,omitempty"`
+}
+
+// LoginConfig gives the account a bot logs into.
+type LoginConfig struct {
+	Namespace string `yaml:"namespace"`
+	ID        string `yaml:"id"`
+	Password  string `yaml:"password"`
+}
+
+// A RoomConfig names a room for a bot to join. In YAML it may be given as
+// just the room's name.
+type RoomConfig struct {
+	Name     string `yaml:"name"`
+	Nick     string `yaml:"nick,omitempty"`
+	Passcode string `yaml:"passcode,omitempty"`
+}
+
+func (rc *RoomConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err == nil {
+		*rc = RoomConfig{Name: name}
+		return nil
+	}
+
+	type plain RoomConfig
+	return unmarshal((*plain)(rc))
+}
+
+// ResponseData is available to response templates.
+type ResponseData struct {
+	Room    string
+	Sender  string
+	Args    []string
+	Command string
+
+	// Count is how many times the command has been used in the room,
+	// including this time.
+	Count int
+}
+
+// LoadConfig reads a Config from a YAML file.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) validate() error {
+	seen := map[string]bool{}
+	for i, bc := range cfg.Bots {
+		if bc.Name == "" {
+			return fmt.Errorf("bot %d: name required", i+1)
+		}
+		if seen[bc.Name] {
+			return fmt.Errorf("bot %s: declared more than once", bc.Name)
+		}
+		seen[bc.Name] = true
+		if bc.Server == "" && cfg.Server == "" {
+			return fmt.Errorf("bot %s: no server given", bc.Name)
+		}
+		if len(bc.Rooms) == 0 {
+			return fmt.Errorf("bot %s: no rooms given", bc.Name)
+		}
+		for _, rc := range bc.Rooms {
+			if rc.Name == "" {
+				return fmt.Errorf("bot %s: room name required", bc.Name)
+			}
+		}
+		for name, text := range bc.Responses {
+			if _, err := template.New(name).Parse(text); err != nil {
+				return fmt.Errorf("bot %s: response to %s: %s", bc.Name, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Start creates the declared bots and joins each to its rooms. If any room
+// can't be joined, the bots already started are closed and the error is
+// returned.
+func (cfg *Config) Start(ctx scope.Context) ([]*Bot, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	var store Store
+	if cfg.StateDir != "" {
+		store = FileStore(cfg.StateDir)
+	} else {
+		store = MemStore()
+	}
+
+	bots := make([]*Bot, 0, len(cfg.Bots))
+	closeAll := func() {
+		for _, b := range bots {
+			b.Close()
+		}
+	}
+
+	for _, bc := range cfg.Bots {
+		b, err := bc.bot(store)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		bots = append(bots, b)
+
+		server := bc.Server
+		if server == "" {
+			server = cfg.Server
+		}
+		for _, rc := range bc.Rooms {
+			cc := client.Config{
+				URL:      server,
+				Room:     rc.Name,
+				Nick:     rc.Nick,
+				Passcode: rc.Passcode,
+				APIToken: bc.APIToken,
+			}
+			if bc.Login != nil {
+				cc.Login = &proto.LoginCommand{
+					Namespace: bc.Login.Namespace,
+					ID:        bc.Login.ID,
+					Password:  bc.Login.Password,
+				}
+			}
+			if _, err := b.Join(ctx, cc); err != nil {
+				closeAll()
+				return nil, fmt.Errorf("bot %s: %s: %s", bc.Name, rc.Name, err)
+			}
+		}
+	}
+	return bots, nil
+}
+
+func (bc *BotConfig) bot(store Store) (*Bot, error) {
+	b := New(bc.Name)
+	b.ShortHelp = bc.ShortHelp
+	b.LongHelp = bc.Help
+	b.AllowKill = bc.AllowKill
+	b.Store = store
+
+	for name, text := range bc.Responses {
+		name = strings.TrimPrefix(name, "!")
+		tmpl, err := template.New(name).Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		b.Command(name, "", respond(name, tmpl))
+	}
+	return b, nil
+}
+
+// respond returns a command that replies with the executed template, keeping
+// count of its uses in the room's state.
+func respond(name string, tmpl *template.Template) CommandFunc {
+	return func(ctx scope.Context, room *Room, msg *proto.SendEvent, args []string) error {
+		counts := map[string]int{}
+		if err := room.State(&counts); err != nil {
+			return err
+		}
+		counts[name]++
+		if err := room.SetState(counts); err != nil {
+			return err
+		}
+
+		data := &ResponseData{
+			Room:    room.Name,
+			Sender:  msg.Sender.Name,
+			Args:    args,
+			Command: name,
+			Count:   counts[name],
+		}
+		buf := &bytes.Buffer{}
+		if err := tmpl.Execute(buf, data); err != nil {
+			return err
+		}
+		_, err := room.Reply(ctx, msg, buf.String())
+		return err
+	}
+}
@@ -0,0 +1,81 @@
+package bot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// A Store persists the state of each room a bot runs in, as JSON.
+type Store interface {
+	// Load returns the saved state of the bot in the room, or nil if there
+	// is none.
+	Load(bot, room string) ([]byte, error)
+
+	// Save replaces the saved state of the bot in the room.
+	Save(bot, room string, data []byte) error
+}
+
+// MemStore returns a Store that keeps state in memory, for bots that don't
+// need it to outlive the process.
+func MemStore() Store { return &memStore{data: map[string][]byte{}} }
+
+type memStore struct {
+	m    sync.Mutex
+	data map[string][]byte
+}
+
+func (s *memStore) Load(bot, room string) ([]byte, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.data[bot+"/"+room], nil
+}
+
+func (s *memStore) Save(bot, room string, data []byte) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.data[bot+"/"+room] = append([]byte(nil), data...)
+	return nil
+}
+
+// FileStore returns a Store that keeps the state of each room in its own
+// file, at dir/bot/room.json.
+func FileStore(dir string) Store { return fileStore(dir) }
+
+type fileStore string
+
+func (s fileStore) path(bot, room string) string {
+	return filepath.Join(string(s), filepath.Base(bot), filepath.Base(room)+".json")
+}
+
+func (s fileStore) Load(bot, room string) ([]byte, error) {
+	data, err := ioutil.ReadFile(s.path(bot, room))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (s fileStore) Save(bot, room string, data []byte) error {
+	path := s.path(bot, room)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash can't leave a partial file.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,24 @@
+import React from 'react'
+
+import { Item, Span, A } from 'react-html-email'
+import { StandardEmail, TopBubbleBox, BodyBox, standardFooter, textDefaults } from './common'
+
+
+module.exports = (
+  <StandardEmail>
+    <TopBubbleBox logo="logo-warning.png" padding={15}>
+      <Item align="center">
+        <Span {...textDefaults} fontSize={20}>{'Two-factor authentication has been {{if .Enabled}}enabled{{else}}disabled{{end}}.'}</Span>
+      </Item>
+    </TopBubbleBox>
+    <BodyBox>
+      <Item>
+        <Span {...textDefaults}>Hey, just keeping you in the loop. If you just {'{{if .Enabled}}turned on{{else}}turned off{{end}}'} two-factor authentication for your <A {...textDefaults} href="{{.SiteURL}}">{'{{.SiteName}}'}</A> account, you're good to go!</Span>
+      </Item>
+      <Item>
+        <Span {...textDefaults}>If you did not make this change and suspect something fishy is going on, please reply to this email immediately.</Span>
+      </Item>
+    </BodyBox>
+    {standardFooter}
+  </StandardEmail>
+)
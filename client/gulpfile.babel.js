@@ -212,6 +212,7 @@ gulp.task('site-templates', ['heim-git-commit'], () => {
     'error',
     'verify-email',
     'reset-password',
+    'oidc-otp',
     'about',
     'about/values',
     'about/conduct',
@@ -232,7 +233,7 @@ gulp.task('email-templates', () => {
   ReactHTMLEmail.injectReactEmailAttributes()
   ReactHTMLEmail.configStyleValidator({platforms: ['gmail']})
   const renderEmail = require('react-html-email').renderEmail
-  const emails = ['welcome', 'room-invitation', 'room-invitation-welcome', 'verification', 'password-changed', 'password-reset']
+  const emails = ['welcome', 'room-invitation', 'room-invitation-welcome', 'verification', 'password-changed', 'password-reset', 'otp-changed']
 
   const htmls = merge(_.map(emails, name => {
     const html = renderEmail(reload('./emails/' + name))
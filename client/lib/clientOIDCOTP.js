@@ -0,0 +1,17 @@
+import React from 'react'
+import ReactDOM from 'react-dom'
+
+import oidcOTPFlow from './stores/oidcOTPFlow'
+import OIDCOTPForm from './ui/OIDCOTPForm'
+
+
+export default function clientOIDCOTP() {
+  const attachPoint = uidocument.getElementById('form-container')
+  const contextData = JSON.parse(attachPoint.getAttribute('data-context'))
+  oidcOTPFlow.initData(contextData)
+
+  ReactDOM.render(
+    <OIDCOTPForm />,
+    attachPoint
+  )
+}
@@ -0,0 +1,56 @@
+import _ from 'lodash'
+import Reflux from 'reflux'
+import Immutable from 'immutable'
+
+import heimURL from '../heimURL'
+import ImmutableMixin from './ImmutableMixin'
+import PostFlowMixin from './PostFlowMixin'
+
+
+const storeActions = Reflux.createActions([
+  'initData',
+  'submitOTP',
+])
+_.extend(module.exports, storeActions)
+
+storeActions.initData.sync = true
+
+const StateRecord = Immutable.Record({
+  provider: null,
+  next: '/',
+  done: false,
+  errors: Immutable.Map(),
+  working: false,
+})
+
+module.exports.store = Reflux.createStore({
+  listenables: [
+    storeActions,
+  ],
+
+  mixins: [
+    ImmutableMixin,
+    PostFlowMixin,
+  ],
+
+  init() {
+    this.state = new StateRecord()
+  },
+
+  getInitialState() {
+    return this.state
+  },
+
+  initData(data) {
+    this.triggerUpdate(this.state.merge(data))
+  },
+
+  submitOTP(otp) {
+    this._postAPI(heimURL('/oidc/' + this.state.provider + '/otp'), {otp})
+      .then(() => {
+        if (this.state.done) {
+          uiwindow.location.assign(this.state.next)
+        }
+      })
+  },
+})
@@ -0,0 +1,44 @@
+import React from 'react'
+import Reflux from 'reflux'
+
+import oidcOTPFlow from '../stores/oidcOTPFlow'
+import { Form, TextField, ErrorMessage } from './forms'
+
+
+export default React.createClass({
+  displayName: 'OIDCOTPForm',
+
+  mixins: [
+    Reflux.connect(oidcOTPFlow.store, 'flow'),
+  ],
+
+  onSubmit(values) {
+    oidcOTPFlow.submitOTP(values.otp)
+  },
+
+  render() {
+    const flow = this.state.flow
+    return (
+      <Form
+        ref="form"
+        className="oidc-otp"
+        onSubmit={this.onSubmit}
+        working={flow.working}
+        errors={flow.errors.toJS()}
+      >
+        <h1>sign in</h1>
+        <h2>please enter a one-time password from your authenticator app, or one of your recovery codes:</h2>
+        <TextField
+          name="otp"
+          label="one-time password"
+          inputType="text"
+          tabIndex={1}
+          spellCheck={false}
+          autoFocus
+        />
+        <ErrorMessage name="reason" />
+        {flow.done ? <button className="major-action done" disabled>signed in! taking you back...</button> : <button type="submit" className="major-action">sign in</button>}
+      </Form>
+    )
+  },
+})
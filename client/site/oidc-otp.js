@@ -0,0 +1,10 @@
+import React from 'react'
+
+import { MainPage, HeimAttachPoint } from './common'
+
+
+module.exports = (
+  <MainPage title="euphoria: sign in" className="form-page" heimPage="oidc-otp">
+    <HeimAttachPoint id="form-container" />
+  </MainPage>
+)
@@ -19,14 +19,50 @@ type Cluster interface {
 	GetDir(key string) (map[string]string, error)
 	GetValue(key string) (string, error)
 	SetValue(key, value string) error
+
+	// DeleteValue removes key. Deleting a key that doesn't exist succeeds.
+	DeleteValue(key string) error
+
 	GetValueWithDefault(key string, setter func() (string, error)) (string, error)
 
+	// WatchDir delivers the current values in the directory key, followed by
+	// every subsequent change to them. The channel is closed when the
+	// cluster is parted.
+	WatchDir(key string) <-chan ValueEvent
+
 	GetSecret(kms security.KMS, name string, bytes int) ([]byte, error)
 
 	Update(desc *PeerDesc) error
 	Part()
 	Peers() []PeerDesc
 	Watch() <-chan PeerEvent
+
+	// Lock takes out a lease on key for ttl. It returns ErrLocked if the
+	// lease is held by another process.
+	Lock(key string, ttl time.Duration) (Lock, error)
+
+	// Campaign begins campaigning for leadership of key.
+	Campaign(key string) *Election
+}
+
+// SharesValues reports whether the values set in c are seen by all of its
+// peers. A cluster whose peers each keep values to themselves says so by
+// implementing LocalValues.
+func SharesValues(c Cluster) bool {
+	if lv, ok := c.(interface{ LocalValues() bool }); ok {
+		return !lv.LocalValues()
+	}
+	return true
+}
+
+// CanLead reports whether this process may ever take locks or win elections
+// in c. A cluster that leaves some of its processes out of leadership says so
+// by implementing CanLead.
+func CanLead(c Cluster) bool {
+	if cl, ok := c.(interface{ CanLead() bool }); ok {
+		return cl.CanLead()
+	}
+	return true
 }
 
 type PeerEvent interface {
@@ -60,17 +96,19 @@ func (ps PeerList) Less(i, j int) bool { return ps[i].ID < ps[j].ID }
 func (ps PeerList) Swap(i, j int)      { ps[i], ps[j] = ps[j], ps[i] }
 
 type TestCluster struct {
-	sync.Mutex
+	m       sync.Mutex
 	data    map[string]string
 	peers   map[string]PeerDesc
 	secrets map[string][]byte
+	locks   map[string]*testLock
+	values  ValueWatchers
 	c       chan PeerEvent
 	myID    string
 }
 
 func (tc *TestCluster) GetDir(key string) (map[string]string, error) {
-	tc.Lock()
-	defer tc.Unlock()
+	tc.m.Lock()
+	defer tc.m.Unlock()
 	key = strings.TrimRight(key, "/") + "/"
 	result := map[string]string{}
 	for k, v := range tc.data {
@@ -82,8 +120,8 @@ func (tc *TestCluster) GetDir(key string) (map[string]string, error) {
 }
 
 func (tc *TestCluster) GetValue(key string) (string, error) {
-	tc.Lock()
-	defer tc.Unlock()
+	tc.m.Lock()
+	defer tc.m.Unlock()
 	data, ok := tc.data[key]
 	if !ok {
 		return "", ErrNotFound
@@ -92,15 +130,30 @@ func (tc *TestCluster) GetValue(key string) (string, error) {
 }
 
 func (tc *TestCluster) SetValue(key, value string) error {
-	tc.Lock()
+	tc.m.Lock()
+	if tc.data == nil {
+		tc.data = map[string]string{}
+	}
 	tc.data[key] = value
-	tc.Unlock()
+	tc.m.Unlock()
+	tc.values.Notify(key, value, false)
+	return nil
+}
+
+func (tc *TestCluster) DeleteValue(key string) error {
+	tc.m.Lock()
+	_, ok := tc.data[key]
+	delete(tc.data, key)
+	tc.m.Unlock()
+	if ok {
+		tc.values.Notify(key, "", true)
+	}
 	return nil
 }
 
 func (tc *TestCluster) GetValueWithDefault(key string, setter func() (string, error)) (string, error) {
-	tc.Lock()
-	defer tc.Unlock()
+	tc.m.Lock()
+	defer tc.m.Unlock()
 	if val, ok := tc.data[key]; ok {
 		return val, nil
 	}
@@ -112,12 +165,27 @@ func (tc *TestCluster) GetValueWithDefault(key string, setter func() (string, er
 		tc.data = map[string]string{}
 	}
 	tc.data[key] = val
+	tc.values.Notify(key, val, false)
 	return val, nil
 }
 
+func (tc *TestCluster) WatchDir(key string) <-chan ValueEvent {
+	tc.m.Lock()
+	defer tc.m.Unlock()
+
+	prefix := strings.Trim(key, "/") + "/"
+	current := map[string]string{}
+	for k, v := range tc.data {
+		if k = strings.TrimLeft(k, "/"); strings.HasPrefix(k, prefix) {
+			current[k[len(prefix):]] = v
+		}
+	}
+	return tc.values.Watch(key, current)
+}
+
 func (tc *TestCluster) GetSecret(kms security.KMS, name string, bytes int) ([]byte, error) {
-	tc.Lock()
-	defer tc.Unlock()
+	tc.m.Lock()
+	defer tc.m.Unlock()
 
 	if secret, ok := tc.secrets[name]; ok {
 		if len(secret) != bytes {
@@ -140,8 +208,8 @@ func (tc *TestCluster) GetSecret(kms security.KMS, name string, bytes int) ([]by
 }
 
 func (tc *TestCluster) update(desc *PeerDesc) PeerEvent {
-	tc.Lock()
-	defer tc.Unlock()
+	tc.m.Lock()
+	defer tc.m.Unlock()
 
 	if tc.myID == "" {
 		tc.myID = desc.ID
@@ -173,8 +241,8 @@ func (tc *TestCluster) Update(desc *PeerDesc) error {
 }
 
 func (tc *TestCluster) part() PeerEvent {
-	tc.Lock()
-	defer tc.Unlock()
+	tc.m.Lock()
+	defer tc.m.Unlock()
 	desc, ok := tc.peers[tc.myID]
 	delete(tc.peers, tc.myID)
 	if ok {
@@ -190,8 +258,8 @@ func (tc *TestCluster) Part() {
 }
 
 func (tc *TestCluster) Peers() []PeerDesc {
-	tc.Lock()
-	defer tc.Unlock()
+	tc.m.Lock()
+	defer tc.m.Unlock()
 	peers := []PeerDesc{}
 	for _, peer := range tc.peers {
 		peers = append(peers, peer)
@@ -200,10 +268,58 @@ func (tc *TestCluster) Peers() []PeerDesc {
 }
 
 func (tc *TestCluster) Watch() <-chan PeerEvent {
-	tc.Lock()
-	defer tc.Unlock()
+	tc.m.Lock()
+	defer tc.m.Unlock()
 	if tc.c == nil {
 		tc.c = make(chan PeerEvent)
 	}
 	return tc.c
 }
+
+type testLock struct {
+	tc      *TestCluster
+	key     string
+	ttl     time.Duration
+	expires time.Time
+}
+
+func (tc *TestCluster) Lock(key string, ttl time.Duration) (Lock, error) {
+	tc.m.Lock()
+	defer tc.m.Unlock()
+
+	if l, ok := tc.locks[key]; ok && time.Now().Before(l.expires) {
+		return nil, ErrLocked
+	}
+	if tc.locks == nil {
+		tc.locks = map[string]*testLock{}
+	}
+	l := &testLock{tc: tc, key: key, ttl: ttl, expires: time.Now().Add(ttl)}
+	tc.locks[key] = l
+	return l, nil
+}
+
+func (tc *TestCluster) Campaign(key string) *Election { return NewElection(tc.Lock, key, TTL) }
+
+func (l *testLock) Key() string { return l.key }
+
+func (l *testLock) Refresh() error {
+	l.tc.m.Lock()
+	defer l.tc.m.Unlock()
+
+	now := time.Now()
+	if l.tc.locks[l.key] != l || !now.Before(l.expires) {
+		return ErrLockLost
+	}
+	l.expires = now.Add(l.ttl)
+	return nil
+}
+
+func (l *testLock) Unlock() error {
+	l.tc.m.Lock()
+	defer l.tc.m.Unlock()
+
+	if l.tc.locks[l.key] == l {
+		delete(l.tc.locks, l.key)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package etcd
 
 import (
+	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -136,6 +137,32 @@ func (t tree) visit(n *etcd.Node, prefix string) {
 	}
 }
 
+// changes returns the events that turn t into next, in key order.
+func (t tree) changes(next tree) []cluster.ValueEvent {
+	keys := make([]string, 0, len(next))
+	for k, v := range next {
+		if prev, ok := t[k]; !ok || prev != v {
+			keys = append(keys, k)
+		}
+	}
+	for k := range t {
+		if _, ok := next[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	events := make([]cluster.ValueEvent, len(keys))
+	for i, k := range keys {
+		if v, ok := next[k]; ok {
+			events[i] = cluster.ValueEvent{Key: k, Value: v}
+		} else {
+			events[i] = cluster.ValueEvent{Key: k, Deleted: true}
+		}
+	}
+	return events
+}
+
 func (e *etcdCluster) GetDir(key string) (map[string]string, error) {
 	prefix := e.key("%s", key) + "/"
 	resp, err := e.c.Get(prefix, false, false)
@@ -170,6 +197,16 @@ func (e *etcdCluster) SetValue(key, value string) error {
 	return nil
 }
 
+func (e *etcdCluster) DeleteValue(key string) error {
+	if _, err := e.c.Delete(e.key("%s", key), false); err != nil {
+		if etcdErr, ok := err.(*etcd.EtcdError); ok && etcdErr.ErrorCode == 100 {
+			return nil
+		}
+		return fmt.Errorf("delete %s: %s", e.key("%s", key), err)
+	}
+	return nil
+}
+
 func (e *etcdCluster) Peers() []cluster.PeerDesc {
 	e.m.RLock()
 	defer e.m.RUnlock()
@@ -345,3 +382,188 @@ func (e *etcdCluster) GetValueWithDefault(key string, setter func() (string, err
 		return resp.Node.Value, nil
 	}
 }
+
+type etcdLock struct {
+	e     *etcdCluster
+	key   string
+	token string
+	ttl   uint64
+}
+
+func ttlSeconds(ttl time.Duration) uint64 {
+	if ttl < time.Second {
+		return 1
+	}
+	return uint64(ttl / time.Second)
+}
+
+func (e *etcdCluster) Lock(key string, ttl time.Duration) (cluster.Lock, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+
+	l := &etcdLock{
+		e:     e,
+		key:   key,
+		token: hex.EncodeToString(token),
+		ttl:   ttlSeconds(ttl),
+	}
+	if _, err := e.c.Create(e.key("/locks/%s", key), l.token, l.ttl); err != nil {
+		if etcdErr, ok := err.(*etcd.EtcdError); ok && etcdErr.ErrorCode == 105 {
+			return nil, cluster.ErrLocked
+		}
+		return nil, fmt.Errorf("lock %s: %s", key, err)
+	}
+	return l, nil
+}
+
+func (e *etcdCluster) Campaign(key string) *cluster.Election {
+	return cluster.NewElection(e.Lock, key, cluster.TTL)
+}
+
+func (l *etcdLock) Key() string { return l.key }
+
+func (l *etcdLock) Refresh() error {
+	if _, err := l.e.c.CompareAndSwap(l.e.key("/locks/%s", l.key), l.token, l.ttl, l.token, 0); err != nil {
+		if etcdErr, ok := err.(*etcd.EtcdError); ok && (etcdErr.ErrorCode == 100 || etcdErr.ErrorCode == 101) {
+			return cluster.ErrLockLost
+		}
+		return fmt.Errorf("refresh lock %s: %s", l.key, err)
+	}
+	return nil
+}
+
+func (l *etcdLock) Unlock() error {
+	if _, err := l.e.c.CompareAndDelete(l.e.key("/locks/%s", l.key), l.token, 0); err != nil {
+		if etcdErr, ok := err.(*etcd.EtcdError); ok && (etcdErr.ErrorCode == 100 || etcdErr.ErrorCode == 101) {
+			return nil
+		}
+		return fmt.Errorf("unlock %s: %s", l.key, err)
+	}
+	return nil
+}
+
+func (e *etcdCluster) WatchDir(key string) <-chan cluster.ValueEvent {
+	ch := make(chan cluster.ValueEvent)
+	go e.watchDir(e.key("%s", key)+"/", ch)
+	return ch
+}
+
+func (e *etcdCluster) watchDir(prefix string, ch chan<- cluster.ValueEvent) {
+	defer close(ch)
+
+	send := func(event cluster.ValueEvent) bool {
+		select {
+		case ch <- event:
+			return true
+		case <-e.stop:
+			return false
+		}
+	}
+
+	backoff := initialWatchBackoff
+	numFailures := 0
+
+	// retry waits out the backoff after a failure, or terminates the server
+	// if there have been too many in a row.
+	retry := func(err error) bool {
+		fmt.Printf("cluster error: watch %s: %s\n", prefix, err)
+		peerWatchErrors.Inc()
+
+		numFailures++
+		if numFailures >= maxConsecutiveWatchFailures {
+			e.ctx.Terminate(fmt.Errorf("cluster error: %d consecutive watch errors on %s", numFailures, prefix))
+			return false
+		}
+		select {
+		case <-time.After(backoff):
+		case <-e.stop:
+			return false
+		}
+		backoff *= 2
+		return true
+	}
+
+	known := tree{}
+	var recv chan *etcd.Response
+	for {
+		if recv == nil {
+			// List the directory and send whatever changed since it was last
+			// seen, then watch from there. Listing again after a failed watch
+			// recovers from etcd clearing the index we were waiting on.
+			current, waitIndex, err := e.listDir(prefix)
+			if err != nil {
+				if !retry(err) {
+					return
+				}
+				continue
+			}
+			for _, event := range known.changes(current) {
+				if !send(event) {
+					return
+				}
+			}
+			known = current
+
+			recv = make(chan *etcd.Response)
+			go e.c.Watch(prefix, waitIndex, true, recv, e.stop)
+		}
+
+		var resp *etcd.Response
+		select {
+		case resp = <-recv:
+		case <-e.stop:
+			return
+		}
+
+		if resp == nil {
+			recv = nil
+			if !retry(fmt.Errorf("nil response")) {
+				return
+			}
+			continue
+		}
+
+		backoff = initialWatchBackoff
+		numFailures = 0
+
+		if resp.Node.Dir || !strings.HasPrefix(resp.Node.Key, prefix) {
+			continue
+		}
+
+		event := cluster.ValueEvent{Key: resp.Node.Key[len(prefix):]}
+		switch resp.Action {
+		case "set", "create", "update", "compareAndSwap":
+			event.Value = resp.Node.Value
+			known[event.Key] = event.Value
+		case "delete", "expire", "compareAndDelete":
+			event.Deleted = true
+			delete(known, event.Key)
+		default:
+			continue
+		}
+		if !send(event) {
+			return
+		}
+	}
+}
+
+// listDir returns the contents of a directory, which may not exist yet, and
+// the index to watch it from.
+func (e *etcdCluster) listDir(prefix string) (tree, uint64, error) {
+	current := tree{}
+	resp, err := e.c.Get(prefix, true, true)
+	switch err := err.(type) {
+	case nil:
+		current.visit(resp.Node, prefix)
+		return current, resp.EtcdIndex + 1, nil
+	case *etcd.EtcdError:
+		if err.ErrorCode != 100 {
+			return nil, 0, err
+		}
+		return current, err.Index + 1, nil
+	default:
+		return nil, 0, err
+	}
+}
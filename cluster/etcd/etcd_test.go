@@ -2,6 +2,7 @@ package etcd_test
 
 import (
 	"testing"
+	"time"
 
 	"euphoria.io/heim/cluster"
 	"euphoria.io/heim/cluster/etcd/clustertest"
@@ -61,6 +62,37 @@ func TestEtcdCluster(t *testing.T) {
 		So(<-a.Watch(), ShouldResemble, &cluster.PeerAliveEvent{cluster.PeerDesc{ID: "b", Era: "2"}})
 	})
 
+	Convey("Locks are exclusive until released", t, func() {
+		a := s.Join("/locks", "a", "0")
+		defer a.Part()
+		b := s.Join("/locks", "b", "0")
+		defer b.Part()
+
+		l, err := a.Lock("x", time.Minute)
+		So(err, ShouldBeNil)
+		_, err = b.Lock("x", time.Minute)
+		So(err, ShouldEqual, cluster.ErrLocked)
+
+		So(l.Refresh(), ShouldBeNil)
+		So(l.Unlock(), ShouldBeNil)
+		So(l.Refresh(), ShouldEqual, cluster.ErrLockLost)
+
+		l, err = b.Lock("x", time.Minute)
+		So(err, ShouldBeNil)
+		So(l.Unlock(), ShouldBeNil)
+	})
+
+	Convey("Values are watched", t, func() {
+		a := s.Join("/watch", "a", "0")
+		defer a.Part()
+
+		So(a.SetValue("dir/x", "1"), ShouldBeNil)
+		c := a.WatchDir("dir")
+		So(<-c, ShouldResemble, cluster.ValueEvent{Key: "x", Value: "1"})
+		So(a.SetValue("dir/y", "2"), ShouldBeNil)
+		So(<-c, ShouldResemble, cluster.ValueEvent{Key: "y", Value: "2"})
+	})
+
 	Convey("Secrets are created if necessary", t, func() {
 		kms := security.LocalKMS()
 		a := s.Join("/secrets1", "a", "0")
@@ -0,0 +1,129 @@
+package cluster
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	ErrLocked   = fmt.Errorf("locked")
+	ErrLockLost = fmt.Errorf("lock lost")
+)
+
+// A Lock is a lease on a key in the cluster, held exclusively by one process
+// until it's unlocked or its TTL passes without a refresh.
+type Lock interface {
+	Key() string
+
+	// Refresh extends the lease by its TTL. It returns ErrLockLost if the
+	// lease has already lapsed.
+	Refresh() error
+
+	// Unlock releases the lease.
+	Unlock() error
+}
+
+// An Election campaigns for leadership of a key on behalf of a process, for
+// as long as the process lives or until it resigns. At most one process in
+// the cluster leads a key at any time, though there may be moments when none
+// does.
+type Election struct {
+	locker func(key string, ttl time.Duration) (Lock, error)
+	key    string
+	ttl    time.Duration
+
+	m       sync.Mutex
+	leading bool
+	c       chan bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewElection begins campaigning for leadership of key, using the given
+// function to take out leases of the given TTL. Leases are refreshed three
+// times per TTL, and leadership is given up as soon as a refresh fails.
+func NewElection(locker func(key string, ttl time.Duration) (Lock, error), key string, ttl time.Duration) *Election {
+	e := &Election{
+		locker: locker,
+		key:    key,
+		ttl:    ttl,
+		c:      make(chan bool, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go e.campaign()
+	return e
+}
+
+func (e *Election) Key() string { return e.key }
+
+// Leading reports whether this process currently leads.
+func (e *Election) Leading() bool {
+	e.m.Lock()
+	defer e.m.Unlock()
+	return e.leading
+}
+
+// Changes delivers true when this process is elected and false when it loses
+// leadership. If the receiver falls behind, only the latest change is kept.
+func (e *Election) Changes() <-chan bool { return e.c }
+
+// Resign stops campaigning, giving up leadership if it's held.
+func (e *Election) Resign() {
+	select {
+	case <-e.stop:
+	default:
+		close(e.stop)
+	}
+	<-e.done
+}
+
+func (e *Election) campaign() {
+	defer close(e.done)
+
+	var lock Lock
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		if lock != nil {
+			if err := lock.Refresh(); err != nil {
+				lock = nil
+				e.setLeading(false)
+			}
+		}
+		if lock == nil {
+			if l, err := e.locker(e.key, e.ttl); err == nil {
+				lock = l
+				e.setLeading(true)
+			}
+		}
+
+		select {
+		case <-e.stop:
+			if lock != nil {
+				lock.Unlock()
+				e.setLeading(false)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *Election) setLeading(leading bool) {
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	if e.leading == leading {
+		return
+	}
+	e.leading = leading
+
+	select {
+	case <-e.c:
+	default:
+	}
+	e.c <- leading
+}
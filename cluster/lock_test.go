@@ -0,0 +1,94 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func nextChange(e *Election) (bool, bool) {
+	select {
+	case leading := <-e.Changes():
+		return leading, true
+	case <-time.After(time.Second):
+		return false, false
+	}
+}
+
+func TestLock(t *testing.T) {
+	Convey("Locks are exclusive until released", t, func() {
+		tc := &TestCluster{}
+		l, err := tc.Lock("a", time.Minute)
+		So(err, ShouldBeNil)
+		So(l.Key(), ShouldEqual, "a")
+
+		_, err = tc.Lock("a", time.Minute)
+		So(err, ShouldEqual, ErrLocked)
+		_, err = tc.Lock("b", time.Minute)
+		So(err, ShouldBeNil)
+
+		So(l.Refresh(), ShouldBeNil)
+		So(l.Unlock(), ShouldBeNil)
+		So(l.Refresh(), ShouldEqual, ErrLockLost)
+
+		_, err = tc.Lock("a", time.Minute)
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Locks lapse after their TTL", t, func() {
+		tc := &TestCluster{}
+		l, err := tc.Lock("a", 10*time.Millisecond)
+		So(err, ShouldBeNil)
+		time.Sleep(20 * time.Millisecond)
+
+		l2, err := tc.Lock("a", time.Minute)
+		So(err, ShouldBeNil)
+		So(l.Refresh(), ShouldEqual, ErrLockLost)
+
+		// A lapsed lock can't release its successor.
+		So(l.Unlock(), ShouldBeNil)
+		So(l2.Refresh(), ShouldBeNil)
+	})
+}
+
+func TestElection(t *testing.T) {
+	Convey("Leadership passes on when the leader resigns", t, func() {
+		tc := &TestCluster{}
+		a := NewElection(tc.Lock, "leader", 30*time.Millisecond)
+		leading, ok := nextChange(a)
+		So(ok, ShouldBeTrue)
+		So(leading, ShouldBeTrue)
+		So(a.Leading(), ShouldBeTrue)
+
+		b := NewElection(tc.Lock, "leader", 30*time.Millisecond)
+		defer b.Resign()
+		time.Sleep(50 * time.Millisecond)
+		So(b.Leading(), ShouldBeFalse)
+
+		a.Resign()
+		So(a.Leading(), ShouldBeFalse)
+		leading, ok = nextChange(b)
+		So(ok, ShouldBeTrue)
+		So(leading, ShouldBeTrue)
+	})
+
+	Convey("Leadership is given up when the lease is lost", t, func() {
+		tc := &TestCluster{}
+		a := NewElection(tc.Lock, "leader", 30*time.Millisecond)
+		defer a.Resign()
+		leading, _ := nextChange(a)
+		So(leading, ShouldBeTrue)
+
+		// Steal the lease out from under the leader.
+		tc.m.Lock()
+		delete(tc.locks, "leader")
+		tc.m.Unlock()
+		_, err := tc.Lock("leader", time.Minute)
+		So(err, ShouldBeNil)
+
+		leading, ok := nextChange(a)
+		So(ok, ShouldBeTrue)
+		So(leading, ShouldBeFalse)
+	})
+}
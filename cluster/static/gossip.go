@@ -0,0 +1,360 @@
+package static
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"euphoria.io/heim/cluster"
+	"euphoria.io/heim/proto/logging"
+)
+
+const maxPacketSize = 64 * 1024
+
+// A member is a peer's entry in the gossiped membership table. Heartbeat is
+// set by the peer itself (to its clock, in nanoseconds) each time it
+// announces itself, so the entry with the greatest heartbeat is the freshest.
+type member struct {
+	cluster.PeerDesc
+	Heartbeat int64 `json:"heartbeat"`
+	Parting   bool  `json:"parting,omitempty"`
+}
+
+// A message is the payload of a gossip packet. Observers send messages with
+// no From and no members, and are answered with the recipient's table.
+type message struct {
+	From    string   `json:"from,omitempty"`
+	Members []member `json:"members,omitempty"`
+}
+
+type peerState struct {
+	member
+	live     bool
+	lastSeen time.Time
+}
+
+// gossip holds the membership state of a staticCluster.
+type gossip struct {
+	conn    *net.UDPConn
+	me      *member
+	started time.Time
+	peers   map[string]*peerState
+	locks   map[string]*staticLock
+	addrs   []*net.UDPAddr
+	ch      chan cluster.PeerEvent
+	stop    chan struct{}
+}
+
+func (sc *staticCluster) start(desc *cluster.PeerDesc) error {
+	listen := ":0"
+	sc.started = time.Now()
+	if desc != nil {
+		sc.me = &member{PeerDesc: *desc, Heartbeat: time.Now().UnixNano()}
+		listen = sc.cfg.Listen
+		if listen == "" {
+			_, port, err := net.SplitHostPort(sc.cfg.Peers[desc.ID])
+			if err != nil {
+				return fmt.Errorf("peer %s: %s", desc.ID, err)
+			}
+			listen = ":" + port
+		}
+	}
+
+	for id, hostport := range sc.cfg.Peers {
+		if desc != nil && id == desc.ID {
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp", hostport)
+		if err != nil {
+			return fmt.Errorf("peer %s: %s", id, err)
+		}
+		sc.addrs = append(sc.addrs, addr)
+	}
+
+	laddr, err := net.ResolveUDPAddr("udp", listen)
+	if err != nil {
+		return err
+	}
+	sc.conn, err = net.ListenUDP("udp", laddr)
+	if err != nil {
+		return err
+	}
+
+	go sc.receive()
+	go sc.announce()
+	sc.broadcast()
+	return nil
+}
+
+func (sc *staticCluster) Update(desc *cluster.PeerDesc) error {
+	sc.m.Lock()
+	if sc.me == nil || sc.me.ID != desc.ID {
+		sc.m.Unlock()
+		return fmt.Errorf("cluster: static: can only update own peer")
+	}
+	sc.me.PeerDesc = *desc
+	sc.me.Heartbeat = time.Now().UnixNano()
+	sc.m.Unlock()
+
+	sc.broadcast()
+	return nil
+}
+
+func (sc *staticCluster) Part() {
+	sc.m.Lock()
+	select {
+	case <-sc.stop:
+		sc.m.Unlock()
+		return
+	default:
+	}
+	if sc.me != nil {
+		sc.me.Parting = true
+		sc.me.Heartbeat = time.Now().UnixNano()
+	}
+	sc.m.Unlock()
+
+	if sc.me != nil {
+		sc.broadcast()
+	}
+
+	sc.m.Lock()
+	close(sc.stop)
+	sc.conn.Close()
+	sc.m.Unlock()
+	sc.store.watchers.Close()
+}
+
+func (sc *staticCluster) Peers() []cluster.PeerDesc {
+	sc.m.Lock()
+	defer sc.m.Unlock()
+
+	peers := cluster.PeerList{}
+	if sc.me != nil && !sc.me.Parting {
+		peers = append(peers, sc.me.PeerDesc)
+	}
+	for _, peer := range sc.peers {
+		if peer.live {
+			peers = append(peers, peer.PeerDesc)
+		}
+	}
+	sort.Sort(peers)
+	return peers
+}
+
+func (sc *staticCluster) Watch() <-chan cluster.PeerEvent {
+	sc.m.Lock()
+	defer sc.m.Unlock()
+
+	if sc.ch == nil {
+		sc.ch = make(chan cluster.PeerEvent, 64)
+	}
+	return sc.ch
+}
+
+// table returns the membership table to gossip. The caller must hold the
+// lock.
+func (sc *staticCluster) table() message {
+	msg := message{}
+	if sc.me != nil {
+		msg.From = sc.me.ID
+		msg.Members = append(msg.Members, *sc.me)
+	}
+	for _, peer := range sc.peers {
+		if peer.live {
+			msg.Members = append(msg.Members, peer.member)
+		}
+	}
+	return msg
+}
+
+func (sc *staticCluster) encode(msg message) ([]byte, error) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, sc.gossipKey)
+	mac.Write(payload)
+	return append(mac.Sum(nil), payload...), nil
+}
+
+func (sc *staticCluster) decode(packet []byte) (*message, error) {
+	if len(packet) < sha256.Size {
+		return nil, fmt.Errorf("short packet")
+	}
+	mac := hmac.New(sha256.New, sc.gossipKey)
+	mac.Write(packet[sha256.Size:])
+	if !hmac.Equal(mac.Sum(nil), packet[:sha256.Size]) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+	msg := &message{}
+	if err := json.Unmarshal(packet[sha256.Size:], msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (sc *staticCluster) send(msg message, addrs ...*net.UDPAddr) {
+	packet, err := sc.encode(msg)
+	if err != nil {
+		logging.Logger(sc.ctx).Printf("cluster: static: %s", err)
+		return
+	}
+	for _, addr := range addrs {
+		// Delivery is best-effort; peers that miss an announcement hear the
+		// next one.
+		sc.conn.WriteToUDP(packet, addr)
+	}
+}
+
+func (sc *staticCluster) broadcast() {
+	sc.m.Lock()
+	msg := sc.table()
+	sc.m.Unlock()
+	sc.send(msg, sc.addrs...)
+}
+
+func (sc *staticCluster) announce() {
+	ticker := time.NewTicker(sc.cfg.gossipInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sc.stop:
+			return
+		case <-ticker.C:
+		}
+
+		sc.m.Lock()
+		now := time.Now()
+		if sc.me != nil {
+			sc.me.Heartbeat = now.UnixNano()
+		}
+		events := sc.expire(now)
+		sc.m.Unlock()
+
+		sc.emit(events)
+		sc.broadcast()
+	}
+}
+
+func (sc *staticCluster) receive() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := sc.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-sc.stop:
+				return
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			logging.Logger(sc.ctx).Printf("cluster: static: receive: %s", err)
+			return
+		}
+
+		msg, err := sc.decode(buf[:n])
+		if err != nil {
+			logging.Logger(sc.ctx).Printf("cluster: static: dropping packet from %s: %s", addr, err)
+			continue
+		}
+
+		sc.m.Lock()
+		events := sc.merge(msg.Members, time.Now())
+		var reply *message
+		if _, ok := sc.cfg.Peers[msg.From]; !ok {
+			table := sc.table()
+			reply = &table
+		}
+		sc.m.Unlock()
+
+		sc.emit(events)
+		if reply != nil {
+			sc.send(*reply, addr)
+		}
+	}
+}
+
+// merge folds gossiped members into the membership table and returns the
+// resulting events. The caller must hold the lock.
+func (sc *staticCluster) merge(members []member, now time.Time) []cluster.PeerEvent {
+	var events []cluster.PeerEvent
+	for _, m := range members {
+		if sc.me != nil && m.ID == sc.me.ID {
+			continue
+		}
+		if _, ok := sc.cfg.Peers[m.ID]; !ok {
+			continue
+		}
+
+		peer, ok := sc.peers[m.ID]
+		if !ok {
+			peer = &peerState{}
+			sc.peers[m.ID] = peer
+		} else if m.Heartbeat <= peer.Heartbeat {
+			continue
+		}
+
+		prev := peer.member
+		wasLive := peer.live
+		peer.member = m
+		peer.lastSeen = now
+
+		switch {
+		case m.Parting:
+			peer.live = false
+			if wasLive {
+				events = append(events, &cluster.PeerLostEvent{PeerDesc: m.PeerDesc})
+			}
+		case !wasLive:
+			peer.live = true
+			events = append(events, &cluster.PeerJoinedEvent{PeerDesc: m.PeerDesc})
+		case m.Era != prev.Era || m.Version != prev.Version:
+			events = append(events, &cluster.PeerAliveEvent{PeerDesc: m.PeerDesc})
+		}
+	}
+	return events
+}
+
+// expire marks peers that haven't been heard from within the timeout as lost,
+// and returns the resulting events. The caller must hold the lock.
+func (sc *staticCluster) expire(now time.Time) []cluster.PeerEvent {
+	var events []cluster.PeerEvent
+	timeout := sc.cfg.peerTimeout()
+	for _, peer := range sc.peers {
+		if peer.live && now.Sub(peer.lastSeen) > timeout {
+			peer.live = false
+			events = append(events, &cluster.PeerLostEvent{PeerDesc: peer.PeerDesc})
+		}
+	}
+	return events
+}
+
+// emit delivers events to the watcher, if there is one. Events that occur
+// before Watch is called are dropped.
+func (sc *staticCluster) emit(events []cluster.PeerEvent) {
+	if len(events) == 0 {
+		return
+	}
+
+	sc.m.Lock()
+	ch := sc.ch
+	sc.m.Unlock()
+	if ch == nil {
+		return
+	}
+
+	for _, event := range events {
+		select {
+		case ch <- event:
+		case <-sc.stop:
+			return
+		}
+	}
+}
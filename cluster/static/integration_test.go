@@ -0,0 +1,32 @@
+package static_test
+
+import (
+	"net"
+	"testing"
+
+	"euphoria.io/heim/backend"
+	"euphoria.io/heim/backend/mock"
+	"euphoria.io/heim/cluster"
+	"euphoria.io/heim/cluster/static"
+	"euphoria.io/heim/proto"
+)
+
+func TestIntegration(t *testing.T) {
+	backend.IntegrationTest(
+		t, func(heim *proto.Heim) (proto.Backend, error) {
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				return nil, err
+			}
+			addr := conn.LocalAddr().String()
+			conn.Close()
+
+			cfg := &static.Config{Peers: map[string]string{"testcase": addr}}
+			c, err := static.New(heim.Context, cfg, heim.KMS, &cluster.PeerDesc{ID: "testcase", Era: "era"})
+			if err != nil {
+				return nil, err
+			}
+			heim.Cluster = c
+			return &mock.TestBackend{}, nil
+		})
+}
@@ -0,0 +1,90 @@
+package static
+
+import (
+	"time"
+
+	"euphoria.io/heim/cluster"
+)
+
+// Without consensus, locks in a static cluster are granted only by its
+// coordinator: the live peer with the lowest ID. Every peer reaches the same
+// conclusion about which peer that is once gossip has settled, so locks are
+// exclusive except while the cluster is partitioned. A peer doesn't grant
+// locks until it's been up long enough to have heard from its peers, and
+// processes observing the cluster without a server ID never hold locks.
+
+type staticLock struct {
+	sc      *staticCluster
+	key     string
+	ttl     time.Duration
+	expires time.Time
+}
+
+// coordinating reports whether this peer may grant locks. The caller must
+// hold the lock.
+func (sc *staticCluster) coordinating(now time.Time) bool {
+	if sc.me == nil || sc.me.Parting {
+		return false
+	}
+	if len(sc.cfg.Peers) > 1 && now.Sub(sc.started) < sc.cfg.peerTimeout() {
+		return false
+	}
+	for id, peer := range sc.peers {
+		if peer.live && id < sc.me.ID {
+			return false
+		}
+	}
+	return true
+}
+
+// CanLead reports whether this process is a peer. Observers never coordinate,
+// so they can't take locks.
+func (sc *staticCluster) CanLead() bool {
+	sc.m.Lock()
+	defer sc.m.Unlock()
+	return sc.me != nil
+}
+
+func (sc *staticCluster) Lock(key string, ttl time.Duration) (cluster.Lock, error) {
+	sc.m.Lock()
+	defer sc.m.Unlock()
+
+	now := time.Now()
+	if !sc.coordinating(now) {
+		return nil, cluster.ErrLocked
+	}
+	if l, ok := sc.locks[key]; ok && now.Before(l.expires) {
+		return nil, cluster.ErrLocked
+	}
+	l := &staticLock{sc: sc, key: key, ttl: ttl, expires: now.Add(ttl)}
+	sc.locks[key] = l
+	return l, nil
+}
+
+func (sc *staticCluster) Campaign(key string) *cluster.Election {
+	return cluster.NewElection(sc.Lock, key, cluster.TTL)
+}
+
+func (l *staticLock) Key() string { return l.key }
+
+func (l *staticLock) Refresh() error {
+	l.sc.m.Lock()
+	defer l.sc.m.Unlock()
+
+	now := time.Now()
+	if l.sc.locks[l.key] != l || !now.Before(l.expires) || !l.sc.coordinating(now) {
+		return cluster.ErrLockLost
+	}
+	l.expires = now.Add(l.ttl)
+	return nil
+}
+
+func (l *staticLock) Unlock() error {
+	l.sc.m.Lock()
+	defer l.sc.m.Unlock()
+
+	if l.sc.locks[l.key] == l {
+		delete(l.sc.locks, l.key)
+	}
+	return nil
+}
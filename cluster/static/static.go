@@ -0,0 +1,368 @@
+// Package static implements a cluster whose membership is fixed in
+// configuration, for deployments too small to justify running etcd.
+//
+// Values are kept on the local disk of each server, so they aren't shared
+// between peers. Secrets are shared by configuring each of them with the
+// same KMS-encrypted key material on every peer. Liveness is tracked by
+// gossip over UDP.
+package static
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"euphoria.io/heim/cluster"
+	"euphoria.io/heim/proto/security"
+	"euphoria.io/scope"
+)
+
+const (
+	DefaultGossipInterval = 2 * time.Second
+
+	secretContextKey = "cluster-secret"
+	gossipSecretName = "gossip"
+	valuesFile       = "values.json"
+)
+
+type Config struct {
+	// Peers maps the server ID of every member of the cluster to the
+	// address (host:port) it gossips on.
+	Peers map[string]string `yaml:"peers"`
+
+	// Listen overrides the address this server gossips on. By default it
+	// listens on the port given for it in Peers. Processes with no server
+	// ID listen on an ephemeral port, and only observe the cluster.
+	Listen string `yaml:"listen,omitempty"`
+
+	// DataDir is the directory values are stored in. If empty, values
+	// don't outlive the process.
+	DataDir string `yaml:"data-dir,omitempty"`
+
+	// Secrets maps secret names to hex-encoded, KMS-encrypted key material,
+	// as generated by heimctl gen-cluster-secret. Every peer must be
+	// configured with the same secrets. A cluster with only one peer may
+	// leave secrets unconfigured, and they'll be generated and kept in
+	// DataDir.
+	Secrets map[string]string `yaml:"secrets,omitempty"`
+
+	// GossipInterval is how often each server announces itself to its peers.
+	GossipInterval time.Duration `yaml:"gossip-interval,omitempty"`
+
+	// PeerTimeout is how long a peer may go unheard from before it's
+	// considered lost. Defaults to cluster.TTL.
+	PeerTimeout time.Duration `yaml:"peer-timeout,omitempty"`
+}
+
+func (cfg *Config) gossipInterval() time.Duration {
+	if cfg.GossipInterval > 0 {
+		return cfg.GossipInterval
+	}
+	return DefaultGossipInterval
+}
+
+func (cfg *Config) peerTimeout() time.Duration {
+	if cfg.PeerTimeout > 0 {
+		return cfg.PeerTimeout
+	}
+	return cluster.TTL
+}
+
+// New joins the static cluster described by cfg. If desc is nil, the process
+// observes the cluster without becoming a member of it.
+func New(ctx scope.Context, cfg *Config, kms security.KMS, desc *cluster.PeerDesc) (cluster.Cluster, error) {
+	if len(cfg.Peers) == 0 {
+		return nil, fmt.Errorf("cluster: static: no peers configured")
+	}
+	if desc != nil {
+		if _, ok := cfg.Peers[desc.ID]; !ok {
+			return nil, fmt.Errorf("cluster: static: server %s is not a configured peer", desc.ID)
+		}
+	}
+
+	store, err := openStore(cfg.DataDir)
+	if err != nil {
+		return nil, fmt.Errorf("cluster: static: %s", err)
+	}
+
+	sc := &staticCluster{
+		cfg:   cfg,
+		store: store,
+		gossip: gossip{
+			peers: map[string]*peerState{},
+			locks: map[string]*staticLock{},
+			stop:  make(chan struct{}),
+		},
+		ctx: ctx,
+	}
+
+	sc.gossipKey, err = sc.GetSecret(kms, gossipSecretName, sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := sc.start(desc); err != nil {
+		return nil, fmt.Errorf("cluster: static: %s", err)
+	}
+	return sc, nil
+}
+
+type staticCluster struct {
+	m         sync.Mutex
+	cfg       *Config
+	store     *store
+	gossipKey []byte
+	gossip
+	ctx scope.Context
+}
+
+func key(k string) string { return strings.Trim(k, "/") }
+
+func (sc *staticCluster) GetDir(k string) (map[string]string, error) {
+	prefix := key(k) + "/"
+	result := map[string]string{}
+	for k, v := range sc.store.all() {
+		if strings.HasPrefix(k, prefix) {
+			result[k[len(prefix):]] = v
+		}
+	}
+	if len(result) == 0 {
+		return nil, cluster.ErrNotFound
+	}
+	return result, nil
+}
+
+func (sc *staticCluster) GetValue(k string) (string, error) {
+	value, ok := sc.store.get(key(k))
+	if !ok {
+		return "", cluster.ErrNotFound
+	}
+	return value, nil
+}
+
+func (sc *staticCluster) SetValue(k, value string) error {
+	return sc.store.set(key(k), value)
+}
+
+func (sc *staticCluster) DeleteValue(k string) error {
+	return sc.store.delete(key(k))
+}
+
+// LocalValues reports that values are kept by each peer to itself, unless the
+// cluster has only one.
+func (sc *staticCluster) LocalValues() bool { return len(sc.cfg.Peers) > 1 }
+
+func (sc *staticCluster) GetValueWithDefault(k string, setter func() (string, error)) (string, error) {
+	return sc.store.getOrSet(key(k), setter)
+}
+
+// WatchDir watches values in the local store, so it sees only the changes
+// made by this process.
+func (sc *staticCluster) WatchDir(k string) <-chan cluster.ValueEvent {
+	return sc.store.watch(key(k))
+}
+
+func (sc *staticCluster) GetSecret(kms security.KMS, name string, bytes int) ([]byte, error) {
+	encoded, ok := sc.cfg.Secrets[name]
+	if !ok {
+		if len(sc.cfg.Peers) > 1 {
+			return nil, fmt.Errorf(
+				"cluster: static: secret %s must be configured (generate it with heimctl gen-cluster-secret %s)",
+				name, name)
+		}
+		var err error
+		encoded, err = sc.store.getOrSet("secrets/"+name, func() (string, error) {
+			return EncryptSecret(kms, name)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	material, err := decryptSecret(kms, name, encoded)
+	if err != nil {
+		return nil, fmt.Errorf("cluster: static: secret %s: %s", name, err)
+	}
+	return expand(material, name, bytes), nil
+}
+
+// EncryptSecret generates key material for a secret, encrypted with the KMS
+// and hex-encoded for configuration.
+func EncryptSecret(kms security.KMS, name string) (string, error) {
+	mkey, err := kms.GenerateEncryptedKey(security.AES256, secretContextKey, name)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(mkey.Ciphertext), nil
+}
+
+func decryptSecret(kms security.KMS, name, encoded string) ([]byte, error) {
+	ciphertext, err := hex.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	mkey := &security.ManagedKey{
+		KeyType:      security.AES256,
+		Ciphertext:   ciphertext,
+		ContextKey:   secretContextKey,
+		ContextValue: name,
+	}
+	if err := kms.DecryptKey(mkey); err != nil {
+		return nil, err
+	}
+	return mkey.Plaintext, nil
+}
+
+// expand derives a secret of the requested size from its key material, in
+// the manner of HKDF-Expand (RFC 5869) with the secret's name as the info.
+func expand(material []byte, name string, n int) []byte {
+	out := make([]byte, 0, n+sha256.Size)
+	var prev []byte
+	for counter := byte(1); len(out) < n; counter++ {
+		mac := hmac.New(sha256.New, material)
+		mac.Write(prev)
+		mac.Write([]byte(name))
+		mac.Write([]byte{counter})
+		prev = mac.Sum(nil)
+		out = append(out, prev...)
+	}
+	return out[:n]
+}
+
+// A store holds values, persisted as JSON to a file if it has a path.
+type store struct {
+	m        sync.Mutex
+	path     string
+	values   map[string]string
+	watchers cluster.ValueWatchers
+}
+
+func openStore(dir string) (*store, error) {
+	s := &store{values: map[string]string{}}
+	if dir == "" {
+		return s, nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s.path = filepath.Join(dir, valuesFile)
+
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.values); err != nil {
+		return nil, fmt.Errorf("%s: %s", s.path, err)
+	}
+	return s, nil
+}
+
+func (s *store) all() map[string]string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	values := make(map[string]string, len(s.values))
+	for k, v := range s.values {
+		values[k] = v
+	}
+	return values
+}
+
+func (s *store) get(k string) (string, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	value, ok := s.values[k]
+	return value, ok
+}
+
+func (s *store) set(k, value string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	prev, existed := s.values[k]
+	s.values[k] = value
+	if err := s.save(); err != nil {
+		if existed {
+			s.values[k] = prev
+		} else {
+			delete(s.values, k)
+		}
+		return err
+	}
+	s.watchers.Notify(k, value, false)
+	return nil
+}
+
+func (s *store) delete(k string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	prev, existed := s.values[k]
+	if !existed {
+		return nil
+	}
+	delete(s.values, k)
+	if err := s.save(); err != nil {
+		s.values[k] = prev
+		return err
+	}
+	s.watchers.Notify(k, "", true)
+	return nil
+}
+
+func (s *store) watch(dir string) <-chan cluster.ValueEvent {
+	s.m.Lock()
+	defer s.m.Unlock()
+	prefix := dir + "/"
+	current := map[string]string{}
+	for k, v := range s.values {
+		if strings.HasPrefix(k, prefix) {
+			current[k[len(prefix):]] = v
+		}
+	}
+	return s.watchers.Watch(dir, current)
+}
+
+func (s *store) getOrSet(k string, setter func() (string, error)) (string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if value, ok := s.values[k]; ok {
+		return value, nil
+	}
+	value, err := setter()
+	if err != nil {
+		return "", err
+	}
+	s.values[k] = value
+	if err := s.save(); err != nil {
+		delete(s.values, k)
+		return "", err
+	}
+	s.watchers.Notify(k, value, false)
+	return value, nil
+}
+
+// save writes out the values. The caller must hold the lock.
+func (s *store) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.values, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,316 @@
+package static
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"euphoria.io/heim/cluster"
+	"euphoria.io/heim/proto/security"
+	"euphoria.io/scope"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func testKMS() security.KMS {
+	kms := security.LocalKMS()
+	kms.SetMasterKey(make([]byte, security.AES256.KeySize()))
+	return kms
+}
+
+func freeAddr(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+func testConfig(t *testing.T, kms security.KMS, ids ...string) *Config {
+	secret, err := EncryptSecret(kms, gossipSecretName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{
+		Peers:          map[string]string{},
+		Secrets:        map[string]string{gossipSecretName: secret},
+		GossipInterval: 10 * time.Millisecond,
+		PeerTimeout:    100 * time.Millisecond,
+	}
+	for _, id := range ids {
+		cfg.Peers[id] = freeAddr(t)
+	}
+	return cfg
+}
+
+func join(cfg *Config, kms security.KMS, id, era string) cluster.Cluster {
+	var desc *cluster.PeerDesc
+	if id != "" {
+		desc = &cluster.PeerDesc{ID: id, Era: era}
+	}
+	c, err := New(scope.New(), cfg, kms, desc)
+	So(err, ShouldBeNil)
+	return c
+}
+
+func nextEvent(c cluster.Cluster) cluster.PeerEvent {
+	select {
+	case event := <-c.Watch():
+		return event
+	case <-time.After(time.Second):
+		return nil
+	}
+}
+
+func waitForPeers(c cluster.Cluster, n int) []cluster.PeerDesc {
+	deadline := time.Now().Add(time.Second)
+	for {
+		peers := c.Peers()
+		if len(peers) == n || time.Now().After(deadline) {
+			return peers
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestGossip(t *testing.T) {
+	kms := testKMS()
+
+	Convey("Observe peers joining and departing", t, func() {
+		cfg := testConfig(t, kms, "a", "b")
+		a := join(cfg, kms, "a", "0")
+		defer a.Part()
+		a.Watch()
+
+		b := join(cfg, kms, "b", "0")
+		So(nextEvent(a), ShouldResemble, &cluster.PeerJoinedEvent{PeerDesc: cluster.PeerDesc{ID: "b", Era: "0"}})
+		So(waitForPeers(a, 2), ShouldResemble, []cluster.PeerDesc{{ID: "a", Era: "0"}, {ID: "b", Era: "0"}})
+
+		b.Part()
+		So(nextEvent(a), ShouldResemble, &cluster.PeerLostEvent{PeerDesc: cluster.PeerDesc{ID: "b", Era: "0"}})
+		So(a.Peers(), ShouldResemble, []cluster.PeerDesc{{ID: "a", Era: "0"}})
+	})
+
+	Convey("Silent peers are lost after the timeout", t, func() {
+		cfg := testConfig(t, kms, "a", "b")
+		a := join(cfg, kms, "a", "0")
+		defer a.Part()
+		a.Watch()
+
+		b := join(cfg, kms, "b", "0")
+		So(nextEvent(a), ShouldResemble, &cluster.PeerJoinedEvent{PeerDesc: cluster.PeerDesc{ID: "b", Era: "0"}})
+
+		// Stop b without announcing its departure.
+		sb := b.(*staticCluster)
+		close(sb.stop)
+		sb.conn.Close()
+		So(nextEvent(a), ShouldResemble, &cluster.PeerLostEvent{PeerDesc: cluster.PeerDesc{ID: "b", Era: "0"}})
+	})
+
+	Convey("Updates are seen", t, func() {
+		cfg := testConfig(t, kms, "a", "b")
+		a := join(cfg, kms, "a", "0")
+		defer a.Part()
+		a.Watch()
+
+		b := join(cfg, kms, "b", "0")
+		defer b.Part()
+		So(nextEvent(a), ShouldResemble, &cluster.PeerJoinedEvent{PeerDesc: cluster.PeerDesc{ID: "b", Era: "0"}})
+
+		So(b.Update(&cluster.PeerDesc{ID: "b", Era: "1"}), ShouldBeNil)
+		So(nextEvent(a), ShouldResemble, &cluster.PeerAliveEvent{PeerDesc: cluster.PeerDesc{ID: "b", Era: "1"}})
+		So(b.Update(&cluster.PeerDesc{ID: "a", Era: "1"}), ShouldNotBeNil)
+	})
+
+	Convey("Membership is relayed through peers", t, func() {
+		cfg := testConfig(t, kms, "a", "b", "c")
+		a := join(cfg, kms, "a", "0")
+		defer a.Part()
+		b := join(cfg, kms, "b", "0")
+		defer b.Part()
+
+		// c can't reach a, so a can only learn of c from b.
+		blocked := *cfg
+		blocked.Peers = map[string]string{"a": "127.0.0.1:9", "b": cfg.Peers["b"], "c": cfg.Peers["c"]}
+		c := join(&blocked, kms, "c", "0")
+		defer c.Part()
+
+		So(waitForPeers(a, 3), ShouldResemble, []cluster.PeerDesc{
+			{ID: "a", Era: "0"}, {ID: "b", Era: "0"}, {ID: "c", Era: "0"}})
+	})
+
+	Convey("Observers learn the membership from peers", t, func() {
+		cfg := testConfig(t, kms, "a", "b")
+		a := join(cfg, kms, "a", "0")
+		defer a.Part()
+		b := join(cfg, kms, "b", "0")
+		defer b.Part()
+
+		o := join(cfg, kms, "", "")
+		defer o.Part()
+		So(waitForPeers(o, 2), ShouldResemble, []cluster.PeerDesc{{ID: "a", Era: "0"}, {ID: "b", Era: "0"}})
+		So(waitForPeers(a, 2), ShouldResemble, []cluster.PeerDesc{{ID: "a", Era: "0"}, {ID: "b", Era: "0"}})
+	})
+
+	Convey("Packets signed with another key are dropped", t, func() {
+		cfg := testConfig(t, kms, "a", "b")
+		a := join(cfg, kms, "a", "0")
+		defer a.Part()
+
+		other := *cfg
+		other.Secrets = testConfig(t, kms).Secrets
+		b := join(&other, kms, "b", "0")
+		defer b.Part()
+
+		time.Sleep(50 * time.Millisecond)
+		So(a.Peers(), ShouldResemble, []cluster.PeerDesc{{ID: "a", Era: "0"}})
+		So(b.Peers(), ShouldResemble, []cluster.PeerDesc{{ID: "b", Era: "0"}})
+	})
+
+	Convey("Only configured peers may join", t, func() {
+		cfg := testConfig(t, kms, "a")
+		_, err := New(scope.New(), cfg, kms, &cluster.PeerDesc{ID: "z"})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestLocks(t *testing.T) {
+	kms := testKMS()
+
+	Convey("Locks are granted only by the coordinator", t, func() {
+		cfg := testConfig(t, kms, "a", "b")
+		a := join(cfg, kms, "a", "0")
+		defer a.Part()
+		b := join(cfg, kms, "b", "0")
+		defer b.Part()
+		o := join(cfg, kms, "", "")
+		defer o.Part()
+		So(cluster.CanLead(a), ShouldBeTrue)
+		So(cluster.CanLead(o), ShouldBeFalse)
+
+		// No locks are granted until peers have had time to hear each other.
+		_, err := a.Lock("x", time.Minute)
+		So(err, ShouldEqual, cluster.ErrLocked)
+		time.Sleep(cfg.PeerTimeout)
+
+		l, err := a.Lock("x", time.Minute)
+		So(err, ShouldBeNil)
+		_, err = a.Lock("x", time.Minute)
+		So(err, ShouldEqual, cluster.ErrLocked)
+		_, err = b.Lock("y", time.Minute)
+		So(err, ShouldEqual, cluster.ErrLocked)
+		_, err = o.Lock("y", time.Minute)
+		So(err, ShouldEqual, cluster.ErrLocked)
+
+		So(l.Refresh(), ShouldBeNil)
+		So(l.Unlock(), ShouldBeNil)
+		So(l.Refresh(), ShouldEqual, cluster.ErrLockLost)
+
+		// Once a departs, b takes over.
+		a.Part()
+		So(waitForPeers(b, 1), ShouldResemble, []cluster.PeerDesc{{ID: "b", Era: "0"}})
+		_, err = b.Lock("y", time.Minute)
+		So(err, ShouldBeNil)
+	})
+}
+
+func TestValues(t *testing.T) {
+	kms := testKMS()
+
+	Convey("Values persist in the data directory", t, func() {
+		dir, err := ioutil.TempDir("", "heim-static-cluster")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		cfg := testConfig(t, kms, "a")
+		cfg.DataDir = dir
+		a := join(cfg, kms, "a", "0")
+
+		_, err = a.GetValue("/x/1")
+		So(err, ShouldEqual, cluster.ErrNotFound)
+		_, err = a.GetDir("x")
+		So(err, ShouldEqual, cluster.ErrNotFound)
+
+		So(a.SetValue("/x/1", "one"), ShouldBeNil)
+		So(a.SetValue("x/2", "two"), ShouldBeNil)
+		So(a.SetValue("y", "why"), ShouldBeNil)
+		value, err := a.GetValueWithDefault("z", func() (string, error) { return "zed", nil })
+		So(err, ShouldBeNil)
+		So(value, ShouldEqual, "zed")
+		a.Part()
+
+		a = join(cfg, kms, "a", "0")
+		defer a.Part()
+		value, err = a.GetValue("x/1")
+		So(err, ShouldBeNil)
+		So(value, ShouldEqual, "one")
+		dir2, err := a.GetDir("/x")
+		So(err, ShouldBeNil)
+		So(dir2, ShouldResemble, map[string]string{"1": "one", "2": "two"})
+		value, err = a.GetValueWithDefault("z", func() (string, error) { return "other", nil })
+		So(err, ShouldBeNil)
+		So(value, ShouldEqual, "zed")
+
+		c := a.WatchDir("x")
+		So(<-c, ShouldResemble, cluster.ValueEvent{Key: "1", Value: "one"})
+		So(<-c, ShouldResemble, cluster.ValueEvent{Key: "2", Value: "two"})
+		So(a.SetValue("x/3", "three"), ShouldBeNil)
+		So(<-c, ShouldResemble, cluster.ValueEvent{Key: "3", Value: "three"})
+		So(a.DeleteValue("x/1"), ShouldBeNil)
+		So(<-c, ShouldResemble, cluster.ValueEvent{Key: "1", Deleted: true})
+		So(a.DeleteValue("x/1"), ShouldBeNil)
+		_, err = a.GetValue("x/1")
+		So(err, ShouldEqual, cluster.ErrNotFound)
+		So(cluster.SharesValues(a), ShouldBeTrue)
+	})
+
+	Convey("Values aren't shared between several peers", t, func() {
+		cfg := testConfig(t, kms, "a", "b")
+		a := join(cfg, kms, "a", "0")
+		defer a.Part()
+		So(cluster.SharesValues(a), ShouldBeFalse)
+	})
+}
+
+func TestSecrets(t *testing.T) {
+	kms := testKMS()
+
+	Convey("Configured secrets are shared by every peer", t, func() {
+		cfg := testConfig(t, kms, "a", "b")
+		encoded, err := EncryptSecret(kms, "cookie")
+		So(err, ShouldBeNil)
+		cfg.Secrets["cookie"] = encoded
+
+		a := join(cfg, kms, "a", "0")
+		defer a.Part()
+		b := join(cfg, kms, "b", "0")
+		defer b.Part()
+
+		sa, err := a.GetSecret(kms, "cookie", 64)
+		So(err, ShouldBeNil)
+		So(len(sa), ShouldEqual, 64)
+		sb, err := b.GetSecret(kms, "cookie", 64)
+		So(err, ShouldBeNil)
+		So(string(sb), ShouldEqual, string(sa))
+
+		_, err = a.GetSecret(kms, "unconfigured", 16)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("A lone peer generates its own secrets", t, func() {
+		cfg := &Config{Peers: map[string]string{"a": freeAddr(t)}}
+		a := join(cfg, kms, "a", "0")
+		defer a.Part()
+
+		secret, err := a.GetSecret(kms, "test", 16)
+		So(err, ShouldBeNil)
+		So(len(secret), ShouldEqual, 16)
+
+		secretCopy, err := a.GetSecret(kms, "test", 16)
+		So(err, ShouldBeNil)
+		So(string(secretCopy), ShouldEqual, string(secret))
+	})
+}
@@ -0,0 +1,123 @@
+package cluster
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A ValueEvent reports the value of a key in a watched directory.
+type ValueEvent struct {
+	Key     string // relative to the watched directory
+	Value   string
+	Deleted bool
+}
+
+// ValueWatchers fans out changes in values to the watchers of the directories
+// containing them. Cluster implementations that learn of changes by making
+// them use it to implement WatchDir. The zero value is ready to use.
+type ValueWatchers struct {
+	m        sync.Mutex
+	watchers []*valueWatcher
+}
+
+// Watch registers a watcher of dir. The given current values of the directory,
+// keyed relative to it, are delivered first.
+func (vw *ValueWatchers) Watch(dir string, current map[string]string) <-chan ValueEvent {
+	w := &valueWatcher{
+		prefix: strings.Trim(dir, "/") + "/",
+		signal: make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		c:      make(chan ValueEvent),
+	}
+
+	keys := make([]string, 0, len(current))
+	for key := range current {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		w.queue = append(w.queue, ValueEvent{Key: key, Value: current[key]})
+	}
+
+	vw.m.Lock()
+	vw.watchers = append(vw.watchers, w)
+	vw.m.Unlock()
+
+	go w.deliver()
+	return w.c
+}
+
+// Notify reports a change to the value of key to the watchers of its
+// directory.
+func (vw *ValueWatchers) Notify(key, value string, deleted bool) {
+	key = strings.Trim(key, "/")
+
+	vw.m.Lock()
+	defer vw.m.Unlock()
+
+	for _, w := range vw.watchers {
+		if strings.HasPrefix(key, w.prefix) {
+			w.push(ValueEvent{Key: key[len(w.prefix):], Value: value, Deleted: deleted})
+		}
+	}
+}
+
+// Close closes the channels of all watchers.
+func (vw *ValueWatchers) Close() {
+	vw.m.Lock()
+	defer vw.m.Unlock()
+
+	for _, w := range vw.watchers {
+		close(w.stop)
+	}
+	vw.watchers = nil
+}
+
+// A valueWatcher queues events without bound, so that notifying never blocks
+// on a slow receiver.
+type valueWatcher struct {
+	prefix string
+	m      sync.Mutex
+	queue  []ValueEvent
+	signal chan struct{}
+	stop   chan struct{}
+	c      chan ValueEvent
+}
+
+func (w *valueWatcher) push(event ValueEvent) {
+	w.m.Lock()
+	w.queue = append(w.queue, event)
+	w.m.Unlock()
+
+	select {
+	case w.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (w *valueWatcher) deliver() {
+	defer close(w.c)
+
+	for {
+		w.m.Lock()
+		if len(w.queue) == 0 {
+			w.m.Unlock()
+			select {
+			case <-w.signal:
+				continue
+			case <-w.stop:
+				return
+			}
+		}
+		event := w.queue[0]
+		w.queue = w.queue[1:]
+		w.m.Unlock()
+
+		select {
+		case w.c <- event:
+		case <-w.stop:
+			return
+		}
+	}
+}
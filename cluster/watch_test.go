@@ -0,0 +1,55 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func nextValue(c <-chan ValueEvent) *ValueEvent {
+	select {
+	case event, ok := <-c:
+		if !ok {
+			return nil
+		}
+		return &event
+	case <-time.After(time.Second):
+		return nil
+	}
+}
+
+func TestWatchDir(t *testing.T) {
+	Convey("Current values are delivered, then changes", t, func() {
+		tc := &TestCluster{}
+		So(tc.SetValue("dir/a", "1"), ShouldBeNil)
+		So(tc.SetValue("other/b", "2"), ShouldBeNil)
+
+		c := tc.WatchDir("dir")
+		So(nextValue(c), ShouldResemble, &ValueEvent{Key: "a", Value: "1"})
+
+		So(tc.SetValue("other/b", "3"), ShouldBeNil)
+		So(tc.SetValue("dir/a", "4"), ShouldBeNil)
+		So(tc.SetValue("/dir/c", "5"), ShouldBeNil)
+		So(nextValue(c), ShouldResemble, &ValueEvent{Key: "a", Value: "4"})
+		So(nextValue(c), ShouldResemble, &ValueEvent{Key: "c", Value: "5"})
+	})
+
+	Convey("Slow watchers don't hold up changes", t, func() {
+		var vw ValueWatchers
+		c := vw.Watch("dir", map[string]string{"a": "0"})
+		for i := 0; i < 100; i++ {
+			vw.Notify("dir/a", "x", false)
+		}
+		vw.Notify("dir/a", "", true)
+
+		So(nextValue(c), ShouldResemble, &ValueEvent{Key: "a", Value: "0"})
+		for i := 0; i < 100; i++ {
+			So(nextValue(c), ShouldResemble, &ValueEvent{Key: "a", Value: "x"})
+		}
+		So(nextValue(c), ShouldResemble, &ValueEvent{Key: "a", Deleted: true})
+
+		vw.Close()
+		So(nextValue(c), ShouldBeNil)
+	})
+}
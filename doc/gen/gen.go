@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"flag"
 	"fmt"
 	"go/ast"
 	"go/build"
@@ -223,6 +224,17 @@ func joinComments(cg *ast.CommentGroup) string {
 	return b.String()
 }
 
+var schemaOutput = flag.Bool("schema", false, "emit a JSON Schema of the protocol instead of Markdown")
+
+// parseProto parses the source of the proto package in the given directory.
+func parseProto(dir string) (*objects, error) {
+	pkgs, err := parser.ParseDir(token.NewFileSet(), dir, nil, parser.ParseComments)
+	if err != nil {
+		return nil, fmt.Errorf("parse error: %s", err)
+	}
+	return (*objects)(doc.New(pkgs["proto"], "euphoria.io/heim/proto", 0)), nil
+}
+
 func run() error {
 	pkg, err := build.Import("euphoria.io/heim/proto", "", build.FindOnly)
 	if err != nil {
@@ -233,14 +245,20 @@ func run() error {
 		return fmt.Errorf("error: can't find source for package euphoria.io/heim/proto")
 	}
 
-	pkgs, err := parser.ParseDir(
-		token.NewFileSet(), filepath.Join(pkg.SrcRoot, "euphoria.io/heim/proto"), nil,
-		parser.ParseComments)
+	obs, err := parseProto(filepath.Join(pkg.SrcRoot, "euphoria.io/heim/proto"))
 	if err != nil {
-		return fmt.Errorf("parse error: %s", err)
+		return err
+	}
+
+	if *schemaOutput {
+		data, err := buildSchema(obs)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(data)
+		return err
 	}
 
-	obs := (*objects)(doc.New(pkgs["proto"], "euphoria.io/heim/proto", 0))
 	ps := sortObjects(obs)
 	ts := types{}
 	t := template.New("api.md").Funcs(template.FuncMap{
@@ -256,8 +274,12 @@ func run() error {
 	ts.registerType("int")
 	ts.registerType("object")
 	ts.registerType("string")
+	ts.registerType("APITokenScope")
+	ts.registerType("APITokenView")
 	ts.registerType("AccountView")
+	ts.registerType("AgentView")
 	ts.registerType("AuthOption")
+	ts.registerType("ListingCounts")
 	ts.registerType("Message")
 	ts.registerType("PacketType")
 	ts.registerType("PersonalAccountView")
@@ -282,6 +304,7 @@ func run() error {
 }
 
 func main() {
+	flag.Parse()
 	if err := run(); err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(1)
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"euphoria.io/heim/proto"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSchema(t *testing.T) {
+	obs, err := parseProto(filepath.Join("..", "..", "proto"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated, err := buildSchema(obs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("The checked-in schema matches the proto package", t, func() {
+		checkedIn, err := ioutil.ReadFile(filepath.Join("..", "api.schema.json"))
+		So(err, ShouldBeNil)
+		// If this fails, regenerate the schema from the repository root with:
+		//   go run ./doc/gen -schema > doc/api.schema.json
+		So(string(checkedIn), ShouldEqual, string(generated))
+	})
+
+	Convey("Every packet type is described and paired", t, func() {
+		var doc schema
+		So(json.Unmarshal(generated, &doc), ShouldBeNil)
+		for packetType := range proto.PacketsByType() {
+			s, ok := doc.Definitions[string(packetType)]
+			So(ok, ShouldBeTrue)
+			So(s.Title, ShouldEqual, string(packetType))
+		}
+
+		send := doc.Definitions[string(proto.SendType)]
+		So(send.PacketKind, ShouldEqual, "command")
+		So(send.Reply, ShouldEqual, string(proto.SendReplyType))
+		So(send.Required, ShouldResemble, []string{"content"})
+		So(send.Properties["parent"].Description, ShouldEqual, "the id of the parent message, if any")
+
+		So(doc.Definitions[string(proto.SendReplyType)].ReplyTo, ShouldEqual, string(proto.SendType))
+		So(doc.Definitions[string(proto.SendEventType)].PacketKind, ShouldEqual, "event")
+	})
+}
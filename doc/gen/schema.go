@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"sort"
+	"strings"
+
+	"euphoria.io/heim/proto"
+)
+
+const schemaURI = "http://json-schema.org/draft-07/schema#"
+
+// A schema is a JSON Schema, extended with annotations that pair commands
+// with their replies.
+type schema struct {
+	Schema      string             `json:"$schema,omitempty"`
+	Ref         string             `json:"$ref,omitempty"`
+	Title       string             `json:"title,omitempty"`
+	Description string             `json:"description,omitempty"`
+	Type        string             `json:"type,omitempty"`
+	Const       string             `json:"const,omitempty"`
+	Enum        []string           `json:"enum,omitempty"`
+	Items       *schema            `json:"items,omitempty"`
+	Properties  map[string]*schema `json:"properties,omitempty"`
+	Required    []string           `json:"required,omitempty"`
+	AllOf       []*schema          `json:"allOf,omitempty"`
+	OneOf       []*schema          `json:"oneOf,omitempty"`
+	Definitions map[string]*schema `json:"definitions,omitempty"`
+
+	PacketKind string `json:"x-packet-kind,omitempty"` // command, reply, or event
+	Reply      string `json:"x-reply,omitempty"`       // for a command, the type of its reply
+	ReplyTo    string `json:"x-reply-to,omitempty"`    // for a reply, the type of its command
+}
+
+// schemaBuilder collects definitions of the types referred to by packets.
+type schemaBuilder struct {
+	obs         *objects
+	definitions map[string]*schema
+	errs        []string
+}
+
+func ref(name string) *schema { return &schema{Ref: "#/definitions/" + name} }
+
+// typeSchema returns the schema of a field of the given type, as named by
+// typeIdent. Named types are defined once and referred to thereafter.
+func (sb *schemaBuilder) typeSchema(name string) *schema {
+	switch {
+	case strings.HasPrefix(name, "[]"):
+		return &schema{Type: "array", Items: sb.typeSchema(name[2:])}
+	case name == "bool":
+		return &schema{Type: "boolean"}
+	case name == "int", name == "int64", name == "uint32", name == "uint64":
+		return &schema{Type: "integer"}
+	case name == "float64":
+		return &schema{Type: "number"}
+	case name == "string":
+		return &schema{Type: "string"}
+	case name == "json.RawMessage":
+		return &schema{}
+	case name == "snowflake.Snowflake":
+		return sb.define("Snowflake", func() *schema {
+			return &schema{
+				Description: "A snowflake is a 13-character string, usually used as a unique identifier for some " +
+					"type of object. It is the base-36 encoding of an unsigned, 64-bit integer.",
+				Type: "string",
+			}
+		})
+	case name == "Time":
+		return sb.define("Time", func() *schema {
+			return &schema{
+				Description: "Time is specified as a signed 64-bit integer, giving the number of seconds since the Unix Epoch.",
+				Type:        "integer",
+			}
+		})
+	}
+
+	for _, typ := range sb.obs.Types {
+		if typ.Name != name || len(typ.Decl.Specs) == 0 {
+			continue
+		}
+		ts, ok := typ.Decl.Specs[0].(*ast.TypeSpec)
+		if !ok {
+			continue
+		}
+		return sb.define(name, func() *schema {
+			var s *schema
+			if _, ok := ts.Type.(*ast.StructType); ok {
+				s = sb.objectSchema(getFields(sb.obs, ts.Type))
+			} else {
+				s = sb.typeSchema(typeIdent(ts.Type))
+			}
+			s.Description = strings.TrimSpace(typ.Doc)
+			return s
+		})
+	}
+
+	sb.errs = append(sb.errs, fmt.Sprintf("undocumented field type: %s", name))
+	return &schema{}
+}
+
+// define adds a named definition, built on first reference, and returns a
+// reference to it.
+func (sb *schemaBuilder) define(name string, build func() *schema) *schema {
+	if _, ok := sb.definitions[name]; !ok {
+		// Reserve the name first, in case the type refers to itself.
+		sb.definitions[name] = nil
+		sb.definitions[name] = build()
+	}
+	return ref(name)
+}
+
+func (sb *schemaBuilder) objectSchema(fields []field) *schema {
+	s := &schema{Type: "object", Properties: map[string]*schema{}}
+	for _, f := range fields {
+		fs := sb.typeSchema(f.TypeName)
+		if comments := strings.TrimSpace(f.Comments); comments != "" {
+			if fs.Ref != "" {
+				// Siblings of $ref are ignored, so describe the field
+				// through allOf.
+				fs = &schema{AllOf: []*schema{fs}}
+			}
+			fs.Description = comments
+		}
+		s.Properties[f.Name] = fs
+		if !f.Optional {
+			s.Required = append(s.Required, f.Name)
+		}
+	}
+	return s
+}
+
+// packetSchema returns the definition of a packet's payload.
+func (sb *schemaBuilder) packetSchema(packetType proto.PacketType, cmd command) *schema {
+	s := sb.objectSchema(cmd.Fields)
+	s.Title = string(packetType)
+	s.Description = strings.TrimSpace(cmd.Doc)
+
+	switch {
+	case packetType.IsEvent():
+		s.PacketKind = "event"
+	case packetType.IsReply():
+		s.PacketKind = "reply"
+		s.ReplyTo = strings.TrimSuffix(string(packetType), "-reply")
+	default:
+		s.PacketKind = "command"
+		if _, ok := proto.PacketsByType()[packetType.Reply()]; ok {
+			s.Reply = string(packetType.Reply())
+		}
+	}
+	return s
+}
+
+// buildSchema describes every packet in the protocol. The document validates
+// a single packet: the envelope, and the payload matching its type.
+func buildSchema(obs *objects) ([]byte, error) {
+	sb := &schemaBuilder{obs: obs, definitions: map[string]*schema{}}
+
+	packetTypes := []string{}
+	for packetType := range proto.PacketsByType() {
+		packetTypes = append(packetTypes, string(packetType))
+	}
+	sort.Strings(packetTypes)
+
+	ps := sortObjects(obs)
+	payloads := make([]*schema, 0, len(packetTypes))
+	packets := map[string]*schema{}
+	for _, name := range packetTypes {
+		cmd, ok := ps[name]
+		if !ok {
+			return nil, fmt.Errorf("packet not found: %s", name)
+		}
+		packets[name] = sb.packetSchema(proto.PacketType(name), cmd)
+		payloads = append(payloads, &schema{
+			Properties: map[string]*schema{
+				"type": {Const: name},
+				"data": ref(name),
+			},
+		})
+	}
+
+	envelope := sb.typeSchema("Packet")
+	sb.definitions["PacketType"].Enum = packetTypes
+
+	if len(sb.errs) > 0 {
+		return nil, fmt.Errorf("schema error: %s", strings.Join(sb.errs, "; "))
+	}
+
+	for name, s := range packets {
+		if _, ok := sb.definitions[name]; ok {
+			return nil, fmt.Errorf("packet type collides with field type: %s", name)
+		}
+		sb.definitions[name] = s
+	}
+
+	doc := &schema{
+		Schema:      schemaURI,
+		Title:       "Heim protocol",
+		Description: "A packet exchanged with a heim server.",
+		AllOf:       []*schema{envelope, {OneOf: payloads}},
+		Definitions: sb.definitions,
+	}
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
@@ -6,12 +6,16 @@ import (
 	"encoding/json"
 
 	"euphoria.io/heim/backend/psql"
+	"euphoria.io/heim/cluster"
 	"euphoria.io/heim/proto"
 	"euphoria.io/heim/proto/logging"
 	"euphoria.io/scope"
 )
 
-func ScanLoop(ctx scope.Context, listener *pq.Listener) {
+// ScanLoop counts activity from the postgres firehose. Notices are only
+// counted while the election is led by this process, so that redundant
+// exporters don't report the same activity twice.
+func ScanLoop(ctx scope.Context, listener *pq.Listener, election *cluster.Election) {
 	defer ctx.WaitGroup().Done()
 
 	logger := logging.Logger(ctx)
@@ -26,6 +30,10 @@ func ScanLoop(ctx scope.Context, listener *pq.Listener) {
 				continue
 			}
 
+			if !election.Leading() {
+				continue
+			}
+
 			var msg psql.BroadcastMessage
 
 			if err := json.Unmarshal([]byte(notice.Extra), &msg); err != nil {
@@ -7,10 +7,13 @@ import (
 
 	"github.com/lib/pq"
 
+	"euphoria.io/heim/cluster"
 	"euphoria.io/heim/heimctl/activity"
 	"euphoria.io/scope"
 )
 
+const activityElection = "activity-exporter"
+
 func init() {
 	register("activity-exporter", &activityCmd{})
 }
@@ -30,7 +33,9 @@ func (activityCmd) usage() string {
 func (activityCmd) longdesc() string {
 	return `
 	Start the activity-exporter server. This is a service that listens to
-	the postgres firehose and collects per-room metrics.
+	the postgres firehose and collects per-room metrics. Any number of
+	exporters may run; only the one elected leader collects metrics. A
+	static cluster elects only its own peers, so the exporter requires etcd.
 `[1:]
 }
 
@@ -46,6 +51,17 @@ func (cmd *activityCmd) run(ctx scope.Context, args []string) error {
 		return err
 	}
 
+	c, err := getCluster(ctx)
+	if err != nil {
+		return err
+	}
+	if !cluster.CanLead(c) {
+		return fmt.Errorf("activity-exporter can't be elected by a static cluster it only observes; use etcd")
+	}
+
+	election := c.Campaign(activityElection)
+	defer election.Resign()
+
 	listener := pq.NewListener(cfg.DB.DSN, 200*time.Millisecond, 5*time.Second, nil)
 	if err := listener.Listen("broadcast"); err != nil {
 		return fmt.Errorf("pq listen error: %s", err)
@@ -62,7 +78,7 @@ func (cmd *activityCmd) run(ctx scope.Context, args []string) error {
 
 	// Start scanner.
 	ctx.WaitGroup().Add(1)
-	activity.ScanLoop(ctx, listener)
+	activity.ScanLoop(ctx, listener, election)
 
 	return nil
 }
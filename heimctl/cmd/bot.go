@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+
+	"euphoria.io/heim/bot"
+	"euphoria.io/scope"
+)
+
+func init() {
+	register("bot", &botCmd{})
+}
+
+type botCmd struct {
+	config string
+}
+
+func (botCmd) desc() string {
+	return "run bots declared in a YAML file"
+}
+
+func (botCmd) usage() string { return "bot -bots=<bots.yml>" }
+
+func (botCmd) longdesc() string {
+	return `
+	Run the bots declared in the given YAML file until interrupted. Each bot
+	joins its rooms as a bot agent, answers the conventional !ping, !help
+	and !uptime commands, and replies to the commands listed under its
+	responses. For example:
+
+		server: https://euphoria.io
+		state-dir: /var/lib/heim-bots
+		bots:
+		  - name: Greeter
+		    short-help: say !hello
+		    rooms:
+		      - test
+		      - name: private
+		        passcode: hunter2
+		    responses:
+		      hello: "Hello, {{.Sender}}! (#{{.Count}})"
+
+	Responses are Go templates, given the room, sender, args, command, and a
+	count of the command's uses in the room. Counts are kept in state-dir,
+	or in memory if it's not given.
+`[1:]
+}
+
+func (cmd *botCmd) flags() *flag.FlagSet {
+	fs := flag.NewFlagSet("bot", flag.ExitOnError)
+	fs.StringVar(&cmd.config, "bots", "bots.yml", "path to the YAML file declaring bots")
+	return fs
+}
+
+func (cmd *botCmd) run(ctx scope.Context, args []string) error {
+	cfg, err := bot.LoadConfig(cmd.config)
+	if err != nil {
+		return err
+	}
+
+	bots, err := cfg.Start(ctx)
+	if err != nil {
+		return err
+	}
+	for _, b := range bots {
+		fmt.Printf("%s: running in %d room(s)\n", b.Name, len(b.Rooms()))
+	}
+
+	<-ctx.Done()
+	for _, b := range bots {
+		b.Close()
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+
+	"euphoria.io/heim/cluster/static"
+	"euphoria.io/scope"
+)
+
+func init() {
+	register("gen-cluster-secret", &genClusterSecretCmd{})
+}
+
+type genClusterSecretCmd struct{}
+
+func (genClusterSecretCmd) desc() string {
+	return "generate a shared secret for a static cluster"
+}
+
+func (genClusterSecretCmd) usage() string {
+	return "gen-cluster-secret NAME..."
+}
+
+func (genClusterSecretCmd) longdesc() string {
+	return `
+	Generate key material for each named secret of a static cluster, encrypted
+	with the configured KMS. The output belongs in the cluster.static.secrets
+	section of the config of every peer in the cluster.
+
+	Peers need the secrets "gossip" and "cookie".
+`[1:]
+}
+
+func (genClusterSecretCmd) flags() *flag.FlagSet {
+	return flag.NewFlagSet("gen-cluster-secret", flag.ExitOnError)
+}
+
+func (cmd *genClusterSecretCmd) run(ctx scope.Context, args []string) error {
+	if len(args) < 1 {
+		fmt.Printf("Usage: %s\r\n", cmd.usage())
+		return nil
+	}
+
+	cfg, err := getConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	kms, err := cfg.KMS.Get()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("secrets:")
+	for _, name := range args {
+		secret, err := static.EncryptSecret(kms, name)
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		fmt.Printf("  %s: %s\n", name, secret)
+	}
+	return nil
+}
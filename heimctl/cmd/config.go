@@ -66,7 +66,12 @@ func getCluster(ctx scope.Context) (cluster.Cluster, error) {
 		return nil, err
 	}
 
-	initializedCluster, err = cfg.Cluster.EtcdCluster(ctx)
+	kms, err := cfg.KMS.Get()
+	if err != nil {
+		return nil, err
+	}
+
+	initializedCluster, err = cfg.Cluster.Get(ctx, kms)
 	return initializedCluster, err
 }
 
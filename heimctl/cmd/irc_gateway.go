@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"net"
+
+	"euphoria.io/heim/irc"
+	"euphoria.io/scope"
+)
+
+func init() {
+	register("irc-gateway", &ircGatewayCmd{})
+}
+
+type ircGatewayCmd struct {
+	addr    string
+	heimURL string
+	name    string
+}
+
+func (ircGatewayCmd) desc() string {
+	return "serve heim rooms to IRC clients"
+}
+
+func (ircGatewayCmd) usage() string {
+	return "irc-gateway [-listen=<interface:port>] [-heim=<url>] [-name=<server name>]"
+}
+
+func (ircGatewayCmd) longdesc() string {
+	return `
+	Run an IRC server that relays each channel to the heim room of the same
+	name, through the heim server at the given URL. Joining #room opens a
+	session in the room under the client's IRC nick; give the room's
+	passcode as the channel key to join a private room.
+
+	Relayed messages are tagged with a short reference to the message, and
+	to its parent if it's a reply. Send ">ref text" to reply to a message.
+`[1:]
+}
+
+func (cmd *ircGatewayCmd) flags() *flag.FlagSet {
+	fs := flag.NewFlagSet("irc-gateway", flag.ExitOnError)
+	fs.StringVar(&cmd.addr, "listen", ":6667", "address to accept IRC connections on")
+	fs.StringVar(&cmd.heimURL, "heim", "http://localhost:8080", "base URL of the heim server")
+	fs.StringVar(&cmd.name, "name", "heim", "server name presented to IRC clients")
+	return fs
+}
+
+func (cmd *ircGatewayCmd) run(ctx scope.Context, args []string) error {
+	listener, err := net.Listen("tcp", cmd.addr)
+	if err != nil {
+		return err
+	}
+
+	server := &irc.Server{HeimURL: cmd.heimURL, Name: cmd.name}
+	fmt.Printf("serving IRC on %s for %s\n", cmd.addr, cmd.heimURL)
+	return server.Serve(ctx, listener)
+}
@@ -0,0 +1,198 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"euphoria.io/heim/proto/jobs"
+	"euphoria.io/heim/proto/snowflake"
+	"euphoria.io/scope"
+)
+
+func init() {
+	register("jobs", &jobsCmd{})
+}
+
+type jobsCmd struct {
+	limit int
+}
+
+func (jobsCmd) desc() string {
+	return "inspect and replay dead jobs"
+}
+
+func (jobsCmd) usage() string {
+	return "jobs [--limit=N] list|retry|purge|show-log QUEUE [JOBID|all]"
+}
+
+func (jobsCmd) longdesc() string {
+	return `
+	Manage jobs in QUEUE that have failed on every attempt they were given.
+	Such jobs are left in the queue but are never claimed again.
+
+	    list               show the queue's stats and its dead jobs
+	    retry JOBID        return a dead job to the queue
+	    retry all          return every dead job to the queue
+	    purge              permanently discard all dead jobs
+	    show-log JOBID     print the output of every attempt of a job
+`[1:]
+}
+
+func (cmd *jobsCmd) flags() *flag.FlagSet {
+	flags := flag.NewFlagSet("jobs", flag.ExitOnError)
+	flags.IntVar(&cmd.limit, "limit", 100, "maximum number of dead jobs to list or retry")
+	return flags
+}
+
+func (cmd *jobsCmd) run(ctx scope.Context, args []string) error {
+	if len(args) < 2 {
+		fmt.Printf("Usage: %s\r\n", cmd.usage())
+		return nil
+	}
+
+	heim, err := getHeim(ctx)
+	if err != nil {
+		return err
+	}
+	defer heim.Backend.Close()
+
+	jq, err := heim.Backend.Jobs().GetQueue(ctx, args[1])
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "list":
+		return cmd.list(ctx, jq)
+	case "retry":
+		if len(args) < 3 {
+			return fmt.Errorf("usage: %s", cmd.usage())
+		}
+		if args[2] == "all" {
+			return cmd.retryAll(ctx, jq)
+		}
+		jobID, err := parseJobID(args[2])
+		if err != nil {
+			return err
+		}
+		if err := jq.Retry(ctx, jobID); err != nil {
+			return fmt.Errorf("retry %s: %s", jobID, err)
+		}
+		fmt.Printf("job %s returned to queue %s\n", jobID, jq.Name())
+		return nil
+	case "purge":
+		n, err := jq.Purge(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("purged %d dead jobs from queue %s\n", n, jq.Name())
+		return nil
+	case "show-log":
+		if len(args) < 3 {
+			return fmt.Errorf("usage: %s", cmd.usage())
+		}
+		jobID, err := parseJobID(args[2])
+		if err != nil {
+			return err
+		}
+		return cmd.showLog(ctx, jq, jobID)
+	default:
+		return fmt.Errorf("invalid jobs command: %s", args[0])
+	}
+}
+
+func (cmd *jobsCmd) list(ctx scope.Context, jq jobs.JobQueue) error {
+	stats, err := jq.Stats(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("queue %s: %d waiting, %d due, %d claimed, %d dead\n\n",
+		jq.Name(), stats.Waiting, stats.Due, stats.Claimed, stats.Failed)
+
+	failed, err := jq.ListFailed(ctx, cmd.limit)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "JOB ID\tTYPE\tCREATED\tATTEMPTS\tLAST FAILURE")
+	for _, job := range failed {
+		reason := ""
+		if jl := lastJobLog(ctx, jq, job); jl != nil {
+			reason = jl.FailureReason
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n",
+			job.ID, job.Type, job.Created.Format(time.RFC3339), job.AttemptsMade, reason)
+	}
+	return w.Flush()
+}
+
+func (cmd *jobsCmd) retryAll(ctx scope.Context, jq jobs.JobQueue) error {
+	failed, err := jq.ListFailed(ctx, cmd.limit)
+	if err != nil {
+		return err
+	}
+
+	for _, job := range failed {
+		if err := jq.Retry(ctx, job.ID); err != nil {
+			return fmt.Errorf("retry %s: %s", job.ID, err)
+		}
+	}
+	fmt.Printf("returned %d dead jobs to queue %s\n", len(failed), jq.Name())
+	return nil
+}
+
+func (cmd *jobsCmd) showLog(ctx scope.Context, jq jobs.JobQueue, jobID snowflake.Snowflake) error {
+	found := false
+	for attempt := int32(0); ; attempt++ {
+		jl, err := jq.Log(ctx, jobID, attempt)
+		if err == jobs.ErrJobNotFound {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		found = true
+
+		outcome := "succeeded"
+		if !jl.Success {
+			outcome = "failed: " + jl.FailureReason
+		}
+		fmt.Printf("--- attempt %d by %s %s\n", jl.AttemptNumber, jl.HandlerID, outcome)
+		os.Stdout.Write(jl.Log)
+	}
+
+	if !found {
+		return fmt.Errorf("no logs for job %s", jobID)
+	}
+	return nil
+}
+
+// lastJobLog returns the log of the job's final attempt, if it can be found.
+func lastJobLog(ctx scope.Context, jq jobs.JobQueue, job *jobs.Job) *jobs.JobLog {
+	if job.AttemptsMade < 1 {
+		return nil
+	}
+	jl, err := jq.Log(ctx, job.ID, job.AttemptsMade-1)
+	if err != nil {
+		return nil
+	}
+	return jl
+}
+
+func parseJobID(s string) (snowflake.Snowflake, error) {
+	var jobID snowflake.Snowflake
+	if err := jobID.FromString(s); err != nil {
+		// Also accept the decimal form stored in the database.
+		n, perr := strconv.ParseInt(s, 10, 64)
+		if perr != nil {
+			return 0, fmt.Errorf("invalid job id: %s", s)
+		}
+		jobID = snowflake.Snowflake(n)
+	}
+	return jobID, nil
+}
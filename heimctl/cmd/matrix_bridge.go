@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"euphoria.io/heim/matrix"
+	"euphoria.io/scope"
+)
+
+func init() {
+	register("matrix-bridge", &matrixBridgeCmd{})
+}
+
+type matrixBridgeCmd struct {
+	config       string
+	registration bool
+}
+
+func (matrixBridgeCmd) desc() string {
+	return "bridge heim rooms to Matrix rooms"
+}
+
+func (matrixBridgeCmd) usage() string {
+	return "matrix-bridge -config=<bridge.yml> [-registration]"
+}
+
+func (matrixBridgeCmd) longdesc() string {
+	return `
+	Run a Matrix application service that bridges heim rooms to Matrix rooms,
+	as declared in the given YAML file. For example:
+
+		heim: https://euphoria.io
+		homeserver: https://matrix.example.org
+		domain: example.org
+		listen: :9000
+		url: http://bridge.internal:9000
+		id: heim
+		as-token: <random secret>
+		hs-token: <random secret>
+		sender-localpart: heimbridge
+		login:
+		  namespace: email
+		  id: bridge@example.org
+		  password: <password>
+		rooms:
+		  - heim: test
+		    matrix: "!abcdef:example.org"
+
+	The login account should manage every bridged heim room, so that edits
+	and redactions made in Matrix can be applied. Run with -registration to
+	print the registration file to install on the homeserver.
+`[1:]
+}
+
+func (cmd *matrixBridgeCmd) flags() *flag.FlagSet {
+	fs := flag.NewFlagSet("matrix-bridge", flag.ExitOnError)
+	fs.StringVar(&cmd.config, "config", "bridge.yml", "path to the YAML file configuring the bridge")
+	fs.BoolVar(&cmd.registration, "registration", false, "print the application-service registration and exit")
+	return fs
+}
+
+func (cmd *matrixBridgeCmd) run(ctx scope.Context, args []string) error {
+	cfg, err := matrix.LoadConfig(cmd.config)
+	if err != nil {
+		return err
+	}
+
+	if cmd.registration {
+		reg, err := cfg.Registration()
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(reg)
+		return err
+	}
+
+	bridge, err := matrix.New(cfg)
+	if err != nil {
+		return err
+	}
+	if err := bridge.Start(ctx); err != nil {
+		return err
+	}
+	defer bridge.Close()
+
+	listener, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	fmt.Printf("bridging %d room(s) to %s, serving on %s\n", len(cfg.Rooms), cfg.Homeserver, cfg.Listen)
+	if err := http.Serve(listener, bridge); err != nil && ctx.Alive() {
+		return err
+	}
+	return nil
+}
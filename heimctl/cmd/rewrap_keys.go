@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+
+	"euphoria.io/heim/backend/psql"
+	"euphoria.io/heim/proto/security"
+	"euphoria.io/scope"
+)
+
+func init() {
+	register("rewrap-keys", &rewrapKeysCmd{})
+}
+
+type rewrapKeysCmd struct {
+	restart bool
+}
+
+func (rewrapKeysCmd) desc() string {
+	return "re-encrypt stored keys under the current KMS master key"
+}
+
+func (rewrapKeysCmd) usage() string { return "rewrap-keys [-restart]" }
+
+func (rewrapKeysCmd) longdesc() string {
+	return `
+	Walk every KMS-encrypted key in the database and re-encrypt it under the
+	current version of the KMS master key. Run this after rotating the master
+	key: for the local KMS, by appending the new key file to
+	kms.aes256.rotated-key-files; for the AWS KMS, by changing
+	kms.amazon.key-id; for the Vault KMS, by rotating the transit key in
+	Vault (vault write -f transit/keys/<name>/rotate). The old master key
+	must remain available until this command has finished.
+
+	Keys already encrypted under the current version are left alone, so the
+	command may be run repeatedly. Progress is recorded in the database after
+	every batch; an interrupted run resumes where it stopped, unless -restart
+	is given. Only one instance should run at a time.
+
+	Some keys live outside the database and aren't touched. Staff
+	capabilities granted with the local KMS type carry a copy of the master
+	key, and must be granted again. Static cluster secrets must be
+	regenerated with gen-cluster-secret before the old master key is retired.
+`[1:]
+}
+
+func (cmd *rewrapKeysCmd) flags() *flag.FlagSet {
+	fs := flag.NewFlagSet("rewrap-keys", flag.ExitOnError)
+	fs.BoolVar(&cmd.restart, "restart", false, "ignore saved progress and check every key")
+	return fs
+}
+
+func (cmd *rewrapKeysCmd) run(ctx scope.Context, args []string) error {
+	heim, b, err := getHeimWithPsqlBackend(ctx)
+	if err != nil {
+		return err
+	}
+	defer heim.Backend.Close()
+
+	kms, ok := heim.KMS.(security.RotatingKMS)
+	if !ok {
+		return fmt.Errorf("configured KMS does not support key rotation")
+	}
+
+	fmt.Printf("rewrapping keys under master key version %s\n", kms.KeyVersion())
+	return b.RewrapKeys(ctx, kms, cmd.restart, func(r psql.RewrapResult) {
+		if r.Skipped {
+			fmt.Printf("%s: already done\n", r.KeyColumn)
+			return
+		}
+		fmt.Printf("%s: %d keys checked, %d rewrapped\n", r.KeyColumn, r.Scanned, r.Rewrapped)
+	})
+}
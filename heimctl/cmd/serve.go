@@ -92,8 +92,22 @@ func (cmd *serveCmd) run(ctx scope.Context, args []string) error {
 	}
 
 	server.SetInsecureCookies(backend.Config.SetInsecureCookies)
+	trustedProxies, err := backend.Config.TrustedProxyNetworks()
+	if err != nil {
+		return fmt.Errorf("configuration error: %s", err)
+	}
+	server.TrustProxies(trustedProxies)
 	server.AllowRoomCreation(backend.Config.AllowRoomCreation)
 	server.NewAccountMinAgentAge(backend.Config.NewAccountMinAgentAge)
+	server.RoomEntryMinAgentAge(backend.Config.RoomEntryMinAgentAge)
+
+	oidcProviders, err := backend.Config.OIDC.Get()
+	if err != nil {
+		return fmt.Errorf("configuration error: %s", err)
+	}
+	for name, provider := range oidcProviders {
+		server.AddOIDCProvider(name, provider)
+	}
 
 	// Spin off goroutine to watch ctx and close listener if shutdown requested.
 	go func() {
@@ -3,8 +3,10 @@ package cmd
 import (
 	"flag"
 	"fmt"
+	"strings"
 
 	"euphoria.io/heim/heimctl/worker"
+	"euphoria.io/heim/proto/jobs"
 	"euphoria.io/scope"
 )
 
@@ -13,22 +15,39 @@ func init() {
 }
 
 type workerCmd struct {
-	addr   string
-	worker string
+	addr              string
+	worker            string
+	queues            string
+	list              bool
+	presenceSchedule  string
+	retentionSchedule string
 }
 
 func (workerCmd) desc() string {
-	return "run a worker for processing a job queue"
+	return "run a worker for processing job queues"
 }
 
 func (workerCmd) usage() string {
-	return "worker [--http=<interface:port>] [--worker=ID] QUEUE"
+	return "worker [--http=<interface:port>] [--worker=ID] [--list] [--queues=QUEUE[:N],...]" +
+		" [--presence-schedule=CRON] [--retention-schedule=CRON] [QUEUE[:N]...]"
 }
 
 func (workerCmd) longdesc() string {
 	return `
-	Run a worker for processing job items from QUEUE. The worker will idle
-	until it can claim a job.
+	Run a worker for processing job items from each QUEUE. The worker will
+	idle until it can claim a job. Jobs for recurring maintenance tasks (the
+	presence and retention queues) are also scheduled by the worker, so at
+	least one worker should be serving each of those queues. Their
+	schedules are cron expressions (minute hour day-of-month month
+	day-of-week), given with --presence-schedule and --retention-schedule.
+	Every worker scheduling them should be given the same schedules. The
+	presence queue requires a cluster whose peers share values, such as
+	etcd or a static cluster with a single peer.
+
+	Queues may be given with --queues as a comma-separated list, as
+	arguments, or both. Follow a queue's name with :N to work on up to N of
+	its jobs at once (e.g. emails:4). Run with --list to show the queues
+	that have registered workers.
 `[1:]
 }
 
@@ -36,16 +55,39 @@ func (cmd *workerCmd) flags() *flag.FlagSet {
 	flags := flag.NewFlagSet("worker", flag.ExitOnError)
 	flags.StringVar(&cmd.addr, "http", ":8080", "address to serve metrics on")
 	flags.StringVar(&cmd.worker, "worker", "worker", "prefix for handler IDs")
+	flags.StringVar(&cmd.queues, "queues", "", "comma-separated queues to work on, each optionally with :CONCURRENCY")
+	flags.BoolVar(&cmd.list, "list", false, "list queues with registered workers and exit")
+	flags.StringVar(&cmd.presenceSchedule, "presence-schedule", worker.PresenceSchedule.String(),
+		"cron schedule of presence table scans")
+	flags.StringVar(&cmd.retentionSchedule, "retention-schedule", worker.RetentionSchedule.String(),
+		"cron schedule of message retention scans")
 	return flags
 }
 
 func (cmd *workerCmd) run(ctx scope.Context, args []string) error {
-	if len(args) < 1 {
+	if cmd.list {
+		for _, name := range worker.Queues() {
+			fmt.Println(name)
+		}
+		return nil
+	}
+
+	queues, err := worker.ParseQueueConfigs(strings.Join(append([]string{cmd.queues}, args...), ","))
+	if err != nil {
+		return err
+	}
+	if len(queues) < 1 {
 		fmt.Printf("Usage: %s\r\n", cmd.usage())
-		// TODO: list queues
 		return nil
 	}
 
+	if worker.PresenceSchedule, err = jobs.ParseSchedule(cmd.presenceSchedule); err != nil {
+		return fmt.Errorf("presence schedule: %s", err)
+	}
+	if worker.RetentionSchedule, err = jobs.ParseSchedule(cmd.retentionSchedule); err != nil {
+		return fmt.Errorf("retention schedule: %s", err)
+	}
+
 	fmt.Printf("getting config\n")
 	cfg, err := getConfig(ctx)
 	if err != nil {
@@ -70,5 +112,5 @@ func (cmd *workerCmd) run(ctx scope.Context, args []string) error {
 	go worker.Serve(ctx, cmd.addr)
 
 	// Start scanner.
-	return worker.Loop(ctx, heim, cmd.worker, args[0])
+	return worker.Loop(ctx, heim, cmd.worker, queues...)
 }
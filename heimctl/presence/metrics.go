@@ -1,6 +1,10 @@
 package presence
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
 
 var (
 	rowCount = prometheus.NewGauge(prometheus.GaugeOpts{
@@ -59,14 +63,46 @@ var (
 	})
 )
 
-func init() {
-	prometheus.MustRegister(rowCount)
-	prometheus.MustRegister(activeRowCount)
-	prometheus.MustRegister(activeRowCountPerRoom)
-	prometheus.MustRegister(lurkingRowCount)
-	prometheus.MustRegister(lurkingRowCountPerRoom)
-	prometheus.MustRegister(uniqueAgentCount)
-	prometheus.MustRegister(uniqueLurkingAgentCount)
-	prometheus.MustRegister(uniqueWebAgentCount)
-	prometheus.MustRegister(sessionsPerAgent)
+var (
+	collectors = []prometheus.Collector{
+		rowCount,
+		activeRowCount,
+		activeRowCountPerRoom,
+		lurkingRowCount,
+		lurkingRowCountPerRoom,
+		uniqueAgentCount,
+		uniqueLurkingAgentCount,
+		uniqueWebAgentCount,
+		sessionsPerAgent,
+	}
+
+	publishedM sync.Mutex
+	published  bool
+)
+
+// Publish exports the metrics of this process's scans. Scans may run in any of
+// several processes, but only the one that made the latest scan should export
+// its metrics, so they're withheld until Publish is called.
+func Publish() {
+	publishedM.Lock()
+	defer publishedM.Unlock()
+	if !published {
+		for _, c := range collectors {
+			prometheus.MustRegister(c)
+		}
+		published = true
+	}
+}
+
+// Withdraw stops exporting the metrics of this process's scans, once another
+// process has made a later one.
+func Withdraw() {
+	publishedM.Lock()
+	defer publishedM.Unlock()
+	if published {
+		for _, c := range collectors {
+			prometheus.Unregister(c)
+		}
+		published = false
+	}
 }
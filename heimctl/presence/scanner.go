@@ -3,7 +3,6 @@ package presence
 import (
 	"fmt"
 	"strings"
-	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 
@@ -13,37 +12,11 @@ import (
 	"euphoria.io/scope"
 )
 
-const (
-	maxErrors = 3
-	chunkSize = 1000
-)
-
-func ScanLoop(ctx scope.Context, c cluster.Cluster, pb *psql.Backend, interval time.Duration) {
-	defer ctx.WaitGroup().Done()
-
-	errCount := 0
-	for {
-		t := time.After(interval)
-		select {
-		case <-ctx.Done():
-			return
-		case <-t:
-			if err := scan(ctx.Fork(), c, pb); err != nil {
-				errCount++
-				fmt.Printf("scan error [%d/%d]: %s", errCount, maxErrors, err)
-				if errCount > maxErrors {
-					fmt.Printf("maximum scan errors exceeded, terminating\n")
-					ctx.Terminate(fmt.Errorf("maximum scan errors exceeded"))
-					return
-				}
-				continue
-			}
-			errCount = 0
-		}
-	}
-}
+const chunkSize = 1000
 
-func scan(ctx scope.Context, c cluster.Cluster, pb *psql.Backend) error {
+// Scan collects metrics from the presence table. They're exported only once
+// Publish is called.
+func Scan(ctx scope.Context, c cluster.Cluster, pb *psql.Backend) error {
 	type PresenceWithUserAgent struct {
 		psql.Presence
 		UserAgent string `db:"user_agent"`
@@ -112,6 +85,10 @@ func scan(ctx scope.Context, c cluster.Cluster, pb *psql.Backend) error {
 	uniqueLurkingAgentCount.Set(float64(len(lurkingSessionsPerAgent)))
 	uniqueWebAgentCount.Set(float64(len(webSessionsPerAgent)))
 
+	// Forget rooms that have emptied since the last scan.
+	activeRowCountPerRoom.Reset()
+	lurkingRowCountPerRoom.Reset()
+
 	for room, count := range activeRowsPerRoom {
 		activeRowCountPerRoom.With(prometheus.Labels{"room": room}).Set(float64(count))
 	}
@@ -13,12 +13,11 @@ import (
 	"euphoria.io/scope"
 )
 
-const (
-	maxErrors   = 3
-	GracePeriod = time.Hour
-)
+const GracePeriod = time.Hour
 
-func scanForExpired(ctx scope.Context, c cluster.Cluster, pb *psql.Backend) error {
+// ScanForExpired reports which rooms hold messages past their retention
+// period.
+func ScanForExpired(ctx scope.Context, c cluster.Cluster, pb *psql.Backend) error {
 	rows, err := pb.DbMap.Select(
 		psql.Room{},
 		"SELECT name, founded_by, retention_days FROM room WHERE retention_days > 0")
@@ -60,32 +59,8 @@ func scanForExpired(ctx scope.Context, c cluster.Cluster, pb *psql.Backend) erro
 	return nil
 }
 
-func ExpiredScanLoop(ctx scope.Context, c cluster.Cluster, pb *psql.Backend, interval time.Duration) {
-	defer ctx.WaitGroup().Done()
-
-	errCount := 0
-	for {
-		t := time.After(interval)
-		select {
-		case <-ctx.Done():
-			return
-		case <-t:
-			if err := scanForExpired(ctx, c, pb); err != nil {
-				errCount++
-				fmt.Printf("scan error [%d/%d]: %s", errCount, maxErrors, err)
-				if errCount > maxErrors {
-					fmt.Println("maximum scan errors exceeded, terminating")
-					ctx.Terminate(fmt.Errorf("maximum scan errors exceeded"))
-					return
-				}
-				continue
-			}
-			errCount = 0
-		}
-	}
-}
-
-func scanToDelete(ctx scope.Context, c cluster.Cluster, pb *psql.Backend) error {
+// ScanToDelete deletes messages past their rooms' retention period.
+func ScanToDelete(ctx scope.Context, c cluster.Cluster, pb *psql.Backend) error {
 	rows, err := pb.DbMap.Select(
 		psql.Room{},
 		"SELECT name, founded_by, retention_days FROM room WHERE retention_days > 0")
@@ -116,28 +91,3 @@ func scanToDelete(ctx scope.Context, c cluster.Cluster, pb *psql.Backend) error
 	}
 	return nil
 }
-
-func DeleteScanLoop(ctx scope.Context, c cluster.Cluster, pb *psql.Backend, interval time.Duration) {
-	defer ctx.WaitGroup().Done()
-
-	errCount := 0
-	for {
-		t := time.After(interval)
-		select {
-		case <-ctx.Done():
-			return
-		case <-t:
-			if err := scanToDelete(ctx, c, pb); err != nil {
-				errCount++
-				fmt.Printf("delete scan error [%d/%d]: %s", errCount, maxErrors, err)
-				if errCount > maxErrors {
-					fmt.Println("maximum delete scan errors exceeded, terminating")
-					ctx.Terminate(fmt.Errorf("maximum delete scan errors exceeded"))
-					return
-				}
-				continue
-			}
-			errCount = 0
-		}
-	}
-}
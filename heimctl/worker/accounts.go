@@ -0,0 +1,28 @@
+package worker
+
+import (
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/jobs"
+	"euphoria.io/scope"
+)
+
+type AccountWorker struct {
+	b proto.Backend
+}
+
+func (AccountWorker) QueueName() string     { return jobs.AccountQueue }
+func (AccountWorker) JobType() jobs.JobType { return jobs.AccountDeletionJobType }
+
+func (w *AccountWorker) Init(heim *proto.Heim) error {
+	w.b = heim.Backend
+	return nil
+}
+
+func (w *AccountWorker) Work(ctx scope.Context, job *jobs.Job, payload interface{}) error {
+	deletionJob := payload.(*jobs.AccountDeletionJob)
+	return proto.ExecuteAccountDeletion(ctx, w.b, deletionJob.AccountID, job.ID)
+}
+
+func init() {
+	Register(&AccountWorker{})
+}
@@ -19,10 +19,6 @@ const (
 	StealChance   = 0.25
 )
 
-var workers = map[string]Worker{}
-
-func register(w Worker) { workers[w.QueueName()] = w }
-
 func NewController(ctx scope.Context, heim *proto.Heim, workerName, queueName string) (*Controller, error) {
 	jq, err := heim.Backend.Jobs().GetQueue(ctx, queueName)
 	if err != nil {
@@ -57,29 +53,53 @@ type Controller struct {
 	w  Worker
 }
 
+// fork returns another controller for the same queue and worker, with its
+// own handler ID, for working on jobs concurrently. The worker is shared, so
+// it must be safe for concurrent use (see Worker).
+func (c *Controller) fork(workerName string) (*Controller, error) {
+	sf, err := snowflake.New()
+	if err != nil {
+		return nil, err
+	}
+
+	ctrl := &Controller{
+		id: fmt.Sprintf("%s-%s", workerName, sf),
+		jq: c.jq,
+		w:  c.w,
+	}
+	return ctrl, nil
+}
+
 func (c *Controller) background(ctx scope.Context) {
 	defer ctx.WaitGroup().Done()
 
 	var lastStatCheck time.Time
 	for {
+		if ctx.Err() != nil {
+			return
+		}
 		logging.Logger(ctx).Printf("[%s] background loop", c.w.QueueName())
 		if time.Now().Sub(lastStatCheck) > StatsInterval {
 			logging.Logger(ctx).Printf("[%s] collecting stats", c.w.QueueName())
-			stats, err := c.jq.Stats(ctx)
-			if err != nil {
+			// Stats are only reported, so a failure to collect them waits
+			// for the next interval rather than stopping work.
+			lastStatCheck = time.Now()
+			if stats, err := c.jq.Stats(ctx); err != nil {
 				logging.Logger(ctx).Printf("error: %s stats: %s", c.w.QueueName(), err)
-				return
+				errorCounter.Inc()
+			} else {
+				labels := map[string]string{"queue": c.w.QueueName()}
+				claimedGauge.With(labels).Set(float64(stats.Claimed))
+				deadGauge.With(labels).Set(float64(stats.Failed))
+				dueGauge.With(labels).Set(float64(stats.Due))
+				waitingGauge.With(labels).Set(float64(stats.Waiting))
 			}
-			lastStatCheck = time.Now()
-			labels := map[string]string{"queue": c.w.QueueName()}
-			claimedGauge.With(labels).Set(float64(stats.Claimed))
-			dueGauge.With(labels).Set(float64(stats.Due))
-			waitingGauge.With(labels).Set(float64(stats.Waiting))
 		}
 		if err := c.processOne(ctx); err != nil {
 			// TODO: retry a couple times before giving up
 			logging.Logger(ctx).Printf("error: %s: %s", c.w.QueueName(), err)
 			errorCounter.Inc()
+			ctx.Terminate(err)
 			return
 		}
 	}
@@ -94,7 +114,7 @@ func (c *Controller) processOne(ctx scope.Context) error {
 		return err
 	}
 
-	if job.Type != jobs.EmailJobType {
+	if job.Type != c.w.JobType() {
 		return jobs.ErrInvalidJobType
 	}
 
@@ -49,5 +49,5 @@ func (w *EmailWorker) send(ctx scope.Context, accountID snowflake.Snowflake, msg
 }
 
 func init() {
-	register(&EmailWorker{})
+	Register(&EmailWorker{})
 }
@@ -2,21 +2,111 @@ package worker
 
 import (
 	"fmt"
+	"time"
 
+	"euphoria.io/heim/cluster"
 	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/jobs"
+	"euphoria.io/heim/proto/logging"
 	"euphoria.io/scope"
 )
 
-func Loop(ctx scope.Context, heim *proto.Heim, workerName, queueName string) error {
+const (
+	SchedulerPollTime = 10 * time.Second
+
+	// SchedulerElection is the cluster key that worker processes campaign on
+	// for the right to schedule recurring jobs.
+	SchedulerElection = "worker/scheduler"
+)
+
+// Loop runs controllers for each of the given queues, as many as the queue's
+// concurrency. If any of their workers have recurring jobs, it also campaigns
+// to schedule them, so that redundant worker processes leave scheduling to a
+// single leader. It returns when the context is cancelled or any controller
+// fails.
+func Loop(ctx scope.Context, heim *proto.Heim, workerName string, queues ...QueueConfig) error {
 	fmt.Printf("Loop\n")
-	ctrl, err := NewController(ctx, heim, workerName, queueName)
-	if err != nil {
-		fmt.Printf("error: %s\n", err)
-		return err
+	ctrls := []*Controller{}
+	recurring := []*jobs.RecurringJob{}
+	for _, qc := range queues {
+		ctrl, err := NewController(ctx, heim, workerName, qc.Name)
+		if err != nil {
+			fmt.Printf("error: %s\n", err)
+			return err
+		}
+		ctrls = append(ctrls, ctrl)
+		for i := 1; i < qc.Concurrency; i++ {
+			forked, err := ctrl.fork(workerName)
+			if err != nil {
+				return err
+			}
+			ctrls = append(ctrls, forked)
+		}
+		if rw, ok := ctrl.w.(RecurringWorker); ok {
+			recurring = append(recurring, rw.Recurring())
+		}
+	}
+
+	for _, ctrl := range ctrls {
+		ctx.WaitGroup().Add(1)
+		go ctrl.background(ctx)
+	}
+
+	if len(recurring) > 0 {
+		ctx.WaitGroup().Add(1)
+		go schedule(ctx, heim, recurring)
 	}
 
-	ctx.WaitGroup().Add(1)
-	go ctrl.background(ctx)
 	ctx.WaitGroup().Wait()
 	return ctx.Err()
 }
+
+// schedule runs a scheduler for the recurring jobs whenever this process leads
+// the scheduler election, or all the time if the cluster won't elect it.
+func schedule(ctx scope.Context, heim *proto.Heim, recurring []*jobs.RecurringJob) {
+	defer ctx.WaitGroup().Done()
+
+	// Observers of a static cluster can never win the election. Scheduling
+	// is still safe without it, since the job queue admits only one job per
+	// tick of each schedule; redundant schedulers just duplicate the effort.
+	if !cluster.CanLead(heim.Cluster) {
+		logging.Logger(ctx).Printf("cluster doesn't elect this process, scheduling recurring jobs without election")
+		scheduler := jobs.NewScheduler(heim.Backend.Jobs(), recurring...)
+		if err := scheduler.Run(ctx, SchedulerPollTime); err != nil && err != scope.Cancelled {
+			ctx.Terminate(err)
+		}
+		return
+	}
+
+	election := heim.Cluster.Campaign(SchedulerElection)
+	defer election.Resign()
+
+	var leaderCtx scope.Context
+	for {
+		select {
+		case <-ctx.Done():
+			if leaderCtx != nil {
+				leaderCtx.Cancel()
+			}
+			return
+		case leading := <-election.Changes():
+			switch {
+			case leading && leaderCtx == nil:
+				logging.Logger(ctx).Printf("elected to schedule recurring jobs")
+				leaderCtx = ctx.Fork()
+				scheduler := jobs.NewScheduler(heim.Backend.Jobs(), recurring...)
+				ctx.WaitGroup().Add(1)
+				go func(leaderCtx scope.Context) {
+					defer ctx.WaitGroup().Done()
+					if err := scheduler.Run(leaderCtx, SchedulerPollTime); err != nil && err != scope.Cancelled {
+						ctx.Terminate(err)
+					}
+				}(leaderCtx)
+			case !leading && leaderCtx != nil:
+				logging.Logger(ctx).Printf("no longer scheduling recurring jobs")
+				leaderCtx.Cancel()
+				leaderCtx = nil
+			}
+		}
+	}
+}
@@ -27,6 +27,12 @@ var (
 		Help:      "Counter of system errors with job management under this worker.",
 	})
 
+	deadGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "dead",
+		Subsystem: "jobs",
+		Help:      "Number of jobs per queue that have exhausted their attempts",
+	}, []string{"queue"})
+
 	failedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name:      "failed",
 		Subsystem: "jobs",
@@ -49,6 +55,7 @@ var (
 func init() {
 	prometheus.MustRegister(claimedGauge)
 	prometheus.MustRegister(completedCounter)
+	prometheus.MustRegister(deadGauge)
 	prometheus.MustRegister(dueGauge)
 	prometheus.MustRegister(errorCounter)
 	prometheus.MustRegister(failedCounter)
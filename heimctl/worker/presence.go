@@ -0,0 +1,101 @@
+package worker
+
+import (
+	"fmt"
+
+	"euphoria.io/heim/backend/psql"
+	"euphoria.io/heim/cluster"
+	"euphoria.io/heim/heimctl/presence"
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/jobs"
+	"euphoria.io/heim/proto/snowflake"
+	"euphoria.io/scope"
+)
+
+// PresenceSchedule is when presence scans are enqueued.
+var PresenceSchedule = jobs.MustParseSchedule("* * * * *")
+
+// PresenceScannerKey is the cluster key naming the process that made the
+// latest presence scan, within the directory presenceDir. Only that process
+// exports presence metrics.
+const (
+	presenceDir        = "worker/presence"
+	PresenceScannerKey = presenceDir + "/scanner"
+)
+
+type PresenceWorker struct {
+	c  cluster.Cluster
+	pb *psql.Backend
+	id string
+}
+
+func (PresenceWorker) QueueName() string     { return jobs.PresenceQueue }
+func (PresenceWorker) JobType() jobs.JobType { return jobs.PresenceScanJobType }
+
+func (w *PresenceWorker) Init(heim *proto.Heim) error {
+	pb, ok := heim.Backend.(*psql.Backend)
+	if !ok {
+		return fmt.Errorf("%s worker requires the psql backend", w.QueueName())
+	}
+	// Workers agree on which of them exports metrics through a cluster value.
+	if !cluster.SharesValues(heim.Cluster) {
+		return fmt.Errorf(
+			"%s worker requires a cluster whose peers share values, such as etcd or a single static peer",
+			w.QueueName())
+	}
+	sf, err := snowflake.New()
+	if err != nil {
+		return err
+	}
+	w.c = heim.Cluster
+	w.pb = pb
+	w.id = sf.String()
+
+	go w.follow(heim.Context, heim.Cluster.WatchDir(presenceDir))
+	return nil
+}
+
+func (w *PresenceWorker) Recurring() *jobs.RecurringJob {
+	return &jobs.RecurringJob{
+		Name:     string(jobs.PresenceScanJobType),
+		Queue:    jobs.PresenceQueue,
+		Schedule: PresenceSchedule,
+		Type:     jobs.PresenceScanJobType,
+		Payload:  &jobs.PresenceScanJob{},
+		Options:  jobs.PresenceScanJobOptions,
+	}
+}
+
+func (w *PresenceWorker) Work(ctx scope.Context, job *jobs.Job, payload interface{}) error {
+	if err := presence.Scan(ctx, w.c, w.pb); err != nil {
+		return err
+	}
+	return w.c.SetValue(PresenceScannerKey, w.id)
+}
+
+// follow publishes presence metrics while this process made the latest scan,
+// and withdraws them when another process makes one.
+func (w *PresenceWorker) follow(ctx scope.Context, events <-chan cluster.ValueEvent) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if presenceDir+"/"+event.Key != PresenceScannerKey {
+				continue
+			}
+			if !event.Deleted && event.Value == w.id {
+				presence.Publish()
+			} else {
+				presence.Withdraw()
+			}
+		}
+	}
+}
+
+func init() {
+	Register(&PresenceWorker{})
+}
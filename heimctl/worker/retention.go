@@ -0,0 +1,55 @@
+package worker
+
+import (
+	"fmt"
+
+	"euphoria.io/heim/backend/psql"
+	"euphoria.io/heim/cluster"
+	"euphoria.io/heim/heimctl/retention"
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/jobs"
+	"euphoria.io/scope"
+)
+
+// RetentionSchedule is when retention scans are enqueued.
+var RetentionSchedule = jobs.MustParseSchedule("* * * * *")
+
+type RetentionWorker struct {
+	c  cluster.Cluster
+	pb *psql.Backend
+}
+
+func (RetentionWorker) QueueName() string     { return jobs.RetentionQueue }
+func (RetentionWorker) JobType() jobs.JobType { return jobs.RetentionScanJobType }
+
+func (w *RetentionWorker) Init(heim *proto.Heim) error {
+	pb, ok := heim.Backend.(*psql.Backend)
+	if !ok {
+		return fmt.Errorf("%s worker requires the psql backend", w.QueueName())
+	}
+	w.c = heim.Cluster
+	w.pb = pb
+	return nil
+}
+
+func (w *RetentionWorker) Recurring() *jobs.RecurringJob {
+	return &jobs.RecurringJob{
+		Name:     string(jobs.RetentionScanJobType),
+		Queue:    jobs.RetentionQueue,
+		Schedule: RetentionSchedule,
+		Type:     jobs.RetentionScanJobType,
+		Payload:  &jobs.RetentionScanJob{},
+		Options:  jobs.RetentionScanJobOptions,
+	}
+}
+
+func (w *RetentionWorker) Work(ctx scope.Context, job *jobs.Job, payload interface{}) error {
+	if err := retention.ScanForExpired(ctx, w.c, w.pb); err != nil {
+		return err
+	}
+	return retention.ScanToDelete(ctx, w.c, w.pb)
+}
+
+func init() {
+	Register(&RetentionWorker{})
+}
@@ -1,14 +1,89 @@
+// Package worker runs handlers for job queues.
+//
+// Workers for built-in queues are registered by this package. To add a
+// worker for a queue of your own, implement Worker, register its job type
+// with jobs.RegisterJobType and the worker with Register (both usually in
+// init), and import your package for its side effects from a main package
+// that calls cmd.Run. Your worker can then be selected by queue name with
+// heimctl worker --queues.
 package worker
 
 import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
 	"euphoria.io/heim/proto"
 	"euphoria.io/heim/proto/jobs"
 	"euphoria.io/scope"
 )
 
+// A Worker handles the jobs of one queue. The registered instance is
+// initialized once and then shared by every controller for its queue, so
+// when a queue is run with a concurrency above 1, Work is called from
+// several goroutines at once. Implementations must be safe for concurrent
+// use.
 type Worker interface {
 	Init(heim *proto.Heim) error
 	QueueName() string
 	JobType() jobs.JobType
 	Work(ctx scope.Context, job *jobs.Job, payload interface{}) error
 }
+
+// A RecurringWorker is a Worker for jobs that are enqueued on a schedule,
+// rather than in response to activity. Every process running the worker
+// also runs the scheduler for its job.
+type RecurringWorker interface {
+	Worker
+	Recurring() *jobs.RecurringJob
+}
+
+var workers = map[string]Worker{}
+
+// Register makes a worker available to handle its queue. Registering a
+// worker for the same queue again replaces it.
+func Register(w Worker) { workers[w.QueueName()] = w }
+
+// Queues returns the names of the queues that have registered workers, in
+// sorted order.
+func Queues() []string {
+	names := make([]string, 0, len(workers))
+	for name := range workers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// A QueueConfig selects a queue for a worker process to serve, and how many
+// jobs from it to work on at once.
+type QueueConfig struct {
+	Name        string
+	Concurrency int
+}
+
+// ParseQueueConfigs parses a comma-separated list of queue names, each
+// optionally followed by a colon and its concurrency (e.g. "emails:4,presence").
+// Concurrency defaults to 1.
+func ParseQueueConfigs(s string) ([]QueueConfig, error) {
+	configs := []QueueConfig{}
+	for _, spec := range strings.Split(s, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		qc := QueueConfig{Name: spec, Concurrency: 1}
+		if i := strings.LastIndex(spec, ":"); i >= 0 {
+			n, err := strconv.Atoi(spec[i+1:])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid concurrency for queue %s: %s", spec[:i], spec[i+1:])
+			}
+			qc.Name = spec[:i]
+			qc.Concurrency = n
+		}
+		configs = append(configs, qc)
+	}
+	return configs, nil
+}
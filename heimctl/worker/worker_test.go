@@ -0,0 +1,30 @@
+package worker
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseQueueConfigs(t *testing.T) {
+	Convey("Queue names with optional concurrency", t, func() {
+		qcs, err := ParseQueueConfigs("emails:4, presence,,accounts:1")
+		So(err, ShouldBeNil)
+		So(qcs, ShouldResemble, []QueueConfig{
+			{Name: "emails", Concurrency: 4},
+			{Name: "presence", Concurrency: 1},
+			{Name: "accounts", Concurrency: 1},
+		})
+
+		qcs, err = ParseQueueConfigs("")
+		So(err, ShouldBeNil)
+		So(qcs, ShouldBeEmpty)
+	})
+
+	Convey("Invalid concurrency", t, func() {
+		for _, s := range []string{"emails:", "emails:0", "emails:-1", "emails:x"} {
+			_, err := ParseQueueConfigs(s)
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
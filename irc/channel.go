@@ -0,0 +1,299 @@
+package irc
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/client"
+	"euphoria.io/heim/proto/logging"
+	"euphoria.io/heim/proto/snowflake"
+	"euphoria.io/scope"
+)
+
+const (
+	// refLength is the number of trailing characters of a message ID used
+	// to refer to it, unless more are needed to make the reference unique.
+	refLength = 4
+
+	// maxRefs bounds how many recent messages can be replied to.
+	maxRefs = 1000
+
+	sendTimeout = 30 * time.Second
+)
+
+// A channel is an IRC client's session in a heim room.
+type channel struct {
+	name   string
+	conn   *conn
+	ctx    scope.Context
+	client *client.Client
+
+	m       sync.Mutex
+	ready   bool
+	pending []message
+	refs    map[string]snowflake.Snowflake
+	ids     map[snowflake.Snowflake]string
+	order   []snowflake.Snowflake
+}
+
+func joinChannel(c *conn, name, room, passcode string) (*channel, error) {
+	cl, err := client.New(client.Config{
+		URL:      c.srv.HeimURL,
+		Room:     room,
+		Human:    true,
+		Nick:     c.currentNick(),
+		Passcode: passcode,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ch := &channel{
+		name:   name,
+		conn:   c,
+		ctx:    c.ctx.Fork(),
+		client: cl,
+		refs:   map[string]snowflake.Snowflake{},
+		ids:    map[snowflake.Snowflake]string{},
+	}
+
+	cl.Handle(proto.SendEventType, func(payload interface{}) {
+		msg := proto.Message(*payload.(*proto.SendEvent))
+		ch.relay(ch.render(&msg)...)
+	})
+	cl.Handle(proto.JoinEventType, func(payload interface{}) {
+		if nick := ircNick(payload.(*proto.PresenceEvent).Name); nick != "" {
+			ch.relay(message{Prefix: hostmask(nick), Command: "JOIN", Params: []string{name}})
+		}
+	})
+	cl.Handle(proto.PartEventType, func(payload interface{}) {
+		if nick := ircNick(payload.(*proto.PresenceEvent).Name); nick != "" {
+			ch.relay(message{Prefix: hostmask(nick), Command: "PART", Params: []string{name}})
+		}
+	})
+	cl.Handle(proto.NickEventType, func(payload interface{}) {
+		event := payload.(*proto.NickEvent)
+		from, to := ircNick(event.From), ircNick(event.To)
+		switch {
+		case from == to:
+		case from == "":
+			ch.relay(message{Prefix: hostmask(to), Command: "JOIN", Params: []string{name}})
+		case to == "":
+			ch.relay(message{Prefix: hostmask(from), Command: "PART", Params: []string{name}})
+		default:
+			ch.relay(message{Prefix: hostmask(from), Command: "NICK", Params: []string{to}})
+		}
+	})
+	cl.Handle(proto.BounceEventType, func(payload interface{}) {
+		ch.notice("access to the room was denied: " + payload.(*proto.BounceEvent).Reason)
+	})
+	cl.Handle(proto.DisconnectEventType, func(payload interface{}) {
+		ch.notice("disconnected from the room: " + payload.(*proto.DisconnectEvent).Reason)
+	})
+
+	if err := cl.Connect(ch.ctx); err != nil {
+		ch.ctx.Cancel()
+		return nil, err
+	}
+	return ch, nil
+}
+
+func joinErrorCode(err error) string {
+	if _, ok := err.(*client.BounceError); ok {
+		return errBadChannelKey
+	}
+	return errNoSuchChannel
+}
+
+func (ch *channel) close() {
+	ch.client.Close()
+	ch.ctx.Cancel()
+}
+
+// replay sends the room's recent history, followed by anything that arrived
+// while the join was being announced, and from then on relays events as
+// they arrive.
+func (ch *channel) replay() {
+	var backlog []message
+	if snapshot := ch.client.Snapshot(); snapshot != nil {
+		for i := range snapshot.Log {
+			backlog = append(backlog, ch.render(&snapshot.Log[i])...)
+		}
+	}
+
+	ch.m.Lock()
+	backlog = append(backlog, ch.pending...)
+	ch.pending = nil
+	ch.ready = true
+	ch.m.Unlock()
+
+	for _, msg := range backlog {
+		ch.conn.send(msg)
+	}
+}
+
+func (ch *channel) relay(msgs ...message) {
+	ch.m.Lock()
+	if !ch.ready {
+		ch.pending = append(ch.pending, msgs...)
+		ch.m.Unlock()
+		return
+	}
+	ch.m.Unlock()
+
+	for _, msg := range msgs {
+		ch.conn.send(msg)
+	}
+}
+
+func (ch *channel) notice(text string) {
+	ch.relay(message{Prefix: ch.conn.srv.name(), Command: "NOTICE", Params: []string{ch.name, text}})
+}
+
+// remember records a message ID so that it may be replied to, returning its
+// reference. A message's reference is the tail of its ID, lengthened as
+// needed to tell it apart from the other messages remembered.
+func (ch *channel) remember(id snowflake.Snowflake) string {
+	ch.m.Lock()
+	defer ch.m.Unlock()
+
+	if ref, ok := ch.ids[id]; ok {
+		return ref
+	}
+
+	full := id.String()
+	ref := shortRef(id)
+	for n := len(ref) + 1; n <= len(full); n++ {
+		if _, taken := ch.refs[ref]; !taken {
+			break
+		}
+		ref = full[len(full)-n:]
+	}
+
+	ch.refs[ref] = id
+	ch.ids[id] = ref
+	ch.order = append(ch.order, id)
+	if len(ch.order) > maxRefs {
+		delete(ch.refs, ch.ids[ch.order[0]])
+		delete(ch.ids, ch.order[0])
+		ch.order = ch.order[1:]
+	}
+	return ref
+}
+
+func (ch *channel) lookup(ref string) (snowflake.Snowflake, bool) {
+	ch.m.Lock()
+	defer ch.m.Unlock()
+	id, ok := ch.refs[strings.ToLower(ref)]
+	return id, ok
+}
+
+func shortRef(id snowflake.Snowflake) string {
+	s := id.String()
+	if len(s) > refLength {
+		s = s[len(s)-refLength:]
+	}
+	return s
+}
+
+// render turns a heim message into PRIVMSGs, tagging the first line with the
+// message's reference and that of its parent.
+func (ch *channel) render(msg *proto.Message) []message {
+	sender := ircNick(msg.Sender.Name)
+	if sender == "" {
+		sender = "_"
+	}
+
+	ref := ch.remember(msg.ID)
+	tag := "[" + ref + "]"
+	if msg.Parent != 0 {
+		tag = fmt.Sprintf("[%s > %s]", ref, ch.remember(msg.Parent))
+	}
+
+	content := msg.Content
+	action := strings.HasPrefix(content, "/me ")
+	if action {
+		content = content[len("/me "):]
+	}
+
+	var msgs []message
+	for i, line := range strings.Split(content, "\n") {
+		if i == 0 {
+			line = tag + " " + line
+		}
+		if action {
+			line = "\x01ACTION " + line + "\x01"
+		}
+		msgs = append(msgs, message{Prefix: hostmask(sender), Command: "PRIVMSG", Params: []string{ch.name, line}})
+	}
+	return msgs
+}
+
+// say posts a line from the IRC client, as a reply if it begins with
+// ">ref".
+func (ch *channel) say(text string) error {
+	if strings.HasPrefix(text, "\x01ACTION ") {
+		text = "/me " + strings.TrimSuffix(text[len("\x01ACTION "):], "\x01")
+	} else if strings.HasPrefix(text, "\x01") {
+		// Other CTCP requests aren't relayed.
+		return nil
+	}
+
+	var parent snowflake.Snowflake
+	if strings.HasPrefix(text, ">") {
+		fields := strings.SplitN(text[1:], " ", 2)
+		id, ok := ch.lookup(fields[0])
+		if !ok {
+			return fmt.Errorf("unknown message reference: %s", fields[0])
+		}
+		parent = id
+		text = ""
+		if len(fields) > 1 {
+			text = fields[1]
+		}
+	}
+
+	ctx := ch.ctx.ForkWithTimeout(sendTimeout)
+	defer ctx.Cancel()
+
+	reply, err := ch.client.Reply(ctx, parent, text)
+	if err != nil {
+		logging.Logger(ch.ctx).Printf("irc: %s: send: %s", ch.name, err)
+		return err
+	}
+	ch.remember(reply.ID)
+	return nil
+}
+
+func (ch *channel) setNick(nick string) error {
+	ctx := ch.ctx.ForkWithTimeout(sendTimeout)
+	defer ctx.Cancel()
+	_, err := ch.client.Nick(ctx, nick)
+	return err
+}
+
+// who lists the other sessions in the room.
+func (ch *channel) who() ([]proto.SessionView, error) {
+	ctx := ch.ctx.ForkWithTimeout(sendTimeout)
+	defer ctx.Cancel()
+
+	reply, err := ch.client.Send(ctx, proto.WhoType, &proto.WhoCommand{})
+	if err != nil {
+		return nil, err
+	}
+
+	self := ""
+	if snapshot := ch.client.Snapshot(); snapshot != nil {
+		self = snapshot.SessionID
+	}
+	var listing []proto.SessionView
+	for _, session := range reply.(*proto.WhoReply).Listing {
+		if session.SessionID != self {
+			listing = append(listing, session)
+		}
+	}
+	return listing, nil
+}
@@ -0,0 +1,304 @@
+package irc
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"euphoria.io/heim/backend"
+	"euphoria.io/heim/backend/mock"
+	"euphoria.io/heim/cluster"
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/client"
+	"euphoria.io/heim/proto/emails"
+	"euphoria.io/heim/proto/security"
+	"euphoria.io/heim/proto/snowflake"
+	"euphoria.io/scope"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMessage(t *testing.T) {
+	Convey("Parse", t, func() {
+		msg, ok := parseMessage(":nick!u@h PRIVMSG #room :hello there")
+		So(ok, ShouldBeTrue)
+		So(msg, ShouldResemble, message{
+			Prefix: "nick!u@h", Command: "PRIVMSG", Params: []string{"#room", "hello there"}})
+
+		msg, ok = parseMessage("join  #a,#b key")
+		So(ok, ShouldBeTrue)
+		So(msg, ShouldResemble, message{Command: "JOIN", Params: []string{"#a,#b", "key"}})
+
+		msg, ok = parseMessage("PRIVMSG #room ::)")
+		So(ok, ShouldBeTrue)
+		So(msg.Params, ShouldResemble, []string{"#room", ":)"})
+
+		_, ok = parseMessage("")
+		So(ok, ShouldBeFalse)
+		_, ok = parseMessage(":prefix-only")
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Format", t, func() {
+		So(message{Prefix: "heim", Command: "001", Params: []string{"nick", "Welcome home"}}.String(),
+			ShouldEqual, ":heim 001 nick :Welcome home")
+		So(message{Command: "JOIN", Params: []string{"#room"}}.String(), ShouldEqual, "JOIN #room")
+		So(message{Command: "PRIVMSG", Params: []string{"#room", ":)"}}.String(), ShouldEqual, "PRIVMSG #room ::)")
+		So(message{Command: "PRIVMSG", Params: []string{"#room", ""}}.String(), ShouldEqual, "PRIVMSG #room :")
+	})
+
+	Convey("Nicks and channels", t, func() {
+		So(ircNick("Mister Bot"), ShouldEqual, "MisterBot")
+		So(ircNick("héllo"), ShouldEqual, "h_llo")
+		So(ircNick("2fast"), ShouldEqual, "_2fast")
+		So(ircNick("  "), ShouldEqual, "")
+		So(validNick("alice"), ShouldBeTrue)
+		So(validNick("al ice"), ShouldBeFalse)
+
+		room, ok := roomName("#Test1")
+		So(ok, ShouldBeTrue)
+		So(room, ShouldEqual, "test1")
+		_, ok = roomName("test")
+		So(ok, ShouldBeFalse)
+		_, ok = roomName("#no-dashes")
+		So(ok, ShouldBeFalse)
+	})
+}
+
+type ircClient struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func dialIRC(addr, nick string) *ircClient {
+	nc, err := net.Dial("tcp", addr)
+	So(err, ShouldBeNil)
+	c := &ircClient{Conn: nc, r: bufio.NewReader(nc)}
+	c.send("NICK %s", nick)
+	c.send("USER %s 0 * :Real Name", nick)
+	c.expect("001")
+	c.expect("422")
+	return c
+}
+
+func (c *ircClient) send(format string, args ...interface{}) {
+	_, err := fmt.Fprintf(c, format+"\r\n", args...)
+	So(err, ShouldBeNil)
+}
+
+// expect returns the next message with the given command, skipping others.
+func (c *ircClient) expect(command string) message {
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		line, err := c.r.ReadString('\n')
+		So(err, ShouldBeNil)
+		msg, ok := parseMessage(strings.TrimRight(line, "\r\n"))
+		So(ok, ShouldBeTrue)
+		if msg.Command == command {
+			return msg
+		}
+	}
+}
+
+func TestRefs(t *testing.T) {
+	Convey("Colliding references are lengthened", t, func() {
+		ch := &channel{refs: map[string]snowflake.Snowflake{}, ids: map[snowflake.Snowflake]string{}}
+
+		// IDs 36^4 apart share their last four base-36 digits.
+		first := snowflake.Snowflake(1 << 40)
+		second := first + 36*36*36*36
+		So(shortRef(first), ShouldEqual, shortRef(second))
+
+		ref1 := ch.remember(first)
+		ref2 := ch.remember(second)
+		So(ref1, ShouldEqual, shortRef(first))
+		So(ref2, ShouldNotEqual, ref1)
+		So(strings.HasSuffix(second.String(), ref2), ShouldBeTrue)
+		So(ch.remember(second), ShouldEqual, ref2)
+
+		id, ok := ch.lookup(ref1)
+		So(ok, ShouldBeTrue)
+		So(id, ShouldEqual, first)
+		id, ok = ch.lookup(ref2)
+		So(ok, ShouldBeTrue)
+		So(id, ShouldEqual, second)
+	})
+
+	Convey("The oldest references are forgotten", t, func() {
+		ch := &channel{refs: map[string]snowflake.Snowflake{}, ids: map[snowflake.Snowflake]string{}}
+		oldest := ch.remember(snowflake.Snowflake(1 << 40))
+		for i := 1; i <= maxRefs; i++ {
+			ch.remember(snowflake.Snowflake(1<<40 + i))
+		}
+		_, ok := ch.lookup(oldest)
+		So(ok, ShouldBeFalse)
+		So(len(ch.refs), ShouldEqual, maxRefs)
+		So(len(ch.ids), ShouldEqual, maxRefs)
+	})
+}
+
+func TestGateway(t *testing.T) {
+	save := security.TestMode
+	defer func() { security.TestMode = save }()
+	security.TestMode = true
+
+	Convey("Gateway", t, func() {
+		heim := &proto.Heim{
+			Backend:        &mock.TestBackend{},
+			Cluster:        &cluster.TestCluster{},
+			Context:        scope.New(),
+			KMS:            security.LocalKMS(),
+			EmailDeliverer: &emails.TestDeliverer{},
+			SiteName:       "test",
+		}
+		heim.KMS.(security.MockKMS).SetMasterKey(make([]byte, security.AES256.KeySize()))
+		app, err := backend.NewServer(heim, "test1", "era1")
+		So(err, ShouldBeNil)
+		app.AllowRoomCreation(true)
+		hs := httptest.NewServer(app)
+		defer hs.Close()
+		defer hs.CloseClientConnections()
+		defer heim.Backend.Close()
+
+		ctx := scope.New()
+		defer ctx.Cancel()
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		gateway := &Server{HeimURL: hs.URL}
+		go gateway.Serve(ctx, listener)
+		addr := listener.Addr().String()
+
+		Convey("Registration is required", func() {
+			nc, err := net.Dial("tcp", addr)
+			So(err, ShouldBeNil)
+			c := &ircClient{Conn: nc, r: bufio.NewReader(nc)}
+			defer c.Close()
+
+			c.send("JOIN #test")
+			c.expect("451")
+			c.send("PING :abc")
+			So(c.expect("PONG").Params, ShouldResemble, []string{"heim", "abc"})
+			c.send("NICK b@d")
+			So(c.expect("432").Params[1], ShouldEqual, "b@d")
+		})
+
+		Convey("Chat with a heim session", func() {
+			heimUser, err := client.New(client.Config{URL: hs.URL, Room: "ircroom", Nick: "web user", Human: true})
+			So(err, ShouldBeNil)
+			received := make(chan *proto.SendEvent, 10)
+			heimUser.Handle(proto.SendEventType, func(payload interface{}) {
+				received <- payload.(*proto.SendEvent)
+			})
+			So(heimUser.Connect(ctx), ShouldBeNil)
+			defer heimUser.Close()
+			first, err := heimUser.Say(ctx, "before you came")
+			So(err, ShouldBeNil)
+
+			c := dialIRC(addr, "alice")
+			defer c.Close()
+
+			c.send("JOIN #IRCRoom")
+			So(c.expect("JOIN").Params, ShouldResemble, []string{"#ircroom"})
+			So(c.expect("353").Params, ShouldResemble, []string{"alice", "=", "#ircroom", "alice webuser"})
+			c.expect("366")
+
+			// Recent history is replayed with references.
+			ref := shortRef(first.ID)
+			msg := c.expect("PRIVMSG")
+			So(msg.Prefix, ShouldEqual, "webuser!heim@heim")
+			So(msg.Params, ShouldResemble, []string{"#ircroom", "[" + ref + "] before you came"})
+
+			// Messages from IRC reach the room.
+			c.send("PRIVMSG #ircroom :hello from irc")
+			sent := <-received
+			So(sent.Content, ShouldEqual, "hello from irc")
+			So(sent.Sender.Name, ShouldEqual, "alice")
+
+			// Replies from IRC are threaded.
+			c.send("PRIVMSG #ircroom :>%s a reply", ref)
+			reply := <-received
+			So(reply.Content, ShouldEqual, "a reply")
+			So(reply.Parent, ShouldEqual, first.ID)
+
+			c.send("PRIVMSG #ircroom :>zzzz nope")
+			So(c.expect("404").Params[2], ShouldEqual, "unknown message reference: zzzz")
+
+			// Replies from heim carry their parent's reference.
+			child, err := heimUser.Reply(ctx, first.ID, "line one\nline two")
+			So(err, ShouldBeNil)
+			msg = c.expect("PRIVMSG")
+			So(msg.Params[1], ShouldEqual, fmt.Sprintf("[%s > %s] line one", shortRef(child.ID), ref))
+			So(c.expect("PRIVMSG").Params[1], ShouldEqual, "line two")
+
+			// Actions map to /me.
+			c.send("PRIVMSG #ircroom :\x01ACTION waves\x01")
+			So((<-received).Content, ShouldEqual, "/me waves")
+			_, err = heimUser.Say(ctx, "/me waves back")
+			So(err, ShouldBeNil)
+			So(c.expect("PRIVMSG").Params[1], ShouldEndWith, " waves back\x01")
+
+			// Nick changes go both ways.
+			c.send("NICK alicia")
+			So(c.expect("NICK").Params, ShouldResemble, []string{"alicia"})
+			c.send("PRIVMSG #ircroom :renamed")
+			So((<-received).Sender.Name, ShouldEqual, "alicia")
+
+			_, err = heimUser.Nick(ctx, "web person")
+			So(err, ShouldBeNil)
+			msg = c.expect("NICK")
+			So(msg.Prefix, ShouldEqual, "webuser!heim@heim")
+			So(msg.Params, ShouldResemble, []string{"webperson"})
+
+			c.send("WHO #ircroom")
+			So(c.expect("352").Params[5], ShouldEqual, "alicia")
+			So(c.expect("352").Params[5], ShouldEqual, "webperson")
+			c.expect("315")
+
+			// Presence is relayed.
+			other, err := client.Dial(ctx, client.Config{URL: hs.URL, Room: "ircroom", Nick: "bob", Human: true})
+			So(err, ShouldBeNil)
+			msg = c.expect("JOIN")
+			So(msg.Prefix, ShouldEqual, "bob!heim@heim")
+			other.Close()
+			So(c.expect("PART").Prefix, ShouldEqual, "bob!heim@heim")
+
+			c.send("PART #ircroom")
+			So(c.expect("PART").Params, ShouldResemble, []string{"#ircroom"})
+			c.send("PRIVMSG #ircroom :gone")
+			c.expect("404")
+		})
+
+		Convey("Passcode-protected rooms", func() {
+			agentKey := &security.ManagedKey{
+				KeyType:   proto.AgentKeyType,
+				Plaintext: make([]byte, proto.AgentKeyType.KeySize()),
+			}
+			agent, err := proto.NewAgent([]byte("owner"), agentKey)
+			So(err, ShouldBeNil)
+			So(heim.Backend.AgentTracker().Register(ctx, agent), ShouldBeNil)
+			owner, ownerKey, err := heim.Backend.AccountManager().Register(
+				ctx, heim.KMS, "email", "owner", "ownerpass", agent.IDString(), agentKey)
+			So(err, ShouldBeNil)
+			room, err := heim.Backend.CreateRoom(ctx, heim.KMS, true, "ircsecret", owner)
+			So(err, ShouldBeNil)
+			rkey, err := room.MessageKey(ctx)
+			So(err, ShouldBeNil)
+			So(rkey.GrantToPasscode(ctx, owner, ownerKey, "hunter2"), ShouldBeNil)
+
+			c := dialIRC(addr, "carol")
+			defer c.Close()
+
+			c.send("JOIN #ircsecret")
+			So(c.expect("475").Params[1], ShouldEqual, "#ircsecret")
+			c.send("JOIN #ircsecret wrong")
+			c.expect("475")
+			c.send("JOIN #ircsecret hunter2")
+			So(c.expect("JOIN").Params, ShouldResemble, []string{"#ircsecret"})
+			c.expect("366")
+		})
+	})
+}
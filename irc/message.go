@@ -0,0 +1,135 @@
+package irc
+
+import (
+	"strings"
+)
+
+// Numeric replies, as named in RFC 2812.
+const (
+	rplWelcome          = "001"
+	rplYourHost         = "002"
+	rplCreated          = "003"
+	rplMyInfo           = "004"
+	rplEndOfWho         = "315"
+	rplNoTopic          = "331"
+	rplWhoReply         = "352"
+	rplNamReply         = "353"
+	rplEndOfNames       = "366"
+	errNoSuchNick       = "401"
+	errNoSuchChannel    = "403"
+	errCannotSendToChan = "404"
+	errUnknownCommand   = "421"
+	errNoMOTD           = "422"
+	errNoNicknameGiven  = "431"
+	errErroneusNickname = "432"
+	errNotOnChannel     = "442"
+	errNotRegistered    = "451"
+	errNeedMoreParams   = "461"
+	errAlreadyRegistred = "462"
+	errBadChannelKey    = "475"
+)
+
+// A message is a single line of the IRC protocol.
+type message struct {
+	Prefix  string
+	Command string
+	Params  []string
+}
+
+// parseMessage parses a line, without its trailing CRLF.
+func parseMessage(line string) (message, bool) {
+	var msg message
+
+	line = strings.TrimLeft(line, " ")
+	if strings.HasPrefix(line, ":") {
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			return msg, false
+		}
+		msg.Prefix, line = line[1:i], strings.TrimLeft(line[i:], " ")
+	}
+
+	for line != "" {
+		if line[0] == ':' {
+			msg.Params = append(msg.Params, line[1:])
+			break
+		}
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			i = len(line)
+		}
+		if msg.Command == "" {
+			msg.Command = strings.ToUpper(line[:i])
+		} else {
+			msg.Params = append(msg.Params, line[:i])
+		}
+		line = strings.TrimLeft(line[i:], " ")
+	}
+
+	return msg, msg.Command != ""
+}
+
+func (msg message) String() string {
+	parts := make([]string, 0, len(msg.Params)+2)
+	if msg.Prefix != "" {
+		parts = append(parts, ":"+msg.Prefix)
+	}
+	parts = append(parts, msg.Command)
+	for i, param := range msg.Params {
+		if i == len(msg.Params)-1 && (param == "" || param[0] == ':' || strings.IndexByte(param, ' ') >= 0) {
+			param = ":" + param
+		}
+		parts = append(parts, param)
+	}
+	return strings.Join(parts, " ")
+}
+
+// param returns the i'th parameter, or the empty string.
+func (msg message) param(i int) string {
+	if i < len(msg.Params) {
+		return msg.Params[i]
+	}
+	return ""
+}
+
+// ircNick reduces a heim nick to something IRC clients will accept.
+func ircNick(name string) string {
+	nick := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case strings.ContainsRune("[]\\`_^{|}-", r):
+			return r
+		case r == ' ':
+			return -1
+		default:
+			return '_'
+		}
+	}, name)
+	if nick == "" {
+		return ""
+	}
+	if c := nick[0]; c == '-' || (c >= '0' && c <= '9') {
+		nick = "_" + nick
+	}
+	return nick
+}
+
+// validNick reports whether an IRC client's chosen nick is acceptable.
+func validNick(nick string) bool {
+	return nick != "" && len(nick) <= 36 && ircNick(nick) == nick
+}
+
+// roomName returns the heim room named by an IRC channel.
+func roomName(channel string) (string, bool) {
+	if !strings.HasPrefix(channel, "#") || len(channel) < 2 {
+		return "", false
+	}
+	name := strings.ToLower(channel[1:])
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9') {
+			return "", false
+		}
+	}
+	return name, true
+}
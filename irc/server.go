@@ -0,0 +1,440 @@
+// Package irc implements an IRC server that relays channels to heim rooms.
+//
+// Each IRC connection is a heim user. Joining #room opens a session in the
+// heim room of that name, using the channel key, if any, as the room's
+// passcode. Messages are relayed in both directions, nick changes and
+// presence are mapped onto their IRC counterparts, and NAMES and WHO list
+// the room's sessions.
+//
+// IRC has no threads, so relayed messages are tagged with a short reference,
+// and replies also carry the reference of their parent:
+//
+//	<alice> [k3x9] anyone around?
+//	<bob> [m2p4 > k3x9] yes
+//
+// A line sent as ">k3x9 text" is posted as a reply to the referenced message.
+package irc
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"euphoria.io/heim/proto/logging"
+	"euphoria.io/scope"
+)
+
+// A Server accepts IRC connections and relays them to a heim server.
+type Server struct {
+	// HeimURL is the base URL of the heim server, such as
+	// https://euphoria.io.
+	HeimURL string
+
+	// Name identifies the gateway to IRC clients. It defaults to
+	// "heim".
+	Name string
+
+	created time.Time
+}
+
+func (s *Server) name() string {
+	if s.Name == "" {
+		return "heim"
+	}
+	return s.Name
+}
+
+// Serve accepts connections on l until ctx is cancelled or l fails.
+func (s *Server) Serve(ctx scope.Context, l net.Listener) error {
+	s.created = time.Now()
+
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			if ctx.Alive() {
+				return err
+			}
+			return nil
+		}
+		go s.serveConn(ctx.Fork(), nc)
+	}
+}
+
+func (s *Server) serveConn(ctx scope.Context, nc net.Conn) {
+	c := &conn{
+		srv:      s,
+		ctx:      ctx,
+		nc:       nc,
+		channels: map[string]*channel{},
+	}
+	defer c.close()
+
+	logging.Logger(ctx).Printf("irc: connection from %s", nc.RemoteAddr())
+	if err := c.serve(); err != nil {
+		logging.Logger(ctx).Printf("irc: %s: %s", nc.RemoteAddr(), err)
+	}
+}
+
+// A conn is one IRC client's connection.
+type conn struct {
+	srv *Server
+	ctx scope.Context
+	nc  net.Conn
+	wm  sync.Mutex
+
+	m          sync.Mutex
+	nick       string
+	user       string
+	realname   string
+	registered bool
+	channels   map[string]*channel
+}
+
+func (c *conn) serve() error {
+	r := bufio.NewReader(c.nc)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		msg, ok := parseMessage(strings.TrimRight(line, "\r\n"))
+		if !ok {
+			continue
+		}
+		if quit := c.handle(msg); quit {
+			return nil
+		}
+	}
+}
+
+func (c *conn) close() {
+	c.m.Lock()
+	channels := c.channels
+	c.channels = map[string]*channel{}
+	c.m.Unlock()
+
+	for _, ch := range channels {
+		ch.close()
+	}
+	c.nc.Close()
+	c.ctx.Cancel()
+}
+
+func (c *conn) send(msg message) {
+	c.wm.Lock()
+	defer c.wm.Unlock()
+	c.nc.SetWriteDeadline(time.Now().Add(time.Minute))
+	fmt.Fprintf(c.nc, "%s\r\n", msg)
+}
+
+// reply sends a message from the server.
+func (c *conn) reply(command string, params ...string) {
+	c.send(message{Prefix: c.srv.name(), Command: command, Params: params})
+}
+
+// numeric sends a numeric reply, which is addressed to the client's nick.
+func (c *conn) numeric(code string, params ...string) {
+	nick := c.currentNick()
+	if nick == "" {
+		nick = "*"
+	}
+	c.reply(code, append([]string{nick}, params...)...)
+}
+
+// from sends a message on behalf of a heim user.
+func (c *conn) from(nick, command string, params ...string) {
+	c.send(message{Prefix: hostmask(nick), Command: command, Params: params})
+}
+
+func hostmask(nick string) string { return nick + "!heim@heim" }
+
+func (c *conn) currentNick() string {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.nick
+}
+
+func (c *conn) channel(name string) (*channel, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	ch, ok := c.channels[name]
+	return ch, ok
+}
+
+func (c *conn) handle(msg message) (quit bool) {
+	switch msg.Command {
+	case "PING":
+		c.reply("PONG", c.srv.name(), msg.param(0))
+		return false
+	case "PONG", "CAP":
+		return false
+	case "QUIT":
+		return true
+	case "NICK":
+		c.handleNick(msg)
+		return false
+	case "USER":
+		c.handleUser(msg)
+		return false
+	}
+
+	c.m.Lock()
+	registered := c.registered
+	c.m.Unlock()
+	if !registered {
+		c.numeric(errNotRegistered, "You have not registered")
+		return false
+	}
+
+	switch msg.Command {
+	case "JOIN":
+		c.handleJoin(msg)
+	case "PART":
+		c.handlePart(msg)
+	case "PRIVMSG", "NOTICE":
+		c.handlePrivmsg(msg)
+	case "NAMES":
+		c.handleNames(msg)
+	case "WHO":
+		c.handleWho(msg)
+	case "MODE":
+		// Channel and user modes have no heim equivalent.
+	default:
+		c.numeric(errUnknownCommand, msg.Command, "Unknown command")
+	}
+	return false
+}
+
+func (c *conn) handleNick(msg message) {
+	nick := msg.param(0)
+	if nick == "" {
+		c.numeric(errNoNicknameGiven, "No nickname given")
+		return
+	}
+	if !validNick(nick) {
+		c.numeric(errErroneusNickname, nick, "Erroneous nickname")
+		return
+	}
+
+	c.m.Lock()
+	old := c.nick
+	c.nick = nick
+	registered := c.registered
+	channels := make([]*channel, 0, len(c.channels))
+	for _, ch := range c.channels {
+		channels = append(channels, ch)
+	}
+	c.m.Unlock()
+
+	if !registered {
+		c.register()
+		return
+	}
+
+	for _, ch := range channels {
+		if err := ch.setNick(nick); err != nil {
+			logging.Logger(c.ctx).Printf("irc: %s: nick: %s", ch.name, err)
+		}
+	}
+	c.send(message{Prefix: hostmask(old), Command: "NICK", Params: []string{nick}})
+}
+
+func (c *conn) handleUser(msg message) {
+	if len(msg.Params) < 4 {
+		c.numeric(errNeedMoreParams, "USER", "Not enough parameters")
+		return
+	}
+
+	c.m.Lock()
+	if c.registered {
+		c.m.Unlock()
+		c.numeric(errAlreadyRegistred, "You may not reregister")
+		return
+	}
+	c.user = msg.Params[0]
+	c.realname = msg.Params[3]
+	c.m.Unlock()
+
+	c.register()
+}
+
+// register completes registration once both NICK and USER have been given.
+func (c *conn) register() {
+	c.m.Lock()
+	if c.registered || c.nick == "" || c.user == "" {
+		c.m.Unlock()
+		return
+	}
+	c.registered = true
+	nick := c.nick
+	c.m.Unlock()
+
+	name := c.srv.name()
+	c.numeric(rplWelcome, fmt.Sprintf("Welcome to the heim IRC gateway %s", hostmask(nick)))
+	c.numeric(rplYourHost, fmt.Sprintf("Your host is %s, relaying to %s", name, c.srv.HeimURL))
+	c.numeric(rplCreated, fmt.Sprintf("This server was created %s", c.srv.created.Format(time.RFC1123)))
+	c.numeric(rplMyInfo, name, "heim", "", "")
+	c.numeric(errNoMOTD, "MOTD File is missing")
+}
+
+func (c *conn) handleJoin(msg message) {
+	if len(msg.Params) < 1 {
+		c.numeric(errNeedMoreParams, "JOIN", "Not enough parameters")
+		return
+	}
+
+	names := strings.Split(msg.Params[0], ",")
+	keys := strings.Split(msg.param(1), ",")
+	for i, name := range names {
+		key := ""
+		if i < len(keys) {
+			key = keys[i]
+		}
+		c.join(name, key)
+	}
+}
+
+func (c *conn) join(name, passcode string) {
+	room, ok := roomName(name)
+	if !ok {
+		c.numeric(errNoSuchChannel, name, "No such channel")
+		return
+	}
+	name = "#" + room
+	if _, ok := c.channel(name); ok {
+		return
+	}
+
+	ch, err := joinChannel(c, name, room, passcode)
+	if err != nil {
+		c.numeric(joinErrorCode(err), name, err.Error())
+		return
+	}
+
+	c.m.Lock()
+	c.channels[name] = ch
+	nick := c.nick
+	c.m.Unlock()
+
+	c.from(nick, "JOIN", name)
+	c.numeric(rplNoTopic, name, "No topic is set")
+	c.names(ch)
+	ch.replay()
+}
+
+func (c *conn) handlePart(msg message) {
+	if len(msg.Params) < 1 {
+		c.numeric(errNeedMoreParams, "PART", "Not enough parameters")
+		return
+	}
+
+	for _, name := range strings.Split(msg.Params[0], ",") {
+		name = strings.ToLower(name)
+		c.m.Lock()
+		ch, ok := c.channels[name]
+		delete(c.channels, name)
+		nick := c.nick
+		c.m.Unlock()
+
+		if !ok {
+			c.numeric(errNotOnChannel, name, "You're not on that channel")
+			continue
+		}
+		ch.close()
+		c.from(nick, "PART", name)
+	}
+}
+
+func (c *conn) handlePrivmsg(msg message) {
+	if len(msg.Params) < 2 {
+		c.numeric(errNeedMoreParams, msg.Command, "Not enough parameters")
+		return
+	}
+
+	target := strings.ToLower(msg.Params[0])
+	if !strings.HasPrefix(target, "#") {
+		c.numeric(errNoSuchNick, msg.Params[0], "Private messages are not supported")
+		return
+	}
+	ch, ok := c.channel(target)
+	if !ok {
+		c.numeric(errCannotSendToChan, msg.Params[0], "Cannot send to channel")
+		return
+	}
+
+	if err := ch.say(msg.Params[1]); err != nil {
+		c.numeric(errCannotSendToChan, target, err.Error())
+	}
+}
+
+func (c *conn) handleNames(msg message) {
+	for _, name := range strings.Split(msg.param(0), ",") {
+		if ch, ok := c.channel(strings.ToLower(name)); ok {
+			c.names(ch)
+		} else if name != "" {
+			c.numeric(rplEndOfNames, name, "End of NAMES list")
+		}
+	}
+}
+
+func (c *conn) names(ch *channel) {
+	listing, err := ch.who()
+	if err != nil {
+		logging.Logger(c.ctx).Printf("irc: %s: who: %s", ch.name, err)
+	}
+
+	nicks := []string{c.currentNick()}
+	for _, session := range listing {
+		if nick := ircNick(session.Name); nick != "" {
+			nicks = append(nicks, nick)
+		}
+	}
+	sort.Strings(nicks[1:])
+
+	// Keep each line comfortably under the 512-byte limit.
+	for len(nicks) > 0 {
+		n := 0
+		size := 0
+		for n < len(nicks) && size+len(nicks[n]) < 400 {
+			size += len(nicks[n]) + 1
+			n++
+		}
+		c.numeric(rplNamReply, "=", ch.name, strings.Join(nicks[:n], " "))
+		nicks = nicks[n:]
+	}
+	c.numeric(rplEndOfNames, ch.name, "End of NAMES list")
+}
+
+func (c *conn) handleWho(msg message) {
+	mask := strings.ToLower(msg.param(0))
+	ch, ok := c.channel(mask)
+	if !ok {
+		c.numeric(rplEndOfWho, msg.param(0), "End of WHO list")
+		return
+	}
+
+	listing, err := ch.who()
+	if err != nil {
+		logging.Logger(c.ctx).Printf("irc: %s: who: %s", ch.name, err)
+	}
+
+	c.m.Lock()
+	nick, realname := c.nick, c.realname
+	c.m.Unlock()
+	c.numeric(rplWhoReply, ch.name, "heim", "heim", c.srv.name(), nick, "H", "0 "+realname)
+	for _, session := range listing {
+		if who := ircNick(session.Name); who != "" {
+			c.numeric(rplWhoReply, ch.name, "heim", "heim", c.srv.name(), who, "H", "0 "+string(session.ID))
+		}
+	}
+	c.numeric(rplEndOfWho, ch.name, "End of WHO list")
+}
@@ -0,0 +1,232 @@
+// Package matrix bridges heim rooms to Matrix rooms through the Matrix
+// application-service API.
+//
+// Each bridged pair of rooms is watched from the heim side by a single relay
+// session, logged into an account that manages the room. Messages posted in
+// heim are sent to Matrix by puppeted users in the bridge's namespace, one
+// per heim user. Matrix users appear in heim as bot sessions of their own,
+// opened the first time they speak, under their display name.
+//
+// Replies are carried over in both directions. Edits and redactions made in
+// Matrix are applied in heim with edit-message, and edits and deletions made
+// in heim are applied to the puppets' Matrix events. The association between
+// heim messages and Matrix events is kept in memory only, so messages from
+// before the bridge last started can be replied to but not edited.
+package matrix
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/logging"
+	"euphoria.io/scope"
+)
+
+// maxTxns bounds how many transaction IDs are remembered for deduplication.
+const maxTxns = 100
+
+// A Bridge relays messages between heim and Matrix. It serves the
+// application-service API over HTTP.
+type Bridge struct {
+	cfg *Config
+	hs  *homeserver
+
+	ctx     scope.Context
+	portals map[string]*portal // by Matrix room ID
+
+	// txnm serializes transactions, so that events are relayed in order.
+	txnm     sync.Mutex
+	txns     map[string]bool
+	txnOrder []string
+}
+
+// New returns a Bridge for the given configuration. Call Start to join the
+// bridged rooms.
+func New(cfg *Config) (*Bridge, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &Bridge{
+		cfg:     cfg,
+		hs:      newHomeserver(cfg.Homeserver, cfg.ASToken),
+		portals: map[string]*portal{},
+		txns:    map[string]bool{},
+	}, nil
+}
+
+// Start joins the bridge user to each Matrix room and opens a relay session
+// in each heim room. If any room can't be joined, the rooms already opened
+// are closed and the error is returned.
+func (b *Bridge) Start(ctx scope.Context) error {
+	b.ctx = ctx.Fork()
+	for _, rc := range b.cfg.Rooms {
+		if err := b.hs.join(rc.Matrix, ""); err != nil {
+			b.Close()
+			return fmt.Errorf("%s: join: %s", rc.Matrix, err)
+		}
+		p, err := openPortal(b, rc)
+		if err != nil {
+			b.Close()
+			return fmt.Errorf("%s: %s", rc.Heim, err)
+		}
+		b.portals[rc.Matrix] = p
+	}
+	return nil
+}
+
+// Close leaves all bridged rooms.
+func (b *Bridge) Close() {
+	for _, p := range b.portals {
+		p.close()
+	}
+	if b.ctx != nil {
+		b.ctx.Cancel()
+	}
+}
+
+// puppetID returns the Matrix user that stands in for a heim user.
+func (b *Bridge) puppetID(id proto.UserID) string {
+	return "@" + b.puppetLocalpart(id) + ":" + b.cfg.Domain
+}
+
+func (b *Bridge) puppetLocalpart(id proto.UserID) string {
+	return b.cfg.userPrefix() + escapeLocalpart(string(id))
+}
+
+// isBridgeUser reports whether a Matrix user belongs to the bridge, either
+// as the bridge user itself or as a puppet.
+func (b *Bridge) isBridgeUser(userID string) bool {
+	return userID == b.cfg.senderID() ||
+		strings.HasPrefix(userID, "@"+b.cfg.userPrefix()) && strings.HasSuffix(userID, ":"+b.cfg.Domain)
+}
+
+// escapeLocalpart maps s onto the characters allowed in a Matrix localpart,
+// following the spec's recommended scheme: capitals become an underscore and
+// the lowercase letter, and other disallowed bytes are hex-encoded after an
+// equals sign.
+func escapeLocalpart(s string) string {
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '.', c == '-', c == '/':
+			out.WriteByte(c)
+		case c == '_':
+			out.WriteString("__")
+		case c >= 'A' && c <= 'Z':
+			out.WriteByte('_')
+			out.WriteByte(c - 'A' + 'a')
+		default:
+			fmt.Fprintf(&out, "=%02x", c)
+		}
+	}
+	return out.String()
+}
+
+// ServeHTTP implements the application-service API.
+func (b *Bridge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("access_token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = auth[len("Bearer "):]
+	}
+	switch {
+	case token == "":
+		writeError(w, http.StatusUnauthorized, "M_UNAUTHORIZED", "missing token")
+		return
+	case subtle.ConstantTimeCompare([]byte(token), []byte(b.cfg.HSToken)) != 1:
+		writeError(w, http.StatusForbidden, "M_FORBIDDEN", "bad token")
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/_matrix/app/v1")
+	switch {
+	case strings.HasPrefix(path, "/transactions/") && r.Method == "PUT":
+		b.serveTransaction(w, r, path[len("/transactions/"):])
+	case strings.HasPrefix(path, "/users/") && r.Method == "GET":
+		b.serveUserQuery(w, path[len("/users/"):])
+	case strings.HasPrefix(path, "/rooms/") && r.Method == "GET":
+		// Rooms are bridged by configuration, not on demand.
+		writeError(w, http.StatusNotFound, "M_NOT_FOUND", "no such room")
+	default:
+		writeError(w, http.StatusNotFound, "M_UNRECOGNIZED", "unrecognized request")
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, &Error{Code: code, Message: message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (b *Bridge) serveTransaction(w http.ResponseWriter, r *http.Request, txnID string) {
+	var txn Transaction
+	if err := json.NewDecoder(r.Body).Decode(&txn); err != nil {
+		writeError(w, http.StatusBadRequest, "M_NOT_JSON", err.Error())
+		return
+	}
+
+	b.txnm.Lock()
+	defer b.txnm.Unlock()
+
+	if !b.txns[txnID] {
+		for i := range txn.Events {
+			b.handleEvent(&txn.Events[i])
+		}
+		b.txns[txnID] = true
+		b.txnOrder = append(b.txnOrder, txnID)
+		if len(b.txnOrder) > maxTxns {
+			delete(b.txns, b.txnOrder[0])
+			b.txnOrder = b.txnOrder[1:]
+		}
+	}
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+func (b *Bridge) serveUserQuery(w http.ResponseWriter, userID string) {
+	if userID == b.cfg.senderID() || !b.isBridgeUser(userID) {
+		writeError(w, http.StatusNotFound, "M_NOT_FOUND", "no such user")
+		return
+	}
+	localpart := strings.TrimSuffix(strings.TrimPrefix(userID, "@"), ":"+b.cfg.Domain)
+	if err := b.hs.register(localpart); err != nil {
+		logging.Logger(b.ctx).Printf("matrix: register %s: %s", userID, err)
+		writeError(w, http.StatusInternalServerError, "M_UNKNOWN", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+func (b *Bridge) handleEvent(ev *Event) {
+	p, ok := b.portals[ev.RoomID]
+	if !ok || b.isBridgeUser(ev.Sender) {
+		return
+	}
+
+	var err error
+	switch ev.Type {
+	case "m.room.message":
+		var content MessageContent
+		if err = json.Unmarshal(ev.Content, &content); err == nil {
+			err = p.fromMatrix(ev, &content)
+		}
+	case "m.room.redaction":
+		err = p.redactFromMatrix(ev)
+	case "m.room.member":
+		var content MemberContent
+		if err = json.Unmarshal(ev.Content, &content); err == nil && ev.StateKey != nil {
+			err = p.memberFromMatrix(*ev.StateKey, &content)
+		}
+	}
+	if err != nil {
+		logging.Logger(b.ctx).Printf("matrix: %s: %s %s: %s", p.heimRoom, ev.Type, ev.EventID, err)
+	}
+}
@@ -0,0 +1,273 @@
+package matrix_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"euphoria.io/heim/backend"
+	"euphoria.io/heim/backend/mock"
+	"euphoria.io/heim/cluster"
+	"euphoria.io/heim/matrix"
+	"euphoria.io/heim/matrix/matrixtest"
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/client"
+	"euphoria.io/heim/proto/emails"
+	"euphoria.io/heim/proto/security"
+	"euphoria.io/scope"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	roomID = "!bridged:matrix.test"
+	alice  = "@alice:matrix.test"
+)
+
+func TestRegistration(t *testing.T) {
+	Convey("Registration", t, func() {
+		cfg := &matrix.Config{
+			Heim:            "http://heim",
+			Homeserver:      "http://matrix",
+			Domain:          "matrix.test",
+			ASToken:         "as",
+			HSToken:         "hs",
+			SenderLocalpart: "heimbridge",
+		}
+		reg, err := cfg.Registration()
+		So(err, ShouldBeNil)
+		So(string(reg), ShouldContainSubstring, `regex: '@heim_.*:matrix\.test'`)
+		So(string(reg), ShouldContainSubstring, "sender_localpart: heimbridge")
+
+		cfg.SenderLocalpart = "heim_bridge"
+		_, err = cfg.Registration()
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func waitMessage(hs *matrixtest.Homeserver, match func(*matrix.Event, *matrix.MessageContent) bool) (matrix.Event, matrix.MessageContent) {
+	var content matrix.MessageContent
+	ev, ok := hs.WaitForEvent(5*time.Second, func(ev *matrix.Event) bool {
+		if ev.Type != "m.room.message" {
+			return false
+		}
+		var c matrix.MessageContent
+		if json.Unmarshal(ev.Content, &c) != nil || !match(ev, &c) {
+			return false
+		}
+		content = c
+		return true
+	})
+	So(ok, ShouldBeTrue)
+	return ev, content
+}
+
+func receive(ch <-chan interface{}) interface{} {
+	select {
+	case payload := <-ch:
+		return payload
+	case <-time.After(5 * time.Second):
+		return nil
+	}
+}
+
+func TestBridge(t *testing.T) {
+	save := security.TestMode
+	defer func() { security.TestMode = save }()
+	security.TestMode = true
+
+	Convey("Bridge", t, func() {
+		heim := &proto.Heim{
+			Backend:        &mock.TestBackend{},
+			Cluster:        &cluster.TestCluster{},
+			Context:        scope.New(),
+			KMS:            security.LocalKMS(),
+			EmailDeliverer: &emails.TestDeliverer{},
+			SiteName:       "test",
+		}
+		heim.KMS.(security.MockKMS).SetMasterKey(make([]byte, security.AES256.KeySize()))
+		app, err := backend.NewServer(heim, "test1", "era1")
+		So(err, ShouldBeNil)
+		app.AllowRoomCreation(true)
+		heimServer := httptest.NewServer(app)
+		defer heimServer.Close()
+		defer heimServer.CloseClientConnections()
+		defer heim.Backend.Close()
+
+		ctx := scope.New()
+		defer ctx.Cancel()
+
+		// The bridge's account manages the heim room.
+		agentKey := &security.ManagedKey{
+			KeyType:   proto.AgentKeyType,
+			Plaintext: make([]byte, proto.AgentKeyType.KeySize()),
+		}
+		agent, err := proto.NewAgent([]byte("bridge"), agentKey)
+		So(err, ShouldBeNil)
+		So(heim.Backend.AgentTracker().Register(ctx, agent), ShouldBeNil)
+		owner, _, err := heim.Backend.AccountManager().Register(
+			ctx, heim.KMS, "email", "bridge@heim.test", "bridgepass", agent.IDString(), agentKey)
+		So(err, ShouldBeNil)
+		_, err = heim.Backend.CreateRoom(ctx, heim.KMS, false, "bridged", owner)
+		So(err, ShouldBeNil)
+
+		hs := matrixtest.NewHomeserver("matrix.test", "as-secret", "hs-secret", "heimbridge")
+		defer hs.Close()
+		hs.CreateRoom(roomID)
+		hs.AddUser(alice, "Alice")
+		So(hs.Join(roomID, alice), ShouldBeNil)
+
+		cfg := &matrix.Config{
+			Heim:            heimServer.URL,
+			Homeserver:      hs.URL,
+			Domain:          "matrix.test",
+			ASToken:         "as-secret",
+			HSToken:         "hs-secret",
+			SenderLocalpart: "heimbridge",
+			Login:           &matrix.LoginConfig{Namespace: "email", ID: "bridge@heim.test", Password: "bridgepass"},
+			Rooms:           []matrix.RoomConfig{{Heim: "bridged", Matrix: roomID}},
+		}
+		bridge, err := matrix.New(cfg)
+		So(err, ShouldBeNil)
+		So(bridge.Start(ctx), ShouldBeNil)
+		defer bridge.Close()
+		asServer := httptest.NewServer(bridge)
+		defer asServer.Close()
+		hs.SetAppService(asServer.URL)
+
+		events := make(chan interface{}, 20)
+		webUser, err := client.New(client.Config{URL: heimServer.URL, Room: "bridged", Nick: "web user", Human: true})
+		So(err, ShouldBeNil)
+		webUser.Handle(proto.SendEventType, func(payload interface{}) { events <- payload })
+		webUser.Handle(proto.EditMessageEventType, func(payload interface{}) { events <- payload })
+		webUser.Handle(proto.PartEventType, func(payload interface{}) { events <- payload })
+		So(webUser.Connect(ctx), ShouldBeNil)
+		defer webUser.Close()
+
+		Convey("The application-service API requires the homeserver's token", func() {
+			resp, err := http.Get(asServer.URL + "/_matrix/app/v1/users/@heim_x:matrix.test?access_token=wrong")
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusForbidden)
+
+			resp, err = http.Get(asServer.URL + "/_matrix/app/v1/users/@heim_x:matrix.test?access_token=hs-secret")
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+			resp, err = http.Get(asServer.URL + "/_matrix/app/v1/users/@bob:matrix.test?access_token=hs-secret")
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("Messages, replies, edits, and deletions are relayed", func() {
+			// heim to Matrix, by a puppet.
+			first, err := webUser.Say(ctx, "hello matrix")
+			So(err, ShouldBeNil)
+			firstEv, content := waitMessage(hs, func(ev *matrix.Event, c *matrix.MessageContent) bool {
+				return c.Body == "hello matrix"
+			})
+			puppet := firstEv.Sender
+			So(puppet, ShouldStartWith, "@heim_")
+			So(hs.DisplayName(puppet), ShouldEqual, "web user")
+			So(content.MsgType, ShouldEqual, "m.text")
+
+			// Matrix to heim, by a bot session.
+			hiEv, err := hs.Send(roomID, alice, &matrix.MessageContent{MsgType: "m.text", Body: "hi heim"})
+			So(err, ShouldBeNil)
+			sent := receive(events).(*proto.SendEvent)
+			So(sent.Content, ShouldEqual, "hi heim")
+			So(sent.Sender.Name, ShouldEqual, "Alice")
+			So(string(sent.Sender.ID), ShouldStartWith, "bot:")
+			hi := sent.ID
+
+			// Replies from Matrix keep their parent, without the quotation.
+			_, err = hs.Send(roomID, alice, &matrix.MessageContent{
+				MsgType:   "m.text",
+				Body:      "> <" + puppet + "> hello matrix\n\nwelcome",
+				RelatesTo: &matrix.RelatesTo{InReplyTo: &matrix.InReplyTo{EventID: firstEv.EventID}},
+			})
+			So(err, ShouldBeNil)
+			sent = receive(events).(*proto.SendEvent)
+			So(sent.Content, ShouldEqual, "welcome")
+			So(sent.Parent, ShouldEqual, first.ID)
+
+			// Replies and actions from heim.
+			_, err = webUser.Reply(ctx, hi, "/me waves")
+			So(err, ShouldBeNil)
+			_, content = waitMessage(hs, func(ev *matrix.Event, c *matrix.MessageContent) bool {
+				return c.Body == "waves"
+			})
+			So(content.MsgType, ShouldEqual, "m.emote")
+			So(content.RelatesTo.InReplyTo.EventID, ShouldEqual, hiEv)
+
+			// Edits from Matrix.
+			_, err = hs.Send(roomID, alice, &matrix.MessageContent{
+				MsgType:    "m.text",
+				Body:       "* hi heim!",
+				NewContent: &matrix.MessageContent{MsgType: "m.text", Body: "hi heim!"},
+				RelatesTo:  &matrix.RelatesTo{RelType: "m.replace", EventID: hiEv},
+			})
+			So(err, ShouldBeNil)
+			edit := receive(events).(*proto.EditMessageEvent)
+			So(edit.ID, ShouldEqual, hi)
+			So(edit.Content, ShouldEqual, "hi heim!")
+
+			// Redactions from Matrix.
+			_, err = hs.Redact(roomID, alice, hiEv)
+			So(err, ShouldBeNil)
+			edit = receive(events).(*proto.EditMessageEvent)
+			So(edit.ID, ShouldEqual, hi)
+			So(time.Time(edit.Deleted).IsZero(), ShouldBeFalse)
+
+			// Edits and deletions from heim, by a manager.
+			manager, err := client.Dial(ctx, client.Config{
+				URL:   heimServer.URL,
+				Room:  "bridged",
+				Login: &proto.LoginCommand{Namespace: "email", ID: "bridge@heim.test", Password: "bridgepass"},
+			})
+			So(err, ShouldBeNil)
+			defer manager.Close()
+			reply, err := manager.Send(ctx, proto.EditMessageType, &proto.EditMessageCommand{
+				ID: first.ID, Content: "hello, matrix", Announce: true})
+			So(err, ShouldBeNil)
+			_, content = waitMessage(hs, func(ev *matrix.Event, c *matrix.MessageContent) bool {
+				return c.NewContent != nil && c.NewContent.Body == "hello, matrix"
+			})
+			So(content.RelatesTo.RelType, ShouldEqual, "m.replace")
+			So(content.RelatesTo.EventID, ShouldEqual, firstEv.EventID)
+
+			_, err = manager.Send(ctx, proto.EditMessageType, &proto.EditMessageCommand{
+				ID:             first.ID,
+				PreviousEditID: reply.(*proto.EditMessageReply).EditID,
+				Delete:         true,
+				Announce:       true,
+			})
+			So(err, ShouldBeNil)
+			redaction, ok := hs.WaitForEvent(5*time.Second, func(ev *matrix.Event) bool {
+				return ev.Type == "m.room.redaction" && ev.Redacts == firstEv.EventID
+			})
+			So(ok, ShouldBeTrue)
+			So(redaction.Sender, ShouldEqual, puppet)
+
+			// Nothing relayed from Matrix was echoed back to it.
+			for _, ev := range hs.Events(roomID) {
+				So(ev.Sender == puppet && strings.Contains(string(ev.Content), "hi heim"), ShouldBeFalse)
+			}
+
+			// Leaving Matrix ends the heim session.
+			So(hs.Leave(roomID, alice), ShouldBeNil)
+			for {
+				payload := receive(events)
+				So(payload, ShouldNotBeNil)
+				if part, ok := payload.(*proto.PresenceEvent); ok && part.Name == "Alice" {
+					break
+				}
+			}
+		})
+	})
+}
@@ -0,0 +1,174 @@
+package matrix
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"euphoria.io/heim/proto"
+
+	"gopkg.in/yaml.v2"
+)
+
+const defaultUserPrefix = "heim_"
+
+// Config describes a bridge. It's the format read by heimctl matrix-bridge.
+type Config struct {
+	// Heim is the base URL of the heim server.
+	Heim string `yaml:"heim"`
+
+	// Homeserver is the base URL of the Matrix homeserver's client-server
+	// API, and Domain is its server name, which appears in user IDs.
+	Homeserver string `yaml:"homeserver"`
+	Domain     string `yaml:"domain"`
+
+	// Listen is the address the application-service API is served on, and
+	// URL is how the homeserver reaches it.
+	Listen string `yaml:"listen"`
+	URL    string `yaml:"url"`
+
+	// ID, ASToken, and HSToken identify the application service to the
+	// homeserver and vice versa, as in its registration file.
+	ID      string `yaml:"id"`
+	ASToken string `yaml:"as-token"`
+	HSToken string `yaml:"hs-token"`
+
+	// SenderLocalpart is the localpart of the bridge's own Matrix user.
+	SenderLocalpart string `yaml:"sender-localpart"`
+
+	// UserPrefix begins the localpart of every puppeted heim user. It
+	// defaults to "heim_".
+	UserPrefix string `yaml:"user-prefix,omitempty"`
+
+	// Login is the heim account the bridge watches each room with. It must
+	// be a manager of every bridged room for edits and deletions made on
+	// Matrix to be carried over.
+	Login *LoginConfig `yaml:"login,omitempty"`
+
+	Rooms []RoomConfig `yaml:"rooms"`
+}
+
+// LoginConfig gives the heim account the bridge logs into.
+type LoginConfig struct {
+	Namespace string `yaml:"namespace"`
+	ID        string `yaml:"id"`
+	Password  string `yaml:"password"`
+}
+
+// A RoomConfig pairs a heim room with a Matrix room.
+type RoomConfig struct {
+	Heim     string `yaml:"heim"`
+	Matrix   string `yaml:"matrix"`
+	Passcode string `yaml:"passcode,omitempty"`
+}
+
+// LoadConfig reads a Config from a YAML file.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) validate() error {
+	switch {
+	case cfg.Heim == "":
+		return fmt.Errorf("heim: URL required")
+	case cfg.Homeserver == "":
+		return fmt.Errorf("homeserver: URL required")
+	case cfg.Domain == "":
+		return fmt.Errorf("domain required")
+	case cfg.ASToken == "" || cfg.HSToken == "":
+		return fmt.Errorf("as-token and hs-token required")
+	case cfg.SenderLocalpart == "":
+		return fmt.Errorf("sender-localpart required")
+	}
+	if strings.HasPrefix(cfg.SenderLocalpart, cfg.userPrefix()) {
+		return fmt.Errorf("sender-localpart must not begin with user-prefix")
+	}
+
+	heimSeen := map[string]bool{}
+	matrixSeen := map[string]bool{}
+	for i, rc := range cfg.Rooms {
+		if rc.Heim == "" || rc.Matrix == "" {
+			return fmt.Errorf("room %d: heim and matrix room required", i+1)
+		}
+		if heimSeen[rc.Heim] || matrixSeen[rc.Matrix] {
+			return fmt.Errorf("room %d: bridged more than once", i+1)
+		}
+		heimSeen[rc.Heim] = true
+		matrixSeen[rc.Matrix] = true
+	}
+	return nil
+}
+
+func (cfg *Config) userPrefix() string {
+	if cfg.UserPrefix == "" {
+		return defaultUserPrefix
+	}
+	return cfg.UserPrefix
+}
+
+func (cfg *Config) login() *proto.LoginCommand {
+	if cfg.Login == nil {
+		return nil
+	}
+	return &proto.LoginCommand{
+		Namespace: cfg.Login.Namespace,
+		ID:        cfg.Login.ID,
+		Password:  cfg.Login.Password,
+	}
+}
+
+// senderID is the Matrix user ID of the bridge itself.
+func (cfg *Config) senderID() string {
+	return "@" + cfg.SenderLocalpart + ":" + cfg.Domain
+}
+
+// Registration returns the application-service registration file to give
+// to the homeserver.
+func (cfg *Config) Registration() ([]byte, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	type namespace struct {
+		Exclusive bool   `yaml:"exclusive"`
+		Regex     string `yaml:"regex"`
+	}
+	reg := struct {
+		ID              string `yaml:"id"`
+		URL             string `yaml:"url"`
+		ASToken         string `yaml:"as_token"`
+		HSToken         string `yaml:"hs_token"`
+		SenderLocalpart string `yaml:"sender_localpart"`
+		RateLimited     bool   `yaml:"rate_limited"`
+		Namespaces      struct {
+			Users   []namespace `yaml:"users"`
+			Aliases []namespace `yaml:"aliases"`
+			Rooms   []namespace `yaml:"rooms"`
+		} `yaml:"namespaces"`
+	}{
+		ID:              cfg.ID,
+		URL:             cfg.URL,
+		ASToken:         cfg.ASToken,
+		HSToken:         cfg.HSToken,
+		SenderLocalpart: cfg.SenderLocalpart,
+	}
+	reg.Namespaces.Users = []namespace{{
+		Exclusive: true,
+		Regex:     "@" + regexp.QuoteMeta(cfg.userPrefix()) + ".*:" + regexp.QuoteMeta(cfg.Domain),
+	}}
+	reg.Namespaces.Aliases = []namespace{}
+	reg.Namespaces.Rooms = []namespace{}
+	return yaml.Marshal(&reg)
+}
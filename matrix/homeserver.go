@@ -0,0 +1,189 @@
+package matrix
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// An Event is a Matrix room event, as delivered to the application service.
+type Event struct {
+	EventID  string          `json:"event_id"`
+	RoomID   string          `json:"room_id"`
+	Sender   string          `json:"sender"`
+	Type     string          `json:"type"`
+	StateKey *string         `json:"state_key,omitempty"`
+	Redacts  string          `json:"redacts,omitempty"`
+	Content  json.RawMessage `json:"content"`
+}
+
+// A Transaction is a batch of events pushed by the homeserver.
+type Transaction struct {
+	Events []Event `json:"events"`
+}
+
+// MessageContent is the content of an m.room.message event.
+type MessageContent struct {
+	MsgType    string          `json:"msgtype"`
+	Body       string          `json:"body"`
+	NewContent *MessageContent `json:"m.new_content,omitempty"`
+	RelatesTo  *RelatesTo      `json:"m.relates_to,omitempty"`
+}
+
+// RelatesTo relates a message to an earlier one, either as a reply or as a
+// replacement.
+type RelatesTo struct {
+	RelType   string     `json:"rel_type,omitempty"`
+	EventID   string     `json:"event_id,omitempty"`
+	InReplyTo *InReplyTo `json:"m.in_reply_to,omitempty"`
+}
+
+type InReplyTo struct {
+	EventID string `json:"event_id"`
+}
+
+// MemberContent is the content of an m.room.member event.
+type MemberContent struct {
+	Membership  string `json:"membership"`
+	DisplayName string `json:"displayname,omitempty"`
+}
+
+// An Error is an error response from the homeserver.
+type Error struct {
+	Status  int    `json:"-"`
+	Code    string `json:"errcode"`
+	Message string `json:"error"`
+}
+
+func (e *Error) Error() string { return fmt.Sprintf("%d %s: %s", e.Status, e.Code, e.Message) }
+
+func isErrCode(err error, code string) bool {
+	merr, ok := err.(*Error)
+	return ok && merr.Code == code
+}
+
+// homeserver makes client-server API requests as the application service,
+// optionally masquerading as one of its users.
+type homeserver struct {
+	url     string
+	asToken string
+	client  *http.Client
+	txn     int64
+}
+
+func newHomeserver(baseURL, asToken string) *homeserver {
+	return &homeserver{
+		url:     strings.TrimSuffix(baseURL, "/"),
+		asToken: asToken,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		txn:     time.Now().UnixNano(),
+	}
+}
+
+func (hs *homeserver) txnID() string {
+	return fmt.Sprintf("heim.%d", atomic.AddInt64(&hs.txn, 1))
+}
+
+func (hs *homeserver) do(method, path, asUser string, body, result interface{}) error {
+	u := hs.url + "/_matrix/client/v3" + path
+	if asUser != "" {
+		u += "?user_id=" + url.QueryEscape(asUser)
+	}
+
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, u, &reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+hs.asToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := hs.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		merr := &Error{Status: resp.StatusCode}
+		if err := json.Unmarshal(data, merr); err != nil || merr.Code == "" {
+			merr.Code = "M_UNKNOWN"
+			merr.Message = strings.TrimSpace(string(data))
+		}
+		return merr
+	}
+	if result != nil {
+		return json.Unmarshal(data, result)
+	}
+	return nil
+}
+
+func pathEscape(s string) string { return url.PathEscape(s) }
+
+// register creates a user in the application service's namespace. It's not
+// an error if the user already exists.
+func (hs *homeserver) register(localpart string) error {
+	body := map[string]string{"type": "m.login.application_service", "username": localpart}
+	err := hs.do("POST", "/register", "", body, nil)
+	if isErrCode(err, "M_USER_IN_USE") {
+		return nil
+	}
+	return err
+}
+
+func (hs *homeserver) setDisplayName(userID, name string) error {
+	body := map[string]string{"displayname": name}
+	return hs.do("PUT", "/profile/"+pathEscape(userID)+"/displayname", userID, body, nil)
+}
+
+func (hs *homeserver) displayName(userID string) (string, error) {
+	var result struct {
+		DisplayName string `json:"displayname"`
+	}
+	if err := hs.do("GET", "/profile/"+pathEscape(userID)+"/displayname", "", nil, &result); err != nil {
+		return "", err
+	}
+	return result.DisplayName, nil
+}
+
+func (hs *homeserver) invite(roomID, asUser, userID string) error {
+	body := map[string]string{"user_id": userID}
+	return hs.do("POST", "/rooms/"+pathEscape(roomID)+"/invite", asUser, body, nil)
+}
+
+func (hs *homeserver) join(roomID, userID string) error {
+	return hs.do("POST", "/join/"+pathEscape(roomID), userID, struct{}{}, nil)
+}
+
+func (hs *homeserver) sendMessage(roomID, userID string, content *MessageContent) (string, error) {
+	var result struct {
+		EventID string `json:"event_id"`
+	}
+	path := fmt.Sprintf("/rooms/%s/send/m.room.message/%s", pathEscape(roomID), hs.txnID())
+	if err := hs.do("PUT", path, userID, content, &result); err != nil {
+		return "", err
+	}
+	return result.EventID, nil
+}
+
+func (hs *homeserver) redact(roomID, userID, eventID string) error {
+	path := fmt.Sprintf("/rooms/%s/redact/%s/%s", pathEscape(roomID), pathEscape(eventID), hs.txnID())
+	return hs.do("PUT", path, userID, struct{}{}, nil)
+}
@@ -0,0 +1,416 @@
+// Package matrixtest provides a stand-in Matrix homeserver for testing
+// application services. It implements just enough of the client-server API
+// for a bridge, and pushes every room event to the application service.
+package matrixtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"euphoria.io/heim/matrix"
+)
+
+// A Homeserver is a Matrix homeserver with a single registered application
+// service.
+type Homeserver struct {
+	*httptest.Server
+
+	Domain          string
+	ASToken         string
+	HSToken         string
+	SenderLocalpart string
+
+	m        sync.Mutex
+	asURL    string
+	users    map[string]string // display names, by user ID
+	rooms    map[string]map[string]bool
+	events   []matrix.Event
+	nextID   int
+	queue    chan matrix.Event
+	done     chan struct{}
+	changed  chan struct{}
+	txnCount int
+}
+
+// NewHomeserver starts a homeserver for the given domain, with an
+// application service identified by the given tokens and sender. Call
+// SetAppService once the application service is listening, and Close when
+// finished.
+func NewHomeserver(domain, asToken, hsToken, senderLocalpart string) *Homeserver {
+	hs := &Homeserver{
+		Domain:          domain,
+		ASToken:         asToken,
+		HSToken:         hsToken,
+		SenderLocalpart: senderLocalpart,
+		users:           map[string]string{},
+		rooms:           map[string]map[string]bool{},
+		queue:           make(chan matrix.Event, 1000),
+		done:            make(chan struct{}),
+		changed:         make(chan struct{}),
+	}
+	hs.users[hs.senderID()] = ""
+	hs.Server = httptest.NewServer(http.HandlerFunc(hs.serve))
+	go hs.push()
+	return hs
+}
+
+func (hs *Homeserver) senderID() string { return "@" + hs.SenderLocalpart + ":" + hs.Domain }
+
+// SetAppService gives the base URL of the application service, which
+// receives all events from then on.
+func (hs *Homeserver) SetAppService(url string) {
+	hs.m.Lock()
+	hs.asURL = url
+	hs.m.Unlock()
+}
+
+// Close shuts down the homeserver.
+func (hs *Homeserver) Close() {
+	close(hs.done)
+	hs.Server.Close()
+}
+
+// CreateRoom creates an empty room.
+func (hs *Homeserver) CreateRoom(roomID string) {
+	hs.m.Lock()
+	defer hs.m.Unlock()
+	hs.rooms[roomID] = map[string]bool{}
+}
+
+// AddUser registers a user who is not in the application service's
+// namespace.
+func (hs *Homeserver) AddUser(userID, displayName string) {
+	hs.m.Lock()
+	defer hs.m.Unlock()
+	hs.users[userID] = displayName
+}
+
+// Join makes a user a member of a room.
+func (hs *Homeserver) Join(roomID, userID string) error {
+	hs.m.Lock()
+	defer hs.m.Unlock()
+	return hs.join(roomID, userID)
+}
+
+// Leave removes a user from a room.
+func (hs *Homeserver) Leave(roomID, userID string) error {
+	hs.m.Lock()
+	defer hs.m.Unlock()
+
+	members, ok := hs.rooms[roomID]
+	if !ok || !members[userID] {
+		return fmt.Errorf("%s is not in %s", userID, roomID)
+	}
+	delete(members, userID)
+	hs.emit(roomID, userID, "m.room.member", &userID, "",
+		&matrix.MemberContent{Membership: "leave"})
+	return nil
+}
+
+// Send posts an event to a room on behalf of a user, returning its ID.
+func (hs *Homeserver) Send(roomID, userID string, content *matrix.MessageContent) (string, error) {
+	hs.m.Lock()
+	defer hs.m.Unlock()
+	return hs.send(roomID, userID, "m.room.message", "", content)
+}
+
+// Redact redacts an event on behalf of a user, returning the redaction's
+// ID.
+func (hs *Homeserver) Redact(roomID, userID, eventID string) (string, error) {
+	hs.m.Lock()
+	defer hs.m.Unlock()
+	return hs.redact(roomID, userID, eventID)
+}
+
+// DisplayName returns a user's display name.
+func (hs *Homeserver) DisplayName(userID string) string {
+	hs.m.Lock()
+	defer hs.m.Unlock()
+	return hs.users[userID]
+}
+
+// Members lists the members of a room.
+func (hs *Homeserver) Members(roomID string) []string {
+	hs.m.Lock()
+	defer hs.m.Unlock()
+	var members []string
+	for userID := range hs.rooms[roomID] {
+		members = append(members, userID)
+	}
+	return members
+}
+
+// Events returns every event sent to a room so far.
+func (hs *Homeserver) Events(roomID string) []matrix.Event {
+	hs.m.Lock()
+	defer hs.m.Unlock()
+	var events []matrix.Event
+	for _, ev := range hs.events {
+		if ev.RoomID == roomID {
+			events = append(events, ev)
+		}
+	}
+	return events
+}
+
+// WaitForEvent waits for an event for which match returns true, returning
+// false if none is sent within the timeout. Events sent before the call are
+// considered too.
+func (hs *Homeserver) WaitForEvent(timeout time.Duration, match func(*matrix.Event) bool) (matrix.Event, bool) {
+	deadline := time.After(timeout)
+	seen := 0
+	for {
+		hs.m.Lock()
+		events := append([]matrix.Event(nil), hs.events[seen:]...)
+		seen = len(hs.events)
+		changed := hs.changed
+		hs.m.Unlock()
+
+		for i := range events {
+			if match(&events[i]) {
+				return events[i], true
+			}
+		}
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return matrix.Event{}, false
+		}
+	}
+}
+
+// TransactionCount returns how many transactions have been pushed to the
+// application service.
+func (hs *Homeserver) TransactionCount() int {
+	hs.m.Lock()
+	defer hs.m.Unlock()
+	return hs.txnCount
+}
+
+func (hs *Homeserver) join(roomID, userID string) error {
+	members, ok := hs.rooms[roomID]
+	if !ok {
+		return &matrix.Error{Status: http.StatusNotFound, Code: "M_NOT_FOUND", Message: "no such room"}
+	}
+	if _, ok := hs.users[userID]; !ok {
+		return &matrix.Error{Status: http.StatusForbidden, Code: "M_FORBIDDEN", Message: "no such user"}
+	}
+	if members[userID] {
+		return nil
+	}
+	members[userID] = true
+	hs.emit(roomID, userID, "m.room.member", &userID, "",
+		&matrix.MemberContent{Membership: "join", DisplayName: hs.users[userID]})
+	return nil
+}
+
+func (hs *Homeserver) send(roomID, userID, eventType, redacts string, content interface{}) (string, error) {
+	if !hs.rooms[roomID][userID] {
+		return "", &matrix.Error{Status: http.StatusForbidden, Code: "M_FORBIDDEN", Message: "not in room"}
+	}
+	return hs.emit(roomID, userID, eventType, nil, redacts, content), nil
+}
+
+func (hs *Homeserver) redact(roomID, userID, eventID string) (string, error) {
+	found := false
+	for i := range hs.events {
+		if hs.events[i].EventID == eventID && hs.events[i].RoomID == roomID {
+			hs.events[i].Content = json.RawMessage("{}")
+			found = true
+		}
+	}
+	if !found {
+		return "", &matrix.Error{Status: http.StatusNotFound, Code: "M_NOT_FOUND", Message: "no such event"}
+	}
+	return hs.send(roomID, userID, "m.room.redaction", eventID, struct{}{})
+}
+
+// emit must be called with hs.m held.
+func (hs *Homeserver) emit(roomID, sender, eventType string, stateKey *string, redacts string, content interface{}) string {
+	data, err := json.Marshal(content)
+	if err != nil {
+		panic(err)
+	}
+	hs.nextID++
+	ev := matrix.Event{
+		EventID:  fmt.Sprintf("$%d:%s", hs.nextID, hs.Domain),
+		RoomID:   roomID,
+		Sender:   sender,
+		Type:     eventType,
+		StateKey: stateKey,
+		Redacts:  redacts,
+		Content:  data,
+	}
+	hs.events = append(hs.events, ev)
+	close(hs.changed)
+	hs.changed = make(chan struct{})
+	hs.queue <- ev
+	return ev.EventID
+}
+
+// push delivers events to the application service one at a time, in order,
+// retrying each until it's accepted.
+func (hs *Homeserver) push() {
+	for {
+		var ev matrix.Event
+		select {
+		case ev = <-hs.queue:
+		case <-hs.done:
+			return
+		}
+
+		hs.m.Lock()
+		asURL := hs.asURL
+		if asURL != "" {
+			hs.txnCount++
+		}
+		txnID := hs.txnCount
+		hs.m.Unlock()
+		if asURL == "" {
+			continue
+		}
+
+		for !hs.deliver(asURL, txnID, ev) {
+			select {
+			case <-time.After(10 * time.Millisecond):
+			case <-hs.done:
+				return
+			}
+		}
+	}
+}
+
+func (hs *Homeserver) deliver(asURL string, txnID int, ev matrix.Event) bool {
+	body, err := json.Marshal(&matrix.Transaction{Events: []matrix.Event{ev}})
+	if err != nil {
+		panic(err)
+	}
+	req, err := http.NewRequest("PUT", fmt.Sprintf("%s/_matrix/app/v1/transactions/%d", asURL, txnID), bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Authorization", "Bearer "+hs.HSToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	if merr, ok := err.(*matrix.Error); ok {
+		writeJSON(w, merr.Status, merr)
+		return
+	}
+	writeJSON(w, http.StatusInternalServerError, &matrix.Error{Code: "M_UNKNOWN", Message: err.Error()})
+}
+
+func (hs *Homeserver) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+hs.ASToken {
+		writeJSON(w, http.StatusForbidden, &matrix.Error{Code: "M_UNKNOWN_TOKEN", Message: "bad token"})
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.EscapedPath(), "/_matrix/client/v3")
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for i, part := range parts {
+		if unescaped, err := url.PathUnescape(part); err == nil {
+			parts[i] = unescaped
+		}
+	}
+
+	var body map[string]interface{}
+	if r.Body != nil {
+		json.NewDecoder(r.Body).Decode(&body)
+	}
+	str := func(key string) string {
+		s, _ := body[key].(string)
+		return s
+	}
+
+	hs.m.Lock()
+	defer hs.m.Unlock()
+
+	asUser := r.URL.Query().Get("user_id")
+	if asUser == "" {
+		asUser = hs.senderID()
+	} else if _, ok := hs.users[asUser]; !ok {
+		writeJSON(w, http.StatusForbidden, &matrix.Error{Code: "M_FORBIDDEN", Message: "unregistered user"})
+		return
+	}
+
+	switch {
+	case r.Method == "POST" && path == "/register":
+		userID := "@" + str("username") + ":" + hs.Domain
+		if _, ok := hs.users[userID]; ok {
+			writeJSON(w, http.StatusBadRequest, &matrix.Error{Code: "M_USER_IN_USE", Message: "taken"})
+			return
+		}
+		hs.users[userID] = ""
+		writeJSON(w, http.StatusOK, map[string]string{"user_id": userID})
+
+	case len(parts) == 3 && parts[0] == "profile" && parts[2] == "displayname":
+		userID := parts[1]
+		name, ok := hs.users[userID]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, &matrix.Error{Code: "M_NOT_FOUND", Message: "no such user"})
+			return
+		}
+		if r.Method == "PUT" {
+			if asUser != userID {
+				writeJSON(w, http.StatusForbidden, &matrix.Error{Code: "M_FORBIDDEN", Message: "not yours"})
+				return
+			}
+			hs.users[userID] = str("displayname")
+			writeJSON(w, http.StatusOK, struct{}{})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"displayname": name})
+
+	case r.Method == "POST" && len(parts) == 2 && parts[0] == "join":
+		if err := hs.join(parts[1], asUser); err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"room_id": parts[1]})
+
+	case r.Method == "POST" && len(parts) == 3 && parts[0] == "rooms" && parts[2] == "invite":
+		// Rooms are public; invitations are accepted but have no effect.
+		writeJSON(w, http.StatusOK, struct{}{})
+
+	case r.Method == "PUT" && len(parts) == 5 && parts[0] == "rooms" && parts[2] == "send":
+		eventID, err := hs.send(parts[1], asUser, parts[3], "", body)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"event_id": eventID})
+
+	case r.Method == "PUT" && len(parts) == 5 && parts[0] == "rooms" && parts[2] == "redact":
+		eventID, err := hs.redact(parts[1], asUser, parts[3])
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"event_id": eventID})
+
+	default:
+		writeJSON(w, http.StatusNotFound, &matrix.Error{Code: "M_UNRECOGNIZED", Message: "unrecognized request"})
+	}
+}
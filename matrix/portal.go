@@ -0,0 +1,436 @@
+package matrix
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/client"
+	"euphoria.io/heim/proto/logging"
+	"euphoria.io/heim/proto/snowflake"
+	"euphoria.io/scope"
+)
+
+const (
+	// maxLinks bounds how many recent messages are remembered in each room
+	// for replies and edits.
+	maxLinks = 10000
+
+	sendTimeout = 30 * time.Second
+)
+
+// A link associates a heim message with the Matrix event it was relayed as,
+// or relayed from.
+type link struct {
+	heimID  snowflake.Snowflake
+	eventID string
+
+	// sender is the Matrix user who sent the event, either a puppet or,
+	// if fromMatrix is set, a user on the homeserver.
+	sender     string
+	fromMatrix bool
+
+	// editID is the ID of the message's latest edit in heim, needed to
+	// edit it again.
+	editID snowflake.Snowflake
+}
+
+// A portal is a bridged pair of rooms.
+type portal struct {
+	b          *Bridge
+	heimRoom   string
+	matrixRoom string
+	passcode   string
+	ctx        scope.Context
+	relay      *client.Client
+
+	m        sync.Mutex
+	ghosts   map[string]*client.Client // heim sessions, by Matrix user ID
+	ghostIDs map[proto.UserID]bool
+	puppets  map[proto.UserID]string // joined puppets' display names
+	byHeim   map[snowflake.Snowflake]*link
+	byEvent  map[string]*link
+	order    []*link
+}
+
+func openPortal(b *Bridge, rc RoomConfig) (*portal, error) {
+	relay, err := client.New(client.Config{
+		URL:      b.cfg.Heim,
+		Room:     rc.Heim,
+		Passcode: rc.Passcode,
+		Login:    b.cfg.login(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	p := &portal{
+		b:          b,
+		heimRoom:   rc.Heim,
+		matrixRoom: rc.Matrix,
+		passcode:   rc.Passcode,
+		ctx:        b.ctx.Fork(),
+		relay:      relay,
+		ghosts:     map[string]*client.Client{},
+		ghostIDs:   map[proto.UserID]bool{},
+		puppets:    map[proto.UserID]string{},
+		byHeim:     map[snowflake.Snowflake]*link{},
+		byEvent:    map[string]*link{},
+	}
+
+	relay.Handle(proto.SendEventType, func(payload interface{}) {
+		msg := payload.(*proto.SendEvent)
+		if err := p.fromHeim((*proto.Message)(msg)); err != nil {
+			logging.Logger(p.ctx).Printf("matrix: %s: send %s: %s", p.heimRoom, msg.ID, err)
+		}
+	})
+	relay.Handle(proto.EditMessageEventType, func(payload interface{}) {
+		event := payload.(*proto.EditMessageEvent)
+		if err := p.editFromHeim(event); err != nil {
+			logging.Logger(p.ctx).Printf("matrix: %s: edit %s: %s", p.heimRoom, event.ID, err)
+		}
+	})
+
+	if err := relay.Connect(p.ctx); err != nil {
+		p.ctx.Cancel()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *portal) close() {
+	p.m.Lock()
+	ghosts := p.ghosts
+	p.ghosts = map[string]*client.Client{}
+	p.m.Unlock()
+
+	for _, g := range ghosts {
+		g.Close()
+	}
+	p.relay.Close()
+	p.ctx.Cancel()
+}
+
+func (p *portal) remember(l *link) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	p.byHeim[l.heimID] = l
+	p.byEvent[l.eventID] = l
+	p.order = append(p.order, l)
+	if len(p.order) > maxLinks {
+		p.forget(p.order[0])
+		p.order = p.order[1:]
+	}
+}
+
+// forget must be called with p.m held.
+func (p *portal) forget(l *link) {
+	if p.byHeim[l.heimID] == l {
+		delete(p.byHeim, l.heimID)
+	}
+	if p.byEvent[l.eventID] == l {
+		delete(p.byEvent, l.eventID)
+	}
+}
+
+func (p *portal) linkByHeim(id snowflake.Snowflake) (link, bool) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if l, ok := p.byHeim[id]; ok {
+		return *l, true
+	}
+	return link{}, false
+}
+
+func (p *portal) linkByEvent(eventID string) (link, bool) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if l, ok := p.byEvent[eventID]; ok {
+		return *l, true
+	}
+	return link{}, false
+}
+
+func (p *portal) setEditID(id, editID snowflake.Snowflake) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if l, ok := p.byHeim[id]; ok {
+		l.editID = editID
+	}
+}
+
+func (p *portal) isGhost(id proto.UserID) bool {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.ghostIDs[id]
+}
+
+// puppet returns the Matrix user standing in for the sender of a heim
+// message, registering it and joining it to the room the first time, and
+// keeping its display name in step with the sender's nick.
+func (p *portal) puppet(sender *proto.SessionView) (string, error) {
+	userID := p.b.puppetID(sender.ID)
+
+	p.m.Lock()
+	name, joined := p.puppets[sender.ID]
+	p.m.Unlock()
+
+	if !joined {
+		if err := p.b.hs.register(p.b.puppetLocalpart(sender.ID)); err != nil {
+			return "", fmt.Errorf("register: %s", err)
+		}
+		// The room may be invite-only. If the puppet is already a member
+		// or invites aren't needed, the join below decides.
+		p.b.hs.invite(p.matrixRoom, "", userID)
+		if err := p.b.hs.join(p.matrixRoom, userID); err != nil {
+			return "", fmt.Errorf("join: %s", err)
+		}
+	}
+	if !joined || name != sender.Name {
+		if err := p.b.hs.setDisplayName(userID, sender.Name); err != nil {
+			return "", fmt.Errorf("set display name: %s", err)
+		}
+	}
+
+	p.m.Lock()
+	p.puppets[sender.ID] = sender.Name
+	p.m.Unlock()
+	return userID, nil
+}
+
+// fromHeim relays a message posted in heim.
+func (p *portal) fromHeim(msg *proto.Message) error {
+	if p.isGhost(msg.Sender.ID) {
+		return nil
+	}
+
+	userID, err := p.puppet(&msg.Sender)
+	if err != nil {
+		return err
+	}
+
+	content := matrixContent(msg.Content)
+	if msg.Parent != 0 {
+		if parent, ok := p.linkByHeim(msg.Parent); ok {
+			content.RelatesTo = &RelatesTo{InReplyTo: &InReplyTo{EventID: parent.eventID}}
+		}
+	}
+
+	eventID, err := p.b.hs.sendMessage(p.matrixRoom, userID, content)
+	if err != nil {
+		return err
+	}
+	p.remember(&link{heimID: msg.ID, eventID: eventID, sender: userID})
+	return nil
+}
+
+// editFromHeim applies an edit made in heim to the corresponding Matrix
+// event. Deletions become redactions. Edits to messages that came from
+// Matrix users can't be applied, since only the original sender may replace
+// an event.
+func (p *portal) editFromHeim(event *proto.EditMessageEvent) error {
+	l, ok := p.linkByHeim(event.ID)
+	if !ok {
+		return nil
+	}
+	p.setEditID(event.ID, event.EditID)
+
+	if !time.Time(event.Deleted).IsZero() {
+		redactor := l.sender
+		if l.fromMatrix {
+			redactor = ""
+		}
+		p.m.Lock()
+		if cur, ok := p.byHeim[event.ID]; ok {
+			p.forget(cur)
+		}
+		p.m.Unlock()
+		return p.b.hs.redact(p.matrixRoom, redactor, l.eventID)
+	}
+
+	if l.fromMatrix {
+		return nil
+	}
+	newContent := matrixContent(event.Content)
+	content := &MessageContent{
+		MsgType:    newContent.MsgType,
+		Body:       "* " + newContent.Body,
+		NewContent: newContent,
+		RelatesTo:  &RelatesTo{RelType: "m.replace", EventID: l.eventID},
+	}
+	_, err := p.b.hs.sendMessage(p.matrixRoom, l.sender, content)
+	return err
+}
+
+// ghost returns the heim session speaking for a Matrix user, opening it the
+// first time.
+func (p *portal) ghost(userID string) (*client.Client, error) {
+	p.m.Lock()
+	g, ok := p.ghosts[userID]
+	p.m.Unlock()
+	if ok {
+		return g, nil
+	}
+
+	name, err := p.b.hs.displayName(userID)
+	if err != nil || name == "" {
+		name = strings.TrimPrefix(strings.SplitN(userID, ":", 2)[0], "@")
+	}
+
+	g, err = client.Dial(p.ctx, client.Config{
+		URL:      p.b.cfg.Heim,
+		Room:     p.heimRoom,
+		Nick:     name,
+		Passcode: p.passcode,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	p.m.Lock()
+	p.ghosts[userID] = g
+	if snapshot := g.Snapshot(); snapshot != nil {
+		p.ghostIDs[snapshot.Identity] = true
+	}
+	p.m.Unlock()
+	return g, nil
+}
+
+// fromMatrix relays a message sent by a Matrix user, or applies it as an
+// edit if it replaces one of theirs.
+func (p *portal) fromMatrix(ev *Event, content *MessageContent) error {
+	ctx := p.ctx.ForkWithTimeout(sendTimeout)
+	defer ctx.Cancel()
+
+	rel := content.RelatesTo
+	if rel != nil && rel.RelType == "m.replace" {
+		l, ok := p.linkByEvent(rel.EventID)
+		if !ok || !l.fromMatrix || l.sender != ev.Sender {
+			return nil
+		}
+		if content.NewContent != nil {
+			content = content.NewContent
+		}
+		reply, err := p.relay.Send(ctx, proto.EditMessageType, &proto.EditMessageCommand{
+			ID:             l.heimID,
+			PreviousEditID: l.editID,
+			Content:        heimContent(content),
+			Announce:       true,
+		})
+		if err != nil {
+			return err
+		}
+		p.setEditID(l.heimID, reply.(*proto.EditMessageReply).EditID)
+		return nil
+	}
+
+	var parent snowflake.Snowflake
+	if rel != nil && rel.InReplyTo != nil {
+		if l, ok := p.linkByEvent(rel.InReplyTo.EventID); ok {
+			parent = l.heimID
+		}
+		content.Body = stripReplyFallback(content.Body)
+	}
+
+	g, err := p.ghost(ev.Sender)
+	if err != nil {
+		return err
+	}
+	reply, err := g.Reply(ctx, parent, heimContent(content))
+	if err != nil {
+		return err
+	}
+	p.remember(&link{heimID: reply.ID, eventID: ev.EventID, sender: ev.Sender, fromMatrix: true})
+	return nil
+}
+
+// redactFromMatrix deletes the heim message behind a redacted event. The
+// homeserver has already checked that the redaction is allowed.
+func (p *portal) redactFromMatrix(ev *Event) error {
+	l, ok := p.linkByEvent(ev.Redacts)
+	if !ok {
+		return nil
+	}
+
+	ctx := p.ctx.ForkWithTimeout(sendTimeout)
+	defer ctx.Cancel()
+
+	_, err := p.relay.Send(ctx, proto.EditMessageType, &proto.EditMessageCommand{
+		ID:             l.heimID,
+		PreviousEditID: l.editID,
+		Delete:         true,
+		Announce:       true,
+	})
+	if err != nil {
+		return err
+	}
+
+	p.m.Lock()
+	if cur, ok := p.byHeim[l.heimID]; ok {
+		p.forget(cur)
+	}
+	p.m.Unlock()
+	return nil
+}
+
+// memberFromMatrix follows a Matrix user's membership: leaving closes their
+// heim session, and a new display name becomes their nick.
+func (p *portal) memberFromMatrix(userID string, content *MemberContent) error {
+	p.m.Lock()
+	g, ok := p.ghosts[userID]
+	if ok && content.Membership != "join" {
+		delete(p.ghosts, userID)
+	}
+	p.m.Unlock()
+	if !ok {
+		return nil
+	}
+
+	if content.Membership != "join" {
+		return g.Close()
+	}
+	if content.DisplayName == "" {
+		return nil
+	}
+
+	ctx := p.ctx.ForkWithTimeout(sendTimeout)
+	defer ctx.Cancel()
+	_, err := g.Nick(ctx, content.DisplayName)
+	return err
+}
+
+// matrixContent converts heim message content to a Matrix message.
+func matrixContent(text string) *MessageContent {
+	if strings.HasPrefix(text, "/me ") {
+		return &MessageContent{MsgType: "m.emote", Body: text[len("/me "):]}
+	}
+	return &MessageContent{MsgType: "m.text", Body: text}
+}
+
+// heimContent converts a Matrix message to heim message content.
+func heimContent(content *MessageContent) string {
+	if content.MsgType == "m.emote" {
+		return "/me " + content.Body
+	}
+	return content.Body
+}
+
+// stripReplyFallback removes the quotation of the parent message that Matrix
+// clients prepend to replies.
+func stripReplyFallback(body string) string {
+	lines := strings.Split(body, "\n")
+	i := 0
+	for i < len(lines) && strings.HasPrefix(lines[i], ">") {
+		i++
+	}
+	if i == 0 {
+		return body
+	}
+	if i < len(lines) && lines[i] == "" {
+		i++
+	}
+	return strings.Join(lines[i:], "\n")
+}
@@ -0,0 +1,352 @@
+// Package oidc implements the relying party side of the OpenID Connect
+// authorization code flow.
+package oidc
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	discoveryPath = "/.well-known/openid-configuration"
+
+	// Tolerate this much clock skew between us and the provider when checking
+	// token expiration.
+	clockSkew = time.Minute
+)
+
+var (
+	ErrInvalidToken  = fmt.Errorf("oidc: invalid id token")
+	ErrNonceMismatch = fmt.Errorf("oidc: nonce mismatch")
+	ErrTokenExpired  = fmt.Errorf("oidc: id token expired")
+)
+
+// Config describes a relying party's registration with a provider.
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+// Claims are the parts of a verified ID token that we care about.
+type Claims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	Expires       int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Name          string   `json:"name"`
+}
+
+// The aud claim may be given as a single string or as a list.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var multi []string
+	if err := json.Unmarshal(data, &multi); err != nil {
+		return err
+	}
+	*a = audience(multi)
+	return nil
+}
+
+func (a audience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// A Provider is an OpenID Connect identity provider. Its discovery document
+// and signing keys are fetched on demand and cached.
+type Provider struct {
+	Client *http.Client
+
+	config Config
+
+	m    sync.Mutex
+	disc *discovery
+	keys map[string]*rsa.PublicKey
+}
+
+func NewProvider(config Config) *Provider {
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid"}
+	}
+	return &Provider{
+		Client: &http.Client{Timeout: 10 * time.Second},
+		config: config,
+	}
+}
+
+func (p *Provider) Issuer() string { return p.config.Issuer }
+
+// AuthCodeURL returns the URL of the provider's consent page. The state and
+// nonce values should be random and must be retained to complete the flow.
+func (p *Provider) AuthCodeURL(state, nonce string) (string, error) {
+	disc, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+
+	scopes := p.config.Scopes
+	hasOpenID := false
+	for _, s := range scopes {
+		if s == "openid" {
+			hasOpenID = true
+		}
+	}
+	if !hasOpenID {
+		scopes = append([]string{"openid"}, scopes...)
+	}
+
+	v := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.config.ClientID},
+		"redirect_uri":  {p.config.RedirectURL},
+		"scope":         {strings.Join(scopes, " ")},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+
+	sep := "?"
+	if strings.Contains(disc.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return disc.AuthorizationEndpoint + sep + v.Encode(), nil
+}
+
+// Exchange trades an authorization code for an ID token, returning the
+// token's claims once verified.
+func (p *Provider) Exchange(code, nonce string) (*Claims, error) {
+	disc, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {p.config.RedirectURL},
+	}
+	req, err := http.NewRequest("POST", disc.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: token request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var reply struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return nil, fmt.Errorf("oidc: token response: %s", err)
+	}
+	if reply.Error != "" {
+		return nil, fmt.Errorf("oidc: token request: %s: %s", reply.Error, reply.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc: token request: %s", resp.Status)
+	}
+	if reply.IDToken == "" {
+		return nil, fmt.Errorf("oidc: token response missing id_token")
+	}
+
+	return p.Verify(reply.IDToken, nonce)
+}
+
+// Verify checks the signature and claims of an RS256-signed ID token.
+func (p *Provider) Verify(rawIDToken, nonce string) (*Claims, error) {
+	parts := strings.Split(rawIDToken, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("oidc: unsupported signing algorithm: %s", header.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	claims := &Claims{}
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	disc, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case claims.Issuer != disc.Issuer:
+		return nil, ErrInvalidToken
+	case !claims.Audience.contains(p.config.ClientID):
+		return nil, ErrInvalidToken
+	case claims.Subject == "":
+		return nil, ErrInvalidToken
+	case time.Now().Add(-clockSkew).After(time.Unix(claims.Expires, 0)):
+		return nil, ErrTokenExpired
+	case claims.Nonce != nonce:
+		return nil, ErrNonceMismatch
+	}
+
+	return claims, nil
+}
+
+func (p *Provider) discover() (*discovery, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if p.disc != nil {
+		return p.disc, nil
+	}
+
+	disc := &discovery{}
+	if err := p.getJSON(strings.TrimSuffix(p.config.Issuer, "/")+discoveryPath, disc); err != nil {
+		return nil, fmt.Errorf("oidc: discovery: %s", err)
+	}
+	if disc.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("oidc: discovery: issuer mismatch: %s", disc.Issuer)
+	}
+	if disc.AuthorizationEndpoint == "" || disc.TokenEndpoint == "" || disc.JWKSURI == "" {
+		return nil, fmt.Errorf("oidc: discovery: incomplete provider metadata")
+	}
+
+	p.disc = disc
+	return disc, nil
+}
+
+// key returns the provider's signing key with the given ID. Key sets are
+// refetched whenever an unknown key ID is seen, to follow key rotation.
+func (p *Provider) key(kid string) (*rsa.PublicKey, error) {
+	disc, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(disc.JWKSURI, &jwks); err != nil {
+		return nil, fmt.Errorf("oidc: jwks: %s", err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil || len(e) > 4 {
+			continue
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	p.keys = keys
+
+	key, ok := keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("oidc: unknown signing key: %s", kid)
+	}
+	return key, nil
+}
+
+func (p *Provider) getJSON(url string, v interface{}) error {
+	resp, err := p.Client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
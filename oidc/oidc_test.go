@@ -0,0 +1,146 @@
+package oidc_test
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"euphoria.io/heim/oidc"
+	"euphoria.io/heim/oidc/oidctest"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const redirectURL = "http://heim.test/oidc/test/callback"
+
+func TestProvider(t *testing.T) {
+	idp, err := oidctest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idp.Close()
+
+	alice := &oidctest.User{Subject: "alice", Email: "alice@heim.test"}
+
+	// authorize follows the consent page redirect without following it back to
+	// the (nonexistent) relying party.
+	authorize := func(p *oidc.Provider, state, nonce string) url.Values {
+		authURL, err := p.AuthCodeURL(state, nonce)
+		So(err, ShouldBeNil)
+
+		client := &http.Client{
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		}
+		resp, err := client.Get(authURL)
+		So(err, ShouldBeNil)
+		resp.Body.Close()
+		So(resp.StatusCode, ShouldEqual, http.StatusFound)
+
+		loc, err := url.Parse(resp.Header.Get("Location"))
+		So(err, ShouldBeNil)
+		So(loc.Host, ShouldEqual, "heim.test")
+		So(loc.Query().Get("state"), ShouldEqual, state)
+		return loc.Query()
+	}
+
+	Convey("Authorization code flow", t, func() {
+		p := idp.Provider(redirectURL)
+		idp.SignIn(alice)
+
+		params := authorize(p, "state1", "nonce1")
+		claims, err := p.Exchange(params.Get("code"), "nonce1")
+		So(err, ShouldBeNil)
+		So(claims.Issuer, ShouldEqual, idp.URL)
+		So(claims.Subject, ShouldEqual, "alice")
+		So(claims.Email, ShouldEqual, "alice@heim.test")
+
+		Convey("Codes can only be used once", func() {
+			_, err := p.Exchange(params.Get("code"), "nonce1")
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Nonce must match", t, func() {
+		p := idp.Provider(redirectURL)
+		idp.SignIn(alice)
+
+		params := authorize(p, "state2", "nonce2")
+		_, err := p.Exchange(params.Get("code"), "other")
+		So(err, ShouldEqual, oidc.ErrNonceMismatch)
+	})
+
+	Convey("Denied authorization", t, func() {
+		p := idp.Provider(redirectURL)
+		idp.SignIn(nil)
+
+		params := authorize(p, "state3", "nonce3")
+		So(params.Get("error"), ShouldEqual, "access_denied")
+		So(params.Get("code"), ShouldEqual, "")
+	})
+
+	Convey("Client secret is required", t, func() {
+		p := oidc.NewProvider(oidc.Config{
+			Issuer:       idp.URL,
+			ClientID:     oidctest.ClientID,
+			ClientSecret: "wrong",
+			RedirectURL:  redirectURL,
+		})
+		idp.SignIn(alice)
+
+		params := authorize(p, "state4", "nonce4")
+		_, err := p.Exchange(params.Get("code"), "nonce4")
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "invalid_client")
+	})
+
+	Convey("Token verification", t, func() {
+		p := idp.Provider(redirectURL)
+
+		Convey("Valid token", func() {
+			token, err := idp.IDToken(*alice, oidctest.ClientID, "n", time.Now().Add(time.Hour))
+			So(err, ShouldBeNil)
+			claims, err := p.Verify(token, "n")
+			So(err, ShouldBeNil)
+			So(claims.Subject, ShouldEqual, "alice")
+		})
+
+		Convey("Wrong audience", func() {
+			token, err := idp.IDToken(*alice, "someone-else", "n", time.Now().Add(time.Hour))
+			So(err, ShouldBeNil)
+			_, err = p.Verify(token, "n")
+			So(err, ShouldEqual, oidc.ErrInvalidToken)
+		})
+
+		Convey("Expired", func() {
+			token, err := idp.IDToken(*alice, oidctest.ClientID, "n", time.Now().Add(-time.Hour))
+			So(err, ShouldBeNil)
+			_, err = p.Verify(token, "n")
+			So(err, ShouldEqual, oidc.ErrTokenExpired)
+		})
+
+		Convey("Tampered", func() {
+			token, err := idp.IDToken(*alice, oidctest.ClientID, "n", time.Now().Add(time.Hour))
+			So(err, ShouldBeNil)
+			mallory, err := idp.IDToken(
+				oidctest.User{Subject: "mallory"}, oidctest.ClientID, "n", time.Now().Add(time.Hour))
+			So(err, ShouldBeNil)
+
+			// Splice mallory's claims onto alice's signature.
+			_, err = p.Verify(splice(mallory, token), "n")
+			So(err, ShouldEqual, oidc.ErrInvalidToken)
+		})
+
+		Convey("Malformed", func() {
+			_, err := p.Verify("not.a-token", "n")
+			So(err, ShouldEqual, oidc.ErrInvalidToken)
+		})
+	})
+}
+
+func splice(claimsFrom, sigFrom string) string {
+	a := strings.Split(claimsFrom, ".")
+	b := strings.Split(sigFrom, ".")
+	return a[0] + "." + a[1] + "." + b[2]
+}
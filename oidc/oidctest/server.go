@@ -0,0 +1,245 @@
+// Package oidctest provides a stand-in OpenID Connect identity provider for
+// tests. It approves every authorization request on behalf of whichever user
+// is currently signed in.
+package oidctest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"euphoria.io/heim/oidc"
+)
+
+const (
+	ClientID     = "heim-test"
+	ClientSecret = "heim-test-secret"
+
+	keyID = "test-key"
+)
+
+// User describes the identity that the provider will vouch for.
+type User struct {
+	Subject string
+	Email   string
+	Name    string
+}
+
+type grant struct {
+	user        User
+	nonce       string
+	redirectURI string
+}
+
+type Server struct {
+	*httptest.Server
+
+	key *rsa.PrivateKey
+
+	m     sync.Mutex
+	user  *User
+	codes map[string]grant
+}
+
+// NewServer starts a provider. Call Close when finished.
+func NewServer() (*Server, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		key:   key,
+		codes: map[string]grant{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", s.handleDiscovery)
+	mux.HandleFunc("/jwks", s.handleJWKS)
+	mux.HandleFunc("/authorize", s.handleAuthorize)
+	mux.HandleFunc("/token", s.handleToken)
+	s.Server = httptest.NewServer(mux)
+	return s, nil
+}
+
+// SignIn sets the user that subsequent authorization requests will approve.
+// A nil user causes the provider to deny authorization.
+func (s *Server) SignIn(user *User) {
+	s.m.Lock()
+	s.user = user
+	s.m.Unlock()
+}
+
+// Provider returns a relying party configured to use this server.
+func (s *Server) Provider(redirectURL string) *oidc.Provider {
+	return oidc.NewProvider(oidc.Config{
+		Issuer:       s.URL,
+		ClientID:     ClientID,
+		ClientSecret: ClientSecret,
+		RedirectURL:  redirectURL,
+	})
+}
+
+// IDToken issues a signed ID token directly, for exercising token
+// verification.
+func (s *Server) IDToken(user User, audience, nonce string, expires time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": keyID})
+	if err != nil {
+		return "", err
+	}
+
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   s.URL,
+		"sub":   user.Subject,
+		"aud":   audience,
+		"exp":   expires.Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": nonce,
+		"email": user.Email,
+		"name":  user.Name,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func (s *Server) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"issuer":                 s.URL,
+		"authorization_endpoint": s.URL + "/authorize",
+		"token_endpoint":         s.URL + "/token",
+		"jwks_uri":               s.URL + "/jwks",
+	})
+}
+
+func (s *Server) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	pub := s.key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA",
+				"kid": keyID,
+				"use": "sig",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			},
+		},
+	})
+}
+
+func (s *Server) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != ClientID || q.Get("response_type") != "code" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || redirect.Host == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	params := redirect.Query()
+	params.Set("state", q.Get("state"))
+
+	s.m.Lock()
+	user := s.user
+	if user == nil {
+		params.Set("error", "access_denied")
+	} else {
+		code := randomString()
+		s.codes[code] = grant{
+			user:        *user,
+			nonce:       q.Get("nonce"),
+			redirectURI: redirect.String(),
+		}
+		params.Set("code", code)
+	}
+	s.m.Unlock()
+
+	redirect.RawQuery = params.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	tokenError := func(code string) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": code})
+	}
+
+	if r.Method != "POST" {
+		tokenError("invalid_request")
+		return
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok || clientID != ClientID || clientSecret != ClientSecret {
+		tokenError("invalid_client")
+		return
+	}
+
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError("invalid_request")
+		return
+	}
+
+	code := r.PostForm.Get("code")
+	s.m.Lock()
+	g, ok := s.codes[code]
+	delete(s.codes, code)
+	s.m.Unlock()
+
+	if !ok || g.redirectURI != r.PostForm.Get("redirect_uri") {
+		tokenError("invalid_grant")
+		return
+	}
+
+	idToken, err := s.IDToken(g.user, ClientID, g.nonce, time.Now().Add(time.Hour))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Printf("oidctest: write error: %s\n", err)
+	}
+}
+
+func randomString() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
@@ -3,9 +3,12 @@ package proto
 import (
 	"bytes"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"image"
 	"io"
@@ -28,6 +31,19 @@ const (
 	PasswordResetRequestLifetime = time.Hour
 )
 
+// An OTPPurpose distinguishes the one-time password keys an account may
+// enroll. Staff and login keys are kept apart, so that enrolling or disabling
+// one never affects the other.
+type OTPPurpose string
+
+const (
+	// OTPForStaff guards the use of staff capabilities.
+	OTPForStaff = OTPPurpose("staff")
+
+	// OTPForLogin is the account's own two-factor authentication.
+	OTPForLogin = OTPPurpose("login")
+)
+
 type OTP struct {
 	URI       string
 	Validated bool
@@ -52,12 +68,137 @@ func (o *OTP) Validate(password string) error {
 	return nil
 }
 
+const (
+	// OTPMaxFailedAttempts is the number of wrong passcodes in a row after
+	// which an OTP key refuses every passcode, correct or not, for
+	// OTPLockoutDuration.
+	OTPMaxFailedAttempts = 5
+	OTPLockoutDuration   = 15 * time.Minute
+)
+
+// OTPFailures counts consecutive wrong passcodes given for an OTP key, so
+// that guessing can be cut off.
+type OTPFailures struct {
+	Count int
+	Last  time.Time
+}
+
+// Locked returns true if the key should refuse all passcodes at the given time.
+func (f OTPFailures) Locked(now time.Time) bool {
+	return f.Count >= OTPMaxFailedAttempts && now.Before(f.Last.Add(OTPLockoutDuration))
+}
+
+// Fail returns the failures after another wrong passcode. Once a lockout
+// expires, counting starts over.
+func (f OTPFailures) Fail(now time.Time) OTPFailures {
+	if f.Count >= OTPMaxFailedAttempts {
+		return OTPFailures{Count: 1, Last: now}
+	}
+	return OTPFailures{Count: f.Count + 1, Last: now}
+}
+
+const OTPRecoveryCodeCount = 10
+
+// NewOTPRecoveryCodes generates a fresh set of recovery codes, each of which
+// may be used once in place of a one-time password.
+func NewOTPRecoveryCodes() ([]string, error) {
+	codes := make([]string, OTPRecoveryCodeCount)
+	buf := make([]byte, 5)
+	for i := range codes {
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		code := hex.EncodeToString(buf)
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
+
+// IsOTPRecoveryCode returns true if the given passcode has the form of a
+// recovery code rather than a one-time password, which is all digits.
+func IsOTPRecoveryCode(passcode string) bool {
+	return strings.ContainsRune(passcode, '-')
+}
+
+// RedeemOTPRecoveryCode looks for the given code in a set of recovery codes.
+// If found, the set is returned without it.
+func RedeemOTPRecoveryCode(codes []string, code string) ([]string, bool) {
+	code = strings.ToLower(strings.TrimSpace(code))
+	for i, c := range codes {
+		if subtle.ConstantTimeCompare([]byte(c), []byte(code)) == 1 {
+			remaining := make([]string, 0, len(codes)-1)
+			remaining = append(remaining, codes[:i]...)
+			return append(remaining, codes[i+1:]...), true
+		}
+	}
+	return codes, false
+}
+
+// OTPRecoveryCodes is a set of recovery codes encrypted under an account's
+// key-encrypting key, so they can only be read with the account's client key.
+type OTPRecoveryCodes struct {
+	IV             []byte
+	Digest         []byte
+	EncryptedCodes []byte
+}
+
+func EncryptOTPRecoveryCodes(
+	account Account, clientKey *security.ManagedKey, codes []string) (*OTPRecoveryCodes, error) {
+
+	kek := account.UserKey()
+	if err := kek.Decrypt(clientKey); err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, ClientKeyType.BlockSize())
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	plaintext, err := json.Marshal(codes)
+	if err != nil {
+		return nil, err
+	}
+
+	digest, ciphertext, err := security.EncryptGCM(&kek, iv, plaintext, []byte(account.ID().String()))
+	if err != nil {
+		return nil, err
+	}
+
+	rc := &OTPRecoveryCodes{
+		IV:             iv,
+		Digest:         digest,
+		EncryptedCodes: ciphertext,
+	}
+	return rc, nil
+}
+
+func (rc *OTPRecoveryCodes) Decrypt(account Account, clientKey *security.ManagedKey) ([]string, error) {
+	kek := account.UserKey()
+	if err := kek.Decrypt(clientKey); err != nil {
+		return nil, err
+	}
+
+	plaintext, err := security.DecryptGCM(
+		&kek, rc.IV, rc.Digest, rc.EncryptedCodes, []byte(account.ID().String()))
+	if err != nil {
+		return nil, err
+	}
+
+	var codes []string
+	if err := json.Unmarshal(plaintext, &codes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
 type AccountManager interface {
 	// GetAccount returns the account with the given ID.
 	Get(ctx scope.Context, id snowflake.Snowflake) (Account, error)
 
 	// RegisterAccount creates and returns a new, unverified account, along with
-	// its (unencrypted) client key.
+	// its (unencrypted) client key. If password is empty, the account has no
+	// password until one is set with ChangeClientKey.
 	Register(
 		ctx scope.Context, kms security.KMS, namespace, id, password string,
 		agentID string, agentKey *security.ManagedKey) (
@@ -75,10 +216,12 @@ type AccountManager interface {
 	// VerifyPersonalIdentity marks a personal identity as verified.
 	VerifyPersonalIdentity(ctx scope.Context, namespace, id string) error
 
-	// ChangeClientKey re-encrypts account keys with a new client key.
-	// The correct former client key must also be given.
+	// ChangeClientKey re-encrypts account keys with a new client key, which
+	// becomes the account's password. The correct former client key must also
+	// be given. The copies of the client key held for linked external
+	// identities are replaced too.
 	ChangeClientKey(
-		ctx scope.Context, accountID snowflake.Snowflake,
+		ctx scope.Context, kms security.KMS, accountID snowflake.Snowflake,
 		oldClientKey, newClientKey *security.ManagedKey) error
 
 	// RequestPasswordReset generates a temporary password-reset record.
@@ -102,16 +245,88 @@ type AccountManager interface {
 	// ChangeName changes an account's name.
 	ChangeName(ctx scope.Context, accountID snowflake.Snowflake, name string) error
 
-	// OTP unlocks and returns the user's enrolled OTP, or nil if one has never
-	// been generated.
-	OTP(ctx scope.Context, kms security.KMS, accountID snowflake.Snowflake) (*OTP, error)
+	// OTP unlocks and returns the user's enrolled OTP for the given purpose,
+	// or nil if one has never been generated.
+	OTP(ctx scope.Context, kms security.KMS, accountID snowflake.Snowflake, purpose OTPPurpose) (*OTP, error)
 
 	// GenerateOTP generates a new OTP secret for the user. If one has been generated
 	// before, then it is replaced if it was never validated, or an error is returned.
-	GenerateOTP(ctx scope.Context, heim *Heim, kms security.KMS, account Account) (*OTP, error)
+	GenerateOTP(
+		ctx scope.Context, heim *Heim, kms security.KMS, account Account, purpose OTPPurpose) (*OTP, error)
 
 	// ValidateOTP validates a one-time passcode according to the user's enrolled OTP.
-	ValidateOTP(ctx scope.Context, kms security.KMS, accountID snowflake.Snowflake, passcode string) error
+	// Wrong passcodes are counted, and after OTPMaxFailedAttempts of them in a
+	// row ErrOTPLocked is returned instead until the lockout expires.
+	ValidateOTP(
+		ctx scope.Context, kms security.KMS, accountID snowflake.Snowflake, purpose OTPPurpose,
+		passcode string) error
+
+	// DisableOTP removes the user's enrolled OTP for the given purpose. Disabling
+	// the login OTP also removes its recovery codes.
+	DisableOTP(ctx scope.Context, accountID snowflake.Snowflake, purpose OTPPurpose) error
+
+	// GenerateOTPRecoveryCodes replaces the recovery codes for the user's
+	// enrolled login OTP, returning the new codes. The client key must be
+	// unencrypted.
+	GenerateOTPRecoveryCodes(
+		ctx scope.Context, account Account, clientKey *security.ManagedKey) ([]string, error)
+
+	// UseOTPRecoveryCode consumes one of the user's recovery codes. If the code
+	// is not valid, ErrAccessDenied is returned. Wrong codes count against the
+	// login OTP the same as wrong passcodes given to ValidateOTP.
+	UseOTPRecoveryCode(ctx scope.Context, account Account, clientKey *security.ManagedKey, code string) error
+
+	// CreateAPIToken issues a new API token for the account, returning the
+	// token and the secret the bearer must present. The client key must be
+	// unencrypted.
+	CreateAPIToken(
+		ctx scope.Context, accountID snowflake.Snowflake, clientKey *security.ManagedKey,
+		name string, tokenScope APITokenScope, lifetime time.Duration) (*APIToken, string, error)
+
+	// APITokens returns the unexpired API tokens issued for the account.
+	APITokens(ctx scope.Context, accountID snowflake.Snowflake) ([]*APIToken, error)
+
+	// RevokeAPIToken deletes one of the account's API tokens.
+	RevokeAPIToken(ctx scope.Context, accountID, tokenID snowflake.Snowflake) error
+
+	// ResolveAPIToken verifies a token secret and returns the token, its account,
+	// and the account's unlocked client key.
+	ResolveAPIToken(ctx scope.Context, secret string) (
+		*APIToken, Account, *security.ManagedKey, error)
+
+	// LinkExternalIdentity attaches a personal identity verified by an outside
+	// party (such as an OpenID Connect provider) to the account, storing a copy
+	// of the account's client key that the server can recover on behalf of the
+	// identity. Linking an identity again refreshes its copy of the key.
+	LinkExternalIdentity(
+		ctx scope.Context, kms security.KMS, accountID snowflake.Snowflake, namespace, id string,
+		clientKey *security.ManagedKey) error
+
+	// UnlockExternalIdentity returns the account linked to an external identity,
+	// along with the account's client key.
+	UnlockExternalIdentity(ctx scope.Context, kms security.KMS, namespace, id string) (
+		Account, *security.ManagedKey, error)
+
+	// ExportData gathers the messages and private chats associated with the
+	// account, for an export request.
+	ExportData(ctx scope.Context, accountID snowflake.Snowflake) (*AccountData, error)
+
+	// RequestDeletion records that the account is to be deleted by the given
+	// job when it comes due. Only one request may be pending at a time.
+	RequestDeletion(ctx scope.Context, accountID, jobID snowflake.Snowflake, due time.Time) error
+
+	// DeletionRequest returns the account's pending deletion request, or
+	// ErrAccountDeletionNotRequested.
+	DeletionRequest(ctx scope.Context, accountID snowflake.Snowflake) (*AccountDeletionRequest, error)
+
+	// CancelDeletion withdraws the account's pending deletion request,
+	// returning it so that its job can be canceled.
+	CancelDeletion(ctx scope.Context, accountID snowflake.Snowflake) (*AccountDeletionRequest, error)
+
+	// Delete permanently erases the account. Messages it authored are kept
+	// but anonymized. Its personal identities, access grants, manager roles,
+	// private chats, emails, and keys are destroyed.
+	Delete(ctx scope.Context, accountID snowflake.Snowflake) error
 }
 
 type PersonalIdentity interface {
@@ -144,6 +359,7 @@ type Account interface {
 	KeyPair() security.ManagedKeyPair
 	Unlock(clientKey *security.ManagedKey) (*security.ManagedKeyPair, error)
 	IsStaff() bool
+	HasPassword() bool
 	UnlockStaffKMS(clientKey *security.ManagedKey) (security.KMS, error)
 	PersonalIdentities() []PersonalIdentity
 	UserKey() security.ManagedKey
@@ -164,13 +380,22 @@ type PersonalAccountView struct {
 }
 
 // NewAccountSecurity initializes the nonce and account secrets for a new account
-// with the given password. Returns an encrypted key-encrypting-key, encrypted
-// key-pair, nonce, and error.
+// with the given password. If the password is empty, a random one is used and
+// discarded. Returns an encrypted key-encrypting-key, encrypted key-pair,
+// nonce, and error.
 func NewAccountSecurity(
 	kms security.KMS, password string) (*AccountSecurity, *security.ManagedKey, error) {
 
 	kpType := security.Curve25519
 
+	if password == "" {
+		discarded, err := kms.GenerateNonce(discardedPasswordSize)
+		if err != nil {
+			return nil, nil, fmt.Errorf("rng error: %s", err)
+		}
+		password = base64.URLEncoding.EncodeToString(discarded)
+	}
+
 	// Use one KMS request to obtain all the randomness we need:
 	//   - nonce
 	//   - private key
@@ -241,6 +466,8 @@ func NewAccountSecurity(
 	return sec, clientKey, nil
 }
 
+const discardedPasswordSize = 32
+
 type AccountSecurity struct {
 	Nonce     []byte
 	MAC       []byte
@@ -406,3 +633,68 @@ func ParsePasswordResetConfirmation(confirmation string) (snowflake.Snowflake, [
 
 	return id, mac, nil
 }
+
+// An ExternalIdentityKey holds a copy of an account's client key on behalf of
+// an externally verified personal identity. The copy is encrypted with a
+// key-encrypting key that only the KMS can unlock.
+type ExternalIdentityKey struct {
+	AccountID snowflake.Snowflake
+	Namespace string
+	ID        string
+	SystemKey security.ManagedKey
+	ClientKey security.ManagedKey
+}
+
+func NewExternalIdentityKey(
+	kms security.KMS, accountID snowflake.Snowflake, namespace, id string,
+	clientKey *security.ManagedKey) (*ExternalIdentityKey, error) {
+
+	if clientKey.Encrypted() {
+		return nil, security.ErrKeyMustBeDecrypted
+	}
+
+	systemKey, err := kms.GenerateEncryptedKey(ClientKeyType, "identity", namespace+":"+id)
+	if err != nil {
+		return nil, fmt.Errorf("key generation error: %s", err)
+	}
+
+	kek := systemKey.Clone()
+	if err := kms.DecryptKey(&kek); err != nil {
+		return nil, fmt.Errorf("key decryption error: %s", err)
+	}
+
+	iv, err := kms.GenerateNonce(ClientKeyType.BlockSize())
+	if err != nil {
+		return nil, fmt.Errorf("rng error: %s", err)
+	}
+
+	encryptedClientKey := clientKey.Clone()
+	encryptedClientKey.IV = iv
+	if err := encryptedClientKey.Encrypt(&kek); err != nil {
+		return nil, fmt.Errorf("key encryption error: %s", err)
+	}
+
+	key := &ExternalIdentityKey{
+		AccountID: accountID,
+		Namespace: namespace,
+		ID:        id,
+		SystemKey: *systemKey,
+		ClientKey: encryptedClientKey,
+	}
+	return key, nil
+}
+
+// Unlock returns the decrypted client key. The key may be stale if the
+// account's password has changed since the identity was linked.
+func (k *ExternalIdentityKey) Unlock(kms security.KMS) (*security.ManagedKey, error) {
+	kek := k.SystemKey.Clone()
+	if err := kms.DecryptKey(&kek); err != nil {
+		return nil, fmt.Errorf("key decryption error: %s", err)
+	}
+
+	clientKey := k.ClientKey.Clone()
+	if err := clientKey.Decrypt(&kek); err != nil {
+		return nil, fmt.Errorf("key decryption error: %s", err)
+	}
+	return &clientKey, nil
+}
@@ -0,0 +1,271 @@
+package proto
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"euphoria.io/heim/proto/emails"
+	"euphoria.io/heim/proto/jobs"
+	"euphoria.io/heim/proto/logging"
+	"euphoria.io/heim/proto/snowflake"
+	"euphoria.io/scope"
+)
+
+const (
+	// An account isn't deleted until this long after deletion is requested,
+	// giving the owner a chance to change their mind.
+	AccountDeletionGracePeriod = 14 * 24 * time.Hour
+
+	// AccountDataExportLifetime is how long a signed export URL remains valid.
+	AccountDataExportLifetime = time.Hour
+
+	// DeletedUserID replaces the sender of messages authored by a deleted
+	// account.
+	DeletedUserID = UserID("deleted")
+)
+
+// An AccountDeletionRequest tracks an account awaiting deletion.
+type AccountDeletionRequest struct {
+	AccountID snowflake.Snowflake
+	JobID     snowflake.Snowflake
+	Requested time.Time
+	Due       time.Time
+}
+
+// AccountData is the data associated with an account beyond the account
+// itself, as gathered for an export request.
+type AccountData struct {
+	Messages []AuthoredMessage
+	PMs      []*PM
+	Emails   []*emails.EmailRef
+}
+
+// An AuthoredMessage is a message posted by an account, along with the room
+// it was posted in. Messages in private rooms are exported as stored, and
+// may be encrypted.
+type AuthoredMessage struct {
+	Room string `json:"room"`
+	Message
+}
+
+type exportedAccount struct {
+	PersonalAccountView
+	PersonalIdentities []exportedIdentity `json:"personal_identities"`
+}
+
+type exportedIdentity struct {
+	Namespace string `json:"namespace"`
+	ID        string `json:"id"`
+	Verified  bool   `json:"verified"`
+}
+
+type exportedPM struct {
+	ID            snowflake.Snowflake `json:"id"`
+	Initiator     UserID              `json:"initiator"`
+	InitiatorNick string              `json:"initiator_nick"`
+	Receiver      UserID              `json:"receiver"`
+	ReceiverNick  string              `json:"receiver_nick"`
+}
+
+type exportedEmail struct {
+	ID        string `json:"id"`
+	EmailType string `json:"email_type"`
+	SendTo    string `json:"send_to"`
+	SendFrom  string `json:"send_from"`
+	Created   Time   `json:"created"`
+	File      string `json:"file"`
+}
+
+// WriteAccountDataArchive gathers everything held about the account and
+// writes it to w as a zip archive.
+func WriteAccountDataArchive(ctx scope.Context, w io.Writer, b Backend, account Account) error {
+	data, err := b.AccountManager().ExportData(ctx, account.ID())
+	if err != nil {
+		return err
+	}
+
+	email, _ := account.Email()
+	acct := exportedAccount{
+		PersonalAccountView: PersonalAccountView{
+			AccountView: AccountView{ID: account.ID(), Name: account.Name()},
+			Email:       email,
+		},
+		PersonalIdentities: []exportedIdentity{},
+	}
+	for _, pid := range account.PersonalIdentities() {
+		acct.PersonalIdentities = append(acct.PersonalIdentities, exportedIdentity{
+			Namespace: pid.Namespace(),
+			ID:        pid.ID(),
+			Verified:  pid.Verified(),
+		})
+	}
+
+	pms := make([]exportedPM, len(data.PMs))
+	for i, pm := range data.PMs {
+		pms[i] = exportedPM{
+			ID:            pm.ID,
+			Initiator:     UserID(fmt.Sprintf("account:%s", pm.Initiator)),
+			InitiatorNick: pm.InitiatorNick,
+			Receiver:      pm.Receiver,
+			ReceiverNick:  pm.ReceiverNick,
+		}
+	}
+
+	messages := data.Messages
+	if messages == nil {
+		messages = []AuthoredMessage{}
+	}
+
+	zw := zip.NewWriter(w)
+
+	writeJSON := func(name string, v interface{}) error {
+		f, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		enc, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(enc)
+		return err
+	}
+
+	if err := writeJSON("account.json", acct); err != nil {
+		return err
+	}
+	if err := writeJSON("messages.json", messages); err != nil {
+		return err
+	}
+	if err := writeJSON("pms.json", pms); err != nil {
+		return err
+	}
+
+	index := make([]exportedEmail, len(data.Emails))
+	for i, ref := range data.Emails {
+		index[i] = exportedEmail{
+			ID:        ref.ID,
+			EmailType: ref.EmailType,
+			SendTo:    ref.SendTo,
+			SendFrom:  ref.SendFrom,
+			Created:   Time(ref.Created),
+			File:      fmt.Sprintf("emails/%04d.eml", i+1),
+		}
+		f, err := zw.Create(index[i].File)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(ref.Message); err != nil {
+			return err
+		}
+	}
+	if err := writeJSON("emails.json", index); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// ScheduleAccountDeletion queues the account for deletion once the grace
+// period has passed.
+func ScheduleAccountDeletion(ctx scope.Context, b Backend, accountID snowflake.Snowflake) (
+	*AccountDeletionRequest, error) {
+
+	am := b.AccountManager()
+	if _, err := am.DeletionRequest(ctx, accountID); err != ErrAccountDeletionNotRequested {
+		if err == nil {
+			return nil, ErrAccountDeletionRequested
+		}
+		return nil, err
+	}
+
+	jq, err := b.Jobs().GetQueue(ctx, jobs.AccountQueue)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &AccountDeletionRequest{
+		AccountID: accountID,
+		Requested: time.Now(),
+		Due:       time.Now().Add(AccountDeletionGracePeriod),
+	}
+	options := append([]jobs.JobOption{jobs.JobOptions.Due(req.Due)}, jobs.AccountDeletionJobOptions...)
+	req.JobID, err = jq.Add(ctx, jobs.AccountDeletionJobType, &jobs.AccountDeletionJob{AccountID: accountID}, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := am.RequestDeletion(ctx, accountID, req.JobID, req.Due); err != nil {
+		if cerr := jq.Cancel(ctx, req.JobID); cerr != nil {
+			logging.Logger(ctx).Printf("error canceling account deletion job %s: %s", req.JobID, cerr)
+		}
+		return nil, err
+	}
+
+	return req, nil
+}
+
+// CancelAccountDeletion withdraws a pending deletion request.
+func CancelAccountDeletion(ctx scope.Context, b Backend, accountID snowflake.Snowflake) error {
+	req, err := b.AccountManager().CancelDeletion(ctx, accountID)
+	if err != nil {
+		return err
+	}
+
+	jq, err := b.Jobs().GetQueue(ctx, jobs.AccountQueue)
+	if err != nil {
+		return err
+	}
+
+	// The deletion job won't act without a matching request, so failing to
+	// cancel it isn't fatal.
+	if err := jq.Cancel(ctx, req.JobID); err != nil && err != jobs.ErrJobNotFound {
+		logging.Logger(ctx).Printf("error canceling account deletion job %s: %s", req.JobID, err)
+	}
+	return nil
+}
+
+// ExecuteAccountDeletion deletes the account, provided the given job still
+// corresponds to its pending deletion request.
+func ExecuteAccountDeletion(ctx scope.Context, b Backend, accountID, jobID snowflake.Snowflake) error {
+	am := b.AccountManager()
+	req, err := am.DeletionRequest(ctx, accountID)
+	if err != nil {
+		if err == ErrAccountDeletionNotRequested || err == ErrAccountNotFound {
+			logging.Logger(ctx).Printf("account %s no longer awaiting deletion", accountID)
+			return nil
+		}
+		return err
+	}
+
+	if req.JobID != jobID {
+		logging.Logger(ctx).Printf(
+			"account %s deletion job %s superseded by %s", accountID, jobID, req.JobID)
+		return nil
+	}
+
+	if req.Due.After(time.Now()) {
+		return fmt.Errorf("account %s deletion not due until %s", accountID, req.Due)
+	}
+
+	logging.Logger(ctx).Printf("deleting account %s", accountID)
+	return DeleteAccount(ctx, b, accountID)
+}
+
+// DeleteAccount deletes the account immediately, then logs out and
+// disconnects any sessions still holding it in memory.
+func DeleteAccount(ctx scope.Context, b Backend, accountID snowflake.Snowflake) error {
+	if err := b.AccountManager().Delete(ctx, accountID); err != nil {
+		return err
+	}
+
+	userID := UserID(fmt.Sprintf("account:%s", accountID))
+	if err := b.NotifyUser(ctx, userID, LogoutEventType, LogoutEvent{}); err != nil {
+		return err
+	}
+	disconnect := &DisconnectEvent{Reason: "account deleted"}
+	return b.NotifyUser(ctx, userID, DisconnectEventType, disconnect)
+}
@@ -34,6 +34,41 @@ type AgentTracker interface {
 
 	// ClearClientKey logs the agent out.
 	ClearClientKey(ctx scope.Context, agentID string) error
+
+	// AccountAgents returns the agents logged into the given account, along
+	// with their most recent activity. The most recently seen agent is first.
+	AccountAgents(ctx scope.Context, accountID snowflake.Snowflake) ([]*AgentActivity, error)
+}
+
+// AgentActivity describes an agent logged into an account, as of its most
+// recent session.
+type AgentActivity struct {
+	AgentID   string
+	Created   time.Time
+	LastSeen  time.Time
+	IP        string
+	UserAgent string
+}
+
+func (a *AgentActivity) View() *AgentView {
+	return &AgentView{
+		AgentID:   a.AgentID,
+		Created:   Time(a.Created),
+		LastSeen:  Time(a.LastSeen),
+		UserAgent: a.UserAgent,
+		IP:        a.IP,
+	}
+}
+
+// AgentView describes an agent to the account it is logged into.
+type AgentView struct {
+	AgentID   string `json:"agent_id"`             // the id of the agent
+	Current   bool   `json:"current,omitempty"`    // true if this is the agent making the request
+	Created   Time   `json:"created"`              // when the agent was first seen
+	LastSeen  Time   `json:"last_seen"`            // when the agent last connected
+	UserAgent string `json:"user_agent,omitempty"` // the user agent reported by the agent's client when it last connected
+	IP        string `json:"ip,omitempty"`         // the address the agent last connected from
+	Location  string `json:"location,omitempty"`   // the approximate location of the address, if known
 }
 
 func NewAgent(agentID []byte, accessKey *security.ManagedKey) (*Agent, error) {
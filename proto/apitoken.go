@@ -0,0 +1,229 @@
+package proto
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/poly1305"
+
+	"euphoria.io/heim/proto/security"
+	"euphoria.io/heim/proto/snowflake"
+)
+
+const (
+	APITokenKeyType         = security.AES128
+	APITokenDefaultLifetime = 90 * 24 * time.Hour
+	APITokenMaxLifetime     = 365 * 24 * time.Hour
+)
+
+// APITokenScope limits the commands available to a session authenticated
+// with an API token.
+type APITokenScope string
+
+const (
+	APITokenReadOnly = APITokenScope("read-only")
+	APITokenSend     = APITokenScope("send")
+	APITokenManage   = APITokenScope("manage")
+)
+
+var (
+	apiTokenReadOnlyCommands = map[PacketType]bool{
+		PingType:       true,
+		PingReplyType:  true,
+		AuthType:       true,
+		GetMessageType: true,
+		LogType:        true,
+		WhoType:        true,
+	}
+
+	apiTokenSendCommands = map[PacketType]bool{
+		NickType:       true,
+		SendType:       true,
+		PMInitiateType: true,
+	}
+
+	apiTokenManageCommands = map[PacketType]bool{
+		BanType:           true,
+		UnbanType:         true,
+		EditMessageType:   true,
+		GrantAccessType:   true,
+		GrantManagerType:  true,
+		RevokeAccessType:  true,
+		RevokeManagerType: true,
+	}
+)
+
+func (s APITokenScope) Valid() bool {
+	switch s {
+	case APITokenReadOnly, APITokenSend, APITokenManage:
+		return true
+	default:
+		return false
+	}
+}
+
+// Allows returns true if a session holding a token of this scope may issue
+// the given command. Account and staff commands are never allowed.
+func (s APITokenScope) Allows(cmdType PacketType) bool {
+	switch s {
+	case APITokenManage:
+		if apiTokenManageCommands[cmdType] {
+			return true
+		}
+		fallthrough
+	case APITokenSend:
+		if apiTokenSendCommands[cmdType] {
+			return true
+		}
+		fallthrough
+	case APITokenReadOnly:
+		return apiTokenReadOnlyCommands[cmdType]
+	default:
+		return false
+	}
+}
+
+// An APIToken grants a headless client access to an account without the
+// account's password. The token's secret is never stored; it serves as the
+// key that unlocks a copy of the account's client key.
+type APIToken struct {
+	ID                 snowflake.Snowflake
+	AccountID          snowflake.Snowflake
+	Name               string
+	Scope              APITokenScope
+	IV                 []byte
+	MAC                []byte
+	EncryptedClientKey *security.ManagedKey
+	Created            time.Time
+	Expires            time.Time
+}
+
+// NewAPIToken generates a token for the given account, returning the token
+// and the secret string that must be presented to use it. The client key
+// must be unencrypted.
+func NewAPIToken(
+	accountID snowflake.Snowflake, clientKey *security.ManagedKey, name string, tokenScope APITokenScope,
+	lifetime time.Duration) (*APIToken, string, error) {
+
+	if clientKey.Encrypted() {
+		return nil, "", security.ErrKeyMustBeDecrypted
+	}
+
+	id, err := snowflake.New()
+	if err != nil {
+		return nil, "", err
+	}
+
+	tokenKey := &security.ManagedKey{
+		KeyType:   APITokenKeyType,
+		Plaintext: make([]byte, APITokenKeyType.KeySize()),
+	}
+	if _, err := rand.Read(tokenKey.Plaintext); err != nil {
+		return nil, "", err
+	}
+
+	iv := make([]byte, APITokenKeyType.BlockSize())
+	if _, err := rand.Read(iv); err != nil {
+		return nil, "", err
+	}
+
+	encryptedClientKey := clientKey.Clone()
+	encryptedClientKey.IV = iv
+	if err := encryptedClientKey.Encrypt(tokenKey); err != nil {
+		return nil, "", err
+	}
+
+	var (
+		mac [16]byte
+		key [32]byte
+	)
+	copy(key[:], tokenKey.Plaintext)
+	poly1305.Sum(&mac, iv, &key)
+
+	now := time.Now()
+	token := &APIToken{
+		ID:                 id,
+		AccountID:          accountID,
+		Name:               name,
+		Scope:              tokenScope,
+		IV:                 iv,
+		MAC:                mac[:],
+		EncryptedClientKey: &encryptedClientKey,
+		Created:            now,
+		Expires:            now.Add(lifetime),
+	}
+	secret := fmt.Sprintf("%s-%s", id, hex.EncodeToString(tokenKey.Plaintext))
+	return token, secret, nil
+}
+
+// ParseAPIToken splits a token secret into the token's ID and its key.
+func ParseAPIToken(secret string) (snowflake.Snowflake, *security.ManagedKey, error) {
+	var id snowflake.Snowflake
+
+	idx := strings.IndexRune(secret, '-')
+	if idx < 0 {
+		return id, nil, ErrAccessDenied
+	}
+
+	keyBytes, err := hex.DecodeString(secret[idx+1:])
+	if err != nil || len(keyBytes) != APITokenKeyType.KeySize() {
+		return id, nil, ErrAccessDenied
+	}
+
+	if err := id.FromString(secret[:idx]); err != nil {
+		return id, nil, ErrAccessDenied
+	}
+
+	key := &security.ManagedKey{
+		KeyType:   APITokenKeyType,
+		Plaintext: keyBytes,
+	}
+	return id, key, nil
+}
+
+func (t *APIToken) Expired() bool { return !time.Now().Before(t.Expires) }
+
+// Unlock verifies the token key and returns the account's client key.
+func (t *APIToken) Unlock(tokenKey *security.ManagedKey) (*security.ManagedKey, error) {
+	if tokenKey.Encrypted() {
+		return nil, security.ErrKeyMustBeDecrypted
+	}
+
+	var (
+		mac [16]byte
+		key [32]byte
+	)
+	copy(mac[:], t.MAC)
+	copy(key[:], tokenKey.Plaintext)
+	if !poly1305.Verify(&mac, t.IV, &key) {
+		return nil, ErrAccessDenied
+	}
+
+	clientKey := t.EncryptedClientKey.Clone()
+	if err := clientKey.Decrypt(tokenKey); err != nil {
+		return nil, err
+	}
+	return &clientKey, nil
+}
+
+func (t *APIToken) View() *APITokenView {
+	return &APITokenView{
+		ID:      t.ID,
+		Name:    t.Name,
+		Scope:   t.Scope,
+		Created: Time(t.Created),
+		Expires: Time(t.Expires),
+	}
+}
+
+// APITokenView describes an API token to the account that owns it.
+type APITokenView struct {
+	ID      snowflake.Snowflake `json:"id"`      // the id of the token
+	Name    string              `json:"name"`    // a label chosen by the token's creator
+	Scope   APITokenScope       `json:"scope"`   // the commands the token permits: `read-only`, `send`, or `manage`
+	Created Time                `json:"created"` // when the token was created
+	Expires Time                `json:"expires"` // when the token stops working
+}
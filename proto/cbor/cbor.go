@@ -0,0 +1,372 @@
+// Package cbor converts between JSON and CBOR (RFC 8949).
+//
+// Only the JSON data model is supported: maps with string keys, arrays,
+// strings, numbers, booleans, and null. This is enough to carry any value
+// with a JSON encoding in a more compact form, without maintaining a second
+// set of marshalers.
+package cbor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+const (
+	majorUint   = 0
+	majorNegInt = 1
+	majorBytes  = 2
+	majorText   = 3
+	majorArray  = 4
+	majorMap    = 5
+	majorTag    = 6
+	majorSimple = 7
+
+	simpleFalse     = 20
+	simpleTrue      = 21
+	simpleNull      = 22
+	simpleUndefined = 23
+
+	infoUint8      = 24
+	infoUint16     = 25
+	infoUint32     = 26
+	infoUint64     = 27
+	infoIndefinite = 31
+
+	breakCode = 0xff
+
+	// maxDepth bounds the nesting of decoded values.
+	maxDepth = 100
+)
+
+var (
+	ErrTruncated   = errors.New("cbor: unexpected end of data")
+	ErrTrailing    = errors.New("cbor: trailing data")
+	ErrTooDeep     = errors.New("cbor: nesting too deep")
+	ErrMapKey      = errors.New("cbor: map keys must be text strings")
+	ErrInvalidUTF8 = errors.New("cbor: invalid UTF-8 in text string")
+)
+
+// FromJSON converts a JSON document to CBOR.
+func FromJSON(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	if err := encode(buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ToJSON converts a CBOR data item to JSON.
+func ToJSON(data []byte) ([]byte, error) {
+	d := &decoder{data: data}
+	v, err := d.value(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, ErrTrailing
+	}
+	return json.Marshal(v)
+}
+
+func writeHead(buf *bytes.Buffer, major byte, n uint64) {
+	major <<= 5
+	switch {
+	case n < infoUint8:
+		buf.WriteByte(major | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(major | infoUint8)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(major | infoUint16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buf.WriteByte(major | infoUint32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(major | infoUint64)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+func encode(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(majorSimple<<5 | simpleNull)
+	case bool:
+		if v {
+			buf.WriteByte(majorSimple<<5 | simpleTrue)
+		} else {
+			buf.WriteByte(majorSimple<<5 | simpleFalse)
+		}
+	case json.Number:
+		return encodeNumber(buf, v)
+	case string:
+		writeHead(buf, majorText, uint64(len(v)))
+		buf.WriteString(v)
+	case []interface{}:
+		writeHead(buf, majorArray, uint64(len(v)))
+		for _, elem := range v {
+			if err := encode(buf, elem); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		writeHead(buf, majorMap, uint64(len(v)))
+		for _, key := range keys {
+			writeHead(buf, majorText, uint64(len(key)))
+			buf.WriteString(key)
+			if err := encode(buf, v[key]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("cbor: unsupported type %T", v)
+	}
+	return nil
+}
+
+func encodeNumber(buf *bytes.Buffer, n json.Number) error {
+	if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+		if i >= 0 {
+			writeHead(buf, majorUint, uint64(i))
+		} else {
+			writeHead(buf, majorNegInt, uint64(-1-i))
+		}
+		return nil
+	}
+	if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+		writeHead(buf, majorUint, u)
+		return nil
+	}
+	f, err := strconv.ParseFloat(string(n), 64)
+	if err != nil {
+		return err
+	}
+	buf.WriteByte(majorSimple<<5 | infoUint64)
+	return binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+}
+
+type decoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *decoder) next(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, ErrTruncated
+	}
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+// head reads the initial byte of a data item and its argument. For
+// indefinite lengths, indefinite is true and n is zero.
+func (d *decoder) head() (major byte, info byte, n uint64, err error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	major, info = b[0]>>5, b[0]&0x1f
+	switch {
+	case info < infoUint8:
+		return major, info, uint64(info), nil
+	case info <= infoUint64:
+		size := uint64(1) << (info - infoUint8)
+		arg, err := d.next(size)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		for _, c := range arg {
+			n = n<<8 | uint64(c)
+		}
+		return major, info, n, nil
+	case info == infoIndefinite:
+		return major, info, 0, nil
+	default:
+		return 0, 0, 0, fmt.Errorf("cbor: reserved additional information %d", info)
+	}
+}
+
+func (d *decoder) atBreak() bool {
+	if d.pos < len(d.data) && d.data[d.pos] == breakCode {
+		d.pos++
+		return true
+	}
+	return false
+}
+
+func (d *decoder) value(depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, ErrTooDeep
+	}
+
+	major, info, n, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	indefinite := info == infoIndefinite
+
+	switch major {
+	case majorUint:
+		if indefinite {
+			break
+		}
+		return n, nil
+
+	case majorNegInt:
+		if indefinite {
+			break
+		}
+		if n > math.MaxInt64 {
+			return -1 - float64(n), nil
+		}
+		return -1 - int64(n), nil
+
+	case majorBytes, majorText:
+		s, err := d.str(major, indefinite, n)
+		if err != nil {
+			return nil, err
+		}
+		if major == majorBytes {
+			// JSON has no byte strings; carry them as base64, as
+			// encoding/json does for []byte.
+			return []byte(s), nil
+		}
+		if !utf8.ValidString(s) {
+			return nil, ErrInvalidUTF8
+		}
+		return s, nil
+
+	case majorArray:
+		var arr []interface{}
+		if !indefinite && n < uint64(len(d.data)) {
+			arr = make([]interface{}, 0, n)
+		}
+		for i := uint64(0); indefinite || i < n; i++ {
+			if indefinite && d.atBreak() {
+				break
+			}
+			elem, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, elem)
+		}
+		if arr == nil {
+			arr = []interface{}{}
+		}
+		return arr, nil
+
+	case majorMap:
+		m := map[string]interface{}{}
+		for i := uint64(0); indefinite || i < n; i++ {
+			if indefinite && d.atBreak() {
+				break
+			}
+			key, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			s, ok := key.(string)
+			if !ok {
+				return nil, ErrMapKey
+			}
+			if m[s], err = d.value(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+
+	case majorTag:
+		// Tags only annotate the value that follows.
+		if indefinite {
+			break
+		}
+		return d.value(depth + 1)
+
+	case majorSimple:
+		switch info {
+		case simpleFalse:
+			return false, nil
+		case simpleTrue:
+			return true, nil
+		case simpleNull, simpleUndefined:
+			return nil, nil
+		case infoUint16:
+			return halfToFloat(uint16(n)), nil
+		case infoUint32:
+			return float64(math.Float32frombits(uint32(n))), nil
+		case infoUint64:
+			return math.Float64frombits(n), nil
+		}
+		return nil, fmt.Errorf("cbor: unsupported simple value %d", n)
+	}
+	return nil, fmt.Errorf("cbor: invalid indefinite length for major type %d", major)
+}
+
+// str reads the contents of a byte or text string, joining the chunks of an
+// indefinite-length string.
+func (d *decoder) str(major byte, indefinite bool, n uint64) (string, error) {
+	if !indefinite {
+		b, err := d.next(n)
+		return string(b), err
+	}
+
+	var buf bytes.Buffer
+	for !d.atBreak() {
+		chunkMajor, info, n, err := d.head()
+		if err != nil {
+			return "", err
+		}
+		if chunkMajor != major || info == infoIndefinite {
+			return "", fmt.Errorf("cbor: invalid chunk in indefinite-length string")
+		}
+		b, err := d.next(n)
+		if err != nil {
+			return "", err
+		}
+		buf.Write(b)
+	}
+	return buf.String(), nil
+}
+
+func halfToFloat(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 0x1f:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		return -f
+	}
+	return f
+}
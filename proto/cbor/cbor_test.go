@@ -0,0 +1,108 @@
+package cbor
+
+import (
+	"encoding/hex"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestCBOR(t *testing.T) {
+	// Examples from RFC 8949, appendix A.
+	examples := []struct {
+		json string
+		cbor string
+	}{
+		{`0`, "00"},
+		{`23`, "17"},
+		{`24`, "1818"},
+		{`1000`, "1903e8"},
+		{`1000000`, "1a000f4240"},
+		{`1000000000000`, "1b000000e8d4a51000"},
+		{`18446744073709551615`, "1bffffffffffffffff"},
+		{`-1`, "20"},
+		{`-1000`, "3903e7"},
+		{`1.1`, "fb3ff199999999999a"},
+		{`false`, "f4"},
+		{`true`, "f5"},
+		{`null`, "f6"},
+		{`""`, "60"},
+		{`"IETF"`, "6449455446"},
+		{`"ü"`, "62c3bc"},
+		{`[]`, "80"},
+		{`[1,[2,3],[4,5]]`, "8301820203820405"},
+		{`{}`, "a0"},
+		{`{"a":1,"b":[2,3]}`, "a26161016162820203"},
+	}
+
+	Convey("Encoding", t, func() {
+		for _, ex := range examples {
+			data, err := FromJSON([]byte(ex.json))
+			So(err, ShouldBeNil)
+			So(hex.EncodeToString(data), ShouldEqual, ex.cbor)
+		}
+	})
+
+	Convey("Decoding", t, func() {
+		for _, ex := range examples {
+			data, err := ToJSON(mustHex(ex.cbor))
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, ex.json)
+		}
+	})
+
+	Convey("Decoding other representations", t, func() {
+		decodes := map[string]string{
+			"f93e00":     `1.5`,
+			"fa47c35000": `100000`,
+			"f7":         `null`,
+			"c074323031332d30332d32315432303a30343a30305a": `"2013-03-21T20:04:00Z"`,
+			"7f657374726561646d696e67ff":                   `"streaming"`,
+			"9f018202039f0405ffff":                         `[1,[2,3],[4,5]]`,
+			"bf61610161629f0203ffff":                       `{"a":1,"b":[2,3]}`,
+			"4401020304":                                   `"AQIDBA=="`,
+		}
+		for in, out := range decodes {
+			data, err := ToJSON(mustHex(in))
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, out)
+		}
+	})
+
+	Convey("Malformed input is rejected", t, func() {
+		for _, in := range []string{
+			"",         // empty
+			"1a0000",   // truncated argument
+			"62c3",     // truncated string
+			"8301",     // truncated array
+			"a10102",   // integer map key
+			"0000",     // trailing data
+			"1c",       // reserved additional information
+			"62c328",   // invalid UTF-8
+			"9f01",     // unterminated indefinite array
+			"7f4161ff", // byte string chunk in a text string
+		} {
+			_, err := ToJSON(mustHex(in))
+			So(err, ShouldNotBeNil)
+		}
+
+		deep := make([]byte, maxDepth+2)
+		for i := range deep {
+			deep[i] = 0x81
+		}
+		_, err := ToJSON(deep)
+		So(err, ShouldEqual, ErrTooDeep)
+
+		// A huge declared length mustn't be trusted for allocation.
+		_, err = ToJSON(mustHex("9b7fffffffffffffff"))
+		So(err, ShouldEqual, ErrTruncated)
+	})
+}
@@ -23,6 +23,7 @@ type Client struct {
 	Agent         *Agent
 	Account       Account
 	Authorization Authorization
+	APIToken      *APIToken
 }
 
 func (c *Client) FromRequest(ctx scope.Context, r *http.Request) {
@@ -83,6 +84,23 @@ func (c *Client) AuthenticateWithAgent(ctx scope.Context, backend Backend, agent
 	return nil
 }
 
+func (c *Client) AuthenticateWithAPIToken(ctx scope.Context, backend Backend, secret string) error {
+	token, account, clientKey, err := backend.AccountManager().ResolveAPIToken(ctx, secret)
+	if err != nil {
+		return err
+	}
+
+	// Tokens issued before a password change hold a stale client key.
+	if _, err := account.Unlock(clientKey); err != nil {
+		return err
+	}
+
+	c.Account = account
+	c.Authorization.ClientKey = clientKey
+	c.APIToken = token
+	return nil
+}
+
 func (c *Client) RoomAuthorize(ctx scope.Context, room Room) error {
 	if c.Account == nil {
 		return nil
@@ -133,12 +151,13 @@ func (c *Client) RoomAuthorize(ctx scope.Context, room Room) error {
 			c.Authorization.ManagerKeyPair = managerKeyPair
 		}
 
-		// Look for message key grants to this account.
-		messageKey, err := managedRoom.MessageKey(ctx)
+		// Look for message key grants to this account, including grants of
+		// keys the room has since rotated away from.
+		messageKeys, err := managedRoom.MessageKeyHistory(ctx)
 		if err != nil {
 			return err
 		}
-		if messageKey != nil {
+		for i, messageKey := range messageKeys {
 			capability, err := messageKey.AccountCapability(ctx, c.Account)
 			if err != nil {
 				return fmt.Errorf("access capability error: %s", err)
@@ -156,7 +175,9 @@ func (c *Client) RoomAuthorize(ctx scope.Context, room Room) error {
 					return fmt.Errorf("access capability unmarshal error: %s", err)
 				}
 				c.Authorization.AddMessageKey(messageKey.KeyID(), roomKey)
-				c.Authorization.CurrentMessageKeyID = messageKey.KeyID()
+				if i == 0 {
+					c.Authorization.CurrentMessageKeyID = messageKey.KeyID()
+				}
 			}
 		}
 	}
@@ -164,36 +185,58 @@ func (c *Client) RoomAuthorize(ctx scope.Context, room Room) error {
 	return nil
 }
 
-func (c *Client) AuthenticateWithPasscode(ctx scope.Context, room ManagedRoom, passcode string) (string, error) {
-	mkey, err := room.MessageKey(ctx)
+func (c *Client) AuthenticateWithPasscode(
+	ctx scope.Context, kms security.KMS, room ManagedRoom, passcode string) (string, error) {
+
+	mkeys, err := room.MessageKeyHistory(ctx)
 	if err != nil {
 		return "", err
 	}
 
-	if mkey == nil {
+	if len(mkeys) == 0 {
 		return "", nil
 	}
 
-	capability, err := mkey.PasscodeCapability(ctx, passcode)
-	if err != nil {
-		return "", err
+	found := false
+	for _, mkey := range mkeys {
+		capability, err := mkey.PasscodeCapability(ctx, passcode)
+		if err != nil {
+			return "", err
+		}
+		if capability == nil {
+			continue
+		}
+
+		holderKey := security.KeyFromPasscode([]byte(passcode), mkey.Nonce(), security.AES128)
+		roomKey, err := decryptRoomKey(holderKey, capability)
+		if err != nil {
+			return "", err
+		}
+		c.Authorization.AddMessageKey(mkey.KeyID(), roomKey)
+		found = true
 	}
 
-	if capability == nil {
+	if !found {
 		return "passcode incorrect", nil
 	}
 
-	holderKey := security.KeyFromPasscode([]byte(passcode), mkey.Nonce(), security.AES128)
-	roomKey, err := decryptRoomKey(holderKey, capability)
-	if err != nil {
-		return "", err
+	// If the passcode was granted before the key was last rotated, and hasn't
+	// been revoked since, carry the grant forward to the current key.
+	current := mkeys[0]
+	if _, ok := c.Authorization.MessageKeys[current.KeyID()]; !ok {
+		if err := current.StaffGrantToPasscode(ctx, kms, passcode); err != nil {
+			return "", err
+		}
+		roomKey := current.ManagedKey()
+		if err := kms.DecryptKey(&roomKey); err != nil {
+			return "", err
+		}
+		c.Authorization.AddMessageKey(current.KeyID(), &roomKey)
 	}
 
 	// TODO: convert to account grant if signed in
-	// TODO: load and return all historic keys
 
-	c.Authorization.AddMessageKey(mkey.KeyID(), roomKey)
-	c.Authorization.CurrentMessageKeyID = mkey.KeyID()
+	c.Authorization.CurrentMessageKeyID = current.KeyID()
 	return "", nil
 }
 
@@ -0,0 +1,729 @@
+// Package client implements a client for the heim websocket protocol.
+//
+// A Client joins a single room, authenticating with a passcode and logging
+// into an account as configured, and stays joined until it's closed. Commands
+// are sent with Send, which waits for the matching reply. Events are
+// dispatched to handlers registered with Handle. Pings from the server are
+// answered automatically, and if the connection drops the client reconnects
+// and repeats the handshake, backing off between failed attempts.
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/snowflake"
+	"euphoria.io/scope"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	DefaultMinBackoff = time.Second
+	DefaultMaxBackoff = time.Minute
+)
+
+var (
+	ErrClosed       = errors.New("client closed")
+	ErrDisconnected = errors.New("disconnected before reply was received")
+)
+
+// A ServerError is returned by Send when the server replies to a command with
+// an error.
+type ServerError struct {
+	Type    proto.PacketType
+	Message string
+}
+
+func (e *ServerError) Error() string { return fmt.Sprintf("%s: %s", e.Type, e.Message) }
+
+// A BounceError is returned when the client is denied access to the room and
+// has no passcode to offer, or its passcode was rejected.
+type BounceError struct {
+	Reason string
+}
+
+func (e *BounceError) Error() string { return "bounced: " + e.Reason }
+
+// A LoginError is returned when the configured login is rejected.
+type LoginError struct {
+	Reason      string
+	OTPRequired bool
+}
+
+func (e *LoginError) Error() string { return "login failed: " + e.Reason }
+
+// Config describes the room a Client should join and how to join it.
+type Config struct {
+	// URL is the base URL of the heim server, such as https://euphoria.io.
+	URL string
+
+	// Room is the name of the room to join.
+	Room string
+
+	// Human marks the client's agent as a human rather than a bot.
+	Human bool
+
+	// Nick, if set, is requested after every successful join.
+	Nick string
+
+	// Passcode is used to authenticate if the room bounces the client.
+	Passcode string
+
+	// Login, if set, logs the client's agent into an account.
+	Login *proto.LoginCommand
+
+	// APIToken, if set, is presented in place of a logged-in agent.
+	APIToken string
+
+	// Features, if set, declares the events the client understands. The
+	// server withholds any other events, apart from those the handshake
+	// depends on. If nil, the server sends every event a client that
+	// predates feature declaration would receive.
+	Features []proto.PacketType
+
+	// MinBackoff and MaxBackoff bound the delay between reconnection
+	// attempts. They default to DefaultMinBackoff and DefaultMaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Dialer is used to open websockets. If nil, a copy of
+	// websocket.DefaultDialer is used.
+	Dialer *websocket.Dialer
+}
+
+func (cfg *Config) roomURL() (string, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	case "ws", "wss":
+	default:
+		return "", fmt.Errorf("unsupported url scheme: %s", u.Scheme)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/room/" + cfg.Room + "/ws"
+	query := url.Values{}
+	if cfg.Human {
+		query.Set("h", "1")
+	}
+	if cfg.Features != nil {
+		features := make([]string, len(cfg.Features))
+		for i, feature := range cfg.Features {
+			features[i] = string(feature)
+		}
+		query.Set("features", strings.Join(features, ","))
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// An EventHandler receives the decoded payload of an event, such as
+// *proto.SendEvent for a send-event.
+type EventHandler func(payload interface{})
+
+type event struct {
+	packetType proto.PacketType
+	payload    interface{}
+}
+
+// A Client maintains a session in a single room.
+type Client struct {
+	cfg    Config
+	dialer websocket.Dialer
+
+	m        sync.Mutex
+	ctx      scope.Context
+	conn     *conn
+	hello    *proto.HelloEvent
+	snapshot *proto.SnapshotEvent
+	handlers map[proto.PacketType][]EventHandler
+	nextID   uint64
+	closed   bool
+
+	// Events wait in an unbounded queue for dispatch, so that reading from
+	// the connection never waits on a handler. A handler may be waiting in
+	// Send for a reply that only the reader can deliver.
+	em     sync.Mutex
+	events []event
+	wake   chan struct{}
+}
+
+// New returns an unconnected Client. Register handlers before calling
+// Connect to be sure of receiving the first hello-event and snapshot-event.
+func New(cfg Config) (*Client, error) {
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = DefaultMinBackoff
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = DefaultMaxBackoff
+		if cfg.MaxBackoff < cfg.MinBackoff {
+			cfg.MaxBackoff = cfg.MinBackoff
+		}
+	}
+	if _, err := cfg.roomURL(); err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		cfg:      cfg,
+		handlers: map[proto.PacketType][]EventHandler{},
+		wake:     make(chan struct{}, 1),
+	}
+	if cfg.Dialer != nil {
+		c.dialer = *cfg.Dialer
+	} else {
+		c.dialer = *websocket.DefaultDialer
+	}
+	if c.dialer.Jar == nil {
+		// The agent cookie identifies the client across reconnects, which is
+		// what keeps it logged in.
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			return nil, err
+		}
+		c.dialer.Jar = jar
+	}
+	return c, nil
+}
+
+// Dial returns a Client that has joined the configured room.
+func Dial(ctx scope.Context, cfg Config) (*Client, error) {
+	c, err := New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Connect(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Handle registers a handler for events of the given type. Handlers are
+// called one at a time, in the order events arrive, on a goroutine of their
+// own; they may call Send.
+func (c *Client) Handle(eventType proto.PacketType, handler EventHandler) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.handlers[eventType] = append(c.handlers[eventType], handler)
+}
+
+// Connect joins the room and returns once the handshake is complete. From
+// then on the client reconnects whenever its connection is lost, until ctx
+// is cancelled or Close is called.
+func (c *Client) Connect(ctx scope.Context) error {
+	c.m.Lock()
+	if c.ctx != nil {
+		c.m.Unlock()
+		return fmt.Errorf("client already connected")
+	}
+	c.ctx = ctx.Fork()
+	ctx = c.ctx
+	c.m.Unlock()
+
+	go c.dispatch(ctx)
+
+	conn, err := c.connect(ctx)
+	if err != nil {
+		ctx.Terminate(err)
+		return err
+	}
+	go c.maintain(ctx, conn)
+	return nil
+}
+
+// Close disconnects the client and stops it from reconnecting.
+func (c *Client) Close() error {
+	c.m.Lock()
+	if c.closed {
+		c.m.Unlock()
+		return nil
+	}
+	c.closed = true
+	conn := c.conn
+	ctx := c.ctx
+	c.m.Unlock()
+
+	if ctx != nil {
+		ctx.Terminate(ErrClosed)
+	}
+	if conn != nil {
+		conn.close()
+	}
+	return nil
+}
+
+// Hello returns the hello-event received on the current connection.
+func (c *Client) Hello() *proto.HelloEvent {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.hello
+}
+
+// Snapshot returns the snapshot-event received on the current connection.
+func (c *Client) Snapshot() *proto.SnapshotEvent {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.snapshot
+}
+
+// Send sends a command and waits for its reply, returning the reply's
+// decoded payload. If the server replies with an error, Send returns a
+// *ServerError. If the connection is lost first, Send returns
+// ErrDisconnected; the command may or may not have been processed.
+func (c *Client) Send(ctx scope.Context, cmdType proto.PacketType, payload interface{}) (interface{}, error) {
+	c.m.Lock()
+	conn := c.conn
+	closed := c.closed
+	c.m.Unlock()
+
+	if closed {
+		return nil, ErrClosed
+	}
+	if conn == nil {
+		return nil, ErrDisconnected
+	}
+	return c.send(ctx, conn, cmdType, payload)
+}
+
+// Say sends a message to the room.
+func (c *Client) Say(ctx scope.Context, content string) (*proto.SendReply, error) {
+	return c.Reply(ctx, 0, content)
+}
+
+// Reply sends a message to the room as a child of the given message.
+func (c *Client) Reply(ctx scope.Context, parent snowflake.Snowflake, content string) (*proto.SendReply, error) {
+	reply, err := c.Send(ctx, proto.SendType, &proto.SendCommand{Content: content, Parent: parent})
+	if err != nil {
+		return nil, err
+	}
+	return reply.(*proto.SendReply), nil
+}
+
+// Nick changes the client's name in the room. The new name is also used
+// after reconnecting.
+func (c *Client) Nick(ctx scope.Context, name string) (*proto.NickReply, error) {
+	reply, err := c.Send(ctx, proto.NickType, &proto.NickCommand{Name: name})
+	if err != nil {
+		return nil, err
+	}
+	c.m.Lock()
+	c.cfg.Nick = name
+	c.m.Unlock()
+	return reply.(*proto.NickReply), nil
+}
+
+func (c *Client) send(
+	ctx scope.Context, conn *conn, cmdType proto.PacketType, payload interface{}) (interface{}, error) {
+
+	c.m.Lock()
+	c.nextID++
+	id := strconv.FormatUint(c.nextID, 10)
+	c.m.Unlock()
+
+	ch, err := conn.send(id, cmdType, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		conn.abandon(id)
+		return nil, ctx.Err()
+	case packet, ok := <-ch:
+		if !ok {
+			return nil, ErrDisconnected
+		}
+		if packet.Error != "" {
+			return nil, &ServerError{Type: packet.Type, Message: packet.Error}
+		}
+		return packet.Payload()
+	}
+}
+
+// connect opens a connection and carries out the handshake, making the
+// connection current once the room has been joined.
+func (c *Client) connect(ctx scope.Context) (*conn, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.handshake(ctx, conn); err != nil {
+		conn.close()
+		if err != errLoggedIn {
+			return nil, err
+		}
+
+		// The agent is now logged in, which takes effect on a new connection.
+		<-conn.done
+		if conn, err = c.dial(); err != nil {
+			return nil, err
+		}
+		if err := c.handshake(ctx, conn); err != nil {
+			conn.close()
+			if err == errLoggedIn {
+				err = fmt.Errorf("login did not take effect")
+			}
+			return nil, err
+		}
+	}
+
+	c.m.Lock()
+	if c.closed {
+		c.m.Unlock()
+		conn.close()
+		return nil, ErrClosed
+	}
+	c.conn = conn
+	c.m.Unlock()
+	return conn, nil
+}
+
+func (c *Client) dial() (*conn, error) {
+	roomURL, _ := c.cfg.roomURL()
+	headers := http.Header{}
+	if c.cfg.APIToken != "" {
+		headers.Set("Authorization", "Bearer "+c.cfg.APIToken)
+	}
+
+	ws, resp, err := c.dialer.Dial(roomURL, headers)
+	if err != nil {
+		if resp != nil && resp.StatusCode != http.StatusSwitchingProtocols {
+			return nil, fmt.Errorf("%s: %s", roomURL, resp.Status)
+		}
+		return nil, err
+	}
+
+	conn := newConn(ws)
+	go conn.read(c)
+	return conn, nil
+}
+
+var errLoggedIn = errors.New("logged in")
+
+func (c *Client) handshake(ctx scope.Context, conn *conn) error {
+	ctx = ctx.ForkWithTimeout(c.dialer.HandshakeTimeout + 30*time.Second)
+	defer ctx.Cancel()
+
+	var hello *proto.HelloEvent
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-conn.done:
+		return conn.err
+	case hello = <-conn.hello:
+	}
+
+	var snapshot *proto.SnapshotEvent
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-conn.done:
+		return conn.err
+	case snapshot = <-conn.joined:
+	case bounce := <-conn.bounced:
+		if c.cfg.Passcode == "" {
+			return &BounceError{Reason: bounce.Reason}
+		}
+		reply, err := c.send(ctx, conn, proto.AuthType, &proto.AuthCommand{
+			Type:     proto.AuthPasscode,
+			Passcode: c.cfg.Passcode,
+		})
+		if err != nil {
+			return err
+		}
+		if auth := reply.(*proto.AuthReply); !auth.Success {
+			return &BounceError{Reason: auth.Reason}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-conn.done:
+			return conn.err
+		case snapshot = <-conn.joined:
+		}
+	}
+
+	if c.cfg.Login != nil && hello.AccountView == nil {
+		reply, err := c.send(ctx, conn, proto.LoginType, c.cfg.Login)
+		if err != nil {
+			return err
+		}
+		login := reply.(*proto.LoginReply)
+		if !login.Success {
+			return &LoginError{Reason: login.Reason, OTPRequired: login.OTPRequired}
+		}
+		return errLoggedIn
+	}
+
+	c.m.Lock()
+	c.hello = hello
+	c.snapshot = snapshot
+	nick := c.cfg.Nick
+	c.m.Unlock()
+
+	if nick != "" && nick != snapshot.Nick {
+		if _, err := c.send(ctx, conn, proto.NickType, &proto.NickCommand{Name: nick}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maintain waits for the current connection to end and replaces it, backing
+// off exponentially while attempts fail.
+func (c *Client) maintain(ctx scope.Context, conn *conn) {
+	for {
+		select {
+		case <-ctx.Done():
+			conn.close()
+			return
+		case <-conn.done:
+		}
+
+		c.m.Lock()
+		if c.conn == conn {
+			c.conn = nil
+		}
+		c.m.Unlock()
+
+		// The server asks us to reconnect right away when our authentication
+		// changes; otherwise give it a moment.
+		backoff := c.cfg.MinBackoff
+		if conn.reconnectNow() {
+			backoff = 0
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+
+			next, err := c.connect(ctx)
+			if err == nil {
+				conn = next
+				break
+			}
+			if err == ErrClosed {
+				return
+			}
+
+			if backoff == 0 {
+				backoff = c.cfg.MinBackoff
+			} else if backoff *= 2; backoff > c.cfg.MaxBackoff {
+				backoff = c.cfg.MaxBackoff
+			}
+		}
+	}
+}
+
+func (c *Client) enqueue(packetType proto.PacketType, payload interface{}) {
+	c.em.Lock()
+	c.events = append(c.events, event{packetType: packetType, payload: payload})
+	c.em.Unlock()
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Client) dispatch(ctx scope.Context) {
+	for {
+		c.em.Lock()
+		if len(c.events) == 0 {
+			c.em.Unlock()
+			select {
+			case <-ctx.Done():
+				return
+			case <-c.wake:
+			}
+			continue
+		}
+		ev := c.events[0]
+		c.events[0] = event{}
+		c.events = c.events[1:]
+		c.em.Unlock()
+
+		c.m.Lock()
+		handlers := c.handlers[ev.packetType]
+		c.m.Unlock()
+		for _, handler := range handlers {
+			handler(ev.payload)
+		}
+	}
+}
+
+// A conn is a single websocket connection to the server. Its pending replies
+// are abandoned when it closes.
+type conn struct {
+	ws *websocket.Conn
+	wm sync.Mutex
+
+	m         sync.Mutex
+	pending   map[string]chan *proto.Packet
+	reconnect bool
+
+	hello   chan *proto.HelloEvent
+	joined  chan *proto.SnapshotEvent
+	bounced chan *proto.BounceEvent
+
+	done chan struct{}
+	err  error
+}
+
+func newConn(ws *websocket.Conn) *conn {
+	return &conn{
+		ws:      ws,
+		pending: map[string]chan *proto.Packet{},
+		hello:   make(chan *proto.HelloEvent, 1),
+		joined:  make(chan *proto.SnapshotEvent, 1),
+		bounced: make(chan *proto.BounceEvent, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+func (conn *conn) close() { conn.ws.Close() }
+
+func (conn *conn) reconnectNow() bool {
+	conn.m.Lock()
+	defer conn.m.Unlock()
+	return conn.reconnect
+}
+
+func (conn *conn) write(packet *proto.Packet) error {
+	data, err := packet.Encode()
+	if err != nil {
+		return err
+	}
+	conn.wm.Lock()
+	defer conn.wm.Unlock()
+	return conn.ws.WriteMessage(websocket.TextMessage, data)
+}
+
+func (conn *conn) send(id string, cmdType proto.PacketType, payload interface{}) (<-chan *proto.Packet, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan *proto.Packet, 1)
+	conn.m.Lock()
+	if conn.pending == nil {
+		conn.m.Unlock()
+		return nil, ErrDisconnected
+	}
+	conn.pending[id] = ch
+	conn.m.Unlock()
+
+	if err := conn.write(&proto.Packet{ID: id, Type: cmdType, Data: data}); err != nil {
+		conn.abandon(id)
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (conn *conn) abandon(id string) {
+	conn.m.Lock()
+	defer conn.m.Unlock()
+	delete(conn.pending, id)
+}
+
+func (conn *conn) reply(packet *proto.Packet) {
+	conn.m.Lock()
+	ch, ok := conn.pending[packet.ID]
+	delete(conn.pending, packet.ID)
+	conn.m.Unlock()
+	if ok {
+		ch <- packet
+	}
+}
+
+func (conn *conn) read(c *Client) {
+	defer func() {
+		conn.m.Lock()
+		for _, ch := range conn.pending {
+			close(ch)
+		}
+		conn.pending = nil
+		conn.m.Unlock()
+		conn.ws.Close()
+		close(conn.done)
+	}()
+
+	for {
+		_, data, err := conn.ws.ReadMessage()
+		if err != nil {
+			conn.err = err
+			return
+		}
+
+		packet, err := proto.ParseRequest(data)
+		if err != nil {
+			conn.err = err
+			return
+		}
+
+		if packet.ID != "" {
+			conn.reply(packet)
+			continue
+		}
+
+		payload, err := packet.Payload()
+		if err != nil {
+			// Tolerate event types this client doesn't know about.
+			continue
+		}
+
+		switch event := payload.(type) {
+		case *proto.PingEvent:
+			reply, err := proto.MakeResponse("", proto.PingType, &proto.PingReply{UnixTime: event.UnixTime}, false)
+			if err == nil {
+				err = conn.write(reply)
+			}
+			if err != nil {
+				conn.err = err
+				return
+			}
+		case *proto.HelloEvent:
+			select {
+			case conn.hello <- event:
+			default:
+			}
+		case *proto.SnapshotEvent:
+			select {
+			case conn.joined <- event:
+			default:
+			}
+		case *proto.BounceEvent:
+			select {
+			case conn.bounced <- event:
+			default:
+			}
+		case *proto.DisconnectEvent:
+			if event.Reason == "authentication changed" {
+				conn.m.Lock()
+				conn.reconnect = true
+				conn.m.Unlock()
+			}
+		}
+
+		c.enqueue(packet.Type, payload)
+	}
+}
@@ -0,0 +1,301 @@
+package client_test
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"euphoria.io/heim/backend"
+	"euphoria.io/heim/backend/mock"
+	"euphoria.io/heim/cluster"
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/client"
+	"euphoria.io/heim/proto/emails"
+	"euphoria.io/heim/proto/security"
+	"euphoria.io/scope"
+
+	"github.com/gorilla/websocket"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type testServer struct {
+	heim   *proto.Heim
+	server *httptest.Server
+}
+
+func newTestServer() *testServer {
+	heim := &proto.Heim{
+		Backend:        &mock.TestBackend{},
+		Cluster:        &cluster.TestCluster{},
+		Context:        scope.New(),
+		KMS:            security.LocalKMS(),
+		EmailDeliverer: &emails.TestDeliverer{},
+		SiteName:       "test",
+	}
+	heim.KMS.(security.MockKMS).SetMasterKey(make([]byte, security.AES256.KeySize()))
+
+	app, err := backend.NewServer(heim, "test1", "era1")
+	So(err, ShouldBeNil)
+	app.AllowRoomCreation(true)
+
+	return &testServer{heim: heim, server: httptest.NewServer(app)}
+}
+
+func (ts *testServer) Close() {
+	ts.server.CloseClientConnections()
+	ts.server.Close()
+	ts.heim.Backend.Close()
+}
+
+func (ts *testServer) config(room string) client.Config {
+	return client.Config{
+		URL:        ts.server.URL,
+		Room:       room,
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 100 * time.Millisecond,
+	}
+}
+
+func (ts *testServer) account(ctx scope.Context, id, password string) (proto.Account, *security.ManagedKey) {
+	agentKey := &security.ManagedKey{
+		KeyType:   proto.AgentKeyType,
+		Plaintext: make([]byte, proto.AgentKeyType.KeySize()),
+	}
+	agent, err := proto.NewAgent([]byte(id), agentKey)
+	So(err, ShouldBeNil)
+	So(ts.heim.Backend.AgentTracker().Register(ctx, agent), ShouldBeNil)
+
+	account, clientKey, err := ts.heim.Backend.AccountManager().Register(
+		ctx, ts.heim.KMS, "email", id, password, agent.IDString(), agentKey)
+	So(err, ShouldBeNil)
+	return account, clientKey
+}
+
+func receive(ch <-chan interface{}) interface{} {
+	select {
+	case payload := <-ch:
+		return payload
+	case <-time.After(5 * time.Second):
+		So("timed out waiting for event", ShouldEqual, "")
+		return nil
+	}
+}
+
+func collect(c *client.Client, eventType proto.PacketType) <-chan interface{} {
+	ch := make(chan interface{}, 10)
+	c.Handle(eventType, func(payload interface{}) { ch <- payload })
+	return ch
+}
+
+func TestClient(t *testing.T) {
+	save := security.TestMode
+	defer func() { security.TestMode = save }()
+	security.TestMode = true
+
+	Convey("Join, nick, and send", t, func() {
+		ts := newTestServer()
+		defer ts.Close()
+		ctx := scope.New()
+
+		cfg := ts.config("clienttest")
+		cfg.Nick = "alice"
+		alice, err := client.New(cfg)
+		So(err, ShouldBeNil)
+		snapshots := collect(alice, proto.SnapshotEventType)
+		joins := collect(alice, proto.JoinEventType)
+		messages := collect(alice, proto.SendEventType)
+		So(alice.Connect(ctx), ShouldBeNil)
+		defer alice.Close()
+
+		snapshot := receive(snapshots).(*proto.SnapshotEvent)
+		So(snapshot.SessionID, ShouldEqual, alice.Snapshot().SessionID)
+		So(alice.Hello().SessionView.SessionID, ShouldEqual, snapshot.SessionID)
+
+		cfg.Nick = "bob"
+		bob, err := client.Dial(ctx, cfg)
+		So(err, ShouldBeNil)
+		defer bob.Close()
+
+		So(bob.Snapshot().Listing, ShouldHaveLength, 1)
+		So(bob.Snapshot().Listing[0].Name, ShouldEqual, "alice")
+		So(receive(joins).(*proto.PresenceEvent).SessionID, ShouldEqual, bob.Snapshot().SessionID)
+
+		reply, err := bob.Say(ctx, "hi")
+		So(err, ShouldBeNil)
+		So(reply.Content, ShouldEqual, "hi")
+		So(reply.Sender.Name, ShouldEqual, "bob")
+
+		msg := receive(messages).(*proto.SendEvent)
+		So(msg.ID, ShouldEqual, reply.ID)
+		So(msg.Sender.Name, ShouldEqual, "bob")
+
+		child, err := alice.Reply(ctx, reply.ID, "hello")
+		So(err, ShouldBeNil)
+		So(child.Parent, ShouldEqual, reply.ID)
+
+		nick, err := bob.Nick(ctx, "robert")
+		So(err, ShouldBeNil)
+		So(nick.From, ShouldEqual, "bob")
+		So(nick.To, ShouldEqual, "robert")
+	})
+
+	Convey("Error replies", t, func() {
+		ts := newTestServer()
+		defer ts.Close()
+		ctx := scope.New()
+
+		c, err := client.Dial(ctx, ts.config("clienttest"))
+		So(err, ShouldBeNil)
+		defer c.Close()
+
+		_, err = c.Send(ctx, proto.GetMessageType, &proto.GetMessageCommand{ID: 1})
+		So(err, ShouldHaveSameTypeAs, &client.ServerError{})
+		So(err.(*client.ServerError).Type, ShouldEqual, proto.GetMessageReplyType)
+	})
+
+	Convey("Passcode authentication", t, func() {
+		ts := newTestServer()
+		defer ts.Close()
+		ctx := scope.New()
+
+		owner, ownerKey := ts.account(ctx, "client-owner", "ownerpass")
+		room, err := ts.heim.Backend.CreateRoom(ctx, ts.heim.KMS, true, "clientprivate", owner)
+		So(err, ShouldBeNil)
+		rkey, err := room.MessageKey(ctx)
+		So(err, ShouldBeNil)
+		So(rkey.GrantToPasscode(ctx, owner, ownerKey, "hunter2"), ShouldBeNil)
+
+		_, err = client.Dial(ctx, ts.config("clientprivate"))
+		So(err, ShouldResemble, &client.BounceError{Reason: "authentication required"})
+
+		cfg := ts.config("clientprivate")
+		cfg.Passcode = "dunno"
+		_, err = client.Dial(ctx, cfg)
+		So(err, ShouldHaveSameTypeAs, &client.BounceError{})
+
+		cfg.Passcode = "hunter2"
+		cfg.Nick = "alice"
+		c, err := client.Dial(ctx, cfg)
+		So(err, ShouldBeNil)
+		defer c.Close()
+		_, err = c.Say(ctx, "hi")
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Login", t, func() {
+		ts := newTestServer()
+		defer ts.Close()
+		ctx := scope.New()
+
+		account, _ := ts.account(ctx, "client-login", "loginpass")
+
+		cfg := ts.config("clienttest")
+		cfg.Login = &proto.LoginCommand{Namespace: "email", ID: "client-login", Password: "wrong"}
+		_, err := client.Dial(ctx, cfg)
+		So(err, ShouldResemble, &client.LoginError{Reason: proto.ErrAccessDenied.Error()})
+
+		cfg.Login.Password = "loginpass"
+		c, err := client.Dial(ctx, cfg)
+		So(err, ShouldBeNil)
+		defer c.Close()
+		So(c.Hello().AccountView, ShouldNotBeNil)
+		So(c.Hello().AccountView.ID, ShouldEqual, account.ID())
+		So(c.Snapshot().Identity, ShouldEqual, proto.UserID("account:"+account.ID().String()))
+	})
+
+	Convey("Handlers may send while events pile up", t, func() {
+		ts := newTestServer()
+		defer ts.Close()
+		ctx := scope.New()
+
+		cfg := ts.config("clienttest")
+		cfg.Nick = "alice"
+		alice, err := client.New(cfg)
+		So(err, ShouldBeNil)
+
+		// The first message's handler waits for many more to arrive, then
+		// sends. Its reply arrives behind all of them.
+		release := make(chan struct{})
+		sent := make(chan error, 1)
+		first := true
+		alice.Handle(proto.SendEventType, func(payload interface{}) {
+			if !first {
+				return
+			}
+			first = false
+			<-release
+			_, err := alice.Say(ctx, "reply")
+			sent <- err
+		})
+		So(alice.Connect(ctx), ShouldBeNil)
+		defer alice.Close()
+
+		// Spread the messages over enough senders that none is throttled.
+		cfg.Nick = "bob"
+		for i := 0; i < 25; i++ {
+			bob, err := client.Dial(ctx, cfg)
+			So(err, ShouldBeNil)
+			defer bob.Close()
+			for j := 0; j < 5; j++ {
+				_, err := bob.Say(ctx, "flood")
+				So(err, ShouldBeNil)
+			}
+		}
+		close(release)
+
+		select {
+		case err := <-sent:
+			So(err, ShouldBeNil)
+		case <-time.After(5 * time.Second):
+			So("timed out waiting for reply", ShouldEqual, "")
+		}
+	})
+
+	Convey("Reconnect", t, func() {
+		ts := newTestServer()
+		defer ts.Close()
+		ctx := scope.New()
+
+		// Keep hold of the client's connections so we can break them.
+		conns := make(chan net.Conn, 10)
+		dialer := *websocket.DefaultDialer
+		dialer.NetDial = func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if err == nil {
+				conns <- conn
+			}
+			return conn, err
+		}
+
+		cfg := ts.config("clienttest")
+		cfg.Nick = "alice"
+		cfg.Dialer = &dialer
+		c, err := client.New(cfg)
+		So(err, ShouldBeNil)
+		snapshots := collect(c, proto.SnapshotEventType)
+		So(c.Connect(ctx), ShouldBeNil)
+		defer c.Close()
+
+		first := receive(snapshots).(*proto.SnapshotEvent)
+		(<-conns).Close()
+		second := receive(snapshots).(*proto.SnapshotEvent)
+		So(second.SessionID, ShouldNotEqual, first.SessionID)
+
+		// The nick is restored on the new session.
+		for c.Snapshot().SessionID != second.SessionID {
+			time.Sleep(time.Millisecond)
+		}
+		reply, err := c.Say(ctx, "back")
+		for err == client.ErrDisconnected {
+			time.Sleep(time.Millisecond)
+			reply, err = c.Say(ctx, "back")
+		}
+		So(err, ShouldBeNil)
+		So(reply.Sender.Name, ShouldEqual, "alice")
+
+		So(c.Close(), ShouldBeNil)
+		_, err = c.Say(ctx, "gone")
+		So(err, ShouldEqual, client.ErrClosed)
+	})
+}
@@ -14,6 +14,7 @@ import (
 )
 
 const (
+	OTPChangedEmail            = "otp-changed"
 	PasswordChangedEmail       = "password-changed"
 	PasswordResetEmail         = "password-reset"
 	RoomInvitationEmail        = "room-invitation"
@@ -28,7 +29,23 @@ type EmailTracker interface {
 	MarkDelivered(ctx scope.Context, accountID snowflake.Snowflake, id string) error
 	Send(
 		ctx scope.Context, js jobs.JobService, templater *templates.Templater, deliverer emails.Deliverer,
-		account Account, to, templateName string, data interface{}) (*emails.EmailRef, error)
+		account Account, to, templateName string, data interface{}, options ...jobs.JobOption) (
+		*emails.EmailRef, error)
+}
+
+// EmailPriorities orders the delivery of emails that have been queued for
+// retry. Emails that someone is waiting on go first; anything not listed has
+// jobs.DefaultPriority.
+var EmailPriorities = map[string]int32{
+	PasswordResetEmail: jobs.HighPriority,
+	VerificationEmail:  jobs.HighPriority,
+	WelcomeEmail:       jobs.LowPriority,
+}
+
+// verificationEmailKey is the idempotency key for emails carrying a
+// verification token, so an address has at most one in flight.
+func verificationEmailKey(account Account, email string) string {
+	return fmt.Sprintf("verify:%s:%s", account.ID(), email)
 }
 
 type CommonEmailParams struct {
@@ -85,6 +102,19 @@ func (p PasswordChangedEmailParams) Subject() template.HTML {
 	return template.HTML(fmt.Sprintf("Your %s account password has been changed", p.SiteName))
 }
 
+type OTPChangedEmailParams struct {
+	CommonEmailParams
+	AccountName string
+	Enabled     bool
+}
+
+func (p OTPChangedEmailParams) Subject() template.HTML {
+	if p.Enabled {
+		return template.HTML(fmt.Sprintf("Two-factor authentication enabled for your %s account", p.SiteName))
+	}
+	return template.HTML(fmt.Sprintf("Two-factor authentication disabled for your %s account", p.SiteName))
+}
+
 type PasswordResetEmailParams struct {
 	CommonEmailParams
 	AccountName  string
@@ -169,6 +199,22 @@ var (
 			},
 		},
 
+		OTPChangedEmail: map[string]templates.TemplateTest{
+			"enabled": templates.TemplateTest{
+				Data: &OTPChangedEmailParams{
+					CommonEmailParams: DefaultCommonEmailParams,
+					AccountName:       "yourname",
+					Enabled:           true,
+				},
+			},
+			"disabled": templates.TemplateTest{
+				Data: &OTPChangedEmailParams{
+					CommonEmailParams: DefaultCommonEmailParams,
+					AccountName:       "yourname",
+				},
+			},
+		},
+
 		PasswordResetEmail: map[string]templates.TemplateTest{
 			"default": templates.TemplateTest{
 				Data: &PasswordResetEmailParams{
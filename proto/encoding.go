@@ -0,0 +1,86 @@
+package proto
+
+import (
+	"euphoria.io/heim/proto/cbor"
+)
+
+// A PacketEncoding is a wire format for packets. Every encoding carries the
+// same packet schema, and is selected by the websocket subprotocol the client
+// negotiates when it connects.
+type PacketEncoding interface {
+	// Subprotocol returns the websocket subprotocol that selects the
+	// encoding.
+	Subprotocol() string
+
+	// Binary returns true if packets are sent in binary websocket
+	// messages, rather than text messages.
+	Binary() bool
+
+	Encode(*Packet) ([]byte, error)
+	Decode([]byte) (*Packet, error)
+}
+
+var (
+	// JSONEncoding is the original encoding, and the default.
+	JSONEncoding PacketEncoding = jsonEncoding{}
+
+	// CBOREncoding encodes packets in CBOR (RFC 8949). This is more
+	// compact than JSON, particularly for log and snapshot payloads.
+	CBOREncoding PacketEncoding = cborEncoding{}
+
+	// packetEncodings lists the available encodings in order of the
+	// server's preference.
+	packetEncodings = []PacketEncoding{CBOREncoding, JSONEncoding}
+)
+
+// Subprotocols returns the websocket subprotocols that select a packet
+// encoding, in order of preference.
+func Subprotocols() []string {
+	subprotocols := make([]string, len(packetEncodings))
+	for i, enc := range packetEncodings {
+		subprotocols[i] = enc.Subprotocol()
+	}
+	return subprotocols
+}
+
+// EncodingForSubprotocol returns the packet encoding selected by the given
+// websocket subprotocol. Clients that don't negotiate a subprotocol get
+// JSONEncoding.
+func EncodingForSubprotocol(subprotocol string) PacketEncoding {
+	for _, enc := range packetEncodings {
+		if enc.Subprotocol() == subprotocol {
+			return enc
+		}
+	}
+	return JSONEncoding
+}
+
+type jsonEncoding struct{}
+
+func (jsonEncoding) Subprotocol() string                   { return "heim1" }
+func (jsonEncoding) Binary() bool                          { return false }
+func (jsonEncoding) Encode(packet *Packet) ([]byte, error) { return packet.Encode() }
+func (jsonEncoding) Decode(data []byte) (*Packet, error)   { return ParseRequest(data) }
+
+// cborEncoding transcodes the JSON encoding, so that payloads keep their
+// JSON marshalers and field names.
+type cborEncoding struct{}
+
+func (cborEncoding) Subprotocol() string { return "heim1+cbor" }
+func (cborEncoding) Binary() bool        { return true }
+
+func (cborEncoding) Encode(packet *Packet) ([]byte, error) {
+	data, err := packet.Encode()
+	if err != nil {
+		return nil, err
+	}
+	return cbor.FromJSON(data)
+}
+
+func (cborEncoding) Decode(data []byte) (*Packet, error) {
+	data, err := cbor.ToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRequest(data)
+}
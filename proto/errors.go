@@ -3,7 +3,10 @@ package proto
 import "fmt"
 
 var (
+	ErrAPITokenNotFound                = fmt.Errorf("api token not found")
 	ErrAccessDenied                    = fmt.Errorf("access denied")
+	ErrAccountDeletionNotRequested     = fmt.Errorf("account deletion not requested")
+	ErrAccountDeletionRequested        = fmt.Errorf("account deletion already requested")
 	ErrAccountIdentityInUse            = fmt.Errorf("account identity already in use")
 	ErrAccountNotFound                 = fmt.Errorf("account not found")
 	ErrAgentAlreadyExists              = fmt.Errorf("agent already exists")
@@ -20,10 +23,12 @@ var (
 	ErrInvalidVerificationToken        = fmt.Errorf("invalid verification token")
 	ErrLoggedIn                        = fmt.Errorf("logged in")
 	ErrOTPAlreadyEnrolled              = fmt.Errorf("otp already enrolled")
+	ErrOTPLocked                       = fmt.Errorf("too many failed one-time passwords, try again later")
 	ErrOTPNotEnrolled                  = fmt.Errorf("otp not enrolled")
 	ErrManagerNotFound                 = fmt.Errorf("manager not found")
 	ErrMessageNotFound                 = fmt.Errorf("message not found")
 	ErrMessageTooLong                  = fmt.Errorf("message too long")
+	ErrNoPassword                      = fmt.Errorf("account has no password, set one with change-password")
 	ErrNotLoggedIn                     = fmt.Errorf("not logged in")
 	ErrPMNotFound                      = fmt.Errorf("pm not found")
 	ErrPersonalIdentityAlreadyVerified = fmt.Errorf("personal identity already verified")
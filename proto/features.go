@@ -0,0 +1,76 @@
+package proto
+
+import (
+	"sort"
+	"strings"
+)
+
+// ProtocolVersion is advertised in the hello-event. It is incremented only
+// for incompatible changes; new packet types are announced as features.
+const ProtocolVersion = 1
+
+var (
+	// essentialEvents are sent to every client, since a session can't
+	// proceed without them.
+	essentialEvents = map[PacketType]bool{
+		BounceEventType:     true,
+		DisconnectEventType: true,
+		HelloEventType:      true,
+		PingEventType:       true,
+		SnapshotEventType:   true,
+	}
+
+	// optInEvents are withheld from clients that don't declare their
+	// features. Event types introduced from now on belong here, so that
+	// older clients never receive packets they don't understand.
+	optInEvents = map[PacketType]bool{}
+)
+
+// IsEvent returns true if the packet type names an event.
+func (c PacketType) IsEvent() bool { return strings.HasSuffix(string(c), "-event") }
+
+// IsReply returns true if the packet type names a reply.
+func (c PacketType) IsReply() bool { return strings.HasSuffix(string(c), "-reply") }
+
+// Features returns the commands and events supported by the server, in
+// sorted order. Support for a command implies support for its reply.
+func Features() []string {
+	features := make([]string, 0, len(payloadMap))
+	for packetType := range payloadMap {
+		if !packetType.IsReply() {
+			features = append(features, string(packetType))
+		}
+	}
+	sort.Strings(features)
+	return features
+}
+
+// A FeatureSet is the set of packet types a client has declared support for.
+// A nil FeatureSet describes a client that declared nothing.
+type FeatureSet map[PacketType]bool
+
+// ParseFeatures builds a FeatureSet from a client's declared features.
+// Features unknown to the server are ignored, so that newer clients can
+// connect to older servers.
+func ParseFeatures(features []string) FeatureSet {
+	fs := FeatureSet{}
+	for _, feature := range features {
+		packetType := PacketType(feature)
+		if _, ok := payloadMap[packetType]; ok && !packetType.IsReply() {
+			fs[packetType] = true
+		}
+	}
+	return fs
+}
+
+// Accepts returns true if a packet of the given type may be sent to the
+// client. Replies are always accepted, since the client asked for them.
+func (fs FeatureSet) Accepts(packetType PacketType) bool {
+	if !packetType.IsEvent() || essentialEvents[packetType] {
+		return true
+	}
+	if fs == nil {
+		return !optInEvents[packetType]
+	}
+	return fs[packetType]
+}
@@ -0,0 +1,39 @@
+package proto
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFeatures(t *testing.T) {
+	Convey("Features are derived from the packet types", t, func() {
+		features := Features()
+		So(features, ShouldContain, string(SendType))
+		So(features, ShouldContain, string(SendEventType))
+		So(features, ShouldNotContain, string(SendReplyType))
+		for i := 1; i < len(features); i++ {
+			So(features[i-1], ShouldBeLessThan, features[i])
+		}
+	})
+
+	Convey("Undeclared features accept everything but opt-in events", t, func() {
+		var fs FeatureSet
+		So(fs.Accepts(SendEventType), ShouldBeTrue)
+		So(fs.Accepts(NickReplyType), ShouldBeTrue)
+
+		optInEvents[PacketType("future-event")] = true
+		defer delete(optInEvents, PacketType("future-event"))
+		So(fs.Accepts(PacketType("future-event")), ShouldBeFalse)
+	})
+
+	Convey("Declared features limit events", t, func() {
+		fs := ParseFeatures([]string{"send-event", "send-reply", "future-event", ""})
+		So(fs, ShouldResemble, FeatureSet{SendEventType: true})
+		So(fs.Accepts(SendEventType), ShouldBeTrue)
+		So(fs.Accepts(NickEventType), ShouldBeFalse)
+		So(fs.Accepts(NickReplyType), ShouldBeTrue)
+		So(fs.Accepts(PingEventType), ShouldBeTrue)
+		So(fs.Accepts(SnapshotEventType), ShouldBeTrue)
+	})
+}
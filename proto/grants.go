@@ -30,6 +30,8 @@ type PasscodeGrantable interface {
 	GrantToPasscode(
 		ctx scope.Context, manager Account, managerClientKey *security.ManagedKey, passcode string) error
 
+	StaffGrantToPasscode(ctx scope.Context, kms security.KMS, passcode string) error
+
 	RevokeFromPasscode(ctx scope.Context, passcode string) error
 
 	PasscodeCapability(ctx scope.Context, passcode string) (*security.SharedSecretCapability, error)
@@ -202,6 +204,27 @@ func (gs *GrantManager) GrantToPasscode(
 	return gs.Capabilities.Save(ctx, nil, c)
 }
 
+func (gs *GrantManager) StaffGrantToPasscode(ctx scope.Context, kms security.KMS, passcode string) error {
+	var payloadKey security.ManagedKey
+	if gs.PayloadKey == nil {
+		payloadKey = gs.KeyEncryptingKey.Clone()
+	} else {
+		payloadKey = gs.PayloadKey.Clone()
+	}
+	if err := kms.DecryptKey(&payloadKey); err != nil {
+		return fmt.Errorf("payload-key decrypt error: %s", err)
+	}
+
+	c, err := security.GrantSharedSecretCapability(
+		security.KeyFromPasscode([]byte(passcode), gs.SubjectNonce, security.AES128),
+		gs.SubjectNonce, nil, payloadKey.Plaintext)
+	if err != nil {
+		return err
+	}
+
+	return gs.Capabilities.Save(ctx, nil, c)
+}
+
 func (gs *GrantManager) RevokeFromPasscode(ctx scope.Context, passcode string) error {
 	cid, err := security.SharedSecretCapabilityID(
 		security.KeyFromPasscode([]byte(passcode), gs.SubjectNonce, security.AES128),
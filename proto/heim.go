@@ -12,6 +12,7 @@ import (
 
 	"euphoria.io/heim/cluster"
 	"euphoria.io/heim/proto/emails"
+	"euphoria.io/heim/proto/jobs"
 	"euphoria.io/heim/proto/security"
 	"euphoria.io/heim/templates"
 	"euphoria.io/scope"
@@ -30,6 +31,17 @@ type Heim struct {
 	EmailTemplater *templates.Templater
 	GeoIP          *geoip2.Api
 	PageTemplater  *templates.Templater
+
+	// EmailParams, if set, supplies the common parameters of outgoing
+	// emails. Otherwise DefaultCommonEmailParams are used.
+	EmailParams func() CommonEmailParams
+}
+
+func (heim *Heim) commonEmailParams() CommonEmailParams {
+	if heim.EmailParams != nil {
+		return heim.EmailParams()
+	}
+	return DefaultCommonEmailParams
 }
 
 func (heim *Heim) MockDeliverer() emails.MockDeliverer {
@@ -37,7 +49,8 @@ func (heim *Heim) MockDeliverer() emails.MockDeliverer {
 }
 
 func (heim *Heim) SendEmail(
-	ctx scope.Context, b Backend, account Account, to, templateName string, data interface{}) (*emails.EmailRef, error) {
+	ctx scope.Context, b Backend, account Account, to, templateName string, data interface{},
+	options ...jobs.JobOption) (*emails.EmailRef, error) {
 
 	if to == "" {
 		for _, pid := range account.PersonalIdentities() {
@@ -52,7 +65,9 @@ func (heim *Heim) SendEmail(
 			}
 		}
 	}
-	return b.EmailTracker().Send(ctx, b.Jobs(), heim.EmailTemplater, heim.EmailDeliverer, account, to, templateName, data)
+	options = append([]jobs.JobOption{jobs.JobOptions.Priority(EmailPriorities[templateName])}, options...)
+	return b.EmailTracker().Send(
+		ctx, b.Jobs(), heim.EmailTemplater, heim.EmailDeliverer, account, to, templateName, data, options...)
 }
 
 func (heim *Heim) OnAccountEmailChanged(
@@ -73,12 +88,17 @@ func (heim *Heim) OnAccountEmailChanged(
 	}
 
 	params := &VerificationEmailParams{
-		CommonEmailParams: DefaultCommonEmailParams,
+		CommonEmailParams: heim.commonEmailParams(),
 		VerificationToken: hex.EncodeToString(token),
 	}
 	// Force delivery to the new address.
 	params.CommonEmailParams.AccountEmailAddress = email
-	if _, err := heim.SendEmail(ctx, b, account, email, VerificationEmail, params); err != nil {
+	key := jobs.JobOptions.IdempotencyKey(verificationEmailKey(account, email))
+	if _, err := heim.SendEmail(ctx, b, account, email, VerificationEmail, params, key); err != nil {
+		// A verification email is already on its way.
+		if err == jobs.ErrDuplicateJob {
+			return nil
+		}
 		return err
 	}
 
@@ -88,7 +108,7 @@ func (heim *Heim) OnAccountEmailChanged(
 func (heim *Heim) OnAccountPasswordChanged(ctx scope.Context, b Backend, account Account) error {
 	// TODO: account names
 	params := &PasswordChangedEmailParams{
-		CommonEmailParams: DefaultCommonEmailParams,
+		CommonEmailParams: heim.commonEmailParams(),
 		AccountName:       account.Name(),
 	}
 	if _, err := heim.SendEmail(ctx, b, account, "", PasswordChangedEmail, params); err != nil {
@@ -98,12 +118,25 @@ func (heim *Heim) OnAccountPasswordChanged(ctx scope.Context, b Backend, account
 	return nil
 }
 
+func (heim *Heim) OnAccountOTPChanged(ctx scope.Context, b Backend, account Account, enabled bool) error {
+	params := &OTPChangedEmailParams{
+		CommonEmailParams: heim.commonEmailParams(),
+		AccountName:       account.Name(),
+		Enabled:           enabled,
+	}
+	if _, err := heim.SendEmail(ctx, b, account, "", OTPChangedEmail, params); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func (heim *Heim) OnAccountPasswordResetRequest(
 	ctx scope.Context, b Backend, account Account, req *PasswordResetRequest) error {
 
 	// TODO: account names
 	params := &PasswordResetEmailParams{
-		CommonEmailParams: DefaultCommonEmailParams,
+		CommonEmailParams: heim.commonEmailParams(),
 		AccountName:       account.Name(),
 		Confirmation:      req.String(),
 	}
@@ -144,10 +177,15 @@ func (heim *Heim) OnAccountRegistration(
 		}
 
 		params := &WelcomeEmailParams{
-			CommonEmailParams: DefaultCommonEmailParams,
+			CommonEmailParams: heim.commonEmailParams(),
 			VerificationToken: hex.EncodeToString(token),
 		}
-		if _, err := heim.SendEmail(ctx, b, account, email, WelcomeEmail, params); err != nil {
+		key := jobs.JobOptions.IdempotencyKey(verificationEmailKey(account, email))
+		if _, err := heim.SendEmail(ctx, b, account, email, WelcomeEmail, params, key); err != nil {
+			// A welcome email is already on its way.
+			if err == jobs.ErrDuplicateJob {
+				return nil
+			}
 			return err
 		}
 	}
@@ -3,6 +3,8 @@ package jobs
 import "fmt"
 
 var (
+	ErrDuplicateJob          = fmt.Errorf("duplicate job")
+	ErrJobAlreadyScheduled   = fmt.Errorf("job already scheduled")
 	ErrInvalidJobType        = fmt.Errorf("invalid job type")
 	ErrJobCancelled          = fmt.Errorf("job cancelled")
 	ErrJobCanceled           = ErrJobCancelled
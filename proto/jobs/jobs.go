@@ -16,7 +16,15 @@ import (
 const (
 	DefaultMaxWorkDuration = time.Minute
 
-	EmailQueue = "emails"
+	// Among jobs that are due, those with higher priority are claimed first.
+	LowPriority     = -10
+	DefaultPriority = 0
+	HighPriority    = 10
+
+	AccountQueue   = "accounts"
+	EmailQueue     = "emails"
+	PresenceQueue  = "presence"
+	RetentionQueue = "retention"
 )
 
 type JobType string
@@ -30,16 +38,61 @@ var (
 		JobOptions.MaxWorkDuration(30 * time.Second),
 	}
 
-	jobPayloadMap = map[JobType]reflect.Type{
-		EmailJobType: reflect.TypeOf(EmailJob{}),
+	AccountDeletionJobType    = JobType("delete-account")
+	AccountDeletionJobOptions = []JobOption{
+		JobOptions.MaxAttempts(5),
+		JobOptions.MaxWorkDuration(5 * time.Minute),
 	}
+
+	// Scans are enqueued every tick, so a failed scan is retried only a few
+	// times before the next tick supersedes it.
+	PresenceScanJobType    = JobType("presence-scan")
+	PresenceScanJobOptions = []JobOption{
+		JobOptions.MaxAttempts(3),
+		JobOptions.MaxWorkDuration(time.Minute),
+	}
+
+	RetentionScanJobType    = JobType("retention-scan")
+	RetentionScanJobOptions = []JobOption{
+		JobOptions.MaxAttempts(3),
+		JobOptions.MaxWorkDuration(5 * time.Minute),
+	}
+
+	jobPayloadMap = map[JobType]reflect.Type{}
 )
 
+// RegisterJobType associates a job type with the type of its payload, which
+// is given by example (e.g. &EmailJob{}). Job types must be registered before
+// their jobs can be decoded by Job.Payload, usually in an init function of
+// the package defining the payload. Registering a type again replaces it.
+func RegisterJobType(name JobType, payloadType interface{}) {
+	t := reflect.TypeOf(payloadType)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	jobPayloadMap[name] = t
+}
+
+func init() {
+	RegisterJobType(AccountDeletionJobType, &AccountDeletionJob{})
+	RegisterJobType(EmailJobType, &EmailJob{})
+	RegisterJobType(PresenceScanJobType, &PresenceScanJob{})
+	RegisterJobType(RetentionScanJobType, &RetentionScanJob{})
+}
+
+type AccountDeletionJob struct {
+	AccountID snowflake.Snowflake
+}
+
 type EmailJob struct {
 	AccountID snowflake.Snowflake
 	EmailID   string
 }
 
+type PresenceScanJob struct{}
+
+type RetentionScanJob struct{}
+
 type JobService interface {
 	GetQueue(ctx scope.Context, name string) (JobQueue, error)
 }
@@ -51,11 +104,29 @@ type JobQueue interface {
 	// Add enqueues a new job, as defined by the given type/payload.
 	// If any callers waiting in WaitForJob (not just in the local
 	// process), at least one should be woken.
+	//
+	// If the job has an idempotency key, and a job with the same key is
+	// still pending or claimed in the queue, then no job is added and
+	// ErrDuplicateJob is returned along with the ID of the existing job.
+	// Callers that only need the job to exist may treat this as success.
 	Add(ctx scope.Context, jobType JobType, payload interface{}, options ...JobOption) (
 		snowflake.Snowflake, error)
 
+	// AddScheduled enqueues a new job for the given tick of the named
+	// recurring schedule. Only the first call for a tick enqueues a job,
+	// no matter how many processes make it. If a job has already been
+	// enqueued for this tick or a later one, returns ErrJobAlreadyScheduled.
+	//
+	// Completed jobs from earlier ticks of the schedule are discarded along
+	// with their logs, except for the most recently completed one.
+	AddScheduled(
+		ctx scope.Context, schedule string, tick time.Time, jobType JobType, payload interface{},
+		options ...JobOption) (snowflake.Snowflake, error)
+
 	// AddAndClaim enqueues a new job, atomically marking it as claimed by the
-	// caller. Returns the added and claimed job.
+	// caller. Returns the added and claimed job. As with Add, if a pending or
+	// claimed job has the same idempotency key, no job is added and
+	// ErrDuplicateJob is returned.
 	AddAndClaim(
 		ctx scope.Context, jobType JobType, payload interface{}, handlerID string, options ...JobOption) (*Job, error)
 
@@ -64,8 +135,9 @@ type JobQueue interface {
 	// immediately claimable.
 	WaitForJob(ctx scope.Context) error
 
-	// TryClaim tries to acquire a currently unclaimed job. If none is
-	// available, returns ErrJobNotFound.
+	// TryClaim tries to acquire a currently unclaimed job. Jobs that are
+	// due are claimed first, in order of priority and then due time. If none
+	// is available, returns ErrJobNotFound.
 	TryClaim(ctx scope.Context, handlerID string) (*Job, error)
 
 	// TrySteal attempts to preempt another handler's claim. Only jobs
@@ -102,6 +174,21 @@ type JobQueue interface {
 
 	// Log returns the output of a given job attempt.
 	Log(ctx scope.Context, jobID snowflake.Snowflake, attemptNumber int32) (*JobLog, error)
+
+	// ListFailed returns up to n dead jobs, oldest first. A job is dead once
+	// its final attempt has failed. Dead jobs are never claimed again unless
+	// retried.
+	ListFailed(ctx scope.Context, n int) ([]*Job, error)
+
+	// Retry returns a dead job to the queue, due immediately, with as many
+	// attempts remaining as it was originally given. Returns ErrJobNotFound
+	// if the job isn't dead, or ErrDuplicateJob if another pending job has
+	// taken over its idempotency key.
+	Retry(ctx scope.Context, jobID snowflake.Snowflake) error
+
+	// Purge permanently discards all dead jobs in the queue, along with
+	// their logs, and returns the number discarded.
+	Purge(ctx scope.Context) (int64, error)
 }
 
 type JobOption interface {
@@ -112,6 +199,7 @@ type JobMaxAttempts int32
 
 func (a JobMaxAttempts) Apply(job *Job) error {
 	job.AttemptsRemaining = int32(a)
+	job.MaxAttempts = int32(a)
 	return nil
 }
 
@@ -129,6 +217,20 @@ func (t JobDue) Apply(job *Job) error {
 	return nil
 }
 
+type JobPriority int32
+
+func (p JobPriority) Apply(job *Job) error {
+	job.Priority = int32(p)
+	return nil
+}
+
+type JobIdempotencyKey string
+
+func (k JobIdempotencyKey) Apply(job *Job) error {
+	job.IdempotencyKey = string(k)
+	return nil
+}
+
 type JobOptionConstructor struct{}
 
 func (JobOptionConstructor) MaxAttempts(n int32) JobMaxAttempts { return JobMaxAttempts(n) }
@@ -139,12 +241,19 @@ func (JobOptionConstructor) MaxWorkDuration(d time.Duration) JobMaxWorkDuration
 
 func (JobOptionConstructor) Due(t time.Time) JobDue { return JobDue(t) }
 
+func (JobOptionConstructor) Priority(n int32) JobPriority { return JobPriority(n) }
+
+func (JobOptionConstructor) IdempotencyKey(key string) JobIdempotencyKey {
+	return JobIdempotencyKey(key)
+}
+
 var JobOptions JobOptionConstructor
 
 type JobQueueStats struct {
 	Waiting int64 // number of jobs waiting to be claimed
 	Due     int64 // number of jobs that are due (whether claimed or waiting)
 	Claimed int64 // number of jobs currently claimed
+	Failed  int64 // number of dead jobs, with no attempts remaining
 }
 
 type Job struct {
@@ -156,6 +265,9 @@ type Job struct {
 	MaxWorkDuration   time.Duration
 	AttemptsMade      int32
 	AttemptsRemaining int32
+	MaxAttempts       int32 // the number of attempts the job was given, or 0 if unlimited
+	Priority          int32
+	IdempotencyKey    string
 
 	*JobClaim
 }
@@ -166,7 +278,7 @@ func (j *Job) Payload() (interface{}, error) {
 		return nil, fmt.Errorf("invalid job type: %s", j.Type)
 	}
 	payload := reflect.New(payloadType).Interface()
-	if payload != nil && payloadType.NumField() > 0 {
+	if payloadType.Kind() != reflect.Struct || payloadType.NumField() > 0 {
 		if err := json.Unmarshal(j.Data, payload); err != nil {
 			return nil, err
 		}
@@ -0,0 +1,34 @@
+package jobs
+
+import (
+	"encoding/json"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type testDigestJob struct {
+	Room string
+}
+
+func TestRegisterJobType(t *testing.T) {
+	Convey("Payloads of registered job types can be decoded", t, func() {
+		job := &Job{Type: JobType("test-digest"), Data: json.RawMessage(`{"Room":"test"}`)}
+		_, err := job.Payload()
+		So(err, ShouldNotBeNil)
+
+		RegisterJobType(job.Type, &testDigestJob{})
+		defer delete(jobPayloadMap, job.Type)
+
+		payload, err := job.Payload()
+		So(err, ShouldBeNil)
+		So(payload, ShouldResemble, &testDigestJob{Room: "test"})
+	})
+
+	Convey("Built-in job types are registered", t, func() {
+		job := &Job{Type: EmailJobType, Data: json.RawMessage(`{"EmailID":"x"}`)}
+		payload, err := job.Payload()
+		So(err, ShouldBeNil)
+		So(payload, ShouldResemble, &EmailJob{EmailID: "x"})
+	})
+}
@@ -0,0 +1,98 @@
+package jobs
+
+import (
+	"time"
+
+	"euphoria.io/heim/proto/logging"
+	"euphoria.io/scope"
+)
+
+// A RecurringJob describes a job to be enqueued on every tick of a schedule.
+type RecurringJob struct {
+	// Name identifies the recurring job within its queue. Every process
+	// scheduling the same job must use the same name.
+	Name     string
+	Queue    string
+	Schedule *Schedule
+	Type     JobType
+	Payload  interface{}
+	Options  []JobOption
+}
+
+// A Scheduler enqueues recurring jobs as their schedules come due. Any number
+// of schedulers across the cluster may run the same recurring jobs; the job
+// queue ensures that each tick is enqueued at most once. Schedules are
+// evaluated in UTC.
+type Scheduler struct {
+	js        JobService
+	recurring []*RecurringJob
+	next      []time.Time
+}
+
+func NewScheduler(js JobService, recurring ...*RecurringJob) *Scheduler {
+	return &Scheduler{
+		js:        js,
+		recurring: recurring,
+		next:      make([]time.Time, len(recurring)),
+	}
+}
+
+// Tick enqueues every recurring job with a tick due at or before now. On the
+// first call, the most recent tick is enqueued in case it came due while no
+// scheduler was running; ticks already enqueued elsewhere are skipped.
+func (s *Scheduler) Tick(ctx scope.Context, now time.Time) error {
+	now = now.UTC()
+	for i, rj := range s.recurring {
+		tick := s.next[i]
+		if tick.IsZero() {
+			tick = rj.Schedule.Prev(now)
+			if tick.IsZero() {
+				s.next[i] = rj.Schedule.Next(now)
+				continue
+			}
+		}
+		if now.Before(tick) {
+			continue
+		}
+
+		jq, err := s.js.GetQueue(ctx, rj.Queue)
+		if err != nil {
+			return err
+		}
+
+		options := append([]JobOption{JobOptions.Due(tick)}, rj.Options...)
+		jobID, err := jq.AddScheduled(ctx, rj.Name, tick, rj.Type, rj.Payload, options...)
+		switch err {
+		case nil:
+			logging.Logger(ctx).Printf("scheduled %s job %s for %s", rj.Name, jobID, tick)
+		case ErrJobAlreadyScheduled:
+		default:
+			return err
+		}
+
+		s.next[i] = rj.Schedule.Next(now)
+	}
+	return nil
+}
+
+// Run calls Tick every pollTime until the context is cancelled. Errors are
+// logged and retried on the next poll.
+func (s *Scheduler) Run(ctx scope.Context, pollTime time.Duration) error {
+	if err := s.Tick(ctx, time.Now()); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(pollTime)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-ticker.C:
+			if err := s.Tick(ctx, now); err != nil {
+				logging.Logger(ctx).Printf("scheduler error: %s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package jobs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Schedule is a parsed cron expression. It has five space-separated fields:
+//
+//	minute hour day-of-month month day-of-week
+//
+// Each field is *, a number, a range (a-b), or a list of these separated by
+// commas. Any of these may be followed by /n to step by n. Months and days of
+// the week are numeric (1-12 and 0-6, with 0 meaning Sunday). If both
+// day-of-month and day-of-week are restricted, a day matching either field
+// matches. The shorthands @hourly, @daily, @weekly, @monthly and @yearly are
+// also accepted.
+type Schedule struct {
+	spec   string
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	anyDOM bool
+	anyDOW bool
+}
+
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var (
+	cronFields = []cronField{
+		{"minute", 0, 59},
+		{"hour", 0, 23},
+		{"day-of-month", 1, 31},
+		{"month", 1, 12},
+		{"day-of-week", 0, 6},
+	}
+
+	cronShorthands = map[string]string{
+		"@yearly":   "0 0 1 1 *",
+		"@annually": "0 0 1 1 *",
+		"@monthly":  "0 0 1 * *",
+		"@weekly":   "0 0 * * 0",
+		"@daily":    "0 0 * * *",
+		"@midnight": "0 0 * * *",
+		"@hourly":   "0 * * * *",
+	}
+)
+
+// ParseSchedule parses a cron expression.
+func ParseSchedule(spec string) (*Schedule, error) {
+	expr := strings.TrimSpace(spec)
+	if full, ok := cronShorthands[expr]; ok {
+		expr = full
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("schedule %q: expected %d fields, got %d", spec, len(cronFields), len(fields))
+	}
+
+	bits := make([]uint64, len(fields))
+	for i, field := range fields {
+		b, err := cronFields[i].parse(field)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: %s", spec, err)
+		}
+		bits[i] = b
+	}
+
+	s := &Schedule{
+		spec:   spec,
+		minute: bits[0],
+		hour:   bits[1],
+		dom:    bits[2],
+		month:  bits[3],
+		dow:    bits[4],
+		anyDOM: fields[2] == "*",
+		anyDOW: fields[4] == "*",
+	}
+	return s, nil
+}
+
+// MustParseSchedule is like ParseSchedule but panics if the expression is
+// invalid. It's intended for schedules defined in code.
+func MustParseSchedule(spec string) *Schedule {
+	s, err := ParseSchedule(spec)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func (s *Schedule) String() string { return s.spec }
+
+// Next returns the first time after t that matches the schedule, in t's
+// location. Returns the zero time if nothing matches within five years
+// (e.g. "0 0 30 2 *").
+func (s *Schedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, loc).Add(time.Minute)
+	yearLimit := t.Year() + 5
+
+wrap:
+	if t.Year() > yearLimit {
+		return time.Time{}
+	}
+
+	for !has(s.month, int(t.Month())) {
+		t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		if t.Month() == time.January {
+			goto wrap
+		}
+	}
+
+	for !s.matchesDay(t) {
+		t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		if t.Day() == 1 {
+			goto wrap
+		}
+	}
+
+	for !has(s.hour, t.Hour()) {
+		t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		if t.Hour() == 0 {
+			goto wrap
+		}
+	}
+
+	for !has(s.minute, t.Minute()) {
+		t = t.Add(time.Minute)
+		if t.Minute() == 0 {
+			goto wrap
+		}
+	}
+
+	return t
+}
+
+// Prev returns the last time at or before t that matches the schedule, in t's
+// location. Returns the zero time if nothing matches within the preceding five
+// years.
+func (s *Schedule) Prev(t time.Time) time.Time {
+	loc := t.Location()
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, loc)
+	yearLimit := t.Year() - 5
+
+wrap:
+	if t.Year() < yearLimit {
+		return time.Time{}
+	}
+
+	for !has(s.month, int(t.Month())) {
+		t = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc).Add(-time.Minute)
+		if t.Month() == time.December {
+			goto wrap
+		}
+	}
+
+	for !s.matchesDay(t) {
+		month := t.Month()
+		t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc).Add(-time.Minute)
+		if t.Month() != month {
+			goto wrap
+		}
+	}
+
+	for !has(s.hour, t.Hour()) {
+		t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, loc).Add(-time.Minute)
+		if t.Hour() == 23 {
+			goto wrap
+		}
+	}
+
+	for !has(s.minute, t.Minute()) {
+		t = t.Add(-time.Minute)
+		if t.Minute() == 59 {
+			goto wrap
+		}
+	}
+
+	return t
+}
+
+func (s *Schedule) matchesDay(t time.Time) bool {
+	domMatch := has(s.dom, t.Day())
+	dowMatch := has(s.dow, int(t.Weekday()))
+	if s.anyDOM || s.anyDOW {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+func has(bits uint64, n int) bool { return bits&(1<<uint(n)) != 0 }
+
+func (f cronField) parse(expr string) (uint64, error) {
+	var bits uint64
+	for _, term := range strings.Split(expr, ",") {
+		lo, hi, step := f.min, f.max, 1
+
+		if i := strings.Index(term, "/"); i >= 0 {
+			n, err := strconv.Atoi(term[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step in %s field: %s", f.name, term)
+			}
+			step = n
+			term = term[:i]
+		}
+
+		switch {
+		case term == "*":
+		case strings.Contains(term, "-"):
+			parts := strings.SplitN(term, "-", 2)
+			var err error
+			if lo, err = f.value(parts[0]); err != nil {
+				return 0, err
+			}
+			if hi, err = f.value(parts[1]); err != nil {
+				return 0, err
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("invalid range in %s field: %s", f.name, term)
+			}
+		default:
+			n, err := f.value(term)
+			if err != nil {
+				return 0, err
+			}
+			lo = n
+			if step == 1 {
+				hi = n
+			}
+		}
+
+		for n := lo; n <= hi; n += step {
+			bits |= 1 << uint(n)
+		}
+	}
+	return bits, nil
+}
+
+func (f cronField) value(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < f.min || n > f.max {
+		return 0, fmt.Errorf("invalid value in %s field: %s", f.name, s)
+	}
+	return n, nil
+}
@@ -0,0 +1,88 @@
+package jobs
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSchedule(t *testing.T) {
+	at := func(s string) time.Time {
+		t, err := time.Parse("2006-01-02 15:04", s)
+		So(err, ShouldBeNil)
+		return t
+	}
+
+	next := func(spec, from string) string {
+		s, err := ParseSchedule(spec)
+		So(err, ShouldBeNil)
+		n := s.Next(at(from))
+		if n.IsZero() {
+			return ""
+		}
+		return n.Format("2006-01-02 15:04")
+	}
+
+	prev := func(spec, from string) string {
+		s, err := ParseSchedule(spec)
+		So(err, ShouldBeNil)
+		p := s.Prev(at(from))
+		if p.IsZero() {
+			return ""
+		}
+		return p.Format("2006-01-02 15:04")
+	}
+
+	Convey("Parsing", t, func() {
+		for _, spec := range []string{
+			"* * * * *", "*/5 * * * *", "0 0 1 1 *", "1,2,3-5 0-23/2 * * 1-5", "@hourly", "@daily"} {
+			_, err := ParseSchedule(spec)
+			So(err, ShouldBeNil)
+		}
+		for _, spec := range []string{
+			"", "* * * *", "* * * * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *",
+			"* * * * 7", "5-1 * * * *", "*/0 * * * *", "x * * * *", "@sometimes"} {
+			_, err := ParseSchedule(spec)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("Next", t, func() {
+		So(next("* * * * *", "2015-06-01 12:00"), ShouldEqual, "2015-06-01 12:01")
+		So(next("*/15 * * * *", "2015-06-01 12:07"), ShouldEqual, "2015-06-01 12:15")
+		So(next("*/15 * * * *", "2015-06-01 23:50"), ShouldEqual, "2015-06-02 00:00")
+		So(next("30 4 * * *", "2015-06-01 04:30"), ShouldEqual, "2015-06-02 04:30")
+		So(next("@monthly", "2015-12-15 00:00"), ShouldEqual, "2016-01-01 00:00")
+		So(next("0 0 29 2 *", "2015-03-01 00:00"), ShouldEqual, "2016-02-29 00:00")
+		So(next("0 0 30 2 *", "2015-03-01 00:00"), ShouldEqual, "")
+
+		// 2015-06-01 was a Monday.
+		So(next("0 9 * * 1-5", "2015-06-05 10:00"), ShouldEqual, "2015-06-08 09:00")
+
+		// Restricting both day fields matches either.
+		So(next("0 0 15 * 0", "2015-06-01 00:00"), ShouldEqual, "2015-06-07 00:00")
+		So(next("0 0 15 * 0", "2015-06-08 00:00"), ShouldEqual, "2015-06-14 00:00")
+		So(next("0 0 15 * 0", "2015-06-14 00:00"), ShouldEqual, "2015-06-15 00:00")
+	})
+
+	Convey("Prev", t, func() {
+		So(prev("* * * * *", "2015-06-01 12:00"), ShouldEqual, "2015-06-01 12:00")
+		So(prev("*/15 * * * *", "2015-06-01 12:07"), ShouldEqual, "2015-06-01 12:00")
+		So(prev("*/15 * * * *", "2015-06-02 00:10"), ShouldEqual, "2015-06-02 00:00")
+		So(prev("50 23 * * *", "2015-06-02 00:10"), ShouldEqual, "2015-06-01 23:50")
+		So(prev("30 4 * * *", "2015-06-01 04:29"), ShouldEqual, "2015-05-31 04:30")
+		So(prev("@monthly", "2016-01-15 00:00"), ShouldEqual, "2016-01-01 00:00")
+		So(prev("0 0 31 * *", "2015-07-15 00:00"), ShouldEqual, "2015-05-31 00:00")
+		So(prev("0 0 29 2 *", "2015-03-01 00:00"), ShouldEqual, "2012-02-29 00:00")
+		So(prev("0 0 30 2 *", "2015-03-01 00:00"), ShouldEqual, "")
+
+		// 2015-06-01 was a Monday.
+		So(prev("0 9 * * 1-5", "2015-06-08 08:00"), ShouldEqual, "2015-06-05 09:00")
+
+		// Restricting both day fields matches either.
+		So(prev("0 0 15 * 0", "2015-06-20 00:00"), ShouldEqual, "2015-06-15 00:00")
+		So(prev("0 0 15 * 0", "2015-06-15 00:00"), ShouldEqual, "2015-06-15 00:00")
+		So(prev("0 0 15 * 0", "2015-06-13 00:00"), ShouldEqual, "2015-06-07 00:00")
+	})
+}
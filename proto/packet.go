@@ -26,6 +26,9 @@ var (
 	SendEventType = SendType.Event()
 	SendReplyType = SendType.Reply()
 
+	CancelAccountDeletionType      = PacketType("cancel-account-deletion")
+	CancelAccountDeletionReplyType = CancelAccountDeletionType.Reply()
+
 	ChangeEmailType      = PacketType("change-email")
 	ChangeEmailReplyType = ChangeEmailType.Reply()
 
@@ -35,10 +38,25 @@ var (
 	ChangePasswordType      = PacketType("change-password")
 	ChangePasswordReplyType = ChangePasswordType.Reply()
 
+	CreateAPITokenType      = PacketType("create-api-token")
+	CreateAPITokenReplyType = CreateAPITokenType.Reply()
+
+	DeleteAccountType      = PacketType("delete-account")
+	DeleteAccountReplyType = DeleteAccountType.Reply()
+
+	DisableOTPType      = PacketType("disable-otp")
+	DisableOTPReplyType = DisableOTPType.Reply()
+
 	EditMessageType      = PacketType("edit-message")
 	EditMessageEventType = EditMessageType.Event()
 	EditMessageReplyType = EditMessageType.Reply()
 
+	EnrollOTPType      = PacketType("enroll-otp")
+	EnrollOTPReplyType = EnrollOTPType.Reply()
+
+	ExportAccountDataType      = PacketType("export-account-data")
+	ExportAccountDataReplyType = ExportAccountDataType.Reply()
+
 	GetMessageType      = PacketType("get-message")
 	GetMessageReplyType = GetMessageType.Reply()
 
@@ -53,6 +71,12 @@ var (
 	PartType      = PacketType("part")
 	PartEventType = PartType.Event()
 
+	ListAPITokensType      = PacketType("list-api-tokens")
+	ListAPITokensReplyType = ListAPITokensType.Reply()
+
+	ListSessionsType      = PacketType("list-sessions")
+	ListSessionsReplyType = ListSessionsType.Reply()
+
 	LogType      = PacketType("log")
 	LogReplyType = LogType.Reply()
 
@@ -85,12 +109,21 @@ var (
 	ResetPasswordType      = PacketType("reset-password")
 	ResetPasswordReplyType = ResetPasswordType.Reply()
 
+	RevokeAPITokenType      = PacketType("revoke-api-token")
+	RevokeAPITokenReplyType = RevokeAPITokenType.Reply()
+
+	RevokeAgentType      = PacketType("revoke-agent")
+	RevokeAgentReplyType = RevokeAgentType.Reply()
+
 	RevokeAccessType      = PacketType("revoke-access")
 	RevokeAccessReplyType = RevokeAccessType.Reply()
 
 	RevokeManagerType      = PacketType("revoke-manager")
 	RevokeManagerReplyType = RevokeManagerType.Reply()
 
+	RotateMessageKeyType      = PacketType("rotate-message-key")
+	RotateMessageKeyReplyType = RotateMessageKeyType.Reply()
+
 	StaffCreateRoomType      = PacketType("staff-create-room")
 	StaffCreateRoomReplyType = StaffCreateRoomType.Reply()
 
@@ -121,6 +154,9 @@ var (
 	UnlockStaffCapabilityType      = PacketType("unlock-staff-capability")
 	UnlockStaffCapabilityReplyType = UnlockStaffCapabilityType.Reply()
 
+	ValidateOTPType      = PacketType("validate-otp")
+	ValidateOTPReplyType = ValidateOTPType.Reply()
+
 	WhoType      = PacketType("who")
 	WhoReplyType = WhoType.Reply()
 
@@ -137,6 +173,9 @@ var (
 		SendReplyType: reflect.TypeOf(SendReply{}),
 		SendEventType: reflect.TypeOf(SendEvent{}),
 
+		CancelAccountDeletionType:      reflect.TypeOf(CancelAccountDeletionCommand{}),
+		CancelAccountDeletionReplyType: reflect.TypeOf(CancelAccountDeletionReply{}),
+
 		ChangeEmailType:      reflect.TypeOf(ChangeEmailCommand{}),
 		ChangeEmailReplyType: reflect.TypeOf(ChangeEmailReply{}),
 
@@ -146,10 +185,25 @@ var (
 		ChangePasswordType:      reflect.TypeOf(ChangePasswordCommand{}),
 		ChangePasswordReplyType: reflect.TypeOf(ChangePasswordReply{}),
 
+		CreateAPITokenType:      reflect.TypeOf(CreateAPITokenCommand{}),
+		CreateAPITokenReplyType: reflect.TypeOf(CreateAPITokenReply{}),
+
+		DeleteAccountType:      reflect.TypeOf(DeleteAccountCommand{}),
+		DeleteAccountReplyType: reflect.TypeOf(DeleteAccountReply{}),
+
+		DisableOTPType:      reflect.TypeOf(DisableOTPCommand{}),
+		DisableOTPReplyType: reflect.TypeOf(DisableOTPReply{}),
+
 		EditMessageType:      reflect.TypeOf(EditMessageCommand{}),
 		EditMessageEventType: reflect.TypeOf(EditMessageEvent{}),
 		EditMessageReplyType: reflect.TypeOf(EditMessageReply{}),
 
+		EnrollOTPType:      reflect.TypeOf(EnrollOTPCommand{}),
+		EnrollOTPReplyType: reflect.TypeOf(EnrollOTPReply{}),
+
+		ExportAccountDataType:      reflect.TypeOf(ExportAccountDataCommand{}),
+		ExportAccountDataReplyType: reflect.TypeOf(ExportAccountDataReply{}),
+
 		GetMessageType:      reflect.TypeOf(GetMessageCommand{}),
 		GetMessageReplyType: reflect.TypeOf(GetMessageReply{}),
 
@@ -159,6 +213,12 @@ var (
 		GrantManagerType:      reflect.TypeOf(GrantManagerCommand{}),
 		GrantManagerReplyType: reflect.TypeOf(GrantManagerReply{}),
 
+		ListAPITokensType:      reflect.TypeOf(ListAPITokensCommand{}),
+		ListAPITokensReplyType: reflect.TypeOf(ListAPITokensReply{}),
+
+		ListSessionsType:      reflect.TypeOf(ListSessionsCommand{}),
+		ListSessionsReplyType: reflect.TypeOf(ListSessionsReply{}),
+
 		LogType:      reflect.TypeOf(LogCommand{}),
 		LogReplyType: reflect.TypeOf(LogReply{}),
 
@@ -235,15 +295,27 @@ var (
 		ResetPasswordType:      reflect.TypeOf(ResetPasswordCommand{}),
 		ResetPasswordReplyType: reflect.TypeOf(ResetPasswordReply{}),
 
+		RevokeAPITokenType:      reflect.TypeOf(RevokeAPITokenCommand{}),
+		RevokeAPITokenReplyType: reflect.TypeOf(RevokeAPITokenReply{}),
+
+		RevokeAgentType:      reflect.TypeOf(RevokeAgentCommand{}),
+		RevokeAgentReplyType: reflect.TypeOf(RevokeAgentReply{}),
+
 		RevokeManagerType:      reflect.TypeOf(RevokeManagerCommand{}),
 		RevokeManagerReplyType: reflect.TypeOf(RevokeManagerReply{}),
 
 		RevokeAccessType:      reflect.TypeOf(RevokeAccessCommand{}),
 		RevokeAccessReplyType: reflect.TypeOf(RevokeAccessReply{}),
 
+		RotateMessageKeyType:      reflect.TypeOf(RotateMessageKeyCommand{}),
+		RotateMessageKeyReplyType: reflect.TypeOf(RotateMessageKeyReply{}),
+
 		UnlockStaffCapabilityType:      reflect.TypeOf(UnlockStaffCapabilityCommand{}),
 		UnlockStaffCapabilityReplyType: reflect.TypeOf(UnlockStaffCapabilityReply{}),
 
+		ValidateOTPType:      reflect.TypeOf(ValidateOTPCommand{}),
+		ValidateOTPReplyType: reflect.TypeOf(ValidateOTPReply{}),
+
 		WhoType:      reflect.TypeOf(WhoCommand{}),
 		WhoReplyType: reflect.TypeOf(WhoReply{}),
 	}
@@ -304,6 +376,14 @@ type EditMessageCommand struct {
 	Announce       bool                `json:"announce"`          // if true, broadcast an `edit-message-event` to the room
 }
 
+// The `cancel-account-deletion` command withdraws a pending `delete-account`
+// request for the signed in account.
+type CancelAccountDeletionCommand struct{}
+
+// `cancel-account-deletion-reply` confirms that the account will not be
+// deleted.
+type CancelAccountDeletionReply struct{}
+
 // The `change-email` command changes the primary email address associated with
 // the signed in account. The email address may need to be verified before the
 // change is fully applied.
@@ -331,14 +411,76 @@ type ChangeNameReply struct {
 }
 
 // The `change-password` command changes the password of the signed in account.
+// An account registered through an external sign-in has no password at first
+// (see `account_password_unset` in `hello-event`), and sets one with this
+// command, leaving `old_password` empty. Until then, commands that ask for the
+// account's password fail.
 type ChangePasswordCommand struct {
-	OldPassword string `json:"old_password"` // the current (and soon-to-be former) password
+	OldPassword string `json:"old_password"` // the current (and soon-to-be former) password, or empty if the account has none
 	NewPassword string `json:"new_password"` // the new password
 }
 
 // The `change-password-reply` packet returns the outcome of changing the password.
 type ChangePasswordReply struct{}
 
+// The `create-api-token` command issues a token that a headless client can
+// present in place of the account's password. The token is sent as a bearer
+// credential in the `Authorization` header of the websocket request, and the
+// resulting session is logged into the account.
+//
+// The scope of the token restricts which commands the session may issue:
+// `read-only` sessions may only read from the room, `send` sessions may also
+// set a nick and send messages, and `manage` sessions may also use room host
+// commands. Account and staff commands are never available to token sessions.
+//
+// Changing the account's password invalidates all of its tokens.
+type CreateAPITokenCommand struct {
+	Name     string        `json:"name"`               // a label to help identify the token later
+	Scope    APITokenScope `json:"scope"`              // `read-only`, `send`, or `manage`
+	Lifetime int           `json:"lifetime,omitempty"` // the number of seconds until the token expires (defaults to 90 days, up to 365 days)
+}
+
+// `create-api-token-reply` returns the new token. The secret is returned only
+// once and cannot be recovered.
+type CreateAPITokenReply struct {
+	APITokenView
+	Token string `json:"token"` // the secret to present as a bearer credential
+}
+
+// The `delete-account` command schedules the signed in account for deletion.
+// The account remains usable until the deletion comes due, two weeks later,
+// and the request may be withdrawn before then with `cancel-account-deletion`.
+//
+// When the account is deleted, messages it posted are kept but attributed to
+// `deleted`, with its name and session details removed. Its email addresses
+// and other personal identities, room access grants, manager roles, private
+// chats, sent emails, and keys are destroyed. Any agents logged into the
+// account are logged out, and its live sessions receive a `logout-event`
+// followed by a `disconnect-event` with the reason `account deleted`.
+//
+// If two-factor authentication is enabled, `otp` must hold a one-time password
+// or an unused recovery code.
+type DeleteAccountCommand struct {
+	Password string `json:"password"`      // the account's password
+	OTP      string `json:"otp,omitempty"` // a one-time password or recovery code, if required
+}
+
+// `delete-account-reply` confirms that the account is scheduled for deletion.
+type DeleteAccountReply struct {
+	Due Time `json:"due"` // when the account will be deleted
+}
+
+// The `disable-otp` command turns off two-factor authentication for the
+// signed in account. Both the account's password and a current one-time
+// password (or an unused recovery code) are required.
+type DisableOTPCommand struct {
+	Password string `json:"password"` // the account's password
+	OTP      string `json:"otp"`      // a one-time password or recovery code
+}
+
+// `disable-otp-reply` confirms that two-factor authentication was disabled.
+type DisableOTPReply struct{}
+
 // `edit-message-reply` returns the id of a successful edit.
 type EditMessageReply struct {
 	EditID snowflake.Snowflake `json:"edit_id"` // the unique id of the edit that was applied
@@ -356,6 +498,34 @@ type EditMessageEvent struct {
 	Message
 }
 
+// The `enroll-otp` command generates a new OTP key for the signed in account.
+// Two-factor authentication is not enabled until the key is confirmed with a
+// successful `validate-otp` command. An error will be returned if the account
+// already has two-factor authentication enabled.
+type EnrollOTPCommand struct{}
+
+// `enroll-otp-reply` returns the OTP key in several forms that a user can
+// use to import into their personal authentication app.
+type EnrollOTPReply struct {
+	URI     string `json:"uri"`    // the otpauth URI for the generated key (https://github.com/google/google-authenticator/wiki/Key-Uri-Format)
+	QRImage string `json:"qr_uri"` // the data URI for a QR image encoding the otpauth URI
+}
+
+// The `export-account-data` command prepares a download of everything held
+// about the signed in account: its profile and personal identities, the
+// messages it has posted, its private chats, and the emails sent to it. The
+// reply carries a link to a zip archive, which may be fetched without a
+// session until it expires.
+type ExportAccountDataCommand struct {
+	Password string `json:"password"` // the account's password
+}
+
+// `export-account-data-reply` returns the link to the archive.
+type ExportAccountDataReply struct {
+	URL     string `json:"url"`     // the path of the archive, relative to the server
+	Expires Time   `json:"expires"` // when the link stops working
+}
+
 // The `grant-access` command may be used by an active manager in a private room
 // to create a new capability for access. Access may be granted to either a
 // passcode or an account.
@@ -414,6 +584,26 @@ type StaffInvadeReply struct{}
 // A `presence-event` describes a session joining into or parting from a room.
 type PresenceEvent SessionView
 
+// The `list-api-tokens` command returns the unexpired API tokens issued for
+// the signed in account.
+type ListAPITokensCommand struct{}
+
+// `list-api-tokens-reply` describes the account's API tokens. Token secrets are
+// not included.
+type ListAPITokensReply struct {
+	Tokens []APITokenView `json:"tokens"` // the account's API tokens
+}
+
+// The `list-sessions` command returns the agents (browsers or other devices)
+// currently logged into the signed in account.
+type ListSessionsCommand struct{}
+
+// `list-sessions-reply` describes each agent logged into the account, most
+// recently seen first.
+type ListSessionsReply struct {
+	Sessions []AgentView `json:"sessions"` // the agents logged into the account
+}
+
 // The `log` command requests messages from the room's message log. This can be used
 // to supplement the log provided by `snapshot-event` (for example, when scrolling
 // back further in history).
@@ -519,8 +709,8 @@ type BounceEvent struct {
 // A `disconnect-event` indicates that the session is being closed. The client
 // will subsequently be disconnected.
 //
-// If the disconnect reason is "authentication changed", the client should
-// immediately reconnect.
+// If the disconnect reason is "authentication changed" or "message key
+// rotated", the client should immediately reconnect.
 type DisconnectEvent struct {
 	Reason string `json:"reason"` // the reason for disconnection
 }
@@ -541,19 +731,23 @@ type HelloEvent struct {
 	SessionView          SessionView          `json:"session"`                          // details about the session
 	AccountHasAccess     bool                 `json:"account_has_access,omitempty"`     // if true, then the account has an explicit access grant to the current room
 	AccountEmailVerified bool                 `json:"account_email_verified,omitempty"` // whether the account's email address has been verified
+	AccountPasswordUnset bool                 `json:"account_password_unset,omitempty"` // if true, the account was registered through an external sign-in and has no password yet
 	RoomIsPrivate        bool                 `json:"room_is_private"`                  // if true, the session is connected to a private room
 	Version              string               `json:"version"`                          // the version of the code being run and served by the server
+	ProtocolVersion      int                  `json:"protocol_version"`                 // the version of the protocol spoken by the server
+	Features             []string             `json:"features"`                         // the commands and events supported by the server
 }
 
 // A `snapshot-event` indicates that a session has successfully joined a room.
 // It also offers a snapshot of the room's state and recent history.
 type SnapshotEvent struct {
-	Identity  UserID    `json:"identity"`       // the id of the agent or account logged into this session
-	SessionID string    `json:"session_id"`     // the globally unique id of this session
-	Version   string    `json:"version"`        // the server's version identifier
-	Listing   Listing   `json:"listing"`        // the list of all other sessions joined to the room (excluding this session)
-	Log       []Message `json:"log"`            // the most recent messages posted to the room (currently up to 100)
-	Nick      string    `json:"nick,omitempty"` // the acting nick of the session; if omitted, client set nick before speaking
+	Identity  UserID         `json:"identity"`         // the id of the agent or account logged into this session
+	SessionID string         `json:"session_id"`       // the globally unique id of this session
+	Version   string         `json:"version"`          // the server's version identifier
+	Listing   Listing        `json:"listing"`          // the list of all other sessions joined to the room (excluding this session), unless reduced by the client
+	Counts    *ListingCounts `json:"counts,omitempty"` // if the listing was reduced, a summary of the full listing
+	Log       []Message      `json:"log"`              // the most recent messages posted to the room (up to 100, unless reduced by the client)
+	Nick      string         `json:"nick,omitempty"`   // the acting nick of the session; if omitted, client set nick before speaking
 
 	PMWithNick   string `json:"pm_with_nick,omitempty"`    // if given, this room is for private chat with the given nick
 	PMWithUserID UserID `json:"pm_with_user_id,omitempty"` // if given, this room is for private chat with the given user
@@ -577,10 +771,14 @@ type NetworkEvent struct {
 // If the login succeeds, the client should expect to receive a
 // `disconnect-event` shortly after. The next connection the client makes
 // will be a logged in session.
+//
+// If the account has two-factor authentication enabled, a login attempt
+// without a valid `otp` fails with `otp_required` set in the reply.
 type LoginCommand struct {
-	Namespace string `json:"namespace"` // the namespace of a personal identifier
-	ID        string `json:"id"`        // the id of a personal identifier
-	Password  string `json:"password"`  // the password for unlocking the account
+	Namespace string `json:"namespace"`     // the namespace of a personal identifier
+	ID        string `json:"id"`            // the id of a personal identifier
+	Password  string `json:"password"`      // the password for unlocking the account
+	OTP       string `json:"otp,omitempty"` // a one-time password or recovery code, if the account has two-factor authentication enabled
 }
 
 // The `login-reply` packet returns whether the session successfully logged
@@ -590,9 +788,10 @@ type LoginCommand struct {
 // `disconnect-event` shortly after. The next connection the client makes
 // will be a logged in session.
 type LoginReply struct {
-	Success   bool                `json:"success"`              // true if the session is now logged in
-	Reason    string              `json:"reason,omitempty"`     // if `success` was false, the reason why
-	AccountID snowflake.Snowflake `json:"account_id,omitempty"` // if `success` was true, the id of the account the session logged into.
+	Success     bool                `json:"success"`                // true if the session is now logged in
+	Reason      string              `json:"reason,omitempty"`       // if `success` was false, the reason why
+	AccountID   snowflake.Snowflake `json:"account_id,omitempty"`   // if `success` was true, the id of the account the session logged into.
+	OTPRequired bool                `json:"otp_required,omitempty"` // if true, the login must be retried with a one-time password
 }
 
 // The `login-event` packet is sent to all sessions of an agent when that
@@ -674,8 +873,30 @@ type ResetPasswordCommand struct {
 // `reset-password-reply` confirms that the password reset is in progress.
 type ResetPasswordReply struct{}
 
+// The `revoke-api-token` command permanently disables one of the signed in
+// account's API tokens. Sessions already authenticated with the token are not
+// disconnected.
+type RevokeAPITokenCommand struct {
+	ID snowflake.Snowflake `json:"id"` // the id of the token to revoke
+}
+
+// `revoke-api-token-reply` confirms that the token was revoked.
+type RevokeAPITokenReply struct{}
+
+// The `revoke-agent` command logs one of the agents listed by `list-sessions`
+// out of the account. Any of the agent's live sessions are sent a
+// `logout-event` and disconnected. To log out the current agent, use `logout`.
+type RevokeAgentCommand struct {
+	AgentID string `json:"agent_id"` // the id of the agent to log out
+}
+
+// `revoke-agent-reply` confirms that the agent was logged out.
+type RevokeAgentReply struct{}
+
 // The `revoke-access` command disables an access grant to a private room.
-// The grant may be to an account or to a passcode.
+// The grant may be to an account or to a passcode. A passcode is revoked from
+// every message key the room has had, so that it can't be carried forward
+// by a later `rotate-message-key`.
 //
 // TODO: all live sessions using the revoked grant should be disconnected
 // TODO: support revocation by capability_id, in case a manager doesn't know the passcode
@@ -687,6 +908,24 @@ type RevokeAccessCommand struct {
 // `revoke-access-reply` confirms that the access grant was revoked.
 type RevokeAccessReply struct{}
 
+// The `rotate-message-key` command may be used by an active manager in a
+// private room to replace the room's message key. Every account that holds
+// access to the room is granted the new key, and passcodes that haven't been
+// revoked are granted it the next time they're used. Anyone whose access was
+// revoked before the rotation can't obtain the new key, and so can't read
+// messages sent after it.
+//
+// Earlier keys remain available to those who held them, so that messages
+// sent before the rotation can still be read. Every other session in the
+// room receives a `disconnect-event` and must authenticate again to rejoin,
+// so none of them keeps sending with the old key.
+type RotateMessageKeyCommand struct{}
+
+// `rotate-message-key-reply` confirms that the message key was replaced.
+type RotateMessageKeyReply struct {
+	KeyID string `json:"key_id"` // the id of the new message key
+}
+
 // The `revoke-manager` command removes an account as manager of the room.
 // This command can be applied to oneself, so be careful not to orphan
 // your room!
@@ -768,6 +1007,21 @@ type UnlockStaffCapabilityReply struct {
 	FailureReason string `json:"failure_reason,omitempty"` // if `success` was false, the reason why
 }
 
+// The `validate-otp` command confirms the OTP key generated by `enroll-otp`,
+// enabling two-factor authentication for the account. Once enabled, `login`
+// requires a one-time password in addition to the account's password.
+type ValidateOTPCommand struct {
+	Password string `json:"password"` // a one-time password generated from the key
+}
+
+// `validate-otp-reply` indicates that the one-time password was accepted. When
+// two-factor authentication is newly enabled, the reply includes a set of
+// single-use recovery codes, which may be given in place of a one-time password
+// if the user loses their authentication app. They are returned only once.
+type ValidateOTPReply struct {
+	RecoveryCodes []string `json:"recovery_codes,omitempty"` // single-use recovery codes, if two-factor authentication was just enabled
+}
+
 // The `who` command requests a list of sessions currently joined in the room.
 type WhoCommand struct{}
 
@@ -37,3 +37,37 @@ func TestCommandPayload(t *testing.T) {
 		So(err, ShouldResemble, fmt.Errorf("invalid command type: unknown"))
 	})
 }
+
+func TestPacketEncodings(t *testing.T) {
+	Convey("Subprotocols select encodings", t, func() {
+		So(Subprotocols(), ShouldResemble, []string{"heim1+cbor", "heim1"})
+		So(EncodingForSubprotocol("heim1+cbor").Binary(), ShouldBeTrue)
+		So(EncodingForSubprotocol("heim1").Binary(), ShouldBeFalse)
+		So(EncodingForSubprotocol("").Subprotocol(), ShouldEqual, "heim1")
+	})
+
+	Convey("Packets survive a round trip", t, func() {
+		event := &SnapshotEvent{
+			Identity:  "agent:abc",
+			SessionID: "abc-00000001",
+			Version:   "v1",
+			Listing:   Listing{},
+			Log:       []Message{{Content: "hello", Sender: SessionView{SessionID: "abc-00000001"}}},
+		}
+		packet, err := MakeEvent(event)
+		So(err, ShouldBeNil)
+		jsonData, err := JSONEncoding.Encode(packet)
+		So(err, ShouldBeNil)
+
+		data, err := CBOREncoding.Encode(packet)
+		So(err, ShouldBeNil)
+		So(len(data), ShouldBeLessThan, len(jsonData))
+
+		decoded, err := CBOREncoding.Decode(data)
+		So(err, ShouldBeNil)
+		So(decoded.Type, ShouldEqual, SnapshotEventType)
+		payload, err := decoded.Payload()
+		So(err, ShouldBeNil)
+		So(payload, ShouldResemble, event)
+	})
+}
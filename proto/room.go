@@ -44,6 +44,76 @@ func (l Listing) Less(i, j int) bool {
 	return l[i].Name < l[j].Name
 }
 
+// DefaultSnapshotMessages is the number of messages included in a snapshot
+// unless the client asks for fewer.
+const DefaultSnapshotMessages = 100
+
+// SnapshotOptions control the size of a snapshot, for clients joining rooms
+// too busy to list in full.
+type SnapshotOptions struct {
+	// NumMessages is the number of recent messages to include in the log.
+	NumMessages int
+
+	// MaxListing, if positive, caps the number of sessions in the listing.
+	MaxListing int
+
+	// CountsOnly replaces the listing with counts of sessions.
+	CountsOnly bool
+}
+
+// DefaultSnapshotOptions returns the options for a full snapshot.
+func DefaultSnapshotOptions() SnapshotOptions {
+	return SnapshotOptions{NumMessages: DefaultSnapshotMessages}
+}
+
+// ListingCounts summarizes a listing that was truncated or omitted from a
+// snapshot.
+type ListingCounts struct {
+	Sessions int `json:"sessions"` // the number of other sessions in the room
+	Lurkers  int `json:"lurkers"`  // how many of those sessions have no nick
+	Bots     int `json:"bots"`     // how many of those sessions are bots
+}
+
+// ReduceListing applies the options to a full, sorted listing. If the
+// listing is cut short, counts describing the full listing are returned too.
+// Sessions with nicks are kept in preference to lurkers.
+func (opts SnapshotOptions) ReduceListing(listing Listing) (Listing, *ListingCounts) {
+	if !opts.CountsOnly && (opts.MaxListing <= 0 || len(listing) <= opts.MaxListing) {
+		return listing, nil
+	}
+
+	counts := &ListingCounts{Sessions: len(listing)}
+	named := make(Listing, 0, len(listing))
+	for _, view := range listing {
+		if kind, _ := view.ID.Parse(); kind == "bot" {
+			counts.Bots++
+		}
+		if view.Name == "" {
+			counts.Lurkers++
+		} else {
+			named = append(named, view)
+		}
+	}
+
+	if opts.CountsOnly {
+		return Listing{}, counts
+	}
+	reduced := make(Listing, 0, opts.MaxListing)
+	reduced = append(reduced, named...)
+	for _, view := range listing {
+		if len(reduced) >= opts.MaxListing {
+			break
+		}
+		if view.Name == "" {
+			reduced = append(reduced, view)
+		}
+	}
+	if len(reduced) > opts.MaxListing {
+		reduced = reduced[:opts.MaxListing]
+	}
+	return reduced, counts
+}
+
 // A Room is a nexus of communication. Users connect to a Room via
 // Session and interact.
 type Room interface {
@@ -51,7 +121,7 @@ type Room interface {
 	Title() string
 	GetMessage(scope.Context, snowflake.Snowflake) (*Message, error)
 	Latest(scope.Context, int, snowflake.Snowflake) ([]Message, error)
-	Snapshot(ctx scope.Context, session Session, level PrivilegeLevel, numMessages int) (*SnapshotEvent, error)
+	Snapshot(ctx scope.Context, session Session, level PrivilegeLevel, opts SnapshotOptions) (*SnapshotEvent, error)
 
 	// Join inserts a Session into the Room's global presence.
 	Join(scope.Context, Session) (virtualClientAddr string, err error)
@@ -97,15 +167,32 @@ type ManagedRoom interface {
 	// UnbanAgent removes an agent ban from the room.
 	Unban(ctx scope.Context, ban Ban) error
 
+	// Disconnect sends a disconnect-event with the given reason to every
+	// session in the room except those excluded, so that they must
+	// authenticate again to rejoin.
+	Disconnect(ctx scope.Context, reason string, exclude ...Session) error
+
 	// GenerateMessageKey generates and stores a new key and nonce
 	// for encrypting messages in the room. This invalidates all grants made with
 	// the previous key.
 	GenerateMessageKey(ctx scope.Context, kms security.KMS) (RoomMessageKey, error)
 
+	// ReplaceMessageKey generates and stores a new message key for the room,
+	// passing it to grant before it becomes current. If grant returns an
+	// error, the new key and any grants made of it are discarded and the
+	// current key is left in place.
+	ReplaceMessageKey(
+		ctx scope.Context, kms security.KMS, grant func(RoomMessageKey) error) (RoomMessageKey, error)
+
 	// MessageKey returns the room's current message key, or nil if the room is
 	// unencrypted.
 	MessageKey(ctx scope.Context) (RoomMessageKey, error)
 
+	// MessageKeyHistory returns every message key the room has had, newest
+	// first. Messages sent before the key was last rotated can only be
+	// decrypted with the key they name in their EncryptionKeyID.
+	MessageKeyHistory(ctx scope.Context) ([]RoomMessageKey, error)
+
 	// ManagerKey returns a handle to the room's manager key.
 	ManagerKey(ctx scope.Context) (RoomManagerKey, error)
 
@@ -146,6 +233,10 @@ type RoomMessageKey interface {
 
 	// ManagedKey returns the current encrypted ManagedKey for the room.
 	ManagedKey() security.ManagedKey
+
+	// AccountHolders returns the accounts that hold a grant of the key.
+	// Passcode grants can't be listed.
+	AccountHolders(ctx scope.Context) ([]Account, error)
 }
 
 type RoomManagerKey interface {
@@ -261,3 +352,69 @@ func (sec *RoomSecurity) Unlock(managerKey *security.ManagedKey) (*security.Mana
 
 	return &kp, nil
 }
+
+// RotateMessageKey replaces the message key of a private room, so that grants
+// revoked from the old key don't carry over to messages sent from now on. The
+// new key is granted to every account holding the old one, under the authority
+// of the given manager. Passcode grants can't be re-granted without knowing the
+// passcode, so they're carried forward when the passcode is next used (see
+// Client.AuthenticateWithPasscode). If any grant fails, the old key stays
+// current.
+func RotateMessageKey(
+	ctx scope.Context, kms security.KMS, room ManagedRoom, manager Account,
+	managerKey *security.ManagedKey) (RoomMessageKey, error) {
+
+	oldKey, err := room.MessageKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if oldKey == nil {
+		return nil, fmt.Errorf("room is public")
+	}
+
+	holders, err := oldKey.AccountHolders(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return room.ReplaceMessageKey(ctx, kms, func(newKey RoomMessageKey) error {
+		// The manager needs a grant of the new key before granting it to
+		// anyone else.
+		if err := newKey.StaffGrantToAccount(ctx, kms, manager); err != nil {
+			return fmt.Errorf("grant to manager: %s", err)
+		}
+		for _, holder := range holders {
+			if holder.ID() == manager.ID() {
+				continue
+			}
+			if err := newKey.GrantToAccount(ctx, kms, manager, managerKey, holder); err != nil {
+				return fmt.Errorf("grant to account %s: %s", holder.ID(), err)
+			}
+		}
+		return nil
+	})
+}
+
+// RevokePasscode revokes a passcode's grants of all of a room's message keys,
+// so that it can't be carried forward to a rotated key.
+func RevokePasscode(ctx scope.Context, room ManagedRoom, passcode string) error {
+	keys, err := room.MessageKeyHistory(ctx)
+	if err != nil {
+		return err
+	}
+
+	revoked := false
+	for _, key := range keys {
+		switch err := key.RevokeFromPasscode(ctx, passcode); err {
+		case nil:
+			revoked = true
+		case ErrCapabilityNotFound:
+		default:
+			return err
+		}
+	}
+	if !revoked {
+		return ErrCapabilityNotFound
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package proto
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestReduceListing(t *testing.T) {
+	view := func(id UserID, name string) SessionView {
+		return SessionView{IdentityView: IdentityView{ID: id, Name: name}, SessionID: string(id)}
+	}
+	listing := Listing{
+		view("agent:a", ""),
+		view("bot:b", "bot"),
+		view("agent:c", "carol"),
+		view("bot:d", ""),
+	}
+	counts := &ListingCounts{Sessions: 4, Lurkers: 2, Bots: 2}
+
+	Convey("Full snapshots are unchanged", t, func() {
+		reduced, c := DefaultSnapshotOptions().ReduceListing(listing)
+		So(reduced, ShouldResemble, listing)
+		So(c, ShouldBeNil)
+
+		reduced, c = SnapshotOptions{MaxListing: 4}.ReduceListing(listing)
+		So(reduced, ShouldResemble, listing)
+		So(c, ShouldBeNil)
+	})
+
+	Convey("Truncated listings prefer sessions with nicks", t, func() {
+		reduced, c := SnapshotOptions{MaxListing: 3}.ReduceListing(listing)
+		So(reduced, ShouldResemble, Listing{listing[1], listing[2], listing[0]})
+		So(c, ShouldResemble, counts)
+
+		reduced, c = SnapshotOptions{MaxListing: 1}.ReduceListing(listing)
+		So(reduced, ShouldResemble, Listing{listing[1]})
+		So(c, ShouldResemble, counts)
+	})
+
+	Convey("Counts only", t, func() {
+		reduced, c := SnapshotOptions{CountsOnly: true}.ReduceListing(listing)
+		So(reduced, ShouldResemble, Listing{})
+		So(c, ShouldResemble, counts)
+	})
+}
@@ -1,12 +1,15 @@
 package security
 
 import (
+	"bytes"
 	"crypto/hmac"
 	"crypto/md5"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"reflect"
 )
@@ -50,22 +53,51 @@ type KMS interface {
 	DecryptKey(*ManagedKey) error
 }
 
+// A RotatingKMS is a KMS whose master key can be replaced while keys wrapped
+// under earlier versions of it remain decryptable.
+type RotatingKMS interface {
+	KMS
+
+	// KeyVersion identifies the version of the master key that new keys are
+	// wrapped under, or is empty if the version can't be determined.
+	KeyVersion() string
+
+	// RewrapKey re-encrypts an encrypted key under the current version of the
+	// master key, without exposing its plaintext. It returns false and leaves
+	// the key unchanged if it's already wrapped under the current version.
+	RewrapKey(*ManagedKey) (bool, error)
+}
+
 const mockCipher = AES256
 
 type MockKMS interface {
-	KMS
+	RotatingKMS
 
 	KMSCredential() KMSCredential
 	MasterKey() []byte
 	SetMasterKey([]byte)
+
+	// RotateMasterKey makes the given key the next version of the master key.
+	// The previous version is kept for decryption.
+	RotateMasterKey([]byte)
 }
 
 func LocalKMS() MockKMS                        { return LocalKMSWithRNG(rand.Reader) }
 func LocalKMSWithRNG(random io.Reader) MockKMS { return &localKMS{random: random} }
 
+// Keys wrapped under version 0 of the local master key have no header, so
+// that keys made before versioning was introduced remain valid. Later versions
+// prefix the ciphertext with localKeyVersionTag and a big-endian uint32.
+const (
+	localKeyVersionTag    = 'v'
+	localKeyVersionHeader = 5
+)
+
 type localKMS struct {
 	random    io.Reader
 	masterKey []byte
+	version   uint32
+	previous  map[uint32][]byte
 }
 
 func (kms *localKMS) KMSType() KMSType             { return LocalKMSType }
@@ -73,6 +105,18 @@ func (kms *localKMS) KMS() KMS                     { return kms }
 func (kms *localKMS) KMSCredential() KMSCredential { return kms }
 func (kms *localKMS) MasterKey() []byte            { return kms.masterKey }
 func (kms *localKMS) SetMasterKey(key []byte)      { kms.masterKey = key }
+func (kms *localKMS) KeyVersion() string           { return fmt.Sprintf("%d", kms.version) }
+
+func (kms *localKMS) RotateMasterKey(key []byte) {
+	if kms.masterKey != nil {
+		if kms.previous == nil {
+			kms.previous = map[uint32][]byte{}
+		}
+		kms.previous[kms.version] = kms.masterKey
+		kms.version++
+	}
+	kms.masterKey = key
+}
 
 func (kms *localKMS) GenerateNonce(bytes int) ([]byte, error) {
 	nonce := make([]byte, bytes)
@@ -95,7 +139,7 @@ func (kms *localKMS) GenerateEncryptedKey(keyType KeyType, ctxKey, ctxVal string
 		ContextKey:   ctxKey,
 		ContextValue: ctxVal,
 	}
-	if err := kms.xorKey(mkey); err != nil {
+	if err := kms.xorKey(mkey, kms.version); err != nil {
 		return nil, err
 	}
 
@@ -106,14 +150,63 @@ func (kms *localKMS) DecryptKey(mkey *ManagedKey) error {
 	if !mkey.Encrypted() {
 		return ErrKeyMustBeEncrypted
 	}
-	return kms.xorKey(mkey)
+	version, err := kms.keyVersion(mkey)
+	if err != nil {
+		return err
+	}
+	return kms.xorKey(mkey, version)
+}
+
+func (kms *localKMS) RewrapKey(mkey *ManagedKey) (bool, error) {
+	if !mkey.Encrypted() {
+		return false, ErrKeyMustBeEncrypted
+	}
+	dup := mkey.Clone()
+	version, err := kms.keyVersion(&dup)
+	if err != nil {
+		return false, err
+	}
+	if version == kms.version {
+		return false, nil
+	}
+
+	if err := kms.xorKey(&dup, version); err != nil {
+		return false, err
+	}
+	if err := kms.xorKey(&dup, kms.version); err != nil {
+		return false, err
+	}
+	mkey.Ciphertext = dup.Ciphertext
+	return true, nil
 }
 
-func (kms *localKMS) xorKey(mkey *ManagedKey) error {
+// keyVersion returns the version of the master key an encrypted key was
+// wrapped under, and strips the version header from its ciphertext.
+func (kms *localKMS) keyVersion(mkey *ManagedKey) (uint32, error) {
+	if len(mkey.Ciphertext) != mkey.KeySize()+sha256.Size+localKeyVersionHeader {
+		return 0, nil
+	}
+	if mkey.Ciphertext[0] != localKeyVersionTag {
+		return 0, ErrInvalidKey
+	}
+	version := binary.BigEndian.Uint32(mkey.Ciphertext[1:localKeyVersionHeader])
+	mkey.Ciphertext = mkey.Ciphertext[localKeyVersionHeader:]
+	return version, nil
+}
+
+func (kms *localKMS) xorKey(mkey *ManagedKey, version uint32) error {
 	if kms.masterKey == nil {
 		return ErrNoMasterKey
 	}
 
+	masterKey := kms.masterKey
+	if version != kms.version {
+		var ok bool
+		if masterKey, ok = kms.previous[version]; !ok {
+			return fmt.Errorf("no master key for version %d", version)
+		}
+	}
+
 	// Generate IV from md5 hash of context.
 	hash := md5.New()
 	hash.Write([]byte(mkey.ContextKey))
@@ -126,7 +219,7 @@ func (kms *localKMS) xorKey(mkey *ManagedKey) error {
 		}
 		macsum := mkey.Ciphertext[:sha256.Size]
 		data := mkey.Ciphertext[sha256.Size:]
-		mockCipher.BlockCrypt(iv, kms.masterKey, data, true)
+		mockCipher.BlockCrypt(iv, masterKey, data, true)
 		mac := hmac.New(sha256.New, data)
 		mac.Write([]byte(mkey.ContextKey))
 		mac.Write([]byte(mkey.ContextValue))
@@ -142,19 +235,48 @@ func (kms *localKMS) xorKey(mkey *ManagedKey) error {
 		mac.Write([]byte(mkey.ContextValue))
 		macsum := mac.Sum(nil)
 		data := mkey.Plaintext
-		mockCipher.BlockCrypt(iv, kms.masterKey, data, false)
+		mockCipher.BlockCrypt(iv, masterKey, data, false)
 		mkey.Plaintext = nil
 		mkey.Ciphertext = append(macsum, data...)
+		if version > 0 {
+			header := make([]byte, localKeyVersionHeader)
+			header[0] = localKeyVersionTag
+			binary.BigEndian.PutUint32(header[1:], version)
+			mkey.Ciphertext = append(header, mkey.Ciphertext...)
+		}
 	}
 
 	return nil
 }
 
-func (kms *localKMS) MarshalJSON() ([]byte, error) { return json.Marshal(kms.masterKey) }
+// localKMSCredential is the encoding of a local KMS credential whose master
+// key has been rotated. Unrotated credentials are encoded as just the key.
+type localKMSCredential struct {
+	MasterKey []byte            `json:"master_key"`
+	Version   uint32            `json:"version"`
+	Previous  map[uint32][]byte `json:"previous"`
+}
+
+func (kms *localKMS) MarshalJSON() ([]byte, error) {
+	if kms.version == 0 {
+		return json.Marshal(kms.masterKey)
+	}
+	return json.Marshal(localKMSCredential{kms.masterKey, kms.version, kms.previous})
+}
 
 func (kms *localKMS) UnmarshalJSON(data []byte) error {
 	kms.random = rand.Reader
-	return json.Unmarshal(data, &kms.masterKey)
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return json.Unmarshal(data, &kms.masterKey)
+	}
+	var cred localKMSCredential
+	if err := json.Unmarshal(data, &cred); err != nil {
+		return err
+	}
+	kms.masterKey = cred.MasterKey
+	kms.version = cred.Version
+	kms.previous = cred.Previous
+	return nil
 }
 
 func init() {
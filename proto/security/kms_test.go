@@ -116,4 +116,66 @@ func TestLocalKMS(t *testing.T) {
 		mkey.Ciphertext = append(mkey.Ciphertext, mkey.Ciphertext...)
 		So(kms.DecryptKey(mkey), ShouldEqual, ErrInvalidKey)
 	})
+
+	Convey("Rotated master key", t, func() {
+		kms := LocalKMS()
+		kms.SetMasterKey(make([]byte, mockCipher.KeySize()))
+		So(kms.KeyVersion(), ShouldEqual, "0")
+
+		oldKey, err := kms.GenerateEncryptedKey(AES128, "room", "test")
+		So(err, ShouldBeNil)
+		oldPlain := oldKey.Clone()
+		So(kms.DecryptKey(&oldPlain), ShouldBeNil)
+
+		newMaster := make([]byte, mockCipher.KeySize())
+		newMaster[0] = 1
+		kms.RotateMasterKey(newMaster)
+		So(kms.KeyVersion(), ShouldEqual, "1")
+
+		Convey("New keys are versioned", func() {
+			mkey, err := kms.GenerateEncryptedKey(AES128, "room", "test")
+			So(err, ShouldBeNil)
+			So(len(mkey.Ciphertext), ShouldEqual, AES128.KeySize()+sha256.Size+localKeyVersionHeader)
+			So(kms.DecryptKey(mkey), ShouldBeNil)
+			So(len(mkey.Plaintext), ShouldEqual, AES128.KeySize())
+		})
+
+		Convey("Old keys remain decryptable", func() {
+			mkey := oldKey.Clone()
+			So(kms.DecryptKey(&mkey), ShouldBeNil)
+			So(mkey.Plaintext, ShouldResemble, oldPlain.Plaintext)
+		})
+
+		Convey("Old keys can be rewrapped once", func() {
+			mkey := oldKey.Clone()
+			changed, err := kms.RewrapKey(&mkey)
+			So(err, ShouldBeNil)
+			So(changed, ShouldBeTrue)
+			So(mkey.Encrypted(), ShouldBeTrue)
+			So(mkey.Ciphertext, ShouldNotResemble, oldKey.Ciphertext)
+
+			rewrapped := mkey.Clone()
+			changed, err = kms.RewrapKey(&mkey)
+			So(err, ShouldBeNil)
+			So(changed, ShouldBeFalse)
+			So(mkey.Ciphertext, ShouldResemble, rewrapped.Ciphertext)
+
+			So(kms.DecryptKey(&mkey), ShouldBeNil)
+			So(mkey.Plaintext, ShouldResemble, oldPlain.Plaintext)
+		})
+
+		Convey("Credentials carry every version", func() {
+			data, err := kms.KMSCredential().MarshalJSON()
+			So(err, ShouldBeNil)
+
+			cred, err := LocalKMSType.KMSCredential()
+			So(err, ShouldBeNil)
+			So(cred.UnmarshalJSON(data), ShouldBeNil)
+			So(cred.KMS().(RotatingKMS).KeyVersion(), ShouldEqual, "1")
+
+			mkey := oldKey.Clone()
+			So(cred.KMS().DecryptKey(&mkey), ShouldBeNil)
+			So(mkey.Plaintext, ShouldResemble, oldPlain.Plaintext)
+		})
+	})
 }
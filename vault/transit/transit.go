@@ -0,0 +1,292 @@
+// Package transit implements security.KMS with the transit secrets engine of
+// HashiCorp Vault.
+//
+// Data keys are generated by Vault and never leave it unencrypted except in
+// response to a decrypt request. The encryption context of each key is passed
+// to Vault as a key derivation context, so the named transit key must be
+// created with derivation enabled:
+//
+//	vault write transit/keys/heim derived=true
+//
+// The transit key may be rotated in Vault. Data keys wrapped under earlier
+// versions of it remain decryptable, and RewrapKey moves them to the latest
+// version without their plaintext leaving Vault.
+package transit
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"euphoria.io/heim/proto/security"
+)
+
+const (
+	VaultKMSType = security.KMSType("vault")
+
+	DefaultMount = "transit"
+)
+
+func init() {
+	security.RegisterKMSType(VaultKMSType, &KMSCredential{})
+}
+
+// Config locates a transit key in Vault, and the token to use it with.
+type Config struct {
+	// Address is the base URL of the Vault server. Defaults to $VAULT_ADDR.
+	Address string `json:"address" yaml:"address"`
+
+	// Token authenticates requests. Defaults to $VAULT_TOKEN.
+	Token string `json:"token,omitempty" yaml:"token,omitempty"`
+
+	// Namespace is the Vault Enterprise namespace of the mount, if any.
+	Namespace string `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+
+	// Mount is the path the transit engine is mounted at. Defaults to
+	// DefaultMount.
+	Mount string `json:"mount,omitempty" yaml:"mount,omitempty"`
+
+	// KeyName names the transit key that data keys are wrapped with.
+	KeyName string `json:"key_name" yaml:"key-name"`
+}
+
+func New(cfg Config) (*KMS, error) {
+	if cfg.Address == "" {
+		cfg.Address = os.Getenv("VAULT_ADDR")
+	}
+	if cfg.Token == "" {
+		cfg.Token = os.Getenv("VAULT_TOKEN")
+	}
+	if cfg.Mount == "" {
+		cfg.Mount = DefaultMount
+	}
+
+	switch {
+	case cfg.Address == "":
+		return nil, fmt.Errorf("vault kms: address must be specified")
+	case cfg.KeyName == "":
+		return nil, fmt.Errorf("vault kms: key name must be specified")
+	}
+
+	kms := &KMS{
+		client: &http.Client{Timeout: 30 * time.Second},
+		cfg:    cfg,
+	}
+	return kms, nil
+}
+
+type KMS struct {
+	client *http.Client
+	cfg    Config
+}
+
+type errorResponse struct {
+	Errors []string `json:"errors"`
+}
+
+// call makes a request to the transit engine and decodes the data of its
+// response. A nil req makes a GET request; otherwise req is posted.
+func (k *KMS) call(path string, req, data interface{}) error {
+	url := fmt.Sprintf("%s/v1/%s/%s",
+		strings.TrimRight(k.cfg.Address, "/"), strings.Trim(k.cfg.Mount, "/"), path)
+	method, body := "GET", io.Reader(nil)
+	if req != nil {
+		encoded, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		method, body = "POST", bytes.NewReader(encoded)
+	}
+	hreq, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	hreq.Header.Set("X-Vault-Token", k.cfg.Token)
+	if k.cfg.Namespace != "" {
+		hreq.Header.Set("X-Vault-Namespace", k.cfg.Namespace)
+	}
+
+	resp, err := k.client.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var errResp errorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&errResp); err == nil && len(errResp.Errors) > 0 {
+			return fmt.Errorf("%s: %s", resp.Status, strings.Join(errResp.Errors, "; "))
+		}
+		return fmt.Errorf("%s", resp.Status)
+	}
+
+	envelope := struct {
+		Data interface{} `json:"data"`
+	}{data}
+	return json.NewDecoder(resp.Body).Decode(&envelope)
+}
+
+// derivationContext encodes an encryption context for Vault.
+func derivationContext(ctxKey, ctxVal string) string {
+	return base64.StdEncoding.EncodeToString([]byte(ctxKey + "\x00" + ctxVal))
+}
+
+func (k *KMS) GenerateNonce(bytes int) ([]byte, error) {
+	var data struct {
+		RandomBytes []byte `json:"random_bytes"`
+	}
+	req := map[string]string{"format": "base64"}
+	if err := k.call(fmt.Sprintf("random/%d", bytes), req, &data); err != nil {
+		return nil, fmt.Errorf("vault kms: error generating nonce of %d bytes: %s", bytes, err)
+	}
+	if len(data.RandomBytes) != bytes {
+		return nil, fmt.Errorf("vault kms: expected nonce of %d bytes, got %d", bytes, len(data.RandomBytes))
+	}
+	return data.RandomBytes, nil
+}
+
+func (k *KMS) GenerateEncryptedKey(keyType security.KeyType, ctxKey, ctxVal string) (
+	*security.ManagedKey, error) {
+
+	var bits int
+	switch keyType {
+	case security.AES128:
+		bits = 128
+	case security.AES256:
+		bits = 256
+	default:
+		return nil, fmt.Errorf("vault kms: key type %s not supported", keyType)
+	}
+
+	var data struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	req := map[string]interface{}{
+		"bits":    bits,
+		"context": derivationContext(ctxKey, ctxVal),
+	}
+	if err := k.call("datakey/wrapped/"+k.cfg.KeyName, req, &data); err != nil {
+		return nil, fmt.Errorf("vault kms: error generating data key of type %s: %s", keyType, err)
+	}
+
+	mkey := &security.ManagedKey{
+		KeyType:      keyType,
+		Ciphertext:   []byte(data.Ciphertext),
+		ContextKey:   ctxKey,
+		ContextValue: ctxVal,
+	}
+	return mkey, nil
+}
+
+func (k *KMS) DecryptKey(key *security.ManagedKey) error {
+	if !key.Encrypted() {
+		return fmt.Errorf("vault kms: key is already decrypted")
+	}
+
+	var data struct {
+		Plaintext []byte `json:"plaintext"`
+	}
+	req := map[string]string{
+		"ciphertext": string(key.Ciphertext),
+		"context":    derivationContext(key.ContextKey, key.ContextValue),
+	}
+	if err := k.call("decrypt/"+k.cfg.KeyName, req, &data); err != nil {
+		return fmt.Errorf("vault kms: error decrypting data key: %s", err)
+	}
+	key.Plaintext = data.Plaintext
+	key.Ciphertext = nil
+	return nil
+}
+
+// KeyVersion returns the latest version of the transit key, as Vault numbers
+// it. It returns an empty string if Vault can't be asked.
+func (k *KMS) KeyVersion() string {
+	var data struct {
+		LatestVersion int `json:"latest_version"`
+	}
+	if err := k.call("keys/"+k.cfg.KeyName, nil, &data); err != nil {
+		return ""
+	}
+	return strconv.Itoa(data.LatestVersion)
+}
+
+// RewrapKey has Vault re-encrypt a data key under the latest version of the
+// transit key.
+func (k *KMS) RewrapKey(key *security.ManagedKey) (bool, error) {
+	if !key.Encrypted() {
+		return false, fmt.Errorf("vault kms: key must be encrypted")
+	}
+
+	var data struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	req := map[string]string{
+		"ciphertext": string(key.Ciphertext),
+		"context":    derivationContext(key.ContextKey, key.ContextValue),
+	}
+	if err := k.call("rewrap/"+k.cfg.KeyName, req, &data); err != nil {
+		return false, fmt.Errorf("vault kms: error rewrapping data key: %s", err)
+	}
+
+	// Vault rewraps even a current key with a fresh nonce, so compare the
+	// version prefixes to tell whether anything changed.
+	if ciphertextVersion(data.Ciphertext) == ciphertextVersion(string(key.Ciphertext)) {
+		return false, nil
+	}
+	key.Ciphertext = []byte(data.Ciphertext)
+	return true, nil
+}
+
+// ciphertextVersion returns the "vault:vN" prefix of a transit ciphertext.
+func ciphertextVersion(ciphertext string) string {
+	if i := strings.LastIndex(ciphertext, ":"); i >= 0 {
+		return ciphertext[:i]
+	}
+	return ""
+}
+
+// A KMSCredential grants access to a transit key, e.g. for a staff member.
+type KMSCredential struct {
+	Config
+}
+
+func (c *KMSCredential) KMS() security.KMS {
+	kms, err := New(c.Config)
+	if err != nil {
+		return &invalidKMS{err}
+	}
+	return kms
+}
+
+func (c *KMSCredential) KMSType() security.KMSType    { return VaultKMSType }
+func (c *KMSCredential) MarshalJSON() ([]byte, error) { return json.Marshal(c.Config) }
+
+func (c *KMSCredential) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, &c.Config)
+}
+
+// invalidKMS stands in for a KMS that couldn't be configured, failing every
+// operation with the configuration error.
+type invalidKMS struct {
+	err error
+}
+
+func (k *invalidKMS) GenerateNonce(int) ([]byte, error) { return nil, k.err }
+
+func (k *invalidKMS) GenerateEncryptedKey(security.KeyType, string, string) (*security.ManagedKey, error) {
+	return nil, k.err
+}
+
+func (k *invalidKMS) DecryptKey(*security.ManagedKey) error { return k.err }
+
+func (k *invalidKMS) KeyVersion() string { return "" }
+
+func (k *invalidKMS) RewrapKey(*security.ManagedKey) (bool, error) { return false, k.err }
@@ -0,0 +1,295 @@
+package transit
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"euphoria.io/heim/proto/security"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const testToken = "s.test"
+
+// testVault stands in for the transit engine of a Vault server, with derived
+// keys only. Each key is a list of versions, the latest last.
+type testVault struct {
+	keys map[string][][]byte
+}
+
+func (v *testVault) fail(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Errors: []string{fmt.Sprintf(format, args...)}})
+}
+
+func (v *testVault) reply(w http.ResponseWriter, data interface{}) {
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+}
+
+func (v *testVault) aead(name string, version int, context string) (cipher.AEAD, error) {
+	versions, ok := v.keys[name]
+	if !ok {
+		return nil, fmt.Errorf("encryption key not found")
+	}
+	if version < 1 || version > len(versions) {
+		return nil, fmt.Errorf("invalid key version")
+	}
+	master := versions[version-1]
+	ctx, err := base64.StdEncoding.DecodeString(context)
+	if err != nil || len(ctx) == 0 {
+		return nil, fmt.Errorf("missing 'context' for key derivation")
+	}
+	mac := hmac.New(sha256.New, master)
+	mac.Write(ctx)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext under the latest version of the named key.
+func (v *testVault) seal(name, context string, plaintext []byte) (string, error) {
+	version := len(v.keys[name])
+	aead, err := v.aead(name, version, context)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	sealed := aead.Seal(nonce, nonce, plaintext, nil)
+	return fmt.Sprintf("vault:v%d:%s", version, base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// open decrypts a ciphertext under the version of the named key it names.
+func (v *testVault) open(name, context, ciphertext string) ([]byte, error) {
+	parts := strings.SplitN(ciphertext, ":", 3)
+	if len(parts) != 3 || parts[0] != "vault" || !strings.HasPrefix(parts[1], "v") {
+		return nil, fmt.Errorf("invalid ciphertext")
+	}
+	version, err := strconv.Atoi(parts[1][1:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid ciphertext")
+	}
+	aead, err := v.aead(name, version, context)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("invalid ciphertext")
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("cipher: message authentication failed")
+	}
+	return plaintext, nil
+}
+
+func (v *testVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Vault-Token") != testToken {
+		v.fail(w, http.StatusForbidden, "permission denied")
+		return
+	}
+
+	var req struct {
+		Bits       int    `json:"bits"`
+		Context    string `json:"context"`
+		Ciphertext string `json:"ciphertext"`
+		Format     string `json:"format"`
+	}
+	if r.Method == "POST" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			v.fail(w, http.StatusBadRequest, "%s", err)
+			return
+		}
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/transit/"), "/")
+	switch {
+	case len(parts) == 2 && parts[0] == "keys" && r.Method == "GET":
+		versions, ok := v.keys[parts[1]]
+		if !ok {
+			v.fail(w, http.StatusNotFound, "")
+			return
+		}
+		v.reply(w, map[string]interface{}{"latest_version": len(versions)})
+	case len(parts) == 2 && parts[0] == "random":
+		n, _ := strconv.Atoi(parts[1])
+		random := make([]byte, n)
+		rand.Read(random)
+		v.reply(w, map[string]interface{}{"random_bytes": random})
+	case len(parts) == 3 && parts[0] == "datakey" && parts[1] == "wrapped":
+		if req.Bits != 128 && req.Bits != 256 && req.Bits != 512 {
+			v.fail(w, http.StatusBadRequest, "invalid bit size")
+			return
+		}
+		key := make([]byte, req.Bits/8)
+		rand.Read(key)
+		ciphertext, err := v.seal(parts[2], req.Context, key)
+		if err != nil {
+			v.fail(w, http.StatusBadRequest, "%s", err)
+			return
+		}
+		v.reply(w, map[string]string{"ciphertext": ciphertext})
+	case len(parts) == 2 && parts[0] == "decrypt":
+		plaintext, err := v.open(parts[1], req.Context, req.Ciphertext)
+		if err != nil {
+			v.fail(w, http.StatusBadRequest, "%s", err)
+			return
+		}
+		v.reply(w, map[string]interface{}{"plaintext": plaintext})
+	case len(parts) == 2 && parts[0] == "rewrap":
+		plaintext, err := v.open(parts[1], req.Context, req.Ciphertext)
+		if err != nil {
+			v.fail(w, http.StatusBadRequest, "%s", err)
+			return
+		}
+		ciphertext, err := v.seal(parts[1], req.Context, plaintext)
+		if err != nil {
+			v.fail(w, http.StatusBadRequest, "%s", err)
+			return
+		}
+		v.reply(w, map[string]string{"ciphertext": ciphertext})
+	default:
+		v.fail(w, http.StatusNotFound, "no handler for route")
+	}
+}
+
+func TestKMS(t *testing.T) {
+	vault := &testVault{keys: map[string][][]byte{"heim": {[]byte("0123456789abcdef0123456789abcdef")}}}
+	server := httptest.NewServer(vault)
+	defer server.Close()
+
+	kms, err := New(Config{Address: server.URL, Token: testToken, KeyName: "heim"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("GenerateNonce", t, func() {
+		nonce, err := kms.GenerateNonce(20)
+		So(err, ShouldBeNil)
+		So(len(nonce), ShouldEqual, 20)
+	})
+
+	Convey("GenerateEncryptedKey and Decrypt", t, func() {
+		Convey("AES-256", func() {
+			key, err := kms.GenerateEncryptedKey(security.AES256, "room", "test")
+			So(err, ShouldBeNil)
+			So(key.Encrypted(), ShouldBeTrue)
+			So(string(key.Ciphertext), ShouldStartWith, "vault:v1:")
+
+			So(kms.DecryptKey(key), ShouldBeNil)
+			So(key.Encrypted(), ShouldBeFalse)
+			So(len(key.Plaintext), ShouldEqual, security.AES256.KeySize())
+			So(key.ContextKey, ShouldEqual, "room")
+			So(key.ContextValue, ShouldEqual, "test")
+		})
+
+		Convey("AES-128", func() {
+			key, err := kms.GenerateEncryptedKey(security.AES128, "room", "test")
+			So(err, ShouldBeNil)
+
+			So(kms.DecryptKey(key), ShouldBeNil)
+			So(len(key.Plaintext), ShouldEqual, security.AES128.KeySize())
+		})
+
+		Convey("Invalid key type", func() {
+			key, err := kms.GenerateEncryptedKey(security.KeyType(255), "room", "test")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "vault kms: key type 255 not supported")
+			So(key, ShouldBeNil)
+		})
+
+		Convey("Key already decrypted", func() {
+			err := kms.DecryptKey(&security.ManagedKey{Plaintext: []byte{0}})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "vault kms: key is already decrypted")
+		})
+
+		Convey("Context must match", func() {
+			key, err := kms.GenerateEncryptedKey(security.AES256, "room", "test")
+			So(err, ShouldBeNil)
+			key.ContextValue = "other"
+			err = kms.DecryptKey(key)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual,
+				"vault kms: error decrypting data key: 400 Bad Request: cipher: message authentication failed")
+		})
+	})
+
+	Convey("Keys are rewrapped after the transit key is rotated", t, func() {
+		var rotating security.RotatingKMS = kms
+		So(rotating.KeyVersion(), ShouldEqual, "1")
+
+		key, err := kms.GenerateEncryptedKey(security.AES256, "room", "rotated")
+		So(err, ShouldBeNil)
+		changed, err := kms.RewrapKey(key)
+		So(err, ShouldBeNil)
+		So(changed, ShouldBeFalse)
+		So(string(key.Ciphertext), ShouldStartWith, "vault:v1:")
+
+		vault.keys["heim"] = append(vault.keys["heim"], []byte("fedcba9876543210fedcba9876543210"))
+		defer func() { vault.keys["heim"] = vault.keys["heim"][:1] }()
+		So(kms.KeyVersion(), ShouldEqual, "2")
+
+		changed, err = kms.RewrapKey(key)
+		So(err, ShouldBeNil)
+		So(changed, ShouldBeTrue)
+		So(string(key.Ciphertext), ShouldStartWith, "vault:v2:")
+		So(kms.DecryptKey(key), ShouldBeNil)
+		So(len(key.Plaintext), ShouldEqual, security.AES256.KeySize())
+
+		_, err = kms.RewrapKey(key)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, "vault kms: key must be encrypted")
+	})
+
+	Convey("Errors from Vault are reported", t, func() {
+		bad, err := New(Config{Address: server.URL, Token: "wrong", KeyName: "heim"})
+		So(err, ShouldBeNil)
+		_, err = bad.GenerateNonce(8)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual,
+			"vault kms: error generating nonce of 8 bytes: 403 Forbidden: permission denied")
+
+		missing, err := New(Config{Address: server.URL, Token: testToken, KeyName: "missing"})
+		So(err, ShouldBeNil)
+		_, err = missing.GenerateEncryptedKey(security.AES256, "room", "test")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Configuration is validated", t, func() {
+		_, err := New(Config{Address: server.URL})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, "vault kms: key name must be specified")
+	})
+
+	Convey("Credentials round-trip through JSON", t, func() {
+		cred, err := VaultKMSType.KMSCredential()
+		So(err, ShouldBeNil)
+		So(cred.UnmarshalJSON([]byte(fmt.Sprintf(
+			`{"address":%q,"token":%q,"key_name":"heim"}`, server.URL, testToken))), ShouldBeNil)
+		So(cred.KMSType(), ShouldEqual, VaultKMSType)
+
+		key, err := cred.KMS().GenerateEncryptedKey(security.AES256, "account", "a")
+		So(err, ShouldBeNil)
+		So(kms.DecryptKey(key), ShouldBeNil)
+
+		data, err := cred.MarshalJSON()
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual,
+			fmt.Sprintf(`{"address":%q,"token":%q,"key_name":"heim"}`, server.URL, testToken))
+	})
+}